@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	applyNoBackup     bool
+	applyNoDiffPrompt bool
+	applyOnlyNew      bool
+	applyQuietShadows bool
+	applyTarget       string
+	applyExclude      []string
+	applyRecover      bool
+	applyRelative     bool
+	applyPrune        bool
+	applyInteractive  bool
+	applyReportOnly   bool
+	applyUser         string // User whose users/<name>/ layer to apply into their home
+)
+
+// applyCmd represents the apply command
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Apply dotfiles to this machine",
+	Long: `Link the dotfiles from common/, envs/<env>/ and machine/<hostname>/ into
+the home directory without pulling or pushing anything.
+
+With --only-new, files that already exist in the home directory (regular files
+or symlinks) are left untouched and only missing files are linked. This is
+useful when onboarding a machine that already has hand-tuned configs.
+
+A warning is logged for every file defined in more than one layer, since only
+the last layer's copy is applied. Use --no-shadow-warnings to silence it.
+
+With --target, the dotfiles are linked into another directory instead of the
+home directory, laid out as they would be in the home directory, for example
+to populate a container image or a test home. The symlinks still point into
+the dotpilot directory. Apply hooks don't run for another target.
+
+With --user <name>, the layer users/<name>/ is applied after the others, so
+it wins over them, into the home directory of that user, or into --target.
+This lets one repository provision several accounts, like your own and a
+service account. Run as root, the links and directories created there are
+handed to the user. The user needs read access to the repository for the
+links to resolve.
+
+With --prune-remote-deletions, tracked files whose repo file was deleted, for
+example on another machine, are cleaned up: their symlink is removed, a regular
+file that replaced it is moved to a .dotpilot.bak backup, and they are dropped
+from the tracking paths of ~/.dotpilotrc.
+
+With --skip-common, --skip-env or --skip-machine, that layer isn't applied
+this time. 'dotpilot layers disable' turns a layer off until it is enabled
+again.
+
+Targets matching a pattern in .dotpilotignore in the repository, or given
+with --exclude, are left out. Patterns are globs matched against the path
+relative to the home directory: a pattern without a slash matches the name
+at any depth, and excluding a directory excludes everything in it.
+
+With --relative, or "relative_symlinks": true in the options of
+~/.dotpilotrc, the symlinks are relative to their directory, like
+../.dotpilot/common/.bashrc, and keep working when the home directory and the
+repository are moved together. Existing links in either form are left as
+they are.
+
+Apply works out every change and asks its questions before touching
+anything, then records each change in a journal while it makes them. If
+one fails the changes made so far are rolled back. If dotpilot is killed
+halfway, the next apply refuses to run until 'dotpilot apply --recover' has
+rolled back the partial changes using the journal.
+
+With --interactive, every change is shown before it is made, whether linking a
+missing file, relinking a link into another layer or replacing a file, and
+can be applied or skipped, or its diff shown first. Quitting leaves
+everything untouched. With --yes every change is applied without asking.
+
+With --report-only, nothing is changed. Instead a JSON report gives the state
+of every target: in-sync when it links to the file of the layer that wins,
+drifted when it links to another file in the repository, like that of another
+layer, missing-link when nothing is there, and foreign when a regular file, a
+directory or a link out of the repository is in the way. The exit status is 1
+if any target isn't in sync, so the report can gate CI on each machine.
+
+For example:
+  dotpilot apply
+  dotpilot apply --only-new
+  dotpilot apply --interactive
+  dotpilot apply --target ./image/root
+  sudo dotpilot apply --user deploy
+  dotpilot apply --relative
+  dotpilot apply --skip-machine
+  dotpilot apply --prune-remote-deletions
+  dotpilot apply --exclude '.config/JetBrains' --exclude '*.local'
+  dotpilot apply --no-backup --no-diff-prompt
+  dotpilot apply --report-only
+  dotpilot apply --recover`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+
+		if applyReportOnly {
+			return reportApply(cmd, repo)
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+
+		if applyRecover {
+			undone, err := core.RecoverApply(repo.Dir)
+			if err != nil {
+				return withMessage(err, "Failed to recover the interrupted apply")
+			}
+			if undone == 0 {
+				utils.Logger.Info().Msg("No interrupted apply to roll back")
+			} else {
+				utils.Logger.Info().Msgf("Rolled back %d changes of the interrupted apply", undone)
+			}
+			return nil
+		}
+
+		if applyInteractive && utils.IsNonInteractive() {
+			return withMessage(fmt.Errorf("--interactive needs a terminal"), "Cannot review changes with --non-interactive")
+		}
+
+		// Get current environment
+		environment := repo.Environment()
+		if err := skipLayers(cmd); err != nil {
+			return err
+		}
+
+		opts := core.ApplyOptions{
+			Backup:       !applyNoBackup,
+			DiffPrompt:   !applyNoDiffPrompt,
+			OnlyNew:      applyOnlyNew,
+			QuietShadows: applyQuietShadows,
+			Target:       applyTarget,
+			Exclude:      applyExclude,
+			Relative:     applyRelative,
+			Prune:        applyPrune,
+			Interactive:  applyInteractive,
+			User:         applyUser,
+		}
+
+		utils.Logger.Info().Msgf("Applying configurations for environment %s...", environment)
+		if err := repo.Apply(opts); err != nil {
+			return withMessage(err, "Failed to apply configurations")
+		}
+
+		utils.Logger.Info().Msg("Configurations applied successfully!")
+		return nil
+	},
+}
+
+// reportApply prints the apply report for --report-only, and fails if any
+// target drifted
+func reportApply(cmd *cobra.Command, repo *core.Repository) error {
+	if applyRecover || applyInteractive || applyPrune {
+		return withMessage(fmt.Errorf("--report-only changes nothing"), "--report-only can't be used with --recover, --interactive or --prune-remote-deletions")
+	}
+
+	report, err := repo.ReportApply(core.ApplyOptions{Target: applyTarget, Exclude: applyExclude, Relative: applyRelative, User: applyUser})
+	if err != nil {
+		return withMessage(err, "Failed to work out the state of the targets")
+	}
+	if err := printJSON(cmd.OutOrStdout(), report); err != nil {
+		return withMessage(err, "Failed to encode the report")
+	}
+
+	if report.Drifted {
+		return fmt.Errorf("%d of %d targets aren't in sync", len(report.Targets)-report.Counts[core.StateInSync], len(report.Targets))
+	}
+	utils.Logger.Info().Msgf("All %d targets are in sync", len(report.Targets))
+	return nil
+}
+
+func init() {
+	applyCmd.Flags().BoolVar(&applyNoBackup, "no-backup", false, "Skip backing up files before overwriting")
+	applyCmd.Flags().BoolVar(&applyNoDiffPrompt, "no-diff-prompt", false, "Skip prompting for diffs before applying changes")
+	applyCmd.Flags().BoolVar(&applyOnlyNew, "only-new", false, "Only link files that don't exist yet, leaving existing files untouched")
+	applyCmd.Flags().BoolVar(&applyQuietShadows, "no-shadow-warnings", false, "Don't warn about files defined in more than one layer")
+	applyCmd.Flags().StringVar(&applyTarget, "target", "", "Apply into this directory instead of the home directory")
+	applyCmd.Flags().StringArrayVar(&applyExclude, "exclude", nil, "Leave out targets matching this glob, relative to the home directory (repeatable)")
+	applyCmd.Flags().BoolVar(&applyRelative, "relative", false, "Create symlinks relative to their directory instead of absolute ones")
+	applyCmd.Flags().BoolVar(&applyPrune, "prune-remote-deletions", false, "Remove the links of tracked files that were deleted from the repository")
+	applyCmd.Flags().BoolVar(&applyInteractive, "interactive", false, "Ask about each change before making it")
+	applyCmd.Flags().BoolVar(&applyReportOnly, "report-only", false, "Print the state of every target as JSON without changing anything, exit 1 if any drifted")
+	applyCmd.Flags().StringVar(&applyUser, "user", "", "Also apply users/<name>/ into the home directory of this user")
+	addSkipLayerFlags(applyCmd)
+	applyCmd.Flags().BoolVar(&applyRecover, "recover", false, "Roll back the partial changes of an interrupted apply instead of applying")
+
+	rootCmd.AddCommand(applyCmd)
+}
@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// nonEmptyArgs validates the arguments with validate and rejects empty or
+// blank ones, which would otherwise name the working directory as a path or
+// nothing as a name
+func nonEmptyArgs(validate cobra.PositionalArgs) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if err := validate(cmd, args); err != nil {
+			return err
+		}
+		for i, arg := range args {
+			if strings.TrimSpace(arg) == "" {
+				return fmt.Errorf("argument %d is empty", i+1)
+			}
+		}
+		return nil
+	}
+}
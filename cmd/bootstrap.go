@@ -1,8 +1,11 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/dotpilot/core"
 	"github.com/dotpilot/utils"
@@ -15,6 +18,14 @@ var (
 	skipMachine   bool
 	skipSetupScripts bool
 	forceOverwrite bool
+	bootstrapOnlyNew bool
+	bootstrapTarget string
+	bootstrapExclude []string
+	bootstrapRelative bool
+	parallelScripts bool
+	bootstrapInteractive bool
+	bootstrapUser string
+	bootstrapResume bool
 )
 
 // bootstrapCmd represents the bootstrap command
@@ -24,39 +35,108 @@ var bootstrapCmd = &cobra.Command{
 	Long: `Bootstrap applies dotfiles from common/, envs/<env>/, and machine/<hostname>/, 
 then runs any setup scripts like install_packages.sh.
 
+The setup scripts of a layer are install_packages.sh and the scripts in its
+setup.d/ directory. The install_packages.sh scripts of all layers run first,
+one after the other, so packages are installed before anything configures
+them. Then the setup.d scripts run in the order of the number their name
+starts with, like 10-fonts.sh before 20-shell.sh, and the ones without a
+number last. With --parallel-scripts, the scripts sharing a number run at the
+same time, across layers, with their output prefixed by the script name. A
+failing script doesn't stop the others; the failures are listed at the end.
+
 This command is typically used when setting up a new machine or after significant changes.
 
+With --target, the dotfiles are linked into another directory instead of the
+home directory, for example to populate a container image. Apply hooks don't
+run for another target, setup scripts still do unless --skip-setup-scripts is
+given.
+
+With --user <name>, the layer users/<name>/ is applied after the others into
+the home directory of that user, or into --target. Run as root, the links and
+directories created there are handed to the user.
+
+Targets matching a pattern in .dotpilotignore in the repository, or given
+with --exclude, are left out. Patterns are globs matched against the path
+relative to the home directory.
+
+Bootstrap records each phase that finishes: every layer, the apply hooks and
+every setup script. If it stops partway, for example at a layer that fails to
+apply, or a setup script fails, run it again with --resume to skip what
+finished and carry on with the rest. Without --resume, bootstrap starts over.
+
+With --interactive, every file is shown before it is linked and can be
+linked or skipped, or its diff shown first. Quitting stops the bootstrap,
+keeping the files linked so far. With --non-interactive, --interactive needs
+--force and then links everything.
+
 For example:
   dotpilot bootstrap
   dotpilot bootstrap --skip-setup-scripts
-  dotpilot bootstrap --force`,
-	Run: func(cmd *cobra.Command, args []string) {
-		// Get home directory
-		home, err := os.UserHomeDir()
+  dotpilot bootstrap --parallel-scripts
+  dotpilot bootstrap --force
+  dotpilot bootstrap --only-new
+  dotpilot bootstrap --interactive
+  dotpilot bootstrap --exclude '.config/JetBrains' --exclude '*.local'
+  dotpilot bootstrap --target ./image/root --skip-setup-scripts
+  sudo dotpilot bootstrap --user deploy --skip-setup-scripts
+  dotpilot bootstrap --resume`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+		dotpilotDir := repo.Dir
+
+		if forceOverwrite && bootstrapOnlyNew {
+			return errors.New("--force and --only-new cannot be used together")
+		}
+
+		if bootstrapInteractive && utils.IsNonInteractive() {
+			if !forceOverwrite {
+				return errors.New("--interactive needs a terminal, use --force to link everything with --non-interactive")
+			}
+			bootstrapInteractive = false
+		}
+
+		// Directory the dotfiles are linked into, the home directory of
+		// --user unless --target is given
+		target := bootstrapTarget
+		var account *core.UserAccount
+		if bootstrapUser != "" {
+			var err error
+			if account, target, err = core.UserTarget(bootstrapUser, bootstrapTarget); err != nil {
+				return withMessage(err, "Invalid user")
+			}
+		}
+		targetRoot, err := core.TargetRoot(target)
 		if err != nil {
-			utils.Logger.Error().Err(err).Msg("Failed to get home directory")
-			os.Exit(1)
+			return withMessage(err, "Invalid target directory")
 		}
 
-		// Check if dotpilot is initialized
-		dotpilotDir := filepath.Join(home, ".dotpilot")
-		if _, err := os.Stat(dotpilotDir); os.IsNotExist(err) {
-			utils.Logger.Error().Msg("Dotpilot is not initialized. Run 'dotpilot init' first.")
-			os.Exit(1)
+		// Targets left out, from .dotpilotignore and --exclude
+		applyOpts := core.DirectoryApplyOptions{ForceOverwrite: forceOverwrite, OnlyNew: bootstrapOnlyNew, Relative: bootstrapRelative, Interactive: bootstrapInteractive}
+		if applyOpts.Exclude, err = core.ExcludePatterns(dotpilotDir, bootstrapExclude); err != nil {
+			return withMessage(err, "Failed to read .dotpilotignore")
 		}
 
 		// Get hostname for machine-specific configurations
-		hostname, err := os.Hostname()
+		hostname, err := core.MachineID()
 		if err != nil {
 			utils.Logger.Error().Err(err).Msg("Failed to get hostname")
 			hostname = "unknown"
 		}
 
 		// Get current environment
-		cfg := core.GetConfig()
-		environment := cfg.CurrentEnvironment
-		if environment == "" {
-			environment = "default"
+		environment := repo.Environment()
+
+		// Progress of the bootstrap, picked up where it stopped with --resume
+		state, err := startBootstrapState(dotpilotDir, environment, targetRoot)
+		if err != nil {
+			return err
 		}
 
 		// Initialize operation manager for progress tracking
@@ -65,135 +145,274 @@ For example:
 		// Apply configurations from different sources
 		utils.Logger.Info().Msg("Starting bootstrap process...")
 
-		// 1. Apply common configurations
-		if !skipCommon {
-			commonOp := operationManager.AddOperation("common", "Applying common dotfiles...", utils.Bar)
-			commonOp.Start()
-
-			commonDir := filepath.Join(dotpilotDir, "common")
-			if _, err := os.Stat(commonDir); os.IsNotExist(err) {
-				utils.Logger.Info().Msg("No common directory found, creating...")
-				if err := os.MkdirAll(commonDir, 0755); err != nil {
-					commonOp.Stop()
-					utils.Logger.Error().Err(err).Msg("Failed to create common directory")
-					os.Exit(1)
-				}
-			}
+		// Targets linked by the layers, for the apply hooks, and the ones
+		// that were excluded
+		linked := state.Linked
+		var excluded []string
 
-			if err := core.ApplyDirectoryConfigs(commonDir, home, forceOverwrite); err != nil {
-				commonOp.Stop()
-				utils.Logger.Error().Err(err).Msg("Failed to apply common configurations")
-				os.Exit(1)
-			}
+		// Apply the layers in the configured order, a later layer wins
+		layerOrder, err := core.LayerOrder()
+		if err != nil {
+			return withMessage(err, "Invalid layer order in ~/.dotpilotrc")
+		}
+
+		// Layers disabled in ~/.dotpilotrc are skipped like with --skip-*
+		disabledLayers, err := core.DisabledLayers()
+		if err != nil {
+			return withMessage(err, "Invalid configuration in ~/.dotpilotrc")
+		}
+		skippedLayers := map[string]bool{"common": skipCommon, "env": skipEnv, "machine": skipMachine}
+		for _, layer := range disabledLayers {
+			skippedLayers[layer] = true
+		}
+
+		applyLayer := map[string]func() error{
+			// Apply common configurations
+			"common": func() error {
+				if !skippedLayers["common"] {
+					commonOp := operationManager.AddOperation("common", "Applying common dotfiles...", utils.Bar)
+					commonOp.Start()
+
+					commonDir := filepath.Join(dotpilotDir, "common")
+					if _, err := os.Stat(commonDir); os.IsNotExist(err) {
+						utils.Logger.Info().Msg("No common directory found, creating...")
+						if err := os.MkdirAll(commonDir, 0755); err != nil {
+							commonOp.StopWithResult(utils.StateError, "Failed to create common directory")
+							return withMessage(err, "Failed to create common directory")
+						}
+					}
+
+					dirLinked, dirExcluded, err := core.ApplyDirectoryConfigsWithOptions(commonDir, targetRoot, applyOpts)
+					if err != nil {
+						commonOp.StopWithResult(utils.StateError, "Failed to apply common dotfiles")
+						return withMessage(err, "Failed to apply common configurations")
+					}
+					linked = append(linked, dirLinked...)
+					excluded = append(excluded, dirExcluded...)
 			
-			commonOp.SetState(utils.StateSuccess)
-			commonOp.Stop()
-		}
-
-		// 2. Apply environment-specific configurations
-		if !skipEnv && environment != "default" {
-			envOp := operationManager.AddOperation("env", "Applying environment-specific dotfiles...", utils.Bar)
-			envOp.Start()
-
-			envDir := filepath.Join(dotpilotDir, "envs", environment)
-			if _, err := os.Stat(envDir); os.IsNotExist(err) {
-				utils.Logger.Info().Msgf("No configuration for environment '%s' found, creating...", environment)
-				if err := os.MkdirAll(envDir, 0755); err != nil {
-					envOp.Stop()
-					utils.Logger.Error().Err(err).Msg("Failed to create environment directory")
-					os.Exit(1)
+					commonOp.StopWithResult(utils.StateSuccess, "Applied common dotfiles")
 				}
-				envOp.SetState(utils.StateInfo)
-				envOp.Stop()
-			} else {
-				if err := core.ApplyDirectoryConfigs(envDir, home, forceOverwrite); err != nil {
-					envOp.Stop()
-					utils.Logger.Error().Err(err).Msg("Failed to apply environment-specific configurations")
-					os.Exit(1)
+				return nil
+			},
+			// Apply environment-specific configurations
+			"env": func() error {
+				if !skippedLayers["env"] {
+					envOp := operationManager.AddOperation("env", "Applying environment-specific dotfiles...", utils.Bar)
+					envOp.Start()
+
+					envDir := filepath.Join(dotpilotDir, "envs", environment)
+					if _, err := os.Stat(envDir); os.IsNotExist(err) {
+						utils.Logger.Info().Msgf("No configuration for environment '%s' found, creating...", environment)
+						if err := os.MkdirAll(envDir, 0755); err != nil {
+							envOp.StopWithResult(utils.StateError, "Failed to create environment directory")
+							return withMessage(err, "Failed to create environment directory")
+						}
+						envOp.StopWithResult(utils.StateInfo, fmt.Sprintf("No dotfiles for environment %s yet", environment))
+					} else {
+						dirLinked, dirExcluded, err := core.ApplyDirectoryConfigsWithOptions(envDir, targetRoot, applyOpts)
+						if err != nil {
+							envOp.StopWithResult(utils.StateError, "Failed to apply environment-specific dotfiles")
+							return withMessage(err, "Failed to apply environment-specific configurations")
+						}
+						linked = append(linked, dirLinked...)
+						excluded = append(excluded, dirExcluded...)
+						envOp.StopWithResult(utils.StateSuccess, "Applied environment-specific dotfiles")
+					}
+				}
+				return nil
+			},
+			// Apply machine-specific configurations
+			"machine": func() error {
+				if !skippedLayers["machine"] {
+					machineOp := operationManager.AddOperation("machine", "Applying machine-specific dotfiles...", utils.Bar)
+					machineOp.Start()
+
+					machineDir := filepath.Join(dotpilotDir, "machine", hostname)
+					if _, err := os.Stat(machineDir); os.IsNotExist(err) {
+						utils.Logger.Info().Msgf("No configuration for machine '%s' found, creating...", hostname)
+						if err := os.MkdirAll(machineDir, 0755); err != nil {
+							machineOp.StopWithResult(utils.StateError, "Failed to create machine directory")
+							return withMessage(err, "Failed to create machine directory")
+						}
+						machineOp.StopWithResult(utils.StateInfo, fmt.Sprintf("No dotfiles for machine %s yet", hostname))
+					} else if allowed, err := core.MachineLayerAllowed(machineDir); err != nil || !allowed {
+						if err != nil {
+							machineOp.StopWithResult(utils.StateError, "Failed to check the machine fingerprint")
+							return withMessage(err, "Failed to check the machine fingerprint")
+						}
+						machineOp.StopWithResult(utils.StateWarning, "Skipped machine-specific dotfiles, machine.json doesn't match this machine")
+					} else {
+						dirLinked, dirExcluded, err := core.ApplyDirectoryConfigsWithOptions(machineDir, targetRoot, applyOpts)
+						if err != nil {
+							machineOp.StopWithResult(utils.StateError, "Failed to apply machine-specific dotfiles")
+							return withMessage(err, "Failed to apply machine-specific configurations")
+						}
+						linked = append(linked, dirLinked...)
+						excluded = append(excluded, dirExcluded...)
+						machineOp.StopWithResult(utils.StateSuccess, "Applied machine-specific dotfiles")
+					}
 				}
-				envOp.SetState(utils.StateSuccess)
-				envOp.Stop()
+				return nil
+			},
+		}
+		for _, layer := range layerOrder {
+			phase := core.BootstrapLayerPhase(layer)
+			if state.Done(phase) {
+				utils.Logger.Info().Msgf("Skipping the %s layer, it was applied before", layer)
+				continue
+			}
+			before := len(linked)
+			if err := applyLayer[layer](); err != nil {
+				return err
+			}
+			if !skippedLayers[layer] {
+				recordBootstrapPhase(state, phase, linked[before:])
 			}
 		}
 
-		// 3. Apply machine-specific configurations
-		if !skipMachine {
-			machineOp := operationManager.AddOperation("machine", "Applying machine-specific dotfiles...", utils.Bar)
-			machineOp.Start()
+		// The user layer comes last, so it wins over the others
+		if bootstrapUser != "" && state.Done(core.BootstrapLayerPhase("user")) {
+			utils.Logger.Info().Msg("Skipping the user layer, it was applied before")
+		} else if bootstrapUser != "" {
+			before := len(linked)
+			userOp := operationManager.AddOperation("user", "Applying user dotfiles...", utils.Bar)
+			userOp.Start()
 
-			machineDir := filepath.Join(dotpilotDir, "machine", hostname)
-			if _, err := os.Stat(machineDir); os.IsNotExist(err) {
-				utils.Logger.Info().Msgf("No configuration for machine '%s' found, creating...", hostname)
-				if err := os.MkdirAll(machineDir, 0755); err != nil {
-					machineOp.Stop()
-					utils.Logger.Error().Err(err).Msg("Failed to create machine directory")
-					os.Exit(1)
-				}
-				machineOp.SetState(utils.StateInfo)
-				machineOp.Stop()
+			userDir := core.UserLayerDir(dotpilotDir, bootstrapUser)
+			if _, err := os.Stat(userDir); os.IsNotExist(err) {
+				userOp.StopWithResult(utils.StateInfo, fmt.Sprintf("No dotfiles for user %s yet", bootstrapUser))
 			} else {
-				if err := core.ApplyDirectoryConfigs(machineDir, home, forceOverwrite); err != nil {
-					machineOp.Stop()
-					utils.Logger.Error().Err(err).Msg("Failed to apply machine-specific configurations")
-					os.Exit(1)
+				dirLinked, dirExcluded, err := core.ApplyDirectoryConfigsWithOptions(userDir, targetRoot, applyOpts)
+				if err != nil {
+					userOp.StopWithResult(utils.StateError, "Failed to apply user dotfiles")
+					return withMessage(err, "Failed to apply user configurations")
 				}
-				machineOp.SetState(utils.StateSuccess)
-				machineOp.Stop()
+				linked = append(linked, dirLinked...)
+				excluded = append(excluded, dirExcluded...)
+				userOp.StopWithResult(utils.StateSuccess, fmt.Sprintf("Applied dotfiles of user %s", bootstrapUser))
 			}
+			recordBootstrapPhase(state, core.BootstrapLayerPhase("user"), linked[before:])
+		}
+		if account != nil {
+			if err := core.ChownTargets(targetRoot, linked, *account); err != nil {
+				return withMessage(err, "Failed to hand the dotfiles to the user")
+			}
+		}
+
+		if len(excluded) > 0 {
+			utils.Logger.Info().Msgf("Excluded %d targets: %s", len(excluded), strings.Join(excluded, ", "))
 		}
 
-		// 4. Run setup scripts
+		// Run the apply hooks of the files that were linked
+		switch {
+		case state.Done(core.BootstrapHooksPhase):
+			utils.Logger.Debug().Msg("Not running apply hooks, they ran before")
+		case targetRoot != repo.Home:
+			utils.Logger.Debug().Msgf("Not running apply hooks, %s is not the home directory", targetRoot)
+		default:
+			if err := core.RunApplyHooks(dotpilotDir, environment, linked); err != nil {
+				utils.Logger.Warn().Err(err).Msg("Error running apply hooks")
+			}
+		}
+		recordBootstrapPhase(state, core.BootstrapHooksPhase, nil)
+
+		// Run setup scripts
+		scriptsFailed := false
 		if !skipSetupScripts {
 			scriptsOp := operationManager.AddOperation("scripts", "Running setup scripts...", utils.Pulse)
 			scriptsOp.Start()
 
-			// Run common setup scripts
-			if !skipCommon {
-				commonScriptPath := filepath.Join(dotpilotDir, "common", "install_packages.sh")
-				if _, err := os.Stat(commonScriptPath); err == nil {
-					utils.Logger.Info().Msg("Running common setup script...")
-					if err := core.RunScript(commonScriptPath); err != nil {
-						scriptsOp.SetState(utils.StateWarning)
-						utils.Logger.Warn().Err(err).Msg("Error running common setup script")
-						// Continue anyway
-					}
+			// Run the scripts of the layers that were applied, in the
+			// configured layer order
+			layerDirs := map[string]string{"common": "common", "env": "envs/" + environment, "machine": "machine/" + hostname}
+			var scriptLayers []string
+			for _, layer := range layerOrder {
+				if !skippedLayers[layer] {
+					scriptLayers = append(scriptLayers, layerDirs[layer])
 				}
 			}
 
-			// Run environment-specific setup scripts
-			if !skipEnv && environment != "default" {
-				envScriptPath := filepath.Join(dotpilotDir, "envs", environment, "install_packages.sh")
-				if _, err := os.Stat(envScriptPath); err == nil {
-					utils.Logger.Info().Msg("Running environment setup script...")
-					if err := core.RunScript(envScriptPath); err != nil {
-						scriptsOp.SetState(utils.StateWarning)
-						utils.Logger.Warn().Err(err).Msg("Error running environment setup script")
-						// Continue anyway
-					}
+			scripts, err := core.FindSetupScripts(dotpilotDir, scriptLayers)
+			if err != nil {
+				scriptsOp.StopWithResult(utils.StateError, "Failed to find setup scripts")
+				return withMessage(err, "Failed to find setup scripts")
+			}
+
+			// Only the scripts that failed or didn't run before
+			var pending []core.SetupScript
+			for _, script := range scripts {
+				if state.Done(core.BootstrapScriptPhase(script)) {
+					utils.Logger.Info().Msgf("Skipping setup script %s, it ran before", script.Name)
+					continue
 				}
+				pending = append(pending, script)
 			}
 
-			// Run machine-specific setup scripts
-			if !skipMachine {
-				machineScriptPath := filepath.Join(dotpilotDir, "machine", hostname, "install_packages.sh")
-				if _, err := os.Stat(machineScriptPath); err == nil {
-					utils.Logger.Info().Msg("Running machine-specific setup script...")
-					if err := core.RunScript(machineScriptPath); err != nil {
-						scriptsOp.SetState(utils.StateWarning)
-						utils.Logger.Warn().Err(err).Msg("Error running machine-specific setup script")
-						// Continue anyway
-					}
+			// Failing scripts don't stop the others, they are reported at
+			// the end
+			failures := core.RunSetupScripts(dotpilotDir, environment, pending, parallelScripts)
+			failed := make(map[string]bool)
+			for _, failure := range failures {
+				failed[failure.Script.Name] = true
+				utils.Logger.Warn().Err(failure.Err).Msgf("Setup script %s failed", failure.Script.Name)
+			}
+			for _, script := range pending {
+				if !failed[script.Name] {
+					recordBootstrapPhase(state, core.BootstrapScriptPhase(script), nil)
 				}
 			}
 
-			scriptsOp.SetState(utils.StateSuccess)
-			scriptsOp.Stop()
+			scriptsFailed = len(failures) > 0
+			if scriptsFailed {
+				scriptsOp.StopWithResult(utils.StateWarning, fmt.Sprintf("%d of %d setup scripts failed", len(failures), len(pending)))
+			} else {
+				scriptsOp.StopWithResult(utils.StateSuccess, "Ran setup scripts")
+			}
 		}
 
+		if scriptsFailed {
+			utils.Logger.Warn().Msg("Fix the failed setup scripts, then run 'dotpilot bootstrap --resume' to run them again")
+			return nil
+		}
+		if err := state.Clear(); err != nil {
+			utils.Logger.Warn().Err(err).Msg("Failed to remove the bootstrap progress")
+		}
 		utils.Logger.Info().Msg("Bootstrap completed successfully!")
+		return nil
 	},
 }
 
+// startBootstrapState returns the progress of the bootstrap of environment
+// into targetRoot: that of the unfinished one with --resume, if there is one,
+// otherwise a new one
+func startBootstrapState(dotpilotDir, environment, targetRoot string) (*core.BootstrapState, error) {
+	if bootstrapResume {
+		state, err := core.LoadBootstrapState(dotpilotDir, environment, targetRoot)
+		if err != nil {
+			return nil, withMessage(err, "Failed to read the bootstrap progress")
+		}
+		if state != nil {
+			utils.Logger.Info().Msgf("Resuming the bootstrap started %s", state.Started.Format("2006-01-02 15:04"))
+			return state, nil
+		}
+		utils.Logger.Info().Msg("No unfinished bootstrap to resume, starting from the beginning")
+	}
+
+	state, err := core.NewBootstrapState(dotpilotDir, environment, targetRoot)
+	if err != nil {
+		return nil, withMessage(err, "Failed to record the bootstrap progress")
+	}
+	return state, nil
+}
+
+// recordBootstrapPhase records that phase of the bootstrap finished. Failing
+// to only means a resume repeats it.
+func recordBootstrapPhase(state *core.BootstrapState, phase string, linked []string) {
+	if err := state.Complete(phase, linked); err != nil {
+		utils.Logger.Warn().Err(err).Msg("Failed to record the bootstrap progress")
+	}
+}
+
 func init() {
 	// Add flags
 	bootstrapCmd.Flags().BoolVar(&skipCommon, "skip-common", false, "Skip applying common dotfiles")
@@ -201,4 +420,12 @@ func init() {
 	bootstrapCmd.Flags().BoolVar(&skipMachine, "skip-machine", false, "Skip applying machine-specific dotfiles")
 	bootstrapCmd.Flags().BoolVar(&skipSetupScripts, "skip-setup-scripts", false, "Skip running setup scripts")
 	bootstrapCmd.Flags().BoolVar(&forceOverwrite, "force", false, "Force overwrite existing files without prompting")
+	bootstrapCmd.Flags().BoolVar(&bootstrapOnlyNew, "only-new", false, "Only link files that don't exist yet, leaving existing files untouched")
+	bootstrapCmd.Flags().StringVar(&bootstrapTarget, "target", "", "Apply into this directory instead of the home directory")
+	bootstrapCmd.Flags().StringArrayVar(&bootstrapExclude, "exclude", nil, "Leave out targets matching this glob, relative to the home directory (repeatable)")
+	bootstrapCmd.Flags().BoolVar(&bootstrapRelative, "relative", false, "Create symlinks relative to their directory instead of absolute ones")
+	bootstrapCmd.Flags().BoolVar(&bootstrapInteractive, "interactive", false, "Ask about each file before linking it")
+	bootstrapCmd.Flags().BoolVar(&bootstrapResume, "resume", false, "Skip the layers, hooks and setup scripts an unfinished bootstrap completed")
+	bootstrapCmd.Flags().StringVar(&bootstrapUser, "user", "", "Also apply users/<name>/ into the home directory of this user")
+	bootstrapCmd.Flags().BoolVar(&parallelScripts, "parallel-scripts", false, "Run the setup.d scripts sharing a number at the same time")
 }
\ No newline at end of file
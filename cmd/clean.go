@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cleanRestore bool // Whether to restore the most recent backup over each removed link
+	cleanDryRun  bool // Whether to only list what would be removed
+)
+
+// cleanCmd represents the clean command
+var cleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: "Remove dotpilot's links and backups from the home directory",
+	Long: `Remove what dotpilot left in the home directory: the symlinks that point
+into the dotpilot directory, and the .dotpilot.bak backups dotpilot makes of
+the files it replaces. Other files and links, the repository and
+~/.dotpilotrc are left alone, so a later apply links everything again. Unlike
+untrack, clean doesn't copy the dotfiles back or change what is tracked.
+
+Only the home directory and the directories below it that mirror a
+directory of a layer are searched, which is where dotpilot creates links.
+
+With --restore, the most recent backup of each removed link is moved back in
+its place instead of being removed, undoing what apply replaced.
+
+What would be removed is listed first and clean asks before removing
+anything. With --dry-run it stops after the list.
+
+For example:
+  dotpilot clean --dry-run
+  dotpilot clean --restore
+  dotpilot clean --yes`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+
+		plan, err := core.PlanClean(repo.Dir, cleanRestore)
+		if err != nil {
+			return withMessage(err, "Failed to search the home directory")
+		}
+		if plan.Empty() {
+			fmt.Fprintln(out, "Nothing to clean, no links into the repository or backups were found.")
+			return nil
+		}
+
+		if len(plan.Links) > 0 {
+			fmt.Fprintln(out, "Links into the repository:")
+			for _, link := range plan.Links {
+				fmt.Fprintf(out, "  %s -> %s\n", tildePath(repo.Home, link.Target), tildePath(repo.Home, link.Source))
+				if link.Restore != "" {
+					fmt.Fprintf(out, "    restoring %s\n", tildePath(repo.Home, link.Restore))
+				}
+			}
+		}
+		if len(plan.Backups) > 0 {
+			fmt.Fprintln(out, "Backups:")
+			for _, backup := range plan.Backups {
+				fmt.Fprintf(out, "  %s\n", tildePath(repo.Home, backup))
+			}
+		}
+
+		if cleanDryRun {
+			fmt.Fprintln(out, "Dry run, nothing was removed.")
+			return nil
+		}
+		if !utils.PromptYesNo(fmt.Sprintf("Remove %d links and %d backups?", len(plan.Links), len(plan.Backups))) {
+			utils.Logger.Info().Msg("Nothing removed")
+			return nil
+		}
+
+		if err := plan.Run(); err != nil {
+			return withMessage(err, "Failed to clean the home directory")
+		}
+
+		restored := 0
+		for _, link := range plan.Links {
+			if link.Restore != "" {
+				restored++
+			}
+		}
+		utils.Logger.Info().Msgf("Removed %d links and %d backups, restored %d backups", len(plan.Links), len(plan.Backups), restored)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cleanCmd)
+
+	cleanCmd.Flags().BoolVar(&cleanRestore, "restore", false, "Move the most recent backup of each removed link back in its place")
+	cleanCmd.Flags().BoolVar(&cleanDryRun, "dry-run", false, "List what would be removed without removing it")
+}
@@ -0,0 +1,526 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dotpilot/core"
+	"github.com/go-git/go-git/v5"
+	"github.com/spf13/cobra"
+)
+
+func TestMain(m *testing.M) {
+	// Relocated XDG base directories of the user running the tests would
+	// send targets of the temporary home directories there
+	os.Unsetenv("XDG_CONFIG_HOME")
+	os.Unsetenv("XDG_DATA_HOME")
+	os.Exit(m.Run())
+}
+
+// runCommand executes the root command with args and returns what was written
+// to the output and error writers
+func runCommand(t *testing.T, args ...string) (string, string) {
+	t.Helper()
+
+	var out, errOut bytes.Buffer
+	SetOutput(&out, &errOut)
+	defer SetOutput(os.Stdout, os.Stderr)
+
+	rootCmd.SetArgs(args)
+	if err := executeRoot(); err != nil {
+		t.Fatalf("dotpilot %s: %v", strings.Join(args, " "), err)
+	}
+	return out.String(), errOut.String()
+}
+
+func TestSecretsListOutput(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	secretsDir := filepath.Join(home, ".dotpilot", "secrets")
+	if err := os.MkdirAll(secretsDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(secretsDir, "token"), []byte("blob"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _ := runCommand(t, "secrets", "list")
+	if want := "Encrypted secrets:\n- token\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+}
+
+func TestSecretsShowOutput(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	// Without gpg, secrets use the AES backend
+	t.Setenv("PATH", t.TempDir())
+
+	sm := core.NewSecretManager(filepath.Join(home, ".dotpilot"))
+	if err := sm.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.EncryptData([]byte("npm_abc123"), "npm_token"); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _ := runCommand(t, "secrets", "show", "npm_token")
+	if out != "npm_abc123" {
+		t.Errorf("output = %q, want the plaintext", out)
+	}
+}
+
+func TestStatsJSONOutput(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if err := os.MkdirAll(filepath.Join(dotpilotDir, "common"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dotpilotDir, "common", ".zshrc"), []byte("export A=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := core.CommitChanges(dotpilotDir, "Add zshrc"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Log messages go to the error writer, so the output is valid JSON
+	out, _ := runCommand(t, "stats", "--json")
+	var stats core.RepoStats
+	if err := json.Unmarshal([]byte(out), &stats); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, out)
+	}
+	if stats.Layers["common"] != 1 {
+		t.Errorf("layers = %v, want one file in common", stats.Layers)
+	}
+}
+
+func TestBootstrapAppliesDefaultEnvironment(t *testing.T) {
+	// bootstrap and apply, which sync uses, link the same layers
+	for _, args := range [][]string{
+		{"bootstrap", "--skip-setup-scripts", "--skip-machine"},
+		{"apply", "--no-diff-prompt"},
+	} {
+		home := t.TempDir()
+		t.Setenv("HOME", home)
+
+		dotpilotDir := filepath.Join(home, ".dotpilot")
+		for name, content := range map[string]string{
+			"common/bin/greet":        "common\n",
+			"common/bin/deploy":       "common\n",
+			"envs/default/bin/deploy": "default\n",
+		} {
+			path := filepath.Join(dotpilotDir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := core.CommitChanges(dotpilotDir, "Add dotfiles"); err != nil {
+			t.Fatal(err)
+		}
+
+		runCommand(t, args...)
+
+		for name, want := range map[string]string{
+			"bin/greet":  filepath.Join(dotpilotDir, "common", "bin", "greet"),
+			"bin/deploy": filepath.Join(dotpilotDir, "envs", "default", "bin", "deploy"),
+		} {
+			if link, err := os.Readlink(filepath.Join(home, filepath.FromSlash(name))); err != nil || link != want {
+				t.Errorf("%s: %s links to %q, %v, want %s", args[0], name, link, err, want)
+			}
+		}
+	}
+}
+
+func TestEnvFlagCompletion(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	for _, dir := range []string{"common", "envs/work", "envs/laptop"} {
+		if err := os.MkdirAll(filepath.Join(dotpilotDir, filepath.FromSlash(dir)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"track", "--env", ""}, []string{"common", "machine", "laptop", "work"}},
+		{[]string{"init", "--env", ""}, []string{"laptop", "work"}},
+		{[]string{"env", "delete", ""}, []string{"laptop", "work"}},
+	}
+	for _, tt := range tests {
+		out, _ := runCommand(t, append([]string{cobra.ShellCompRequestCmd}, tt.args...)...)
+		// The last line is the directive
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		if got := lines[:len(lines)-1]; strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("completing %v = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestPlugins(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	pluginDir := t.TempDir()
+	t.Setenv("PATH", pluginDir)
+
+	result := filepath.Join(t.TempDir(), "result")
+	script := "#!/bin/sh\necho \"$DOTPILOT_DIR $DOTPILOT_ENV $*\" > " + result + "\n"
+	for name, mode := range map[string]os.FileMode{"dotpilot-hello": 0755, "dotpilot-status": 0755, "dotpilot-notes": 0644} {
+		if err := os.WriteFile(filepath.Join(pluginDir, name), []byte(script), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plugin, args, ok := findPlugin([]string{"hello", "a", "--b"})
+	if !ok || plugin.Name != "hello" {
+		t.Fatalf("findPlugin(hello) = %+v, %v", plugin, ok)
+	}
+	if err := runPlugin(plugin, args); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(result)
+	if want := filepath.Join(home, ".dotpilot") + " default a --b\n"; err != nil || string(data) != want {
+		t.Errorf("plugin wrote %q (%v), want %q", data, err, want)
+	}
+
+	// Built-in commands win, and only executables are plugins
+	for _, name := range []string{"status", "notes", "--verbose", "help"} {
+		if _, _, ok := findPlugin([]string{name}); ok {
+			t.Errorf("findPlugin(%s) found a plugin", name)
+		}
+	}
+
+	out, _ := runCommand(t, "plugins", "list")
+	want := "COMMAND  PATH\n" +
+		"hello    " + filepath.Join(pluginDir, "dotpilot-hello") + "\n" +
+		"status   " + filepath.Join(pluginDir, "dotpilot-status") + " (shadowed by the built-in command)\n"
+	if out != want {
+		t.Errorf("plugins list = %q, want %q", out, want)
+	}
+}
+
+func TestDiffStatOutput(t *testing.T) {
+	change := func(repoPath, from, to string) core.DiffReport {
+		return core.FileChange{RepoPath: repoPath, Diff: core.UnifiedDiff("a", "b", []byte(from), []byte(to))}.Report()
+	}
+	changes := []core.DiffReport{
+		change("common/.zshrc", "a\nb\n", "a\nc\nd\n"),
+		change("envs/work/.gitconfig", "a\n", "a\nb\n"),
+		change("machine/laptop/.config/kitty.conf", "a\nb\n", "a\n"),
+		change("common/.vimrc", "", "x\n"),
+	}
+
+	var out bytes.Buffer
+	printDiffStat(&out, changes)
+	want := `Common:
+  .zshrc  common  +2 -1
+  .vimrc  common  +1 -0
+  2 files changed, 3 insertions(+), 1 deletion(-)
+
+Environment:
+  .gitconfig  envs/work  +1 -0
+  1 file changed, 1 insertion(+), 0 deletions(-)
+
+Machine:
+  .config/kitty.conf  machine/laptop  +0 -1
+  1 file changed, 0 insertions(+), 1 deletion(-)
+
+4 files changed, 4 insertions(+), 2 deletions(-)
+`
+	if got := out.String(); got != want {
+		t.Errorf("diff --stat =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDoctorUninitialized(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	var out bytes.Buffer
+	if runDoctorChecks(&out, home) {
+		t.Error("doctor passed without a repository")
+	}
+	want := "[FAIL] repository: not initialized, run 'dotpilot init'\n[FAIL] remote: skipped, no repository\n[FAIL] tracking: skipped, no repository\n"
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+}
+
+func TestListAndDiffJSON(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	defer func() { listJSON, diffJSON = false, false }()
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	for name, content := range map[string]string{
+		"common/.zshrc": "export A=1\n",
+		"common/.vimrc": "set number\n",
+	} {
+		path := filepath.Join(dotpilotDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := core.CommitChanges(dotpilotDir, "Add dotfiles"); err != nil {
+		t.Fatal(err)
+	}
+	// A drifted copy of .zshrc, and no .vimrc
+	if err := os.WriteFile(filepath.Join(home, ".zshrc"), []byte("export A=2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _ := runCommand(t, "list", "--json")
+	var list []core.DotfileReport
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		t.Fatalf("list output is not JSON: %v\n%s", err, out)
+	}
+	wantList := []core.DotfileReport{
+		{Path: "common/.vimrc", Layer: "common", Target: filepath.Join(home, ".vimrc"), LinkStatus: core.HealthMissing},
+		{Path: "common/.zshrc", Layer: "common", Target: filepath.Join(home, ".zshrc"), LinkStatus: core.HealthUnlinked},
+	}
+	if !reflect.DeepEqual(list, wantList) {
+		t.Errorf("list --json = %+v, want %+v", list, wantList)
+	}
+	if !strings.Contains(out, `"linkStatus": "missing"`) {
+		t.Errorf("list --json doesn't name the linkStatus field:\n%s", out)
+	}
+
+	out, _ = runCommand(t, "diff", "--json")
+	var diff []core.DiffReport
+	if err := json.Unmarshal([]byte(out), &diff); err != nil {
+		t.Fatalf("diff output is not JSON: %v\n%s", err, out)
+	}
+	if len(diff) != 1 || diff[0].Path != "common/.zshrc" || diff[0].Layer != "common" || diff[0].Added != 1 || diff[0].Removed != 1 {
+		t.Errorf("diff --json = %+v", diff)
+	}
+	if strings.Contains(out, "\x1b[") {
+		t.Errorf("diff --json has ANSI codes:\n%s", out)
+	}
+}
+
+func TestSandboxedHome(t *testing.T) {
+	// Nothing may end up in the real home directory
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	sandbox := t.TempDir()
+	t.Setenv("DOTPILOT_HOME", sandbox)
+	t.Setenv("DOTPILOT_HOSTNAME", "sandbox-box")
+
+	dotpilotDir := filepath.Join(sandbox, ".dotpilot")
+	for name, content := range map[string]string{
+		".dotpilot/common/bin/greet":            "common\n",
+		".dotpilot/machine/sandbox-box/bin/box": "machine\n",
+		"notes.txt":                             "notes\n",
+	} {
+		path := filepath.Join(sandbox, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := core.CommitChanges(dotpilotDir, "Add dotfiles"); err != nil {
+		t.Fatal(err)
+	}
+
+	runCommand(t, "track", "~/notes.txt")
+	runCommand(t, "bootstrap", "--skip-setup-scripts", "--skip-machine=false")
+
+	for name, want := range map[string]string{
+		"notes.txt": filepath.Join(dotpilotDir, "envs", "default", "notes.txt"),
+		"bin/greet": filepath.Join(dotpilotDir, "common", "bin", "greet"),
+		"bin/box":   filepath.Join(dotpilotDir, "machine", "sandbox-box", "bin", "box"),
+	} {
+		if link, err := os.Readlink(filepath.Join(sandbox, filepath.FromSlash(name))); err != nil || link != want {
+			t.Errorf("%s links to %q, %v, want %s", name, link, err, want)
+		}
+	}
+	if entries, err := os.ReadDir(home); err != nil || len(entries) != 0 {
+		t.Errorf("the real home directory was touched: %v, %v", entries, err)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, ExitOK},
+		{errors.New("disk on fire"), ExitGeneral},
+		{core.ErrLocked, ExitGeneral},
+		{fmt.Errorf("open: %w", core.ErrNotInitialized), ExitNotInitialized},
+		{fmt.Errorf("%w: connection refused", core.ErrNetwork), ExitNetwork},
+		{fmt.Errorf("%w: permission denied (publickey)", core.ErrAuthFailed), ExitNetwork},
+		{&core.ConflictError{Targets: []string{"/home/u/.bashrc"}}, ExitConflict},
+		{fmt.Errorf("sync: %w", &core.ConflictError{Targets: []string{"/home/u/.zshrc"}}), ExitConflict},
+		{fmt.Errorf("%w: cipher: message authentication failed", core.ErrDecryptFailed), ExitCrypto},
+		{fmt.Errorf("gpg %w: exit status 2", core.ErrEncryptFailed), ExitCrypto},
+		{fmt.Errorf("%w: token", core.ErrSecretNotFound), ExitCrypto},
+		{core.ErrSopsUnavailable, ExitCrypto},
+		{core.ErrNoGPGKey, ExitCrypto},
+		{fmt.Errorf("%w: context canceled", core.ErrInterrupted), ExitInterrupted},
+	}
+	for _, tt := range tests {
+		if got := ExitCode(tt.err); got != tt.want {
+			t.Errorf("ExitCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	// Commands return the error that stopped them instead of exiting, which
+	// is logged once with its hint, unless the command reported it already
+	tests := []struct {
+		args   []string
+		code   int
+		logged string
+	}{
+		{[]string{"status"}, ExitNotInitialized, "Run 'dotpilot init' first."},
+		{[]string{"doctor"}, ExitGeneral, ""},
+	}
+	for _, tt := range tests {
+		var errOut bytes.Buffer
+		SetOutput(io.Discard, &errOut)
+		rootCmd.SetArgs(tt.args)
+		err := executeRoot()
+		LogError(err)
+		SetOutput(os.Stdout, os.Stderr)
+
+		if got := ExitCode(err); got != tt.code {
+			t.Errorf("dotpilot %q exits with %d, want %d: %v", tt.args, got, tt.code, err)
+		}
+		if tt.logged == "" && errOut.Len() > 0 {
+			t.Errorf("dotpilot %q logged %q, want nothing", tt.args, errOut.String())
+		}
+		if !strings.Contains(errOut.String(), tt.logged) || strings.Count(errOut.String(), "ERR") > 1 {
+			t.Errorf("dotpilot %q logged %q, want %q once", tt.args, errOut.String(), tt.logged)
+		}
+	}
+}
+
+func TestBootstrapResume(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("DOTPILOT_HOSTNAME", "resume-box")
+	defer func() { bootstrapResume, skipMachine, skipSetupScripts = false, false, false }()
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	marker := filepath.Join(t.TempDir(), "ran")
+	for name, content := range map[string]string{
+		"common/bin/greet":           "greet\n",
+		"common/setup.d/10-fonts.sh": "echo fonts >> '" + marker + "'\n",
+		"common/setup.d/20-shell.sh": "exit 1\n",
+	} {
+		path := filepath.Join(dotpilotDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := core.CommitChanges(dotpilotDir, "Add dotfiles"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second script fails, its progress is kept
+	runCommand(t, "bootstrap", "--skip-machine", "--skip-setup-scripts=false")
+	stateFile := filepath.Join(dotpilotDir, ".bootstrap-state.json")
+	if _, err := os.Stat(stateFile); err != nil {
+		t.Fatalf("no progress recorded after a failed script: %v", err)
+	}
+
+	// Resuming only runs the script that failed
+	if err := os.WriteFile(filepath.Join(dotpilotDir, "common", "setup.d", "20-shell.sh"), []byte("echo shell >> '"+marker+"'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	runCommand(t, "bootstrap", "--skip-machine", "--skip-setup-scripts=false", "--resume")
+	if data, err := os.ReadFile(marker); err != nil || string(data) != "fonts\nshell\n" {
+		t.Errorf("scripts ran %q, %v, want each once", data, err)
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("progress kept after the bootstrap finished: %v", err)
+	}
+	if link, err := os.Readlink(filepath.Join(home, "bin", "greet")); err != nil || link != filepath.Join(dotpilotDir, "common", "bin", "greet") {
+		t.Errorf("bin/greet links to %q, %v", link, err)
+	}
+}
+
+func TestEmptyArgs(t *testing.T) {
+	// No argument validator panics on missing or empty arguments
+	var walk func(c *cobra.Command)
+	walk = func(c *cobra.Command) {
+		for _, sub := range c.Commands() {
+			walk(sub)
+		}
+		if c.Args == nil {
+			return
+		}
+		for _, args := range [][]string{nil, {""}, {"", " "}} {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Errorf("%s with %q panicked: %v", c.CommandPath(), args, r)
+					}
+				}()
+				c.Args(c, args)
+			}()
+		}
+	}
+	walk(rootCmd)
+
+	// Empty names and paths are rejected before the commands run
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	for _, args := range [][]string{{"which", ""}, {"track", "~/.bashrc", " "}, {"env", "delete", ""}, {"secrets", "show", ""}, {"sops", "get", "token", ""}} {
+		SetOutput(io.Discard, io.Discard)
+		rootCmd.SetArgs(args)
+		err := rootCmd.Execute()
+		SetOutput(os.Stdout, os.Stderr)
+		if err == nil || !strings.Contains(err.Error(), "is empty") {
+			t.Errorf("dotpilot %q = %v, want an empty argument error", args, err)
+		}
+	}
+
+	// The test command without a test only lists them
+	runCommand(t, "test")
+}
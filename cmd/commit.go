@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+var commitMessage string
+
+// commitCmd represents the commit command
+var commitCmd = &cobra.Command{
+	Use:   "commit",
+	Short: "Commit pending changes in the dotpilot repository",
+	Long: `Commit everything that is staged or changed in the dotpilot repository.
+
+Use this together with --no-commit on track, secrets and sops to group several
+changes into a single commit.
+
+For example:
+  dotpilot track ~/.zshrc --no-commit
+  dotpilot track ~/.config/nvim --no-commit
+  dotpilot commit -m "Add shell and editor configs"`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+		dotpilotDir := repo.Dir
+
+		hasChanges, err := core.HasUncommittedChanges(dotpilotDir)
+		if err != nil {
+			return withMessage(err, "Failed to check for uncommitted changes")
+		}
+		if !hasChanges {
+			utils.Logger.Info().Msg("Nothing to commit, the repository is clean")
+			return nil
+		}
+
+		utils.Logger.Info().Msg("Committing changes...")
+		if err := repo.Commit(commitMessage); err != nil {
+			return withMessage(err, "Failed to commit changes")
+		}
+
+		utils.Logger.Info().Msg("Changes committed successfully!")
+		return nil
+	},
+}
+
+// commitOrStage commits the repository with message as the auto_commit option
+// asks, see core.MaybeCommit, or only stages the changes when noCommit is set
+// so they can be committed later with 'dotpilot commit'
+func commitOrStage(dotpilotDir, message string, noCommit bool) error {
+	if noCommit {
+		utils.Logger.Info().Msg("Staging changes...")
+		if err := core.StageChanges(dotpilotDir); err != nil {
+			return withMessage(err, "Failed to stage changes")
+		}
+		utils.Logger.Info().Msg("Changes staged, run 'dotpilot commit' to commit them")
+		return nil
+	}
+
+	committed, err := core.MaybeCommit(dotpilotDir, message)
+	if err != nil {
+		return withMessage(err, "Failed to commit changes")
+	}
+	if !committed {
+		utils.Logger.Info().Msg("Changes staged, run 'dotpilot commit' to commit them")
+	}
+	return nil
+}
+
+func init() {
+	commitCmd.Flags().StringVarP(&commitMessage, "message", "m", "Update dotfiles via dotpilot", "Commit message")
+
+	rootCmd.AddCommand(commitCmd)
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"os"
 
+	"github.com/dotpilot/core"
 	"github.com/dotpilot/utils"
 	"github.com/spf13/cobra"
 )
@@ -48,7 +49,7 @@ PowerShell:
 	DisableFlagsInUseLine: true,
 	ValidArgs:             []string{"bash", "zsh", "fish", "powershell"},
 	Args:                  cobra.ExactValidArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		var err error
 		switch args[0] {
 		case "bash":
@@ -62,12 +63,61 @@ PowerShell:
 		}
 
 		if err != nil {
-			utils.Logger.Error().Err(err).Msg("Failed to generate completion script")
-			os.Exit(1)
+			return withMessage(err, "Failed to generate completion script")
 		}
+		return nil
 	},
 }
 
+// environmentNames returns the environments of the repository for
+// completion, or nothing if there is no repository yet
+func environmentNames() []string {
+	repo, err := core.OpenRepository()
+	if err != nil {
+		return nil
+	}
+	names, _ := core.ListEnvironments(repo.Dir)
+	return names
+}
+
+// completeEnvironments completes the names of the environments for the first
+// argument
+func completeEnvironments(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return environmentNames(), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeEnvironmentFlag completes an --env flag that takes an environment
+func completeEnvironmentFlag(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return environmentNames(), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeLayerFlag completes an --env flag that takes a layer: common,
+// machine or an environment
+func completeLayerFlag(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return append([]string{"common", "machine"}, environmentNames()...), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeRemoteURLFlag completes a remote URL flag with the URLs of the
+// remotes the repository already has, for reinitializing it
+func completeRemoteURLFlag(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	repo, err := core.OpenRepository()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	urls, _ := core.RemoteURLs(repo.Dir)
+	return urls, cobra.ShellCompDirectiveNoFileComp
+}
+
+// registerFlagCompletion registers complete for the flag of cmd
+func registerFlagCompletion(cmd *cobra.Command, flag string, complete func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective)) {
+	if err := cmd.RegisterFlagCompletionFunc(flag, complete); err != nil {
+		utils.Logger.Debug().Err(err).Msgf("Failed to register %s flag completion for %s", flag, cmd.Name())
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(completionCmd)
 }
\ No newline at end of file
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/dotpilot/core"
+	"github.com/spf13/cobra"
+)
+
+var configSourcesJSON bool
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the dotpilot configuration",
+	Long: `Inspect the dotpilot configuration, ~/.dotpilotrc and the JSON fragments in
+~/.dotpilot/config.d that are merged over it in lexical order.`,
+}
+
+// configSourcesCmd represents the config sources command
+var configSourcesCmd = &cobra.Command{
+	Use:   "sources",
+	Short: "Show which file set each configuration value",
+	Long: `Show every value set by ~/.dotpilotrc and the fragments in ~/.dotpilot/config.d,
+with the file it came from. A value a later fragment overrides is listed with
+that fragment; each tracking path is listed with the first file naming it.
+
+For example:
+  dotpilot config sources
+  dotpilot config sources --json`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+
+		home, err := core.Home()
+		if err != nil {
+			return withMessage(err, "Failed to get home directory")
+		}
+
+		values := core.ConfigSources()
+		if configSourcesJSON {
+			if values == nil {
+				values = []core.ConfigValue{}
+			}
+			if err := printJSON(out, values); err != nil {
+				return withMessage(err, "Failed to encode the configuration")
+			}
+			return nil
+		}
+		if len(values) == 0 {
+			fmt.Fprintln(out, "No configuration file was loaded, dotpilot uses its defaults.")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+		for _, value := range values {
+			data, err := json.Marshal(value.Value)
+			if err != nil {
+				return withMessage(err, "Failed to encode the configuration")
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", value.Key, data, tildePath(home, value.Source))
+		}
+		w.Flush()
+		return nil
+	},
+}
+
+func init() {
+	configSourcesCmd.Flags().BoolVar(&configSourcesJSON, "json", false, "Print the values as JSON")
+	configCmd.AddCommand(configSourcesCmd)
+	rootCmd.AddCommand(configCmd)
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/dotpilot/core"
+	"github.com/spf13/cobra"
+)
+
+var shadowsEnvironment string
+
+// conflictsCmd represents the conflicts command
+var conflictsCmd = &cobra.Command{
+	Use:   "conflicts",
+	Short: "Report conflicts within the dotfiles repository",
+	Long: `Report conflicts within the dotfiles repository itself, as opposed to
+'dotpilot resolve', which handles conflicts between the repository and the
+home directory.`,
+}
+
+// conflictsShadowsCmd represents the conflicts shadows command
+var conflictsShadowsCmd = &cobra.Command{
+	Use:   "shadows",
+	Short: "List files defined in more than one layer",
+	Long: `List the files defined in more than one of common/, envs/<env>/ and
+machine/<hostname>/. Only the copy in the last layer is applied; the copies it
+shadows are never linked, so editing them has no effect.
+
+For each file the applied copy is shown along with the shadowed copies and
+whether their content differs from it.
+
+For example:
+  dotpilot conflicts shadows
+  dotpilot conflicts shadows --env work`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		dotpilotDir := repo.Dir
+
+		environment := shadowsEnvironment
+		if environment == "" {
+			environment = core.GetConfig().CurrentEnvironment
+		}
+		if environment == "" {
+			environment = "default"
+		}
+
+		shadows, err := core.FindShadows(dotpilotDir, environment)
+		if err != nil {
+			return withMessage(err, "Failed to check for shadowed files")
+		}
+
+		if len(shadows) == 0 {
+			fmt.Fprintf(out, "No files are defined in more than one layer for environment %s.\n", environment)
+			return nil
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TARGET\tAPPLIED\tSHADOWED\tCONTENT")
+		for _, shadow := range shadows {
+			for _, shadowed := range shadow.Shadowed {
+				content := "identical"
+				if shadowed.Differs {
+					content = "differs"
+				}
+				fmt.Fprintf(w, "~/%s\t%s\t%s\t%s\n", shadow.Target, shadow.Winner, shadowed.RepoPath, content)
+			}
+		}
+		w.Flush()
+		return nil
+	},
+}
+
+func init() {
+	conflictsShadowsCmd.Flags().StringVar(&shadowsEnvironment, "env", "", "Environment to check (defaults to the current environment)")
+	registerFlagCompletion(conflictsShadowsCmd, "env", completeEnvironmentFlag)
+
+	conflictsCmd.AddCommand(conflictsShadowsCmd)
+	rootCmd.AddCommand(conflictsCmd)
+}
@@ -0,0 +1,252 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	diffRemote bool
+	diffStat   bool
+	diffJSON   bool
+	diffTool   string // Diff tool to open each drifted file in, see diffToolDefault
+
+	diffToolArgs []string // Arguments of the --tool program, before the files
+
+	diffIgnoreWhitespace string // Whitespace to ignore when deciding whether a file drifted
+)
+
+// diffToolDefault is the value of --tool given without one, which opens the
+// diff tool configured by the diff_tool option
+const diffToolDefault = "default"
+
+// diffStatGroups are the headers --stat groups the layers under, in order
+var diffStatGroups = []string{"Common", "Environment", "Machine", "Other"}
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Show how dotfiles differ from the repository",
+	Long: `Show a unified diff for each applied dotfile whose file in the home directory
+was replaced by a copy that no longer matches the repository. Files that are
+linked to the repository can't drift and are not shown.
+
+With --remote, fetch the remote repository instead and show for each file how
+the remote-tracking branch differs from the local commit: a preview of what the
+next sync would pull. Neither the repository nor the home directory is changed.
+
+With --stat, only an overview is shown, like git diff --stat: each changed file
+with its layer and the number of lines inserted and deleted, grouped by common,
+environment and machine layers, with totals per group and overall.
+
+With --json, the changed files are printed as a JSON array of objects with the
+path, layer, added and removed line counts and unified diff of each file, for
+editors and scripts.
+
+With --ignore-whitespace, files whose copy in the home directory only differs
+in trailing whitespace or the newlines at its end are not shown, and with
+--ignore-whitespace=all neither are differences in whitespace within lines.
+--ignore-whitespace=none shows them even if the ignore_whitespace option of
+~/.dotpilotrc hides them. The diffs of the files shown are complete.
+
+With --tool, each drifted file is opened in an external diff tool instead,
+the repository version against the file in the home directory, one after
+the other: the diff_tool option of ~/.dotpilotrc, or the first of meld,
+kdiff3, vimdiff, VS Code and diff that is installed. --tool=<program> picks
+another for this run, its path taken whole, and each --tool-arg is passed to
+it before the two files. Without any diff tool, the diff is printed.
+
+For example:
+  dotpilot diff
+  dotpilot diff --stat
+  dotpilot diff --remote --stat
+  dotpilot diff --json
+  dotpilot diff --tool
+  dotpilot diff --tool=code --tool-arg=-d --tool-arg=--wait
+  dotpilot diff --ignore-whitespace`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		dotpilotDir := repo.Dir
+		if err := ignoreWhitespace(cmd, diffIgnoreWhitespace); err != nil {
+			return err
+		}
+
+		if cmd.Flags().Changed("tool") && diffRemote {
+			return withMessage(fmt.Errorf("--tool compares files in the home directory"), "--tool can't be used with --remote")
+		}
+		if cmd.Flags().Changed("tool-arg") && (!cmd.Flags().Changed("tool") || diffTool == diffToolDefault) {
+			return withMessage(fmt.Errorf("--tool-arg needs --tool=<program>"), "--tool-arg is passed to the program of --tool")
+		}
+
+		var changes []core.FileChange
+		if diffRemote {
+			utils.Logger.Info().Msg("Fetching changes from remote...")
+			if err := core.FetchChanges(dotpilotDir); err != nil {
+				return withMessage(err, "Failed to fetch changes")
+			}
+
+			changes, err = core.RemoteChanges(dotpilotDir)
+			if err != nil {
+				return withMessage(err, "Failed to compare with the remote")
+			}
+			if len(changes) == 0 && !diffJSON {
+				fmt.Fprintln(out, "The remote has no changes to the dotfiles.")
+				return nil
+			}
+		} else {
+			changes, err = core.LocalDrift(dotpilotDir, repo.Environment())
+			if err != nil {
+				return withMessage(err, "Failed to compare with the home directory")
+			}
+			if len(changes) == 0 && !diffJSON {
+				fmt.Fprintln(out, "No dotfiles differ from the repository.")
+				return nil
+			}
+		}
+
+		reports := make([]core.DiffReport, 0, len(changes))
+		for _, change := range changes {
+			reports = append(reports, change.Report())
+		}
+
+		switch {
+		case diffJSON:
+			if err := printJSON(out, reports); err != nil {
+				return withMessage(err, "Failed to encode the changes")
+			}
+		case diffStat:
+			printDiffStat(out, reports)
+		case cmd.Flags().Changed("tool"):
+			return openDiffTool(out, dotpilotDir, changes)
+		default:
+			for _, report := range reports {
+				fmt.Fprint(out, report.Unified)
+			}
+		}
+		return nil
+	},
+}
+
+// openDiffTool opens each drifted file in the diff tool of --tool, the repo
+// file against the file in the home directory. Without a diff tool the diffs
+// are printed to out.
+func openDiffTool(out io.Writer, dotpilotDir string, changes []core.FileChange) error {
+	var tool []string
+	if diffTool != diffToolDefault {
+		tool = append([]string{diffTool}, diffToolArgs...)
+	}
+	for _, change := range changes {
+		repoFile := filepath.Join(dotpilotDir, filepath.FromSlash(change.RepoPath))
+		if err := core.ViewDiffExternal(out, tool, repoFile, change.Target, change.Diff); err != nil {
+			return withMessage(err, fmt.Sprintf("Failed to open %s in the diff tool", change.Target))
+		}
+	}
+	return nil
+}
+
+// printDiffStat prints the changed files with their insertions and deletions,
+// grouped by the kind of layer they belong to
+func printDiffStat(out io.Writer, reports []core.DiffReport) {
+	grouped := make(map[string][]core.DiffReport)
+	for _, report := range reports {
+		group := diffStatGroup(report.Layer)
+		grouped[group] = append(grouped[group], report)
+	}
+
+	var files, insertions, deletions int
+	for _, group := range diffStatGroups {
+		if len(grouped[group]) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "%s:\n", group)
+
+		var groupInsertions, groupDeletions int
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		for _, report := range grouped[group] {
+			groupInsertions += report.Added
+			groupDeletions += report.Removed
+			fmt.Fprintf(w, "  %s\t%s\t+%d -%d\n", strings.TrimPrefix(report.Path, report.Layer+"/"), report.Layer, report.Added, report.Removed)
+		}
+		w.Flush()
+		fmt.Fprintf(out, "  %s\n\n", diffStatSummary(len(grouped[group]), groupInsertions, groupDeletions))
+
+		files += len(grouped[group])
+		insertions += groupInsertions
+		deletions += groupDeletions
+	}
+	fmt.Fprintln(out, diffStatSummary(files, insertions, deletions))
+}
+
+// ignoreWhitespace makes --ignore-whitespace, if given, win over the
+// ignore_whitespace option of ~/.dotpilotrc
+func ignoreWhitespace(cmd *cobra.Command, mode string) error {
+	if !cmd.Flags().Changed("ignore-whitespace") {
+		return nil
+	}
+	if err := core.SetIgnoreWhitespace(mode); err != nil {
+		return withMessage(err, "Invalid --ignore-whitespace")
+	}
+	return nil
+}
+
+// addIgnoreWhitespaceFlag adds --ignore-whitespace to cmd, meaning trailing
+// when given without a value
+func addIgnoreWhitespaceFlag(cmd *cobra.Command, mode *string) {
+	cmd.Flags().StringVar(mode, "ignore-whitespace", "", "Treat files differing only in whitespace as the same: trailing (the default), all or none")
+	cmd.Flags().Lookup("ignore-whitespace").NoOptDefVal = core.WhitespaceTrailing
+}
+
+// diffStatGroup returns the header of diffStatGroups a layer is shown under
+func diffStatGroup(layer string) string {
+	switch {
+	case layer == "common":
+		return "Common"
+	case strings.HasPrefix(layer, "envs"):
+		return "Environment"
+	case strings.HasPrefix(layer, "machine"):
+		return "Machine"
+	default:
+		return "Other"
+	}
+}
+
+// diffStatSummary returns the summary line of git diff --stat
+func diffStatSummary(files, insertions, deletions int) string {
+	return fmt.Sprintf("%d %s changed, %d %s(+), %d %s(-)",
+		files, plural(files, "file", "files"),
+		insertions, plural(insertions, "insertion", "insertions"),
+		deletions, plural(deletions, "deletion", "deletions"))
+}
+
+// plural returns singular for a count of one, else pluralForm
+func plural(count int, singular, pluralForm string) string {
+	if count == 1 {
+		return singular
+	}
+	return pluralForm
+}
+
+func init() {
+	diffCmd.Flags().BoolVar(&diffRemote, "remote", false, "Compare the local commit with the remote-tracking branch after fetching")
+	diffCmd.Flags().BoolVar(&diffStat, "stat", false, "Only show the changed files with their inserted and deleted lines, grouped by layer")
+	diffCmd.Flags().BoolVar(&diffJSON, "json", false, "Print the changed files as JSON")
+	addIgnoreWhitespaceFlag(diffCmd, &diffIgnoreWhitespace)
+	diffCmd.Flags().StringVar(&diffTool, "tool", "", "Open each drifted file in an external diff tool, the configured one or this program")
+	diffCmd.Flags().Lookup("tool").NoOptDefVal = diffToolDefault
+	diffCmd.Flags().StringArrayVar(&diffToolArgs, "tool-arg", nil, "Pass this argument to the --tool program, can be repeated")
+	diffCmd.MarkFlagsMutuallyExclusive("stat", "json", "tool")
+	rootCmd.AddCommand(diffCmd)
+}
@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/dotpilot/core"
+	"github.com/spf13/cobra"
+)
+
+var doctorTimeout time.Duration
+
+// doctorCheck is one check of the doctor command. run returns what it found
+// and whether that is fine.
+type doctorCheck struct {
+	name string
+	run  func(home string) (string, bool)
+}
+
+// doctorChecks are run in order by the doctor command
+var doctorChecks = []doctorCheck{
+	{name: "repository", run: checkRepository},
+	{name: "remote", run: checkRemote},
+	{name: "tracking", run: checkTracking},
+}
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the dotpilot setup for problems",
+	Long: `Check that the dotpilot repository is fully initialized and that its remote is
+reachable with your credentials, see 'dotpilot verify-remote', and that the
+tracking paths of ~/.dotpilotrc agree with the repository and the links in
+the home directory, see 'dotpilot status --fix'. Nothing is changed. The exit status is 1 if a check failed.
+
+For example:
+  dotpilot doctor`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		home, err := core.Home()
+		if err != nil {
+			return withMessage(err, "Failed to get home directory")
+		}
+		if !runDoctorChecks(cmd.OutOrStdout(), home) {
+			return exitStatus(ExitGeneral)
+		}
+		return nil
+	},
+}
+
+// runDoctorChecks prints the result of each doctor check and reports
+// whether all of them passed
+func runDoctorChecks(w io.Writer, home string) bool {
+	ok := true
+	for _, check := range doctorChecks {
+		result, passed := check.run(home)
+		status := "ok"
+		if !passed {
+			status = "FAIL"
+			ok = false
+		}
+		fmt.Fprintf(w, "[%s] %s: %s\n", status, check.name, result)
+	}
+	return ok
+}
+
+// checkRepository checks that init finished
+func checkRepository(home string) (string, bool) {
+	state, err := core.CheckInitState(home)
+	if err != nil {
+		return err.Error(), false
+	}
+	switch {
+	case !state.Exists:
+		return "not initialized, run 'dotpilot init'", false
+	case !state.Complete():
+		return fmt.Sprintf("init was interrupted, it is missing the %s; run 'dotpilot init --repair'", strings.Join(state.Missing(), ", ")), false
+	}
+	return core.DotpilotDir(home), true
+}
+
+// checkRemote checks that the origin remote is reachable
+func checkRemote(home string) (string, bool) {
+	dotpilotDir := core.DotpilotDir(home)
+	if err := core.CheckInitialized(dotpilotDir); err != nil {
+		return "skipped, no repository", false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	v, err := core.VerifyRemote(ctx, dotpilotDir)
+	if err != nil {
+		return err.Error(), false
+	}
+	if !v.OK() {
+		result := fmt.Sprintf("cannot reach %s: %s", v.URL, v.Problem)
+		if hint := remoteProblemHint(v.Problem); hint != "" {
+			result += ". " + hint
+		}
+		return result, false
+	}
+	return fmt.Sprintf("reached %s with %s credentials", v.URL, v.Auth), true
+}
+
+// checkTracking checks that the tracking paths agree with the repository and
+// the links in the home directory
+func checkTracking(home string) (string, bool) {
+	if err := core.CheckInitialized(core.DotpilotDir(home)); err != nil {
+		return "skipped, no repository", false
+	}
+
+	repo, err := core.OpenRepository()
+	if err != nil {
+		return err.Error(), false
+	}
+	drift, err := repo.CheckTracking()
+	if err != nil {
+		return err.Error(), false
+	}
+	if !drift.Empty() {
+		var problems []string
+		if n := len(drift.MissingFromRepo); n > 0 {
+			problems = append(problems, fmt.Sprintf("%d tracked paths missing from the repository", n))
+		}
+		if n := len(drift.NotInConfig); n > 0 {
+			problems = append(problems, fmt.Sprintf("%d dotfiles not tracked", n))
+		}
+		if n := len(drift.UntrackedLinks); n > 0 {
+			problems = append(problems, fmt.Sprintf("%d links into the repository not tracked", n))
+		}
+		return strings.Join(problems, ", ") + "; run 'dotpilot status --fix'", false
+	}
+	return fmt.Sprintf("%d tracked paths agree with the repository", len(repo.Config.TrackingPaths)), true
+}
+
+func init() {
+	doctorCmd.Flags().DurationVar(&doctorTimeout, "timeout", 15*time.Second, "How long to wait for the remote")
+	rootCmd.AddCommand(doctorCmd)
+}
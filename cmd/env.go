@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	envFrom     string
+	envForce    bool
+	envNoCommit bool
+)
+
+// envCmd represents the env command
+var envCmd = &cobra.Command{
+	Use:   "env",
+	Short: "Manage environments",
+	Long: `Create, delete and rename the environments of the repository, the layer
+directories below envs/, and show which one env-rules.json selects.
+
+For example:
+  dotpilot env create work --from common
+  dotpilot env rename work office
+  dotpilot env delete office
+  dotpilot env detect`,
+}
+
+// envDetectCmd represents the env detect command
+var envDetectCmd = &cobra.Command{
+	Use:   "detect",
+	Short: "Show the environment env-rules.json selects for this machine",
+	Long: `Show which rule of env-rules.json, in the root of the repository, matches
+this machine and the environment it selects.
+
+Each rule sets an environment and conditions that must all hold: a hostname
+glob, an operating system (like macOS, ubuntu or linux) and a variable that
+must be set, or NAME=value for a value it must have. The first matching rule
+wins, and a rule without conditions matches every machine:
+
+  [
+    {"hostname": "*-prod", "env": "prod"},
+    {"os": "macOS", "env_var": "WORK_LAPTOP", "env": "work"},
+    {"env": "personal"}
+  ]
+
+The rules select the environment when ~/.dotpilotrc doesn't set one, or with
+--auto-env even when it does. The selected environment isn't saved.
+
+For example:
+  dotpilot env detect`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+
+		match, ok, err := core.DetectEnvironment(repo.Dir)
+		if err != nil {
+			return withMessage(err, "Failed to read the environment rules")
+		}
+		if !ok {
+			fmt.Fprintf(out, "No rule of env-rules.json matches this machine, the environment is %s.\n", repo.Environment())
+			return nil
+		}
+		fmt.Fprintf(out, "Environment %s, selected by %s.\n", match.Rule.Env, match)
+		if match.Rule.Env != repo.Environment() {
+			fmt.Fprintf(out, "~/.dotpilotrc sets %s, pass --auto-env to use the rules anyway.\n", repo.Environment())
+		}
+		return nil
+	},
+}
+
+// envCreateCmd represents the env create command
+var envCreateCmd = &cobra.Command{
+	Use:   "create [name]",
+	Short: "Create an environment",
+	Long: `Create the envs/<name>/ directory of a new environment and commit it.
+
+The environment starts out empty unless --from names a layer to copy the files
+of, either "common" or another environment.
+
+For example:
+  dotpilot env create work
+  dotpilot env create staging --from prod`,
+	Args: nonEmptyArgs(cobra.ExactArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+		dotpilotDir := repo.Dir
+		name := args[0]
+
+		if err := core.CreateEnvironment(dotpilotDir, name, envFrom); err != nil {
+			return withMessage(err, "Failed to create environment")
+		}
+
+		message := fmt.Sprintf("Created environment %s", name)
+		if envFrom != "" {
+			message += " from " + envFrom
+		}
+		utils.Logger.Info().Msg(message)
+		return commitOrStage(dotpilotDir, message, envNoCommit)
+	},
+}
+
+// envDeleteCmd represents the env delete command
+var envDeleteCmd = &cobra.Command{
+	Use:   "delete [name]",
+	Short: "Delete an environment",
+	Long: `Delete the envs/<name>/ directory of an environment and commit the removal.
+The files stay in the history.
+
+The current environment is only deleted with --force; the links it applied are
+removed and the current environment falls back to "default". Run
+'dotpilot apply' afterwards to link the files of the remaining layers.
+
+For example:
+  dotpilot env delete staging
+  dotpilot env delete work --force --yes`,
+	Args: nonEmptyArgs(cobra.ExactArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+		dotpilotDir := repo.Dir
+		name := args[0]
+
+		current := name == repo.Environment()
+		if current && !envForce {
+			return withMessage(fmt.Errorf("%w: %s", core.ErrEnvironmentInUse, name), "Refusing to delete the current environment")
+		}
+		if !utils.PromptYesNo(fmt.Sprintf("Delete environment %s and all of its files?", name)) {
+			utils.Logger.Info().Msg("Nothing deleted")
+			return nil
+		}
+
+		removed, err := core.DeleteEnvironment(dotpilotDir, repo.Home, name)
+		for _, target := range removed {
+			utils.Logger.Info().Msgf("Removed link %s", target)
+		}
+		if err != nil {
+			return withMessage(err, "Failed to delete environment")
+		}
+
+		if current && name != "default" {
+			if err := core.UpdateEnvironment("default"); err != nil {
+				utils.Logger.Error().Err(err).Msg("Failed to update configuration")
+			}
+			utils.Logger.Info().Msg("Switched to the default environment")
+		}
+
+		message := fmt.Sprintf("Deleted environment %s", name)
+		utils.Logger.Info().Msg(message)
+		return commitOrStage(dotpilotDir, message, envNoCommit)
+	},
+}
+
+// envRenameCmd represents the env rename command
+var envRenameCmd = &cobra.Command{
+	Use:   "rename [old] [new]",
+	Short: "Rename an environment",
+	Long: `Move the envs/<old>/ directory to envs/<new>/ and commit the move. Links
+into the old directory are pointed at the new one, and ~/.dotpilotrc is
+updated if it is the current environment.
+
+Other machines using the old name need to switch environment after pulling.
+
+For example:
+  dotpilot env rename work office`,
+	Args: nonEmptyArgs(cobra.ExactArgs(2)),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+		dotpilotDir := repo.Dir
+
+		relinked, err := core.RenameEnvironment(dotpilotDir, repo.Home, args[0], args[1])
+		for _, target := range relinked {
+			utils.Logger.Debug().Msgf("Relinked %s", target)
+		}
+		if err != nil {
+			return withMessage(err, "Failed to rename environment")
+		}
+
+		message := fmt.Sprintf("Renamed environment %s to %s", args[0], args[1])
+		utils.Logger.Info().Msg(message)
+		return commitOrStage(dotpilotDir, message, envNoCommit)
+	},
+}
+
+func init() {
+	envCreateCmd.Flags().StringVar(&envFrom, "from", "", "Copy the files of this layer: common or an environment")
+	envDeleteCmd.Flags().BoolVar(&envForce, "force", false, "Delete the environment even if it is the current one")
+	for _, c := range []*cobra.Command{envCreateCmd, envDeleteCmd, envRenameCmd} {
+		c.Flags().BoolVar(&envNoCommit, "no-commit", false, "Stage the change without committing it")
+	}
+
+	envDeleteCmd.ValidArgsFunction = completeEnvironments
+	envRenameCmd.ValidArgsFunction = completeEnvironments
+	registerFlagCompletion(envCreateCmd, "from", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return append([]string{"common"}, environmentNames()...), cobra.ShellCompDirectiveNoFileComp
+	})
+
+	envCmd.AddCommand(envCreateCmd)
+	envCmd.AddCommand(envDeleteCmd)
+	envCmd.AddCommand(envRenameCmd)
+	envCmd.AddCommand(envDetectCmd)
+	rootCmd.AddCommand(envCmd)
+}
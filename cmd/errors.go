@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+)
+
+// Exit codes, one per class of failure, so scripts can react to each. A
+// command returns the error that stopped it from RunE and dotpilot exits
+// with its code, see ExitCode.
+const (
+	ExitOK             = 0
+	ExitGeneral        = 1 // Any other failure, including invalid flags and arguments
+	ExitNotInitialized = 2 // The dotpilot repository doesn't exist, run 'dotpilot init'
+	ExitNetwork        = 3 // The remote couldn't be reached or rejected the credentials
+	ExitConflict       = 4 // Conflicts were left unresolved and need attention
+	ExitCrypto         = 5 // A secret couldn't be found, encrypted or decrypted, or gpg, sops or a key is missing
+	// ExitInterrupted is the exit code after Ctrl-C or SIGTERM, 128 plus
+	// SIGINT like shells report it
+	ExitInterrupted = 130
+)
+
+// ExitCode maps err to the exit code of its class of failure. Errors are
+// matched with errors.Is, so wrapped core errors map like the originals, and
+// an error of exitStatus has its own code.
+func ExitCode(err error) int {
+	var exitErr *exitError
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.As(err, &exitErr):
+		return exitErr.code
+	case errors.Is(err, core.ErrNotInitialized):
+		return ExitNotInitialized
+	case errors.Is(err, core.ErrNetwork), errors.Is(err, core.ErrAuthFailed):
+		return ExitNetwork
+	case errors.Is(err, core.ErrConflict):
+		return ExitConflict
+	case errors.Is(err, core.ErrEncryptFailed), errors.Is(err, core.ErrDecryptFailed),
+		errors.Is(err, core.ErrSecretNotFound), errors.Is(err, core.ErrGPGUnavailable),
+		errors.Is(err, core.ErrSopsUnavailable), errors.Is(err, core.ErrNoGPGKey):
+		return ExitCrypto
+	case errors.Is(err, core.ErrInterrupted):
+		return ExitInterrupted
+	}
+	return ExitGeneral
+}
+
+// commandError is an error a command stopped with, logged under msg by
+// LogError
+type commandError struct {
+	msg string
+	err error
+}
+
+func (e *commandError) Error() string {
+	return e.msg + ": " + e.err.Error()
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+// withMessage returns err for a command to stop with, logged under msg with a
+// hint for known core errors. The command exits with the exit code of err.
+func withMessage(err error, msg string) error {
+	return &commandError{msg: msg, err: err}
+}
+
+// exitError stops a command that has reported why already, with code as its
+// exit code
+type exitError struct {
+	code int
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+// exitStatus returns an error that makes the command exit with code without
+// logging anything
+func exitStatus(code int) error {
+	return &exitError{code: code}
+}
+
+// LogError logs the error a command stopped with, with a hint for known core
+// errors. Errors of exitStatus were reported by the command already.
+func LogError(err error) {
+	var exitErr *exitError
+	if err == nil || errors.As(err, &exitErr) {
+		return
+	}
+
+	event := utils.Logger.Error()
+	msg := err.Error()
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) {
+		event = event.Err(cmdErr.err)
+		msg = cmdErr.msg
+	}
+	if hint := errorHint(err); hint != "" {
+		event = event.Str("hint", hint)
+	}
+	event.Msg(msg)
+}
+
+// errorHint returns a suggestion for how to recover from err, if there is one
+func errorHint(err error) string {
+	switch {
+	case errors.Is(err, core.ErrNotInitialized):
+		return "Run 'dotpilot init' first."
+	case errors.Is(err, core.ErrSecretExists):
+		return "Use --overwrite to replace it."
+	case errors.Is(err, core.ErrSecretNotFound):
+		return "Run 'dotpilot secrets list' or 'dotpilot sops list' to see the available secrets."
+	case errors.Is(err, core.ErrNoGPGKey):
+		return "Create a key with 'gpg --full-generate-key'."
+	case errors.Is(err, core.ErrStashExists):
+		return "Run 'dotpilot sync --stash' without local changes to re-apply it."
+	case errors.Is(err, core.ErrConflict):
+		return "Run 'dotpilot resolve' to resolve the remaining conflicts."
+	case errors.Is(err, core.ErrManagedDestination):
+		return "Pick a destination outside the repository, or use --replace-link if the destination is a dotpilot symlink."
+	case errors.Is(err, core.ErrUntrackableSource):
+		return "Track the dotfiles in it one by one, like 'dotpilot track ~/.zshrc ~/.config/nvim'."
+	case errors.Is(err, core.ErrSnapshotExists):
+		return "Pick another name, or delete the old snapshot with 'dotpilot snapshot delete'."
+	case errors.Is(err, core.ErrSnapshotNotFound):
+		return "Run 'dotpilot snapshot list' to see the available snapshots."
+	case errors.Is(err, core.ErrLocked):
+		return "Wait for it to finish, or use --force-unlock if that process is stuck."
+	case errors.Is(err, core.ErrNetwork):
+		return "Check your network connection and the remote URL, then try again."
+	case errors.Is(err, core.ErrAuthFailed):
+		return "For SSH remotes, load a key with access into ssh-agent; for HTTPS remotes, set DOTPILOT_GIT_TOKEN."
+	case errors.Is(err, core.ErrDiskFull):
+		return "Free up some disk space and try again."
+	case errors.Is(err, core.ErrInterrupted):
+		return "Nothing was left behind, run the command again to start over."
+	case errors.Is(err, core.ErrEnvironmentExists):
+		return "Pick another name, or delete the old environment with 'dotpilot env delete'."
+	case errors.Is(err, core.ErrEnvironmentNotFound):
+		return "The environments are the directories below envs/ in the repository."
+	case errors.Is(err, core.ErrEnvironmentInUse):
+		return "Switch to another environment first, or use --force."
+	case errors.Is(err, core.ErrApplyInterrupted):
+		return "Run 'dotpilot apply --recover' to roll back its partial changes."
+	case errors.Is(err, core.ErrSensitiveContent):
+		return "Store it encrypted with 'dotpilot secrets add' instead, or use --force-plaintext if it isn't a secret."
+	case errors.Is(err, core.ErrApplyQuit):
+		return "Run the command again to review the remaining changes."
+	case errors.Is(err, core.ErrConflictsAborted):
+		return "Nothing was changed. Run 'dotpilot resolve' when you are ready, or pick a strategy with --strategy."
+	case errors.Is(err, core.ErrUntrustedCommit):
+		return "Check who pushed those commits. To trust their key, add its fingerprint to \"trusted_signers\" in ~/.dotpilotrc."
+	case errors.Is(err, core.ErrCommitRejected):
+		return "The changes are staged. Fix what the hook reported and run 'dotpilot commit', or use --no-verify to commit anyway."
+	case errors.Is(err, core.ErrFileExists):
+		return "Move the existing file out of the way and try again."
+	case errors.Is(err, core.ErrLayoutTooNew):
+		return "Update dotpilot with 'dotpilot self-update'."
+	}
+	return ""
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+// fetchCmd represents the fetch command
+var fetchCmd = &cobra.Command{
+	Use:   "fetch",
+	Short: "Check the remote for changes without applying them",
+	Long: `Fetch the remote repository and show how far this machine is ahead of or
+behind it, including the commits that the next sync would pull.
+
+Unlike sync, fetch only updates the remote-tracking refs: no files in the
+repository or the home directory are changed.
+
+For example:
+  dotpilot fetch`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+		dotpilotDir := repo.Dir
+
+		utils.Logger.Info().Msg("Fetching changes from remote...")
+		if err := core.FetchChanges(dotpilotDir); err != nil {
+			return withMessage(err, "Failed to fetch changes")
+		}
+
+		remoteStatus, err := core.GetRemoteStatus(dotpilotDir)
+		if err != nil {
+			return withMessage(err, "Failed to get remote status")
+		}
+		printRemoteStatus(out, remoteStatus)
+
+		incoming, err := core.IncomingCommits(dotpilotDir)
+		if err != nil {
+			return withMessage(err, "Failed to list incoming commits")
+		}
+		if len(incoming) > 0 {
+			fmt.Fprintln(out)
+			fmt.Fprintln(out, "=== Incoming Commits ===")
+			for _, c := range incoming {
+				fmt.Fprintf(out, "%s %s (%s, %s)\n", c.Hash[:7], c.Subject, c.Author, c.When.Local().Format("2006-01-02 15:04"))
+			}
+			fmt.Fprintln(out)
+			fmt.Fprintln(out, "Run 'dotpilot sync' to pull and apply them.")
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fetchCmd)
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	stowEnv       string
+	stowPackages  []string
+	stowFold      bool
+	stowDotfiles  bool
+	stowOverwrite bool
+	stowDryRun    bool
+	stowNoCommit  bool
+)
+
+// importStowCmd represents the import-stow command
+var importStowCmd = &cobra.Command{
+	Use:   "import-stow [stow-dir]",
+	Short: "Import dotfiles from a GNU Stow directory",
+	Long: `Import the packages of a GNU Stow directory into dotpilot.
+
+Every top-level directory of the stow directory is a package whose contents
+mirror the home directory. The files are copied into the chosen layer (common
+by default) and the links in the home directory are switched from the stow
+directory to the dotpilot repository. Stow's ignore rules, including
+.stow-local-ignore, are honored.
+
+By default every file gets its own symlink, which is how dotpilot applies
+files. With --fold, directories that belong to a single package are linked as
+a whole, like Stow's tree folding.
+
+For example:
+  dotpilot import-stow ~/dotfiles
+  dotpilot import-stow ~/dotfiles --package zsh --package nvim
+  dotpilot import-stow ~/dotfiles --env dev --fold
+  dotpilot import-stow ~/dotfiles --dotfiles --dry-run`,
+	Args: nonEmptyArgs(cobra.ExactArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+		dotpilotDir := repo.Dir
+
+		stowDir, err := expandHome(repo.Home, args[0])
+		if err != nil {
+			return err
+		}
+		opts := core.StowImportOptions{
+			Layer:     layerDir(stowEnv),
+			Packages:  stowPackages,
+			Fold:      stowFold,
+			Dotfiles:  stowDotfiles,
+			Overwrite: stowOverwrite,
+			DryRun:    stowDryRun,
+		}
+
+		utils.Logger.Info().Msgf("Importing %s into %s...", stowDir, opts.Layer)
+		imports, err := core.ImportStow(dotpilotDir, stowDir, opts)
+		if err != nil {
+			return withMessage(err, "Failed to import stow directory")
+		}
+
+		if len(imports) == 0 {
+			utils.Logger.Info().Msg("No files found to import")
+			return nil
+		}
+
+		files := 0
+		for _, imp := range imports {
+			kind := "file"
+			if imp.Dir {
+				kind = fmt.Sprintf("dir, %d files", imp.Files)
+			}
+			fmt.Fprintf(out, "%-12s %s -> %s (%s)\n", imp.Package, imp.Target, imp.RepoPath, kind)
+			files += imp.Files
+		}
+
+		if stowDryRun {
+			utils.Logger.Info().Msgf("[DRY RUN] Would import %d files as %d links", files, len(imports))
+			return nil
+		}
+
+		if err := commitOrStage(dotpilotDir, fmt.Sprintf("Imported %d files from GNU Stow", files), stowNoCommit); err != nil {
+			return err
+		}
+		utils.Logger.Info().Msgf("Imported %d files as %d links", files, len(imports))
+		return nil
+	},
+}
+
+func init() {
+	importStowCmd.Flags().StringVar(&stowEnv, "env", "common", "Layer to import into (common, machine, or specific environment name)")
+	importStowCmd.Flags().StringSliceVarP(&stowPackages, "package", "p", nil, "Only import these packages (can be repeated)")
+	importStowCmd.Flags().BoolVar(&stowFold, "fold", false, "Link directories that belong to a single package as a whole")
+	importStowCmd.Flags().BoolVar(&stowDotfiles, "dotfiles", false, "Translate dot- prefixes to dotfiles, like stow --dotfiles")
+	importStowCmd.Flags().BoolVar(&stowOverwrite, "overwrite", false, "Overwrite files that already exist in the layer")
+	importStowCmd.Flags().BoolVar(&stowDryRun, "dry-run", false, "Show what would be imported without changing anything")
+	importStowCmd.Flags().BoolVar(&stowNoCommit, "no-commit", false, "Stage the imported files without committing them")
+	registerFlagCompletion(importStowCmd, "env", completeLayerFlag)
+
+	rootCmd.AddCommand(importStowCmd)
+}
@@ -1,8 +1,12 @@
 package cmd
 
 import (
+        "context"
+        "errors"
         "fmt"
+        "io"
         "os"
+        "strings"
 
         "github.com/dotpilot/core"
         "github.com/dotpilot/utils"
@@ -16,6 +20,12 @@ var (
         skipPackages  bool
         skipHooks     bool
         packageSystem string
+        sparsePaths   []string
+        subdir        string
+        cloneDepth    int
+        shallowClone  bool
+        repairInit    bool
+        initDryRun    bool
 )
 
 // initCmd represents the init command
@@ -26,65 +36,140 @@ var initCmd = &cobra.Command{
 setting up configurations, and optionally installing packages and running hooks.
 
 For example:
-  dotpilot init --remote https://github.com/username/dotfiles.git --env dev`,
-        Run: func(cmd *cobra.Command, args []string) {
+  dotpilot init --remote https://github.com/username/dotfiles.git --env dev
+  dotpilot init --remote https://github.com/username/dotfiles.git --sparse common --sparse envs/dev
+  dotpilot init --remote https://github.com/username/configs.git --subdir dotfiles
+  dotpilot init --remote https://github.com/username/dotfiles.git --shallow
+  dotpilot init --remote https://github.com/username/dotfiles.git --repair
+
+With --subdir, the dotfiles live in a subdirectory of a larger repository: the
+whole repository is cloned, but the common/, envs/ and machine/ layers are
+read from the subdirectory and commits only include changes inside it.
+
+With --depth, only the latest commits are cloned, and --shallow clones just the
+latest one. A shallow clone is faster and smaller, which suits provisioning a
+new machine, but log, history and status only see the commits it has. Syncing
+works as usual.
+
+If a previous init was interrupted, for example after cloning but before
+writing ~/.dotpilotrc, init offers to resume it instead of requiring --force,
+which would throw away the clone. Only the missing steps are done again; a
+repository without any commits is cloned again. --repair resumes without
+asking.
+
+--force deletes the dotpilot directory and starts over. What only exists
+there is lost: commits that weren't pushed, uncommitted changes, and the
+files kept out of git, like the AES key of the secrets and the snapshots.
+init lists them, offers to back up the AES key to the home directory, and
+asks before deleting anything; --yes answers yes to both. With --dry-run it
+only reports what --force would delete.
+
+  dotpilot init --remote https://github.com/username/dotfiles.git --force --dry-run`,
+        RunE: func(cmd *cobra.Command, args []string) error {
                 if remoteRepo == "" {
-                        utils.Logger.Error().Msg("Remote repository URL is required")
                         cmd.Help()
-                        os.Exit(1)
+                        return errors.New("Remote repository URL is required")
+                }
+
+                depth := cloneDepth
+                if shallowClone {
+                        depth = 1
+                }
+                if depth < 0 {
+                        return errors.New("--depth must be a positive number of commits")
                 }
 
                 // Get the home directory
-                home, err := os.UserHomeDir()
+                home, err := core.Home()
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to get home directory")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to get home directory")
                 }
 
                 // Create .dotpilot directory
                 dotpilotDir := fmt.Sprintf("%s/.dotpilot", home)
-                if _, err := os.Stat(dotpilotDir); !os.IsNotExist(err) && !forceInit {
-                        utils.Logger.Error().Msg("Dotpilot directory already exists. Use --force to reinitialize")
-                        os.Exit(1)
+                state, err := core.CheckInitState(home)
+                if err != nil {
+                        return withMessage(err, "Failed to inspect the dotpilot directory")
                 }
+                if state.Exists && !forceInit {
+                        if !state.Resumable() {
+                                return errors.New("Dotpilot directory already exists. Use --force to reinitialize")
+                        }
 
-                if forceInit && !os.IsNotExist(err) {
+                        // Resume an interrupted init rather than throwing
+                        // away what it got done
+                        missing := strings.Join(state.Missing(), ", ")
+                        if !repairInit && !utils.PromptYesNo(fmt.Sprintf("A previous init was interrupted, it is missing the %s. Resume it?", missing)) {
+                                return errors.New("Dotpilot directory is partially initialized. Use --repair to resume the interrupted init, or --force to start over")
+                        }
+                        if err := lockRepository(home); err != nil {
+                                return err
+                        }
+                        utils.Logger.Info().Msgf("Resuming the interrupted init, adding the %s", missing)
+                }
+
+                if initDryRun && !forceInit {
+                        return errors.New("--dry-run reports what --force would delete, use both")
+                }
+                if forceInit && (state.Exists || initDryRun) {
+                        report, err := core.InspectReinit(home)
+                        if err != nil {
+                                return withMessage(err, "Failed to inspect the dotpilot directory")
+                        }
+                        printReinitReport(cmd.OutOrStdout(), home, report)
+                        if initDryRun {
+                                return nil
+                        }
+                        if err := confirmReinit(home, report); err != nil {
+                                return err
+                        }
+                }
+
+                if forceInit && state.Exists {
+                        if err := lockRepository(home); err != nil {
+                                return err
+                        }
                         utils.Logger.Info().Msg("Removing existing dotpilot directory...")
                         if err := os.RemoveAll(dotpilotDir); err != nil {
-                                utils.Logger.Error().Err(err).Msg("Failed to remove existing dotpilot directory")
-                                os.Exit(1)
+                                return withMessage(err, "Failed to remove existing dotpilot directory")
                         }
                 }
 
-                // Initialize dotpilot
+                // Initialize dotpilot, Ctrl-C aborts the clone and removes
+                // the partial clone
+                ctx, stop := utils.InterruptContext(context.Background())
                 utils.Logger.Info().Msgf("Initializing dotpilot with repository: %s", remoteRepo)
-                if err := core.InitializeRepo(remoteRepo, dotpilotDir, environment); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to initialize repository")
-                        os.Exit(1)
+                err = core.InitializeRepo(ctx, remoteRepo, dotpilotDir, environment, sparsePaths, subdir, depth)
+                stop()
+                if err != nil {
+                        return withMessage(err, "Failed to initialize repository")
+                }
+                if err := lockRepository(home); err != nil {
+                        return err
                 }
 
+                // The layers may live in a subdirectory of the repository
+                dotpilotDir = core.DotpilotDir(home)
+
                 // Apply configurations
                 utils.Logger.Info().Msg("Applying configurations...")
                 if err := core.ApplyConfigurations(dotpilotDir, environment); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to apply configurations")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to apply configurations")
                 }
 
                 // Run pre-installation hooks
                 if !skipHooks {
                         utils.Logger.Info().Msg("Running pre-installation hooks...")
                         if err := core.RunHooks(dotpilotDir, environment, "preinstall.sh"); err != nil {
-                                utils.Logger.Error().Err(err).Msg("Failed to run pre-installation hooks")
-                                os.Exit(1)
+                                return withMessage(err, "Failed to run pre-installation hooks")
                         }
                 }
 
                 // Install packages
                 if !skipPackages {
                         utils.Logger.Info().Msg("Installing packages...")
-                        if err := core.InstallPackages(dotpilotDir, environment, packageSystem); err != nil {
-                                utils.Logger.Error().Err(err).Msg("Failed to install packages")
-                                os.Exit(1)
+                        if err := core.InstallPackages(dotpilotDir, environment, packageSystem, forceInit); err != nil {
+                                return withMessage(err, "Failed to install packages")
                         }
                 }
 
@@ -92,12 +177,12 @@ For example:
                 if !skipHooks {
                         utils.Logger.Info().Msg("Running post-installation hooks...")
                         if err := core.RunHooks(dotpilotDir, environment, "postinstall.sh"); err != nil {
-                                utils.Logger.Error().Err(err).Msg("Failed to run post-installation hooks")
-                                os.Exit(1)
+                                return withMessage(err, "Failed to run post-installation hooks")
                         }
                 }
 
                 utils.Logger.Info().Msg("Dotpilot initialized successfully!")
+                return nil
         },
 }
 
@@ -108,16 +193,22 @@ func init() {
         initCmd.Flags().BoolVar(&skipPackages, "skip-packages", false, "Skip package installation")
         initCmd.Flags().BoolVar(&skipHooks, "skip-hooks", false, "Skip running hooks")
         initCmd.Flags().StringVar(&packageSystem, "package-system", "", "Override automatic package system detection (apt, brew, yay)")
+        initCmd.Flags().StringSliceVar(&sparsePaths, "sparse", nil, "Only apply repo paths matching this pattern (repeatable, e.g. common, envs/dev, machine/*)")
+        initCmd.Flags().StringVar(&subdir, "subdir", "", "Subdirectory of the repository that holds the dotfiles, for monorepos")
+        initCmd.Flags().IntVar(&cloneDepth, "depth", 0, "Only clone this many of the latest commits (default: the full history)")
+        initCmd.Flags().BoolVar(&shallowClone, "shallow", false, "Only clone the latest commit, like --depth 1")
+        initCmd.Flags().BoolVar(&repairInit, "repair", false, "Resume an interrupted init without asking, instead of starting over")
+        initCmd.Flags().BoolVar(&initDryRun, "dry-run", false, "With --force, report what would be deleted without deleting it")
 
         initCmd.MarkFlagRequired("remote")
+        initCmd.MarkFlagsMutuallyExclusive("depth", "shallow")
+        initCmd.MarkFlagsMutuallyExclusive("repair", "force")
         
-        // Add completion for environment flag
-        if err := initCmd.RegisterFlagCompletionFunc("env", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
-                return []string{"default", "dev", "prod", "test", "hardened"}, cobra.ShellCompDirectiveNoFileComp
-        }); err != nil {
-                utils.Logger.Debug().Err(err).Msg("Failed to register environment flag completion")
-        }
-        
+        // Complete the environments and remotes of an existing repository,
+        // for reinitializing it with --force
+        registerFlagCompletion(initCmd, "env", completeEnvironmentFlag)
+        registerFlagCompletion(initCmd, "remote", completeRemoteURLFlag)
+
         // Add completion for package system flag
         if err := initCmd.RegisterFlagCompletionFunc("package-system", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
                 return []string{"apt", "brew", "yay", "dnf", "pacman", "zypper"}, cobra.ShellCompDirectiveNoFileComp
@@ -125,3 +216,54 @@ func init() {
                 utils.Logger.Debug().Err(err).Msg("Failed to register package-system flag completion")
         }
 }
+
+// printReinitReport prints what init --force deletes, and what of that exists
+// nowhere else
+func printReinitReport(out io.Writer, home string, report core.ReinitReport) {
+        if report.Files == 0 {
+                fmt.Fprintf(out, "%s doesn't exist, there is nothing to delete.\n", tildePath(home, report.Dir))
+                return
+        }
+        fmt.Fprintf(out, "--force deletes %s: %d files, %s.\n", tildePath(home, report.Dir), report.Files, utils.FormatSize(report.Size))
+        if !report.AtRisk() {
+                fmt.Fprintln(out, "Everything in it is committed and pushed, init clones it again.")
+                return
+        }
+
+        fmt.Fprintln(out, "\nThese only exist there and are lost:")
+        if report.RemoteErr != nil {
+                fmt.Fprintf(out, "- commits that may not have been pushed, they can't be compared with the remote: %v\n", report.RemoteErr)
+        } else if report.Unpushed > 0 {
+                fmt.Fprintf(out, "- %d commits that weren't pushed, see 'dotpilot log'\n", report.Unpushed)
+        }
+        if len(report.Uncommitted) > 0 {
+                fmt.Fprintf(out, "- %d uncommitted changes:\n", len(report.Uncommitted))
+                for _, file := range report.Uncommitted {
+                        fmt.Fprintf(out, "    %s\n", file)
+                }
+        }
+        for _, file := range report.LocalOnly {
+                fmt.Fprintf(out, "- %s, %s\n", tildePath(home, file.Path), file.Description)
+        }
+}
+
+// confirmReinit offers to back up the AES key and asks before init --force
+// deletes the dotpilot directory, failing if the answer is no
+func confirmReinit(home string, report core.ReinitReport) error {
+        if report.Files == 0 {
+                return nil
+        }
+
+        if report.KeyFile != "" && utils.PromptYesNo("Back up the AES key to your home directory first?") {
+                backup, err := core.BackupSecretKey(home, report.KeyFile)
+                if err != nil {
+                        return withMessage(err, "Failed to back up the AES key")
+                }
+                utils.Logger.Info().Msgf("Backed up the AES key to %s, copy it to %s to decrypt the secrets again", backup, report.KeyFile)
+        }
+
+        if !utils.PromptYesNo(fmt.Sprintf("Delete %s and everything in it?", tildePath(home, report.Dir))) {
+                return errors.New("Nothing was deleted. Use --yes to reinitialize without asking")
+        }
+        return nil
+}
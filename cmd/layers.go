@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+// layersCmd represents the layers command
+var layersCmd = &cobra.Command{
+	Use:   "layers",
+	Short: "Turn layers on or off",
+	Long: `Show which layers are applied, and turn the common, env and machine layers
+off or on again without deleting their directories.
+
+A disabled layer is recorded in the disabled_layers option of ~/.dotpilotrc.
+apply, sync and bootstrap don't apply it, and conflict detection, diff and
+status leave it out, until it is enabled again. What it linked before stays
+in place. --skip-common, --skip-env and --skip-machine on apply, sync and
+bootstrap turn a layer off for a single run instead.
+
+For example:
+  dotpilot layers
+  dotpilot layers disable machine
+  dotpilot layers enable machine`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		openRepository()
+
+		disabled, err := core.DisabledLayers()
+		if err != nil {
+			return withMessage(err, "Invalid configuration in ~/.dotpilotrc")
+		}
+		order, err := core.LayerOrder()
+		if err != nil {
+			return withMessage(err, "Invalid layer order in ~/.dotpilotrc")
+		}
+		for _, layer := range order {
+			state := "enabled"
+			for _, l := range disabled {
+				if l == layer {
+					state = "disabled"
+				}
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%-8s %s\n", layer, state)
+		}
+		return nil
+	},
+}
+
+// layersEnableCmd represents the layers enable command
+var layersEnableCmd = &cobra.Command{
+	Use:       "enable [layer]",
+	Short:     "Apply a disabled layer again",
+	Long:      `Remove a layer, common, env or machine, from the disabled layers of ~/.dotpilotrc.`,
+	Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	ValidArgs: core.DefaultLayerOrder,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setLayerEnabled(cmd, args[0], true)
+	},
+}
+
+// layersDisableCmd represents the layers disable command
+var layersDisableCmd = &cobra.Command{
+	Use:   "disable [layer]",
+	Short: "Stop applying a layer",
+	Long: `Add a layer, common, env or machine, to the disabled layers of ~/.dotpilotrc.
+Its directory and the links it made are left alone.`,
+	Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	ValidArgs: core.DefaultLayerOrder,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setLayerEnabled(cmd, args[0], false)
+	},
+}
+
+// setLayerEnabled turns layer on or off in ~/.dotpilotrc and says so
+func setLayerEnabled(cmd *cobra.Command, layer string, enabled bool) error {
+	repo, err := openRepository()
+	if err != nil {
+		return err
+	}
+	if err := lockRepository(repo.Home); err != nil {
+		return err
+	}
+
+	state := "disabled"
+	if enabled {
+		state = "enabled"
+	}
+	changed, err := core.SetLayerEnabled(layer, enabled)
+	if err != nil {
+		return withMessage(err, "Failed to save the configuration")
+	}
+	if !changed {
+		fmt.Fprintf(cmd.OutOrStdout(), "The %s layer is already %s\n", layer, state)
+		return nil
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "The %s layer is now %s\n", layer, state)
+	return nil
+}
+
+// addSkipLayerFlags adds --skip-common, --skip-env and --skip-machine to cmd,
+// like bootstrap has, see skipLayers
+func addSkipLayerFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("skip-common", false, "Skip applying common dotfiles")
+	cmd.Flags().Bool("skip-env", false, "Skip applying environment-specific dotfiles")
+	cmd.Flags().Bool("skip-machine", false, "Skip applying machine-specific dotfiles")
+}
+
+// skipLayers turns off the layers of the --skip-* flags of cmd for this run
+func skipLayers(cmd *cobra.Command) error {
+	var skipped []string
+	for _, layer := range core.DefaultLayerOrder {
+		if skip, _ := cmd.Flags().GetBool("skip-" + layer); skip {
+			skipped = append(skipped, layer)
+		}
+	}
+	if err := core.SetSkippedLayers(skipped...); err != nil {
+		return withMessage(err, "Invalid layer")
+	}
+	if len(skipped) > 0 {
+		utils.Logger.Info().Msgf("Skipping the %s %s", strings.Join(skipped, " and "), plural(len(skipped), "layer", "layers"))
+	}
+	return nil
+}
+
+func init() {
+	layersCmd.AddCommand(layersEnableCmd)
+	layersCmd.AddCommand(layersDisableCmd)
+	rootCmd.AddCommand(layersCmd)
+}
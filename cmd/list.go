@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var listJSON bool
+
+// listCmd represents the list command
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the tracked dotfiles and their links",
+	Long: `List the dotfiles committed to the repository, of every layer, with the path
+each is applied to and the health of its link, see 'dotpilot status --help'.
+
+With --json, the list is printed as a JSON array of objects with the path,
+layer, target and linkStatus of each file, for editors and scripts.
+
+For example:
+  dotpilot list
+  dotpilot list --json`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+
+		reports, err := repo.ListDotfiles()
+		if err != nil {
+			return withMessage(err, "Failed to list the tracked files")
+		}
+
+		if listJSON {
+			if err := printJSON(out, reports); err != nil {
+				return withMessage(err, "Failed to encode the tracked files")
+			}
+			return nil
+		}
+		if len(reports) == 0 {
+			fmt.Fprintln(out, "No files are currently tracked.")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TARGET\tLAYER\tHEALTH\tREPO PATH")
+		for _, report := range reports {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", tildePath(repo.Home, report.Target), report.Layer, report.LinkStatus, report.Path)
+		}
+		w.Flush()
+		return nil
+	},
+}
+
+// printJSON writes v as indented JSON
+func printJSON(w io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+func init() {
+	listCmd.Flags().BoolVar(&listJSON, "json", false, "Print the files as JSON")
+	rootCmd.AddCommand(listCmd)
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	logFormat string
+	logLimit  int
+)
+
+// logFormats are the values accepted by --format
+var logFormats = []string{"oneline", "full", "json"}
+
+// logCmd represents the log command
+var logCmd = &cobra.Command{
+	Use:   "log",
+	Short: "Show the history of your dotfiles",
+	Long: `Show the commits of the dotpilot repository, newest first.
+
+The --format option picks the level of detail:
+  oneline  short hash and subject (default)
+  full     author, date, full message and the files each commit changed
+  json     an array of commits with the changed files, for tooling
+
+For example:
+  dotpilot log
+  dotpilot log -n 5 --format full
+  dotpilot log --format json | jq '.[0].files'`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+
+		if !isLogFormat(logFormat) {
+			return fmt.Errorf("Unknown format %q, use one of: %s", logFormat, strings.Join(logFormats, ", "))
+		}
+
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+
+		// Only full and json show files, which needs a tree diff per commit
+		entries, err := core.Log(repo.Dir, core.LogOptions{
+			Limit: logLimit,
+			Files: logFormat != "oneline",
+		})
+		if err != nil {
+			return withMessage(err, "Failed to read the history")
+		}
+
+		switch logFormat {
+		case "json":
+			if entries == nil {
+				entries = []core.LogEntry{}
+			}
+			data, err := json.MarshalIndent(entries, "", "  ")
+			if err != nil {
+				return withMessage(err, "Failed to encode the history")
+			}
+			fmt.Fprintln(out, string(data))
+		case "full":
+			printFullLog(out, entries)
+		default:
+			for _, entry := range entries {
+				fmt.Fprintf(out, "%s %s\n", entry.Hash[:7], entry.Subject)
+			}
+		}
+
+		// Only when the log reached the oldest commit there is. The JSON
+		// stays a plain array for tooling.
+		complete := logLimit <= 0 || len(entries) < logLimit
+		if shallow, err := core.IsShallow(repo.Dir); err == nil && shallow && complete && logFormat != "json" {
+			fmt.Fprintln(out)
+			fmt.Fprintln(out, "This is a shallow clone, older history isn't available.")
+		}
+		return nil
+	},
+}
+
+// isLogFormat reports whether format is one of logFormats
+func isLogFormat(format string) bool {
+	for _, f := range logFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// printFullLog prints entries like git log --name-status, with the action
+// (added, modified or deleted) abbreviated to its first letter
+func printFullLog(out io.Writer, entries []core.LogEntry) {
+	for i, entry := range entries {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		fmt.Fprintf(out, "commit %s\n", entry.Hash)
+		fmt.Fprintf(out, "Author: %s <%s>\n", entry.Author, entry.Email)
+		fmt.Fprintf(out, "Date:   %s\n\n", entry.When.Format("Mon Jan 2 15:04:05 2006 -0700"))
+		for _, line := range strings.Split(entry.Message, "\n") {
+			fmt.Fprintf(out, "    %s\n", line)
+		}
+		if len(entry.Files) > 0 {
+			fmt.Fprintln(out)
+			for _, file := range entry.Files {
+				fmt.Fprintf(out, "    %s %s\n", strings.ToUpper(file.Action[:1]), file.Path)
+			}
+		}
+	}
+}
+
+func init() {
+	logCmd.Flags().StringVar(&logFormat, "format", "oneline", "Output format: oneline, full or json")
+	logCmd.Flags().IntVarP(&logLimit, "max-count", "n", 0, "Show at most this many commits")
+
+	if err := logCmd.RegisterFlagCompletionFunc("format", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return logFormats, cobra.ShellCompDirectiveNoFileComp
+	}); err != nil {
+		utils.Logger.Debug().Err(err).Msg("Failed to register format flag completion")
+	}
+
+	rootCmd.AddCommand(logCmd)
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+var machineNoCommit bool
+
+// machineCmd represents the machine command
+var machineCmd = &cobra.Command{
+	Use:   "machine",
+	Short: "Manage the machine-specific layer",
+	Long:  `Manage the machine/<hostname>/ layer of this machine.`,
+}
+
+// machineFingerprintCmd represents the machine fingerprint command
+var machineFingerprintCmd = &cobra.Command{
+	Use:   "fingerprint",
+	Short: "Record the hostname, OS and architecture of this machine",
+	Long: `Record the hostname, OS and architecture of this machine in
+machine/<hostname>/machine.json.
+
+When "machine_guard" is enabled in ~/.dotpilotrc, apply and bootstrap skip a
+machine layer whose fingerprint does not match the current system, so a
+machine layer doesn't leak onto another machine that happens to share its
+hostname. Fields can be removed from machine.json to match any value.
+
+For example:
+  dotpilot machine fingerprint`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+		dotpilotDir := repo.Dir
+
+		fingerprintPath, err := core.WriteMachineFingerprint(dotpilotDir)
+		if err != nil {
+			return withMessage(err, "Failed to record machine fingerprint")
+		}
+
+		fingerprint, err := core.LoadMachineFingerprint(filepath.Dir(fingerprintPath))
+		if err != nil {
+			return withMessage(err, "Failed to read machine fingerprint")
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "%s: hostname=%s os=%s arch=%s\n", fingerprintPath, fingerprint.Hostname, fingerprint.OS, fingerprint.Arch)
+
+		if err := commitOrStage(dotpilotDir, fmt.Sprintf("Recorded fingerprint of %s", fingerprint.Hostname), machineNoCommit); err != nil {
+			return err
+		}
+		if !core.GetConfig().MachineGuard {
+			utils.Logger.Info().Msg("The fingerprint is only enforced with \"machine_guard\": true in ~/.dotpilotrc")
+		}
+		return nil
+	},
+}
+
+func init() {
+	machineFingerprintCmd.Flags().BoolVar(&machineNoCommit, "no-commit", false, "Stage the fingerprint without committing it")
+
+	machineCmd.AddCommand(machineFingerprintCmd)
+	rootCmd.AddCommand(machineCmd)
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/dotpilot/core"
+	"github.com/spf13/cobra"
+)
+
+var (
+	migrateDryRun   bool // Whether to only show what the migrations would change
+	migrateNoCommit bool // Whether to stage the migrations without committing them
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrade the repository layout to this version of dotpilot",
+	Long: `Bring a repository created by an older version of dotpilot up to date. The
+layout version of the repository is recorded in .dotpilot-version, and the
+migrations above it run in order:
+
+  1. Add the dotpilot entries to .gitignore
+  2. Index the secrets added before the metadata index
+
+Each migration lists what it changed and is committed on its own, together
+with the new layout version. Migrations only add what is missing, so running
+migrate again changes nothing. A repository created by 'dotpilot init' is at
+the latest version already. ~/.dotpilotrc isn't part of the repository, use
+'dotpilot repair-config' to rebuild a broken one.
+
+With --dry-run, the changes are listed without making them.
+
+For example:
+  dotpilot migrate --dry-run
+  dotpilot migrate`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+		dotpilotDir := repo.Dir
+
+		pending, err := core.PendingMigrations(dotpilotDir)
+		if err != nil {
+			return withMessage(err, "Failed to read the layout version")
+		}
+		if len(pending) == 0 {
+			fmt.Fprintf(out, "The repository is up to date (layout version %d).\n", core.LatestLayoutVersion())
+			return nil
+		}
+
+		for _, migration := range pending {
+			changes, err := migration.Run(dotpilotDir, migrateDryRun)
+			if err != nil {
+				return withMessage(err, fmt.Sprintf("Migration %d failed", migration.Version))
+			}
+
+			fmt.Fprintf(out, "%d. %s\n", migration.Version, migration.Description)
+			if len(changes) == 0 {
+				fmt.Fprintln(out, "   nothing to change")
+			}
+			for _, change := range changes {
+				fmt.Fprintf(out, "   %s\n", change)
+			}
+			if !migrateDryRun {
+				if err := commitOrStage(dotpilotDir, fmt.Sprintf("Migrate to layout version %d: %s", migration.Version, migration.Description), migrateNoCommit); err != nil {
+					return err
+				}
+			}
+		}
+
+		if migrateDryRun {
+			fmt.Fprintln(out, "Dry run, nothing was changed.")
+			return nil
+		}
+		fmt.Fprintf(out, "The repository is at layout version %d.\n", core.LatestLayoutVersion())
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+
+	migrateCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "Show what the migrations would change without changing anything")
+	migrateCmd.Flags().BoolVar(&migrateNoCommit, "no-commit", false, "Stage the changes without committing them")
+}
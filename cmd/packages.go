@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	packagesSystem string // Package system overriding the detected one
+	packagesForce  bool   // Whether to install package files even when unchanged
+)
+
+// packagesCmd represents the packages command
+var packagesCmd = &cobra.Command{
+	Use:   "packages",
+	Short: "Install the packages listed in the dotfiles",
+	Long: `Install the packages listed in packages.<system> files of the common,
+environment and machine layers, where <system> is apt, brew or yay.
+
+The hash of each package file and the packages it listed are recorded in
+.package-state.json after a successful install. Unchanged files are skipped
+afterwards, and only newly added packages are installed from changed ones.`,
+}
+
+// packagesStatusCmd represents the packages status command
+var packagesStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show which package files are pending",
+	Long: `Show for each package file whether it is installed or which of its
+packages the next install would install.
+
+For example:
+  dotpilot packages status
+  dotpilot packages status --package-system brew`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		environment := repo.Environment()
+
+		packageSystem, statuses, err := core.PackageStatus(repo.Dir, environment, packagesSystem)
+		if err != nil {
+			return withMessage(err, "Failed to get package status")
+		}
+
+		if len(statuses) == 0 {
+			fmt.Fprintf(out, "No packages.%s files for environment %s.\n", packageSystem, environment)
+			return nil
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "FILE\tSTATUS\tPENDING")
+		for _, s := range statuses {
+			status := "installed " + s.Updated.Local().Format("2006-01-02 15:04")
+			if !s.Installed {
+				status = "pending"
+			}
+			pending := strings.Join(s.Pending, " ")
+			if pending == "" {
+				pending = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", s.RepoPath, status, pending)
+		}
+		w.Flush()
+		return nil
+	},
+}
+
+// packagesInstallCmd represents the packages install command
+var packagesInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Install pending packages",
+	Long: `Install the packages of package files that changed since their last
+install. Use --force to install every package file again.
+
+For example:
+  dotpilot packages install
+  dotpilot packages install --force`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+
+		if err := core.InstallPackages(repo.Dir, repo.Environment(), packagesSystem, packagesForce); err != nil {
+			return withMessage(err, "Failed to install packages")
+		}
+
+		utils.Logger.Info().Msg("Packages are up to date")
+		return nil
+	},
+}
+
+func init() {
+	packagesCmd.PersistentFlags().StringVar(&packagesSystem, "package-system", "", "Override automatic package system detection (apt, brew, yay)")
+	packagesInstallCmd.Flags().BoolVar(&packagesForce, "force", false, "Install every package file, even if unchanged since its last install")
+
+	packagesCmd.AddCommand(packagesStatusCmd)
+	packagesCmd.AddCommand(packagesInstallCmd)
+	rootCmd.AddCommand(packagesCmd)
+}
@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"text/tabwriter"
+
+	"github.com/dotpilot/core"
+	"github.com/spf13/cobra"
+)
+
+// pluginsCmd represents the plugins command
+var pluginsCmd = &cobra.Command{
+	Use:   "plugins",
+	Short: "Manage external subcommands",
+	Long: `dotpilot runs an executable named dotpilot-<name> on PATH as 'dotpilot <name>'
+when <name> isn't one of its own commands, like git does. The remaining
+arguments are passed on, and the plugin gets the DOTPILOT_DIR, DOTPILOT_ENV,
+DOTPILOT_HOSTNAME, DOTPILOT_OS and DOTPILOT_PKG_MANAGER variables hooks get.
+
+For example:
+  dotpilot plugins list`,
+}
+
+// pluginsListCmd represents the plugins list command
+var pluginsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the plugins on PATH",
+	Long: `List the dotpilot-<name> executables on PATH and the subcommand each provides.
+A plugin with the name of a built-in command is never run.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		out := cmd.OutOrStdout()
+
+		plugins := core.ListPlugins()
+		if len(plugins) == 0 {
+			fmt.Fprintf(out, "No plugins found, plugins are executables named %s<name> on PATH.\n", core.PluginPrefix)
+			return
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "COMMAND\tPATH")
+		for _, plugin := range plugins {
+			path := plugin.Path
+			if isBuiltinCommand(plugin.Name) {
+				path += " (shadowed by the built-in command)"
+			}
+			fmt.Fprintf(w, "%s\t%s\n", plugin.Name, path)
+		}
+		w.Flush()
+	},
+}
+
+// findPlugin returns the plugin args run and the arguments to pass it, if the
+// first argument is a subcommand dotpilot doesn't have itself. Flags before
+// the subcommand aren't supported.
+func findPlugin(args []string) (core.Plugin, []string, bool) {
+	if len(args) == 0 || isBuiltinCommand(args[0]) {
+		return core.Plugin{}, nil, false
+	}
+	plugin, ok := core.LookPlugin(args[0])
+	return plugin, args[1:], ok
+}
+
+// isBuiltinCommand reports whether name is a subcommand of dotpilot or one of
+// its aliases, or a flag
+func isBuiltinCommand(name string) bool {
+	if name == "" || name[0] == '-' {
+		return true
+	}
+	for _, c := range rootCmd.Commands() {
+		if c.Name() == name || c.HasAlias(name) {
+			return true
+		}
+	}
+	// cobra adds these when executing
+	return name == "help" || name == "completion" || name == cobra.ShellCompRequestCmd || name == cobra.ShellCompNoDescRequestCmd
+}
+
+// runPlugin runs plugin with args and the DOTPILOT_* variables of hooks. Its
+// exit status becomes the exit status of dotpilot.
+func runPlugin(plugin core.Plugin, args []string) error {
+	initConfig()
+	if configErr != nil {
+		return configErr
+	}
+	home, err := core.Home()
+	if err != nil {
+		return err
+	}
+
+	c := exec.Command(plugin.Path, args...)
+	c.Env = core.ScriptEnv(core.DotpilotDir(home), core.GetConfig().CurrentEnvironment)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+
+	err = c.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code := exitErr.ExitCode()
+		if code < 0 {
+			// Killed by a signal
+			code = 1
+		}
+		return exitStatus(code)
+	}
+	return err
+}
+
+func init() {
+	pluginsCmd.AddCommand(pluginsListCmd)
+	rootCmd.AddCommand(pluginsCmd)
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+var reapplyEnv string
+
+// reapplyCmd represents the reapply command
+var reapplyCmd = &cobra.Command{
+	Use:   "reapply [file...]",
+	Short: "Relink individual dotfiles from the repository",
+	Long: `Recreate the symlink for one or more dotfiles, for example after an
+application replaced ~/.config/foo with a regular file.
+
+Each path can be a file in the home directory or a file inside the dotpilot
+repository. Home paths are looked up in the machine, environment and common
+layers, in that order; use --env to pick the layer (common, machine or an
+environment name). Whatever currently occupies the target is backed up first.
+
+For example:
+  dotpilot reapply ~/.zshrc
+  dotpilot reapply ~/.config/foo/config.toml ~/.gitconfig
+  dotpilot reapply ~/.vimrc --env dev
+  dotpilot reapply ~/.dotpilot/common/.bashrc`,
+	Args: nonEmptyArgs(cobra.MinimumNArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+		dotpilotDir := repo.Dir
+
+		// Get current environment
+		environment := repo.Config.CurrentEnvironment
+
+		failed := 0
+		for _, arg := range args {
+			target, err := expandHome(repo.Home, arg)
+			if err != nil {
+				return err
+			}
+			repoPath, err := core.FindRepoPath(dotpilotDir, target, environment, reapplyEnv)
+			if err != nil {
+				utils.Logger.Error().Err(err).Msgf("Cannot reapply %s", arg)
+				failed++
+				continue
+			}
+
+			result, err := core.ReapplyFile(dotpilotDir, repoPath)
+			if err != nil {
+				utils.Logger.Error().Err(err).Msgf("Failed to reapply %s", repoPath)
+				failed++
+				continue
+			}
+
+			switch {
+			case result.Unchanged:
+				utils.Logger.Info().Msgf("%s already links to %s", result.Target, result.RepoPath)
+			case result.Backup != "":
+				utils.Logger.Info().Msgf("Relinked %s to %s (backed up to %s)", result.Target, result.RepoPath, result.Backup)
+			default:
+				utils.Logger.Info().Msgf("Linked %s to %s", result.Target, result.RepoPath)
+			}
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("Failed to reapply %d of %d paths", failed, len(args))
+		}
+		return nil
+	},
+}
+
+func init() {
+	reapplyCmd.Flags().StringVar(&reapplyEnv, "env", "", "Layer to take the files from (common, machine, or specific environment name)")
+	registerFlagCompletion(reapplyCmd, "env", completeLayerFlag)
+
+	rootCmd.AddCommand(reapplyCmd)
+}
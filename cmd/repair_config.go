@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	repairEnv    string // Environment to record instead of the most populated one
+	repairSubdir string // Monorepo subdirectory holding the layers
+	repairDryRun bool   // Whether to print the rebuilt configuration without writing it
+)
+
+// repairConfigCmd represents the repair-config command
+var repairConfigCmd = &cobra.Command{
+	Use:   "repair-config",
+	Short: "Rebuild ~/.dotpilotrc from the dotpilot repository",
+	Long: `Rebuild a lost or corrupted ~/.dotpilotrc from the dotpilot repository,
+which records everything the configuration tracks:
+
+  - the remote, from the remote of the repository (origin first)
+  - the current environment, the one with the most committed dotfiles, or
+    --env; when several tie, you are asked which to use
+  - the tracked paths, the targets of the committed dotfiles of common/, the
+    current environment and the machine layer of this host
+
+Options and other settings are kept if the old file still parses, otherwise
+the defaults are used. The file is replaced atomically. For a repository in
+monorepo mode, pass the subdirectory holding the layers with --subdir.
+
+With --dry-run, the rebuilt configuration is printed instead of written.
+
+For example:
+  dotpilot repair-config
+  dotpilot repair-config --env work --dry-run`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+
+		// ~/.dotpilotrc may not load, so don't open the repository through it
+		home, err := core.Home()
+		if err != nil {
+			return withMessage(err, "Failed to find the home directory")
+		}
+		configPath := cfgFile
+		if configPath == "" {
+			configPath = filepath.Join(home, ".dotpilotrc")
+		}
+		if !cmd.Flags().Changed("subdir") {
+			repairSubdir = core.GetConfig().Subdir
+		}
+		if repairEnv != "" {
+			if err := core.ValidateEnvironmentName(repairEnv); err != nil {
+				return withMessage(err, "Invalid environment")
+			}
+		}
+
+		dotpilotDir := filepath.Join(home, ".dotpilot", filepath.FromSlash(repairSubdir))
+		if err := core.CheckInitialized(dotpilotDir); err != nil {
+			return withMessage(err, "Dotpilot is not initialized")
+		}
+		if !repairDryRun {
+			if err := lockRepository(home); err != nil {
+				return err
+			}
+		}
+
+		repair, err := core.RepairConfig(configPath, home, dotpilotDir, repairEnv, repairSubdir)
+		if err != nil {
+			return withMessage(err, "Failed to rebuild the configuration")
+		}
+		if len(repair.Tied) > 0 {
+			// The tracked paths depend on the environment
+			if chosen := chooseEnvironment(repair.Tied, repair.Environments); chosen != repair.Config.CurrentEnvironment {
+				if repair, err = core.RepairConfig(configPath, home, dotpilotDir, chosen, repairSubdir); err != nil {
+					return withMessage(err, "Failed to rebuild the configuration")
+				}
+			}
+		}
+
+		if repairDryRun {
+			data, err := json.MarshalIndent(repair.Config, "", "  ")
+			if err != nil {
+				return withMessage(err, "Failed to print the configuration")
+			}
+			fmt.Fprintln(out, string(data))
+			return nil
+		}
+
+		if err := core.SaveRepairedConfig(configPath, repair.Config); err != nil {
+			return withMessage(err, "Failed to save the configuration")
+		}
+
+		remote := repair.Config.RemoteRepository
+		if remote == "" {
+			remote = "none"
+		}
+		fmt.Fprintf(out, "Rebuilt %s\n", tildePath(home, configPath))
+		fmt.Fprintf(out, "  Remote:        %s\n", remote)
+		fmt.Fprintf(out, "  Environment:   %s\n", repair.Config.CurrentEnvironment)
+		fmt.Fprintf(out, "  Tracked paths: %d\n", len(repair.Config.TrackingPaths))
+		return nil
+	},
+}
+
+// chooseEnvironment asks which of the tied environments to use, the first if
+// no answer picks one
+func chooseEnvironment(tied []string, counts map[string]int) string {
+	utils.Logger.Warn().Msgf("%d environments have %d dotfiles each", len(tied), counts[tied[0]])
+	for _, name := range tied {
+		if utils.PromptYesNo(fmt.Sprintf("Use environment %s?", name)) {
+			return name
+		}
+	}
+	utils.Logger.Warn().Msgf("Using environment %s, pick another with --env", tied[0])
+	return tied[0]
+}
+
+func init() {
+	rootCmd.AddCommand(repairConfigCmd)
+
+	repairConfigCmd.Flags().StringVar(&repairEnv, "env", "", "Environment to record instead of the one with the most dotfiles")
+	repairConfigCmd.Flags().StringVar(&repairSubdir, "subdir", "", "Repository subdirectory holding the layers (monorepo mode)")
+	repairConfigCmd.Flags().BoolVar(&repairDryRun, "dry-run", false, "Print the rebuilt configuration without writing it")
+}
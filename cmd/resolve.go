@@ -1,8 +1,8 @@
 package cmd
 
 import (
-        "os"
-        "path/filepath"
+        "fmt"
+        "strings"
 
         "github.com/dotpilot/core"
         "github.com/dotpilot/utils"
@@ -11,6 +11,7 @@ import (
 
 var (
         resolveStrategy string
+        resolveSummary  bool
 )
 
 // resolveCmd represents the resolve command
@@ -27,24 +28,30 @@ Strategies available:
 - merge: Attempt to merge changes using a merge tool
 - backup-both: Keep both versions with backups
 
+An interactive resolution starts with a summary of the conflicts, counted by
+kind (content, type-mismatch or binary) and listed by target. Keep the remote
+version of all of them, or of those of one kind, resolve them individually,
+or abort without changing anything.
+
+The decision made for each conflict, and the backup made of the version that
+was replaced, is recorded in logs/conflicts-<timestamp>.log in the dotpilot
+directory. With --summary, the same table is printed at the end.
+
 For example:
   dotpilot resolve
   dotpilot resolve --strategy=keep-remote
+  dotpilot resolve --strategy=backup-both --summary
   dotpilot resolve --strategy=merge`,
-        Run: func(cmd *cobra.Command, args []string) {
-                // Get home directory
-                home, err := os.UserHomeDir()
+        RunE: func(cmd *cobra.Command, args []string) error {
+                // Open the dotpilot repository
+                repo, err := openRepository()
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to get home directory")
-                        os.Exit(1)
+                        return err
                 }
-
-                // Check if dotpilot is initialized
-                dotpilotDir := filepath.Join(home, ".dotpilot")
-                if _, err := os.Stat(dotpilotDir); os.IsNotExist(err) {
-                        utils.Logger.Error().Msg("Dotpilot is not initialized. Run 'dotpilot init' first.")
-                        os.Exit(1)
+                if err := lockRepository(repo.Home); err != nil {
+                        return err
                 }
+                dotpilotDir := repo.Dir
 
                 // Parse the strategy
                 var strategy core.ConflictResolutionStrategy
@@ -65,18 +72,44 @@ For example:
                 }
 
                 utils.Logger.Info().Msgf("Checking for conflicts with strategy: %s", strategy)
-                if err := core.ResolveConflicts(dotpilotDir, strategy); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to resolve conflicts")
-                        os.Exit(1)
+                report, err := core.ResolveConflicts(dotpilotDir, strategy)
+                if resolveSummary && len(report.Decisions) > 0 {
+                        out := cmd.OutOrStdout()
+                        fmt.Fprintln(out)
+                        if err := core.WriteConflictTable(out, report.Decisions); err != nil {
+                                utils.Logger.Warn().Err(err).Msg("Failed to print the summary")
+                        }
+                }
+                reportConflicts(report)
+                if err != nil {
+                        return withMessage(err, "Failed to resolve conflicts")
                 }
 
                 utils.Logger.Info().Msg("Conflict resolution completed successfully")
+                return nil
         },
 }
 
+// reportConflicts logs how many conflicts were resolved and lists the
+// targets that still need attention
+func reportConflicts(report core.ConflictReport) {
+        if len(report.Decisions) == 0 {
+                return
+        }
+        resolved, failed, skipped := report.Resolved(), report.Failed(), report.Skipped()
+        utils.Logger.Info().Msgf("Resolved %d of %d conflicts", len(resolved), len(report.Decisions))
+        if len(failed) > 0 {
+                utils.Logger.Warn().Msgf("%d conflicts failed to resolve: %s", len(failed), strings.Join(failed, ", "))
+        }
+        if len(skipped) > 0 {
+                utils.Logger.Warn().Msgf("%d conflicts were skipped: %s", len(skipped), strings.Join(skipped, ", "))
+        }
+}
+
 func init() {
         resolveCmd.Flags().StringVar(&resolveStrategy, "strategy", "interactive",
                 "Conflict resolution strategy: interactive, keep-local, keep-remote, merge, or backup-both")
+        resolveCmd.Flags().BoolVar(&resolveSummary, "summary", false, "Print a table of the decision made for each conflict at the end")
 
         // Add completion for strategy flag
         if err := resolveCmd.RegisterFlagCompletionFunc("strategy", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
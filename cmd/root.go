@@ -1,7 +1,8 @@
 package cmd
 
 import (
-        "fmt"
+        "errors"
+        "io"
         "os"
         "path/filepath"
 
@@ -11,8 +12,23 @@ import (
 )
 
 var (
-        cfgFile string
-        verbose bool
+        cfgFile        string
+        verbose        bool
+        noColor        bool
+        forceColor     bool
+        nonInteractive bool
+        assumeYes      bool
+        editor         string
+        forceUnlock    bool
+        noVerify       bool
+        noPrune        bool
+        autoEnv        bool
+
+        // repoLock is held by mutating commands, see lockRepository
+        repoLock *core.Lock
+
+        // configErr is why the config couldn't be loaded, see initConfig
+        configErr error
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -24,27 +40,96 @@ multiple machines with environment-specific overrides.
 
 It uses a Git-backed system to track changes to dotfiles, supports scoped
 environments (e.g., dev, prod, hardened), and includes machine-specific
-configurations.`,
-        PersistentPreRun: func(cmd *cobra.Command, args []string) {
+configurations.
+
+Executables named dotpilot-<name> on PATH add the subcommand <name>, see
+'dotpilot plugins'.`,
+        // Commands log their errors in LogError
+        SilenceErrors: true,
+        PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+                // Flags and arguments are valid by now, so an error is no
+                // reason to print the usage
+                cmd.SilenceUsage = true
+
+                // Log to the command's error writer so output written to
+                // cmd.OutOrStdout() stays clean, e.g. for stats --json
+                utils.SetLogOutput(cmd.ErrOrStderr())
+
+                // Set up color output (--no-color wins over --force-color)
+                utils.SetColorMode(noColor, forceColor)
+
+                // Never wait for answers that nobody can give
+                utils.SetNonInteractive(nonInteractive)
+                utils.SetAssumeYes(assumeYes)
+
+                // Commit without running the repository's pre-commit hook
+                core.SetNoVerify(noVerify)
+
+                // Keep every backup instead of applying backup_retention
+                core.SetBackupPruning(!noPrune)
+
+                // Let env-rules.json pick the environment even if one is set
+                core.SetAutoEnvironment(autoEnv)
+
+                // Launch the requested editor for edits and manual merges
+                utils.SetEditor(editor)
+
                 // Set up logging level
                 if verbose {
                         utils.SetLogLevel("debug")
                 }
+                return configErr
         },
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// A subcommand dotpilot doesn't have runs the plugin of that name, if any.
 func Execute() error {
+        if plugin, args, ok := findPlugin(os.Args[1:]); ok {
+                return runPlugin(plugin, args)
+        }
+        return executeRoot()
+}
+
+// executeRoot runs the command of the arguments and releases the repository
+// lock it took, whether it failed or not
+func executeRoot() error {
+        defer releaseRepository()
         return rootCmd.Execute()
 }
 
+// releaseRepository releases the lock of lockRepository, if it was taken
+func releaseRepository() {
+        if err := repoLock.Release(); err != nil {
+                utils.Logger.Debug().Err(err).Msg("Failed to release the repository lock")
+        }
+        repoLock = nil
+}
+
+// SetOutput redirects command output to out and log messages to errOut, so
+// dotpilot can be driven from tests or other Go programs. Both default to
+// stdout and stderr.
+func SetOutput(out, errOut io.Writer) {
+        rootCmd.SetOut(out)
+        rootCmd.SetErr(errOut)
+}
+
 func init() {
         cobra.OnInitialize(initConfig)
 
         // Global flags
         rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.dotpilotrc)")
         rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "enable verbose output")
+        rootCmd.PersistentFlags().BoolVar(&noColor, "no-color", false, "disable colored output (also honors NO_COLOR)")
+        rootCmd.PersistentFlags().BoolVar(&forceColor, "force-color", false, "keep colored output even when not writing to a terminal (also honors CLICOLOR_FORCE)")
+        rootCmd.PersistentFlags().BoolVar(&nonInteractive, "non-interactive", false, "never prompt, answer no to every question (for scripts and CI)")
+        rootCmd.PersistentFlags().BoolVarP(&assumeYes, "yes", "y", false, "never prompt, answer yes to every question (--non-interactive wins)")
+        rootCmd.PersistentFlags().BoolVar(&noVerify, "no-verify", false, "commit without running the repository's hooks/pre-commit")
+        rootCmd.PersistentFlags().BoolVar(&noPrune, "no-prune", false, "keep every .dotpilot.bak backup instead of pruning old ones by the backup_retention option")
+        rootCmd.PersistentFlags().BoolVar(&autoEnv, "auto-env", false, "select the environment with env-rules.json even if one is set")
+        rootCmd.PersistentFlags().BoolVar(&forceUnlock, "force-unlock", false, "remove a stale repository lock left by a stuck dotpilot process")
+        rootCmd.PersistentFlags().StringVar(&editor, "editor", "", "editor to launch for edits (default: $VISUAL, then $EDITOR, then nano, vim, vi or emacs)")
 
         // Setup bash completion
         rootCmd.CompletionOptions.DisableDefaultCmd = false
@@ -58,17 +143,19 @@ func init() {
         rootCmd.AddCommand(statusCmd)
 }
 
-// initConfig reads in config file and ENV variables if set.
+// initConfig reads in config file and ENV variables if set. An error is
+// returned by the command, see configErr.
 func initConfig() {
+        configErr = nil
         if cfgFile != "" {
                 // Use config file from the flag
                 core.LoadConfig(cfgFile)
         } else {
                 // Find home directory
-                home, err := os.UserHomeDir()
+                home, err := core.Home()
                 if err != nil {
-                        fmt.Println(err)
-                        os.Exit(1)
+                        configErr = err
+                        return
                 }
 
                 // Search for config in home directory
@@ -81,3 +168,39 @@ func initConfig() {
                 }
         }
 }
+
+// openRepository opens the dotpilot repository, failing with
+// core.ErrNotInitialized if dotpilot is not initialized
+func openRepository() (*core.Repository, error) {
+        repo, err := core.OpenRepository()
+        if errors.Is(err, core.ErrNotInitialized) {
+                return nil, withMessage(err, "Dotpilot is not initialized")
+        }
+        if err != nil {
+                return nil, withMessage(err, "Failed to open the dotpilot repository")
+        }
+        return repo, nil
+}
+
+// lockRepository takes the repository lock for a command that modifies the
+// repository or the files it manages, failing if another dotpilot operation
+// is in progress. Read-only commands don't lock. The lock is released when
+// the command returns. init locks again once it recreated the repository.
+func lockRepository(home string) error {
+        if repoLock != nil {
+                repoLock.Release()
+        }
+        if forceUnlock {
+                if err := core.ForceUnlock(home); err != nil {
+                        return withMessage(err, "Failed to remove the repository lock")
+                }
+        }
+
+        lock, err := core.AcquireLock(home)
+        if err != nil {
+                return withMessage(err, "Failed to lock the dotpilot repository")
+        }
+        repoLock = lock
+        utils.Cleanup.Add(func() { lock.Release() })
+        return nil
+}
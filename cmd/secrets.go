@@ -1,9 +1,13 @@
 package cmd
 
 import (
+        "errors"
         "fmt"
+        "io"
         "os"
         "path/filepath"
+        "strings"
+        "text/tabwriter"
 
         "github.com/dotpilot/core"
         "github.com/dotpilot/utils"
@@ -13,6 +17,24 @@ import (
 var (
         secretDestination string
         secretOverwrite   bool
+        secretStdin       bool
+        secretNoCommit    bool // Whether to stage changes without committing them
+        secretTarget      string // Where the secret is meant to be decrypted to
+        secretListLong    bool   // Whether to list secrets with their metadata
+        secretDiffDriver  bool   // Whether to show secret metadata instead of ciphertext in git diffs
+        secretReplaceLink bool   // Whether to replace a dotpilot symlink at the destination
+        secretGetAll      bool   // Whether to decrypt every secret to its recorded destination
+        secretParallel    int    // How many secrets to decrypt at once with --all
+        secretFromDotenv  string // .env file to import secrets from
+        secretFromPass    string // pass entry or folder to import secrets from
+        secretFromJSON    bool   // Whether to import a JSON object of secrets from stdin
+        secretShowForce   bool   // Whether to print a secret to a terminal without a warning
+        secretEnv         string // Environment the secrets belong to, see secretEnvironment
+        secretEnvVar      string // Environment variable to encrypt the value of
+        secretInfoJSON    bool   // Whether to print the secret info as JSON
+        secretListTree    bool   // Whether to list secrets by layer with their health
+        secretListVerify  bool   // Whether to decrypt each listed secret to check it can be
+        secretListJSON    bool   // Whether to print the listed secrets and their health as JSON
 )
 
 // secretsCmd represents the secrets command
@@ -23,7 +45,13 @@ var secretsCmd = &cobra.Command{
 Allows you to securely store sensitive configuration files
 that will be encrypted before being stored in the Git repository.
 
-DotPilot will use GPG if available, or fall back to AES-256 encryption.`,
+DotPilot will use GPG if available, or fall back to AES-256 encryption.
+
+Secrets are common to all environments unless they are added with --env,
+which stores them in secrets/envs/<env>/. Getting, showing, listing and
+restoring secrets sees the common secrets and those of the current
+environment, or of the one given with --env; a secret of the environment
+hides a common secret of the same name.`,
 }
 
 // addSecretCmd represents the add-secret command
@@ -35,95 +63,245 @@ The file will be encrypted before being stored in the repository.
 
 For example:
   dotpilot secrets add ~/.aws/credentials
-  dotpilot secrets add ~/.ssh/id_rsa --name ssh_key`,
-        Args: cobra.ExactArgs(1),
-        Run: func(cmd *cobra.Command, args []string) {
-                // Get home directory
-                home, err := os.UserHomeDir()
+  dotpilot secrets add ~/.ssh/id_rsa --name ssh_key
+  pass generate -n github/token | dotpilot secrets add --stdin --name github_token
+  dotpilot secrets add ~/.config/api/key --name api_key --env prod
+  dotpilot secrets add --env-var GITHUB_TOKEN
+
+With --env-var, the value of an environment variable is encrypted instead of
+a file, named after the variable unless --name is given. The variable is
+recorded with the secret, so 'dotpilot secrets export-env' can export it
+again. The value is never written to a plaintext file.
+
+The secrets directory always carries a .gitattributes that keeps git from
+diffing and merging the encrypted files as text. With --git-attributes, git
+diffs additionally show the backend, size and hash of a changed secret.`,
+        Args: nonEmptyArgs(cobra.MaximumNArgs(1)),
+        RunE: func(cmd *cobra.Command, args []string) error {
+                // Open the dotpilot repository
+                repo, err := openRepository()
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to get home directory")
-                        os.Exit(1)
+                        return err
                 }
-
-                // Check if dotpilot is initialized
-                dotpilotDir := filepath.Join(home, ".dotpilot")
-                if _, err := os.Stat(dotpilotDir); os.IsNotExist(err) {
-                        utils.Logger.Error().Msg("Dotpilot is not initialized. Run 'dotpilot init' first.")
-                        os.Exit(1)
+                if err := lockRepository(repo.Home); err != nil {
+                        return err
                 }
+                dotpilotDir := repo.Dir
 
-                // Expand ~ to home directory
-                srcPath := args[0]
-                if srcPath[0] == '~' {
-                        srcPath = filepath.Join(home, srcPath[1:])
-                }
+                // Read the secret from stdin or locate the source file
+                var absPath string
+                var stdinData []byte
+                if secretEnvVar != "" {
+                        if len(args) > 0 || secretStdin {
+                                return errors.New("Cannot use a file argument or --stdin together with --env-var")
+                        }
+                } else if secretStdin {
+                        if len(args) > 0 {
+                                return errors.New("Cannot use a file argument together with --stdin")
+                        }
+                        if secretDestination == "" {
+                                return errors.New("--name is required when reading from --stdin")
+                        }
 
-                // Get absolute path
-                absPath, err := filepath.Abs(srcPath)
-                if err != nil {
-                        utils.Logger.Error().Err(err).Msgf("Failed to get absolute path for %s", srcPath)
-                        os.Exit(1)
-                }
+                        stdinData, err = io.ReadAll(os.Stdin)
+                        if err != nil {
+                                return withMessage(err, "Failed to read from stdin")
+                        }
+                } else {
+                        if len(args) != 1 {
+                                return errors.New("A file to encrypt is required, or use --stdin")
+                        }
+
+                        // Expand ~ to home directory
+                        srcPath, err := expandHome(repo.Home, args[0])
+                        if err != nil {
+                                return err
+                        }
 
-                // Check if file exists
-                if _, err := os.Stat(absPath); os.IsNotExist(err) {
-                        utils.Logger.Error().Msgf("File does not exist: %s", absPath)
-                        os.Exit(1)
+                        // Get absolute path
+                        absPath, err = filepath.Abs(srcPath)
+                        if err != nil {
+                                return withMessage(err, fmt.Sprintf("Failed to get absolute path for %s", srcPath))
+                        }
+
+                        // Check if file exists
+                        if _, err := os.Stat(absPath); os.IsNotExist(err) {
+                                return fmt.Errorf("File does not exist: %s", absPath)
+                        }
                 }
 
                 // Determine secret name
                 var secretName string
                 if secretDestination != "" {
                         secretName = secretDestination
+                } else if secretEnvVar != "" {
+                        secretName = secretEnvVar
                 } else {
                         // Use filename as secret name (with directory structure removed)
                         secretName = filepath.Base(absPath)
                 }
 
-                // Create secret manager
-                secretManager := core.NewSecretManager(dotpilotDir)
+                // Create secret manager for the chosen environment
+                secretManager := core.NewSecretManager(dotpilotDir).ForEnvironment(secretEnv)
                 if err := secretManager.Initialize(); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to initialize secret manager")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to initialize secret manager")
                 }
 
                 // Check if secret already exists
-                secrets, err := secretManager.ListSecrets()
+                if err := secretManager.CanAdd(secretName, secretOverwrite); err != nil {
+                        return withMessage(err, "Cannot add secret")
+                }
+
+                // Encrypt the variable, the file or the piped content
+                if secretEnvVar != "" {
+                        utils.Logger.Info().Msgf("Encrypting $%s as %s", secretEnvVar, secretName)
+                        err = secretManager.EncryptEnvVar(secretEnvVar, secretName)
+                } else if secretStdin {
+                        utils.Logger.Info().Msgf("Encrypting standard input as %s", secretName)
+                        err = secretManager.EncryptData(stdinData, secretName)
+                } else {
+                        utils.Logger.Info().Msgf("Encrypting %s as %s", absPath, secretName)
+                        err = secretManager.EncryptFile(absPath, secretName)
+                }
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to list secrets")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to encrypt file")
                 }
 
-                secretExists := false
-                for _, s := range secrets {
-                        if s == secretName {
-                                secretExists = true
-                                break
+                utils.Logger.Info().Msgf("Successfully encrypted %s", secretName)
+
+                // Record the intended destination, if one was given
+                if secretTarget != "" {
+                        destination, err := expandHome(repo.Home, secretTarget)
+                        if err != nil {
+                                return err
+                        }
+                        if err := secretManager.SetDestination(secretName, destination); err != nil {
+                                utils.Logger.Warn().Err(err).Msg("Failed to record the secret destination")
                         }
                 }
 
-                if secretExists && !secretOverwrite {
-                        utils.Logger.Error().Msgf("Secret %s already exists. Use --overwrite to replace it.", secretName)
-                        os.Exit(1)
+                // Show metadata instead of ciphertext in git diffs
+                if secretDiffDriver {
+                        if err := secretManager.EnableDiffDriver(); err != nil {
+                                utils.Logger.Warn().Err(err).Msg("Failed to configure the git diff driver for secrets")
+                        }
                 }
 
-                // Encrypt the file
-                utils.Logger.Info().Msgf("Encrypting %s as %s", absPath, secretName)
-                if err := secretManager.EncryptFile(absPath, secretName); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to encrypt file")
-                        os.Exit(1)
+                // Commit or stage changes
+                if err := commitOrStage(dotpilotDir, fmt.Sprintf("Added encrypted secret: %s", secretName), secretNoCommit); err != nil {
+                        return err
                 }
 
-                utils.Logger.Info().Msgf("Successfully encrypted %s", secretName)
+                utils.Logger.Info().Msg("Secret added successfully!")
+                return nil
+        },
+}
+
+// importSecretCmd represents the secrets import command
+var importSecretCmd = &cobra.Command{
+        Use:   "import",
+        Short: "Import secrets from other secret stores",
+        Long: `Import secrets from a .env file, the pass password store or a JSON object
+and encrypt each of them as a named secret.
+
+  --from-dotenv <file>  each KEY=VALUE line becomes a secret named KEY
+  --from-pass <path>    an entry, or every entry below a folder, read with
+                        'pass show'; github/token becomes github_token
+  --from-stdin-json     a JSON object of names to string values on stdin,
+                        e.g. exported from a password manager
+
+Secrets that already exist are skipped unless --overwrite is given. The store
+each secret came from is recorded in its metadata.
+
+For example:
+  dotpilot secrets import --from-dotenv ~/projects/api/.env
+  dotpilot secrets import --from-pass github
+  op item get api --format json | jq '{api_key: .fields[0].value}' | dotpilot secrets import --from-stdin-json`,
+        Args: cobra.NoArgs,
+        RunE: func(cmd *cobra.Command, args []string) error {
+                out := cmd.OutOrStdout()
 
-                // Commit changes
-                utils.Logger.Info().Msg("Committing changes...")
-                if err := core.CommitChanges(dotpilotDir, fmt.Sprintf("Added encrypted secret: %s", secretName)); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to commit changes")
-                        os.Exit(1)
+                // Open the dotpilot repository
+                repo, err := openRepository()
+                if err != nil {
+                        return err
+                }
+                if err := lockRepository(repo.Home); err != nil {
+                        return err
                 }
+                dotpilotDir := repo.Dir
 
-                utils.Logger.Info().Msg("Secret added successfully!")
+                // Read the secrets from the chosen store
+                var secrets []core.ImportedSecret
+                var source string
+                switch {
+                case secretFromDotenv != "":
+                        source = secretFromDotenv
+                        var path string
+                        if path, err = expandHome(repo.Home, secretFromDotenv); err != nil {
+                                return err
+                        }
+                        secrets, err = core.ReadDotenvSecrets(path)
+                case secretFromPass != "":
+                        source = "pass " + secretFromPass
+                        secrets, err = core.ReadPassSecrets(secretFromPass)
+                case secretFromJSON:
+                        source = "stdin"
+                        secrets, err = core.ReadJSONSecrets(os.Stdin)
+                default:
+                        return errors.New("One of --from-dotenv, --from-pass or --from-stdin-json is required")
+                }
+                if err != nil {
+                        return withMessage(err, "Failed to read secrets from "+source)
+                }
+                if len(secrets) == 0 {
+                        fmt.Fprintf(out, "No secrets found in %s.\n", source)
+                        return nil
+                }
+
+                // Create secret manager for the chosen environment
+                secretManager := core.NewSecretManager(dotpilotDir).ForEnvironment(secretEnv)
+                if err := secretManager.Initialize(); err != nil {
+                        return withMessage(err, "Failed to initialize secret manager")
+                }
+
+                var imported, skipped []string
+                failed := 0
+                for _, secret := range secrets {
+                        if err := secretManager.CanAdd(secret.Name, secretOverwrite); err != nil {
+                                if errors.Is(err, core.ErrSecretExists) {
+                                        skipped = append(skipped, secret.Name)
+                                        continue
+                                }
+                                utils.Logger.Error().Err(err).Msgf("Cannot import %s", secret.Name)
+                                failed++
+                                continue
+                        }
+                        if err := secretManager.ImportData(secret.Value, secret.Name, secret.Origin); err != nil {
+                                utils.Logger.Error().Err(err).Msgf("Failed to encrypt %s", secret.Name)
+                                failed++
+                                continue
+                        }
+                        imported = append(imported, secret.Name)
+                }
+
+                if len(imported) > 0 {
+                        if err := commitOrStage(dotpilotDir, fmt.Sprintf("Imported %d encrypted secrets from %s", len(imported), source), secretNoCommit); err != nil {
+                                return err
+                        }
+                }
+
+                fmt.Fprintf(out, "Imported %d of %d secrets from %s.\n", len(imported), len(secrets), source)
+                for _, name := range imported {
+                        fmt.Fprintf(out, "  + %s\n", name)
+                }
+                if len(skipped) > 0 {
+                        fmt.Fprintf(out, "Skipped %d existing secrets, use --overwrite to replace them: %s\n", len(skipped), strings.Join(skipped, ", "))
+                }
+                if failed > 0 {
+                        return fmt.Errorf("Failed to import %d secrets", failed)
+                }
+                return nil
         },
 }
 
@@ -134,69 +312,281 @@ var getSecretCmd = &cobra.Command{
         Long: `Decrypt and retrieve a secret from the dotpilot repository.
 The secret will be decrypted and saved to the specified destination.
 
+With --all, every secret is decrypted to the destination recorded when it was
+added. Up to --parallel secrets are decrypted at once; the first one is
+decrypted alone so a GPG passphrase is only asked for once. Only the common
+secrets and those of the current environment, or of --env, are decrypted.
+
 For example:
   dotpilot secrets get aws_credentials ~/.aws/credentials
-  dotpilot secrets get ssh_key ~/.ssh/id_rsa`,
-        Args: cobra.ExactArgs(2),
-        Run: func(cmd *cobra.Command, args []string) {
-                // Get home directory
-                home, err := os.UserHomeDir()
+  dotpilot secrets get ssh_key ~/.ssh/id_rsa
+  dotpilot secrets get --all --overwrite
+
+A destination that is a symlink into the dotpilot repository is refused, since
+the plaintext would end up in the repository. Use --replace-link to replace
+such a link with a regular file.`,
+        Args: nonEmptyArgs(getSecretArgs(&secretGetAll)),
+        RunE: func(cmd *cobra.Command, args []string) error {
+                // Open the dotpilot repository
+                repo, err := openRepository()
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to get home directory")
-                        os.Exit(1)
+                        return err
                 }
+                if err := lockRepository(repo.Home); err != nil {
+                        return err
+                }
+                dotpilotDir := repo.Dir
+
+                if secretGetAll {
+                        secretManager := core.NewSecretManager(dotpilotDir).ForEnvironment(secretEnvironment(repo, secretEnv))
+                        if err := secretManager.Initialize(); err != nil {
+                                return withMessage(err, "Failed to initialize secret manager")
+                        }
 
-                // Check if dotpilot is initialized
-                dotpilotDir := filepath.Join(home, ".dotpilot")
-                if _, err := os.Stat(dotpilotDir); os.IsNotExist(err) {
-                        utils.Logger.Error().Msg("Dotpilot is not initialized. Run 'dotpilot init' first.")
-                        os.Exit(1)
+                        secrets, err := secretManager.ListSecretMetadata()
+                        if err != nil {
+                                return withMessage(err, "Failed to list secrets")
+                        }
+
+                        if !restoreAllSecrets(repo.Home, dotpilotDir, secrets, secretOverwrite, secretReplaceLink, secretParallel, secretManager.DecryptAll) {
+                                return exitStatus(ExitCrypto)
+                        }
+                        return nil
                 }
 
                 // Get secret name and destination
                 secretName := args[0]
-                destPath := args[1]
 
                 // Expand ~ to home directory in destination
-                if destPath[0] == '~' {
-                        destPath = filepath.Join(home, destPath[1:])
+                destPath, err := expandHome(repo.Home, args[1])
+                if err != nil {
+                        return err
                 }
 
                 // Get absolute path for destination
                 destPath, err = filepath.Abs(destPath)
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msgf("Failed to get absolute path for %s", destPath)
-                        os.Exit(1)
+                        return withMessage(err, fmt.Sprintf("Failed to get absolute path for %s", destPath))
                 }
 
                 // Create parent directories if needed
                 parentDir := filepath.Dir(destPath)
                 if err := os.MkdirAll(parentDir, 0755); err != nil {
-                        utils.Logger.Error().Err(err).Msgf("Failed to create directory %s", parentDir)
-                        os.Exit(1)
+                        return withMessage(err, fmt.Sprintf("Failed to create directory %s", parentDir))
+                }
+
+                // Never decrypt into the repository through a dotpilot symlink
+                if err := core.CheckSecretDestination(dotpilotDir, destPath, secretReplaceLink); err != nil {
+                        return withMessage(err, "Refusing to decrypt secret")
                 }
 
                 // Check if destination file exists
                 if _, err := os.Stat(destPath); err == nil && !secretOverwrite {
-                        utils.Logger.Error().Msgf("Destination file already exists: %s. Use --overwrite to replace it.", destPath)
-                        os.Exit(1)
+                        return fmt.Errorf("Destination file already exists: %s. Use --overwrite to replace it.", destPath)
                 }
 
                 // Create secret manager
-                secretManager := core.NewSecretManager(dotpilotDir)
+                secretManager := core.NewSecretManager(dotpilotDir).ForEnvironment(secretEnvironment(repo, secretEnv))
                 if err := secretManager.Initialize(); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to initialize secret manager")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to initialize secret manager")
                 }
 
                 // Decrypt the secret
                 utils.Logger.Info().Msgf("Decrypting %s to %s", secretName, destPath)
                 if err := secretManager.DecryptFile(secretName, destPath); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to decrypt secret")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to decrypt secret")
                 }
 
                 utils.Logger.Info().Msgf("Successfully decrypted %s to %s", secretName, destPath)
+                return nil
+        },
+}
+
+// showSecretCmd represents the secrets show command
+var showSecretCmd = &cobra.Command{
+        Use:   "show [name]",
+        Short: "Print a decrypted secret",
+        Long: `Decrypt a secret and print it to standard output, for use in scripts.
+The plaintext is only held in memory, no file is written.
+
+Printed to a terminal, the secret may end up in the scrollback or a session
+recording, so a warning is logged first unless --force is given.
+
+For example:
+  export NPM_TOKEN=$(dotpilot secrets show npm_token)
+  dotpilot secrets show ssh_key | ssh-add -`,
+        Args: nonEmptyArgs(cobra.ExactArgs(1)),
+        RunE: func(cmd *cobra.Command, args []string) error {
+                // Open the dotpilot repository
+                repo, err := openRepository()
+                if err != nil {
+                        return err
+                }
+
+                // Create secret manager
+                secretManager := core.NewSecretManager(repo.Dir).ForEnvironment(secretEnvironment(repo, secretEnv))
+                if err := secretManager.Initialize(); err != nil {
+                        return withMessage(err, "Failed to initialize secret manager")
+                }
+
+                return showSecret(cmd.OutOrStdout(), args[0], secretManager.DecryptData, secretShowForce)
+        },
+}
+
+// exportEnvSecretCmd represents the secrets export-env command
+var exportEnvSecretCmd = &cobra.Command{
+        Use:   "export-env",
+        Short: "Print export lines for the secrets added from environment variables",
+        Long: `Decrypt the secrets added with 'secrets add --env-var' and print a line
+exporting each under the name of its variable, for the shell to eval. The
+common secrets and those of the current environment, or of --env, are
+exported. The values are only held in memory, no file is written.
+
+Printed to a terminal, the values may end up in the scrollback, so a warning
+is logged first unless --force is given.
+
+For example:
+  eval "$(dotpilot secrets export-env)"
+  dotpilot secrets export-env --env work > /dev/null`,
+        Args: cobra.NoArgs,
+        RunE: func(cmd *cobra.Command, args []string) error {
+                out := cmd.OutOrStdout()
+
+                // Open the dotpilot repository
+                repo, err := openRepository()
+                if err != nil {
+                        return err
+                }
+
+                // Create secret manager
+                secretManager := core.NewSecretManager(repo.Dir).ForEnvironment(secretEnvironment(repo, secretEnv))
+                if err := secretManager.Initialize(); err != nil {
+                        return withMessage(err, "Failed to initialize secret manager")
+                }
+
+                lines, err := secretManager.ExportEnv()
+                if err != nil {
+                        return withMessage(err, "Failed to decrypt secret")
+                }
+                if len(lines) == 0 {
+                        utils.Logger.Info().Msg("No secrets were added from environment variables, add one with 'dotpilot secrets add --env-var NAME'")
+                        return nil
+                }
+
+                warnIfTerminal(out, "the exported secrets", secretShowForce)
+                for _, line := range lines {
+                        fmt.Fprintln(out, line)
+                }
+                return nil
+        },
+}
+
+// showSecret decrypts a secret with decrypt and writes the plaintext to out,
+// warning first if out is a terminal unless force is set
+func showSecret(out io.Writer, name string, decrypt func(name string) ([]byte, error), force bool) error {
+        plaintext, err := decrypt(name)
+        if err != nil {
+                return withMessage(err, "Failed to decrypt secret")
+        }
+
+        warnIfTerminal(out, "secret "+name, force)
+        if _, err := out.Write(plaintext); err != nil {
+                return withMessage(err, "Failed to print secret")
+        }
+        return nil
+}
+
+// showSecretInfo prints what info returns about the secret name, as JSON
+// with asJSON
+func showSecretInfo(out io.Writer, home, name string, info func(name string) (*core.SecretInfo, error), asJSON bool) error {
+        secret, err := info(name)
+        if err != nil {
+                return withMessage(err, "Failed to read secret")
+        }
+        if asJSON {
+                // The mode in octal, like in file-modes.json
+                secretJSON := struct {
+                        *core.SecretInfo
+                        Mode string `json:"mode"`
+                }{secret, fmt.Sprintf("%04o", secret.Mode)}
+                if err := printJSON(out, secretJSON); err != nil {
+                        return withMessage(err, "Failed to print secret info")
+                }
+                return nil
+        }
+
+        destination := tildePath(home, secret.Destination)
+        if secret.EnvVar != "" {
+                destination = "$" + secret.EnvVar
+        } else if destination == "" {
+                destination = "-"
+        }
+
+        w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+        fmt.Fprintf(w, "Name:\t%s\n", secret.Name)
+        fmt.Fprintf(w, "Layer:\t%s\n", secret.Layer())
+        fmt.Fprintf(w, "Backend:\t%s\n", secret.Backend)
+        fmt.Fprintf(w, "Destination:\t%s\n", destination)
+        if secret.Source != "" {
+                fmt.Fprintf(w, "Source:\t%s\n", secret.Source)
+        }
+        if secret.Origin != "" {
+                fmt.Fprintf(w, "Origin:\t%s\n", secret.Origin)
+        }
+        fmt.Fprintf(w, "Added:\t%s\n", secret.Added.Local().Format("2006-01-02 15:04:05"))
+        fmt.Fprintf(w, "SHA256:\t%s\n", secret.SHA256)
+        fmt.Fprintf(w, "File:\t%s\n", tildePath(home, secret.Path))
+        fmt.Fprintf(w, "Size:\t%d bytes\n", secret.Size)
+        fmt.Fprintf(w, "Mode:\t%s (%04o)\n", secret.Mode, secret.Mode)
+        w.Flush()
+
+        if !secret.Indexed {
+                fmt.Fprintln(out, "\nThe secret isn't in the metadata index, the backend and added time are inferred from the file.")
+        }
+        if secret.Changed {
+                fmt.Fprintln(out, "\nThe file changed since it was added, its hash no longer matches the recorded one.")
+        }
+        return nil
+}
+
+// warnIfTerminal warns that what is about to be printed to a terminal, unless
+// out is no terminal or force is set
+func warnIfTerminal(out io.Writer, what string, force bool) {
+        if f, ok := out.(*os.File); ok && !force {
+                if info, err := f.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+                        utils.Logger.Warn().Msgf("Printing %s to the terminal, use --force to hide this warning", what)
+                }
+        }
+}
+
+// infoSecretCmd represents the secrets info command
+var infoSecretCmd = &cobra.Command{
+        Use:   "info [name]",
+        Short: "Show the metadata of a secret without decrypting it",
+        Long: `Show what is known about a secret without decrypting it: its layer,
+backend, destination, when it was added and the hash of the encrypted file
+from the metadata index, and the size and permissions of the file. Neither
+gpg nor the key is needed. A secret added before the index existed shows what
+can be inferred from the file.
+
+For example:
+  dotpilot secrets info npm_token
+  dotpilot secrets info api_key --env prod --json`,
+        Args: nonEmptyArgs(cobra.ExactArgs(1)),
+        RunE: func(cmd *cobra.Command, args []string) error {
+                // Open the dotpilot repository
+                repo, err := openRepository()
+                if err != nil {
+                        return err
+                }
+
+                // Create secret manager
+                secretManager := core.NewSecretManager(repo.Dir).ForEnvironment(secretEnvironment(repo, secretEnv))
+                if err := secretManager.Initialize(); err != nil {
+                        return withMessage(err, "Failed to initialize secret manager")
+                }
+
+                return showSecretInfo(cmd.OutOrStdout(), repo.Home, args[0], secretManager.Info, secretInfoJSON)
         },
 }
 
@@ -204,48 +594,89 @@ For example:
 var listSecretsCmd = &cobra.Command{
         Use:   "list",
         Short: "List all secrets",
-        Long: `List all encrypted secrets stored in the dotpilot repository.
+        Long: `List the encrypted secrets stored in the dotpilot repository: the common
+secrets and those of the current environment, or of --env. Secrets of an
+environment are marked with their layer.
+
+With --tree, the secrets of every layer are listed grouped by layer, or only
+the common ones and those of --env, with their backend, destination, added
+date and health on this machine: whether they can be decrypted here, which
+only checks that gpg or the AES key is present, and whether their plaintext
+is at their destination. --verify decrypts each secret to check it really can
+be, without writing it anywhere. --json prints the same as JSON.
 
 For example:
-  dotpilot secrets list`,
-        Run: func(cmd *cobra.Command, args []string) {
-                // Get home directory
-                home, err := os.UserHomeDir()
-                if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to get home directory")
-                        os.Exit(1)
-                }
+  dotpilot secrets list
+  dotpilot secrets list --long
+  dotpilot secrets list --env prod
+  dotpilot secrets list --tree
+  dotpilot secrets list --tree --verify
+  dotpilot secrets list --json`,
+        RunE: func(cmd *cobra.Command, args []string) error {
+                out := cmd.OutOrStdout()
 
-                // Check if dotpilot is initialized
-                dotpilotDir := filepath.Join(home, ".dotpilot")
-                if _, err := os.Stat(dotpilotDir); os.IsNotExist(err) {
-                        utils.Logger.Error().Msg("Dotpilot is not initialized. Run 'dotpilot init' first.")
-                        os.Exit(1)
+                // Open the dotpilot repository
+                repo, err := openRepository()
+                if err != nil {
+                        return err
                 }
+                dotpilotDir := repo.Dir
 
                 // Create secret manager
-                secretManager := core.NewSecretManager(dotpilotDir)
+                secretManager := core.NewSecretManager(dotpilotDir).ForEnvironment(secretEnvironment(repo, secretEnv))
                 if err := secretManager.Initialize(); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to initialize secret manager")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to initialize secret manager")
+                }
+
+                // By layer, with their health
+                if secretListTree || secretListVerify || secretListJSON {
+                        list := secretManager.ListAllSecretMetadata
+                        if secretEnv != "" {
+                                list = secretManager.ListSecretMetadata
+                        }
+                        secrets, err := list()
+                        if err != nil {
+                                return withMessage(err, "Failed to list secrets")
+                        }
+                        return printSecretHealth(out, repo.Home, secretManager.Health(secrets, secretListVerify), secretListJSON)
                 }
 
                 // List secrets
-                secrets, err := secretManager.ListSecrets()
+                secrets, err := secretManager.ListSecretMetadata()
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to list secrets")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to list secrets")
+                }
+
+                // With their metadata
+                if secretListLong {
+                        printSecretMetadata(out, secrets)
+                        return nil
                 }
 
                 if len(secrets) == 0 {
-                        fmt.Println("No secrets found.")
-                        return
+                        fmt.Fprintln(out, "No secrets found.")
+                        return nil
                 }
 
-                fmt.Println("Encrypted secrets:")
-                for _, s := range secrets {
-                        fmt.Printf("- %s\n", s)
+                fmt.Fprintln(out, "Encrypted secrets:")
+                printSecretNames(out, secrets)
+                return nil
+        },
+}
+
+// textconvSecretCmd is the textconv command of the dotpilot-secret git diff driver
+var textconvSecretCmd = &cobra.Command{
+        Use:    "textconv [file]",
+        Short:  "Describe an encrypted secret for git diff",
+        Hidden: true,
+        Args:   nonEmptyArgs(cobra.ExactArgs(1)),
+        RunE: func(cmd *cobra.Command, args []string) error {
+                data, err := os.ReadFile(args[0])
+                if err != nil {
+                        return withMessage(err, fmt.Sprintf("Failed to read %s", args[0]))
                 }
+                fmt.Fprint(cmd.OutOrStdout(), core.DescribeSecretBlob(data))
+                return nil
         },
 }
 
@@ -253,51 +684,46 @@ For example:
 var removeSecretCmd = &cobra.Command{
         Use:   "remove [name]",
         Short: "Remove a secret",
-        Long: `Remove an encrypted secret from the dotpilot repository.
+        Long: `Remove an encrypted secret from the dotpilot repository. A secret of an
+environment is removed with --env, without it the common secret is removed.
 
 For example:
-  dotpilot secrets remove aws_credentials`,
-        Args: cobra.ExactArgs(1),
-        Run: func(cmd *cobra.Command, args []string) {
-                // Get home directory
-                home, err := os.UserHomeDir()
+  dotpilot secrets remove aws_credentials
+  dotpilot secrets remove api_key --env prod`,
+        Args: nonEmptyArgs(cobra.ExactArgs(1)),
+        RunE: func(cmd *cobra.Command, args []string) error {
+                // Open the dotpilot repository
+                repo, err := openRepository()
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to get home directory")
-                        os.Exit(1)
+                        return err
                 }
-
-                // Check if dotpilot is initialized
-                dotpilotDir := filepath.Join(home, ".dotpilot")
-                if _, err := os.Stat(dotpilotDir); os.IsNotExist(err) {
-                        utils.Logger.Error().Msg("Dotpilot is not initialized. Run 'dotpilot init' first.")
-                        os.Exit(1)
+                if err := lockRepository(repo.Home); err != nil {
+                        return err
                 }
+                dotpilotDir := repo.Dir
 
                 // Get secret name
                 secretName := args[0]
 
-                // Create secret manager
-                secretManager := core.NewSecretManager(dotpilotDir)
+                // Create secret manager for the chosen environment
+                secretManager := core.NewSecretManager(dotpilotDir).ForEnvironment(secretEnv)
                 if err := secretManager.Initialize(); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to initialize secret manager")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to initialize secret manager")
                 }
 
                 // Remove the secret
                 utils.Logger.Info().Msgf("Removing secret %s", secretName)
                 if err := secretManager.RemoveSecret(secretName); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to remove secret")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to remove secret")
                 }
 
-                // Commit changes
-                utils.Logger.Info().Msg("Committing changes...")
-                if err := core.CommitChanges(dotpilotDir, fmt.Sprintf("Removed encrypted secret: %s", secretName)); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to commit changes")
-                        os.Exit(1)
+                // Commit or stage changes
+                if err := commitOrStage(dotpilotDir, fmt.Sprintf("Removed encrypted secret: %s", secretName), secretNoCommit); err != nil {
+                        return err
                 }
 
                 utils.Logger.Info().Msgf("Successfully removed secret %s", secretName)
+                return nil
         },
 }
 
@@ -305,15 +731,61 @@ func init() {
         rootCmd.AddCommand(secretsCmd)
         secretsCmd.AddCommand(addSecretCmd)
         secretsCmd.AddCommand(getSecretCmd)
+        secretsCmd.AddCommand(showSecretCmd)
+        secretsCmd.AddCommand(exportEnvSecretCmd)
+        secretsCmd.AddCommand(infoSecretCmd)
         secretsCmd.AddCommand(listSecretsCmd)
         secretsCmd.AddCommand(removeSecretCmd)
+        secretsCmd.AddCommand(importSecretCmd)
+        secretsCmd.AddCommand(textconvSecretCmd)
 
         // Add flags for add-secret command
         addSecretCmd.Flags().StringVar(&secretDestination, "name", "", "Custom name for the secret")
+        addSecretCmd.Flags().BoolVar(&secretStdin, "stdin", false, "Read the secret from standard input instead of a file (requires --name)")
         addSecretCmd.Flags().BoolVar(&secretOverwrite, "overwrite", false, "Overwrite existing secret")
+        addSecretCmd.Flags().BoolVar(&secretNoCommit, "no-commit", false, "Stage the change without committing it")
+        addSecretCmd.Flags().StringVar(&secretTarget, "dest", "", "Where the secret is meant to be decrypted to (defaults to the source file)")
+        addSecretCmd.Flags().BoolVar(&secretDiffDriver, "git-attributes", false, "Configure git to diff secrets by their metadata instead of their ciphertext")
+        addSecretCmd.Flags().StringVar(&secretEnv, "env", "", "Environment the secret belongs to (common if not set)")
+        addSecretCmd.Flags().StringVar(&secretEnvVar, "env-var", "", "Encrypt the value of this environment variable instead of a file")
+
+        // Add flags for list-secrets command
+        listSecretsCmd.Flags().BoolVarP(&secretListLong, "long", "l", false, "Show the backend, destination, added time and hash of each secret")
+        listSecretsCmd.Flags().StringVar(&secretEnv, "env", "", "List the secrets of this environment (defaults to the current one)")
+        listSecretsCmd.Flags().BoolVar(&secretListTree, "tree", false, "List the secrets grouped by layer with their metadata and health")
+        listSecretsCmd.Flags().BoolVar(&secretListVerify, "verify", false, "Decrypt each secret to check it can be (implies --tree)")
+        listSecretsCmd.Flags().BoolVar(&secretListJSON, "json", false, "Print the secrets and their health as JSON")
+        listSecretsCmd.MarkFlagsMutuallyExclusive("long", "tree")
+        listSecretsCmd.MarkFlagsMutuallyExclusive("long", "json")
+
+        // Add flags for remove-secret command
+        removeSecretCmd.Flags().BoolVar(&secretNoCommit, "no-commit", false, "Stage the change without committing it")
+        removeSecretCmd.Flags().StringVar(&secretEnv, "env", "", "Environment the secret belongs to (common if not set)")
+
+        // Add flags for import-secrets command
+        importSecretCmd.Flags().StringVar(&secretFromDotenv, "from-dotenv", "", "Import the variables of a .env file")
+        importSecretCmd.Flags().StringVar(&secretFromPass, "from-pass", "", "Import a pass entry, or every entry below a pass folder")
+        importSecretCmd.Flags().BoolVar(&secretFromJSON, "from-stdin-json", false, "Import a JSON object of names to values from standard input")
+        importSecretCmd.Flags().BoolVar(&secretOverwrite, "overwrite", false, "Overwrite existing secrets")
+        importSecretCmd.Flags().BoolVar(&secretNoCommit, "no-commit", false, "Stage the change without committing it")
+        importSecretCmd.Flags().StringVar(&secretEnv, "env", "", "Environment the secrets belong to (common if not set)")
+        importSecretCmd.MarkFlagsMutuallyExclusive("from-dotenv", "from-pass", "from-stdin-json")
 
         // Add flags for get-secret command
         getSecretCmd.Flags().BoolVar(&secretOverwrite, "overwrite", false, "Overwrite existing file")
+        getSecretCmd.Flags().BoolVar(&secretReplaceLink, "replace-link", false, "Replace a destination that links into the dotpilot repository with a regular file")
+        getSecretCmd.Flags().BoolVar(&secretGetAll, "all", false, "Decrypt every secret to its recorded destination")
+        showSecretCmd.Flags().BoolVar(&secretShowForce, "force", false, "Print the secret to a terminal without a warning")
+        getSecretCmd.Flags().IntVar(&secretParallel, "parallel", core.DefaultSecretParallelism, "Number of secrets to decrypt at once with --all")
+        getSecretCmd.Flags().StringVar(&secretEnv, "env", "", "Get the secrets of this environment (defaults to the current one)")
+        showSecretCmd.Flags().StringVar(&secretEnv, "env", "", "Show the secret of this environment (defaults to the current one)")
+        exportEnvSecretCmd.Flags().BoolVar(&secretShowForce, "force", false, "Print the secrets to a terminal without a warning")
+        exportEnvSecretCmd.Flags().StringVar(&secretEnv, "env", "", "Export the secrets of this environment (defaults to the current one)")
+        infoSecretCmd.Flags().StringVar(&secretEnv, "env", "", "Show the secret of this environment (defaults to the current one)")
+        infoSecretCmd.Flags().BoolVar(&secretInfoJSON, "json", false, "Print the info as JSON")
+        for _, c := range []*cobra.Command{addSecretCmd, importSecretCmd, getSecretCmd, showSecretCmd, listSecretsCmd, removeSecretCmd} {
+                registerFlagCompletion(c, "env", completeSecretEnvFlag)
+        }
 
         // Enable filepath completion for add-secret
         addSecretCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
@@ -328,17 +800,16 @@ func init() {
                 }
 
                 // Get available secrets
-                home, err := os.UserHomeDir()
+                repo, err := core.OpenRepository()
                 if err != nil {
                         return nil, cobra.ShellCompDirectiveNoFileComp
                 }
 
-                dotpilotDir := filepath.Join(home, ".dotpilot")
-                if _, err := os.Stat(dotpilotDir); os.IsNotExist(err) {
-                        return nil, cobra.ShellCompDirectiveNoFileComp
+                environment := secretEnvironment(repo, secretEnv)
+                if cmd == removeSecretCmd {
+                        environment = secretEnv
                 }
-
-                secretManager := core.NewSecretManager(dotpilotDir)
+                secretManager := core.NewSecretManager(repo.Dir).ForEnvironment(environment)
                 if err := secretManager.Initialize(); err != nil {
                         return nil, cobra.ShellCompDirectiveNoFileComp
                 }
@@ -352,5 +823,212 @@ func init() {
         }
 
         getSecretCmd.ValidArgsFunction = secretCompleter
+        showSecretCmd.ValidArgsFunction = secretCompleter
         removeSecretCmd.ValidArgsFunction = secretCompleter
-}
\ No newline at end of file
+}
+
+// secretEnvironment returns the environment whose secrets get, show and list
+// see: env, the value of their --env flag, or the current environment
+func secretEnvironment(repo *core.Repository, env string) string {
+        if env != "" {
+                return env
+        }
+        return repo.Environment()
+}
+
+// completeSecretEnvFlag completes an --env flag of the secret commands with
+// common and the environments
+func completeSecretEnvFlag(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+        return append([]string{"common"}, environmentNames()...), cobra.ShellCompDirectiveNoFileComp
+}
+
+// printSecretNames prints a list of secrets, marking those of an environment
+// with their layer
+func printSecretNames(out io.Writer, secrets []core.SecretMetadata) {
+        for _, s := range secrets {
+                if s.Environment != "" {
+                        fmt.Fprintf(out, "- %s (%s)\n", s.Name, s.Layer())
+                } else {
+                        fmt.Fprintf(out, "- %s\n", s.Name)
+                }
+        }
+}
+
+// printSecretMetadata prints a table of secrets and their metadata
+func printSecretMetadata(out io.Writer, secrets []core.SecretMetadata) {
+        if len(secrets) == 0 {
+                fmt.Fprintln(out, "No secrets found.")
+                return
+        }
+
+        w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(w, "NAME\tLAYER\tBACKEND\tDESTINATION\tADDED\tSHA256")
+        for _, s := range secrets {
+                destination := s.Destination
+                if s.EnvVar != "" {
+                        destination = "$" + s.EnvVar
+                } else if destination == "" {
+                        destination = "-"
+                }
+                hash := s.SHA256
+                if len(hash) > 12 {
+                        hash = hash[:12]
+                }
+                fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.Name, s.Layer(), s.Backend, destination, s.Added.Local().Format("2006-01-02 15:04"), hash)
+        }
+        w.Flush()
+}
+
+// printSecretHealth prints the health of secrets grouped by their layer, with
+// the problems found below, or as JSON
+func printSecretHealth(out io.Writer, home string, health []core.SecretHealth, asJSON bool) error {
+        if asJSON {
+                if health == nil {
+                        health = []core.SecretHealth{}
+                }
+                if err := printJSON(out, health); err != nil {
+                        return withMessage(err, "Failed to print secrets")
+                }
+                return nil
+        }
+
+        if len(health) == 0 {
+                fmt.Fprintln(out, "No secrets found.")
+                return nil
+        }
+
+        var layers []string
+        byLayer := make(map[string][]core.SecretHealth)
+        for _, h := range health {
+                if _, ok := byLayer[h.Layer]; !ok {
+                        layers = append(layers, h.Layer)
+                }
+                byLayer[h.Layer] = append(byLayer[h.Layer], h)
+        }
+
+        var problems []string
+        for _, layer := range layers {
+                fmt.Fprintln(out, layer)
+                w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+                for _, h := range byLayer[layer] {
+                        destination, present := tildePath(home, h.Destination), "missing"
+                        if h.EnvVar != "" {
+                                destination = "$" + h.EnvVar
+                        } else if destination == "" {
+                                destination, present = "-", "-"
+                        }
+                        if h.Present {
+                                present = "present"
+                        }
+                        decryptable := "decryptable"
+                        if !h.Decryptable {
+                                decryptable = "not decryptable"
+                        } else if h.Verified {
+                                decryptable = "verified"
+                        }
+                        fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\t%s\n", h.Name, h.Backend, destination, h.Added.Local().Format("2006-01-02"), decryptable, present)
+
+                        if h.Problem != "" {
+                                problems = append(problems, fmt.Sprintf("%s (%s): %s", h.Name, h.Layer, h.Problem))
+                        }
+                        if h.Changed {
+                                problems = append(problems, fmt.Sprintf("%s (%s): changed since it was added, its hash no longer matches the recorded one", h.Name, h.Layer))
+                        }
+                }
+                w.Flush()
+        }
+
+        if len(problems) > 0 {
+                fmt.Fprintln(out, "\nProblems:")
+                for _, p := range problems {
+                        fmt.Fprintf(out, "- %s\n", p)
+                }
+        }
+        return nil
+}
+
+// expandHome expands a leading ~ in path to the home directory, and fails if
+// path can't be expanded, like an empty path or a bare ~, see utils.ExpandHome
+func expandHome(home, path string) (string, error) {
+        expanded, err := utils.ExpandHome(home, path)
+        if err != nil {
+                return "", withMessage(err, "Invalid path")
+        }
+        return expanded, nil
+}
+
+// getSecretArgs accepts a name and destination, or no arguments when *all is set
+func getSecretArgs(all *bool) cobra.PositionalArgs {
+        return func(cmd *cobra.Command, args []string) error {
+                if *all {
+                        if len(args) > 0 {
+                                return fmt.Errorf("--all does not take a name or destination, secrets are decrypted to their recorded destinations")
+                        }
+                        return nil
+                }
+                return cobra.ExactArgs(2)(cmd, args)
+        }
+}
+
+// restoreAllSecrets decrypts every secret that has a recorded destination
+// using decryptAll. Secrets whose destination exists (without overwrite) or
+// links into the repository are reported and left alone. It returns whether
+// every secret was restored.
+func restoreAllSecrets(home, dotpilotDir string, secrets []core.SecretMetadata, overwrite, replaceLink bool, parallel int, decryptAll func([]core.SecretRestore, int) []error) bool {
+        if parallel < 1 {
+                utils.Logger.Error().Msgf("Invalid --parallel value %d, it must be at least 1", parallel)
+                return false
+        }
+
+        ok := true
+        var restores []core.SecretRestore
+        for _, s := range secrets {
+                if s.Destination == "" {
+                        utils.Logger.Warn().Msgf("Skipping %s: no destination recorded, use 'get %s <destination>'", s.Name, s.Name)
+                        continue
+                }
+
+                destPath, err := utils.ExpandHome(home, s.Destination)
+                if err == nil {
+                        destPath, err = filepath.Abs(destPath)
+                }
+                if err != nil {
+                        utils.Logger.Error().Err(err).Msgf("Failed to get absolute path for %s", s.Destination)
+                        ok = false
+                        continue
+                }
+
+                if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+                        utils.Logger.Error().Err(err).Msgf("Failed to create directory %s", filepath.Dir(destPath))
+                        ok = false
+                        continue
+                }
+
+                if err := core.CheckSecretDestination(dotpilotDir, destPath, replaceLink); err != nil {
+                        utils.Logger.Error().Err(err).Msgf("Refusing to decrypt %s", s.Name)
+                        ok = false
+                        continue
+                }
+
+                if _, err := os.Stat(destPath); err == nil && !overwrite {
+                        utils.Logger.Error().Msgf("Destination file already exists: %s. Use --overwrite to replace it.", destPath)
+                        ok = false
+                        continue
+                }
+
+                restores = append(restores, core.SecretRestore{Name: s.Name, Environment: s.Environment, Destination: destPath})
+        }
+
+        restored := 0
+        for i, err := range decryptAll(restores, parallel) {
+                if err != nil {
+                        utils.Logger.Error().Err(err).Msgf("Failed to decrypt %s", restores[i].Name)
+                        ok = false
+                        continue
+                }
+                restored++
+        }
+
+        utils.Logger.Info().Msgf("Restored %d of %d secrets", restored, len(secrets))
+        return ok
+}
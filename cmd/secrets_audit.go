@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	auditFix  bool // Whether to move flagged files into encrypted secrets
+	auditJSON bool // Whether to print the findings as JSON
+)
+
+// auditSecretCmd represents the secrets audit command
+var auditSecretCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Look for plaintext secrets in the tracked files",
+	Long: `Scan every committed dotfile for lines that look like plaintext secrets:
+private keys and AWS credentials (severity high), passwords assigned in
+configuration (medium) and long random-looking tokens (low). The encrypted
+secrets, binary files and values encrypted with SOPS are not reported.
+
+The exit status is 1 if anything was found, so the audit can gate CI.
+
+With --fix, each flagged file is moved into the encrypted secrets, named after
+its target (.aws/credentials becomes aws_credentials) and in the environment of
+its layer, and the change is committed. A target in the home directory that
+links to the file is replaced with a regular copy. The plaintext remains in
+the git history; rotate the secret if the repository was ever pushed.
+
+For example:
+  dotpilot secrets audit
+  dotpilot secrets audit --json
+  dotpilot secrets audit --fix`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if auditFix {
+			if err := lockRepository(repo.Home); err != nil {
+				return err
+			}
+		}
+
+		findings, err := core.AuditRepository(repo.Dir)
+		if err != nil {
+			return withMessage(err, "Failed to audit the tracked files")
+		}
+
+		if auditJSON {
+			if findings == nil {
+				findings = []core.AuditFinding{}
+			}
+			if err := printJSON(out, findings); err != nil {
+				return withMessage(err, "Failed to encode the findings")
+			}
+		} else if len(findings) == 0 {
+			fmt.Fprintln(out, "No plaintext secrets found.")
+		} else {
+			w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "SEVERITY\tLOCATION\tFINDING")
+			for _, finding := range findings {
+				fmt.Fprintf(w, "%s\t%s:%d\t%s\n", finding.Severity, finding.Path, finding.Line, finding.Reason)
+			}
+			w.Flush()
+		}
+
+		if len(findings) == 0 {
+			return nil
+		}
+		if !auditFix {
+			return exitStatus(ExitGeneral)
+		}
+
+		// Move each flagged file once
+		var moved []string
+		failed := false
+		seen := map[string]bool{}
+		for _, finding := range findings {
+			if seen[finding.Path] {
+				continue
+			}
+			seen[finding.Path] = true
+
+			name, err := core.MoveToSecrets(repo.Dir, repo.Home, finding.Dotfile)
+			if err != nil {
+				utils.Logger.Error().Err(err).Msgf("Failed to move %s into the secrets", finding.Path)
+				failed = true
+				continue
+			}
+			utils.Logger.Info().Msgf("Moved %s into the encrypted secret %s", finding.Path, name)
+			moved = append(moved, name)
+		}
+
+		if len(moved) > 0 {
+			if err := commitOrStage(repo.Dir, fmt.Sprintf("Moved plaintext secrets into encrypted secrets: %s", strings.Join(moved, ", ")), false); err != nil {
+				return err
+			}
+			utils.Logger.Warn().Msg("The plaintext is still in the git history, rotate these secrets if the repository was ever pushed")
+		}
+		if failed {
+			return exitStatus(ExitGeneral)
+		}
+		return nil
+	},
+}
+
+func init() {
+	secretsCmd.AddCommand(auditSecretCmd)
+
+	auditSecretCmd.Flags().BoolVar(&auditFix, "fix", false, "Move flagged files into encrypted secrets")
+	auditSecretCmd.Flags().BoolVar(&auditJSON, "json", false, "Print the findings as JSON")
+}
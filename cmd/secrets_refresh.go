@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/spf13/cobra"
+)
+
+var (
+	refreshSince    string // Commit to refresh the secrets changed since
+	refreshParallel int    // How many secrets to decrypt at once
+)
+
+// reencryptOnPullCmd represents the secrets reencrypt-on-pull command
+var reencryptOnPullCmd = &cobra.Command{
+	Use:   "reencrypt-on-pull [on|off]",
+	Short: "Refresh decrypted secrets when a pull changes them",
+	Long: `Turn on or off decrypting secrets again when 'dotpilot sync' pulls a new
+version of them, so the plaintext at their destinations stays current. The
+setting is stored as reencrypt_on_pull in the options of ~/.dotpilotrc. Without
+an argument the current setting is shown.
+
+A secret changed when the hash of its blob recorded in the pulled metadata
+index differs from the one before the pull. Only unlocked secrets are
+refreshed, those already decrypted to their recorded destination on this
+machine; secrets that were never decrypted here, or whose plaintext was
+removed, stay locked. The refresh runs after the pull, before the post-pull
+hooks, and is skipped with --no-apply.
+
+With --since, the secrets changed since that commit are refreshed right away,
+for example after pulling with git directly.
+
+For example:
+  dotpilot secrets reencrypt-on-pull on
+  dotpilot secrets reencrypt-on-pull --since HEAD~1`,
+	Args:      cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+	ValidArgs: []string{"on", "off"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+
+		if len(args) == 1 {
+			if err := core.SetReencryptOnPull(args[0] == "on"); err != nil {
+				return withMessage(err, "Failed to save the configuration")
+			}
+		}
+		if len(args) == 1 || refreshSince == "" {
+			state := "off"
+			if core.ReencryptOnPull() {
+				state = "on"
+			}
+			fmt.Fprintf(out, "Refreshing secrets after a pull is %s\n", state)
+		}
+
+		if refreshSince != "" {
+			since, err := core.ResolveCommit(repo.Dir, refreshSince)
+			if err != nil {
+				return withMessage(err, "Failed to resolve --since")
+			}
+			if !refreshChangedSecrets(repo, since, refreshParallel) {
+				return withMessage(fmt.Errorf("some secrets could not be refreshed"), "Failed to refresh secrets")
+			}
+		}
+		return nil
+	},
+}
+
+// refreshChangedSecrets decrypts the unlocked secrets of the current
+// environment that changed since the commit since again, and reports each.
+// It returns whether none failed.
+func refreshChangedSecrets(repo *core.Repository, since plumbing.Hash, parallel int) bool {
+	refreshes, err := core.RefreshChangedSecrets(repo.Dir, repo.Home, repo.Environment(), since, parallel)
+	if err != nil {
+		utils.Logger.Error().Err(err).Msg("Failed to find the secrets that changed")
+		return false
+	}
+
+	ok := true
+	refreshed := 0
+	for _, r := range refreshes {
+		switch {
+		case r.Err != nil:
+			utils.Logger.Error().Err(r.Err).Msgf("Failed to refresh secret %s", r.Secret.Name)
+			ok = false
+		case r.Refreshed:
+			utils.Logger.Info().Msgf("Refreshed secret %s at %s", r.Secret.Name, tildePath(repo.Home, r.Destination))
+			refreshed++
+		default:
+			utils.Logger.Info().Msgf("Secret %s changed, not refreshed: %s", r.Secret.Name, r.Skipped)
+		}
+	}
+	if len(refreshes) == 0 {
+		utils.Logger.Info().Msg("No secrets changed")
+	} else {
+		utils.Logger.Info().Msgf("Refreshed %d of %d changed secrets", refreshed, len(refreshes))
+	}
+	return ok
+}
+
+func init() {
+	secretsCmd.AddCommand(reencryptOnPullCmd)
+
+	reencryptOnPullCmd.Flags().StringVar(&refreshSince, "since", "", "Refresh the secrets changed since this commit now")
+	reencryptOnPullCmd.Flags().IntVar(&refreshParallel, "parallel", core.DefaultSecretParallelism, "Number of secrets to decrypt at once")
+}
@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+// snapshotCmd represents the snapshot command
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Create and restore named checkpoints of your dotfiles",
+	Long: `Take a named checkpoint of the repository and of the files it applied
+before a risky change, and return to it later.
+
+A snapshot tags the current commit and records which of the managed files in
+your home directory are symlinks and where they point, keeping copies of the
+ones that are regular files. Snapshots are local to this machine: the tags are
+not pushed and the recorded state is kept out of git.
+
+For example:
+  dotpilot snapshot create before-zsh-rewrite
+  dotpilot snapshot list
+  dotpilot snapshot restore before-zsh-rewrite
+  dotpilot snapshot delete before-zsh-rewrite`,
+}
+
+// snapshotCreateCmd represents the snapshot create command
+var snapshotCreateCmd = &cobra.Command{
+	Use:   "create [name]",
+	Short: "Create a snapshot of the current state",
+	Long: `Tag the current commit as a snapshot and record the state of the managed
+files in your home directory. Uncommitted changes must be committed first.
+
+For example:
+  dotpilot snapshot create before-zsh-rewrite`,
+	Args: nonEmptyArgs(cobra.ExactArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+
+		snapshot, err := core.CreateSnapshot(repo.Dir, repo.Environment(), args[0])
+		if err != nil {
+			return withMessage(err, "Failed to create snapshot")
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "Created snapshot %s at %s (%d files)\n", snapshot.Name, snapshot.Commit[:7], len(snapshot.Targets))
+		return nil
+	},
+}
+
+// snapshotRestoreCmd represents the snapshot restore command
+var snapshotRestoreCmd = &cobra.Command{
+	Use:   "restore [name]",
+	Short: "Return to a snapshot",
+	Long: `Return the repository and your home directory to a snapshot.
+
+The content of the snapshot is committed on top of the current branch, so the
+history since the snapshot is kept and the next sync pushes the restore
+instead of undoing it. The snapshot's environment is then applied, symlinks to
+files the snapshot doesn't have are removed, and the recorded symlinks and
+regular files are put back. Files that are replaced are backed up first.
+
+For example:
+  dotpilot snapshot restore before-zsh-rewrite`,
+	Args: nonEmptyArgs(cobra.ExactArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+
+		snapshot, err := core.RestoreSnapshot(repo.Dir, args[0])
+		if err != nil {
+			return withMessage(err, "Failed to restore snapshot")
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "Restored snapshot %s from %s\n", snapshot.Name, snapshot.Created.Format("2006-01-02 15:04"))
+		return nil
+	},
+}
+
+// snapshotListCmd represents the snapshot list command
+var snapshotListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List snapshots",
+	Long: `List the snapshots on this machine, oldest first.
+
+For example:
+  dotpilot snapshot list`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+
+		snapshots, err := core.ListSnapshots(repo.Dir)
+		if err != nil {
+			return withMessage(err, "Failed to list snapshots")
+		}
+
+		if len(snapshots) == 0 {
+			fmt.Fprintln(out, "No snapshots found.")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tCREATED\tCOMMIT\tENVIRONMENT\tFILES")
+		for _, snapshot := range snapshots {
+			commit := snapshot.Commit
+			if len(commit) > 7 {
+				commit = commit[:7]
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", snapshot.Name, snapshot.Created.Format("2006-01-02 15:04"), commit, snapshot.Environment, len(snapshot.Targets))
+		}
+		w.Flush()
+		return nil
+	},
+}
+
+// snapshotDeleteCmd represents the snapshot delete command
+var snapshotDeleteCmd = &cobra.Command{
+	Use:   "delete [name]",
+	Short: "Delete a snapshot",
+	Long: `Delete the tag and the recorded state of a snapshot. The commits it pointed
+to stay in the history.
+
+For example:
+  dotpilot snapshot delete before-zsh-rewrite`,
+	Args: nonEmptyArgs(cobra.ExactArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+
+		if err := core.DeleteSnapshot(repo.Dir, args[0]); err != nil {
+			return withMessage(err, "Failed to delete snapshot")
+		}
+
+		utils.Logger.Info().Msgf("Deleted snapshot %s", args[0])
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(snapshotCmd)
+	snapshotCmd.AddCommand(snapshotCreateCmd)
+	snapshotCmd.AddCommand(snapshotRestoreCmd)
+	snapshotCmd.AddCommand(snapshotListCmd)
+	snapshotCmd.AddCommand(snapshotDeleteCmd)
+}
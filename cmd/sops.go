@@ -1,7 +1,9 @@
 package cmd
 
 import (
+        "errors"
         "fmt"
+        "io"
         "os"
         "path/filepath"
 
@@ -15,6 +17,20 @@ var (
         sopsSecretOverwrite bool
         sopsSecretEdit     bool
         sopsNoProgress    bool // Whether to disable progress indicators
+        sopsSecretStdin   bool // Whether to read the secret from stdin
+        sopsNoCommit      bool // Whether to stage changes without committing them
+        sopsSecretTarget  string // Where the secret is meant to be decrypted to
+        sopsListLong      bool   // Whether to list secrets with their metadata
+        sopsListTree      bool   // Whether to list secrets by layer with their health
+        sopsListVerify    bool   // Whether to decrypt each listed secret to check it can be
+        sopsListJSON      bool   // Whether to print the listed secrets and their health as JSON
+        sopsDiffDriver    bool   // Whether to show secret metadata instead of ciphertext in git diffs
+        sopsReplaceLink   bool   // Whether to replace a dotpilot symlink at the destination
+        sopsGetAll        bool   // Whether to decrypt every secret to its recorded destination
+        sopsParallel      int    // How many secrets to decrypt at once with --all
+        sopsShowForce     bool   // Whether to print a secret to a terminal without a warning
+        sopsEnv           string // Environment the secrets belong to, see secretEnvironment
+        sopsInfoJSON      bool   // Whether to print the secret info as JSON
 )
 
 // sopsCmd represents the sops command
@@ -30,7 +46,10 @@ Requirements:
 - SOPS must be installed (https://github.com/mozilla/sops)
 
 DotPilot will create a SOPS configuration file and use your GPG key
-for encryption and decryption.`,
+for encryption and decryption.
+
+Like the secrets command, SOPS secrets are common to all environments unless
+they are added with --env, which stores them in sops-secrets/envs/<env>/.`,
 }
 
 // sopsAddCmd represents the sops add command
@@ -43,40 +62,57 @@ The file will be encrypted with GPG before being stored in the repository.
 For example:
   dotpilot sops add ~/.aws/credentials
   dotpilot sops add ~/.ssh/id_rsa --name ssh_key
-  dotpilot sops add ~/.npmrc --edit`,
-        Args: cobra.ExactArgs(1),
-        Run: func(cmd *cobra.Command, args []string) {
-                // Get home directory
-                home, err := os.UserHomeDir()
+  dotpilot sops add ~/.npmrc --edit
+  pass generate -n github/token | dotpilot sops add --stdin --name github_token
+  dotpilot sops add ~/.config/api/key.json --name api_key --env prod`,
+        Args: nonEmptyArgs(cobra.MaximumNArgs(1)),
+        RunE: func(cmd *cobra.Command, args []string) error {
+                // Open the dotpilot repository
+                repo, err := openRepository()
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to get home directory")
-                        os.Exit(1)
+                        return err
                 }
-
-                // Check if dotpilot is initialized
-                dotpilotDir := filepath.Join(home, ".dotpilot")
-                if _, err := os.Stat(dotpilotDir); os.IsNotExist(err) {
-                        utils.Logger.Error().Msg("Dotpilot is not initialized. Run 'dotpilot init' first.")
-                        os.Exit(1)
+                if err := lockRepository(repo.Home); err != nil {
+                        return err
                 }
+                dotpilotDir := repo.Dir
 
-                // Expand ~ to home directory
-                srcPath := args[0]
-                if srcPath[0] == '~' {
-                        srcPath = filepath.Join(home, srcPath[1:])
-                }
+                // Read the secret from stdin or locate the source file
+                var absPath string
+                var stdinData []byte
+                if sopsSecretStdin {
+                        if len(args) > 0 {
+                                return errors.New("Cannot use a file argument together with --stdin")
+                        }
+                        if sopsSecretName == "" {
+                                return errors.New("--name is required when reading from --stdin")
+                        }
 
-                // Get absolute path
-                absPath, err := filepath.Abs(srcPath)
-                if err != nil {
-                        utils.Logger.Error().Err(err).Msgf("Failed to get absolute path for %s", srcPath)
-                        os.Exit(1)
-                }
+                        stdinData, err = io.ReadAll(os.Stdin)
+                        if err != nil {
+                                return withMessage(err, "Failed to read from stdin")
+                        }
+                } else {
+                        if len(args) != 1 {
+                                return errors.New("A file to encrypt is required, or use --stdin")
+                        }
+
+                        // Expand ~ to home directory
+                        srcPath, err := expandHome(repo.Home, args[0])
+                        if err != nil {
+                                return err
+                        }
 
-                // Check if file exists
-                if _, err := os.Stat(absPath); os.IsNotExist(err) {
-                        utils.Logger.Error().Msgf("File does not exist: %s", absPath)
-                        os.Exit(1)
+                        // Get absolute path
+                        absPath, err = filepath.Abs(srcPath)
+                        if err != nil {
+                                return withMessage(err, fmt.Sprintf("Failed to get absolute path for %s", srcPath))
+                        }
+
+                        // Check if file exists
+                        if _, err := os.Stat(absPath); os.IsNotExist(err) {
+                                return fmt.Errorf("File does not exist: %s", absPath)
+                        }
                 }
 
                 // Determine secret name
@@ -85,51 +121,43 @@ For example:
                         sopsSecretName = filepath.Base(absPath)
                 }
 
-                // Create SOPS manager
-                sopsManager := core.NewSopsManager(dotpilotDir)
+                // Create SOPS manager for the chosen environment
+                sopsManager := core.NewSopsManager(dotpilotDir).ForEnvironment(sopsEnv)
                 if err := sopsManager.Initialize(); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to initialize SOPS manager")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to initialize SOPS manager")
                 }
 
                 // Check if secret already exists
-                secrets, err := sopsManager.ListSecrets()
-                if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to list secrets")
-                        os.Exit(1)
+                if err := sopsManager.CanAdd(sopsSecretName, sopsSecretOverwrite); err != nil {
+                        return withMessage(err, "Cannot add secret")
                 }
 
-                secretExists := false
-                for _, s := range secrets {
-                        if s == sopsSecretName {
-                                secretExists = true
-                                break
-                        }
-                }
-
-                if secretExists && !sopsSecretOverwrite {
-                        utils.Logger.Error().Msgf("Secret %s already exists. Use --overwrite to replace it.", sopsSecretName)
-                        os.Exit(1)
+                // Encrypt the file or the piped content
+                source := absPath
+                if sopsSecretStdin {
+                        source = "standard input"
                 }
-
-                // Encrypt the file
-                utils.Logger.Info().Msgf("Encrypting %s as %s", absPath, sopsSecretName)
+                utils.Logger.Info().Msgf("Encrypting %s as %s", source, sopsSecretName)
                 
                 // Create progress for encryption operation
                 var encryptOp *utils.Operation
                 if !sopsNoProgress {
-                    encryptOp = utils.NewOperation("encrypt", fmt.Sprintf("Encrypting %s...", filepath.Base(absPath)), utils.Spinner)
+                    encryptOp = utils.NewOperation("encrypt", fmt.Sprintf("Encrypting %s...", filepath.Base(source)), utils.Spinner)
                     encryptOp.Start()
                     // For larger files, encryption might take some time
                     encryptOp.SimulateProgress(3) // Simulate progress for 3 seconds
                 }
                 
-                if err := sopsManager.EncryptFile(absPath, sopsSecretName); err != nil {
+                if sopsSecretStdin {
+                        err = sopsManager.EncryptData(stdinData, sopsSecretName)
+                } else {
+                        err = sopsManager.EncryptFile(absPath, sopsSecretName)
+                }
+                if err != nil {
                         if encryptOp != nil {
                             encryptOp.Stop()
                         }
-                        utils.Logger.Error().Err(err).Msg("Failed to encrypt file")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to encrypt file")
                 }
                 
                 if encryptOp != nil {
@@ -138,23 +166,69 @@ For example:
 
                 utils.Logger.Info().Msgf("Successfully encrypted %s", sopsSecretName)
 
+                // Record the intended destination, if one was given
+                if sopsSecretTarget != "" {
+                        destination, err := expandHome(repo.Home, sopsSecretTarget)
+                        if err != nil {
+                                return err
+                        }
+                        if err := sopsManager.SetDestination(sopsSecretName, destination); err != nil {
+                                utils.Logger.Warn().Err(err).Msg("Failed to record the secret destination")
+                        }
+                }
+
+                // Show metadata instead of ciphertext in git diffs
+                if sopsDiffDriver {
+                        if err := sopsManager.EnableDiffDriver(); err != nil {
+                                utils.Logger.Warn().Err(err).Msg("Failed to configure the git diff driver for secrets")
+                        }
+                }
+
                 // If edit flag is set, open the secret for editing
                 if sopsSecretEdit {
                         utils.Logger.Info().Msg("Opening secret for editing...")
                         if err := sopsManager.EditSecret(sopsSecretName); err != nil {
-                                utils.Logger.Error().Err(err).Msg("Failed to edit secret")
-                                os.Exit(1)
+                                return withMessage(err, "Failed to edit secret")
                         }
                 }
 
-                // Commit changes
-                utils.Logger.Info().Msg("Committing changes...")
-                if err := core.CommitChanges(dotpilotDir, fmt.Sprintf("Added encrypted SOPS secret: %s", sopsSecretName)); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to commit changes")
-                        os.Exit(1)
+                // Commit or stage changes
+                if err := commitOrStage(dotpilotDir, fmt.Sprintf("Added encrypted SOPS secret: %s", sopsSecretName), sopsNoCommit); err != nil {
+                        return err
                 }
 
                 utils.Logger.Info().Msg("Secret added successfully!")
+                return nil
+        },
+}
+
+// sopsShowCmd represents the sops show command
+var sopsShowCmd = &cobra.Command{
+        Use:   "show [name]",
+        Short: "Print a decrypted secret",
+        Long: `Decrypt a secret with SOPS and print it to standard output, for use in
+scripts. The plaintext is only held in memory, no file is written.
+
+Printed to a terminal, the secret may end up in the scrollback or a session
+recording, so a warning is logged first unless --force is given.
+
+For example:
+  export NPM_TOKEN=$(dotpilot sops show npm_token)`,
+        Args: nonEmptyArgs(cobra.ExactArgs(1)),
+        RunE: func(cmd *cobra.Command, args []string) error {
+                // Open the dotpilot repository
+                repo, err := openRepository()
+                if err != nil {
+                        return err
+                }
+
+                // Create SOPS manager
+                sopsManager := core.NewSopsManager(repo.Dir).ForEnvironment(secretEnvironment(repo, sopsEnv))
+                if err := sopsManager.Initialize(); err != nil {
+                        return withMessage(err, "Failed to initialize SOPS manager")
+                }
+
+                return showSecret(cmd.OutOrStdout(), args[0], sopsManager.DecryptData, sopsShowForce)
         },
 }
 
@@ -165,59 +239,83 @@ var sopsGetCmd = &cobra.Command{
         Long: `Decrypt and retrieve a secret from the dotpilot repository.
 The secret will be decrypted and saved to the specified destination.
 
+With --all, every secret is decrypted to the destination recorded when it was
+added. Up to --parallel secrets are decrypted at once; the first one is
+decrypted alone so the GPG passphrase is only asked for once. Only the common
+secrets and those of the current environment, or of --env, are decrypted.
+
 For example:
   dotpilot sops get aws_credentials ~/.aws/credentials
-  dotpilot sops get ssh_key ~/.ssh/id_rsa`,
-        Args: cobra.ExactArgs(2),
-        Run: func(cmd *cobra.Command, args []string) {
-                // Get home directory
-                home, err := os.UserHomeDir()
+  dotpilot sops get ssh_key ~/.ssh/id_rsa
+  dotpilot sops get --all --parallel 8
+
+A destination that is a symlink into the dotpilot repository is refused, since
+the plaintext would end up in the repository. Use --replace-link to replace
+such a link with a regular file.`,
+        Args: nonEmptyArgs(getSecretArgs(&sopsGetAll)),
+        RunE: func(cmd *cobra.Command, args []string) error {
+                // Open the dotpilot repository
+                repo, err := openRepository()
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to get home directory")
-                        os.Exit(1)
+                        return err
+                }
+                if err := lockRepository(repo.Home); err != nil {
+                        return err
                 }
+                dotpilotDir := repo.Dir
+
+                if sopsGetAll {
+                        sopsManager := core.NewSopsManager(dotpilotDir).ForEnvironment(secretEnvironment(repo, sopsEnv))
+                        if err := sopsManager.Initialize(); err != nil {
+                                return withMessage(err, "Failed to initialize SOPS manager")
+                        }
 
-                // Check if dotpilot is initialized
-                dotpilotDir := filepath.Join(home, ".dotpilot")
-                if _, err := os.Stat(dotpilotDir); os.IsNotExist(err) {
-                        utils.Logger.Error().Msg("Dotpilot is not initialized. Run 'dotpilot init' first.")
-                        os.Exit(1)
+                        secrets, err := sopsManager.ListSecretMetadata()
+                        if err != nil {
+                                return withMessage(err, "Failed to list SOPS secrets")
+                        }
+
+                        if !restoreAllSecrets(repo.Home, dotpilotDir, secrets, sopsSecretOverwrite, sopsReplaceLink, sopsParallel, sopsManager.DecryptAll) {
+                                return exitStatus(ExitCrypto)
+                        }
+                        return nil
                 }
 
                 // Get secret name and destination
                 secretName := args[0]
-                destPath := args[1]
 
                 // Expand ~ to home directory in destination
-                if destPath[0] == '~' {
-                        destPath = filepath.Join(home, destPath[1:])
+                destPath, err := expandHome(repo.Home, args[1])
+                if err != nil {
+                        return err
                 }
 
                 // Get absolute path for destination
                 destPath, err = filepath.Abs(destPath)
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msgf("Failed to get absolute path for %s", destPath)
-                        os.Exit(1)
+                        return withMessage(err, fmt.Sprintf("Failed to get absolute path for %s", destPath))
                 }
 
                 // Create parent directories if needed
                 parentDir := filepath.Dir(destPath)
                 if err := os.MkdirAll(parentDir, 0755); err != nil {
-                        utils.Logger.Error().Err(err).Msgf("Failed to create directory %s", parentDir)
-                        os.Exit(1)
+                        return withMessage(err, fmt.Sprintf("Failed to create directory %s", parentDir))
+                }
+
+                // Never decrypt into the repository through a dotpilot symlink
+                if err := core.CheckSecretDestination(dotpilotDir, destPath, sopsReplaceLink); err != nil {
+                        return withMessage(err, "Refusing to decrypt secret")
                 }
 
                 // Check if destination file exists
                 if _, err := os.Stat(destPath); err == nil && !sopsSecretOverwrite {
-                        utils.Logger.Error().Msgf("Destination file already exists: %s. Use --overwrite to replace it.", destPath)
-                        os.Exit(1)
+                        return fmt.Errorf("Destination file already exists: %s. Use --overwrite to replace it.", destPath)
                 }
 
                 // Create SOPS manager
-                sopsManager := core.NewSopsManager(dotpilotDir)
+                sopsManager := core.NewSopsManager(dotpilotDir).ForEnvironment(secretEnvironment(repo, sopsEnv))
                 if err := sopsManager.Initialize(); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to initialize SOPS manager")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to initialize SOPS manager")
                 }
 
                 // Decrypt the secret
@@ -235,8 +333,7 @@ For example:
                         if decryptOp != nil {
                             decryptOp.Stop()
                         }
-                        utils.Logger.Error().Err(err).Msg("Failed to decrypt secret")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to decrypt secret")
                 }
                 
                 if decryptOp != nil {
@@ -244,6 +341,37 @@ For example:
                 }
 
                 utils.Logger.Info().Msgf("Successfully decrypted %s to %s", secretName, destPath)
+                return nil
+        },
+}
+
+// sopsInfoCmd represents the sops info command
+var sopsInfoCmd = &cobra.Command{
+        Use:   "info [name]",
+        Short: "Show the metadata of a secret without decrypting it",
+        Long: `Show what is known about a SOPS secret without decrypting it: its layer,
+destination, when it was added and the hash of the encrypted file from the
+metadata index, and the size and permissions of the file. Neither sops nor
+gpg is needed.
+
+For example:
+  dotpilot sops info npm_token
+  dotpilot sops info api_key --env prod --json`,
+        Args: nonEmptyArgs(cobra.ExactArgs(1)),
+        RunE: func(cmd *cobra.Command, args []string) error {
+                // Open the dotpilot repository
+                repo, err := openRepository()
+                if err != nil {
+                        return err
+                }
+
+                // Create SOPS manager
+                sopsManager := core.NewSopsManager(repo.Dir).ForEnvironment(secretEnvironment(repo, sopsEnv))
+                if err := sopsManager.Initialize(); err != nil {
+                        return withMessage(err, "Failed to initialize SOPS manager")
+                }
+
+                return showSecretInfo(cmd.OutOrStdout(), repo.Home, args[0], sopsManager.Info, sopsInfoJSON)
         },
 }
 
@@ -251,48 +379,72 @@ For example:
 var sopsListCmd = &cobra.Command{
         Use:   "list",
         Short: "List all SOPS secrets",
-        Long: `List all encrypted secrets stored in the dotpilot repository.
+        Long: `List the SOPS secrets stored in the dotpilot repository: the common
+secrets and those of the current environment, or of --env. Secrets of an
+environment are marked with their layer.
+
+With --tree, the secrets of every layer are listed grouped by layer, or only
+the common ones and those of --env, with their destination, added date and
+health on this machine: whether they can be decrypted here, which only checks
+that sops and the tools of its keys are present, and whether their plaintext
+is at their destination. --verify decrypts each secret to check it really can
+be, without writing it anywhere. --json prints the same as JSON.
 
 For example:
-  dotpilot sops list`,
-        Run: func(cmd *cobra.Command, args []string) {
-                // Get home directory
-                home, err := os.UserHomeDir()
+  dotpilot sops list
+  dotpilot sops list --long
+  dotpilot sops list --env prod
+  dotpilot sops list --tree --verify
+  dotpilot sops list --json`,
+        RunE: func(cmd *cobra.Command, args []string) error {
+                out := cmd.OutOrStdout()
+
+                // Open the dotpilot repository
+                repo, err := openRepository()
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to get home directory")
-                        os.Exit(1)
-                }
-
-                // Check if dotpilot is initialized
-                dotpilotDir := filepath.Join(home, ".dotpilot")
-                if _, err := os.Stat(dotpilotDir); os.IsNotExist(err) {
-                        utils.Logger.Error().Msg("Dotpilot is not initialized. Run 'dotpilot init' first.")
-                        os.Exit(1)
+                        return err
                 }
+                dotpilotDir := repo.Dir
 
                 // Create SOPS manager
-                sopsManager := core.NewSopsManager(dotpilotDir)
+                sopsManager := core.NewSopsManager(dotpilotDir).ForEnvironment(secretEnvironment(repo, sopsEnv))
                 if err := sopsManager.Initialize(); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to initialize SOPS manager")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to initialize SOPS manager")
+                }
+
+                // By layer, with their health
+                if sopsListTree || sopsListVerify || sopsListJSON {
+                        list := sopsManager.ListAllSecretMetadata
+                        if sopsEnv != "" {
+                                list = sopsManager.ListSecretMetadata
+                        }
+                        secrets, err := list()
+                        if err != nil {
+                                return withMessage(err, "Failed to list secrets")
+                        }
+                        return printSecretHealth(out, repo.Home, sopsManager.Health(secrets, sopsListVerify), sopsListJSON)
                 }
 
                 // List secrets
-                secrets, err := sopsManager.ListSecrets()
+                secrets, err := sopsManager.ListSecretMetadata()
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to list secrets")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to list secrets")
                 }
 
-                if len(secrets) == 0 {
-                        fmt.Println("No SOPS secrets found.")
-                        return
+                // With their metadata
+                if sopsListLong {
+                        printSecretMetadata(out, secrets)
+                        return nil
                 }
 
-                fmt.Println("SOPS encrypted secrets:")
-                for _, s := range secrets {
-                        fmt.Printf("- %s\n", s)
+                if len(secrets) == 0 {
+                        fmt.Fprintln(out, "No SOPS secrets found.")
+                        return nil
                 }
+
+                fmt.Fprintln(out, "SOPS encrypted secrets:")
+                printSecretNames(out, secrets)
+                return nil
         },
 }
 
@@ -300,51 +452,46 @@ For example:
 var sopsRemoveCmd = &cobra.Command{
         Use:   "remove [name]",
         Short: "Remove a SOPS secret",
-        Long: `Remove an encrypted SOPS secret from the dotpilot repository.
+        Long: `Remove an encrypted SOPS secret from the dotpilot repository. A secret of
+an environment is removed with --env, without it the common secret is removed.
 
 For example:
-  dotpilot sops remove aws_credentials`,
-        Args: cobra.ExactArgs(1),
-        Run: func(cmd *cobra.Command, args []string) {
-                // Get home directory
-                home, err := os.UserHomeDir()
+  dotpilot sops remove aws_credentials
+  dotpilot sops remove api_key --env prod`,
+        Args: nonEmptyArgs(cobra.ExactArgs(1)),
+        RunE: func(cmd *cobra.Command, args []string) error {
+                // Open the dotpilot repository
+                repo, err := openRepository()
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to get home directory")
-                        os.Exit(1)
+                        return err
                 }
-
-                // Check if dotpilot is initialized
-                dotpilotDir := filepath.Join(home, ".dotpilot")
-                if _, err := os.Stat(dotpilotDir); os.IsNotExist(err) {
-                        utils.Logger.Error().Msg("Dotpilot is not initialized. Run 'dotpilot init' first.")
-                        os.Exit(1)
+                if err := lockRepository(repo.Home); err != nil {
+                        return err
                 }
+                dotpilotDir := repo.Dir
 
                 // Get secret name
                 secretName := args[0]
 
-                // Create SOPS manager
-                sopsManager := core.NewSopsManager(dotpilotDir)
+                // Create SOPS manager for the chosen environment
+                sopsManager := core.NewSopsManager(dotpilotDir).ForEnvironment(sopsEnv)
                 if err := sopsManager.Initialize(); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to initialize SOPS manager")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to initialize SOPS manager")
                 }
 
                 // Remove the secret
                 utils.Logger.Info().Msgf("Removing secret %s", secretName)
                 if err := sopsManager.RemoveSecret(secretName); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to remove secret")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to remove secret")
                 }
 
-                // Commit changes
-                utils.Logger.Info().Msg("Committing changes...")
-                if err := core.CommitChanges(dotpilotDir, fmt.Sprintf("Removed encrypted SOPS secret: %s", secretName)); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to commit changes")
-                        os.Exit(1)
+                // Commit or stage changes
+                if err := commitOrStage(dotpilotDir, fmt.Sprintf("Removed encrypted SOPS secret: %s", secretName), sopsNoCommit); err != nil {
+                        return err
                 }
 
                 utils.Logger.Info().Msgf("Successfully removed secret %s", secretName)
+                return nil
         },
 }
 
@@ -357,47 +504,41 @@ This will open the secret in an editor for secure editing.
 
 For example:
   dotpilot sops edit aws_credentials`,
-        Args: cobra.ExactArgs(1),
-        Run: func(cmd *cobra.Command, args []string) {
-                // Get home directory
-                home, err := os.UserHomeDir()
+        Args: nonEmptyArgs(cobra.ExactArgs(1)),
+        RunE: func(cmd *cobra.Command, args []string) error {
+                // Open the dotpilot repository
+                repo, err := openRepository()
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to get home directory")
-                        os.Exit(1)
+                        return err
                 }
-
-                // Check if dotpilot is initialized
-                dotpilotDir := filepath.Join(home, ".dotpilot")
-                if _, err := os.Stat(dotpilotDir); os.IsNotExist(err) {
-                        utils.Logger.Error().Msg("Dotpilot is not initialized. Run 'dotpilot init' first.")
-                        os.Exit(1)
+                if err := lockRepository(repo.Home); err != nil {
+                        return err
                 }
+                dotpilotDir := repo.Dir
 
                 // Get secret name
                 secretName := args[0]
 
-                // Create SOPS manager
-                sopsManager := core.NewSopsManager(dotpilotDir)
+                // Create SOPS manager, the secret of the environment hides a
+                // common one
+                sopsManager := core.NewSopsManager(dotpilotDir).ForEnvironment(secretEnvironment(repo, sopsEnv))
                 if err := sopsManager.Initialize(); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to initialize SOPS manager")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to initialize SOPS manager")
                 }
 
                 // Edit the secret
                 utils.Logger.Info().Msgf("Editing secret %s", secretName)
                 if err := sopsManager.EditSecret(secretName); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to edit secret")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to edit secret")
                 }
 
-                // Commit changes
-                utils.Logger.Info().Msg("Committing changes...")
-                if err := core.CommitChanges(dotpilotDir, fmt.Sprintf("Edited encrypted SOPS secret: %s", secretName)); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to commit changes")
-                        os.Exit(1)
+                // Commit or stage changes
+                if err := commitOrStage(dotpilotDir, fmt.Sprintf("Edited encrypted SOPS secret: %s", secretName), sopsNoCommit); err != nil {
+                        return err
                 }
 
                 utils.Logger.Info().Msgf("Successfully edited secret %s", secretName)
+                return nil
         },
 }
 
@@ -405,6 +546,8 @@ func init() {
         rootCmd.AddCommand(sopsCmd)
         sopsCmd.AddCommand(sopsAddCmd)
         sopsCmd.AddCommand(sopsGetCmd)
+        sopsCmd.AddCommand(sopsShowCmd)
+        sopsCmd.AddCommand(sopsInfoCmd)
         sopsCmd.AddCommand(sopsListCmd)
         sopsCmd.AddCommand(sopsRemoveCmd)
         sopsCmd.AddCommand(sopsEditCmd)
@@ -414,10 +557,43 @@ func init() {
         sopsAddCmd.Flags().BoolVar(&sopsSecretOverwrite, "overwrite", false, "Overwrite existing secret")
         sopsAddCmd.Flags().BoolVar(&sopsSecretEdit, "edit", false, "Open the secret for editing after adding")
         sopsAddCmd.Flags().BoolVar(&sopsNoProgress, "no-progress", false, "Disable animated progress indicators")
+        sopsAddCmd.Flags().BoolVar(&sopsSecretStdin, "stdin", false, "Read the secret from standard input instead of a file (requires --name)")
+        sopsAddCmd.Flags().BoolVar(&sopsNoCommit, "no-commit", false, "Stage the change without committing it")
+        sopsAddCmd.Flags().StringVar(&sopsSecretTarget, "dest", "", "Where the secret is meant to be decrypted to (defaults to the source file)")
+        sopsAddCmd.Flags().BoolVar(&sopsDiffDriver, "git-attributes", false, "Configure git to diff secrets by their metadata instead of their ciphertext")
+
+        // Add flags for list command
+        sopsListCmd.Flags().BoolVarP(&sopsListLong, "long", "l", false, "Show the destination, added time and hash of each secret")
+        sopsListCmd.Flags().BoolVar(&sopsListTree, "tree", false, "List the secrets grouped by layer with their metadata and health")
+        sopsListCmd.Flags().BoolVar(&sopsListVerify, "verify", false, "Decrypt each secret to check it can be (implies --tree)")
+        sopsListCmd.Flags().BoolVar(&sopsListJSON, "json", false, "Print the secrets and their health as JSON")
+        sopsListCmd.MarkFlagsMutuallyExclusive("long", "tree")
+        sopsListCmd.MarkFlagsMutuallyExclusive("long", "json")
+
+        // Add flags for remove and edit commands
+        sopsRemoveCmd.Flags().BoolVar(&sopsNoCommit, "no-commit", false, "Stage the change without committing it")
+        sopsEditCmd.Flags().BoolVar(&sopsNoCommit, "no-commit", false, "Stage the change without committing it")
 
         // Add flags for get command
         sopsGetCmd.Flags().BoolVar(&sopsSecretOverwrite, "overwrite", false, "Overwrite existing file")
+        sopsGetCmd.Flags().BoolVar(&sopsReplaceLink, "replace-link", false, "Replace a destination that links into the dotpilot repository with a regular file")
         sopsGetCmd.Flags().BoolVar(&sopsNoProgress, "no-progress", false, "Disable animated progress indicators")
+        sopsGetCmd.Flags().BoolVar(&sopsGetAll, "all", false, "Decrypt every secret to its recorded destination")
+        sopsShowCmd.Flags().BoolVar(&sopsShowForce, "force", false, "Print the secret to a terminal without a warning")
+        sopsGetCmd.Flags().IntVar(&sopsParallel, "parallel", core.DefaultSecretParallelism, "Number of secrets to decrypt at once with --all")
+
+        // Add the --env flag choosing the environment of the secrets
+        sopsAddCmd.Flags().StringVar(&sopsEnv, "env", "", "Environment the secret belongs to (common if not set)")
+        sopsRemoveCmd.Flags().StringVar(&sopsEnv, "env", "", "Environment the secret belongs to (common if not set)")
+        sopsGetCmd.Flags().StringVar(&sopsEnv, "env", "", "Get the secrets of this environment (defaults to the current one)")
+        sopsShowCmd.Flags().StringVar(&sopsEnv, "env", "", "Show the secret of this environment (defaults to the current one)")
+        sopsListCmd.Flags().StringVar(&sopsEnv, "env", "", "List the secrets of this environment (defaults to the current one)")
+        sopsInfoCmd.Flags().StringVar(&sopsEnv, "env", "", "Show the secret of this environment (defaults to the current one)")
+        sopsInfoCmd.Flags().BoolVar(&sopsInfoJSON, "json", false, "Print the info as JSON")
+        sopsEditCmd.Flags().StringVar(&sopsEnv, "env", "", "Edit the secret of this environment (defaults to the current one)")
+        for _, c := range []*cobra.Command{sopsAddCmd, sopsRemoveCmd, sopsGetCmd, sopsShowCmd, sopsListCmd, sopsEditCmd} {
+                registerFlagCompletion(c, "env", completeSecretEnvFlag)
+        }
 
         // Add completion for file paths and secret names
         sopsAddCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
@@ -432,17 +608,16 @@ func init() {
                 }
 
                 // Get available secrets
-                home, err := os.UserHomeDir()
+                repo, err := core.OpenRepository()
                 if err != nil {
                         return nil, cobra.ShellCompDirectiveNoFileComp
                 }
 
-                dotpilotDir := filepath.Join(home, ".dotpilot")
-                if _, err := os.Stat(dotpilotDir); os.IsNotExist(err) {
-                        return nil, cobra.ShellCompDirectiveNoFileComp
+                environment := secretEnvironment(repo, sopsEnv)
+                if cmd == sopsRemoveCmd {
+                        environment = sopsEnv
                 }
-
-                secretManager := core.NewSopsManager(dotpilotDir)
+                secretManager := core.NewSopsManager(repo.Dir).ForEnvironment(environment)
                 if err := secretManager.Initialize(); err != nil {
                         return nil, cobra.ShellCompDirectiveNoFileComp
                 }
@@ -456,6 +631,7 @@ func init() {
         }
 
         sopsGetCmd.ValidArgsFunction = sopsSecretCompleter
+        sopsShowCmd.ValidArgsFunction = sopsSecretCompleter
         sopsRemoveCmd.ValidArgsFunction = sopsSecretCompleter
         sopsEditCmd.ValidArgsFunction = sopsSecretCompleter
 }
\ No newline at end of file
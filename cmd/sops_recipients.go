@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+// Flags of sops recipients add and remove selecting cloud key sources
+var (
+	sopsKMS           []string
+	sopsGCPKMS        []string
+	sopsAzureKeyVault []string
+	sopsVaultURI      []string
+)
+
+// sopsRecipientsCmd represents the sops recipients command
+var sopsRecipientsCmd = &cobra.Command{
+	Use:   "recipients",
+	Short: "List the keys that can decrypt SOPS secrets",
+	Long: `List the keys SOPS secrets are encrypted for, as recorded in .sops.yaml:
+the fingerprints of PGP keys, and AWS KMS, GCP KMS, Azure Key Vault and
+HashiCorp Vault keys. Use 'add' and 'remove' to share the secrets with a
+teammate or a cloud key service, or revoke their access.
+
+For example:
+  dotpilot sops recipients
+  dotpilot sops recipients add 0123456789ABCDEF0123456789ABCDEF01234567
+  dotpilot sops recipients add --kms arn:aws:kms:us-east-1:111122223333:key/1234abcd
+  dotpilot sops recipients remove 0123456789ABCDEF0123456789ABCDEF01234567`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+
+		keys, err := core.NewSopsManager(repo.Dir).KeySources()
+		if err != nil {
+			return withMessage(err, "Failed to read the SOPS configuration")
+		}
+
+		if keys.Len() == 0 {
+			fmt.Fprintln(out, "No SOPS recipients configured yet, 'dotpilot sops add' adds your own key.")
+			return nil
+		}
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		keys.Each(func(source, key string) {
+			fmt.Fprintf(w, "%s\t%s\n", source, key)
+		})
+		w.Flush()
+		return nil
+	},
+}
+
+// sopsRecipientKeys returns the keys given as the fingerprint in args and
+// with the key source flags
+func sopsRecipientKeys(args []string) (core.SopsKeySources, error) {
+	var keys core.SopsKeySources
+	if len(args) > 0 {
+		if err := keys.AddKey("pgp", strings.Join(args, "")); err != nil {
+			return keys, err
+		}
+	}
+
+	sources := map[string][]string{
+		"kms":                  sopsKMS,
+		"gcp_kms":              sopsGCPKMS,
+		"azure_keyvault":       sopsAzureKeyVault,
+		"hc_vault_transit_uri": sopsVaultURI,
+	}
+	for source, values := range sources {
+		for _, key := range values {
+			if err := keys.AddKey(source, key); err != nil {
+				return keys, err
+			}
+		}
+	}
+
+	if keys.Len() == 0 {
+		return keys, fmt.Errorf("expected a fingerprint or one of --kms, --gcp-kms, --azure-kv and --vault-uri")
+	}
+	return keys, nil
+}
+
+// sopsRecipientsAddCmd represents the sops recipients add command
+var sopsRecipientsAddCmd = &cobra.Command{
+	Use:   "add [fingerprint]",
+	Short: "Give a PGP or cloud key access to all SOPS secrets",
+	Long: `Add a PGP fingerprint or cloud keys to the recipients in .sops.yaml and
+re-encrypt the data key of every SOPS secret with 'sops updatekeys', so the
+owner of the key can decrypt them. The public key of a PGP fingerprint must be
+imported into your gpg keyring, and you must be able to decrypt the secrets
+yourself.
+
+The fingerprint may be given with spaces, as gpg prints it. Cloud keys are
+given with --kms (an AWS KMS key ARN), --gcp-kms (a GCP KMS key resource ID),
+--azure-kv (an Azure Key Vault key URL) and --vault-uri (a HashiCorp Vault
+transit key URI), each repeatable. sops reaches those with the credentials of
+the service, like AWS_PROFILE or VAULT_TOKEN, and doesn't need gpg for them.
+
+For example:
+  gpg --import teammate.asc
+  dotpilot sops recipients add 0123 4567 89AB CDEF 0123 4567 89AB CDEF 0123 4567
+  dotpilot sops recipients add --kms arn:aws:kms:us-east-1:111122223333:key/1234abcd
+  dotpilot sops recipients add --vault-uri https://vault.example.com:8200/v1/sops/keys/dotfiles`,
+	Args: nonEmptyArgs(cobra.ArbitraryArgs),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+		dotpilotDir := repo.Dir
+
+		keys, err := sopsRecipientKeys(args)
+		if err != nil {
+			return withMessage(err, "Invalid recipient")
+		}
+
+		if err := core.NewSopsManager(dotpilotDir).AddRecipients(keys); err != nil {
+			return withMessage(err, "Failed to add recipient")
+		}
+
+		if err := commitOrStage(dotpilotDir, fmt.Sprintf("Added SOPS recipient %s", keys), sopsNoCommit); err != nil {
+			return err
+		}
+
+		utils.Logger.Info().Msgf("%s can now decrypt the SOPS secrets", keys)
+		return nil
+	},
+}
+
+// sopsRecipientsRemoveCmd represents the sops recipients remove command
+var sopsRecipientsRemoveCmd = &cobra.Command{
+	Use:   "remove [fingerprint]",
+	Short: "Revoke the access of a PGP or cloud key to SOPS secrets",
+	Long: `Remove a PGP fingerprint or cloud keys, given with the flags of 'add', from
+the recipients in .sops.yaml and re-encrypt the data key of every SOPS secret
+with 'sops updatekeys', so the key can't decrypt future versions of them. The
+last recipient can't be removed.
+
+Earlier versions of the secrets stay readable with the removed key in the git
+history, so rotate the credentials they hold.
+
+For example:
+  dotpilot sops recipients remove 0123456789ABCDEF0123456789ABCDEF01234567
+  dotpilot sops recipients remove --kms arn:aws:kms:us-east-1:111122223333:key/1234abcd`,
+	Args: nonEmptyArgs(cobra.ArbitraryArgs),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		if err := lockRepository(repo.Home); err != nil {
+			return err
+		}
+		dotpilotDir := repo.Dir
+
+		keys, err := sopsRecipientKeys(args)
+		if err != nil {
+			return withMessage(err, "Invalid recipient")
+		}
+
+		if err := core.NewSopsManager(dotpilotDir).RemoveRecipients(keys); err != nil {
+			return withMessage(err, "Failed to remove recipient")
+		}
+
+		if err := commitOrStage(dotpilotDir, fmt.Sprintf("Removed SOPS recipient %s", keys), sopsNoCommit); err != nil {
+			return err
+		}
+
+		utils.Logger.Info().Msgf("%s can no longer decrypt the SOPS secrets", keys)
+		utils.Logger.Warn().Msg("Older versions of the secrets remain in the git history, rotate the credentials they hold")
+		return nil
+	},
+}
+
+func init() {
+	sopsCmd.AddCommand(sopsRecipientsCmd)
+	sopsRecipientsCmd.AddCommand(sopsRecipientsAddCmd)
+	sopsRecipientsCmd.AddCommand(sopsRecipientsRemoveCmd)
+
+	sopsRecipientsAddCmd.Flags().BoolVar(&sopsNoCommit, "no-commit", false, "Stage the change without committing it")
+	sopsRecipientsRemoveCmd.Flags().BoolVar(&sopsNoCommit, "no-commit", false, "Stage the change without committing it")
+
+	for _, cmd := range []*cobra.Command{sopsRecipientsAddCmd, sopsRecipientsRemoveCmd} {
+		cmd.Flags().StringArrayVar(&sopsKMS, "kms", nil, "AWS KMS key ARN (repeatable)")
+		cmd.Flags().StringArrayVar(&sopsGCPKMS, "gcp-kms", nil, "GCP KMS key resource ID (repeatable)")
+		cmd.Flags().StringArrayVar(&sopsAzureKeyVault, "azure-kv", nil, "Azure Key Vault key URL (repeatable)")
+		cmd.Flags().StringArrayVar(&sopsVaultURI, "vault-uri", nil, "HashiCorp Vault transit key URI (repeatable)")
+	}
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	statsJSON bool
+	statsTop  int
+)
+
+// statsCmd represents the stats command
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show repository statistics",
+	Long: `Show statistics about the dotpilot repository: the number and size of
+tracked files, a breakdown per layer and file type, secrets, commits, the size
+of the git database and the largest tracked files.
+
+For example:
+  dotpilot stats
+  dotpilot stats --top 20
+  dotpilot stats --json`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+		dotpilotDir := repo.Dir
+
+		stats, err := core.GetRepoStats(dotpilotDir, statsTop)
+		if err != nil {
+			return withMessage(err, "Failed to compute repository statistics")
+		}
+
+		if statsJSON {
+			data, err := json.MarshalIndent(stats, "", "  ")
+			if err != nil {
+				return withMessage(err, "Failed to encode statistics")
+			}
+			fmt.Fprintln(out, string(data))
+			return nil
+		}
+
+		fmt.Fprintln(out, "=== DotPilot Stats ===")
+		fmt.Fprintf(out, "Tracked files: %d\n", stats.TrackedFiles)
+		fmt.Fprintf(out, "Total size: %s\n", utils.FormatSize(stats.TotalSize))
+		fmt.Fprintf(out, "Secrets: %d (sops: %d)\n", stats.Secrets, stats.SopsSecrets)
+		fmt.Fprintf(out, "Commits: %d\n", stats.Commits)
+		fmt.Fprintf(out, "Repository size: %s\n", utils.FormatSize(stats.RepoSize))
+		fmt.Fprintln(out)
+
+		fmt.Fprintln(out, "=== Files per Layer ===")
+		printCounts(out, stats.Layers)
+		fmt.Fprintln(out)
+
+		fmt.Fprintln(out, "=== File Types ===")
+		printCounts(out, stats.FileTypes)
+		fmt.Fprintln(out)
+
+		fmt.Fprintln(out, "=== Largest Files ===")
+		if len(stats.LargestFiles) == 0 {
+			fmt.Fprintln(out, "No files are currently tracked.")
+		}
+		for _, file := range stats.LargestFiles {
+			fmt.Fprintf(out, "%10s  %s\n", utils.FormatSize(file.Size), file.Path)
+		}
+		return nil
+	},
+}
+
+// printCounts prints a count map sorted by count, then by name
+func printCounts(out io.Writer, counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	if len(keys) == 0 {
+		fmt.Fprintln(out, "None")
+	}
+	for _, key := range keys {
+		fmt.Fprintf(out, "%6d  %s\n", counts[key], key)
+	}
+}
+
+func init() {
+	statsCmd.Flags().BoolVar(&statsJSON, "json", false, "Output statistics as JSON")
+	statsCmd.Flags().IntVar(&statsTop, "top", 10, "Number of largest files to show")
+
+	rootCmd.AddCommand(statsCmd)
+}
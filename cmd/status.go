@@ -1,15 +1,28 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/dotpilot/core"
 	"github.com/dotpilot/utils"
 	"github.com/spf13/cobra"
 )
 
+var (
+	statusEnv           string
+	statusLayer         string
+	statusOffline       bool
+	statusRemoteTimeout time.Duration
+	statusFix           bool // Whether to reconcile the tracking paths
+)
+
 // statusCmd represents the status command
 var statusCmd = &cobra.Command{
 	Use:   "status",
@@ -17,32 +30,59 @@ var statusCmd = &cobra.Command{
 	Long: `Show the current status of the dotpilot repository,
 including the current environment, tracked files, and git status.
 
+With --env or --layer, the tracked files are limited to one layer, and each
+file is listed with its target and the health of its link:
+
+  linked     the target resolves to the repo file
+  missing    nothing is at the target, run 'dotpilot apply'
+  broken     the target is a symlink to a file that doesn't exist
+  elsewhere  the target links to another file, like that of a higher layer
+  unlinked   a regular file or directory is at the target
+
+The remote status is given up on after --remote-timeout, 5s by default, so
+status stays fast without a network; it then reports the remote status as
+unavailable and shows everything else. --offline skips it entirely.
+
+Status also compares the tracking paths of ~/.dotpilotrc with the repository
+and the links in the home directory, and lists the tracking paths no applied
+layer has a file for, the dotfiles of the applied layers missing from the
+tracking paths, and the links into the repository that aren't tracked. --fix
+drops the former from the tracking paths and adds the others; links to
+nothing are left for 'dotpilot clean'.
+
 For example:
-  dotpilot status`,
-	Run: func(cmd *cobra.Command, args []string) {
-		// Get home directory
-		home, err := os.UserHomeDir()
+  dotpilot status
+  dotpilot status --offline
+  dotpilot status --env work
+  dotpilot status --layer machine
+  dotpilot status --fix`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+
+		// Open the dotpilot repository
+		repo, err := openRepository()
 		if err != nil {
-			utils.Logger.Error().Err(err).Msg("Failed to get home directory")
-			os.Exit(1)
+			return err
+		}
+		if statusFix {
+			if err := lockRepository(repo.Home); err != nil {
+				return err
+			}
 		}
 
-		// Check if dotpilot is initialized
-		dotpilotDir := filepath.Join(home, ".dotpilot")
-		if _, err := os.Stat(dotpilotDir); os.IsNotExist(err) {
-			utils.Logger.Error().Msg("Dotpilot is not initialized. Run 'dotpilot init' first.")
-			os.Exit(1)
+		scope, err := statusScope(repo.Dir)
+		if err != nil {
+			return withMessage(err, "Failed to select the layer")
 		}
 
-		// Get current environment
-		cfg := core.GetConfig()
-		environment := cfg.CurrentEnvironment
-		if environment == "" {
-			environment = "default"
+		opts := core.StatusOptions{Offline: statusOffline, RemoteTimeout: statusRemoteTimeout}
+		status, err := repo.StatusWithOptions(cmd.Context(), opts)
+		if err != nil {
+			return withMessage(err, "Failed to get repository status")
 		}
 
 		// Get hostname
-		hostname, err := os.Hostname()
+		hostname, err := core.MachineID()
 		if err != nil {
 			utils.Logger.Error().Err(err).Msg("Failed to get hostname")
 			hostname = "unknown"
@@ -52,68 +92,176 @@ For example:
 		osInfo := utils.GetOSInfo()
 
 		// Print general status
-		fmt.Println("=== DotPilot Status ===")
-		fmt.Printf("Current environment: %s\n", environment)
-		fmt.Printf("Machine hostname: %s\n", hostname)
-		fmt.Printf("Operating system: %s\n", osInfo.Name)
-		fmt.Printf("Package system: %s\n", osInfo.PackageManager)
-		fmt.Println()
-
-		// Check for uncommitted changes
-		hasChanges, err := core.HasUncommittedChanges(dotpilotDir)
-		if err != nil {
-			utils.Logger.Error().Err(err).Msg("Failed to check for uncommitted changes")
-			os.Exit(1)
+		fmt.Fprintln(out, "=== DotPilot Status ===")
+		fmt.Fprintf(out, "Current environment: %s\n", status.Environment)
+		fmt.Fprintf(out, "Machine hostname: %s\n", hostname)
+		fmt.Fprintf(out, "Operating system: %s\n", osInfo.Name)
+		fmt.Fprintf(out, "Package system: %s\n", osInfo.PackageManager)
+		if len(repo.Config.SparsePaths) > 0 {
+			fmt.Fprintf(out, "Sparse paths: %s\n", strings.Join(repo.Config.SparsePaths, ", "))
 		}
+		fmt.Fprintln(out)
 
 		// Print Git status
-		fmt.Println("=== Git Status ===")
-		if hasChanges {
-			fmt.Println("Repository has uncommitted changes.")
-			changes, err := core.GetGitStatus(dotpilotDir)
-			if err != nil {
-				utils.Logger.Error().Err(err).Msg("Failed to get git status")
-			} else {
-				fmt.Print(changes)
+		fmt.Fprintln(out, "=== Git Status ===")
+		if status.Changes != "" {
+			fmt.Fprintln(out, "Repository has uncommitted changes.")
+			fmt.Fprint(out, status.Changes)
+
+			// Staged changes come from --no-commit and wait for 'dotpilot commit'
+			if len(status.Staged) > 0 {
+				fmt.Fprintf(out, "%d staged changes are waiting to be committed, run 'dotpilot commit' to commit them.\n", len(status.Staged))
 			}
 		} else {
-			fmt.Println("Repository is clean, no uncommitted changes.")
+			fmt.Fprintln(out, "Repository is clean, no uncommitted changes.")
 		}
 
-		// Get remote status
-		behindAhead, err := core.GetRemoteStatus(dotpilotDir)
-		if err != nil {
-			utils.Logger.Error().Err(err).Msg("Failed to get remote status")
+		// Print remote status
+		switch {
+		case status.RemoteSkipped:
+			fmt.Fprintln(out, "Remote status skipped (--offline).")
+		case errors.Is(status.RemoteErr, core.ErrNetwork):
+			utils.Logger.Debug().Err(status.RemoteErr).Msg("No remote status")
+			fmt.Fprintln(out, "Remote status unavailable (offline).")
+		case status.RemoteErr != nil:
+			utils.Logger.Error().Err(status.RemoteErr).Msg("Failed to get remote status")
+		default:
+			printRemoteStatus(out, status.Remote)
+		}
+		fmt.Fprintln(out)
+
+		if scope != "" {
+			// Print the tracked dotfiles of one layer with their health
+			printLayerDotfiles(out, repo, scope, status.Dotfiles)
 		} else {
-			if behindAhead.Behind > 0 {
-				fmt.Printf("Local is behind remote by %d commits.\n", behindAhead.Behind)
-			}
-			if behindAhead.Ahead > 0 {
-				fmt.Printf("Local is ahead of remote by %d commits.\n", behindAhead.Ahead)
+			// Print tracked dotfiles by layer
+			fmt.Fprintln(out, "=== Tracked Files ===")
+			if len(status.Dotfiles) == 0 {
+				fmt.Fprintln(out, "No files are currently tracked.")
 			}
-			if behindAhead.Behind == 0 && behindAhead.Ahead == 0 {
-				fmt.Println("Local is in sync with remote.")
+			for i, dotfile := range status.Dotfiles {
+				if i == 0 || dotfile.Layer != status.Dotfiles[i-1].Layer {
+					fmt.Fprintf(out, "%s:\n", dotfile.Layer)
+				}
+				fmt.Fprintf(out, "- ~/%s\n", dotfile.Target)
 			}
 		}
-		fmt.Println()
 
-		// Print tracked files
-		fmt.Println("=== Tracked Files ===")
-		trackedFiles, err := core.GetTrackedFiles(dotpilotDir)
+		// Compare the tracking paths with the repository and the links
+		drift, err := repo.CheckTracking()
 		if err != nil {
-			utils.Logger.Error().Err(err).Msg("Failed to get tracked files")
-		} else {
-			if len(trackedFiles) == 0 {
-				fmt.Println("No files are currently tracked.")
-			} else {
-				for _, file := range trackedFiles {
-					fmt.Printf("- %s\n", file)
-				}
-			}
+			return withMessage(err, "Failed to compare the tracking paths with the repository")
+		}
+		if drift.Empty() {
+			return nil
+		}
+		fmt.Fprintln(out)
+		printTrackingDrift(out, repo.Home, drift)
+		if !statusFix {
+			fmt.Fprintln(out, "Run 'dotpilot status --fix' to update the tracking paths.")
+			return nil
 		}
+		if err := repo.FixTracking(drift); err != nil {
+			return withMessage(err, "Failed to update the tracking paths")
+		}
+		fmt.Fprintln(out, "Updated the tracking paths.")
+		return nil
 	},
 }
 
 func init() {
-	// No additional flags needed for status command
+	statusCmd.Flags().StringVar(&statusEnv, "env", "", "Only list the tracked files of this environment")
+	statusCmd.Flags().StringVar(&statusLayer, "layer", "", "Only list the tracked files of this layer (common or machine)")
+	statusCmd.Flags().BoolVar(&statusOffline, "offline", false, "Skip the remote status")
+	statusCmd.Flags().DurationVar(&statusRemoteTimeout, "remote-timeout", 5*time.Second, "Give up on the remote status after this long")
+	statusCmd.Flags().BoolVar(&statusFix, "fix", false, "Update the tracking paths to match the repository and the links in the home directory")
+	statusCmd.MarkFlagsMutuallyExclusive("env", "layer")
+	registerFlagCompletion(statusCmd, "env", completeEnvironmentFlag)
+	registerFlagCompletion(statusCmd, "layer", cobra.FixedCompletions([]string{"common", "machine"}, cobra.ShellCompDirectiveNoFileComp))
+}
+
+// statusScope returns the layer --env or --layer limits the tracked files to,
+// like "envs/work" or "machine/<hostname>", or "" if neither is set
+func statusScope(dotpilotDir string) (string, error) {
+	switch {
+	case statusEnv != "":
+		if info, err := os.Stat(filepath.Join(dotpilotDir, "envs", statusEnv)); err != nil || !info.IsDir() {
+			return "", fmt.Errorf("%w: %s", core.ErrEnvironmentNotFound, statusEnv)
+		}
+		return "envs/" + statusEnv, nil
+	case statusLayer == "common", statusLayer == "machine":
+		return filepath.ToSlash(layerDir(statusLayer)), nil
+	case statusLayer != "":
+		return "", fmt.Errorf("unknown layer %q, use common or machine, or --env for an environment", statusLayer)
+	}
+	return "", nil
+}
+
+// printLayerDotfiles prints the dotfiles of layer with their target and the
+// health of its link
+func printLayerDotfiles(out io.Writer, repo *core.Repository, layer string, dotfiles []core.TrackedDotfile) {
+	fmt.Fprintf(out, "=== Tracked Files (%s) ===\n", layer)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	count := 0
+	for _, dotfile := range dotfiles {
+		if dotfile.Layer != layer {
+			continue
+		}
+		if count == 0 {
+			fmt.Fprintln(w, "TARGET\tHEALTH\tREPO PATH")
+		}
+		count++
+		report := dotfile.Report(repo.Dir, repo.Home)
+		fmt.Fprintf(w, "%s\t%s\t%s\n", tildePath(repo.Home, report.Target), report.LinkStatus, report.Path)
+	}
+	w.Flush()
+	if count == 0 {
+		fmt.Fprintf(out, "No files are tracked in %s.\n", layer)
+	}
+}
+
+// printTrackingDrift prints where the tracking paths, the repository and the
+// home directory disagree
+func printTrackingDrift(out io.Writer, home string, drift core.TrackingDrift) {
+	fmt.Fprintln(out, "=== Tracking Paths ===")
+	if len(drift.MissingFromRepo) > 0 {
+		fmt.Fprintln(out, "Tracked but missing from the repository:")
+		for _, tracked := range drift.MissingFromRepo {
+			fmt.Fprintf(out, "- %s\n", tracked)
+		}
+	}
+	if len(drift.NotInConfig) > 0 {
+		fmt.Fprintln(out, "In the repository but not tracked:")
+		for _, dotfile := range drift.NotInConfig {
+			fmt.Fprintf(out, "- %s (%s)\n", tildePath(home, dotfile.TargetPath(home)), dotfile.RepoPath)
+		}
+	}
+	if len(drift.UntrackedLinks) > 0 {
+		fmt.Fprintln(out, "Linked into the repository but not tracked:")
+		for _, link := range drift.UntrackedLinks {
+			note := ""
+			if _, err := os.Stat(link.Source); err != nil {
+				note = ", which doesn't exist"
+			}
+			fmt.Fprintf(out, "- %s -> %s%s\n", tildePath(home, link.Target), link.Source, note)
+		}
+	}
+}
+
+// printRemoteStatus prints how far the local branch is ahead of and behind its
+// remote-tracking branch
+func printRemoteStatus(out io.Writer, status core.RemoteStatus) {
+	if status.Behind > 0 {
+		fmt.Fprintf(out, "Local is behind remote by %d commits.\n", status.Behind)
+	}
+	if status.Ahead > 0 {
+		fmt.Fprintf(out, "Local is ahead of remote by %d commits.\n", status.Ahead)
+	}
+	if status.Behind == 0 && status.Ahead == 0 {
+		fmt.Fprintln(out, "Local is in sync with remote.")
+	}
+	if status.Shallow {
+		fmt.Fprintln(out, "This is a shallow clone, only the commits it has are counted.")
+	}
 }
@@ -1,9 +1,12 @@
 package cmd
 
 import (
+        "encoding/json"
+        "errors"
         "fmt"
-        "os"
+        "io"
         "path/filepath"
+        "strings"
 
         "github.com/dotpilot/core"
         "github.com/dotpilot/utils"
@@ -19,41 +22,129 @@ var (
         resolveConflicts  bool
         conflictStrategy  string
         noProgress        bool // Whether to disable progress indicators
+        stashChanges      bool // Whether to stash uncommitted changes instead of committing them
+        fullApply         bool // Whether to re-apply every file instead of only the pulled changes
+        noApply           bool // Whether to only sync the repository without touching the home directory
+        syncJSON          bool // Whether to print the --dry-run plan as JSON
+        pruneDeletions    bool // Whether to remove the links of tracked files deleted from the repository
+        syncIgnoreWhitespace string // Whitespace to ignore when looking for conflicts
 )
 
+// reportUntrustedCommits lists the fetched commits that failed verification
+func reportUntrustedCommits(err error) {
+        var untrusted *core.UntrustedCommitsError
+        if !errors.As(err, &untrusted) {
+                return
+        }
+        for _, commit := range untrusted.Commits {
+                utils.Logger.Error().Msgf("Fetched commit %s %q: %s", commit.Hash[:7], commit.Subject, commit.Reason)
+        }
+        utils.Logger.Warn().Msg("Nothing was pulled or applied, the branch stays where it was")
+}
+
 // syncCmd represents the sync command
 var syncCmd = &cobra.Command{
         Use:   "sync",
         Short: "Sync dotfiles with remote repository",
         Long: `Sync dotfiles between the local dotpilot repository and the remote repository.
-By default, this will pull changes from the remote, apply them to the local system,
-and push any local changes back to the remote.
+By default, this will pull changes from the remote, apply the files that changed
+to the local system, and push any local changes back to the remote.
 
 For example:
   dotpilot sync
   dotpilot sync --no-push
   dotpilot sync --dry-run
-  dotpilot sync --resolve-conflicts --strategy=interactive`,
-        Run: func(cmd *cobra.Command, args []string) {
-                // Get home directory
-                home, err := os.UserHomeDir()
+  dotpilot sync --stash
+  dotpilot sync --full-apply
+  dotpilot sync --no-apply
+  dotpilot sync --prune-remote-deletions
+  dotpilot sync --resolve-conflicts --strategy=interactive
+  dotpilot sync --ignore-whitespace
+  dotpilot sync --skip-machine
+
+With --no-apply, sync only commits, pulls and pushes the repository. Nothing is
+applied to the home directory and post-pull hooks are not run, which suits
+servers that merely keep a copy of the dotfiles; run 'dotpilot apply' later to
+apply them.
+
+With --prune-remote-deletions, files deleted from the repository, for example
+on another machine, are also removed from the home directory: their symlink is
+removed, a regular file that replaced it is moved to a backup, and they are
+dropped from the tracking paths of ~/.dotpilotrc.
+
+With --skip-common, --skip-env or --skip-machine, that layer is neither
+applied nor checked for conflicts this time, like a layer turned off with
+'dotpilot layers disable'.
+
+With --dry-run, sync fetches the remote and shows what it would do: the
+uncommitted changes it would commit, the commits it would pull and push, the
+files applying the pull would create, update or remove, and the files with
+local changes that would conflict. Only the remote-tracking branch is updated,
+like 'dotpilot fetch' does. Add --json for a machine-readable plan.
+
+With --ignore-whitespace, local copies that only differ from the repository in
+trailing whitespace or the newlines at their end are not conflicts and are
+replaced without asking; --ignore-whitespace=all ignores whitespace within
+lines too. It overrides the ignore_whitespace option of ~/.dotpilotrc.
+
+With "trusted_signers" in the options of ~/.dotpilotrc, a list of OpenPGP
+fingerprints and SSH SHA256 fingerprints, every fetched commit must be signed
+by one of those keys before the branch is moved to it. If one isn't, nothing
+is pulled or applied and no hooks run, and the next sync checks it again.
+
+With --resolve-conflicts, a conflict that fails to resolve is left in place
+and the others are still resolved. The sync then goes on, but exits with an
+error listing the files that still need attention.`,
+        RunE: func(cmd *cobra.Command, args []string) error {
+                // Open the dotpilot repository
+                repo, err := openRepository()
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to get home directory")
-                        os.Exit(1)
+                        return err
                 }
-
-                // Check if dotpilot is initialized
-                dotpilotDir := filepath.Join(home, ".dotpilot")
-                if _, err := os.Stat(dotpilotDir); os.IsNotExist(err) {
-                        utils.Logger.Error().Msg("Dotpilot is not initialized. Run 'dotpilot init' first.")
-                        os.Exit(1)
+                if err := lockRepository(repo.Home); err != nil {
+                        return err
+                }
+                dotpilotDir := repo.Dir
+                if err := ignoreWhitespace(cmd, syncIgnoreWhitespace); err != nil {
+                        return err
+                }
+                if err := skipLayers(cmd); err != nil {
+                        return err
                 }
 
                 // Get current environment
-                cfg := core.GetConfig()
-                environment := cfg.CurrentEnvironment
-                if environment == "" {
-                        environment = "default"
+                environment := repo.Environment()
+
+                // Conflicts left unresolved by --resolve-conflicts
+                var unresolvedErr error
+
+                if noApply && resolveConflicts {
+                        return errors.New("--no-apply cannot be combined with --resolve-conflicts, conflicts are between the repository and the home directory")
+                }
+
+                // Parse the conflict resolution strategy
+                var strategy core.ConflictResolutionStrategy
+                switch conflictStrategy {
+                case "interactive":
+                        strategy = core.StrategyInteractive
+                case "keep-local":
+                        strategy = core.StrategyKeepLocal
+                case "keep-remote":
+                        strategy = core.StrategyKeepRemote
+                case "merge":
+                        strategy = core.StrategyMerge
+                case "backup-both":
+                        strategy = core.StrategyBackupBoth
+                default:
+                        utils.Logger.Warn().Msgf("Unknown conflict strategy: %s, using interactive", conflictStrategy)
+                        strategy = core.StrategyInteractive
+                }
+
+                if syncJSON && !dryRun {
+                        return errors.New("--json is only supported with --dry-run")
+                }
+                if dryRun {
+                        return printSyncPlan(cmd.OutOrStdout(), repo, environment)
                 }
 
                 // Sync process
@@ -61,144 +152,207 @@ For example:
                 
                 // Initialize operation manager for progress tracking
                 var operationManager *utils.OperationManager
-                if !noProgress && !dryRun {
+                if !noProgress {
                     operationManager = utils.NewOperationManager()
                 }
 
                 // Check for uncommitted changes
                 hasChanges, err := core.HasUncommittedChanges(dotpilotDir)
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to check for uncommitted changes")
-                        os.Exit(1)
+                        return withMessage(err, "Failed to check for uncommitted changes")
                 }
 
-                if hasChanges {
+                // A stash left behind by an earlier failed sync is re-applied after pulling
+                stashed := false
+                if stashChanges {
+                        stashed, err = core.HasStash(dotpilotDir)
+                        if err != nil {
+                                return withMessage(err, "Failed to check for a pending stash")
+                        }
+                        if stashed && hasChanges {
+                                return fmt.Errorf("Uncommitted changes exist and a previous stash is still pending at %s. Commit or discard the changes first.", core.StashRef)
+                        }
+                        if stashed {
+                                utils.Logger.Warn().Msgf("Found a pending stash at %s, it will be re-applied after pulling", core.StashRef)
+                        }
+                }
+
+                if hasChanges && stashChanges {
+                        utils.Logger.Info().Msg("Uncommitted changes detected, stashing...")
+
+                        if _, err := core.StashChanges(dotpilotDir); err != nil {
+                                return withMessage(err, "Failed to stash changes")
+                        }
+                        stashed = true
+                } else if hasChanges {
                         utils.Logger.Info().Msg("Uncommitted changes detected, committing...")
                         
                         // Create progress for commit operation
+                        // No spinner over the question of the prompt mode
                         var commitOp *utils.Operation
-                        if operationManager != nil {
+                        if operationManager != nil && core.AutoCommit() == core.AutoCommitAlways {
                             commitOp = operationManager.AddOperation("commit", "Committing changes...", utils.Spinner)
                             commitOp.Start()
                         }
                         
-                        if err := core.CommitChanges(dotpilotDir, "Auto-commit before sync"); err != nil {
+                        committed, err := core.MaybeCommit(dotpilotDir, "Auto-commit before sync")
+                        if err != nil {
                                 if commitOp != nil {
-                                    commitOp.Stop()
+                                    commitOp.StopWithResult(utils.StateError, "Failed to commit changes")
                                 }
-                                utils.Logger.Error().Err(err).Msg("Failed to commit changes")
-                                os.Exit(1)
+                                return withMessage(err, "Failed to commit changes")
+                        }
+                        if !committed {
+                                if commitOp != nil {
+                                    commitOp.StopSilent()
+                                }
+                                return errors.New("Not syncing with uncommitted changes. Commit them with 'dotpilot commit', or use --stash to set them aside during the sync")
                         }
                         
                         if commitOp != nil {
-                            commitOp.Stop()
+                            commitOp.StopWithResult(utils.StateSuccess, "Committed local changes")
                         }
                 }
 
-                // Pull changes
+                // Pull changes. Only the files changed by the pull are applied
+                // afterwards unless --full-apply is set; applyPaths stays nil
+                // (apply everything) when nothing was pulled to compare.
+                var applyPaths []string
                 if !noPull {
                         utils.Logger.Info().Msg("Pulling changes from remote...")
                         
-                        if dryRun {
-                                utils.Logger.Info().Msg("[DRY RUN] Would pull changes from remote")
-                        } else {
-                                // Create progress for pull operation
-                                var pullOp *utils.Operation
-                                if operationManager != nil {
-                                    pullOp = operationManager.AddOperation("pull", "Pulling changes from remote...", utils.Bounce)
-                                    pullOp.Start()
-                                    pullOp.SimulateProgress(5) // Simulate progress for 5 seconds
+                        // Create progress for pull operation
+                        var pullOp *utils.Operation
+                        if operationManager != nil {
+                            pullOp = operationManager.AddOperation("pull", "Pulling changes from remote...", utils.Bounce)
+                            pullOp.Start()
+                            pullOp.SimulateProgress(5) // Simulate progress for 5 seconds
+                        }
+                        
+                        preHash, headErr := core.HeadHash(dotpilotDir)
+                        if headErr != nil {
+                                utils.Logger.Debug().Err(headErr).Msg("Failed to read HEAD before pulling, applying everything")
+                        }
+
+                        // With trusted signers, the fetched commits are
+                        // verified before the branch and the linked dotfiles
+                        // get any of them
+                        pull := repo.Pull
+                        if trusted, err := core.TrustedSigners(); err != nil {
+                                return withMessage(err, "Failed to read the trusted signers")
+                        } else if len(trusted) > 0 {
+                                pull = func() error { return core.PullVerifiedChanges(dotpilotDir) }
+                        }
+
+                        if err := pull(); err != nil {
+                                if pullOp != nil {
+                                    pullOp.StopWithResult(utils.StateError, "Failed to pull changes")
                                 }
-                                
-                                if err := core.PullChanges(dotpilotDir); err != nil {
-                                        if pullOp != nil {
-                                            pullOp.Stop()
-                                        }
-                                        utils.Logger.Error().Err(err).Msg("Failed to pull changes")
-                                        os.Exit(1)
+                                reportUntrustedCommits(err)
+                                if stashed {
+                                        utils.Logger.Warn().Msgf("Local changes remain stashed at %s, run 'dotpilot sync --stash' again to re-apply them", core.StashRef)
                                 }
-                                
-                                if pullOp != nil {
-                                    pullOp.Stop()
+                                return withMessage(err, "Failed to pull changes")
+                        }
+                        
+                        if pullOp != nil {
+                            pullOp.StopWithResult(utils.StateSuccess, "Pulled changes from remote")
+                        }
+
+                        if !fullApply && !noApply && headErr == nil {
+                                changed, err := core.ChangedFilesSince(dotpilotDir, preHash)
+                                if err != nil {
+                                        utils.Logger.Warn().Err(err).Msg("Failed to list files changed by the pull, applying everything")
+                                } else {
+                                        applyPaths = changed
+                                }
+                        }
+
+                        // Refresh the decrypted secrets the pull changed
+                        if core.ReencryptOnPull() && !noApply && headErr == nil {
+                                utils.Logger.Info().Msg("Refreshing secrets changed by the pull...")
+                                if !refreshChangedSecrets(repo, preHash, core.DefaultSecretParallelism) {
+                                        // Continue anyway, like the hooks
+                                        utils.Logger.Warn().Msg("Some secrets could not be refreshed, run 'dotpilot secrets get --all --overwrite'")
                                 }
+                        }
 
-                                // Run post-pull hooks
+                        // Run post-pull hooks
+                        if noApply {
+                                utils.Logger.Info().Msg("Skipping post-pull hooks (--no-apply)")
+                        } else {
                                 utils.Logger.Info().Msg("Running post-pull hooks...")
-                                
+                        
                                 // Create progress for hooks operation
                                 var hooksOp *utils.Operation
                                 if operationManager != nil {
                                     hooksOp = operationManager.AddOperation("hooks", "Running post-pull hooks...", utils.Spinner)
                                     hooksOp.Start()
                                 }
-                                
+                        
                                 if err := core.RunHooks(dotpilotDir, environment, "postpull.sh"); err != nil {
                                         if hooksOp != nil {
-                                            hooksOp.Stop()
+                                            hooksOp.StopWithResult(utils.StateWarning, "Post-pull hooks failed")
                                         }
                                         utils.Logger.Error().Err(err).Msg("Failed to run post-pull hooks")
                                         // Continue anyway
                                 }
-                                
+                        
                                 if hooksOp != nil {
-                                    hooksOp.Stop()
+                                    hooksOp.StopWithResult(utils.StateSuccess, "Ran post-pull hooks")
                                 }
                         }
                 }
 
+                // Re-apply stashed changes on top of what was pulled
+                if stashed {
+                        utils.Logger.Info().Msg("Re-applying stashed changes...")
+                        if err := core.PopStash(dotpilotDir, strategy); err != nil {
+                                return withMessage(err, "Failed to re-apply stashed changes")
+                        }
+                        utils.Logger.Info().Msg("Stashed changes were restored as uncommitted changes and will not be pushed")
+                }
+
                 // Resolve conflicts if requested
                 if resolveConflicts {
                         utils.Logger.Info().Msgf("Resolving conflicts with strategy: %s", conflictStrategy)
                         
-                        if dryRun {
-                                utils.Logger.Info().Msg("[DRY RUN] Would resolve conflicts")
-                        } else {
-                                // Parse the strategy
-                                var strategy core.ConflictResolutionStrategy
-                                switch conflictStrategy {
-                                case "interactive":
-                                        strategy = core.StrategyInteractive
-                                case "keep-local":
-                                        strategy = core.StrategyKeepLocal
-                                case "keep-remote":
-                                        strategy = core.StrategyKeepRemote
-                                case "merge":
-                                        strategy = core.StrategyMerge
-                                case "backup-both":
-                                        strategy = core.StrategyBackupBoth
-                                default:
-                                        utils.Logger.Warn().Msgf("Unknown conflict strategy: %s, using interactive", conflictStrategy)
-                                        strategy = core.StrategyInteractive
-                                }
-                                
-                                // Create progress for conflict resolution (only for non-interactive strategies)
-                                var conflictOp *utils.Operation
-                                if operationManager != nil && strategy != core.StrategyInteractive {
-                                    conflictOp = operationManager.AddOperation("conflicts", 
-                                        fmt.Sprintf("Resolving conflicts with %s strategy...", conflictStrategy), 
-                                        utils.Dots)
-                                    conflictOp.Start()
-                                }
-                                
-                                if err := core.ResolveConflicts(dotpilotDir, strategy); err != nil {
-                                        if conflictOp != nil {
-                                            conflictOp.Stop()
-                                        }
-                                        utils.Logger.Error().Err(err).Msg("Failed to resolve conflicts")
-                                        os.Exit(1)
-                                }
-                                
+                        // Create progress for conflict resolution (only for non-interactive strategies)
+                        var conflictOp *utils.Operation
+                        if operationManager != nil && strategy != core.StrategyInteractive {
+                            conflictOp = operationManager.AddOperation("conflicts", 
+                                fmt.Sprintf("Resolving conflicts with %s strategy...", conflictStrategy), 
+                                utils.Dots)
+                            conflictOp.Start()
+                        }
+                        
+                        report, err := core.ResolveConflicts(dotpilotDir, strategy)
+                        if err != nil && !errors.Is(err, core.ErrConflict) {
                                 if conflictOp != nil {
-                                    conflictOp.Stop()
+                                    conflictOp.StopWithResult(utils.StateError, "Failed to resolve conflicts")
                                 }
+                                return withMessage(err, "Failed to resolve conflicts")
+                        }
+
+                        // Conflicts that could not be resolved are left in
+                        // place, the sync goes on and fails at the end
+                        unresolvedErr = err
+                        if conflictOp != nil {
+                            if unresolvedErr != nil {
+                                conflictOp.StopWithResult(utils.StateWarning, "Some conflicts were left unresolved")
+                            } else {
+                                conflictOp.StopWithResult(utils.StateSuccess, "Resolved conflicts")
+                            }
                         }
+                        reportConflicts(report)
                 }
 
                 // Apply configurations
-                utils.Logger.Info().Msg("Applying configurations...")
-                if dryRun {
-                        utils.Logger.Info().Msg("[DRY RUN] Would apply configurations")
+                if noApply {
+                        utils.Logger.Info().Msg("Skipping applying configurations (--no-apply)")
                 } else {
+                        utils.Logger.Info().Msg("Applying configurations...")
+
                         // Create progress for applying configurations
                         var configOp *utils.Operation
                         if operationManager != nil {
@@ -212,62 +366,172 @@ For example:
                         
                         // Progress indicator is not compatible with diff prompts, so disable it temporarily
                         if diffPromptEnabled && configOp != nil {
-                            configOp.Stop()
+                            configOp.StopSilent()
                             configOp = nil
                         }
                         
-                        if err := core.ApplyConfigurationsWithOptions(dotpilotDir, environment, backupEnabled, diffPromptEnabled); err != nil {
+                        if applyPaths != nil {
+                                utils.Logger.Info().Msgf("Applying %d files changed by the pull (use --full-apply to re-apply everything)", len(applyPaths))
+                        }
+
+                        if err := repo.Apply(core.ApplyOptions{Backup: backupEnabled, DiffPrompt: diffPromptEnabled, Paths: applyPaths, Prune: pruneDeletions}); err != nil {
                                 if configOp != nil {
-                                    configOp.Stop()
+                                    configOp.StopWithResult(utils.StateError, "Failed to apply configurations")
                                 }
-                                utils.Logger.Error().Err(err).Msg("Failed to apply configurations")
-                                os.Exit(1)
+                                return withMessage(err, "Failed to apply configurations")
                         }
                         
                         if configOp != nil {
-                            configOp.Stop()
+                            configOp.StopWithResult(utils.StateSuccess, "Applied configurations")
                         }
                 }
 
                 // Push changes
                 if !noPush {
                         utils.Logger.Info().Msg("Pushing changes to remote...")
-                        if dryRun {
-                                utils.Logger.Info().Msg("[DRY RUN] Would push changes to remote")
-                        } else {
-                                // Create progress for push operation
-                                var pushOp *utils.Operation
-                                if operationManager != nil {
-                                    pushOp = operationManager.AddOperation("push", "Pushing changes to remote...", utils.Bounce)
-                                    pushOp.Start()
-                                    pushOp.SimulateProgress(4) // Simulate progress for 4 seconds
-                                }
-                                
-                                if err := core.PushChanges(dotpilotDir); err != nil {
-                                        if pushOp != nil {
-                                            pushOp.Stop()
-                                        }
-                                        utils.Logger.Error().Err(err).Msg("Failed to push changes")
-                                        os.Exit(1)
-                                }
-                                
+                        // Create progress for push operation
+                        var pushOp *utils.Operation
+                        if operationManager != nil {
+                            pushOp = operationManager.AddOperation("push", "Pushing changes to remote...", utils.Bounce)
+                            pushOp.Start()
+                            pushOp.SimulateProgress(4) // Simulate progress for 4 seconds
+                        }
+                        
+                        if err := repo.Push(); err != nil {
                                 if pushOp != nil {
-                                    pushOp.Stop()
+                                    pushOp.StopWithResult(utils.StateError, "Failed to push changes")
                                 }
+                                return withMessage(err, "Failed to push changes")
+                        }
+                        
+                        if pushOp != nil {
+                            pushOp.StopWithResult(utils.StateSuccess, "Pushed changes to remote")
                         }
                 }
 
+                if unresolvedErr != nil {
+                        return withMessage(unresolvedErr, "Sync completed, but some conflicts still need attention")
+                }
                 utils.Logger.Info().Msg("Sync completed successfully!")
+                return nil
         },
 }
 
+// printSyncPlan computes what sync would do with the current flags and
+// prints it, as JSON with --json
+func printSyncPlan(out io.Writer, repo *core.Repository, environment string) error {
+        plan, err := core.PlanSync(repo.Dir, environment, core.SyncPlanOptions{Fetch: !noPull})
+        if err != nil {
+                return withMessage(err, "Failed to compute the sync plan")
+        }
+
+        // Leave out what the flags skip
+        if noPull {
+                plan.Incoming = []core.CommitSummary{}
+        }
+        if noPull || noApply {
+                plan.Apply = []core.PlannedChange{}
+                plan.Conflicts = []core.PlannedChange{}
+        }
+        if noPush {
+                plan.Outgoing = []core.CommitSummary{}
+        }
+
+        if syncJSON {
+                data, err := json.MarshalIndent(plan, "", "  ")
+                if err != nil {
+                        return withMessage(err, "Failed to encode the sync plan")
+                }
+                fmt.Fprintln(out, string(data))
+                return nil
+        }
+
+        fmt.Fprintf(out, "Environment: %s\n", plan.Environment)
+        if plan.RemoteErr != "" {
+                fmt.Fprintf(out, "Remote: %s\n", plan.RemoteErr)
+        }
+
+        if len(plan.Uncommitted) > 0 {
+                action := "committed"
+                if stashChanges {
+                        action = "stashed"
+                }
+                fmt.Fprintf(out, "\n=== Uncommitted Changes (would be %s) ===\n", action)
+                for _, path := range plan.Uncommitted {
+                        fmt.Fprintf(out, "  %s\n", path)
+                }
+        }
+
+        printPlanCommits(out, "Incoming Commits (would be pulled)", plan.Incoming)
+        if plan.Diverged {
+                fmt.Fprintln(out, "Local and remote have diverged, the pull has to merge them.")
+        }
+
+        if len(plan.Apply) > 0 {
+                fmt.Fprintln(out, "\n=== Files to Apply ===")
+                for _, change := range plan.Apply {
+                        fmt.Fprintf(out, "  %-8s %s (%s)\n", change.Action, tildePath(repo.Home, change.Target), change.RepoPath)
+                }
+        }
+        if len(plan.Conflicts) > 0 {
+                fmt.Fprintln(out, "\n=== Conflicts ===")
+                for _, conflict := range plan.Conflicts {
+                        fmt.Fprintf(out, "%s has local changes:\n", tildePath(repo.Home, conflict.Target))
+                        fmt.Fprint(out, conflict.Diff)
+                }
+                fmt.Fprintln(out, "Use --resolve-conflicts to resolve them while syncing.")
+        }
+
+        outgoing := plan.Outgoing
+        if len(plan.Uncommitted) > 0 && !stashChanges && !noPush {
+                outgoing = append([]core.CommitSummary{{Subject: "Auto-commit before sync"}}, outgoing...)
+        }
+        printPlanCommits(out, "Outgoing Commits (would be pushed)", outgoing)
+
+        if len(plan.Uncommitted) == 0 && len(plan.Incoming) == 0 && len(outgoing) == 0 {
+                fmt.Fprintln(out, "\nNothing to sync.")
+        }
+        return nil
+}
+
+// printPlanCommits prints a section of commits, nothing if there are none.
+// Commits without a hash are yet to be made.
+func printPlanCommits(out io.Writer, title string, commits []core.CommitSummary) {
+        if len(commits) == 0 {
+                return
+        }
+        fmt.Fprintf(out, "\n=== %s ===\n", title)
+        for _, c := range commits {
+                if c.Hash == "" {
+                        fmt.Fprintf(out, "(new)   %s\n", c.Subject)
+                        continue
+                }
+                fmt.Fprintf(out, "%s %s (%s, %s)\n", c.Hash[:7], c.Subject, c.Author, c.When.Local().Format("2006-01-02 15:04"))
+        }
+}
+
+// tildePath shortens a path in the home directory to ~/...
+func tildePath(home, path string) string {
+        if relPath, err := filepath.Rel(home, path); err == nil && !strings.HasPrefix(relPath, "..") {
+                return filepath.Join("~", relPath)
+        }
+        return path
+}
+
 func init() {
         syncCmd.Flags().BoolVar(&noPull, "no-pull", false, "Skip pulling changes from remote")
         syncCmd.Flags().BoolVar(&noPush, "no-push", false, "Skip pushing changes to remote")
         syncCmd.Flags().BoolVar(&noBackup, "no-backup", false, "Skip backing up files before overwriting")
         syncCmd.Flags().BoolVar(&noDiffPrompt, "no-diff-prompt", false, "Skip prompting for diffs before applying changes")
         syncCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show what would be done without making changes")
+        syncCmd.Flags().BoolVar(&syncJSON, "json", false, "Print the --dry-run plan as JSON")
         syncCmd.Flags().BoolVar(&noProgress, "no-progress", false, "Disable animated progress indicators")
+        syncCmd.Flags().BoolVar(&fullApply, "full-apply", false, "Re-apply every file instead of only the files changed by the pull")
+        syncCmd.Flags().BoolVar(&pruneDeletions, "prune-remote-deletions", false, "Remove the links of tracked files that were deleted from the repository")
+        addSkipLayerFlags(syncCmd)
+        syncCmd.Flags().BoolVar(&noApply, "no-apply", false, "Only commit, pull and push the repository without applying anything to the home directory")
+        addIgnoreWhitespaceFlag(syncCmd, &syncIgnoreWhitespace)
+        syncCmd.Flags().BoolVar(&stashChanges, "stash", false, "Stash uncommitted changes before pulling and re-apply them afterwards instead of auto-committing")
         
         // Advanced conflict resolution flags
         syncCmd.Flags().BoolVar(&resolveConflicts, "resolve-conflicts", false, "Detect and resolve conflicts between local and remote files")
@@ -288,3 +552,4 @@ func init() {
                 utils.Logger.Debug().Err(err).Msg("Failed to register strategy flag completion")
         }
 }
+
@@ -1,9 +1,14 @@
 package cmd
 
 import (
+        "errors"
+        "encoding/json"
+        "fmt"
+        "io"
         "os"
         "path/filepath"
         "strings"
+        "text/tabwriter"
 
         "github.com/dotpilot/core"
         "github.com/dotpilot/utils"
@@ -11,9 +16,21 @@ import (
 )
 
 var (
-        destPath      string
-        overwrite     bool
-        environmentOp string
+        destPath       string
+        overwrite      bool
+        skipExisting   bool
+        environmentOp  string
+        trackNoCommit  bool
+        forcePlaintext bool
+        trackDryRun    bool
+        trackJSON      bool // Whether to print the --dry-run plan as JSON
+        trackRelative  bool
+        trackDeref     bool // Whether to follow symlinked directories
+        trackMove      bool // Whether to move files into the repo instead of copying them
+        trackGitCrypt  bool // Whether to hand the files to git-crypt
+        trackChmod     string // Mode to give the tracked files, recorded for apply
+        trackLinkMode  string // How to replace the tracked files, recorded for apply
+        trackCommitTemplate string // Template of the commit message, see core.CommitTemplate
 )
 
 // trackCmd represents the track command
@@ -24,30 +41,144 @@ var trackCmd = &cobra.Command{
 This will copy the file or directory to the dotpilot repository and create a symlink
 in the original location.
 
+When a file is already in the repository, track asks whether to overwrite or
+skip it, or to do the same for all remaining files. --overwrite and
+--skip-existing answer for every file up front; with --non-interactive,
+existing files are skipped and listed at the end.
+
+Files that look like they hold a secret, such as private keys, AWS access
+keys, SOPS-encrypted files or long random tokens, are not tracked as
+plaintext. Store them with 'dotpilot secrets add' instead, or pass
+--force-plaintext if the match is a false positive.
+
+Files inside a tracked directory that match a pattern in .dotpilotignore,
+relative to the home directory, are left out.
+
+Symlinks, also those to directories inside a tracked directory, are recorded
+as links and recreated by apply; what they point to isn't copied. With
+--dereference, symlinked directories outside the repository are followed
+instead and the files in them tracked like any other. A link leading back
+into the tree being tracked is not followed.
+
+With --move, files are moved into the repository and linked back instead of
+copied, leaving no backup of the original behind, which saves the space of a
+second copy of large files. Across filesystems the file is copied and the
+original removed. If the link can't be created, the file is moved back.
+
+With --dry-run, nothing is copied, linked or committed. Instead track prints
+a tree of what it would do with every file: copy it in (new-copy), replace
+the file in the repository (overwrite), ask about it (ask), or leave it out
+because it is linked already, in the repository already, a duplicate of a
+tracked file or ignored. Files marked "backup" are moved aside and replaced
+by a link. Add --json for a machine-readable plan.
+
+In a repository that keeps its secrets with git-crypt, --git-crypt (or
+--secret) tracks files like any other but appends a filter=git-crypt line for
+each to the .gitattributes of the repository, so git encrypts them when they
+are committed. They are tracked even if they look like secrets. If git-crypt
+is locked on this machine the files would be committed as plaintext, so they
+are neither staged nor committed: run 'git-crypt unlock', then
+'dotpilot commit'.
+
+With --chmod, the tracked files get that mode, in octal like 0600, and it is
+recorded in file-modes.json in the repository. Git only keeps whether a file
+is executable, so apply and bootstrap set the recorded mode again on every
+machine; the links in the home directory resolve to files with that mode.
+
+With --link-mode, the tracked files are replaced by a symlink (the default),
+a hardlink or a copy of the file in the repository, and the mode is recorded
+in link-modes.json for apply and bootstrap. A hardlink suits programs that
+resolve symlinks oddly, a copy programs that rewrite their files in place.
+Across filesystems a hardlink falls back to a copy. A copy edited in place
+shows up in 'dotpilot diff', and apply asks before replacing it; an
+unchanged copy is refreshed without asking.
+
+With --commit-template, the commit message is rendered from a Go template
+instead of the "commit_template" option of ~/.dotpilotrc, or the default
+message. The template sees .Action, the default message, .Files, the changed
+files, .Env, .Host and .Time.
+
 For example:
   dotpilot track ~/.zshrc
-  dotpilot track ~/.config/nvim --env dev`,
-        Args: cobra.MinimumNArgs(1),
-        Run: func(cmd *cobra.Command, args []string) {
-                // Get home directory
-                home, err := os.UserHomeDir()
+  dotpilot track ~/.config/nvim --env dev
+  dotpilot track ~/.config/nvim --skip-existing
+  dotpilot track ~/.gitconfig --no-commit
+  dotpilot track ~/.local/share/fonts --move
+  dotpilot track ~/.ssh/id_ed25519 --git-crypt
+  dotpilot track ~/.ssh/authorized_keys --chmod 0600
+  dotpilot track ~/.config/Code/User/settings.json --link-mode copy
+  dotpilot track ~/.config --dry-run
+  dotpilot track ~/.tmux.conf --commit-template "[{{.Env}}@{{.Host}}] {{.Action}}: {{.Files}}"`,
+        Args: nonEmptyArgs(cobra.MinimumNArgs(1)),
+        RunE: func(cmd *cobra.Command, args []string) error {
+                if trackJSON && !trackDryRun {
+                        return errors.New("--json only applies to --dry-run")
+                }
+
+                // Open the dotpilot repository, a dry run changes nothing
+                repo, err := openRepository()
                 if err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to get home directory")
-                        os.Exit(1)
+                        return err
+                }
+                if !trackDryRun {
+                        if err := lockRepository(repo.Home); err != nil {
+                                return err
+                        }
+                }
+                dotpilotDir := repo.Dir
+
+                if trackGitCrypt && !core.GitCryptConfigured(dotpilotDir) {
+                        return errors.New("The dotpilot repository doesn't use git-crypt, run 'git-crypt init' in it first or store secrets with 'dotpilot secrets add'")
+                }
+
+                var mode os.FileMode
+                if trackChmod != "" {
+                        var err error
+                        if mode, err = core.ParseFileMode(trackChmod); err != nil {
+                                return withMessage(err, "Invalid --chmod")
+                        }
                 }
 
-                // Check if dotpilot is initialized
-                dotpilotDir := filepath.Join(home, ".dotpilot")
-                if _, err := os.Stat(dotpilotDir); os.IsNotExist(err) {
-                        utils.Logger.Error().Msg("Dotpilot is not initialized. Run 'dotpilot init' first.")
-                        os.Exit(1)
+                linkMode := core.LinkSymlink
+                if trackLinkMode != "" {
+                        var err error
+                        if linkMode, err = core.ParseLinkMode(trackLinkMode); err != nil {
+                                return withMessage(err, "Invalid --link-mode")
+                        }
+                        if trackRelative && linkMode != core.LinkSymlink {
+                                return errors.New("--relative only applies to symlinks")
+                        }
+                }
+
+                if trackCommitTemplate != "" {
+                        if _, err := core.ParseCommitTemplate(trackCommitTemplate); err != nil {
+                                return withMessage(err, "Invalid --commit-template")
+                        }
+                        core.SetCommitTemplate(trackCommitTemplate)
+                }
+
+                opts := core.TrackOptions{Existing: core.ExistingPrompt, ForcePlaintext: forcePlaintext, DryRun: trackDryRun, Relative: trackRelative, Dereference: trackDeref, Move: trackMove, LinkMode: linkMode}
+                if overwrite {
+                        opts.Existing = core.ExistingOverwrite
+                } else if skipExisting {
+                        opts.Existing = core.ExistingSkip
+                }
+                if trackGitCrypt {
+                        // git-crypt encrypts them on commit
+                        opts.ForcePlaintext = true
                 }
 
                 // Track each file or directory
+                var skipped, duplicates []string
+                var plans []trackPlan
+                var tracked []string
+                failed := false
                 for _, src := range args {
                         // Expand ~ to home directory
-                        if src[0] == '~' {
-                                src = filepath.Join(home, src[1:])
+                        src, err := utils.ExpandHome(repo.Home, src)
+                        if err != nil {
+                                utils.Logger.Error().Err(err).Msg("Can't track the path")
+                                continue
                         }
 
                         // Get absolute path
@@ -57,6 +188,14 @@ For example:
                                 continue
                         }
 
+                        // Tracking the home directory or the repository would
+                        // move the repository into itself
+                        if err := core.CheckTrackSource(repo.Home, dotpilotDir, absPath); err != nil {
+                                failed = true
+                                utils.Logger.Error().Err(err).Str("hint", errorHint(err)).Msg("Can't track the path")
+                                continue
+                        }
+
                         // Check if file or directory exists
                         if _, err := os.Stat(absPath); os.IsNotExist(err) {
                                 utils.Logger.Error().Msgf("File or directory does not exist: %s", absPath)
@@ -68,91 +207,247 @@ For example:
                         if destPath != "" {
                                 destination = destPath
                         } else {
-                                // Make path relative to home if it's under home
+                                // Make path relative to home if it's under home,
+                                // or under a relocated XDG base directory
                                 relPath := absPath
-                                if filepath.HasPrefix(absPath, home) {
-                                        relPath, _ = filepath.Rel(home, absPath)
+                                if rel, ok := core.HomeRelPath(repo.Home, absPath); ok {
+                                        relPath = filepath.FromSlash(rel)
                                 }
 
                                 // Determine environment path
-                                var envDir string
-                                switch environmentOp {
-                                case "common":
-                                        envDir = "common"
-                                case "machine":
-                                        hostname, err := os.Hostname()
-                                        if err != nil {
-                                                utils.Logger.Error().Err(err).Msg("Failed to get hostname")
-                                                hostname = "unknown"
-                                        }
-                                        envDir = filepath.Join("machine", hostname)
-                                default:
-                                        if environmentOp != "" {
-                                                envDir = filepath.Join("envs", environmentOp)
-                                        } else {
-                                                // Use current environment from config
-                                                cfg := core.GetConfig()
-                                                if cfg.CurrentEnvironment != "" {
-                                                        envDir = filepath.Join("envs", cfg.CurrentEnvironment)
-                                                } else {
-                                                        envDir = "common"
-                                                }
-                                        }
-                                }
+                                envDir := layerDir(environmentOp)
 
                                 destination = filepath.Join(dotpilotDir, envDir, relPath)
                         }
 
                         // Track the file
-                        if err := core.TrackFile(absPath, destination, dotpilotDir, overwrite); err != nil {
-                                utils.Logger.Error().Err(err).Msgf("Failed to track %s", absPath)
+                        result, err := repo.TrackWithOptions(absPath, destination, opts)
+                        skipped = append(skipped, result.Skipped...)
+                        duplicates = append(duplicates, result.Duplicates...)
+                        plans = append(plans, trackPlan{Source: absPath, Entries: result.Plan})
+                        if err != nil {
+                                failed = true
+                                event := utils.Logger.Error().Err(err)
+                                if hint := errorHint(err); hint != "" {
+                                        event = event.Str("hint", hint)
+                                }
+                                event.Msgf("Failed to track %s", absPath)
                                 continue
                         }
 
-                        utils.Logger.Info().Msgf("Successfully tracked %s", absPath)
+                        if !trackDryRun {
+                                tracked = append(tracked, destination)
+                                utils.Logger.Info().Msgf("Successfully tracked %s", absPath)
+                        }
+                }
+
+                if trackDryRun {
+                        if err := printTrackPlans(cmd.OutOrStdout(), repo.Home, plans); err != nil {
+                                return withMessage(err, "Failed to print the plan")
+                        }
+                        if failed {
+                                return exitStatus(ExitGeneral)
+                        }
+                        return nil
+                }
+
+                if len(skipped) > 0 {
+                        utils.Logger.Warn().Msgf("Skipped %d files already in the repository, use --overwrite to replace them:", len(skipped))
+                        for _, path := range skipped {
+                                utils.Logger.Warn().Msgf("  %s", path)
+                        }
+                }
+                if len(duplicates) > 0 {
+                        utils.Logger.Warn().Msgf("Skipped %d files identical to files tracked already:", len(duplicates))
+                        for _, path := range duplicates {
+                                utils.Logger.Warn().Msgf("  %s", path)
+                        }
+                }
+
+                if trackChmod != "" && len(tracked) > 0 {
+                        recorded, err := core.RecordFileModes(dotpilotDir, tracked, mode)
+                        if err != nil {
+                                return withMessage(err, "Failed to set the mode of the tracked files")
+                        }
+                        utils.Logger.Info().Msgf("Set the mode of %d files to %04o", len(recorded), mode)
+                }
+
+                if trackLinkMode != "" && len(tracked) > 0 {
+                        recorded, err := core.RecordLinkModes(dotpilotDir, tracked, linkMode)
+                        if err != nil {
+                                return withMessage(err, "Failed to record the link mode of the tracked files")
+                        }
+                        if linkMode != core.LinkSymlink {
+                                utils.Logger.Info().Msgf("Recorded the link mode %s for %d files", linkMode, len(recorded))
+                        }
                 }
 
-                // Commit changes
-                utils.Logger.Info().Msg("Committing changes...")
-                if err := core.CommitChanges(dotpilotDir, "Added tracked files via dotpilot"); err != nil {
-                        utils.Logger.Error().Err(err).Msg("Failed to commit changes")
-                        os.Exit(1)
+                if trackGitCrypt {
+                        committable, err := handToGitCrypt(dotpilotDir, tracked)
+                        if err != nil || !committable {
+                                return err
+                        }
                 }
 
+                // Commit or stage changes
+                if err := commitOrStage(dotpilotDir, "Added tracked files via dotpilot", trackNoCommit); err != nil {
+                        return err
+                }
+
+                // The errors of the paths that failed were logged above
+                if failed {
+                        return exitStatus(ExitGeneral)
+                }
                 utils.Logger.Info().Msg("Files tracked successfully!")
+                return nil
         },
 }
 
-func init() {
-        trackCmd.Flags().StringVar(&destPath, "dest", "", "Custom destination path in the dotpilot repo")
-        trackCmd.Flags().BoolVar(&overwrite, "overwrite", false, "Overwrite existing files")
-        trackCmd.Flags().StringVar(&environmentOp, "env", "", "Environment to track in (common, machine, or specific environment name)")
+// handToGitCrypt makes git-crypt encrypt the tracked files at paths in the
+// repository. It returns whether they can be committed, which they can't
+// while git-crypt is locked.
+func handToGitCrypt(dotpilotDir string, paths []string) (bool, error) {
+        patterns, err := core.EnsureGitCryptAttributes(dotpilotDir, paths)
+        if err != nil {
+                return false, withMessage(err, "Failed to update .gitattributes for git-crypt")
+        }
+        for _, pattern := range patterns {
+                utils.Logger.Info().Msgf("Added %s to .gitattributes for git-crypt", pattern)
+        }
 
-        // Add file path completion for track command arguments
-        if err := trackCmd.RegisterFlagCompletionFunc("env", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
-                // Get available environments
-                envs := []string{"common", "machine"}
-                
-                // Add environment-specific directories
-                home, err := os.UserHomeDir()
-                if err == nil {
-                        dotpilotDir := filepath.Join(home, ".dotpilot")
-                        envsDir := filepath.Join(dotpilotDir, "envs")
-                        if info, err := os.Stat(envsDir); err == nil && info.IsDir() {
-                                if dirs, err := os.ReadDir(envsDir); err == nil {
-                                        for _, dir := range dirs {
-                                                if dir.IsDir() && !strings.HasPrefix(dir.Name(), ".") {
-                                                        envs = append(envs, dir.Name())
-                                                }
-                                        }
-                                }
+        if !core.GitCryptUnlocked(dotpilotDir) {
+                utils.Logger.Warn().Msg("git-crypt is locked, the files would be committed as plaintext, so they were not staged")
+                utils.Logger.Warn().Msg("Run 'git-crypt unlock' in the repository, then 'dotpilot commit'")
+                return false, nil
+        }
+        return true, nil
+}
+
+// trackPlan is the --dry-run plan for one argument of track
+type trackPlan struct {
+        Source  string                `json:"source"`
+        Entries []core.TrackPlanEntry `json:"entries"`
+}
+
+// printTrackPlans prints what track would do, as a tree per argument with the
+// counts per action, or as JSON with --json
+func printTrackPlans(out io.Writer, home string, plans []trackPlan) error {
+        counts := make(map[core.TrackAction]int)
+        for _, plan := range plans {
+                for _, entry := range plan.Entries {
+                        counts[entry.Action]++
+                }
+        }
+
+        if trackJSON {
+                data, err := json.MarshalIndent(struct {
+                        Plans  []trackPlan               `json:"plans"`
+                        Counts map[core.TrackAction]int `json:"counts"`
+                }{plans, counts}, "", "  ")
+                if err != nil {
+                        return err
+                }
+                fmt.Fprintln(out, string(data))
+                return nil
+        }
+
+        w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+        for _, plan := range plans {
+                fmt.Fprintf(w, "%s\n", tildePath(home, plan.Source))
+                var dirs []string
+                for _, entry := range plan.Entries {
+                        relPath, err := filepath.Rel(plan.Source, entry.Source)
+                        if err != nil || relPath == "." {
+                                relPath = filepath.Base(entry.Source)
+                        }
+                        parts := strings.Split(filepath.ToSlash(relPath), "/")
+
+                        // Print the directories the entry is in that the
+                        // previous one wasn't in
+                        same := 0
+                        for same < len(dirs) && same < len(parts)-1 && dirs[same] == parts[same] {
+                                same++
+                        }
+                        dirs = parts[:len(parts)-1]
+                        for i := same; i < len(dirs); i++ {
+                                fmt.Fprintf(w, "%s%s/\n", strings.Repeat("  ", i+1), dirs[i])
+                        }
+
+                        name := parts[len(parts)-1]
+                        if info, err := os.Lstat(entry.Source); err == nil && info.IsDir() {
+                                name += "/"
+                        }
+                        action := string(entry.Action)
+                        if entry.Backup {
+                                action += ", backup"
                         }
+                        fmt.Fprintf(w, "%s%s\t%s\n", strings.Repeat("  ", len(parts)), name, action)
+                }
+        }
+        w.Flush()
+
+        var summary []string
+        total := 0
+        for _, action := range core.TrackActions {
+                if counts[action] > 0 {
+                        summary = append(summary, fmt.Sprintf("%d %s", counts[action], action))
+                        total += counts[action]
+                }
+        }
+        if total == 0 {
+                fmt.Fprintln(out, "Nothing to track.")
+                return nil
+        }
+        fmt.Fprintf(out, "\nDry run, nothing was changed. %d paths: %s\n", total, strings.Join(summary, ", "))
+        return nil
+}
+
+// layerDir returns the repo directory for an --env value: common, machine
+// (this host) or an environment name. An empty value selects the current
+// environment, or common if none is set.
+func layerDir(layer string) string {
+        switch layer {
+        case "common":
+                return "common"
+        case "machine":
+                hostname, err := core.MachineID()
+                if err != nil {
+                        utils.Logger.Error().Err(err).Msg("Failed to get hostname")
+                        hostname = "unknown"
+                }
+                return filepath.Join("machine", hostname)
+        case "":
+                // Use current environment from config
+                if environment := core.GetConfig().CurrentEnvironment; environment != "" {
+                        return filepath.Join("envs", environment)
                 }
-                
-                return envs, cobra.ShellCompDirectiveNoFileComp
-        }); err != nil {
-                utils.Logger.Debug().Err(err).Msg("Failed to register environment flag completion")
+                return "common"
+        default:
+                return filepath.Join("envs", layer)
         }
+}
+
+func init() {
+        trackCmd.Flags().StringVar(&destPath, "dest", "", "Custom destination path in the dotpilot repo")
+        trackCmd.Flags().BoolVar(&overwrite, "overwrite", false, "Overwrite files already in the repository without asking")
+        trackCmd.Flags().BoolVar(&skipExisting, "skip-existing", false, "Skip files already in the repository without asking")
+        trackCmd.MarkFlagsMutuallyExclusive("overwrite", "skip-existing")
+        trackCmd.Flags().StringVar(&environmentOp, "env", "", "Environment to track in (common, machine, or specific environment name)")
+        trackCmd.Flags().BoolVar(&trackNoCommit, "no-commit", false, "Stage the tracked files without committing them")
+        trackCmd.Flags().BoolVar(&forcePlaintext, "force-plaintext", false, "Track files that look like secrets as plaintext anyway")
+        trackCmd.Flags().BoolVar(&trackDryRun, "dry-run", false, "Show what would be tracked without changing anything")
+        trackCmd.Flags().BoolVar(&trackJSON, "json", false, "Print the --dry-run plan as JSON")
+        trackCmd.Flags().BoolVar(&trackRelative, "relative", false, "Replace the tracked files with symlinks relative to their directory")
+        trackCmd.Flags().BoolVar(&trackDeref, "dereference", false, "Follow symlinked directories and track their files instead of the links")
+        trackCmd.Flags().BoolVar(&trackMove, "move", false, "Move files into the repository instead of copying and backing them up")
+        trackCmd.Flags().BoolVar(&trackGitCrypt, "git-crypt", false, "Have git-crypt encrypt the files when they are committed")
+        trackCmd.Flags().BoolVar(&trackGitCrypt, "secret", false, "Same as --git-crypt")
+        trackCmd.Flags().StringVar(&trackChmod, "chmod", "", "Give the tracked files this octal mode, like 0600, and have apply keep it")
+        trackCmd.Flags().StringVar(&trackLinkMode, "link-mode", "", "Replace the tracked files with a symlink, hardlink or copy, and have apply keep it")
+        trackCmd.Flags().StringVar(&trackCommitTemplate, "commit-template", "", "Go template of the commit message, like \"[{{.Env}}@{{.Host}}] {{.Action}}: {{.Files}}\"")
+
+        // Complete the layers of the repository for --env
+        registerFlagCompletion(trackCmd, "env", completeLayerFlag)
 
         // Enable filepath completion for arguments
         trackCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+var verifyRemoteTimeout time.Duration
+
+// verifyRemoteCmd represents the verify-remote command
+var verifyRemoteCmd = &cobra.Command{
+	Use:   "verify-remote",
+	Short: "Check that the remote is reachable with your credentials",
+	Long: `Connect to the remote repository with the credentials sync uses and list its
+branches, like git ls-remote. Nothing is fetched or changed, so it is a quick
+check to run before a long bootstrap. When the remote can't be reached, the
+reason is reported: the host name doesn't resolve, the connection was refused
+or timed out, the credentials were rejected, or the SSH host key is unknown or
+doesn't match known_hosts.
+
+For example:
+  dotpilot verify-remote
+  dotpilot verify-remote --timeout 5s`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+
+		ctx, stop := utils.InterruptContext(context.Background())
+		defer stop()
+		ctx, cancel := context.WithTimeout(ctx, verifyRemoteTimeout)
+		defer cancel()
+
+		v, err := core.VerifyRemote(ctx, repo.Dir)
+		if err != nil {
+			return withMessage(err, "Failed to verify the remote")
+		}
+		if !v.OK() {
+			utils.Logger.Error().Err(v.Err).Str("hint", remoteProblemHint(v.Problem)).Msgf("Cannot reach %s: %s", v.URL, v.Problem)
+			return exitStatus(ExitNetwork)
+		}
+		printRemoteVerification(out, v)
+		return nil
+	},
+}
+
+// printRemoteVerification prints a remote that was reached
+func printRemoteVerification(w io.Writer, v core.RemoteVerification) {
+	fmt.Fprintf(w, "Reached %s in %s with %s credentials, %d refs\n", v.URL, v.Duration.Round(time.Millisecond), v.Auth, v.Refs)
+}
+
+// remoteProblemHint returns how to fix a remote that couldn't be reached
+func remoteProblemHint(problem core.RemoteProblem) string {
+	switch problem {
+	case core.RemoteDNS:
+		return "Check the host name in the remote URL and your DNS settings."
+	case core.RemoteRefused:
+		return "Check the host and port in the remote URL, and that the server is up."
+	case core.RemoteTimeout:
+		return "Check your network connection and firewall, or wait longer with --timeout."
+	case core.RemoteUnreachable:
+		return errorHint(core.ErrNetwork)
+	case core.RemoteAuthRejected:
+		return errorHint(core.ErrAuthFailed)
+	case core.RemoteHostKeyMismatch:
+		return "The SSH host key differs from the one in ~/.ssh/known_hosts. Make sure the new key is genuine before replacing the old one."
+	case core.RemoteUnknownHostKey:
+		return "Add the host to ~/.ssh/known_hosts, for example by connecting to it once with ssh."
+	case core.RemoteNotFound:
+		return "Check the remote URL. Without access, a private repository looks like it doesn't exist."
+	}
+	return ""
+}
+
+func init() {
+	verifyRemoteCmd.Flags().DurationVar(&verifyRemoteTimeout, "timeout", 15*time.Second, "How long to wait for the remote")
+	rootCmd.AddCommand(verifyRemoteCmd)
+}
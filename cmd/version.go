@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/dotpilot/core"
+	"github.com/dotpilot/utils"
+	"github.com/spf13/cobra"
+)
+
+// version is the version of this build, set by release builds with
+//
+//	go build -ldflags "-X github.com/dotpilot/cmd.version=v1.2.3"
+var version = "dev"
+
+var versionCheck bool
+
+// versionCmd represents the version command
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print the dotpilot version",
+	Long: `Print the version of this dotpilot build.
+
+With --check, GitHub is asked for the latest release and where to download it
+if it is newer. Builds from source report the version "dev" and are never
+out of date.
+
+For example:
+  dotpilot version
+  dotpilot version --check`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+		fmt.Fprintf(out, "dotpilot %s (%s/%s, %s)\n", version, runtime.GOOS, runtime.GOARCH, runtime.Version())
+		if !versionCheck {
+			return nil
+		}
+
+		release, err := core.LatestRelease(context.Background())
+		if err != nil {
+			return withMessage(err, "Failed to check for a newer version")
+		}
+		if !core.IsNewerVersion(release.Tag, version) {
+			fmt.Fprintf(out, "dotpilot is up to date, the latest release is %s.\n", release.Tag)
+			return nil
+		}
+
+		fmt.Fprintf(out, "A newer version is available: %s\n", release.Tag)
+		if binary, ok := release.BinaryAsset(); ok {
+			fmt.Fprintf(out, "Download: %s\n", binary.URL)
+		}
+		fmt.Fprintf(out, "Release notes: %s\n", release.URL)
+		fmt.Fprintln(out, "Run 'dotpilot self-update' to install it.")
+		return nil
+	},
+}
+
+// selfUpdateCmd represents the self-update command
+var selfUpdateCmd = &cobra.Command{
+	Use:   "self-update",
+	Short: "Replace dotpilot with the latest release",
+	Long: `Download the latest dotpilot release for this platform from GitHub and
+replace the running executable with it, after verifying the download against
+the checksums published with the release.
+
+Self-update works on Linux and macOS. On other platforms, and for package
+manager installs, update dotpilot the way it was installed.
+
+For example:
+  dotpilot self-update`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Ctrl-C aborts the download, the executable is only replaced once
+		// it is complete
+		ctx, stop := utils.InterruptContext(context.Background())
+		defer stop()
+
+		release, err := core.LatestRelease(ctx)
+		if err != nil {
+			return withMessage(err, "Failed to check for a newer version")
+		}
+		if !core.IsNewerVersion(release.Tag, version) {
+			utils.Logger.Info().Msgf("dotpilot %s is up to date, the latest release is %s", version, release.Tag)
+			return nil
+		}
+
+		executable, err := os.Executable()
+		if err != nil {
+			return withMessage(err, "Failed to find the dotpilot executable")
+		}
+		utils.Logger.Info().Msgf("Updating dotpilot %s to %s...", version, release.Tag)
+		if err := core.SelfUpdate(ctx, release, executable); err != nil {
+			return withMessage(err, "Failed to update dotpilot")
+		}
+		utils.Logger.Info().Msgf("Updated dotpilot to %s", release.Tag)
+		return nil
+	},
+}
+
+func init() {
+	versionCmd.Flags().BoolVar(&versionCheck, "check", false, "Check GitHub for a newer release")
+
+	rootCmd.Version = version
+	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(selfUpdateCmd)
+}
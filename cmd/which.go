@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dotpilot/core"
+	"github.com/spf13/cobra"
+)
+
+// whichCmd represents the which command
+var whichCmd = &cobra.Command{
+	Use:   "which [file]",
+	Short: "Show which repo file provides a dotfile",
+	Long: `Show which layer and file of the repository provide a dotfile, where the
+file in your home directory points, and whether the two agree.
+
+The path can be a file in the home directory or a file inside the dotpilot
+repository. For a home path, the machine, environment and common layers are
+searched in that order, like apply does, and files of lower layers that are
+shadowed are listed. For a repo path, the home path it is applied to is shown,
+along with the file that is actually in effect there.
+
+Exits with a non-zero status if no layer provides the file.
+
+For example:
+  dotpilot which ~/.zshrc
+  dotpilot which ~/.config/nvim/init.lua
+  dotpilot which ~/.dotpilot/envs/dev/.gitconfig`,
+	Args: nonEmptyArgs(cobra.ExactArgs(1)),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out := cmd.OutOrStdout()
+
+		// Open the dotpilot repository
+		repo, err := openRepository()
+		if err != nil {
+			return err
+		}
+
+		target, err := expandHome(repo.Home, args[0])
+		if err != nil {
+			return err
+		}
+		result, err := core.Which(repo.Dir, repo.Environment(), target)
+		if err != nil {
+			return withMessage(err, "Failed to resolve "+args[0])
+		}
+
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "Target:\t%s\n", result.Target)
+		if result.RepoPath != "" {
+			fmt.Fprintf(w, "Provided by:\t%s\n", result.RepoPath)
+		} else {
+			fmt.Fprintf(w, "Provided by:\tnothing, no active layer has this file\n")
+		}
+		if len(result.Shadowed) > 0 {
+			fmt.Fprintf(w, "Shadows:\t%s\n", strings.Join(result.Shadowed, ", "))
+		}
+		switch {
+		case !result.Exists:
+			fmt.Fprintf(w, "Currently:\tmissing\n")
+		case result.Link != "":
+			fmt.Fprintf(w, "Currently:\tsymlink to %s\n", result.Link)
+		default:
+			fmt.Fprintf(w, "Currently:\tregular file\n")
+		}
+		fmt.Fprintf(w, "Status:\t%s\n", whichStatus(repo.Dir, result))
+		w.Flush()
+
+		if result.RepoPath == "" {
+			return exitStatus(ExitGeneral)
+		}
+		return nil
+	},
+}
+
+// whichStatus summarizes whether the target agrees with the repo file that
+// provides it
+func whichStatus(dotpilotDir string, result core.WhichResult) string {
+	switch {
+	case result.RepoPath == "":
+		if result.Exists {
+			return "not managed by dotpilot"
+		}
+		return "not tracked"
+	case result.Linked:
+		return "ok, linked to the repo file"
+	case !result.Exists:
+		return "not applied yet, run 'dotpilot apply'"
+	case result.Link == "":
+		return "out of sync, a regular file replaced the link, run 'dotpilot reapply " + result.Target + "'"
+	}
+
+	// A link into another layer is left over from before a higher layer
+	// started to shadow it
+	if repoPath, err := core.RepoPath(dotpilotDir, result.Link); err == nil && !strings.HasPrefix(repoPath, "../") && filepath.IsAbs(result.Link) {
+		return "out of sync, links to " + repoPath + ", run 'dotpilot reapply " + result.Target + "'"
+	}
+	return "out of sync, links outside the repository, run 'dotpilot reapply " + result.Target + "'"
+}
+
+func init() {
+	rootCmd.AddCommand(whichCmd)
+}
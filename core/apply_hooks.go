@@ -0,0 +1,141 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// applyHooksFile maps glob patterns to commands that run after matching files
+// were linked. It lives in the root of the dotpilot repository, so it is never
+// linked into the home directory itself.
+const applyHooksFile = "apply-hooks.json"
+
+// ApplyHook is a command run once per apply when files matching Pattern were
+// (re)linked
+type ApplyHook struct {
+	Pattern string
+	Command string
+}
+
+// LoadApplyHooks reads apply-hooks.json from the dotpilot repository, for
+// example {".config/fontconfig": "fc-cache -f"}. The hooks are returned sorted
+// by pattern so they run in a stable order. A missing file means no hooks.
+func LoadApplyHooks(dotpilotDir string) ([]ApplyHook, error) {
+	data, err := os.ReadFile(filepath.Join(dotpilotDir, applyHooksFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var commands map[string]string
+	if err := json.Unmarshal(data, &commands); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", applyHooksFile, err)
+	}
+
+	hooks := make([]ApplyHook, 0, len(commands))
+	for pattern, command := range commands {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q in %s: %w", pattern, applyHooksFile, err)
+		}
+		hooks = append(hooks, ApplyHook{Pattern: pattern, Command: command})
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		return hooks[i].Pattern < hooks[j].Pattern
+	})
+
+	return hooks, nil
+}
+
+// matchHookPattern matches a slash-separated path relative to home against a
+// hook pattern. The pattern may match the path or one of its parent
+// directories, so ".config/fontconfig" covers every file below it. Patterns
+// without a slash also match the base name, like "*.conf".
+func matchHookPattern(pattern, relPath string) bool {
+	pattern = strings.Trim(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		if ok, _ := path.Match(pattern, path.Base(relPath)); ok {
+			return true
+		}
+	}
+
+	for p := relPath; p != "." && p != "/"; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RunApplyHooks runs every apply hook whose pattern matches one of the linked
+// targets, once, with the matching targets as arguments ("$@") and in
+// DOTPILOT_APPLIED_FILES, one per line. Hook output is streamed to the logger.
+// With prompts disabled (see utils.SetNonInteractive) hooks get no stdin. A
+// failing hook does not stop the others.
+func RunApplyHooks(dotpilotDir, environment string, linked []string) error {
+	if len(linked) == 0 {
+		return nil
+	}
+
+	hooks, err := LoadApplyHooks(dotpilotDir)
+	if err != nil || len(hooks) == 0 {
+		return err
+	}
+
+	home, err := Home()
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, hook := range hooks {
+		var files []string
+		for _, target := range linked {
+			relPath, ok := HomeRelPath(home, target)
+			if !ok {
+				continue
+			}
+			if matchHookPattern(hook.Pattern, relPath) {
+				files = append(files, target)
+			}
+		}
+		if len(files) == 0 {
+			continue
+		}
+
+		utils.Logger.Info().Msgf("Running apply hook for %s (%d files): %s", hook.Pattern, len(files), hook.Command)
+		if err := runApplyHook(dotpilotDir, environment, hook, files); err != nil {
+			utils.Logger.Error().Err(err).Msgf("Apply hook for %s failed", hook.Pattern)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d apply hooks failed", failed)
+	}
+	return nil
+}
+
+// runApplyHook runs a single hook command with sh
+func runApplyHook(dotpilotDir, environment string, hook ApplyHook, files []string) error {
+	opts := utils.StreamOptions{
+		Env:    append(ScriptEnv(dotpilotDir, environment), "DOTPILOT_APPLIED_FILES="+strings.Join(files, "\n")),
+		Prefix: hook.Pattern,
+	}
+	opts.Dir, _ = Home()
+	if !utils.IsNonInteractive() {
+		opts.Stdin = os.Stdin
+	}
+
+	_, err := utils.StreamCommandWithOptions(context.Background(), opts, "sh", append([]string{"-c", hook.Command, "dotpilot-hook"}, files...)...)
+	return err
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMatchHookPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		relPath string
+		want    bool
+	}{
+		{".config/fontconfig", ".config/fontconfig/fonts.conf", true},
+		{".config/fontconfig/", ".config/fontconfig/conf.d/10-hinting.conf", true},
+		{".config/*/fonts.conf", ".config/fontconfig/fonts.conf", true},
+		{"*.conf", ".config/fontconfig/fonts.conf", true},
+		{".tmux.conf", ".tmux.conf", true},
+		{".config/fontconfig", ".config/fontconfigs/fonts.conf", false},
+		{".config/fontconfig", ".fonts.conf", false},
+		{"*.conf", ".zshrc", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchHookPattern(tt.pattern, tt.relPath); got != tt.want {
+			t.Errorf("matchHookPattern(%q, %q) = %v, want %v", tt.pattern, tt.relPath, got, tt.want)
+		}
+	}
+}
+
+func TestApplyHooks(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	for _, name := range []string{"common/.config/fontconfig/fonts.conf", "common/.config/fontconfig/conf.d/hinting.conf", "common/.zshrc"} {
+		path := filepath.Join(dotpilotDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("repo\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The hook appends its arguments to a log, one run per line
+	hookLog := filepath.Join(home, "hook.log")
+	hooks := `{".config/fontconfig": "echo \"$@\" >> '` + hookLog + `'"}`
+	if err := os.WriteFile(filepath.Join(dotpilotDir, applyHooksFile), []byte(hooks), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second apply changes nothing, so the hook must not run again
+	for i := 0; i < 2; i++ {
+		if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(hookLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(runs) != 1 {
+		t.Fatalf("hook ran %d times, want 1: %q", len(runs), data)
+	}
+	for _, name := range []string{".config/fontconfig/fonts.conf", ".config/fontconfig/conf.d/hinting.conf"} {
+		if !strings.Contains(runs[0], filepath.Join(home, name)) {
+			t.Errorf("hook arguments %q do not include %s", runs[0], name)
+		}
+	}
+	if strings.Contains(runs[0], ".zshrc") {
+		t.Errorf("hook arguments %q include .zshrc", runs[0])
+	}
+
+	// The hooks file itself is never linked into home
+	if _, err := os.Lstat(filepath.Join(home, applyHooksFile)); !os.IsNotExist(err) {
+		t.Errorf("%s was linked into home", applyHooksFile)
+	}
+}
@@ -0,0 +1,250 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dotpilot/utils"
+)
+
+// applyJournalName is the journal of the apply in progress inside the
+// dotpilot directory. It is machine-local and kept out of git.
+const applyJournalName = ".apply-journal"
+
+// applyAsideSuffix is appended to targets that are moved out of the way
+// during an apply without a backup, they are removed once it is done
+const applyAsideSuffix = ".dotpilot.apply"
+
+// symlink is os.Symlink, replaced in tests to interrupt an apply or a track.
+// Apply links through EnsureSymlink.
+var symlink = os.Symlink
+
+// applyStep is one change an apply makes below the target root, as recorded
+// in the journal
+type applyStep struct {
+	// Op is "mkdir" to create Target, "link" to link Target to Source, or
+	// "commit" for the entry that marks the end of a successful apply
+	Op     string      `json:"op"`
+	Target string      `json:"target,omitempty"`
+	Source string      `json:"source,omitempty"`
+	Mode   os.FileMode `json:"mode,omitempty"`
+	// Backup is where the existing target is moved before it is linked
+	Backup string `json:"backup,omitempty"`
+	// Keep is set if Backup is kept after the apply
+	Keep bool `json:"keep,omitempty"`
+	// LinkMode is set if Target is a hardlink or copy of the repo file
+	// Source instead of a symlink, see MaterializeFile
+	LinkMode LinkMode `json:"link_mode,omitempty"`
+}
+
+// applyJournalPath returns the path of the apply journal
+func applyJournalPath(dotpilotDir string) string {
+	return filepath.Join(dotpilotDir, applyJournalName)
+}
+
+// checkApplyJournal returns ErrApplyInterrupted if an earlier apply left its
+// journal behind
+func checkApplyJournal(dotpilotDir string) error {
+	if _, err := os.Stat(applyJournalPath(dotpilotDir)); err == nil {
+		return fmt.Errorf("%w: %s exists", ErrApplyInterrupted, applyJournalPath(dotpilotDir))
+	}
+	return nil
+}
+
+// runApplySteps makes the changes of an apply. Every step is written to the
+// journal before it is made, so if the apply fails they are rolled back, and
+// if the process dies RecoverApply can roll them back later. The targets
+// moved aside are only removed once every step succeeded.
+func runApplySteps(dotpilotDir string, steps []applyStep) error {
+	if len(steps) == 0 {
+		return nil
+	}
+
+	path := applyJournalPath(dotpilotDir)
+	journal, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return fmt.Errorf("%w: %s exists", ErrApplyInterrupted, path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create the apply journal: %w", err)
+	}
+	defer journal.Close()
+	if err := excludeLocalFile(dotpilotDir, applyJournalName); err != nil {
+		utils.Logger.Debug().Err(err).Msg("Failed to exclude the apply journal from git")
+	}
+
+	for i, step := range steps {
+		if err := writeJournalEntry(journal, step); err != nil {
+			return abortApply(path, steps[:i], fmt.Errorf("failed to write the apply journal: %w", err))
+		}
+		if err := step.run(); err != nil {
+			return abortApply(path, steps[:i+1], err)
+		}
+	}
+
+	if err := writeJournalEntry(journal, applyStep{Op: "commit"}); err != nil {
+		return abortApply(path, steps, fmt.Errorf("failed to write the apply journal: %w", err))
+	}
+	finishApply(steps)
+	journal.Close()
+	return os.Remove(path)
+}
+
+// writeJournalEntry appends step to the journal and syncs it to disk
+func writeJournalEntry(journal *os.File, step applyStep) error {
+	data, err := json.Marshal(step)
+	if err != nil {
+		return err
+	}
+	if _, err := journal.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return journal.Sync()
+}
+
+// abortApply rolls back steps after the apply failed with err. The journal is
+// removed if the rollback succeeds and kept for RecoverApply otherwise.
+func abortApply(journalPath string, steps []applyStep, err error) error {
+	if rollbackErr := rollbackApply(steps); rollbackErr != nil {
+		return fmt.Errorf("%w, and rolling back failed: %v (run 'dotpilot apply --recover' to retry)", err, rollbackErr)
+	}
+	os.Remove(journalPath)
+	utils.Logger.Warn().Msgf("Rolled back %d changes of the failed apply", len(steps))
+	return err
+}
+
+// run makes the change of a step
+func (s applyStep) run() error {
+	switch s.Op {
+	case "mkdir":
+		return os.Mkdir(s.Target, s.Mode)
+	case "link":
+		if s.Backup != "" {
+			if err := utils.MoveFile(s.Target, s.Backup); err != nil {
+				return fmt.Errorf("failed to move %s aside: %w", s.Target, err)
+			}
+		}
+		if s.LinkMode != "" {
+			_, err := MaterializeFile(s.Source, s.Target, s.LinkMode)
+			return err
+		}
+		utils.Logger.Debug().Msgf("Creating symlink: %s -> %s", s.Target, s.Source)
+		return EnsureSymlink(s.Target, s.Source)
+	}
+	return nil
+}
+
+// undo reverts a step that may or may not have been made. Directories are
+// only removed while empty.
+func (s applyStep) undo() error {
+	switch s.Op {
+	case "mkdir":
+		if entries, err := os.ReadDir(s.Target); err == nil && len(entries) == 0 {
+			return os.Remove(s.Target)
+		}
+	case "link":
+		// A hardlink may have fallen back to a copy, either has the content
+		// of the repo file. If moving the target aside failed, what is there
+		// is the user's.
+		made := false
+		if s.LinkMode != "" && materialized(s.Target, s.Source, LinkCopy) {
+			_, err := os.Lstat(s.Backup)
+			made = s.Backup == "" || err == nil
+		}
+		if link, err := os.Readlink(s.Target); made || (err == nil && link == s.Source) {
+			if err := os.Remove(s.Target); err != nil {
+				return err
+			}
+		}
+		if s.Backup == "" {
+			return nil
+		}
+		if _, err := os.Lstat(s.Backup); os.IsNotExist(err) {
+			return nil
+		}
+		if _, err := os.Lstat(s.Target); err == nil {
+			return fmt.Errorf("%s changed during the apply, the original is at %s", s.Target, s.Backup)
+		}
+		return utils.MoveFile(s.Backup, s.Target)
+	}
+	return nil
+}
+
+// rollbackApply undoes steps in reverse order, returning the first error
+func rollbackApply(steps []applyStep) error {
+	var firstErr error
+	for i := len(steps) - 1; i >= 0; i-- {
+		if err := steps[i].undo(); err != nil {
+			utils.Logger.Warn().Err(err).Msgf("Failed to roll back %s", steps[i].Target)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// finishApply removes the targets that were only moved aside and reports the
+// backups that are kept
+func finishApply(steps []applyStep) {
+	for _, step := range steps {
+		if step.Backup == "" {
+			continue
+		}
+		if step.Keep {
+			utils.Logger.Info().Msgf("Backed up %s to %s", step.Target, step.Backup)
+		} else if err := os.Remove(step.Backup); err != nil && !os.IsNotExist(err) {
+			utils.Logger.Warn().Err(err).Msgf("Failed to remove %s", step.Backup)
+		}
+	}
+}
+
+// RecoverApply rolls back the changes of an apply that was interrupted, as
+// recorded in its journal, and returns how many were undone. An apply that
+// got to the end is finished instead. It does nothing if there is no
+// journal.
+func RecoverApply(dotpilotDir string) (int, error) {
+	path := applyJournalPath(dotpilotDir)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var steps []applyStep
+	committed := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var step applyStep
+		// The entry being written when the process died may be cut off, its
+		// step was never made
+		if err := json.Unmarshal(scanner.Bytes(), &step); err != nil {
+			utils.Logger.Debug().Err(err).Msg("Ignoring a damaged apply journal entry")
+			continue
+		}
+		if step.Op == "commit" {
+			committed = true
+			continue
+		}
+		steps = append(steps, step)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	file.Close()
+
+	if committed {
+		finishApply(steps)
+		return 0, os.Remove(path)
+	}
+	if err := rollbackApply(steps); err != nil {
+		return 0, err
+	}
+	return len(steps), os.Remove(path)
+}
@@ -0,0 +1,101 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupJournalTest creates a repository with three files, the first of which
+// replaces a local file, and makes linking the last one run fail
+func setupJournalTest(t *testing.T, fail func() error) (string, string) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	for _, name := range []string{"common/.aliases", "common/.config/app/conf", "common/.zshrc"} {
+		writeRepoFile(t, dotpilotDir, name, name+"\n")
+	}
+	writeRepoFile(t, home, ".aliases", "local\n")
+
+	saved := symlink
+	t.Cleanup(func() { symlink = saved })
+	symlink = func(oldname, newname string) error {
+		if filepath.Base(newname) == ".zshrc" {
+			if err := fail(); err != nil {
+				return err
+			}
+		}
+		return os.Symlink(oldname, newname)
+	}
+	return home, dotpilotDir
+}
+
+// checkUntouched fails if the home directory isn't as before the apply
+func checkUntouched(t *testing.T, home string) {
+	t.Helper()
+	if data, err := os.ReadFile(filepath.Join(home, ".aliases")); err != nil || string(data) != "local\n" {
+		t.Errorf(".aliases = %q, %v, want the local file", data, err)
+	}
+	for _, name := range []string{".config", ".zshrc", ".aliases" + applyAsideSuffix} {
+		if _, err := os.Lstat(filepath.Join(home, name)); !os.IsNotExist(err) {
+			t.Errorf("%s exists after the rollback", name)
+		}
+	}
+}
+
+func TestApplyRollsBackOnFailure(t *testing.T) {
+	failed := errors.New("disk full")
+	home, dotpilotDir := setupJournalTest(t, func() error { return failed })
+
+	err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{})
+	if !errors.Is(err, failed) {
+		t.Fatalf("apply = %v, want %v", err, failed)
+	}
+	checkUntouched(t, home)
+	if _, err := os.Stat(applyJournalPath(dotpilotDir)); !os.IsNotExist(err) {
+		t.Errorf("journal left behind after a rollback")
+	}
+}
+
+func TestRecoverApply(t *testing.T) {
+	home, dotpilotDir := setupJournalTest(t, func() error { panic("killed") })
+
+	// The process dies on the last link
+	func() {
+		defer func() { recover() }()
+		ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{})
+	}()
+	if link, err := os.Readlink(filepath.Join(home, ".aliases")); err != nil || link != filepath.Join(dotpilotDir, "common", ".aliases") {
+		t.Fatalf(".aliases = %q, %v, want the link made before the crash", link, err)
+	}
+
+	// Nothing is applied on top of the partial changes
+	symlink = os.Symlink
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{}); !errors.Is(err, ErrApplyInterrupted) {
+		t.Fatalf("apply after the crash = %v, want ErrApplyInterrupted", err)
+	}
+
+	undone, err := RecoverApply(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The two directories and the three links, including the one that was
+	// being made
+	if undone != 5 {
+		t.Errorf("undone = %d, want 5", undone)
+	}
+	checkUntouched(t, home)
+
+	// Recovering again is a no-op, and apply works again
+	if undone, err := RecoverApply(dotpilotDir); err != nil || undone != 0 {
+		t.Errorf("second recover = %d, %v", undone, err)
+	}
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Readlink(filepath.Join(home, ".zshrc")); err != nil {
+		t.Errorf(".zshrc was not linked after recovering: %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Apply reports
+//
+// ReportApply works out what an apply would change, like one that asks no
+// questions, and tells for every target of the active layers whether it is
+// already what apply makes of it, without changing anything. It backs 'apply
+// --report-only', a check fleet machines run in CI to fail when their
+// dotfiles drifted from the repository.
+
+// TargetState is the state of a target in an apply report
+type TargetState string
+
+const (
+	StateInSync  TargetState = "in-sync"      // The target links to the file of the layer that wins
+	StateDrifted TargetState = "drifted"      // The target links to another file in the repository, like that of another layer or a deleted one
+	StateMissing TargetState = "missing-link" // Nothing exists at the target
+	StateForeign TargetState = "foreign"      // A regular file, a directory or a link out of the repository is at the target
+)
+
+// TargetReport is the state of one target of the active layers
+type TargetReport struct {
+	Target   string      `json:"target"`
+	RepoPath string      `json:"repo_path"` // Slash-separated path of the repo file relative to the dotpilot repository
+	Layer    string      `json:"layer"`     // "common", "envs/<env>" or "machine/<hostname>"
+	State    TargetState `json:"state"`
+	Expected string      `json:"expected"`         // What the link should hold
+	Actual   string      `json:"actual,omitempty"` // Where an existing link points
+}
+
+// ApplyReport is the state of every target an apply would link
+type ApplyReport struct {
+	Environment string              `json:"environment"`
+	TargetRoot  string              `json:"target_root"`
+	Drifted     bool                `json:"drifted"` // Whether any target isn't in sync
+	Counts      map[TargetState]int `json:"counts"`
+	Targets     []TargetReport      `json:"targets"`
+}
+
+// ReportApply returns the state of every target applying the layers of
+// environment with opts links, sorted by target. Only Target, Exclude,
+// Relative and User of opts are used, and nothing is changed.
+func ReportApply(dotpilotDir, environment string, opts ApplyOptions) (*ApplyReport, error) {
+	configDirs, err := activeLayers(dotpilotDir, environment)
+	if err != nil {
+		return nil, err
+	}
+	if opts.User != "" {
+		if _, opts.Target, err = UserTarget(opts.User, opts.Target); err != nil {
+			return nil, err
+		}
+		configDirs = append(configDirs, UserLayerDir(dotpilotDir, opts.User))
+	}
+
+	// Like TargetRoot, without creating the directory
+	root, err := Home()
+	if opts.Target != "" {
+		root, err = filepath.Abs(opts.Target)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Exclude, err = ExcludePatterns(dotpilotDir, opts.Exclude); err != nil {
+		return nil, err
+	}
+	planOpts := ApplyOptions{Exclude: opts.Exclude, Relative: opts.Relative || RelativeSymlinks()}
+
+	plan := &applyPlan{links: make(map[string]plannedLink)}
+	for _, configDir := range configDirs {
+		if err := applyConfigDir(dotpilotDir, configDir, root, planOpts, plan); err != nil {
+			return nil, err
+		}
+	}
+	steps, _, blocked, err := planApplySteps(dotpilotDir, plan, planOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	// The targets apply would change, and what it would link them to
+	changes := make(map[string]string)
+	for _, step := range steps {
+		if step.Op == "link" {
+			changes[step.Target] = step.Source
+		}
+	}
+	for _, target := range blocked {
+		changes[target] = symlinkContent(target, plan.links[target].linkSource, planOpts.Relative)
+	}
+
+	report := &ApplyReport{Environment: environment, TargetRoot: root, Counts: make(map[TargetState]int), Targets: []TargetReport{}}
+	for _, target := range plan.targets {
+		link := plan.links[target]
+		entry := TargetReport{Target: target, State: StateInSync, Expected: link.linkSource}
+		if repoPath, err := RepoPath(dotpilotDir, link.repoFile); err == nil {
+			entry.RepoPath = repoPath
+			entry.Layer = layerOf(repoPath)
+		}
+		if expected, ok := changes[target]; ok {
+			entry.Expected = expected
+			entry.State, entry.Actual = targetState(dotpilotDir, target)
+		}
+
+		report.Counts[entry.State]++
+		report.Drifted = report.Drifted || entry.State != StateInSync
+		report.Targets = append(report.Targets, entry)
+	}
+	sort.Slice(report.Targets, func(i, j int) bool {
+		return report.Targets[i].Target < report.Targets[j].Target
+	})
+	return report, nil
+}
+
+// targetState tells what is at a target apply would change, and where it
+// links to if it is a link
+func targetState(dotpilotDir, target string) (TargetState, string) {
+	info, err := os.Lstat(target)
+	if err != nil {
+		return StateMissing, ""
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return StateForeign, ""
+	}
+
+	actual, err := readLinkTarget(target)
+	if err != nil {
+		return StateForeign, ""
+	}
+	if insideDir(actual, filepath.Clean(dotpilotDir)) {
+		return StateDrifted, actual
+	}
+	return StateForeign, actual
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReportApply(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	for _, name := range []string{"common/.synced", "common/.shadowed", "envs/work/.shadowed", "common/.missing", "common/.replaced", "common/.elsewhere"} {
+		writeRepoFile(t, dotpilotDir, name, "repo\n")
+	}
+
+	// .shadowed still links to the common file the work environment overrides
+	for name, source := range map[string]string{
+		".synced":    filepath.Join(dotpilotDir, "common", ".synced"),
+		".shadowed":  filepath.Join(dotpilotDir, "common", ".shadowed"),
+		".elsewhere": filepath.Join(home, "other"),
+	} {
+		if err := os.Symlink(source, filepath.Join(home, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeRepoFile(t, home, ".replaced", "local\n")
+
+	report, err := ReportApply(dotpilotDir, "work", ApplyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]TargetState{
+		".synced":    StateInSync,
+		".shadowed":  StateDrifted,
+		".missing":   StateMissing,
+		".replaced":  StateForeign,
+		".elsewhere": StateForeign,
+	}
+	if len(report.Targets) != len(want) || !report.Drifted || report.Counts[StateForeign] != 2 {
+		t.Fatalf("report %+v", report)
+	}
+	for _, target := range report.Targets {
+		name := filepath.Base(target.Target)
+		if target.State != want[name] {
+			t.Errorf("%s is %s, want %s", name, target.State, want[name])
+		}
+	}
+	shadowed := report.Targets[3]
+	if shadowed.Layer != "envs/work" || shadowed.Expected != filepath.Join(dotpilotDir, "envs", "work", ".shadowed") || shadowed.Actual != filepath.Join(dotpilotDir, "common", ".shadowed") {
+		t.Errorf("drifted target %+v", shadowed)
+	}
+
+	// Nothing was changed
+	if _, err := os.Lstat(filepath.Join(home, ".missing")); !os.IsNotExist(err) {
+		t.Errorf("the report linked .missing: %v", err)
+	}
+
+	// Once applied, everything is in sync
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "work", ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := ReportApply(dotpilotDir, "work", ApplyOptions{}); err != nil || report.Drifted || report.Counts[StateInSync] != len(want) {
+		t.Errorf("after applying: %+v, %v", report, err)
+	}
+}
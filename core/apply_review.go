@@ -0,0 +1,110 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// Interactive apply
+//
+// With ApplyOptions.Interactive, or DirectoryApplyOptions.Interactive for
+// bootstrap, every change is shown before it is made: linking a missing
+// target, relinking a link into another layer and replacing a file, which is
+// backed up. Each change can be applied or skipped, or its diff shown first,
+// and quitting stops with ErrApplyQuit. Apply asks all its questions before
+// changing anything, so nothing is left behind; bootstrap keeps the layers it
+// linked before. --yes applies every change without asking.
+
+// applyReviewer asks about each change of an interactive apply
+type applyReviewer struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// newApplyReviewer returns a reviewer reading answers from in, or from stdin
+// if in is nil
+func newApplyReviewer(in io.Reader) *applyReviewer {
+	if in == nil {
+		in = os.Stdin
+	}
+	return &applyReviewer{in: bufio.NewReader(in), out: os.Stdout}
+}
+
+// review describes linking target to linkSource, the link content for the
+// layer file repoFile, or hardlinking or copying repoFile in those modes, and
+// asks whether to do it. backup tells whether an existing target is kept as a
+// backup. It returns an error wrapping ErrApplyQuit if the user quits or
+// there are no more answers.
+func (r *applyReviewer) review(target, repoFile, linkSource string, mode LinkMode, backup bool) (bool, error) {
+	if utils.IsAssumeYes() {
+		return true, nil
+	}
+
+	fmt.Fprintf(r.out, "\n%s\n", describeApplyChange(target, linkSource, mode, backup))
+	for {
+		fmt.Fprint(r.out, "[a]pply, [s]kip, show [d]iff, [q]uit? ")
+		response, err := r.in.ReadString('\n')
+		if err != nil && response == "" {
+			return false, fmt.Errorf("%w: no answer for %s: %v", ErrApplyQuit, target, err)
+		}
+
+		switch strings.TrimSpace(response) {
+		case "a":
+			return true, nil
+		case "s":
+			utils.Logger.Info().Msgf("Skipping %s", target)
+			return false, nil
+		case "d":
+			fmt.Fprint(r.out, applyChangeDiff(target, repoFile))
+		case "q":
+			return false, fmt.Errorf("%w at %s", ErrApplyQuit, target)
+		default:
+			fmt.Fprintln(r.out, "Please answer a, s, d or q")
+		}
+	}
+}
+
+// describeApplyChange says what linking target to linkSource in mode does
+func describeApplyChange(target, linkSource string, mode LinkMode, backup bool) string {
+	info, err := os.Lstat(target)
+	if mode == LinkHardlink || mode == LinkCopy {
+		switch {
+		case err != nil:
+			return fmt.Sprintf("Make %s a %s of %s", target, mode, linkSource)
+		case backup:
+			return fmt.Sprintf("Replace %s with a %s of %s, keeping a backup", target, mode, linkSource)
+		}
+		return fmt.Sprintf("Replace %s with a %s of %s", target, mode, linkSource)
+	}
+	switch {
+	case err != nil:
+		return fmt.Sprintf("Link %s -> %s", target, linkSource)
+	case info.Mode()&os.ModeSymlink != 0:
+		current, _ := os.Readlink(target)
+		return fmt.Sprintf("Relink %s from %s to %s", target, current, linkSource)
+	case backup:
+		return fmt.Sprintf("Replace %s with a link to %s, keeping a backup", target, linkSource)
+	}
+	return fmt.Sprintf("Replace %s with a link to %s", target, linkSource)
+}
+
+// applyChangeDiff returns the diff from what target holds now, nothing if it
+// doesn't exist, to the layer file repoFile
+func applyChangeDiff(target, repoFile string) string {
+	from, _ := ioutil.ReadFile(target)
+	to, err := ioutil.ReadFile(repoFile)
+	if err != nil {
+		return fmt.Sprintf("Failed to read %s: %v\n", repoFile, err)
+	}
+	diff := UnifiedDiff(target, repoFile, comparableContent(from), comparableContent(to))
+	if diff == "" {
+		return "The content is the same\n"
+	}
+	return diff
+}
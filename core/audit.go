@@ -0,0 +1,164 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Severity of an audit finding
+const (
+	SeverityHigh   = "high"   // Private keys and cloud credentials
+	SeverityMedium = "medium" // Passwords assigned in configuration
+	SeverityLow    = "low"    // Random-looking tokens, which may be false positives
+)
+
+// passwordPattern matches a password assigned a literal value, but not one
+// read from a variable, a command or a template
+var passwordPattern = regexp.MustCompile(`(?i)(?:password|passwd|pwd)\s*[:=]\s*["']?([^\s"'$` + "`" + `{<#]{4,})`)
+
+// AuditFinding is a line of a tracked file that looks like a plaintext secret
+type AuditFinding struct {
+	Dotfile  TrackedDotfile `json:"-"`
+	Path     string         `json:"path"` // Slash-separated path relative to the dotpilot repository
+	Line     int            `json:"line"`
+	Severity string         `json:"severity"`
+	Reason   string         `json:"reason"`
+}
+
+// AuditRepository scans the committed dotfiles for plaintext secrets, line by
+// line with LooksSensitive and for password assignments. Secrets, which are
+// stored encrypted, and binary files are not scanned, and values encrypted
+// with SOPS are fine.
+func AuditRepository(dotpilotDir string) ([]AuditFinding, error) {
+	dotfiles, err := GetTrackedDotfiles(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []AuditFinding
+	for _, dotfile := range dotfiles {
+		path := filepath.Join(dotpilotDir, filepath.FromSlash(dotfile.RepoPath))
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, finding := range AuditContent(data) {
+			finding.Dotfile = dotfile
+			finding.Path = dotfile.RepoPath
+			findings = append(findings, finding)
+		}
+	}
+	return findings, nil
+}
+
+// AuditContent returns the lines of data that look like plaintext secrets,
+// with Path left empty
+func AuditContent(data []byte) []AuditFinding {
+	if bytes.IndexByte(data, 0) >= 0 {
+		return nil
+	}
+
+	var findings []AuditFinding
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), sensitiveScanLimit)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if sopsValuePattern.Match(line) {
+			continue
+		}
+		if sensitive, reason := LooksSensitive(line); sensitive {
+			findings = append(findings, AuditFinding{Line: n, Severity: lineSeverity(line), Reason: reason})
+			continue
+		}
+		if passwordPattern.Match(line) {
+			findings = append(findings, AuditFinding{Line: n, Severity: SeverityMedium, Reason: "assigns a password"})
+		}
+	}
+	return findings
+}
+
+// lineSeverity rates a line LooksSensitive flagged
+func lineSeverity(line []byte) string {
+	if privateKeyPattern.Match(line) || awsAccessKeyPattern.Match(line) || awsSecretKeyPattern.Match(line) {
+		return SeverityHigh
+	}
+	return SeverityLow
+}
+
+// SecretNameFor derives a secret name from the target of a dotfile:
+// .aws/credentials becomes aws_credentials
+func SecretNameFor(dotfile TrackedDotfile) string {
+	var parts []string
+	for _, part := range strings.Split(dotfile.Target, "/") {
+		if part = strings.TrimLeft(part, "."); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "_")
+}
+
+// MoveToSecrets replaces a committed dotfile with an encrypted secret named
+// SecretNameFor it, in the environment of its layer and with its target as the
+// destination. The repo file is removed and staged; a target in the home
+// directory that links to it is replaced with a regular copy so the machine
+// keeps working. The plaintext stays in the history of the repository.
+func MoveToSecrets(dotpilotDir, home string, dotfile TrackedDotfile) (string, error) {
+	name := SecretNameFor(dotfile)
+	environment := ""
+	if strings.HasPrefix(dotfile.Layer, "envs/") {
+		environment = strings.TrimPrefix(dotfile.Layer, "envs/")
+	}
+
+	sm := NewSecretManager(dotpilotDir).ForEnvironment(environment)
+	if err := sm.Initialize(); err != nil {
+		return "", err
+	}
+	if err := sm.CanAdd(name, false); err != nil {
+		return "", err
+	}
+
+	repoPath := filepath.Join(dotpilotDir, filepath.FromSlash(dotfile.RepoPath))
+	target := dotfile.TargetPath(home)
+	linked := resolvesTo(target, repoPath)
+	if info, err := os.Lstat(target); linked && err == nil && info.Mode()&os.ModeSymlink == 0 {
+		// Writing the copy would write into the repository again
+		return "", fmt.Errorf("%s is linked through a parent directory, move it out of the repository by hand", target)
+	}
+
+	data, err := ioutil.ReadFile(repoPath)
+	if err != nil {
+		return "", err
+	}
+	if err := sm.encrypt(data, SecretMetadata{Name: name, Source: portablePath(target), Destination: portablePath(target)}); err != nil {
+		return "", err
+	}
+
+	if linked {
+		if err := os.Remove(target); err != nil {
+			return "", fmt.Errorf("failed to unlink %s: %w", target, err)
+		}
+		if err := writeSecretFile(target, data); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Remove(repoPath); err != nil {
+		return "", err
+	}
+	return name, StageChanges(dotpilotDir)
+}
@@ -0,0 +1,100 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/dotpilot/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// Credentials for the remote repository
+//
+// go-git does not read git's credential helpers or ~/.ssh/config, so dotpilot
+// picks the credentials itself:
+//   - SSH remotes use the ssh-agent when SSH_AUTH_SOCK is set, otherwise the
+//     first unencrypted default key in ~/.ssh.
+//   - HTTP(S) remotes use DOTPILOT_GIT_TOKEN as password, with
+//     DOTPILOT_GIT_USER (default "git") as user name.
+//
+// When nothing applies the remote is accessed without credentials.
+
+// defaultSSHKeys are tried in order when no ssh-agent is running
+var defaultSSHKeys = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// remoteAuth returns the credentials for the origin remote of repo, or nil
+func remoteAuth(repo *git.Repository) (transport.AuthMethod, error) {
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return nil, err
+	}
+
+	urls := remote.Config().URLs
+	if len(urls) == 0 {
+		return nil, nil
+	}
+	return authForURL(urls[0])
+}
+
+// authForURL returns the credentials for a remote URL, or nil
+func authForURL(url string) (transport.AuthMethod, error) {
+	endpoint, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, err
+	}
+
+	switch endpoint.Protocol {
+	case "ssh":
+		user := endpoint.User
+		if user == "" {
+			user = "git"
+		}
+		return sshAuth(user), nil
+	case "http", "https":
+		token := os.Getenv("DOTPILOT_GIT_TOKEN")
+		if token == "" {
+			return nil, nil
+		}
+		user := os.Getenv("DOTPILOT_GIT_USER")
+		if user == "" {
+			user = "git"
+		}
+		return &http.BasicAuth{Username: user, Password: token}, nil
+	}
+
+	return nil, nil
+}
+
+// sshAuth returns the ssh-agent or a default key file for user, or nil to let
+// go-git try its own defaults
+func sshAuth(user string) transport.AuthMethod {
+	if os.Getenv("SSH_AUTH_SOCK") != "" {
+		auth, err := ssh.NewSSHAgentAuth(user)
+		if err == nil {
+			return auth
+		}
+		utils.Logger.Debug().Err(err).Msg("Failed to use the ssh-agent")
+	}
+
+	home, err := Home()
+	if err != nil {
+		return nil
+	}
+	for _, name := range defaultSSHKeys {
+		keyFile := filepath.Join(home, ".ssh", name)
+		if _, err := os.Stat(keyFile); err != nil {
+			continue
+		}
+		auth, err := ssh.NewPublicKeysFromFile(user, keyFile, "")
+		if err != nil {
+			utils.Logger.Debug().Err(err).Msgf("Skipping SSH key %s", keyFile)
+			continue
+		}
+		return auth
+	}
+
+	return nil
+}
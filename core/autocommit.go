@@ -0,0 +1,63 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/dotpilot/utils"
+)
+
+// Auto-commit
+//
+// Commands that change the repository, like track or secrets add, commit the
+// change right away. Options["auto_commit"] in ~/.dotpilotrc changes that:
+// "always" is the default, "never" only stages changes for a later
+// 'dotpilot commit', and "prompt" shows what changed and asks before
+// committing, staging only when the answer is no. --yes answers that question
+// with yes, --non-interactive with no. The commit init makes while setting up
+// the repository and 'dotpilot commit' itself always commit.
+
+// Values of Options["auto_commit"]
+const (
+	AutoCommitAlways = "always"
+	AutoCommitNever  = "never"
+	AutoCommitPrompt = "prompt"
+)
+
+// AutoCommit returns the configured auto-commit behavior, AutoCommitAlways
+// unless Options["auto_commit"] sets another
+func AutoCommit() string {
+	value, _ := GetConfig().Options["auto_commit"].(string)
+	switch value {
+	case AutoCommitAlways, AutoCommitNever, AutoCommitPrompt:
+		return value
+	case "":
+		return AutoCommitAlways
+	}
+	utils.Logger.Warn().Msgf("Ignoring the auto_commit option %q, expected always, never or prompt", value)
+	return AutoCommitAlways
+}
+
+// MaybeCommit commits the changes in the repository with message, formatted
+// by the commit template in use, or only stages them, as AutoCommit asks. It
+// reports whether it committed.
+func MaybeCommit(dotpilotDir, message string) (bool, error) {
+	switch AutoCommit() {
+	case AutoCommitNever:
+		return false, StageChanges(dotpilotDir)
+	case AutoCommitPrompt:
+		status, err := GetGitStatus(dotpilotDir)
+		if err != nil {
+			return false, err
+		}
+		if status == "" {
+			return false, nil
+		}
+		fmt.Printf("Changes in the dotpilot repository:\n%s", status)
+		message = commitMessage(dotpilotDir, message)
+		if !utils.PromptYesNo(fmt.Sprintf("Commit them as %q?", message)) {
+			return false, StageChanges(dotpilotDir)
+		}
+		return true, commitChanges(dotpilotDir, message)
+	}
+	return true, CommitChanges(dotpilotDir, message)
+}
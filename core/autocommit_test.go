@@ -0,0 +1,65 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/dotpilot/utils"
+	"github.com/go-git/go-git/v5"
+)
+
+func TestMaybeCommit(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "zsh\n")
+	if err := CommitChanges(dotpilotDir, "initial"); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+	defer utils.SetNonInteractive(false)
+	defer utils.SetAssumeYes(false)
+
+	tests := []struct {
+		option         string
+		nonInteractive bool
+		yes            bool
+		want           bool
+	}{
+		{option: "", want: true},
+		{option: "always", want: true},
+		{option: "never", want: false},
+		{option: "prompt", nonInteractive: true, want: false},
+		{option: "prompt", yes: true, want: true},
+	}
+	for i, tt := range tests {
+		currentConfig.Options = map[string]interface{}{"auto_commit": tt.option}
+		utils.SetNonInteractive(tt.nonInteractive)
+		utils.SetAssumeYes(tt.yes)
+
+		writeRepoFile(t, dotpilotDir, "common/.zshrc", "zsh "+string(rune('a'+i))+"\n")
+		committed, err := MaybeCommit(dotpilotDir, "Update zshrc")
+		if err != nil {
+			t.Fatalf("auto_commit %q: %v", tt.option, err)
+		}
+		changed, err := HasUncommittedChanges(dotpilotDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if committed != tt.want || changed == tt.want {
+			t.Errorf("auto_commit %q (non-interactive %v, yes %v): committed %v with changes left %v, want committed %v",
+				tt.option, tt.nonInteractive, tt.yes, committed, changed, tt.want)
+		}
+		if !tt.want {
+			// Left staged for 'dotpilot commit'
+			if staged, err := GetStagedFiles(dotpilotDir); err != nil || len(staged) != 1 {
+				t.Errorf("auto_commit %q: staged %v, %v", tt.option, staged, err)
+			}
+			if err := CommitChanges(dotpilotDir, "manual"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
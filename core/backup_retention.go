@@ -0,0 +1,176 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dotpilot/utils"
+)
+
+// Backup retention
+//
+// Apply, track and the other commands that replace a file keep it as a
+// .dotpilot.bak backup next to it, and without a limit these pile up over
+// months of use. Options["backup_retention"] in ~/.dotpilotrc sets one:
+// {"keep": 5} keeps the 5 most recent backups of each file and
+// {"max_age_days": 30} removes those made more than 30 days ago; both can be
+// combined. A bare number is a keep count. Every time a file is backed up,
+// the older backups of that same file beyond the limit are removed and
+// logged. --no-prune keeps them all for one run, see SetBackupPruning.
+
+// BackupRetention limits the backups kept of each file
+type BackupRetention struct {
+	Keep   int           // Most recent backups kept, any number if 0
+	MaxAge time.Duration // Backups older than this are removed, if not 0
+}
+
+// Enabled reports whether the retention removes any backups
+func (r BackupRetention) Enabled() bool {
+	return r.Keep > 0 || r.MaxAge > 0
+}
+
+// backupPruningDisabled is set by SetBackupPruning for --no-prune
+var backupPruningDisabled bool
+
+// SetBackupPruning turns pruning old backups after a backup on or off for the
+// rest of the run, whatever Options["backup_retention"] says
+func SetBackupPruning(enabled bool) {
+	backupPruningDisabled = !enabled
+}
+
+// ConfiguredBackupRetention returns the retention Options["backup_retention"]
+// in ~/.dotpilotrc sets, which keeps every backup if the option isn't set
+func ConfiguredBackupRetention() (BackupRetention, error) {
+	var retention BackupRetention
+	value, ok := GetConfig().Options["backup_retention"]
+	if !ok || value == nil {
+		return retention, nil
+	}
+
+	const expected = `expected a number of backups to keep or an object like {"keep": 5, "max_age_days": 30}`
+	switch v := value.(type) {
+	case float64, int:
+		keep, err := retentionCount("keep", v)
+		if err != nil {
+			return retention, err
+		}
+		retention.Keep = keep
+	case map[string]interface{}:
+		for name, value := range v {
+			count, err := retentionCount(name, value)
+			if err != nil {
+				return retention, err
+			}
+			switch name {
+			case "keep":
+				retention.Keep = count
+			case "max_age_days":
+				retention.MaxAge = time.Duration(count) * 24 * time.Hour
+			default:
+				return retention, fmt.Errorf("invalid backup_retention option: unknown setting %s, %s", name, expected)
+			}
+		}
+	default:
+		return retention, fmt.Errorf("invalid backup_retention option: %s", expected)
+	}
+	return retention, nil
+}
+
+// retentionCount returns the setting name of the backup_retention option as
+// a whole number that isn't negative
+func retentionCount(name string, value interface{}) (int, error) {
+	var n float64
+	switch v := value.(type) {
+	case float64:
+		n = v
+	case int:
+		n = float64(v)
+	default:
+		return 0, fmt.Errorf("invalid backup_retention option: %s must be a number", name)
+	}
+	if n < 0 || n != float64(int(n)) {
+		return 0, fmt.Errorf("invalid backup_retention option: %s must be a whole number, not %v", name, n)
+	}
+	return int(n), nil
+}
+
+// PruneBackups removes the backups of original that retention doesn't keep
+// and returns them. The most recent backups are kept first.
+func PruneBackups(original string, retention BackupRetention) ([]string, error) {
+	if !retention.Enabled() {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(original))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	prefix := filepath.Base(original) + backupMarker
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		path := filepath.Join(filepath.Dir(original), entry.Name())
+		if backedUp, _, ok := parseBackupName(path); ok && backedUp == filepath.Clean(original) {
+			backups = append(backups, path)
+		}
+	}
+	sortBackups(backups)
+
+	var pruned []string
+	for i, backup := range backups {
+		newer := len(backups) - 1 - i
+		if !(retention.Keep > 0 && newer >= retention.Keep) && !backupExpired(backup, retention.MaxAge) {
+			continue
+		}
+		if err := os.RemoveAll(backup); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, backup)
+	}
+	return pruned, nil
+}
+
+// backupExpired reports whether backup was made more than maxAge ago, which
+// is never if maxAge is 0
+func backupExpired(backup string, maxAge time.Duration) bool {
+	if maxAge <= 0 {
+		return false
+	}
+	_, made, _ := parseBackupName(backup)
+	stamp, _, _ := strings.Cut(made, ".")
+	t, err := time.ParseInLocation("20060102150405", stamp, time.Local)
+	return err == nil && time.Since(t) > maxAge
+}
+
+// pruneBackupsOf applies the configured retention to the backups of each of
+// originals after they were backed up, unless SetBackupPruning turned it off.
+// Pruning is housekeeping, so failures are logged instead of failing the
+// operation that made the backup.
+func pruneBackupsOf(originals ...string) {
+	if backupPruningDisabled || len(originals) == 0 {
+		return
+	}
+	retention, err := ConfiguredBackupRetention()
+	if err != nil {
+		utils.Logger.Warn().Err(err).Msg("Not pruning old backups")
+		return
+	}
+
+	for _, original := range originals {
+		pruned, err := PruneBackups(original, retention)
+		for _, backup := range pruned {
+			utils.Logger.Info().Msgf("Pruned the old backup %s", backup)
+		}
+		if err != nil {
+			utils.Logger.Warn().Err(err).Msgf("Failed to prune the old backups of %s", original)
+		}
+	}
+}
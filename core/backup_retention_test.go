@@ -0,0 +1,147 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestConfiguredBackupRetention(t *testing.T) {
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+
+	for option, want := range map[string]BackupRetention{
+		`null`:                            {},
+		`3`:                               {Keep: 3},
+		`{"keep": 2}`:                     {Keep: 2},
+		`{"max_age_days": 7}`:             {MaxAge: 7 * 24 * time.Hour},
+		`{"keep": 1, "max_age_days": 30}`: {Keep: 1, MaxAge: 30 * 24 * time.Hour},
+	} {
+		var value interface{}
+		if err := json.Unmarshal([]byte(option), &value); err != nil {
+			t.Fatal(err)
+		}
+		currentConfig.Options = map[string]interface{}{"backup_retention": value}
+		got, err := ConfiguredBackupRetention()
+		if err != nil || got != want {
+			t.Errorf("backup_retention %s: got %+v, %v, want %+v", option, got, err, want)
+		}
+	}
+
+	for _, option := range []string{`"5"`, `-1`, `1.5`, `{"keep": "all"}`, `{"days": 3}`} {
+		var value interface{}
+		if err := json.Unmarshal([]byte(option), &value); err != nil {
+			t.Fatal(err)
+		}
+		currentConfig.Options = map[string]interface{}{"backup_retention": value}
+		if _, err := ConfiguredBackupRetention(); err == nil {
+			t.Errorf("backup_retention %s was accepted", option)
+		}
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	dir := t.TempDir()
+	original := filepath.Join(dir, ".bashrc")
+	recent := time.Now().Add(-time.Hour).Format("20060102150405")
+	names := []string{
+		".bashrc.dotpilot.bak.20200101120000",
+		".bashrc.dotpilot.bak.20200101120000.2",
+		".bashrc.dotpilot.bak." + recent,
+		".bashrc.dotpilot.bak." + recent + ".2",
+		".bashrc.old.dotpilot.bak.20200101120000",
+		".zshrc.dotpilot.bak.20200101120000",
+	}
+	create := func() {
+		for _, name := range names {
+			if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	left := func() []string {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	create()
+	pruned, err := PruneBackups(original, BackupRetention{Keep: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(dir, names[0])}; !reflect.DeepEqual(pruned, want) {
+		t.Errorf("keep 3 pruned %q, want %q", pruned, want)
+	}
+
+	pruned, err = PruneBackups(original, BackupRetention{MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(dir, names[1])}; !reflect.DeepEqual(pruned, want) {
+		t.Errorf("max age pruned %q, want %q", pruned, want)
+	}
+
+	pruned, err = PruneBackups(original, BackupRetention{Keep: 1, MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(dir, names[2])}; !reflect.DeepEqual(pruned, want) {
+		t.Errorf("keep 1 pruned %q, want %q", pruned, want)
+	}
+
+	// The backups of other files are left alone
+	want := []string{names[3], names[4], names[5]}
+	if got := left(); !reflect.DeepEqual(got, want) {
+		t.Errorf("left %q, want %q", got, want)
+	}
+
+	// Without a retention nothing is pruned
+	if pruned, err := PruneBackups(original, BackupRetention{}); err != nil || pruned != nil {
+		t.Errorf("no retention pruned %q, %v", pruned, err)
+	}
+}
+
+func TestBackupFilePrunes(t *testing.T) {
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+	currentConfig.Options = map[string]interface{}{"backup_retention": 1}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, ".vimrc")
+	old := path + ".dotpilot.bak.20200101120000"
+	for _, p := range []string{path, old} {
+		if err := os.WriteFile(p, []byte("set nu\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	SetBackupPruning(false)
+	if _, err := BackupFile(path); err != nil {
+		t.Fatal(err)
+	}
+	SetBackupPruning(true)
+	if _, err := os.Stat(old); err != nil {
+		t.Errorf("pruned with pruning off: %v", err)
+	}
+
+	backup, err := BackupFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, _ := filepath.Glob(path + backupMarker + "*")
+	if !reflect.DeepEqual(matches, []string{backup}) {
+		t.Errorf("backups left %q, want only %s", matches, backup)
+	}
+}
@@ -2,29 +2,97 @@ package core
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 
 	"github.com/dotpilot/utils"
 )
 
+// DirectoryApplyOptions controls how ApplyDirectoryConfigsWithOptions links
+// a layer directory
+type DirectoryApplyOptions struct {
+	ForceOverwrite bool // Replace existing destinations without asking
+	OnlyNew        bool // Skip destinations that already exist instead of replacing them
+	// Exclude are glob patterns of destinations to leave out, matched against
+	// the path relative to the destination directory, see ExcludePatterns
+	Exclude []string
+	// Relative creates links relative to the directory of their
+	// destination, also set by Options["relative_symlinks"]
+	Relative bool
+	// Interactive asks about each change before making it, see
+	// applyReviewer
+	Interactive bool
+
+	// input is where interactive answers are read from, stdin if nil
+	input io.Reader
+	// reviewer asks about the changes of an interactive apply
+	reviewer *applyReviewer
+	// home is set when linking into the home directory, to honor relocated
+	// XDG base directories
+	home string
+	// linkModes are the recorded link modes of the dotpilot repository at
+	// repoDir, see LoadLinkModes
+	linkModes map[string]LinkMode
+	repoDir   string
+}
+
 // ApplyDirectoryConfigs applies all configurations from the given directory
-// to the destination directory (typically home directory)
-func ApplyDirectoryConfigs(sourceDir, destDir string, forceOverwrite bool) error {
+// to the destination directory (typically home directory). With onlyNew set,
+// destinations that already exist are skipped instead of replaced. It returns
+// the destinations that were (re)linked.
+func ApplyDirectoryConfigs(sourceDir, destDir string, forceOverwrite, onlyNew bool) ([]string, error) {
+	linked, _, err := ApplyDirectoryConfigsWithOptions(sourceDir, destDir, DirectoryApplyOptions{
+		ForceOverwrite: forceOverwrite,
+		OnlyNew:        onlyNew,
+	})
+	return linked, err
+}
+
+// ApplyDirectoryConfigsWithOptions is ApplyDirectoryConfigs with options. It
+// returns the destinations that were (re)linked and the slash-separated
+// relative paths that were excluded. The files of sourceDir with a mode
+// recorded in file-modes.json are given that mode first, and those with a
+// link mode in link-modes.json are hardlinked or copied, see MaterializeFile.
+func ApplyDirectoryConfigsWithOptions(sourceDir, destDir string, opts DirectoryApplyOptions) ([]string, []string, error) {
+	opts.Relative = opts.Relative || RelativeSymlinks()
+	if home, err := Home(); err == nil && filepath.Clean(destDir) == home {
+		opts.home = home
+	}
+	if opts.Interactive && opts.reviewer == nil {
+		opts.reviewer = newApplyReviewer(opts.input)
+	}
+	if repoDir, err := dotpilotRepoDir(); err == nil {
+		if err := EnforceFileModes(repoDir, []string{sourceDir}); err != nil {
+			return nil, nil, err
+		}
+		if opts.linkModes, err = LoadLinkModes(repoDir); err != nil {
+			return nil, nil, err
+		}
+		opts.repoDir = repoDir
+	}
+	return applyDirectoryConfigs(sourceDir, destDir, "", opts)
+}
+
+// applyDirectoryConfigs links sourceDir into destDir, relDir is the
+// slash-separated path of destDir below the destination directory the apply
+// started in
+func applyDirectoryConfigs(sourceDir, destDir, relDir string, opts DirectoryApplyOptions) ([]string, []string, error) {
 	// Check if the source directory exists
 	if _, err := os.Stat(sourceDir); os.IsNotExist(err) {
-		return fmt.Errorf("source directory does not exist: %s", sourceDir)
+		return nil, nil, fmt.Errorf("source directory does not exist: %s", sourceDir)
 	}
 
 	// List all files and directories in the source directory
 	entries, err := ioutil.ReadDir(sourceDir)
 	if err != nil {
-		return fmt.Errorf("failed to read directory: %s: %w", sourceDir, err)
+		return nil, nil, fmt.Errorf("failed to read directory: %s: %w", sourceDir, err)
 	}
 
 	// Process each entry
+	var linked, excluded []string
 	for _, entry := range entries {
 		sourcePath := filepath.Join(sourceDir, entry.Name())
 		
@@ -33,36 +101,204 @@ func ApplyDirectoryConfigs(sourceDir, destDir string, forceOverwrite bool) error
 			continue
 		}
 
+		// Skip paths outside the sparse include list and machine fingerprints
+		if repoDir, err := dotpilotRepoDir(); err == nil {
+			if isSparseExcluded(repoDir, sourcePath, entry.IsDir()) {
+				utils.Logger.Debug().Msgf("Skipping %s (outside sparse paths)", sourcePath)
+				continue
+			}
+			if repoPath, err := RepoPath(repoDir, sourcePath); err == nil && isMachineFingerprint(repoPath) {
+				continue
+			}
+		}
+
+		// Skip destinations matching an exclude pattern
+		relPath := path.Join(relDir, entry.Name())
+		if pattern := excludedBy(opts.Exclude, relPath, entry.IsDir()); pattern != "" {
+			utils.Logger.Debug().Msgf("Excluding %s (matches %s)", relPath, pattern)
+			excluded = append(excluded, relPath)
+			continue
+		}
+
 		// Determine destination path
 		destPath := filepath.Join(destDir, entry.Name())
+		if opts.home != "" {
+			destPath = expandXDG(opts.home, relPath)
+		}
 
 		if entry.IsDir() {
 			// For directories, recursively apply configurations
 			if err := os.MkdirAll(destPath, 0755); err != nil {
-				return fmt.Errorf("failed to create directory: %s: %w", destPath, err)
+				return nil, nil, fmt.Errorf("failed to create directory: %s: %w", destPath, err)
 			}
 
-			if err := ApplyDirectoryConfigs(sourcePath, destPath, forceOverwrite); err != nil {
-				return err
+			dirLinked, dirExcluded, err := applyDirectoryConfigs(sourcePath, destPath, relPath, opts)
+			if err != nil {
+				return nil, nil, err
 			}
+			linked = append(linked, dirLinked...)
+			excluded = append(excluded, dirExcluded...)
 		} else {
+			// Hardlinks and copies are made in their own way
+			if mode := opts.linkModeOf(sourcePath); mode != LinkSymlink {
+				changed, err := applyLinkMode(sourcePath, destPath, mode, opts)
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to %s %s: %w", mode, entry.Name(), err)
+				}
+				if changed {
+					linked = append(linked, destPath)
+				}
+				continue
+			}
+
+			// Nothing to do if the destination already links here
+			if linksTo(destPath, sourcePath) {
+				utils.Logger.Debug().Msgf("Symlink already exists: %s -> %s", destPath, sourcePath)
+				continue
+			}
+
+
+			// Leave anything that already exists alone in additive mode
+			if opts.OnlyNew {
+				if _, err := os.Lstat(destPath); err == nil {
+					utils.Logger.Info().Msgf("Skipping %s (already exists)", destPath)
+					continue
+				}
+			}
+
+			// A link into an earlier layer is dotpilot's own, later layers
+			// replace it without asking, like apply does
+			own := false
+			if link, err := readLinkTarget(destPath); err == nil {
+				if repoDir, err := dotpilotRepoDir(); err == nil && insideDir(link, repoDir) {
+					own = true
+				}
+			}
+
+			linkContent := symlinkContent(destPath, sourcePath, opts.Relative)
+			reviewed := false
+			if opts.reviewer != nil {
+				ok, err := opts.reviewer.review(destPath, sourcePath, linkContent, LinkSymlink, !own)
+				if err != nil {
+					return nil, nil, err
+				}
+				if !ok {
+					continue
+				}
+				reviewed = true
+			}
+
+			if own {
+				utils.Logger.Debug().Msgf("Replacing %s", destPath)
+				if err := os.Remove(destPath); err != nil {
+					return nil, nil, err
+				}
+			}
+
 			// For files, create symlinks
-			if err := CreateSymlink(sourcePath, destPath, forceOverwrite); err != nil {
-				return fmt.Errorf("failed to create symlink for %s: %w", entry.Name(), err)
+			if err := CreateSymlink(linkContent, destPath, opts.ForceOverwrite || reviewed); err != nil {
+				return nil, nil, fmt.Errorf("failed to create symlink for %s: %w", entry.Name(), err)
+			}
+
+			// CreateSymlink leaves the destination alone if the user declines
+			if linksTo(destPath, sourcePath) {
+				utils.Logger.Debug().Msgf("Created symlink: %s -> %s", destPath, sourcePath)
+				linked = append(linked, destPath)
 			}
-			utils.Logger.Debug().Msgf("Created symlink: %s -> %s", destPath, sourcePath)
 		}
 	}
 
-	return nil
+	return linked, excluded, nil
+}
+
+// linkModeOf returns the link mode of the layer file sourcePath, see
+// LoadLinkModes
+func (opts DirectoryApplyOptions) linkModeOf(sourcePath string) LinkMode {
+	if opts.repoDir == "" || isSymlinkDescriptor(sourcePath) {
+		return LinkSymlink
+	}
+	repoPath, err := RepoPath(opts.repoDir, sourcePath)
+	if err != nil {
+		return LinkSymlink
+	}
+	return linkModeOf(opts.linkModes, repoPath)
+}
+
+// applyLinkMode makes destPath a hardlink or copy of the layer file
+// sourcePath, asking before replacing something else like CreateSymlink
+// does. It reports whether destPath was changed.
+func applyLinkMode(sourcePath, destPath string, mode LinkMode, opts DirectoryApplyOptions) (bool, error) {
+	if materialized(destPath, sourcePath, mode) {
+		utils.Logger.Debug().Msgf("%s is already a %s of %s", destPath, mode, sourcePath)
+		return false, nil
+	}
+
+	if info, err := os.Lstat(destPath); err == nil {
+		if opts.OnlyNew {
+			utils.Logger.Info().Msgf("Skipping %s (already exists)", destPath)
+			return false, nil
+		}
+
+		// A link into the repository, or a hardlink or copy that wasn't
+		// changed since it was made, is dotpilot's own
+		own := info.Mode().IsRegular() && unchangedSinceMaterialized(destPath)
+		if link, err := readLinkTarget(destPath); err == nil && insideDir(link, opts.repoDir) {
+			own = true
+		}
+
+		switch {
+		case opts.reviewer != nil:
+			ok, err := opts.reviewer.review(destPath, sourcePath, sourcePath, mode, !own)
+			if err != nil || !ok {
+				return false, err
+			}
+		case !own && !opts.ForceOverwrite:
+			utils.Logger.Warn().Msgf("File already exists: %s", destPath)
+			if !PromptYesNo(fmt.Sprintf("Overwrite existing file: %s?", destPath)) {
+				utils.Logger.Info().Msgf("Skipping %s", destPath)
+				return false, nil
+			}
+		}
+
+		if own {
+			utils.Logger.Debug().Msgf("Replacing %s", destPath)
+			if err := os.Remove(destPath); err != nil {
+				return false, err
+			}
+		} else {
+			backupPath := backupPathFor(destPath)
+			utils.Logger.Info().Msgf("Backing up %s to %s", destPath, backupPath)
+			if err := utils.MoveFile(destPath, backupPath); err != nil {
+				return false, fmt.Errorf("failed to create backup of %s: %w", destPath, err)
+			}
+			pruneBackupsOf(destPath)
+		}
+	}
+
+	if _, err := MaterializeFile(sourcePath, destPath, mode); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-// CreateSymlink creates a symlink from source to dest
+// CreateSymlink creates a symlink from source to dest. A relative source is
+// relative to the directory of dest.
+// If dest already links to source, absolute or relative, nothing is done.
 // If dest already exists and forceOverwrite is true, it will be replaced
 // Otherwise, the user will be prompted to confirm the overwrite
+// The replaced destination is kept as a timestamped backup, see BackupFile.
 func CreateSymlink(source, dest string, forceOverwrite bool) error {
+	absSource := source
+	if !filepath.IsAbs(absSource) {
+		absSource = filepath.Join(filepath.Dir(dest), source)
+	}
+	if linksTo(dest, absSource) {
+		utils.Logger.Debug().Msgf("Symlink already exists: %s -> %s", dest, source)
+		return nil
+	}
+
 	// Check if destination already exists
-	if _, err := os.Stat(dest); err == nil {
+	if _, err := os.Lstat(dest); err == nil {
 		// If forceOverwrite is false, prompt the user
 		if !forceOverwrite {
 			utils.Logger.Warn().Msgf("File already exists: %s", dest)
@@ -73,11 +309,12 @@ func CreateSymlink(source, dest string, forceOverwrite bool) error {
 		}
 		
 		// Create a backup of the existing file
-		backupPath := dest + ".backup"
-		utils.Logger.Debug().Msgf("Creating backup of %s to %s", dest, backupPath)
-		if err := os.Rename(dest, backupPath); err != nil {
+		backupPath := backupPathFor(dest)
+		utils.Logger.Info().Msgf("Backing up %s to %s", dest, backupPath)
+		if err := utils.MoveFile(dest, backupPath); err != nil {
 			return fmt.Errorf("failed to create backup of %s: %w", dest, err)
 		}
+		pruneBackupsOf(dest)
 	}
 
 	// Create parent directory if it doesn't exist
@@ -88,28 +325,20 @@ func CreateSymlink(source, dest string, forceOverwrite bool) error {
 
 	// Create the symlink
 	utils.Logger.Debug().Msgf("Creating symlink: %s -> %s", dest, source)
-	if err := os.Symlink(source, dest); err != nil {
+	if err := EnsureSymlink(dest, source); err != nil {
 		return fmt.Errorf("failed to create symlink: %w", err)
 	}
 
 	return nil
 }
 
-// RunScript executes the given script with bash
-func RunScript(scriptPath string) error {
+// RunScript executes the given script with the interpreter of its #! line,
+// or bash, in dotpilotDir and exposing the DOTPILOT_* variables from
+// ScriptEnv, see RunShellScript
+func RunScript(dotpilotDir, environment, scriptPath string) error {
 	utils.Logger.Debug().Msgf("Running script: %s", scriptPath)
 
-	// Make script executable if it's not already
-	if err := os.Chmod(scriptPath, 0755); err != nil {
-		return fmt.Errorf("failed to make script executable: %w", err)
-	}
-
-	// Run the script with bash
-	cmd := exec.Command("bash", scriptPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
+	if err := RunShellScript(scriptPath, dotpilotDir, ScriptEnv(dotpilotDir, environment), os.Stdout, os.Stderr); err != nil {
 		return fmt.Errorf("script execution failed: %w", err)
 	}
 
@@ -118,6 +347,10 @@ func RunScript(scriptPath string) error {
 
 // PromptYesNo asks the user a yes/no question and returns true if the answer is yes
 func PromptYesNo(question string) bool {
+	if utils.IsNonInteractive() || utils.IsAssumeYes() {
+		return utils.PromptYesNo(question)
+	}
+
 	var response string
 	utils.Logger.Info().Msgf("%s (y/n): ", question)
 	fmt.Scanln(&response)
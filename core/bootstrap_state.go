@@ -0,0 +1,124 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dotpilot/utils"
+)
+
+// Resuming a bootstrap
+//
+// Bootstrap links the layers, runs the apply hooks, then the setup scripts.
+// It stops at the first layer that fails to apply, and a failing setup script
+// leaves the machine half provisioned. It records every phase that finished
+// in a machine-local state file, so bootstrap --resume can skip those and
+// carry on with the rest: the layers not applied yet, the hooks, and the
+// scripts that failed or never ran. The state is removed once a bootstrap
+// finishes without failures, and a bootstrap without --resume starts over.
+
+// bootstrapStateFile records the progress of an unfinished bootstrap. It is
+// machine-local and kept out of git.
+const bootstrapStateFile = ".bootstrap-state.json"
+
+// BootstrapState is the progress of a bootstrap on this machine
+type BootstrapState struct {
+	Started time.Time `json:"started"`
+	// Environment and Target are what the bootstrap applied; a bootstrap for
+	// another environment or target doesn't resume it
+	Environment string `json:"environment"`
+	Target      string `json:"target"`
+	// Completed lists the finished phases, see BootstrapLayerPhase,
+	// BootstrapHooksPhase and BootstrapScriptPhase
+	Completed []string `json:"completed"`
+	// Linked are the targets the finished layers linked, for the apply hooks
+	Linked []string `json:"linked,omitempty"`
+
+	dotpilotDir string
+}
+
+// BootstrapHooksPhase is the phase running the apply hooks
+const BootstrapHooksPhase = "hooks"
+
+// BootstrapLayerPhase returns the phase applying a layer, like "common"
+func BootstrapLayerPhase(layer string) string {
+	return "layer:" + layer
+}
+
+// BootstrapScriptPhase returns the phase running a setup script
+func BootstrapScriptPhase(script SetupScript) string {
+	return "script:" + script.Name
+}
+
+// LoadBootstrapState returns the progress of the unfinished bootstrap of
+// environment into target, or nil if there is none to resume
+func LoadBootstrapState(dotpilotDir, environment, target string) (*BootstrapState, error) {
+	data, err := os.ReadFile(filepath.Join(dotpilotDir, bootstrapStateFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state BootstrapState
+	if err := json.Unmarshal(data, &state); err != nil {
+		utils.Logger.Warn().Err(err).Msgf("Ignoring unreadable %s, starting over", bootstrapStateFile)
+		return nil, nil
+	}
+	if state.Environment != environment || state.Target != target {
+		utils.Logger.Warn().Msgf("The unfinished bootstrap was for environment %s into %s, starting over", state.Environment, state.Target)
+		return nil, nil
+	}
+	state.dotpilotDir = dotpilotDir
+	return &state, nil
+}
+
+// NewBootstrapState starts recording a bootstrap of environment into target,
+// replacing the progress of an earlier one
+func NewBootstrapState(dotpilotDir, environment, target string) (*BootstrapState, error) {
+	state := &BootstrapState{Started: time.Now(), Environment: environment, Target: target, dotpilotDir: dotpilotDir}
+	return state, state.save()
+}
+
+// Done reports whether phase finished
+func (s *BootstrapState) Done(phase string) bool {
+	for _, completed := range s.Completed {
+		if completed == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// Complete records that phase finished, linking the targets linked
+func (s *BootstrapState) Complete(phase string, linked []string) error {
+	if !s.Done(phase) {
+		s.Completed = append(s.Completed, phase)
+	}
+	s.Linked = append(s.Linked, linked...)
+	return s.save()
+}
+
+// Clear removes the state once the bootstrap finished
+func (s *BootstrapState) Clear() error {
+	err := os.Remove(filepath.Join(s.dotpilotDir, bootstrapStateFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// save writes the state to the dotpilot directory
+func (s *BootstrapState) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(s.dotpilotDir, bootstrapStateFile), append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return excludeLocalFile(s.dotpilotDir, bootstrapStateFile)
+}
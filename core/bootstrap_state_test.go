@@ -0,0 +1,61 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestBootstrapState(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if state, err := LoadBootstrapState(dotpilotDir, "work", "/home/me"); err != nil || state != nil {
+		t.Fatalf("nothing to resume: got %+v, %v", state, err)
+	}
+
+	state, err := NewBootstrapState(dotpilotDir, "work", "/home/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Complete(BootstrapLayerPhase("common"), []string{"/home/me/.zshrc", "/home/me/.vimrc"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Complete(BootstrapScriptPhase(SetupScript{Name: "common/setup.d/10-fonts.sh"}), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only a bootstrap of the same environment and target resumes it
+	resumed, err := LoadBootstrapState(dotpilotDir, "work", "/home/me")
+	if err != nil || resumed == nil {
+		t.Fatalf("LoadBootstrapState = %+v, %v", resumed, err)
+	}
+	if !resumed.Done("layer:common") || !resumed.Done("script:common/setup.d/10-fonts.sh") || resumed.Done(BootstrapHooksPhase) {
+		t.Errorf("completed = %q", resumed.Completed)
+	}
+	if want := []string{"/home/me/.zshrc", "/home/me/.vimrc"}; !reflect.DeepEqual(resumed.Linked, want) {
+		t.Errorf("linked = %q, want %q", resumed.Linked, want)
+	}
+	if other, err := LoadBootstrapState(dotpilotDir, "home", "/home/me"); err != nil || other != nil {
+		t.Errorf("another environment resumed %+v, %v", other, err)
+	}
+
+	// The state stays out of git
+	exclude, err := os.ReadFile(filepath.Join(dotpilotDir, ".git", "info", "exclude"))
+	if err != nil || !strings.Contains(string(exclude), "/"+bootstrapStateFile) {
+		t.Errorf("exclude = %q, %v", exclude, err)
+	}
+
+	if err := resumed.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := LoadBootstrapState(dotpilotDir, "work", "/home/me"); err != nil || state != nil {
+		t.Errorf("cleared state resumed: %+v, %v", state, err)
+	}
+}
@@ -0,0 +1,224 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestApplyDirectoryConfigsOnlyNew(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	for _, name := range []string{"present", "absent", "nested/absent"} {
+		path := filepath.Join(sourceDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("repo\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(destDir, "present"), []byte("local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// forceOverwrite is off, so an existing file would prompt without onlyNew
+	if _, err := ApplyDirectoryConfigs(sourceDir, destDir, false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(destDir, "present"))
+	if err != nil || string(data) != "local\n" {
+		t.Errorf("present was modified: %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(destDir, "present.backup")); !os.IsNotExist(err) {
+		t.Errorf("present was backed up")
+	}
+
+	for _, name := range []string{"absent", "nested/absent"} {
+		link, err := os.Readlink(filepath.Join(destDir, name))
+		if err != nil {
+			t.Errorf("%s was not linked: %v", name, err)
+			continue
+		}
+		if want := filepath.Join(sourceDir, name); link != want {
+			t.Errorf("%s links to %s, want %s", name, link, want)
+		}
+	}
+}
+
+func TestApplyDirectoryConfigsExclude(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	for _, name := range []string{"kept", "notes.bak", "nested/kept", "nested/notes.bak", "cache/data"} {
+		path := filepath.Join(sourceDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("repo\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := DirectoryApplyOptions{Exclude: []string{"*.bak", "cache"}}
+	linked, excluded, err := ApplyDirectoryConfigsWithOptions(sourceDir, destDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{filepath.Join(destDir, "kept"), filepath.Join(destDir, "nested", "kept")}; !reflect.DeepEqual(linked, want) {
+		t.Errorf("linked = %v, want %v", linked, want)
+	}
+	if want := []string{"cache", "nested/notes.bak", "notes.bak"}; !reflect.DeepEqual(excluded, want) {
+		t.Errorf("excluded = %v, want %v", excluded, want)
+	}
+	for _, name := range []string{"notes.bak", "nested/notes.bak", "cache"} {
+		if _, err := os.Lstat(filepath.Join(destDir, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Errorf("%s was applied although it is excluded", name)
+		}
+	}
+}
+
+func TestApplyDirectoryConfigsRelative(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	root := t.TempDir()
+	sourceDir := filepath.Join(root, "repo", "common")
+	destDir := filepath.Join(root, "home")
+	path := filepath.Join(sourceDir, "nested", "conf")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("repo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DirectoryApplyOptions{ForceOverwrite: true, Relative: true}
+	linked, _, err := ApplyDirectoryConfigsWithOptions(sourceDir, destDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(destDir, "nested", "conf")
+	if want := []string{target}; !reflect.DeepEqual(linked, want) {
+		t.Errorf("linked = %v, want %v", linked, want)
+	}
+	want := filepath.FromSlash("../../repo/common/nested/conf")
+	if link, err := os.Readlink(target); err != nil || link != want {
+		t.Errorf("link = %q (%v), want %q", link, err, want)
+	}
+
+	// The relative link is up to date for an absolute bootstrap too
+	linked, _, err = ApplyDirectoryConfigsWithOptions(sourceDir, destDir, DirectoryApplyOptions{ForceOverwrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(linked) != 0 {
+		t.Errorf("relinked %v", linked)
+	}
+}
+
+func TestCreateSymlinkRerun(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "repo", ".bashrc")
+	dest := filepath.Join(dir, "home", ".bashrc")
+	for _, path := range []string{source, dest} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(path+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups := func() []string {
+		matches, err := filepath.Glob(dest + ".dotpilot.bak.*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return matches
+	}
+
+	if err := CreateSymlink(source, dest, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := backups(); len(got) != 1 {
+		t.Fatalf("expected one backup, got %v", got)
+	}
+
+	// The link is correct already, a re-run leaves it and the backup alone,
+	// also when asked for the relative form
+	for _, link := range []string{source, filepath.Join("..", "repo", ".bashrc")} {
+		if err := CreateSymlink(link, dest, true); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := os.Readlink(dest); got != source {
+			t.Errorf("the link was recreated as %s", got)
+		}
+		if got := backups(); len(got) != 1 {
+			t.Errorf("a re-run made another backup: %v", got)
+		}
+	}
+
+	// Replacing another file within the same second keeps both backups
+	if err := os.Remove(dest); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dest, []byte("second\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateSymlink(source, dest, true); err != nil {
+		t.Fatal(err)
+	}
+	got := backups()
+	if len(got) != 2 {
+		t.Fatalf("expected two backups, got %v", got)
+	}
+	var contents []string
+	for _, backup := range got {
+		data, err := os.ReadFile(backup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(data))
+	}
+	sort.Strings(contents)
+	if want := []string{dest + "\n", "second\n"}; !reflect.DeepEqual(contents, want) {
+		t.Errorf("backups hold %q, want %q", contents, want)
+	}
+}
+
+func TestApplyDirectoryConfigsInteractive(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	sourceDir := t.TempDir()
+	destDir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		writeRepoFile(t, sourceDir, name, "repo\n")
+	}
+	writeRepoFile(t, destDir, "b", "local\n")
+
+	// Link a, replace b after answering nonsense, then quit at c
+	opts := DirectoryApplyOptions{Interactive: true, input: strings.NewReader("a\nx\na\nq\n")}
+	linked, _, err := ApplyDirectoryConfigsWithOptions(sourceDir, destDir, opts)
+	if !errors.Is(err, ErrApplyQuit) {
+		t.Fatalf("apply = %v, want ErrApplyQuit", err)
+	}
+	if linked != nil {
+		t.Errorf("linked %v after quitting", linked)
+	}
+	for _, name := range []string{"a", "b"} {
+		if link, err := os.Readlink(filepath.Join(destDir, name)); err != nil || link != filepath.Join(sourceDir, name) {
+			t.Errorf("%s links to %q, %v", name, link, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(destDir, "c")); !os.IsNotExist(err) {
+		t.Errorf("c was linked after quitting: %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package core
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/dotpilot/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Default branch
+//
+// The remote decides which branch the dotfiles live on, often main rather
+// than the master go-git starts new repositories on. Init and sync ask origin
+// for the branch its HEAD points to, put the local branch on it, and record it
+// as the upstream of the local branch, so pull, push and status all compare
+// against the same remote branch.
+
+// fallbackBranch is the branch a new repository starts on when the remote
+// doesn't have a default branch yet, the default of GitHub and most hosts
+const fallbackBranch = "main"
+
+// originHead is the remote-tracking ref recording the default branch of
+// origin, like git clone does
+var originHead = plumbing.NewRemoteHEADReferenceName("origin")
+
+// DefaultBranch returns the name of the default branch of origin, the branch
+// its HEAD points to, and records it in refs/remotes/origin/HEAD. If origin
+// can't be reached, the recorded default branch is used. A remote without a
+// default branch, like an empty one, gets the current branch with the first
+// push.
+func DefaultBranch(repo *git.Repository) (string, error) {
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return "", err
+	}
+	auth, err := remoteAuth(repo)
+	if err != nil {
+		return "", err
+	}
+
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	if err != nil && !errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		if branch, ok := recordedDefaultBranch(repo); ok {
+			utils.Logger.Debug().Err(err).Msgf("Failed to ask origin for its default branch, using %s", branch)
+			return branch, nil
+		}
+		return "", err
+	}
+
+	for _, ref := range refs {
+		if ref.Name() == plumbing.HEAD && ref.Type() == plumbing.SymbolicReference && ref.Target().IsBranch() {
+			branch := ref.Target().Short()
+			symref := plumbing.NewSymbolicReference(originHead, plumbing.NewRemoteReferenceName("origin", branch))
+			if err := repo.Storer.SetReference(symref); err != nil {
+				return "", err
+			}
+			return branch, nil
+		}
+	}
+
+	// Nothing to follow yet
+	if head, err := repo.Storer.Reference(plumbing.HEAD); err == nil && head.Type() == plumbing.SymbolicReference && head.Target().IsBranch() {
+		return head.Target().Short(), nil
+	}
+	return fallbackBranch, nil
+}
+
+// recordedDefaultBranch returns the default branch of origin recorded in
+// refs/remotes/origin/HEAD
+func recordedDefaultBranch(repo *git.Repository) (string, bool) {
+	ref, err := repo.Storer.Reference(originHead)
+	if err != nil || ref.Type() != plumbing.SymbolicReference {
+		return "", false
+	}
+	target := ref.Target().String()
+	branch := strings.TrimPrefix(target, "refs/remotes/origin/")
+	return branch, branch != target && branch != ""
+}
+
+// trackDefaultBranch puts the current branch on the default branch of origin
+// and records that branch as its upstream. A local branch with another name,
+// like the master of a repository initialized before the remote had any
+// commits, is renamed unless a branch with the right name exists already. It
+// returns the default branch.
+func trackDefaultBranch(repo *git.Repository) (string, error) {
+	branch, err := DefaultBranch(repo)
+	if err != nil {
+		return "", err
+	}
+
+	head, err := repo.Head()
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		// Nothing committed yet, start on the default branch
+		return branch, repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName(branch)))
+	}
+	if err != nil {
+		return "", err
+	}
+	if !head.Name().IsBranch() {
+		return branch, nil
+	}
+
+	local := head.Name().Short()
+	if local != branch {
+		if _, err := repo.Reference(plumbing.NewBranchReferenceName(branch), false); err == nil {
+			utils.Logger.Warn().Msgf("The current branch %s isn't the default branch %s of origin, pulling and pushing %s", local, branch, branch)
+		} else {
+			if err := renameBranch(repo, head, branch); err != nil {
+				return "", err
+			}
+			utils.Logger.Info().Msgf("Renamed the local branch %s to %s, the default branch of origin", local, branch)
+			local = branch
+		}
+	}
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return "", err
+	}
+	merge := plumbing.NewBranchReferenceName(branch)
+	if b, ok := cfg.Branches[local]; ok && b.Remote == "origin" && b.Merge == merge {
+		return branch, nil
+	}
+	cfg.Branches[local] = &config.Branch{Name: local, Remote: "origin", Merge: merge}
+	return branch, repo.SetConfig(cfg)
+}
+
+// renameBranch renames the branch head points to, which must be checked out,
+// to name
+func renameBranch(repo *git.Repository, head *plumbing.Reference, name string) error {
+	newName := plumbing.NewBranchReferenceName(name)
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(newName, head.Hash())); err != nil {
+		return err
+	}
+	if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, newName)); err != nil {
+		return err
+	}
+	if err := repo.Storer.RemoveReference(head.Name()); err != nil {
+		return err
+	}
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	if _, ok := cfg.Branches[head.Name().Short()]; ok {
+		delete(cfg.Branches, head.Name().Short())
+		return repo.SetConfig(cfg)
+	}
+	return nil
+}
+
+// upstreamBranch returns the branch of origin the current branch head is
+// compared with: its recorded upstream, the recorded default branch of
+// origin, or a branch of the same name. It doesn't contact the remote.
+func upstreamBranch(repo *git.Repository, head *plumbing.Reference) string {
+	if cfg, err := repo.Config(); err == nil {
+		if b, ok := cfg.Branches[head.Name().Short()]; ok && b.Remote == "origin" && b.Merge.IsBranch() {
+			return b.Merge.Short()
+		}
+	}
+	if branch, ok := recordedDefaultBranch(repo); ok {
+		return branch
+	}
+	return head.Name().Short()
+}
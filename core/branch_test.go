@@ -0,0 +1,141 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// initMainRemote creates a bare repository whose default branch is main, with
+// one commit if seed is set
+func initMainRemote(t *testing.T, seed bool) string {
+	t.Helper()
+	main := git.InitOptions{DefaultBranch: plumbing.NewBranchReferenceName("main")}
+	remoteDir := t.TempDir()
+	if _, err := git.PlainInitWithOptions(remoteDir, &git.PlainInitOptions{InitOptions: main, Bare: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !seed {
+		return remoteDir
+	}
+
+	seedDir := t.TempDir()
+	repo, err := git.PlainInitWithOptions(seedDir, &git.PlainInitOptions{InitOptions: main})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{remoteDir}}); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, seedDir, "common/.zshrc", "zsh\n")
+	if err := CommitChanges(seedDir, "initial"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Push(&git.PushOptions{RemoteName: "origin"}); err != nil {
+		t.Fatal(err)
+	}
+	return remoteDir
+}
+
+// remoteBranches returns the names of the branches of the bare repository at
+// dir
+func remoteBranches(t *testing.T, dir string) map[string]bool {
+	t.Helper()
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs, err := repo.Branches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	branches := map[string]bool{}
+	refs.ForEach(func(ref *plumbing.Reference) error {
+		branches[ref.Name().Short()] = true
+		return nil
+	})
+	return branches
+}
+
+func TestDefaultBranchRenamesMaster(t *testing.T) {
+	remoteDir := initMainRemote(t, true)
+
+	// A clone whose local branch is master, like repositories that were
+	// initialized before the remote had commits
+	dotpilotDir := filepath.Join(t.TempDir(), ".dotpilot")
+	repo, err := git.PlainClone(dotpilotDir, false, &git.CloneOptions{URL: remoteDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := renameBranch(repo, head, "master"); err != nil {
+		t.Fatal(err)
+	}
+
+	branch, err := DefaultBranch(repo)
+	if err != nil || branch != "main" {
+		t.Fatalf("DefaultBranch = %q, %v, want main", branch, err)
+	}
+
+	// Pulling moves onto main, pushing updates main and status compares
+	// against it
+	if err := PullChanges(dotpilotDir); err != nil {
+		t.Fatal(err)
+	}
+	if head, err := repo.Head(); err != nil || head.Name() != plumbing.NewBranchReferenceName("main") {
+		t.Fatalf("HEAD = %v, %v, want main", head, err)
+	}
+	writeRepoFile(t, dotpilotDir, "common/.vimrc", "vim\n")
+	if err := CommitChanges(dotpilotDir, "local change"); err != nil {
+		t.Fatal(err)
+	}
+	if err := PushChanges(dotpilotDir); err != nil {
+		t.Fatal(err)
+	}
+	if branches := remoteBranches(t, remoteDir); !branches["main"] || branches["master"] {
+		t.Errorf("remote branches = %v, want only main", branches)
+	}
+	status, err := GetRemoteStatus(dotpilotDir)
+	if err != nil || status.Ahead != 0 || status.Behind != 0 {
+		t.Errorf("remote status = %+v, %v, want in sync", status, err)
+	}
+}
+
+func TestInitializeRepoEmptyRemote(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+
+	remoteDir := initMainRemote(t, false)
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if err := InitializeRepo(context.Background(), remoteDir, dotpilotDir, "default", nil, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dotpilotDir, "common")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing to pull yet, the first push creates main
+	if err := PullChanges(dotpilotDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := PushChanges(dotpilotDir); err != nil {
+		t.Fatal(err)
+	}
+	if branches := remoteBranches(t, remoteDir); !branches["main"] || len(branches) != 1 {
+		t.Errorf("remote branches = %v, want only main", branches)
+	}
+	if status, err := GetRemoteStatus(dotpilotDir); err != nil || status.Ahead != 0 {
+		t.Errorf("remote status = %+v, %v, want in sync", status, err)
+	}
+}
@@ -0,0 +1,226 @@
+package core
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Cleaning the home directory
+//
+// Experimenting with dotpilot or a bootstrap that went wrong can leave links
+// into the repository and .dotpilot.bak backups all over the home directory.
+// Cleaning removes exactly those: symlinks that resolve into the dotpilot
+// directory, and backups named like the ones BackupFile and apply make. It
+// leaves the repository and ~/.dotpilotrc alone, unlike untrack. dotpilot only
+// links below directories that mirror a layer, so only the home directory and
+// the directories a layer has are searched, not all of the home directory.
+
+// backupMarker separates the backed up name and the time of a backup made by
+// BackupFile or apply, see backupPathFor
+const backupMarker = ".dotpilot.bak."
+
+// CleanLink is a link into the repository that cleaning removes
+type CleanLink struct {
+	Target string // The link in the home directory
+	Source string // Where the link points, inside the dotpilot directory
+	// Restore is the backup moved over the removed link, empty if none is
+	Restore string
+}
+
+// CleanPlan lists what cleaning the home directory removes
+type CleanPlan struct {
+	Links []CleanLink
+	// Backups are the backups removed, without the ones restored
+	Backups []string
+}
+
+// Empty reports whether there is nothing to clean
+func (p *CleanPlan) Empty() bool {
+	return len(p.Links) == 0 && len(p.Backups) == 0
+}
+
+// PlanClean finds the links into dotpilotDir and the dotpilot backups in the
+// home directory. With restore, the most recent backup of each link is
+// restored over it instead of being removed.
+func PlanClean(dotpilotDir string, restore bool) (*CleanPlan, error) {
+	home, err := Home()
+	if err != nil {
+		return nil, err
+	}
+	dotpilotDir, err = filepath.Abs(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	realDotpilotDir, err := filepath.EvalSymlinks(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := cleanDirs(dotpilotDir, realDotpilotDir, home)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &CleanPlan{}
+	backups := make(map[string][]string) // Backups by the path they back up
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if original, _, ok := parseBackupName(path); ok {
+				backups[original] = append(backups[original], path)
+				continue
+			}
+			if entry.Type()&fs.ModeSymlink == 0 {
+				continue
+			}
+			source, err := readLinkTarget(path)
+			if err == nil && (insideDir(source, dotpilotDir) || insideDir(source, realDotpilotDir)) {
+				plan.Links = append(plan.Links, CleanLink{Target: path, Source: source})
+			}
+		}
+	}
+
+	for i, link := range plan.Links {
+		candidates := backups[link.Target]
+		if !restore || len(candidates) == 0 {
+			continue
+		}
+		sortBackups(candidates)
+		plan.Links[i].Restore = candidates[len(candidates)-1]
+		backups[link.Target] = candidates[:len(candidates)-1]
+	}
+	for _, paths := range backups {
+		plan.Backups = append(plan.Backups, paths...)
+	}
+	sort.Strings(plan.Backups)
+	return plan, nil
+}
+
+// Run removes the links and backups of the plan, restoring the backups over
+// the links that have one
+func (p *CleanPlan) Run() error {
+	for _, link := range p.Links {
+		if err := os.Remove(link.Target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if link.Restore != "" {
+			if err := os.Rename(link.Restore, link.Target); err != nil {
+				return err
+			}
+		}
+	}
+	for _, backup := range p.Backups {
+		if err := os.RemoveAll(backup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanDirs returns the home directory and the directories below it that
+// mirror a directory of a layer, without those that are or are inside a link
+// into the repository, which realDotpilotDir is with its symlinks resolved
+func cleanDirs(dotpilotDir, realDotpilotDir, home string) ([]string, error) {
+	layerDirs := []string{filepath.Join(dotpilotDir, "common")}
+	for _, pattern := range []string{"envs/*", "machine/*"} {
+		matches, err := filepath.Glob(filepath.Join(dotpilotDir, filepath.FromSlash(pattern)))
+		if err != nil {
+			return nil, err
+		}
+		layerDirs = append(layerDirs, matches...)
+	}
+
+	seen := map[string]bool{home: true}
+	dirs := []string{home}
+	for _, layerDir := range layerDirs {
+		err := filepath.WalkDir(layerDir, func(path string, d fs.DirEntry, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil || !d.IsDir() || path == layerDir {
+				return err
+			}
+
+			repoPath, err := RepoPath(dotpilotDir, path)
+			if err != nil {
+				return err
+			}
+			target, ok := RepoPathToTarget(home, repoPath)
+			if !ok || seen[target] {
+				return nil
+			}
+			seen[target] = true
+			dirs = append(dirs, target)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A directory linked into the repository lists the repo files
+	var outside []string
+	for _, dir := range dirs {
+		real, err := filepath.EvalSymlinks(dir)
+		if err == nil && !insideDir(real, realDotpilotDir) {
+			outside = append(outside, dir)
+		}
+	}
+	return outside, nil
+}
+
+// parseBackupName returns the path a dotpilot backup at path backs up and
+// when it was made, like 20240101120000 or 20240101120000.2 for the second
+// backup within that second
+func parseBackupName(path string) (original, made string, ok bool) {
+	dir, name := filepath.Split(path)
+	i := strings.LastIndex(name, backupMarker)
+	if i <= 0 {
+		return "", "", false
+	}
+	original, made = filepath.Join(dir, name[:i]), name[i+len(backupMarker):]
+
+	stamp, counter, hasCounter := strings.Cut(made, ".")
+	if len(stamp) != len("20060102150405") {
+		return "", "", false
+	}
+	if _, err := strconv.ParseUint(stamp, 10, 64); err != nil {
+		return "", "", false
+	}
+	if hasCounter {
+		if _, err := strconv.Atoi(counter); err != nil {
+			return "", "", false
+		}
+	}
+	return original, made, true
+}
+
+// sortBackups sorts the backups of one path from the oldest to the most
+// recent
+func sortBackups(backups []string) {
+	order := func(backup string) (string, int) {
+		_, made, _ := parseBackupName(backup)
+		stamp, counter, _ := strings.Cut(made, ".")
+		n, _ := strconv.Atoi(counter)
+		return stamp, n
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		stampI, nI := order(backups[i])
+		stampJ, nJ := order(backups[j])
+		if stampI != stampJ {
+			return stampI < stampJ
+		}
+		return nI < nJ
+	})
+}
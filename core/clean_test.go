@@ -0,0 +1,125 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseBackupName(t *testing.T) {
+	for path, want := range map[string]string{
+		"/home/u/.bashrc.dotpilot.bak.20240101120000":      "/home/u/.bashrc",
+		"/home/u/.bashrc.dotpilot.bak.20240101120000.2":    "/home/u/.bashrc",
+		"/home/u/.config/nvim.dotpilot.bak.20240101120000": "/home/u/.config/nvim",
+	} {
+		if original, _, ok := parseBackupName(path); !ok || original != want {
+			t.Errorf("parseBackupName(%q) = %q, %v, want %q", path, original, ok, want)
+		}
+	}
+	for _, path := range []string{
+		"/home/u/.bashrc",
+		"/home/u/.dotpilot.bak.20240101120000",
+		"/home/u/.bashrc.dotpilot.bak.2024",
+		"/home/u/.bashrc.dotpilot.bak.20240101120000.orig",
+	} {
+		if _, _, ok := parseBackupName(path); ok {
+			t.Errorf("parseBackupName(%q) accepted", path)
+		}
+	}
+}
+
+func TestCleanHome(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	writeRepoFile(t, dotpilotDir, "common/.bashrc", "alias ll='ls -l'\n")
+	writeRepoFile(t, dotpilotDir, "common/.config/git/config", "[user]\n")
+	writeRepoFile(t, dotpilotDir, "envs/work/.config/nvim/init.vim", "set number\n")
+	writeRepoFile(t, dotpilotDir, "envs/work/.unlinked/file", "\n")
+
+	mustLink := func(source, target string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(source, target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustWrite := func(path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bashrc := filepath.Join(home, ".bashrc")
+	gitconfig := filepath.Join(home, ".config", "git", "config")
+	nvim := filepath.Join(home, ".config", "nvim")
+	mustLink(filepath.Join(dotpilotDir, "common", ".bashrc"), bashrc)
+	mustLink(filepath.Join("..", "..", ".dotpilot", "common", ".config", "git", "config"), gitconfig)
+	mustLink(filepath.Join(dotpilotDir, "envs", "work", ".config", "nvim"), nvim)
+	mustLink(filepath.Join(dotpilotDir, "common", ".deleted"), filepath.Join(home, ".deleted"))
+	mustWrite(bashrc+".dotpilot.bak.20240101120000", "old\n")
+	mustWrite(bashrc+".dotpilot.bak.20240102120000", "older\n")
+	mustWrite(bashrc+".dotpilot.bak.20240102120000.2", "newest\n")
+	mustWrite(filepath.Join(home, ".profile.dotpilot.bak.20240101120000"), "profile\n")
+
+	// Left alone: a link elsewhere, a regular file, and anything below
+	// directories no layer has
+	mustLink("/etc/hosts", filepath.Join(home, ".hosts"))
+	mustWrite(filepath.Join(home, ".vimrc"), "set number\n")
+	mustLink(filepath.Join(dotpilotDir, "common", ".bashrc"), filepath.Join(home, "projects", ".bashrc"))
+
+	plan, err := PlanClean(dotpilotDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var links []string
+	for _, link := range plan.Links {
+		links = append(links, link.Target)
+		if link.Restore != "" {
+			t.Errorf("%s restores %s without restore", link.Target, link.Restore)
+		}
+	}
+	wantLinks := []string{bashrc, filepath.Join(home, ".deleted"), nvim, gitconfig}
+	if !reflect.DeepEqual(links, wantLinks) {
+		t.Errorf("links %q, want %q", links, wantLinks)
+	}
+	if len(plan.Backups) != 4 {
+		t.Errorf("backups %q", plan.Backups)
+	}
+
+	plan, err = PlanClean(dotpilotDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Links[0].Restore != bashrc+".dotpilot.bak.20240102120000.2" || len(plan.Backups) != 3 {
+		t.Fatalf("restore plan %+v", plan)
+	}
+	if err := plan.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(bashrc); err != nil || string(data) != "newest\n" {
+		t.Errorf("restored .bashrc = %q, %v", data, err)
+	}
+	for _, gone := range append(wantLinks[1:], plan.Backups...) {
+		if _, err := os.Lstat(gone); !os.IsNotExist(err) {
+			t.Errorf("%s is still there", gone)
+		}
+	}
+	for _, kept := range []string{".hosts", ".vimrc", "projects/.bashrc", ".dotpilot/common/.bashrc", ".dotpilot/envs/work/.config/nvim/init.vim"} {
+		if _, err := os.Lstat(filepath.Join(home, filepath.FromSlash(kept))); err != nil {
+			t.Errorf("%s was removed: %v", kept, err)
+		}
+	}
+
+	if plan, err := PlanClean(dotpilotDir, true); err != nil || !plan.Empty() {
+		t.Errorf("second clean %+v, %v", plan, err)
+	}
+}
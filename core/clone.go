@@ -0,0 +1,138 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/dotpilot/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// cloneProgressLine matches the progress lines of git's sideband, for example
+// "Receiving objects:  45% (450/1000), 1.20 MiB | 2.00 MiB/s"
+var cloneProgressLine = regexp.MustCompile(`^([A-Za-z ]+):\s+\d+% \((\d+)/(\d+)\)`)
+
+// cloneProgress parses the progress git sends during a clone and reports it to
+// update, one call per progress line
+type cloneProgress struct {
+	update  func(stage string, current, total int)
+	pending []byte
+}
+
+// Write implements io.Writer. Progress lines end in \r while they are updated
+// and in \n when their stage is done.
+func (p *cloneProgress) Write(data []byte) (int, error) {
+	p.pending = append(p.pending, data...)
+	for {
+		i := strings.IndexAny(string(p.pending), "\r\n")
+		if i < 0 {
+			break
+		}
+		line := strings.TrimSpace(string(p.pending[:i]))
+		p.pending = p.pending[i+1:]
+
+		match := cloneProgressLine.FindStringSubmatch(line)
+		if match == nil {
+			if line != "" {
+				utils.Logger.Debug().Msgf("remote: %s", line)
+			}
+			continue
+		}
+		current, _ := strconv.Atoi(match[2])
+		total, _ := strconv.Atoi(match[3])
+		p.update(strings.TrimSpace(match[1]), current, total)
+	}
+	return len(data), nil
+}
+
+// cloneRepository clones remoteURL into dotpilotDir, which must exist and be
+// empty. A depth above 0 makes a shallow clone of that many commits. Progress is shown with an indicator when stdout is a terminal.
+// Canceling ctx aborts the clone. If the clone fails, everything it wrote to
+// dotpilotDir is removed again, so a retry starts clean; the error is wrapped
+// in ErrInterrupted, ErrAuthFailed, ErrDiskFull or ErrNetwork when the cause
+// is known.
+func cloneRepository(ctx context.Context, remoteURL, dotpilotDir string, auth transport.AuthMethod, depth int) error {
+	description := fmt.Sprintf("Cloning %s...", remoteURL)
+	progress := &cloneProgress{update: func(stage string, current, total int) {
+		utils.Logger.Debug().Msgf("%s: %d/%d", stage, current, total)
+	}}
+	var op *utils.Operation
+	if utils.IsTerminal() {
+		op = utils.NewOperation("clone", description, utils.Bar)
+		op.Start()
+		progress.update = func(stage string, current, total int) {
+			op.SetMessage(fmt.Sprintf("Cloning %s: %s", remoteURL, strings.ToLower(stage)))
+			op.UpdateProgress(current, total)
+		}
+	}
+
+	_, err := git.PlainCloneContext(ctx, dotpilotDir, false, &git.CloneOptions{
+		URL:      remoteURL,
+		Auth:     auth,
+		Progress: progress,
+		Depth:    depth,
+	})
+	if op != nil {
+		if err == nil {
+			op.StopWithResult(utils.StateSuccess, fmt.Sprintf("Cloned %s", remoteURL))
+		} else {
+			op.StopSilent()
+		}
+	}
+	if err == nil || err == git.ErrRepositoryAlreadyExists || err == git.ErrRepositoryNotExists {
+		return err
+	}
+
+	// go-git only cleans up after a failed fetch, not after a failed checkout
+	removeDirContents(dotpilotDir)
+
+	return classifyRemoteError(ctx, err)
+}
+
+// classifyRemoteError wraps err in the sentinel error describing why a clone,
+// fetch, pull or push failed, if the cause is known
+func classifyRemoteError(ctx context.Context, err error) error {
+	message := strings.ToLower(err.Error())
+	var netErr net.Error
+	switch {
+	case ctx.Err() != nil || errors.Is(err, context.Canceled):
+		return fmt.Errorf("%w: %w", ErrInterrupted, err)
+	case errors.Is(err, transport.ErrAuthenticationRequired),
+		errors.Is(err, transport.ErrAuthorizationFailed),
+		strings.Contains(message, "unable to authenticate"),
+		strings.Contains(message, "permission denied (publickey"):
+		return fmt.Errorf("%w: %w", ErrAuthFailed, err)
+	case errors.Is(err, syscall.ENOSPC),
+		strings.Contains(message, "no space left on device"):
+		return fmt.Errorf("%w: %w", ErrDiskFull, err)
+	case errors.As(err, &netErr),
+		strings.Contains(message, "connection refused"),
+		strings.Contains(message, "no such host"),
+		strings.Contains(message, "network is unreachable"),
+		strings.Contains(message, "unexpected eof"):
+		return fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+	return err
+}
+
+// removeDirContents removes everything inside dir, leaving dir itself
+func removeDirContents(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			utils.Logger.Warn().Err(err).Msgf("Failed to clean up %s", dir)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+func TestCloneProgress(t *testing.T) {
+	var got []string
+	progress := &cloneProgress{update: func(stage string, current, total int) {
+		got = append(got, fmt.Sprintf("%s %d/%d", stage, current, total))
+	}}
+
+	// Lines may be split across writes and updated in place with \r
+	for _, chunk := range []string{
+		"Enumerating objects: 12, done.\n",
+		"Counting objects:  50% (6/12)\rCounting objects: 100% (12/12), done.\n",
+		"Receiving objects:  25% (3/1",
+		"2), 1.00 KiB | 1.00 MiB/s\r",
+	} {
+		if _, err := progress.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"Counting objects 6/12", "Counting objects 12/12", "Receiving objects 3/12"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("progress = %v, want %v", got, want)
+	}
+}
+
+func TestInitializeRepoInterrupted(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+
+	remoteDir := t.TempDir()
+	if _, err := git.PlainInit(remoteDir, false); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, remoteDir, "common/.zshrc", "zsh\n")
+	if err := CommitChanges(remoteDir, "initial"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Canceled before the clone gets anywhere
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	err := InitializeRepo(ctx, remoteDir, dotpilotDir, "default", nil, "", 0)
+	if !errors.Is(err, ErrInterrupted) {
+		t.Fatalf("InitializeRepo = %v, want ErrInterrupted", err)
+	}
+	if _, err := os.Stat(dotpilotDir); !os.IsNotExist(err) {
+		t.Errorf("%s was left behind after the interrupted clone", dotpilotDir)
+	}
+
+	// A retry starts clean
+	if err := InitializeRepo(context.Background(), remoteDir, dotpilotDir, "default", nil, "", 0); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dotpilotDir, "common", ".zshrc")); err != nil {
+		t.Errorf("retry didn't clone: %v", err)
+	}
+}
+
+func TestClassifyCloneError(t *testing.T) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		err  error
+		want error
+	}{
+		{transport.ErrAuthenticationRequired, ErrAuthFailed},
+		{errors.New("ssh: handshake failed: ssh: unable to authenticate"), ErrAuthFailed},
+		{&os.PathError{Op: "write", Path: "pack", Err: syscall.ENOSPC}, ErrDiskFull},
+		{errors.New("dial tcp: lookup example.invalid: no such host"), ErrNetwork},
+	} {
+		if err := classifyRemoteError(ctx, tt.err); !errors.Is(err, tt.want) || !errors.Is(err, tt.err) {
+			t.Errorf("classifyRemoteError(%v) = %v, want %v", tt.err, err, tt.want)
+		}
+	}
+
+	other := errors.New("something else")
+	if err := classifyRemoteError(ctx, other); err != other {
+		t.Errorf("classifyRemoteError(%v) = %v, want it unchanged", other, err)
+	}
+}
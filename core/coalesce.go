@@ -0,0 +1,159 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dotpilot/utils"
+)
+
+// DefaultCoalesceWindow is how long a CoalescingCommitter collects changes
+// before committing them
+const DefaultCoalesceWindow = 30 * time.Second
+
+// coalesceListLimit is how many file names a coalesced commit message lists
+const coalesceListLimit = 3
+
+// CoalescingCommitter batches a stream of changed files into a single commit,
+// so long-running modes that react to every save don't commit each one. The
+// first change after a commit starts a window; when it expires, everything
+// changed in the meantime is committed together with a message summarizing
+// the files. It is safe for concurrent use.
+type CoalescingCommitter struct {
+	dotpilotDir string
+	window      time.Duration
+
+	mu      sync.Mutex
+	pending []string
+	seen    map[string]bool
+	timer   *time.Timer
+}
+
+// NewCoalescingCommitter returns a committer for the repository at
+// dotpilotDir that commits window after the first uncommitted change. A
+// window of zero or less uses DefaultCoalesceWindow.
+func NewCoalescingCommitter(dotpilotDir string, window time.Duration) *CoalescingCommitter {
+	if window <= 0 {
+		window = DefaultCoalesceWindow
+	}
+	return &CoalescingCommitter{
+		dotpilotDir: dotpilotDir,
+		window:      window,
+		seen:        make(map[string]bool),
+	}
+}
+
+// Add records a changed file, a path in the home directory or inside the
+// repository, and starts the window if it isn't running. Adding a file twice
+// within a window lists it once.
+func (c *CoalescingCommitter) Add(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.seen[path] {
+		c.seen[path] = true
+		c.pending = append(c.pending, path)
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.window, func() {
+			if err := c.Flush(); err != nil {
+				utils.Logger.Error().Err(err).Msg("Failed to commit changes")
+			}
+		})
+	}
+}
+
+// Pending returns the files recorded since the last commit
+func (c *CoalescingCommitter) Pending() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.pending...)
+}
+
+// Flush commits the recorded files now instead of waiting for the window. It
+// is called by the timer and should be called once more when the caller
+// stops, so no change is left uncommitted. Nothing is committed if the
+// repository has no changes, for example when a file was saved unchanged.
+func (c *CoalescingCommitter) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.pending) == 0 {
+		return nil
+	}
+	paths := c.pending
+	c.pending = nil
+	c.seen = make(map[string]bool)
+
+	changed, err := HasUncommittedChanges(c.dotpilotDir)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		utils.Logger.Debug().Msgf("Nothing to commit for %d changed files", len(paths))
+		return nil
+	}
+
+	message := CoalescedCommitMessage(c.displayNames(paths))
+	committed, err := MaybeCommit(c.dotpilotDir, message)
+	if err != nil {
+		return err
+	}
+	if committed {
+		utils.Logger.Info().Msg(message)
+	}
+	return nil
+}
+
+// displayNames returns the names paths are listed under in a commit message:
+// the target path relative to home for layer files and home paths, the repo
+// path for other repository files
+func (c *CoalescingCommitter) displayNames(paths []string) []string {
+	home, _ := Home()
+
+	names := make([]string, 0, len(paths))
+	for _, p := range paths {
+		name := p
+		if repoPath, err := RepoPath(c.dotpilotDir, p); err == nil && !strings.HasPrefix(repoPath, "../") {
+			name = repoPath
+			if target, ok := RepoPathToTarget("", repoPath); ok {
+				name = filepath.ToSlash(target)
+			}
+		} else if home != "" {
+			if relPath, ok := TargetToRepoPath(home, p, ""); ok {
+				name = relPath
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// CoalescedCommitMessage returns the message of a commit changing names, for
+// example "Update 3 files: .zshrc, .vimrc, .gitconfig". Long lists are cut
+// short.
+func CoalescedCommitMessage(names []string) string {
+	switch len(names) {
+	case 0:
+		return "Update dotfiles"
+	case 1:
+		return "Update " + names[0]
+	}
+
+	listed := names
+	if len(names) > coalesceListLimit {
+		listed = names[:coalesceListLimit]
+	}
+	message := fmt.Sprintf("Update %d files: %s", len(names), strings.Join(listed, ", "))
+	if more := len(names) - len(listed); more > 0 {
+		message += fmt.Sprintf(" and %d more", more)
+	}
+	return message
+}
@@ -0,0 +1,118 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// headMessage returns the message of the HEAD commit of dir
+func headMessage(t *testing.T, dir string) string {
+	t.Helper()
+
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return commit.Message
+}
+
+func TestCoalescedCommitMessage(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  string
+	}{
+		{nil, "Update dotfiles"},
+		{[]string{".zshrc"}, "Update .zshrc"},
+		{[]string{".zshrc", ".vimrc", ".gitconfig"}, "Update 3 files: .zshrc, .vimrc, .gitconfig"},
+		{[]string{"a", "b", "c", "d", "e"}, "Update 5 files: a, b, c and 2 more"},
+	}
+	for _, tt := range tests {
+		if got := CoalescedCommitMessage(tt.names); got != tt.want {
+			t.Errorf("CoalescedCommitMessage(%v) = %q, want %q", tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestCoalescingCommitterFlush(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "README.md", "dotfiles\n")
+	if err := CommitChanges(dotpilotDir, "initial"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A window long enough that only Flush commits
+	committer := NewCoalescingCommitter(dotpilotDir, time.Hour)
+	for _, name := range []string{"common/.zshrc", "envs/dev/.vimrc", "common/.zshrc"} {
+		writeRepoFile(t, dotpilotDir, name, name+"\n")
+		committer.Add(filepath.Join(dotpilotDir, filepath.FromSlash(name)))
+	}
+	committer.Add(filepath.Join(home, ".gitconfig"))
+
+	if err := committer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := headMessage(t, dotpilotDir), "Update 3 files: .zshrc, .vimrc, .gitconfig"; got != want {
+		t.Errorf("commit message = %q, want %q", got, want)
+	}
+	if pending := committer.Pending(); len(pending) != 0 {
+		t.Errorf("Pending() = %v after Flush", pending)
+	}
+
+	// Files saved without changes don't produce an empty commit
+	committer.Add(filepath.Join(dotpilotDir, "common", ".zshrc"))
+	if err := committer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := headMessage(t, dotpilotDir); got != "Update 3 files: .zshrc, .vimrc, .gitconfig" {
+		t.Errorf("unchanged files were committed as %q", got)
+	}
+}
+
+func TestCoalescingCommitterWindow(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "README.md", "dotfiles\n")
+	if err := CommitChanges(dotpilotDir, "initial"); err != nil {
+		t.Fatal(err)
+	}
+
+	committer := NewCoalescingCommitter(dotpilotDir, 50*time.Millisecond)
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "zsh\n")
+	committer.Add(filepath.Join(dotpilotDir, "common", ".zshrc"))
+	writeRepoFile(t, dotpilotDir, "common/.vimrc", "vim\n")
+	committer.Add(filepath.Join(dotpilotDir, "common", ".vimrc"))
+
+	// Both changes land in the commit made when the window expires
+	deadline := time.Now().Add(5 * time.Second)
+	for len(committer.Pending()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := committer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := headMessage(t, dotpilotDir), "Update 2 files: .zshrc, .vimrc"; got != want {
+		t.Errorf("commit message = %q, want %q", got, want)
+	}
+}
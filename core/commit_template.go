@@ -0,0 +1,110 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dotpilot/utils"
+)
+
+// Commit message templates
+//
+// The commits dotpilot makes have a message describing what the command did,
+// like "Added encrypted secret: aws". Options["commit_template"] in
+// ~/.dotpilotrc, or --commit-template for one invocation, formats them with a
+// text/template instead, e.g. "[{{.Env}}@{{.Host}}] {{.Action}}: {{.Files}}",
+// rendered with a CommitContext. The default message is the Action. A template
+// that can't be rendered, like one naming a field CommitContext doesn't have,
+// falls back to the default message with a warning.
+
+// commitTemplateOption is the option of ~/.dotpilotrc holding the template
+const commitTemplateOption = "commit_template"
+
+// commitTemplate overrides Options["commit_template"], see SetCommitTemplate
+var commitTemplate string
+
+// SetCommitTemplate makes the commits of this invocation use text instead of
+// Options["commit_template"]. An empty text keeps the option.
+func SetCommitTemplate(text string) {
+	commitTemplate = text
+}
+
+// CommitTemplate returns the commit message template in use, empty for the
+// default messages
+func CommitTemplate() string {
+	if commitTemplate != "" {
+		return commitTemplate
+	}
+	text, _ := GetConfig().Options[commitTemplateOption].(string)
+	return text
+}
+
+// CommitContext is what a commit message template is rendered with
+type CommitContext struct {
+	Action string      // What the command did, the default message
+	Files  CommitFiles // The changed files, relative to the dotpilot directory
+	Env    string      // The current environment
+	Host   string      // The name of this machine, see MachineID
+	Time   time.Time
+}
+
+// CommitFiles are the changed files of a commit. They print comma-separated,
+// and can be ranged over.
+type CommitFiles []string
+
+// String joins the files with commas
+func (f CommitFiles) String() string {
+	return strings.Join(f, ", ")
+}
+
+// ParseCommitTemplate parses a commit message template
+func ParseCommitTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New(commitTemplateOption).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid commit template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// RenderCommitMessage renders the commit message template text with ctx. A
+// template rendering to nothing but whitespace is an error.
+func RenderCommitMessage(text string, ctx CommitContext) (string, error) {
+	tmpl, err := ParseCommitTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	var message strings.Builder
+	if err := tmpl.Execute(&message, ctx); err != nil {
+		return "", fmt.Errorf("invalid commit template: %w", err)
+	}
+	if strings.TrimSpace(message.String()) == "" {
+		return "", fmt.Errorf("invalid commit template: %q renders an empty message", text)
+	}
+	return message.String(), nil
+}
+
+// commitMessage returns the message of a commit of the changes in the
+// repository of dotpilotDir that action describes: the template in use
+// rendered, or action itself without one
+func commitMessage(dotpilotDir, action string) string {
+	text := CommitTemplate()
+	if text == "" {
+		return action
+	}
+
+	ctx := CommitContext{Action: action, Env: GetConfig().CurrentEnvironment, Time: time.Now()}
+	if host, err := MachineID(); err == nil {
+		ctx.Host = host
+	}
+	if files, err := uncommittedFiles(dotpilotDir); err == nil {
+		ctx.Files = files
+	}
+	message, err := RenderCommitMessage(text, ctx)
+	if err != nil {
+		utils.Logger.Warn().Err(err).Msg("Using the default commit message")
+		return action
+	}
+	return message
+}
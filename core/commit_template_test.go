@@ -0,0 +1,83 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestRenderCommitMessage(t *testing.T) {
+	ctx := CommitContext{
+		Action: "Track .zshrc",
+		Files:  CommitFiles{"common/.zshrc", "common/.zprofile"},
+		Env:    "work",
+		Host:   "laptop",
+		Time:   time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		text    string
+		want    string
+		wantErr bool
+	}{
+		{text: "[{{.Env}}@{{.Host}}] {{.Action}}: {{.Files}}", want: "[work@laptop] Track .zshrc: common/.zshrc, common/.zprofile"},
+		{text: "{{.Action}} ({{len .Files}} files)", want: "Track .zshrc (2 files)"},
+		{text: "{{range .Files}}{{.}};{{end}}", want: "common/.zshrc;common/.zprofile;"},
+		{text: `{{.Time.Format "2006-01-02"}} {{.Action}}`, want: "2024-05-01 Track .zshrc"},
+		{text: "{{.Missing}}", wantErr: true},
+		{text: "{{.Action", wantErr: true},
+		{text: "{{if false}}x{{end}}  ", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := RenderCommitMessage(tt.text, ctx)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("RenderCommitMessage(%q) error = %v, want error %v", tt.text, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("RenderCommitMessage(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestCommitChangesTemplate(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DOTPILOT_HOSTNAME", "laptop")
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+	currentConfig.CurrentEnvironment = "work"
+	currentConfig.Options = map[string]interface{}{"commit_template": "{{.Env}}: {{.Action}}"}
+	defer SetCommitTemplate("")
+
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "zsh\n")
+	if err := CommitChanges(dotpilotDir, "Track .zshrc"); err != nil {
+		t.Fatal(err)
+	}
+	if got := headMessage(t, dotpilotDir); got != "work: Track .zshrc" {
+		t.Errorf("option: message %q", got)
+	}
+
+	// The flag overrides the option
+	SetCommitTemplate("[{{.Host}}] {{.Action}}: {{.Files}}")
+	writeRepoFile(t, dotpilotDir, "common/.vimrc", "vim\n")
+	if err := CommitChanges(dotpilotDir, "Track .vimrc"); err != nil {
+		t.Fatal(err)
+	}
+	if got := headMessage(t, dotpilotDir); got != "[laptop] Track .vimrc: common/.vimrc" {
+		t.Errorf("flag: message %q", got)
+	}
+
+	// A broken template falls back to the action
+	SetCommitTemplate("{{.Missing}}")
+	writeRepoFile(t, dotpilotDir, "common/.bashrc", "bash\n")
+	if err := CommitChanges(dotpilotDir, "Track .bashrc"); err != nil {
+		t.Fatal(err)
+	}
+	if got := headMessage(t, dotpilotDir); got != "Track .bashrc" {
+		t.Errorf("fallback: message %q", got)
+	}
+}
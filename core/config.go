@@ -3,7 +3,6 @@ package core
 import (
 	"encoding/json"
 	"io/ioutil"
-	"os"
 	"path/filepath"
 
 	"github.com/dotpilot/utils"
@@ -14,12 +13,21 @@ type Config struct {
 	RemoteRepository   string                 `json:"remote_repository"`
 	CurrentEnvironment string                 `json:"current_environment"`
 	TrackingPaths      []string               `json:"tracking_paths"`
+	SparsePaths        []string               `json:"sparse_paths,omitempty"`
+	MachineGuard       bool                   `json:"machine_guard,omitempty"`
+	Subdir             string                 `json:"subdir,omitempty"`        // Repo subdirectory holding the layers (monorepo mode)
+	QuietShadows       bool                   `json:"quiet_shadows,omitempty"` // Don't warn about targets defined in several layers
 	Options            map[string]interface{} `json:"options"`
 }
 
 var currentConfig Config
 
-// LoadConfig loads the configuration from the file
+// configLoaded is set once a configuration was loaded or set, so
+// OpenRepository only loads ~/.dotpilotrc when nobody else did
+var configLoaded bool
+
+// LoadConfig loads the configuration from the file, and merges the fragments
+// in ~/.dotpilot/config.d over it
 func LoadConfig(configPath string) error {
 	data, err := ioutil.ReadFile(configPath)
 	if err != nil {
@@ -30,14 +38,29 @@ func LoadConfig(configPath string) error {
 	if err != nil {
 		return err
 	}
+	configLoaded = true
+
+	home, err := Home()
+	if err != nil {
+		return err
+	}
+	if err := loadConfigFragments(home, configPath, data); err != nil {
+		return err
+	}
 
 	utils.Logger.Debug().Msgf("Loaded config from %s", configPath)
 	return nil
 }
 
-// SaveConfig saves the current configuration to the file
+// SaveConfig saves the current configuration to the file. Values that came
+// from config fragments are left out, see loadConfigFragments.
 func SaveConfig(configPath string) error {
-	data, err := json.MarshalIndent(currentConfig, "", "  ")
+	config, err := unmergedConfig()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return err
 	}
@@ -59,6 +82,8 @@ func GetConfig() Config {
 // SetConfig sets the current configuration
 func SetConfig(config Config) {
 	currentConfig = config
+	resetConfigFragments()
+	configLoaded = true
 }
 
 // InitDefaultConfig initializes a default configuration
@@ -72,11 +97,13 @@ func InitDefaultConfig() {
 			"prompt_on_diff":          true,
 		},
 	}
+	configLoaded = true
+	resetConfigFragments()
 }
 
 // CreateDefaultConfigFile creates a default configuration file
 func CreateDefaultConfigFile(remoteRepo, environment string) error {
-	home, err := os.UserHomeDir()
+	home, err := Home()
 	if err != nil {
 		return err
 	}
@@ -93,6 +120,8 @@ func CreateDefaultConfigFile(remoteRepo, environment string) error {
 			"prompt_on_diff":          true,
 		},
 	}
+	configLoaded = true
+	resetConfigFragments()
 
 	// Save config
 	return SaveConfig(configPath)
@@ -102,7 +131,33 @@ func CreateDefaultConfigFile(remoteRepo, environment string) error {
 func UpdateEnvironment(environment string) error {
 	currentConfig.CurrentEnvironment = environment
 
-	home, err := os.UserHomeDir()
+	home, err := Home()
+	if err != nil {
+		return err
+	}
+
+	configPath := filepath.Join(home, ".dotpilotrc")
+	return SaveConfig(configPath)
+}
+
+// UpdateSparsePaths updates the sparse checkout include list in the configuration
+func UpdateSparsePaths(paths []string) error {
+	currentConfig.SparsePaths = paths
+
+	home, err := Home()
+	if err != nil {
+		return err
+	}
+
+	configPath := filepath.Join(home, ".dotpilotrc")
+	return SaveConfig(configPath)
+}
+
+// UpdateSubdir records the repository subdirectory that holds the layers
+func UpdateSubdir(subdir string) error {
+	currentConfig.Subdir = subdir
+
+	home, err := Home()
 	if err != nil {
 		return err
 	}
@@ -122,7 +177,34 @@ func AddTrackingPath(path string) error {
 
 	currentConfig.TrackingPaths = append(currentConfig.TrackingPaths, path)
 
-	home, err := os.UserHomeDir()
+	home, err := Home()
+	if err != nil {
+		return err
+	}
+
+	configPath := filepath.Join(home, ".dotpilotrc")
+	return SaveConfig(configPath)
+}
+
+// RemoveTrackingPaths drops paths from the tracked paths list
+func RemoveTrackingPaths(paths ...string) error {
+	drop := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		drop[p] = true
+	}
+
+	kept := []string{}
+	for _, p := range currentConfig.TrackingPaths {
+		if !drop[p] {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) == len(currentConfig.TrackingPaths) {
+		return nil
+	}
+	currentConfig.TrackingPaths = kept
+
+	home, err := Home()
 	if err != nil {
 		return err
 	}
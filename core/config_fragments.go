@@ -0,0 +1,243 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Config fragments
+//
+// Besides ~/.dotpilotrc, the JSON files in ~/.dotpilot/config.d are loaded in
+// lexical order, each over the configuration so far, so machine-specific
+// overrides can live in files of their own:
+//   - options are merged by name, a fragment's value replacing the earlier one
+//     and null removing the option
+//   - tracking_paths is the union of all files, in order of appearance
+//   - any other field a fragment sets replaces the earlier value
+// Values that came from fragments are not written back to ~/.dotpilotrc when
+// dotpilot saves the configuration, unless they were changed since loading.
+
+// ConfigValue is a configuration value and the file it came from
+type ConfigValue struct {
+	Key    string      `json:"key"` // Field name, "options.<name>" for an option
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+var (
+	// configBase is ~/.dotpilotrc as loaded and configOverlay the values
+	// fragments and overrideConfigValue set, by key as in ConfigValue
+	configBase    map[string]interface{}
+	configOverlay map[string]interface{}
+	// fragmentTrackingPaths are the tracking paths only fragments contain
+	fragmentTrackingPaths map[string]bool
+	// configSources records where each loaded value came from
+	configSources map[string]ConfigValue
+	// trackingPathSources are the tracking paths with the first file naming them
+	trackingPathSources []ConfigValue
+)
+
+// ConfigFragmentDir returns the directory of configuration fragments
+func ConfigFragmentDir(home string) string {
+	return filepath.Join(home, ".dotpilot", "config.d")
+}
+
+// ConfigSources returns the values the loaded configuration files set, sorted
+// by key, with the file each came from. Every tracking path is a value of its
+// own.
+func ConfigSources() []ConfigValue {
+	var values []ConfigValue
+	for _, value := range configSources {
+		values = append(values, value)
+	}
+	values = append(values, trackingPathSources...)
+	sort.SliceStable(values, func(i, j int) bool { return values[i].Key < values[j].Key })
+	return values
+}
+
+// resetConfigFragments forgets the fragments and sources of the last load
+func resetConfigFragments() {
+	configBase = nil
+	configOverlay = nil
+	fragmentTrackingPaths = nil
+	configSources = map[string]ConfigValue{}
+	trackingPathSources = nil
+	envRulesApplied = false
+}
+
+// loadConfigFragments records the sources of the base configuration, data
+// read from basePath, and merges the fragments of home over currentConfig
+func loadConfigFragments(home, basePath string, data []byte) error {
+	resetConfigFragments()
+
+	base, err := recordConfigSources(basePath, data, nil)
+	if err != nil {
+		return err
+	}
+	configBase = base
+
+	fragments, err := filepath.Glob(filepath.Join(ConfigFragmentDir(home), "*.json"))
+	if err != nil || len(fragments) == 0 {
+		return err
+	}
+	configOverlay = map[string]interface{}{}
+	fragmentTrackingPaths = map[string]bool{}
+
+	for _, fragment := range fragments {
+		data, err := ioutil.ReadFile(fragment)
+		if err != nil {
+			return err
+		}
+
+		paths := currentConfig.TrackingPaths
+		if currentConfig.Options == nil {
+			currentConfig.Options = map[string]interface{}{}
+		}
+		// Unmarshaling merges into the existing options map
+		if err := json.Unmarshal(data, &currentConfig); err != nil {
+			return fmt.Errorf("config fragment %s: %w", fragment, err)
+		}
+		for name, value := range currentConfig.Options {
+			if value == nil {
+				delete(currentConfig.Options, name)
+			}
+		}
+		for _, path := range currentConfig.TrackingPaths {
+			if !slices.Contains(paths, path) {
+				paths = append(paths, path)
+				fragmentTrackingPaths[path] = true
+			}
+		}
+		currentConfig.TrackingPaths = paths
+
+		if _, err := recordConfigSources(fragment, data, configOverlay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// overrideConfigValue records that the top-level value key was set to value
+// by source for this run only. Like the values of fragments, it isn't written
+// back to ~/.dotpilotrc unless changed since.
+func overrideConfigValue(key string, value interface{}, source string) {
+	if configOverlay == nil {
+		configOverlay = map[string]interface{}{}
+	}
+	if configSources == nil {
+		configSources = map[string]ConfigValue{}
+	}
+	configOverlay[key] = value
+	configSources[key] = ConfigValue{Key: key, Value: value, Source: source}
+}
+
+// recordConfigSources notes the values data, read from path, sets as coming
+// from path and, if overlay isn't nil, adds them to it. It returns data as a
+// generic map.
+func recordConfigSources(path string, data []byte, overlay map[string]interface{}) (map[string]interface{}, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for key, value := range raw {
+		switch key {
+		case "options":
+			options, _ := value.(map[string]interface{})
+			for name, value := range options {
+				configSources["options."+name] = ConfigValue{Key: "options." + name, Value: value, Source: path}
+				if overlay != nil {
+					overlay["options."+name] = value
+				}
+			}
+		case "tracking_paths":
+			paths, _ := value.([]interface{})
+			for _, p := range paths {
+				if !trackingPathRecorded(p) {
+					trackingPathSources = append(trackingPathSources, ConfigValue{Key: key, Value: p, Source: path})
+				}
+			}
+		default:
+			configSources[key] = ConfigValue{Key: key, Value: value, Source: path}
+			if overlay != nil {
+				overlay[key] = value
+			}
+		}
+	}
+	return raw, nil
+}
+
+// trackingPathRecorded reports whether an earlier file named path already
+func trackingPathRecorded(path interface{}) bool {
+	for _, value := range trackingPathSources {
+		if value.Value == path {
+			return true
+		}
+	}
+	return false
+}
+
+// unmergedConfig returns currentConfig with the values that came from
+// fragments, and weren't changed since, set back to those of ~/.dotpilotrc
+func unmergedConfig() (Config, error) {
+	if configOverlay == nil {
+		return currentConfig, nil
+	}
+
+	data, err := json.Marshal(currentConfig)
+	if err != nil {
+		return Config{}, err
+	}
+	var merged map[string]interface{}
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return Config{}, err
+	}
+
+	options, _ := merged["options"].(map[string]interface{})
+	baseOptions, _ := configBase["options"].(map[string]interface{})
+	for key, value := range configOverlay {
+		if name := strings.TrimPrefix(key, "options."); name != key {
+			if options != nil {
+				restoreBaseValue(options, baseOptions, name, value)
+			}
+			continue
+		}
+		restoreBaseValue(merged, configBase, key, value)
+	}
+
+	if paths, ok := merged["tracking_paths"].([]interface{}); ok {
+		kept := []interface{}{}
+		for _, path := range paths {
+			if p, _ := path.(string); !fragmentTrackingPaths[p] {
+				kept = append(kept, path)
+			}
+		}
+		merged["tracking_paths"] = kept
+	}
+
+	if data, err = json.Marshal(merged); err != nil {
+		return Config{}, err
+	}
+	var config Config
+	err = json.Unmarshal(data, &config)
+	return config, err
+}
+
+// restoreBaseValue sets key of current back to its value in base, or removes
+// it, if it still holds the value a fragment gave it
+func restoreBaseValue(current, base map[string]interface{}, key string, fragmentValue interface{}) {
+	if !reflect.DeepEqual(current[key], fragmentValue) {
+		return
+	}
+	if value, ok := base[key]; ok {
+		current[key] = value
+	} else {
+		delete(current, key)
+	}
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigFragments(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	saved := currentConfig
+	defer func() { currentConfig = saved; resetConfigFragments() }()
+	currentConfig = Config{}
+
+	configPath := filepath.Join(home, ".dotpilotrc")
+	writeRepoFile(t, home, ".dotpilotrc", `{
+  "current_environment": "default",
+  "tracking_paths": ["~/.zshrc"],
+  "options": {"prompt_on_diff": true, "layer_order": ["common", "env"]}
+}`)
+	writeRepoFile(t, home, ".dotpilot/config.d/20-local.json", `{"options": {"auto_commit": "never"}}`)
+	writeRepoFile(t, home, ".dotpilot/config.d/10-work.json", `{
+  "current_environment": "work",
+  "tracking_paths": ["~/.zshrc", "~/.gitconfig"],
+  "options": {"prompt_on_diff": null, "auto_commit": "prompt"}
+}`)
+
+	if err := LoadConfig(configPath); err != nil {
+		t.Fatal(err)
+	}
+	config := GetConfig()
+	if config.CurrentEnvironment != "work" {
+		t.Errorf("environment %q, want the fragment's", config.CurrentEnvironment)
+	}
+	if want := []string{"~/.zshrc", "~/.gitconfig"}; !reflect.DeepEqual(config.TrackingPaths, want) {
+		t.Errorf("tracking paths %v, want %v", config.TrackingPaths, want)
+	}
+	if _, ok := config.Options["prompt_on_diff"]; ok {
+		t.Error("null in a fragment didn't remove the option")
+	}
+	if config.Options["auto_commit"] != "never" || config.Options["layer_order"] == nil {
+		t.Errorf("options %v", config.Options)
+	}
+
+	sources := map[string]string{}
+	for _, value := range ConfigSources() {
+		if value.Key == "tracking_paths" {
+			sources[value.Value.(string)] = filepath.Base(value.Source)
+			continue
+		}
+		sources[value.Key] = filepath.Base(value.Source)
+	}
+	want := map[string]string{
+		"current_environment":    "10-work.json",
+		"options.prompt_on_diff": "10-work.json",
+		"options.auto_commit":    "20-local.json",
+		"options.layer_order":    ".dotpilotrc",
+		"~/.zshrc":               ".dotpilotrc",
+		"~/.gitconfig":           "10-work.json",
+	}
+	if !reflect.DeepEqual(sources, want) {
+		t.Errorf("sources %v, want %v", sources, want)
+	}
+
+	// Saving keeps the fragment values out of ~/.dotpilotrc, but not changes
+	currentConfig.SparsePaths = []string{"common"}
+	currentConfig.Options["relative_symlinks"] = true
+	if err := SaveConfig(configPath); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written Config
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	if written.CurrentEnvironment != "default" || !reflect.DeepEqual(written.TrackingPaths, []string{"~/.zshrc"}) {
+		t.Errorf("fragment values written back: %s", data)
+	}
+	if _, ok := written.Options["auto_commit"]; ok || written.Options["prompt_on_diff"] != true || written.Options["relative_symlinks"] != true {
+		t.Errorf("options written %v", written.Options)
+	}
+	if !reflect.DeepEqual(written.SparsePaths, []string{"common"}) {
+		t.Errorf("sparse paths written %v", written.SparsePaths)
+	}
+}
@@ -3,10 +3,13 @@ package core
 import (
         "bufio"
         "fmt"
+        "io"
         "os"
-        "os/exec"
         "path/filepath"
+        "runtime"
+        "sort"
         "strings"
+        "sync"
         "time"
 
         "github.com/dotpilot/utils"
@@ -34,42 +37,117 @@ type ConflictFile struct {
         RemotePath string
         Target     string
         Diff       string
+        // Directory is set when a directory with files in it is where the
+        // repo file is applied, see resolveDirectoryConflict
+        Directory bool
+        // Kind classifies the conflict for the summary of an interactive
+        // resolution, it is worked out from the files if empty
+        Kind ConflictKind
+        // Stashed is set when LocalPath is a stashed version, see PopStash. It
+        // stays on StashRef unless it is kept, so it isn't backed up.
+        Stashed bool
 }
 
-// ResolveConflicts identifies and resolves conflicts between local and remote files
-func ResolveConflicts(dotpilotDir string, strategy ConflictResolutionStrategy) error {
-        // Get the current list of conflicts
-        conflicts, err := detectConflicts(dotpilotDir)
+// ResolveConflicts identifies and resolves conflicts between local and remote
+// files. The decision made for each conflict is recorded in an audit log below
+// the logs/ directory of the repository, see writeConflictLog.
+func ResolveConflicts(dotpilotDir string, strategy ConflictResolutionStrategy) (ConflictReport, error) {
+        var report ConflictReport
+
+        // Show progress while scanning, unless output is redirected
+        var indicator *utils.ProgressIndicator
+        var progress func(done, total int)
+        if utils.IsTerminal() {
+                indicator = utils.NewProgressIndicator("Scanning for conflicts...", utils.Bar)
+                indicator.Start()
+                progress = func(done, total int) {
+                        indicator.UpdateProgress(done, total)
+                }
+        }
+
+        // Get the current list of conflicts. The indicator is stopped before
+        // resolving, its redraws would run over the prompts.
+        conflicts, err := detectConflicts(dotpilotDir, progress)
+        if indicator != nil {
+                indicator.Stop()
+        }
         if err != nil {
-                return err
+                return report, err
         }
 
         if len(conflicts) == 0 {
                 utils.Logger.Info().Msg("No conflicts detected")
-                return nil
+                return report, nil
         }
 
         utils.Logger.Info().Msgf("Detected %d conflicts", len(conflicts))
 
+        report.Decisions, err = ResolveConflictList(conflicts, strategy)
+        report.LogPath = writeConflictLog(dotpilotDir, strategy, report.Decisions)
+        return report, err
+}
+
+// ResolveConflictList resolves an already collected list of conflicts and
+// returns the decision made for each. Every conflict is attempted; the ones
+// that fail are reported in a ConflictError. An interactive resolution first
+// shows a summary of the conflicts and offers to keep the remote version of
+// all of them or of one kind, see chooseBulkResolution; aborting there skips
+// them all and returns ErrConflictsAborted.
+func ResolveConflictList(conflicts []ConflictFile, strategy ConflictResolutionStrategy) ([]ConflictDecision, error) {
+        return resolveConflictList(conflicts, strategy, bufio.NewReader(os.Stdin), os.Stdout)
+}
+
+// resolveConflictList is ResolveConflictList reading the answers about the
+// conflicts as a whole from in
+func resolveConflictList(conflicts []ConflictFile, strategy ConflictResolutionStrategy, in *bufio.Reader, out io.Writer) ([]ConflictDecision, error) {
+        var unresolved []string
+        decisions := make([]ConflictDecision, 0, len(conflicts))
+
+        var bulk bulkResolution
+        if strategy == StrategyInteractive && len(conflicts) > 0 {
+                var err error
+                if bulk, err = chooseBulkResolution(in, out, conflicts); err != nil {
+                        return nil, err
+                }
+        }
+        if bulk.abort {
+                for _, conflict := range conflicts {
+                        decisions = append(decisions, ConflictDecision{Target: conflict.Target, Strategy: strategy, Outcome: OutcomeSkipped})
+                }
+                return decisions, ErrConflictsAborted
+        }
+
         // Process each conflict according to the strategy
         for _, conflict := range conflicts {
                 utils.Logger.Info().Msgf("Resolving conflict for %s", conflict.Target)
-                
-                if err := resolveConflict(conflict, strategy); err != nil {
+
+                conflictStrategy := strategy
+                if bulk.keepRemote[conflict.kind()] {
+                        conflictStrategy = StrategyKeepRemote
+                }
+                decision, err := resolveConflict(conflict, conflictStrategy)
+                decision.Target = conflict.Target
+                decision.Strategy = conflictStrategy
+                if err != nil {
                         utils.Logger.Error().Err(err).Msgf("Failed to resolve conflict for %s", conflict.Target)
-                        continue
+                        decision.Outcome = OutcomeFailed
+                        decision.Error = err.Error()
+                        unresolved = append(unresolved, conflict.Target)
                 }
+                decisions = append(decisions, decision)
         }
 
-        return nil
+        if len(unresolved) > 0 {
+                return decisions, &ConflictError{Targets: unresolved}
+        }
+        return decisions, nil
 }
 
-// detectConflicts identifies files with potential conflicts
-func detectConflicts(dotpilotDir string) ([]ConflictFile, error) {
-        var conflicts []ConflictFile
-
+// detectConflicts identifies files with potential conflicts. progress, if not
+// nil, is called after each file has been checked.
+func detectConflicts(dotpilotDir string, progress func(done, total int)) ([]ConflictFile, error) {
         // Get home directory
-        home, err := os.UserHomeDir()
+        home, err := Home()
         if err != nil {
                 return nil, err
         }
@@ -81,153 +159,170 @@ func detectConflicts(dotpilotDir string) ([]ConflictFile, error) {
                 environment = "default"
         }
 
-        // Get hostname
-        hostname, err := os.Hostname()
+        // Check the files of the layers apply links, in the same order
+        layers, err := activeLayers(dotpilotDir, environment)
         if err != nil {
                 return nil, err
         }
 
-        // Collect files that might have conflicts
-        // We'll check files from all three layers:
-        // 1. Common
-        // 2. Environment-specific
-        // 3. Machine-specific
-        var allPaths []string
+        return scanConflicts(dotpilotDir, home, layers, progress)
+}
 
-        // 1. Common files
-        commonDir := filepath.Join(dotpilotDir, "common")
-        commonFiles, err := collectFiles(commonDir)
+// scanConflicts checks the files of layers for conflicts across a bounded
+// pool of workers. The files are handed to the workers as the walk finds
+// them, so the total passed to progress grows until the walk is done.
+// Results are sorted by target path so the order does not depend on
+// scheduling.
+func scanConflicts(dotpilotDir, home string, layers []string, progress func(done, total int)) ([]ConflictFile, error) {
+        var (
+                conflicts   []ConflictFile
+                mutex       sync.Mutex
+                wg          sync.WaitGroup
+                done, found int
+        )
+
+        jobs := make(chan string)
+        for i := 0; i < runtime.NumCPU(); i++ {
+                wg.Add(1)
+                go func() {
+                        defer wg.Done()
+                        for path := range jobs {
+                                conflict, ok := checkConflict(dotpilotDir, home, path)
+
+                                mutex.Lock()
+                                if ok {
+                                        conflicts = append(conflicts, conflict)
+                                }
+                                done++
+                                if progress != nil {
+                                        progress(done, found)
+                                }
+                                mutex.Unlock()
+                        }
+                }()
+        }
+
+        err := walkLayerDirs(dotpilotDir, layers, func(layer, repoPath string) error {
+                mutex.Lock()
+                found++
+                mutex.Unlock()
+                jobs <- filepath.Join(dotpilotDir, filepath.FromSlash(repoPath))
+                return nil
+        })
+        close(jobs)
+        wg.Wait()
         if err != nil {
                 return nil, err
         }
-        allPaths = append(allPaths, commonFiles...)
 
-        // 2. Environment-specific files
-        if environment != "" {
-                envDir := filepath.Join(dotpilotDir, "envs", environment)
-                envFiles, err := collectFiles(envDir)
-                if err != nil {
-                        return nil, err
-                }
-                allPaths = append(allPaths, envFiles...)
-        }
+        sort.Slice(conflicts, func(i, j int) bool {
+                return conflicts[i].Target < conflicts[j].Target
+        })
 
-        // 3. Machine-specific files
-        machineDir := filepath.Join(dotpilotDir, "machine", hostname)
-        machineFiles, err := collectFiles(machineDir)
+        return conflicts, nil
+}
+
+// checkConflict checks a single repo file against its target in the home
+// directory and reports whether the two conflict
+func checkConflict(dotpilotDir, home, path string) (ConflictFile, bool) {
+        // Get the slash-separated repo path
+        relPath, err := RepoPath(dotpilotDir, path)
         if err != nil {
-                return nil, err
+                utils.Logger.Error().Err(err).Msgf("Failed to get relative path for %s", path)
+                return ConflictFile{}, false
         }
-        allPaths = append(allPaths, machineFiles...)
 
-        // Check each file for conflicts
-        for _, path := range allPaths {
-                // Get relative path from dotpilotDir
-                relPath, err := filepath.Rel(dotpilotDir, path)
-                if err != nil {
-                        utils.Logger.Error().Err(err).Msgf("Failed to get relative path for %s", path)
-                        continue
-                }
+        // Skip special files and directories
+        if strings.HasPrefix(relPath, ".git") || relPath == "README.md" {
+                return ConflictFile{}, false
+        }
 
-                // Skip special files and directories
-                if strings.HasPrefix(relPath, ".git") || relPath == "README.md" {
-                        continue
-                }
+        // Skip paths outside the sparse include list
+        if !IsSparseIncluded(relPath) {
+                return ConflictFile{}, false
+        }
 
-                // Construct the target path in the home directory
-                // We need to determine which part of the path structure this is in
-                var targetPath string
+        // Construct the target path in the home directory from the layer
+        // (common, envs/<env> or machine/<hostname>) the file lives in
+        targetPath, ok := RepoPathToTarget(home, relPath)
+        if !ok {
+                return ConflictFile{}, false
+        }
 
-                // Extract the type of file (common, env, machine)
-                parts := strings.Split(relPath, string(os.PathSeparator))
-                if len(parts) < 2 {
-                        continue
-                }
+        // Check if the target exists and is not a symlink to our path
+        targetInfo, err := os.Lstat(targetPath)
+        if err != nil {
+                // Target doesn't exist, no conflict
+                return ConflictFile{}, false
+        }
 
-                // Determine the base directory based on the file type
-                switch parts[0] {
-                case "common":
-                        targetPath = filepath.Join(home, filepath.Join(parts[2:]...))
-                case "envs":
-                        if len(parts) < 3 {
-                                continue
-                        }
-                        targetPath = filepath.Join(home, filepath.Join(parts[3:]...))
-                case "machine":
-                        if len(parts) < 3 {
-                                continue
-                        }
-                        targetPath = filepath.Join(home, filepath.Join(parts[3:]...))
-                default:
-                        continue
-                }
+        // Tracked symlinks are recreated rather than linked to the repo file
+        linkSource, err := linkSourceFor(path)
+        if err != nil {
+                utils.Logger.Warn().Err(err).Msgf("Failed to read %s", path)
+                return ConflictFile{}, false
+        }
 
-                // Check if the target exists and is not a symlink to our path
-                targetInfo, err := os.Lstat(targetPath)
-                if err != nil {
-                        // Target doesn't exist, no conflict
-                        continue
+        isSymlink := targetInfo.Mode()&os.ModeSymlink != 0
+        if isSymlink {
+                // Check if symlink points to our dotpilot path
+                if linksTo(targetPath, linkSource) {
+                        // No conflict, symlink points to our file
+                        return ConflictFile{}, false
                 }
+        }
 
-                isSymlink := targetInfo.Mode()&os.ModeSymlink != 0
-                if isSymlink {
-                        // Check if symlink points to our dotpilot path
-                        linkTarget, err := os.Readlink(targetPath)
-                        if err == nil && linkTarget == path {
-                                // No conflict, symlink points to our file
-                                continue
-                        }
-                }
+        // No conflict either if a parent directory links into the repository
+        if resolvesTo(targetPath, path) {
+                return ConflictFile{}, false
+        }
 
-                // At this point, we have a potential conflict
-                // Get the diff for the user to see
-                diff, err := FileDiff(targetPath, path)
-                if err != nil {
-                        utils.Logger.Warn().Err(err).Msgf("Failed to get diff for %s", targetPath)
-                        diff = "Unable to generate diff"
+        // A directory in the way of the repo file can't be diffed, and apply
+        // only replaces an empty one
+        if targetInfo.IsDir() {
+                if isEmptyDir(targetPath) {
+                        return ConflictFile{}, false
                 }
-
-                conflicts = append(conflicts, ConflictFile{
+                return ConflictFile{
                         LocalPath:  targetPath,
                         RemotePath: path,
                         Target:     targetPath,
-                        Diff:       diff,
-                })
+                        Diff:       fmt.Sprintf("%s is a directory, the repository has the file %s in its place\n", targetPath, relPath),
+                        Directory:  true,
+                        Kind:       ConflictTypeMismatch,
+                }, true
         }
 
-        return conflicts, nil
-}
-
-// collectFiles recursively collects all files in a directory
-func collectFiles(dir string) ([]string, error) {
-        var files []string
-
-        // Check if directory exists
-        _, err := os.Stat(dir)
-        if os.IsNotExist(err) {
-                return files, nil
+        // Nor if the files only differ in line endings or whitespace, see
+        // LineEndings and IgnoreWhitespace
+        if !isSymlink && (LineEndings() != "" || IgnoreWhitespace() != "") && sameFileContent(targetPath, path) {
+                return ConflictFile{}, false
         }
 
-        // Walk through the directory
-        err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-                if err != nil {
-                        return err
-                }
-
-                // Skip directories
-                if info.IsDir() {
-                        return nil
-                }
-
-                files = append(files, path)
-                return nil
-        })
+        // At this point, we have a potential conflict
+        // Get the diff for the user to see
+        diff, err := FileDiff(targetPath, path)
+        if err != nil {
+                utils.Logger.Warn().Err(err).Msgf("Failed to get diff for %s", targetPath)
+                diff = "Unable to generate diff"
+        }
 
-        return files, err
+        return ConflictFile{
+                LocalPath:  targetPath,
+                RemotePath: path,
+                Target:     targetPath,
+                Diff:       diff,
+                Kind:       classifyConflict(targetPath, path),
+        }, true
 }
 
-// resolveConflict resolves a single conflict based on the strategy
-func resolveConflict(conflict ConflictFile, strategy ConflictResolutionStrategy) error {
+// resolveConflict resolves a single conflict based on the strategy and
+// returns the outcome
+func resolveConflict(conflict ConflictFile, strategy ConflictResolutionStrategy) (ConflictDecision, error) {
+        if conflict.Directory {
+                return resolveDirectoryConflict(conflict, strategy)
+        }
+
         switch strategy {
         case StrategyInteractive:
                 return resolveInteractive(conflict)
@@ -240,12 +335,42 @@ func resolveConflict(conflict ConflictFile, strategy ConflictResolutionStrategy)
         case StrategyBackupBoth:
                 return resolveBackupBoth(conflict)
         default:
-                return fmt.Errorf("unknown conflict resolution strategy: %s", strategy)
+                return ConflictDecision{}, fmt.Errorf("unknown conflict resolution strategy: %s", strategy)
+        }
+}
+
+// resolveDirectoryConflict resolves a conflict with a directory in the way of
+// a repo file. Nothing in the directory is ever deleted or merged: keeping
+// the remote version moves the whole directory aside before linking the repo
+// file, and the other strategies can't keep a directory in place of a file.
+func resolveDirectoryConflict(conflict ConflictFile, strategy ConflictResolutionStrategy) (ConflictDecision, error) {
+        switch strategy {
+        case StrategyKeepRemote:
+        case StrategyInteractive:
+                fmt.Printf("\nConflict detected for %s\n%s", conflict.Target, conflict.Diff)
+                if !utils.PromptYesNo(fmt.Sprintf("Move the directory %s aside and link the repo file in its place?", conflict.Target)) {
+                        utils.Logger.Info().Msgf("Skipping conflict for %s", conflict.Target)
+                        return ConflictDecision{Outcome: OutcomeSkipped}, nil
+                }
+        default:
+                return ConflictDecision{}, fmt.Errorf("%s is a directory and can't be kept in place of the repo file %s, use the keep-remote strategy to move it aside, or move it yourself", conflict.Target, conflict.RemotePath)
         }
+
+        backupPath := backupPathFor(conflict.LocalPath)
+        if err := os.Rename(conflict.LocalPath, backupPath); err != nil {
+                return ConflictDecision{}, err
+        }
+        utils.Logger.Info().Msgf("Moved the directory %s to %s", conflict.LocalPath, backupPath)
+        pruneBackupsOf(conflict.LocalPath)
+
+        if err := updateSymlink(conflict.RemotePath, conflict.LocalPath); err != nil {
+                return ConflictDecision{Backup: backupPath}, err
+        }
+        return ConflictDecision{Outcome: OutcomeKeptRemote, Backup: backupPath}, nil
 }
 
 // resolveInteractive prompts the user to resolve the conflict
-func resolveInteractive(conflict ConflictFile) error {
+func resolveInteractive(conflict ConflictFile) (ConflictDecision, error) {
         fmt.Printf("\nConflict detected for %s\n", conflict.Target)
         fmt.Printf("Diff:\n%s\n", conflict.Diff)
         fmt.Println("\nHow would you like to resolve this conflict?")
@@ -262,7 +387,7 @@ func resolveInteractive(conflict ConflictFile) error {
                 fmt.Print("\nEnter your choice (1-7): ")
                 choice, err := reader.ReadString('\n')
                 if err != nil {
-                        return err
+                        return ConflictDecision{}, err
                 }
 
                 choice = strings.TrimSpace(choice)
@@ -274,7 +399,7 @@ func resolveInteractive(conflict ConflictFile) error {
                 case "3":
                         return resolveMerge(conflict)
                 case "4":
-                        if err := viewDiffExternal(conflict); err != nil {
+                        if err := ViewDiffExternal(os.Stdout, nil, conflict.LocalPath, conflict.RemotePath, conflict.Diff); err != nil {
                                 utils.Logger.Error().Err(err).Msg("Failed to view diff in external tool")
                         }
                         // After viewing, ask again
@@ -289,7 +414,7 @@ func resolveInteractive(conflict ConflictFile) error {
                         return resolveBackupBoth(conflict)
                 case "7":
                         utils.Logger.Info().Msgf("Skipping conflict for %s", conflict.Target)
-                        return nil
+                        return ConflictDecision{Outcome: OutcomeSkipped}, nil
                 default:
                         fmt.Println("Invalid choice, please try again")
                 }
@@ -297,30 +422,33 @@ func resolveInteractive(conflict ConflictFile) error {
 }
 
 // resolveKeepLocal keeps the local version and updates the remote file
-func resolveKeepLocal(conflict ConflictFile) error {
+func resolveKeepLocal(conflict ConflictFile) (ConflictDecision, error) {
         utils.Logger.Info().Msgf("Keeping local version for %s", conflict.Target)
 
         // Copy the local file to remote
-        if err := copyFile(conflict.LocalPath, conflict.RemotePath, 0644); err != nil {
-                return err
+        if err := copyTextFile(conflict.LocalPath, conflict.RemotePath, 0644); err != nil {
+                return ConflictDecision{}, err
         }
 
         // Update the symlink
         if err := updateSymlink(conflict.RemotePath, conflict.LocalPath); err != nil {
-                return err
+                return ConflictDecision{}, err
         }
 
-        return nil
+        return ConflictDecision{Outcome: OutcomeKeptLocal}, nil
 }
 
 // resolveKeepRemote keeps the remote version and updates the local file
-func resolveKeepRemote(conflict ConflictFile) error {
+func resolveKeepRemote(conflict ConflictFile) (ConflictDecision, error) {
         utils.Logger.Info().Msgf("Keeping remote version for %s", conflict.Target)
 
         // Backup the local file
-        backupPath, err := BackupFile(conflict.LocalPath)
-        if err != nil {
-                return err
+        backupPath := ""
+        if !conflict.Stashed {
+                var err error
+                if backupPath, err = BackupFile(conflict.LocalPath); err != nil {
+                        return ConflictDecision{}, err
+                }
         }
         if backupPath != "" {
                 utils.Logger.Info().Msgf("Backed up local file to %s", backupPath)
@@ -328,95 +456,74 @@ func resolveKeepRemote(conflict ConflictFile) error {
 
         // Create symlink to remote file
         if err := updateSymlink(conflict.RemotePath, conflict.LocalPath); err != nil {
-                return err
+                return ConflictDecision{Backup: backupPath}, err
         }
 
-        return nil
+        return ConflictDecision{Outcome: OutcomeKeptRemote, Backup: backupPath}, nil
 }
 
 // resolveMerge attempts to merge changes using an external merge tool
-func resolveMerge(conflict ConflictFile) error {
+func resolveMerge(conflict ConflictFile) (ConflictDecision, error) {
         utils.Logger.Info().Msgf("Attempting to merge changes for %s", conflict.Target)
 
-        // Check if we have common merge tools installed
-        mergeTools := []string{"meld", "kdiff3", "vimdiff", "code -d"}
-        selectedTool := ""
-
-        for _, tool := range mergeTools {
-                // Extract the command (part before any space)
-                cmd := strings.Split(tool, " ")[0]
-                _, err := exec.LookPath(cmd)
-                if err == nil {
-                        selectedTool = tool
-                        break
-                }
+        // Use the configured merge tool, or a common one that is installed
+        selectedTool, err := externalTool("merge_tool", defaultMergeTools)
+        if err != nil {
+                return ConflictDecision{}, err
         }
-
-        if selectedTool == "" {
-                return fmt.Errorf("no merge tool found, please install a merge tool (meld, kdiff3, vimdiff)")
+        if selectedTool == nil {
+                return ConflictDecision{}, fmt.Errorf("no merge tool found, please install a merge tool (meld, kdiff3, vimdiff) or set the merge_tool option")
         }
 
         // Create a temporary file for the merged result
         mergedFile, err := os.CreateTemp("", "dotpilot-merge-*")
         if err != nil {
-                return err
+                return ConflictDecision{}, err
         }
         mergedPath := mergedFile.Name()
         mergedFile.Close()
+        defer utils.Cleanup.AddFile(mergedPath)()
 
         // Copy remote file to merged file as a starting point
         if err := copyFile(conflict.RemotePath, mergedPath, 0644); err != nil {
-                os.Remove(mergedPath)
-                return err
-        }
-
-        // Build the merge command
-        var cmdParts []string
-        if selectedTool == "vimdiff" {
-                cmdParts = []string{selectedTool, conflict.LocalPath, mergedPath, conflict.RemotePath}
-        } else {
-                // General format for most merge tools
-                cmdParts = strings.Split(selectedTool, " ")
-                cmdParts = append(cmdParts, conflict.LocalPath, mergedPath, conflict.RemotePath)
+                utils.ShredFile(mergedPath)
+                return ConflictDecision{}, err
         }
 
         // Execute the merge tool
-        cmd := exec.Command(cmdParts[0], cmdParts[1:]...)
-        cmd.Stdin = os.Stdin
-        cmd.Stdout = os.Stdout
-        cmd.Stderr = os.Stderr
+        cmd := toolCommand(selectedTool, conflict.LocalPath, mergedPath, conflict.RemotePath)
 
-        utils.Logger.Info().Msgf("Launching merge tool: %s", strings.Join(cmdParts, " "))
+        utils.Logger.Info().Msgf("Launching merge tool: %q", cmd.Args)
         if err := cmd.Run(); err != nil {
-                os.Remove(mergedPath)
-                return err
+                utils.ShredFile(mergedPath)
+                return ConflictDecision{}, err
         }
 
         // After the merge tool completes, copy the merged result to both local and remote
         if err := copyFile(mergedPath, conflict.LocalPath, 0644); err != nil {
-                os.Remove(mergedPath)
-                return err
+                utils.ShredFile(mergedPath)
+                return ConflictDecision{}, err
         }
 
         if err := copyFile(mergedPath, conflict.RemotePath, 0644); err != nil {
-                os.Remove(mergedPath)
-                return err
+                utils.ShredFile(mergedPath)
+                return ConflictDecision{}, err
         }
 
         // Clean up
-        os.Remove(mergedPath)
+        utils.ShredFile(mergedPath)
 
         // Update the symlink
         if err := updateSymlink(conflict.RemotePath, conflict.LocalPath); err != nil {
-                return err
+                return ConflictDecision{}, err
         }
 
         utils.Logger.Info().Msgf("Successfully merged changes for %s", conflict.Target)
-        return nil
+        return ConflictDecision{Outcome: OutcomeMerged}, nil
 }
 
 // resolveBackupBoth keeps both versions with the remote in dotpilot and the local as-is
-func resolveBackupBoth(conflict ConflictFile) error {
+func resolveBackupBoth(conflict ConflictFile) (ConflictDecision, error) {
         utils.Logger.Info().Msgf("Keeping both versions for %s", conflict.Target)
 
         // Generate a unique backup name for the remote file
@@ -426,70 +533,21 @@ func resolveBackupBoth(conflict ConflictFile) error {
 
         // Copy the local file to the backup location in dotpilot
         if err := copyFile(conflict.LocalPath, backupPath, 0644); err != nil {
-                return err
+                return ConflictDecision{}, err
         }
 
         utils.Logger.Info().Msgf("Created backup of local file at %s", backupPath)
         utils.Logger.Info().Msgf("Original remote file remains at %s", conflict.RemotePath)
         utils.Logger.Info().Msgf("Local file remains at %s", conflict.LocalPath)
 
-        return nil
-}
-
-// viewDiffExternal shows the diff in an external diff tool
-func viewDiffExternal(conflict ConflictFile) error {
-        // Check for available diff tools
-        diffTools := []string{"meld", "kdiff3", "vimdiff", "code -d", "diff -u"}
-        selectedTool := ""
-
-        for _, tool := range diffTools {
-                // Extract the command (part before any space)
-                cmd := strings.Split(tool, " ")[0]
-                _, err := exec.LookPath(cmd)
-                if err == nil {
-                        selectedTool = tool
-                        break
-                }
-        }
-
-        if selectedTool == "" {
-                // Fallback to printing the diff
-                fmt.Printf("Diff between %s and %s:\n%s\n", conflict.LocalPath, conflict.RemotePath, conflict.Diff)
-                return nil
-        }
-
-        // Build the diff command
-        cmdParts := strings.Split(selectedTool, " ")
-        cmdParts = append(cmdParts, conflict.LocalPath, conflict.RemotePath)
-
-        // Execute the diff tool
-        cmd := exec.Command(cmdParts[0], cmdParts[1:]...)
-        cmd.Stdin = os.Stdin
-        cmd.Stdout = os.Stdout
-        cmd.Stderr = os.Stderr
-
-        utils.Logger.Info().Msgf("Launching diff tool: %s", strings.Join(cmdParts, " "))
-        return cmd.Run()
+        return ConflictDecision{Outcome: OutcomeBackedUp, Backup: backupPath}, nil
 }
 
 // editFileManually opens the file in an editor for manual editing
 func editFileManually(conflict ConflictFile) error {
-        // Try to find an editor
-        editor := os.Getenv("EDITOR")
-        if editor == "" {
-                // Try common editors
-                editors := []string{"nano", "vim", "vi", "emacs", "code"}
-                for _, ed := range editors {
-                        _, err := exec.LookPath(ed)
-                        if err == nil {
-                                editor = ed
-                                break
-                        }
-                }
-        }
-
-        if editor == "" {
-                return fmt.Errorf("no editor found, please set the EDITOR environment variable")
+        // Fail before copying anything if there is no editor
+        if _, err := utils.ResolveEditor(); err != nil {
+                return err
         }
 
         // Create a temporary file with the content
@@ -499,22 +557,17 @@ func editFileManually(conflict ConflictFile) error {
         }
         tmpPath := tmpFile.Name()
         tmpFile.Close()
+        defer utils.Cleanup.AddFile(tmpPath)()
 
         // Copy the remote file as a starting point
         if err := copyFile(conflict.RemotePath, tmpPath, 0644); err != nil {
-                os.Remove(tmpPath)
+                utils.ShredFile(tmpPath)
                 return err
         }
 
         // Open the editor
-        cmd := exec.Command(editor, tmpPath)
-        cmd.Stdin = os.Stdin
-        cmd.Stdout = os.Stdout
-        cmd.Stderr = os.Stderr
-
-        utils.Logger.Info().Msgf("Opening %s in %s", tmpPath, editor)
-        if err := cmd.Run(); err != nil {
-                os.Remove(tmpPath)
+        if err := utils.EditFile(tmpPath); err != nil {
+                utils.ShredFile(tmpPath)
                 return err
         }
 
@@ -523,7 +576,7 @@ func editFileManually(conflict ConflictFile) error {
         fmt.Print("Use this edited version? (y/n): ")
         response, err := reader.ReadString('\n')
         if err != nil {
-                os.Remove(tmpPath)
+                utils.ShredFile(tmpPath)
                 return err
         }
 
@@ -531,18 +584,18 @@ func editFileManually(conflict ConflictFile) error {
         if response == "y" || response == "yes" {
                 // Copy the edited file to both local and remote
                 if err := copyFile(tmpPath, conflict.LocalPath, 0644); err != nil {
-                        os.Remove(tmpPath)
+                        utils.ShredFile(tmpPath)
                         return err
                 }
 
                 if err := copyFile(tmpPath, conflict.RemotePath, 0644); err != nil {
-                        os.Remove(tmpPath)
+                        utils.ShredFile(tmpPath)
                         return err
                 }
 
                 // Update the symlink
                 if err := updateSymlink(conflict.RemotePath, conflict.LocalPath); err != nil {
-                        os.Remove(tmpPath)
+                        utils.ShredFile(tmpPath)
                         return err
                 }
 
@@ -552,11 +605,12 @@ func editFileManually(conflict ConflictFile) error {
         }
 
         // Clean up
-        os.Remove(tmpPath)
+        utils.ShredFile(tmpPath)
         return nil
 }
 
-// updateSymlink creates or updates a symlink
+// updateSymlink creates or updates a symlink, relative with
+// Options["relative_symlinks"]
 func updateSymlink(source, target string) error {
         // Remove the target if it exists
         _, err := os.Lstat(target)
@@ -567,5 +621,5 @@ func updateSymlink(source, target string) error {
         }
 
         // Create symlink
-        return os.Symlink(source, target)
+        return EnsureSymlink(target, symlinkContent(target, source, RelativeSymlinks()))
 }
\ No newline at end of file
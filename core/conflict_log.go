@@ -0,0 +1,130 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dotpilot/utils"
+)
+
+// logsDir is the directory of the repository holding dotpilot's logs, ignored
+// by the managed .gitignore
+const logsDir = "logs"
+
+// ConflictOutcome is what resolving a conflict did to it
+type ConflictOutcome string
+
+const (
+	OutcomeKeptLocal  ConflictOutcome = "kept-local"  // The local version replaced the repo file
+	OutcomeKeptRemote ConflictOutcome = "kept-remote" // The local file was backed up and linked to the repo file
+	OutcomeMerged     ConflictOutcome = "merged"      // Both were replaced by the merge result
+	OutcomeBackedUp   ConflictOutcome = "backed-up"   // A copy of the local version was added next to the repo file
+	OutcomeSkipped    ConflictOutcome = "skipped"     // Left alone when asked
+	OutcomeFailed     ConflictOutcome = "failed"      // Resolving failed, the conflict remains
+)
+
+// ConflictDecision records how one conflict was resolved
+type ConflictDecision struct {
+	Target   string                     `json:"target"`
+	Strategy ConflictResolutionStrategy `json:"strategy"`
+	Outcome  ConflictOutcome            `json:"outcome"`
+	Backup   string                     `json:"backup,omitempty"` // Copy of the version that was replaced, if one was made
+	Error    string                     `json:"error,omitempty"`
+}
+
+// ConflictReport is what ResolveConflicts did
+type ConflictReport struct {
+	Decisions []ConflictDecision
+	// LogPath is the audit log the decisions were written to, empty if
+	// there were no conflicts or the log couldn't be written
+	LogPath string
+}
+
+// Resolved returns the targets whose conflict was resolved
+func (r ConflictReport) Resolved() []string {
+	var targets []string
+	for _, d := range r.Decisions {
+		if d.Outcome != OutcomeFailed && d.Outcome != OutcomeSkipped {
+			targets = append(targets, d.Target)
+		}
+	}
+	return targets
+}
+
+// Failed returns the targets whose conflict failed to resolve
+func (r ConflictReport) Failed() []string {
+	return r.targetsWith(OutcomeFailed)
+}
+
+// Skipped returns the targets whose conflict was skipped when asked
+func (r ConflictReport) Skipped() []string {
+	return r.targetsWith(OutcomeSkipped)
+}
+
+// targetsWith returns the targets of the decisions with outcome
+func (r ConflictReport) targetsWith(outcome ConflictOutcome) []string {
+	var targets []string
+	for _, d := range r.Decisions {
+		if d.Outcome == outcome {
+			targets = append(targets, d.Target)
+		}
+	}
+	return targets
+}
+
+// writeConflictLog writes decisions to logs/conflicts-<timestamp>.log in the
+// repository and returns its path. Failing to write the log only logs a
+// warning, the conflicts are resolved either way.
+func writeConflictLog(dotpilotDir string, strategy ConflictResolutionStrategy, decisions []ConflictDecision) string {
+	if len(decisions) == 0 {
+		return ""
+	}
+
+	now := time.Now()
+	path := filepath.Join(dotpilotDir, logsDir, "conflicts-"+now.Format("20060102150405")+".log")
+	err := func() error {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		// Runs within the same second share a log
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(f, "# dotpilot conflict resolution at %s with strategy %s\n", now.Format(time.RFC3339), strategy)
+		if err := WriteConflictTable(f, decisions); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}()
+	if err != nil {
+		utils.Logger.Warn().Err(err).Msgf("Failed to write the conflict log %s", path)
+		return ""
+	}
+	utils.Logger.Info().Msgf("Recorded %d conflict decisions in %s", len(decisions), path)
+	return path
+}
+
+// WriteConflictTable writes decisions to w as a table with a row per
+// conflict
+func WriteConflictTable(w io.Writer, decisions []ConflictDecision) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tSTRATEGY\tOUTCOME\tBACKUP")
+	for _, d := range decisions {
+		backup := d.Backup
+		if backup == "" {
+			backup = "-"
+		}
+		outcome := string(d.Outcome)
+		if d.Error != "" {
+			outcome += " (" + d.Error + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", d.Target, d.Strategy, outcome, backup)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,148 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// ConflictKind classifies a conflict for the summary shown before an
+// interactive resolution
+type ConflictKind string
+
+const (
+	ConflictContent      ConflictKind = "content"       // Two text files with different content
+	ConflictTypeMismatch ConflictKind = "type-mismatch" // A directory, broken link or tracked symlink on one side only
+	ConflictBinary       ConflictKind = "binary"        // Either version is a binary file
+)
+
+// ConflictKinds are the kinds of conflicts in the order they are summarized
+var ConflictKinds = []ConflictKind{ConflictContent, ConflictTypeMismatch, ConflictBinary}
+
+// classifyConflict returns the kind of the conflict between the local file
+// and the repo file remote
+func classifyConflict(local, remote string) ConflictKind {
+	info, err := os.Stat(local)
+	if err != nil || !info.Mode().IsRegular() {
+		return ConflictTypeMismatch
+	}
+
+	// A tracked symlink differs in where it points, unless the local file
+	// isn't a link at all
+	if isSymlinkDescriptor(remote) {
+		if link, err := os.Lstat(local); err == nil && link.Mode()&os.ModeSymlink != 0 {
+			return ConflictContent
+		}
+		return ConflictTypeMismatch
+	}
+
+	for _, path := range []string{local, remote} {
+		data, err := os.ReadFile(path)
+		if err == nil && !isText(data) {
+			return ConflictBinary
+		}
+	}
+	return ConflictContent
+}
+
+// kind returns the kind of the conflict, classifying it if detection didn't
+func (c ConflictFile) kind() ConflictKind {
+	if c.Kind != "" {
+		return c.Kind
+	}
+	if c.Directory {
+		return ConflictTypeMismatch
+	}
+	return classifyConflict(c.LocalPath, c.RemotePath)
+}
+
+// CountConflictKinds returns how many of conflicts there are of each kind
+func CountConflictKinds(conflicts []ConflictFile) map[ConflictKind]int {
+	counts := make(map[ConflictKind]int)
+	for _, c := range conflicts {
+		counts[c.kind()]++
+	}
+	return counts
+}
+
+// WriteConflictSummary writes the number of conflicts, by kind, and a table
+// of their targets to w
+func WriteConflictSummary(w io.Writer, conflicts []ConflictFile) error {
+	counts := CountConflictKinds(conflicts)
+	var kinds []string
+	for _, kind := range ConflictKinds {
+		if counts[kind] > 0 {
+			kinds = append(kinds, fmt.Sprintf("%d %s", counts[kind], kind))
+		}
+	}
+	fmt.Fprintf(w, "%d conflicts: %s\n\n", len(conflicts), strings.Join(kinds, ", "))
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range conflicts {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.Target, c.kind())
+	}
+	return tw.Flush()
+}
+
+// bulkResolution is what the user chose to do with the conflicts of an
+// interactive resolution as a whole
+type bulkResolution struct {
+	abort bool
+	// keepRemote are the kinds of conflicts that keep the remote version
+	// without asking, the others are asked about one by one
+	keepRemote map[ConflictKind]bool
+}
+
+// chooseBulkResolution shows a summary of conflicts on out and asks whether
+// to keep the remote version of all of them, or of those of one kind, to
+// resolve each one individually, or to abort
+func chooseBulkResolution(in *bufio.Reader, out io.Writer, conflicts []ConflictFile) (bulkResolution, error) {
+	fmt.Fprintln(out)
+	if err := WriteConflictSummary(out, conflicts); err != nil {
+		return bulkResolution{}, err
+	}
+
+	type option struct {
+		label      string
+		resolution bulkResolution
+	}
+	all := make(map[ConflictKind]bool)
+	for _, kind := range ConflictKinds {
+		all[kind] = true
+	}
+	options := []option{{fmt.Sprintf("Keep the remote version of all %d", len(conflicts)), bulkResolution{keepRemote: all}}}
+	counts := CountConflictKinds(conflicts)
+	if len(counts) > 1 {
+		for _, kind := range ConflictKinds {
+			if counts[kind] > 0 {
+				label := fmt.Sprintf("Keep the remote version of the %d %s conflicts, resolve the others individually", counts[kind], kind)
+				options = append(options, option{label, bulkResolution{keepRemote: map[ConflictKind]bool{kind: true}}})
+			}
+		}
+	}
+	options = append(options,
+		option{"Resolve each one individually", bulkResolution{}},
+		option{"Abort without changing anything", bulkResolution{abort: true}},
+	)
+
+	fmt.Fprintln(out, "\nHow would you like to resolve them?")
+	for i, o := range options {
+		fmt.Fprintf(out, "%d) %s\n", i+1, o.label)
+	}
+	for {
+		fmt.Fprintf(out, "\nEnter your choice (1-%d): ", len(options))
+		response, err := in.ReadString('\n')
+		if err != nil && response == "" {
+			return bulkResolution{}, err
+		}
+		choice, err := strconv.Atoi(strings.TrimSpace(response))
+		if err == nil && choice >= 1 && choice <= len(options) {
+			return options[choice-1].resolution, nil
+		}
+		fmt.Fprintln(out, "Invalid choice, please try again")
+	}
+}
@@ -0,0 +1,333 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// makeConflictTree creates a repo with n files in the default environment and
+// a near-identical regular file for each of them in the home directory
+func makeConflictTree(tb testing.TB, n int) string {
+	tb.Helper()
+
+	home := tb.TempDir()
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	repoDir := filepath.Join(dotpilotDir, "envs", "default")
+	if err := os.MkdirAll(repoDir, 0755); err != nil {
+		tb.Fatal(err)
+	}
+
+	body := strings.Repeat("export SOME_SETTING=value\n", 200)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("file%04d", i)
+		if err := os.WriteFile(filepath.Join(repoDir, name), []byte(body+"repo\n"), 0644); err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(home, name), []byte(body+"local\n"), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return dotpilotDir
+}
+
+func TestDetectConflictsSorted(t *testing.T) {
+	dotpilotDir := makeConflictTree(t, 50)
+	t.Setenv("HOME", filepath.Dir(dotpilotDir))
+
+	calls := 0
+	conflicts, err := detectConflicts(dotpilotDir, func(done, total int) {
+		calls++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conflicts) != 50 {
+		t.Fatalf("expected 50 conflicts, got %d", len(conflicts))
+	}
+	if calls != 50 {
+		t.Errorf("expected 50 progress updates, got %d", calls)
+	}
+	if !sort.SliceIsSorted(conflicts, func(i, j int) bool {
+		return conflicts[i].Target < conflicts[j].Target
+	}) {
+		t.Error("conflicts are not sorted by target")
+	}
+}
+
+func BenchmarkDetectConflicts(b *testing.B) {
+	dotpilotDir := makeConflictTree(b, 500)
+	b.Setenv("HOME", filepath.Dir(dotpilotDir))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := detectConflicts(dotpilotDir, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestResolveConflictsAuditLog(t *testing.T) {
+	dotpilotDir := makeConflictTree(t, 2)
+	home := filepath.Dir(dotpilotDir)
+	t.Setenv("HOME", home)
+
+	report, err := ResolveConflicts(dotpilotDir, StrategyKeepRemote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Decisions) != 2 {
+		t.Fatalf("expected 2 decisions, got %+v", report.Decisions)
+	}
+	for _, d := range report.Decisions {
+		if d.Strategy != StrategyKeepRemote || d.Outcome != OutcomeKeptRemote {
+			t.Errorf("decision for %s = %s/%s, want keep-remote/kept-remote", d.Target, d.Strategy, d.Outcome)
+		}
+		if _, err := os.Stat(d.Backup); err != nil {
+			t.Errorf("backup of %s: %v", d.Target, err)
+		}
+	}
+
+	if filepath.Dir(report.LogPath) != filepath.Join(dotpilotDir, "logs") || !strings.HasPrefix(filepath.Base(report.LogPath), "conflicts-") {
+		t.Fatalf("unexpected log path %s", report.LogPath)
+	}
+	data, err := os.ReadFile(report.LogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range report.Decisions {
+		if !strings.Contains(string(data), d.Target) || !strings.Contains(string(data), d.Backup) {
+			t.Errorf("log doesn't record %s:\n%s", d.Target, data)
+		}
+	}
+	if !strings.Contains(string(data), "kept-remote") {
+		t.Errorf("log doesn't record the outcome:\n%s", data)
+	}
+}
+
+func TestResolveConflictListPartialFailure(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+
+	var conflicts []ConflictFile
+	for _, name := range []string{"a", "b", "c"} {
+		local := filepath.Join(dir, "home-"+name)
+		remote := filepath.Join(dir, "repo-"+name)
+		if err := os.WriteFile(remote, []byte("remote\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// The local file of b is missing, so keeping it fails
+		if name != "b" {
+			if err := os.WriteFile(local, []byte("local\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		conflicts = append(conflicts, ConflictFile{LocalPath: local, RemotePath: remote, Target: local})
+	}
+
+	decisions, err := ResolveConflictList(conflicts, StrategyKeepLocal)
+	var conflictErr *ConflictError
+	if !errors.As(err, &conflictErr) {
+		t.Fatalf("expected a ConflictError, got %v", err)
+	}
+	if want := []string{conflicts[1].Target}; !reflect.DeepEqual(conflictErr.Targets, want) {
+		t.Errorf("unresolved = %v, want %v", conflictErr.Targets, want)
+	}
+
+	report := ConflictReport{Decisions: decisions}
+	if want := []string{conflicts[0].Target, conflicts[2].Target}; !reflect.DeepEqual(report.Resolved(), want) {
+		t.Errorf("resolved = %v, want %v", report.Resolved(), want)
+	}
+	if want := []string{conflicts[1].Target}; !reflect.DeepEqual(report.Failed(), want) {
+		t.Errorf("failed = %v, want %v", report.Failed(), want)
+	}
+	if decisions[1].Error == "" {
+		t.Error("the failed decision has no error")
+	}
+	if data, _ := os.ReadFile(conflicts[2].RemotePath); string(data) != "local\n" {
+		t.Errorf("the conflict after the failed one wasn't resolved, repo file reads %q", data)
+	}
+}
+
+func TestResolveMergeToolWithSpaces(t *testing.T) {
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+
+	dir := t.TempDir()
+	tool := filepath.Join(dir, "My Tools", "merge tool")
+	script := "#!/bin/sh\n[ \"$1\" = --wait ] || exit 9\nprintf 'merged\\n' > \"$3\"\n"
+	writeRepoFile(t, dir, filepath.Join("My Tools", "merge tool"), script)
+	if err := os.Chmod(tool, 0755); err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join(dir, "local")
+	remote := filepath.Join(dir, "repo file")
+	writeRepoFile(t, dir, "local", "local\n")
+	writeRepoFile(t, dir, "repo file", "remote\n")
+
+	// The path with spaces is the program, not split into arguments
+	currentConfig.Options = map[string]interface{}{"merge_tool": []interface{}{tool, "--wait"}}
+	decision, err := resolveMerge(ConflictFile{LocalPath: local, RemotePath: remote, Target: local})
+	if err != nil || decision.Outcome != OutcomeMerged {
+		t.Fatalf("resolveMerge = %+v, %v", decision, err)
+	}
+	if data, _ := os.ReadFile(remote); string(data) != "merged\n" {
+		t.Errorf("repo file holds %q, want the merged result", data)
+	}
+	if target, _ := os.Readlink(local); target == "" {
+		t.Errorf("%s isn't linked to the repo file", local)
+	}
+
+	// A string is the whole path of the program
+	currentConfig.Options = map[string]interface{}{"diff_tool": tool}
+	if got, err := externalTool("diff_tool", defaultDiffTools); err != nil || !reflect.DeepEqual(got, []string{tool}) {
+		t.Errorf("externalTool = %q, %v, want %q", got, err, tool)
+	}
+	currentConfig.Options = map[string]interface{}{"merge_tool": []interface{}{filepath.Join(dir, "missing tool")}}
+	if _, err := externalTool("merge_tool", defaultMergeTools); err == nil {
+		t.Error("a merge tool that doesn't exist was accepted")
+	}
+}
+
+func TestViewDiffExternal(t *testing.T) {
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+
+	dir := t.TempDir()
+	tool := filepath.Join(dir, "difftool")
+	writeRepoFile(t, dir, "difftool", "#!/bin/sh\nprintf '%s\\n' \"$@\" > \""+filepath.Join(dir, "args")+"\"\n")
+	if err := os.Chmod(tool, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// A tool given wins over the configured one
+	currentConfig.Options = map[string]interface{}{"diff_tool": filepath.Join(dir, "missing tool")}
+	if err := ViewDiffExternal(io.Discard, []string{tool, "--wait"}, "repo", "home", ""); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "args")); string(data) != "--wait\nrepo\nhome\n" {
+		t.Errorf("the diff tool got %q", data)
+	}
+
+	// The program is taken whole, spaces and all
+	spaced := filepath.Join(dir, "my tools", "difftool")
+	writeRepoFile(t, dir, "my tools/difftool", "#!/bin/sh\nprintf '%s\\n' \"$@\" > \""+filepath.Join(dir, "args")+"\"\n")
+	if err := os.Chmod(spaced, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ViewDiffExternal(io.Discard, []string{spaced}, "repo", "home", ""); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "args")); string(data) != "repo\nhome\n" {
+		t.Errorf("the diff tool with a space in its path got %q", data)
+	}
+
+	if err := ViewDiffExternal(io.Discard, []string{filepath.Join(dir, "missing")}, "repo", "home", ""); err == nil {
+		t.Error("a diff tool that doesn't exist was accepted")
+	}
+
+	// Without any diff tool the diff is printed
+	t.Setenv("PATH", t.TempDir())
+	currentConfig.Options = map[string]interface{}{}
+	var out bytes.Buffer
+	if err := ViewDiffExternal(&out, nil, "repo", "home", "-a\n+b\n"); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "Diff between repo and home:\n-a\n+b\n\n" {
+		t.Errorf("printed %q", out.String())
+	}
+}
+
+func TestResolveConflictListBulk(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+
+	contents := map[string]string{"a": "text\n", "b": "more text\n", "c": "\x00\x01binary"}
+	newConflicts := func() []ConflictFile {
+		var conflicts []ConflictFile
+		for _, name := range []string{"a", "b", "c"} {
+			local := filepath.Join(dir, "home-"+name)
+			remote := filepath.Join(dir, "repo-"+name)
+			if err := os.WriteFile(remote, []byte("remote "+contents[name]), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(local, []byte(contents[name]), 0644); err != nil {
+				t.Fatal(err)
+			}
+			conflicts = append(conflicts, ConflictFile{LocalPath: local, RemotePath: remote, Target: local})
+		}
+		return conflicts
+	}
+
+	// The summary counts the conflicts by kind
+	var out strings.Builder
+	conflicts := newConflicts()
+	decisions, err := resolveConflictList(conflicts, StrategyInteractive, bufio.NewReader(strings.NewReader("9\n5\n")), &out)
+	if !errors.Is(err, ErrConflictsAborted) {
+		t.Fatalf("aborting returned %v", err)
+	}
+	for _, want := range []string{"3 conflicts: 2 content, 1 binary", conflicts[2].Target, "Keep the remote version of the 2 content conflicts", "Invalid choice"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("the summary doesn't show %q:\n%s", want, out.String())
+		}
+	}
+	for _, d := range decisions {
+		if d.Outcome != OutcomeSkipped {
+			t.Errorf("aborting resolved %s: %s", d.Target, d.Outcome)
+		}
+		if info, err := os.Lstat(d.Target); err != nil || !info.Mode().IsRegular() {
+			t.Errorf("aborting changed %s", d.Target)
+		}
+	}
+
+	// Keeping the remote version of all doesn't ask about any
+	decisions, err = resolveConflictList(conflicts, StrategyInteractive, bufio.NewReader(strings.NewReader("1\n")), &out)
+	if err != nil || len(decisions) != 3 {
+		t.Fatalf("resolveConflictList = %+v, %v", decisions, err)
+	}
+	for _, d := range decisions {
+		if d.Strategy != StrategyKeepRemote || d.Outcome != OutcomeKeptRemote {
+			t.Errorf("decision for %s = %s/%s, want keep-remote/kept-remote", d.Target, d.Strategy, d.Outcome)
+		}
+	}
+}
+
+func TestClassifyConflict(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	text, otherText, binary := write("text", "a\n"), write("other", "b\n"), write("binary", "\x00")
+	descriptor := write(".link"+symlinkSuffix, "target\n")
+
+	tests := []struct {
+		local, remote string
+		want          ConflictKind
+	}{
+		{text, otherText, ConflictContent},
+		{text, binary, ConflictBinary},
+		{binary, text, ConflictBinary},
+		{dir, text, ConflictTypeMismatch},
+		{filepath.Join(dir, "missing"), text, ConflictTypeMismatch},
+		{text, descriptor, ConflictTypeMismatch},
+	}
+	for _, tt := range tests {
+		if got := classifyConflict(tt.local, tt.remote); got != tt.want {
+			t.Errorf("classifyConflict(%s, %s) = %s, want %s", tt.local, tt.remote, got, tt.want)
+		}
+	}
+}
@@ -1,10 +1,19 @@
 package core
 
 import (
+	"os"
 	"testing"
 )
 
+func TestMain(m *testing.M) {
+	// Relocated XDG base directories of the user running the tests would
+	// send targets of the temporary home directories there
+	os.Unsetenv("XDG_CONFIG_HOME")
+	os.Unsetenv("XDG_DATA_HOME")
+	os.Exit(m.Run())
+}
+
 // TestDotpilotSanity is a simple test to verify that tests can run successfully
 func TestDotpilotSanity(t *testing.T) {
 	t.Log("DotPilot test running successfully")
-}
\ No newline at end of file
+}
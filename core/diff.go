@@ -0,0 +1,362 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dotpilot/utils"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// FileChange is the difference between two versions of a dotfile
+type FileChange struct {
+	RepoPath string // Slash-separated path relative to the dotpilot repository
+	Target   string // File in the home directory the repo path is applied to, if any
+	Diff     string // Unified diff from the old to the new version
+}
+
+// DiffReport is a changed file as shown by 'dotpilot diff'
+type DiffReport struct {
+	Path    string `json:"path"`  // Slash-separated path relative to the dotpilot repository
+	Layer   string `json:"layer"` // Layer of the file, see FileChange.Layer
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
+	Unified string `json:"unified"` // Unified diff from the old to the new version
+}
+
+// Report returns the change with its line counts, see Stat
+func (c FileChange) Report() DiffReport {
+	added, removed := c.Stat()
+	return DiffReport{Path: c.RepoPath, Layer: c.Layer(), Added: added, Removed: removed, Unified: c.Diff}
+}
+
+// Stat returns how many lines the diff of the change inserts and deletes,
+// like git diff --stat
+func (c FileChange) Stat() (insertions, deletions int) {
+	inHunk := false
+	for _, line := range strings.Split(c.Diff, "\n") {
+		// The ---/+++ header lines come before the first hunk
+		if strings.HasPrefix(line, "@@") {
+			inHunk = true
+			continue
+		}
+		if !inHunk || line == "" {
+			continue
+		}
+		switch line[0] {
+		case '+':
+			insertions++
+		case '-':
+			deletions++
+		}
+	}
+	return insertions, deletions
+}
+
+// Layer returns the layer the changed file belongs to, like "common",
+// "envs/dev" or "machine/laptop", or "other" for files outside the layers
+func (c FileChange) Layer() string {
+	return layerOf(c.RepoPath)
+}
+
+// diffLine is one line of a line diff
+type diffLine struct {
+	op   byte // ' ', '-' or '+'
+	text string
+}
+
+// UnifiedDiff returns a unified diff from one content to another, labelled
+// with fromName and toName, or "" if they are equal
+func UnifiedDiff(fromName, toName string, from, to []byte) string {
+	if bytes.Equal(from, to) {
+		return ""
+	}
+
+	// Flatten the diff into one entry per line
+	var lines []diffLine
+	for _, d := range diff.Do(string(from), string(to)) {
+		op := byte(' ')
+		switch d.Type {
+		case diffmatchpatch.DiffDelete:
+			op = '-'
+		case diffmatchpatch.DiffInsert:
+			op = '+'
+		}
+		for _, text := range strings.SplitAfter(d.Text, "\n") {
+			if text != "" {
+				lines = append(lines, diffLine{op: op, text: text})
+			}
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", fromName, toName)
+
+	// Group changes that are close enough to share their context into hunks
+	for start := 0; start < len(lines); {
+		first := start
+		for first < len(lines) && lines[first].op == ' ' {
+			first++
+		}
+		if first == len(lines) {
+			break
+		}
+
+		last := first
+		for i := first; i < len(lines) && i <= last+2*diffContext; i++ {
+			if lines[i].op != ' ' {
+				last = i
+			}
+		}
+
+		from := first - diffContext
+		if from < 0 {
+			from = 0
+		}
+		to := last + diffContext + 1
+		if to > len(lines) {
+			to = len(lines)
+		}
+		writeHunk(&b, lines, from, to)
+		start = to
+	}
+
+	return b.String()
+}
+
+// writeHunk writes lines[from:to] as a unified diff hunk
+func writeHunk(b *strings.Builder, lines []diffLine, from, to int) {
+	oldStart, newStart := 1, 1
+	for _, l := range lines[:from] {
+		if l.op != '+' {
+			oldStart++
+		}
+		if l.op != '-' {
+			newStart++
+		}
+	}
+
+	oldCount, newCount := 0, 0
+	for _, l := range lines[from:to] {
+		if l.op != '+' {
+			oldCount++
+		}
+		if l.op != '-' {
+			newCount++
+		}
+	}
+
+	// An empty range starts at the line before it
+	if oldCount == 0 {
+		oldStart--
+	}
+	if newCount == 0 {
+		newStart--
+	}
+
+	fmt.Fprintf(b, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+	for _, l := range lines[from:to] {
+		b.WriteByte(l.op)
+		b.WriteString(l.text)
+		if !strings.HasSuffix(l.text, "\n") {
+			b.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// appliedFiles returns the layer file apply links each target to, keyed by
+// the slash-separated target path relative to home. Later layers win, like in
+// applyConfigDir.
+func appliedFiles(dotpilotDir, environment string) (map[string]string, error) {
+	configDirs, err := activeLayers(dotpilotDir, environment)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[string]string)
+	for _, configDir := range configDirs {
+		files, err := layerFiles(dotpilotDir, configDir)
+		if err != nil {
+			return nil, err
+		}
+		for relPath, path := range files {
+			applied[relPath] = path
+		}
+	}
+	return applied, nil
+}
+
+// LocalDrift returns the applied files of environment whose file in the home
+// directory is not a link to the repository and differs from the repo version.
+// Each diff goes from the repository version to the file in the home
+// directory. Targets that don't exist yet, and files differing only in
+// whitespace IgnoreWhitespace ignores, are not reported.
+func LocalDrift(dotpilotDir, environment string) ([]FileChange, error) {
+	home, err := Home()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedFiles(dotpilotDir, environment)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []FileChange
+	for relPath, path := range applied {
+		target := expandXDG(home, relPath)
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			continue
+		}
+		repoContent, err := readLayerFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		// Tracked symlinks are compared by where they point
+		var local []byte
+		if isSymlinkDescriptor(path) {
+			local, err = readLayerFile(target)
+		} else if resolvesTo(target, path) {
+			continue
+		} else {
+			local, err = ioutil.ReadFile(target)
+		}
+		if err != nil {
+			// Broken links and directories in the way can't be compared
+			utils.Logger.Debug().Err(err).Msgf("Not comparing %s", target)
+			continue
+		}
+
+		if IgnoreWhitespace() != "" && sameIgnoringWhitespace(repoContent, local) {
+			continue
+		}
+
+		repoPath, err := RepoPath(dotpilotDir, path)
+		if err != nil {
+			return nil, err
+		}
+		if d := UnifiedDiff(repoPath, "~/"+relPath, comparableContent(repoContent), comparableContent(local)); d != "" {
+			changes = append(changes, FileChange{RepoPath: repoPath, Target: target, Diff: d})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].RepoPath < changes[j].RepoPath })
+	return changes, nil
+}
+
+// RemoteChanges returns the files changed on the remote-tracking branch since
+// it diverged from HEAD, with diffs from the version committed locally to the
+// remote version. Files the local commits changed too show the local changes
+// as well. It reads the remote-tracking branch as last fetched, see
+// FetchChanges.
+func RemoteChanges(dotpilotDir string) ([]FileChange, error) {
+	// Open repository
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	remoteRef, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", head.Name().Short()), true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the files changed on the remote side since the branches diverged
+	// are incoming, files changed by local commits alone are not
+	base := head.Hash()
+	headCommit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	remoteCommit, err := repo.CommitObject(remoteRef.Hash())
+	if err != nil {
+		return nil, err
+	}
+	bases, err := headCommit.MergeBase(remoteCommit)
+	if err != nil {
+		return nil, err
+	}
+	if len(bases) > 0 {
+		base = bases[0].Hash
+	}
+
+	files, err := ChangedFilesBetween(dotpilotDir, base, remoteRef.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	localTree, err := commitTree(repo, head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	remoteTree, err := commitTree(repo, remoteRef.Hash())
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := repoPrefix(repo, dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+
+	home, err := Home()
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []FileChange
+	for _, name := range files {
+		local, err := treeFileContent(localTree, prefix+name)
+		if err != nil {
+			return nil, err
+		}
+		remote, err := treeFileContent(remoteTree, prefix+name)
+		if err != nil {
+			return nil, err
+		}
+
+		if sameContent(local, remote) {
+			continue
+		}
+
+		change := FileChange{RepoPath: name, Diff: UnifiedDiff("a/"+name, "b/"+name, comparableContent(local), comparableContent(remote))}
+		if target, ok := RepoPathToTarget(home, name); ok {
+			change.Target = target
+		}
+		changes = append(changes, change)
+	}
+
+	return changes, nil
+}
+
+// treeFileContent returns the content of a file in a tree, or nil if the tree
+// doesn't contain it
+func treeFileContent(tree *object.Tree, name string) ([]byte, error) {
+	file, err := tree.File(name)
+	if err == object.ErrFileNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := file.Contents()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(contents), nil
+}
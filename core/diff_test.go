@@ -0,0 +1,101 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	from := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+	to := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\n"
+
+	want := `--- old
++++ new
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -10,3 +10,4 @@
+ j
+ k
+ l
++m
+`
+	if got := UnifiedDiff("old", "new", []byte(from), []byte(to)); got != want {
+		t.Errorf("UnifiedDiff() =\n%s\nwant\n%s", got, want)
+	}
+
+	if got := UnifiedDiff("old", "new", []byte(from), []byte(from)); got != "" {
+		t.Errorf("UnifiedDiff() of equal content = %q, want empty", got)
+	}
+
+	want = "--- old\n+++ new\n@@ -0,0 +1,1 @@\n+x\n\\ No newline at end of file\n"
+	if got := UnifiedDiff("old", "new", nil, []byte("x")); got != want {
+		t.Errorf("UnifiedDiff() of new file = %q, want %q", got, want)
+	}
+}
+
+func TestFileChangeStat(t *testing.T) {
+	// A deleted line starting with "-- " looks like a header line
+	from := "a\n-- b\nc\n"
+	to := "a\nc\nd\ne\n"
+	change := FileChange{RepoPath: "envs/work/.vimrc", Diff: UnifiedDiff("old", "new", []byte(from), []byte(to))}
+	if insertions, deletions := change.Stat(); insertions != 2 || deletions != 1 {
+		t.Errorf("Stat() = %d, %d, want 2, 1", insertions, deletions)
+	}
+	if layer := change.Layer(); layer != "envs/work" {
+		t.Errorf("Layer() = %s, want envs/work", layer)
+	}
+}
+
+func TestRemoteChanges(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	remoteDir := t.TempDir()
+	if _, err := git.PlainInit(remoteDir, false); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, remoteDir, "common/.zshrc", "one\n")
+	if err := CommitChanges(remoteDir, "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	dotpilotDir := filepath.Join(t.TempDir(), ".dotpilot")
+	if _, err := git.PlainClone(dotpilotDir, false, &git.CloneOptions{URL: remoteDir}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A remote change and a local commit that must not show as incoming
+	writeRepoFile(t, remoteDir, "common/.zshrc", "two\n")
+	if err := CommitChanges(remoteDir, "remote change"); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "common/.vimrc", "one\n")
+	if err := CommitChanges(dotpilotDir, "local change"); err != nil {
+		t.Fatal(err)
+	}
+	if err := FetchChanges(dotpilotDir); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := RemoteChanges(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].RepoPath != "common/.zshrc" {
+		t.Fatalf("changes = %+v, want only common/.zshrc", changes)
+	}
+	want := "--- a/common/.zshrc\n+++ b/common/.zshrc\n@@ -1,1 +1,1 @@\n-one\n+two\n"
+	if changes[0].Diff != want {
+		t.Errorf("diff = %q, want %q", changes[0].Diff, want)
+	}
+	if changes[0].Target != filepath.Join(os.Getenv("HOME"), ".zshrc") {
+		t.Errorf("target = %q", changes[0].Target)
+	}
+}
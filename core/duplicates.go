@@ -0,0 +1,188 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// duplicateIndex finds tracked files with the same content as a file about
+// to be tracked. Files are grouped by size and only hashed once a file of the
+// same size comes along, so tracking stays cheap in large repositories.
+type duplicateIndex struct {
+	dotpilotDir string
+	bySize      map[int64][]string
+	hashes      map[string]string
+}
+
+// newDuplicateIndex indexes the regular files in layerDirs
+func newDuplicateIndex(dotpilotDir string, layerDirs []string) (*duplicateIndex, error) {
+	d := &duplicateIndex{
+		dotpilotDir: dotpilotDir,
+		bySize:      make(map[int64][]string),
+		hashes:      make(map[string]string),
+	}
+
+	for _, layerDir := range layerDirs {
+		files, err := layerFiles(dotpilotDir, layerDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range files {
+			if isSymlinkDescriptor(path) {
+				continue
+			}
+			if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+				d.add(path, info.Size())
+			}
+		}
+	}
+	return d, nil
+}
+
+// add indexes a file of the given size
+func (d *duplicateIndex) add(path string, size int64) {
+	for _, indexed := range d.bySize[size] {
+		if indexed == path {
+			return
+		}
+	}
+	d.bySize[size] = append(d.bySize[size], path)
+}
+
+// find returns the repo paths of the indexed files with the same content as
+// source, leaving out destination, the file source is about to replace.
+// Empty files are never reported, they are identical by nature.
+func (d *duplicateIndex) find(source, destination string) ([]string, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 || len(d.bySize[info.Size()]) == 0 {
+		return nil, nil
+	}
+
+	sourceHash, err := blobHash(source)
+	if err != nil {
+		return nil, err
+	}
+
+	var duplicates []string
+	for _, path := range d.bySize[info.Size()] {
+		if path == destination {
+			continue
+		}
+		hash, ok := d.hashes[path]
+		if !ok {
+			if hash, err = blobHash(path); err != nil {
+				return nil, err
+			}
+			d.hashes[path] = hash
+		}
+		if hash == sourceHash {
+			repoPath, err := RepoPath(d.dotpilotDir, path)
+			if err != nil {
+				return nil, err
+			}
+			duplicates = append(duplicates, repoPath)
+		}
+	}
+	return duplicates, nil
+}
+
+// precedingLayers returns the layer destination lies in followed by the
+// layers it takes precedence over, those applied before it: by default common
+// for an environment, the current environment and common for a machine
+// layer, see LayerOrder. It returns false for destinations outside the
+// layers, e.g. a custom --dest.
+func precedingLayers(dotpilotDir, destination string) ([]string, bool) {
+	repoPath, err := RepoPath(dotpilotDir, destination)
+	if err != nil {
+		return nil, false
+	}
+
+	hostname, _ := MachineID()
+	layerDirs := map[string]string{
+		"common":  filepath.Join(dotpilotDir, "common"),
+		"machine": filepath.Join(dotpilotDir, "machine", hostname),
+	}
+	if environment := GetConfig().CurrentEnvironment; environment != "" {
+		layerDirs["env"] = filepath.Join(dotpilotDir, "envs", environment)
+	}
+
+	var layer string
+	parts := strings.Split(repoPath, "/")
+	switch {
+	case parts[0] == "common" && len(parts) > 1:
+		layer = "common"
+	case parts[0] == "envs" && len(parts) > 2:
+		layer = "env"
+		layerDirs[layer] = filepath.Join(dotpilotDir, "envs", parts[1])
+	case parts[0] == "machine" && len(parts) > 2:
+		layer = "machine"
+		layerDirs[layer] = filepath.Join(dotpilotDir, "machine", parts[1])
+	default:
+		return nil, false
+	}
+
+	order, err := LayerOrder()
+	if err != nil {
+		order = DefaultLayerOrder
+	}
+	position := 0
+	for i, l := range order {
+		if l == layer {
+			position = i
+		}
+	}
+	layers := []string{layerDirs[layer]}
+	for i := position - 1; i >= 0; i-- {
+		if dir, ok := layerDirs[order[i]]; ok {
+			layers = append(layers, dir)
+		}
+	}
+	return layers, true
+}
+
+// checkDuplicate warns when source is identical to a file already tracked in
+// the layer of destination or a layer below it, and asks whether to track it
+// anyway. It returns false if source should be skipped.
+func (t *tracker) checkDuplicate(source, destination string) bool {
+	layers, ok := precedingLayers(t.dotpilotDir, destination)
+	if !ok {
+		return true
+	}
+
+	if t.duplicates == nil {
+		index, err := newDuplicateIndex(t.dotpilotDir, layers)
+		if err != nil {
+			utils.Logger.Debug().Err(err).Msg("Failed to index tracked files")
+			return true
+		}
+		t.duplicates = index
+	}
+
+	duplicates, err := t.duplicates.find(source, destination)
+	if err != nil {
+		utils.Logger.Debug().Err(err).Msgf("Failed to check %s for duplicates", source)
+		return true
+	}
+	if len(duplicates) == 0 {
+		return true
+	}
+
+	utils.Logger.Warn().Msgf("%s is identical to %s, which is tracked already", source, strings.Join(duplicates, ", "))
+	if layers[0] != filepath.Join(t.dotpilotDir, "common") {
+		utils.Logger.Warn().Msg("Files that are the same in several layers belong in common/, which every environment and machine applies")
+	}
+	if !t.dryRun && utils.PromptYesNo(fmt.Sprintf("Track %s anyway?", source)) {
+		return true
+	}
+
+	t.result.Duplicates = append(t.result.Duplicates, source)
+	t.plan(source, destination, TrackSkippedDuplicate, false)
+	return false
+}
@@ -0,0 +1,174 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// Environment rules
+//
+// env-rules.json in the root of the dotpilot repository picks the environment
+// by where dotpilot runs, for example:
+//
+//	[
+//	  {"hostname": "*-prod", "env": "prod"},
+//	  {"os": "macOS", "env_var": "WORK_LAPTOP", "env": "work"},
+//	  {"env": "personal"}
+//	]
+//
+// The first rule whose conditions all hold selects its environment, so a rule
+// without conditions is a fallback. The rules are consulted when the
+// environment isn't set in ~/.dotpilotrc, or always with SetAutoEnvironment.
+// The environment they select isn't saved to ~/.dotpilotrc.
+
+// envRulesFile holds the environment rules, in the root of the dotpilot
+// repository
+const envRulesFile = "env-rules.json"
+
+// EnvRule selects an environment when all of its conditions hold
+type EnvRule struct {
+	Hostname string `json:"hostname,omitempty"` // Glob the hostname matches, see path.Match
+	// OS is the operating system as in DOTPILOT_OS, like macOS or ubuntu, or
+	// as Go names it, like darwin or linux, in any case
+	OS string `json:"os,omitempty"`
+	// EnvVar is a variable that must be set and not empty, or NAME=value for
+	// one that must have that value
+	EnvVar string `json:"env_var,omitempty"`
+	Env    string `json:"env"`
+}
+
+// EnvRuleMatch is the rule of env-rules.json that selected an environment
+type EnvRuleMatch struct {
+	Rule  EnvRule
+	Index int // Position of the rule in the file, from 1
+}
+
+// String describes the rule for messages, like "rule 2 (hostname *-prod)"
+func (m EnvRuleMatch) String() string {
+	var conditions []string
+	if m.Rule.Hostname != "" {
+		conditions = append(conditions, "hostname "+m.Rule.Hostname)
+	}
+	if m.Rule.OS != "" {
+		conditions = append(conditions, "os "+m.Rule.OS)
+	}
+	if m.Rule.EnvVar != "" {
+		conditions = append(conditions, "env_var "+m.Rule.EnvVar)
+	}
+	if len(conditions) == 0 {
+		conditions = append(conditions, "fallback")
+	}
+	return fmt.Sprintf("rule %d (%s)", m.Index, strings.Join(conditions, ", "))
+}
+
+var (
+	// autoEnvironment makes OpenRepository consult the environment rules
+	// even if an environment is set, see SetAutoEnvironment
+	autoEnvironment bool
+	// envRulesApplied is set once the rules were consulted for the loaded
+	// configuration
+	envRulesApplied bool
+)
+
+// SetAutoEnvironment makes OpenRepository select the environment with
+// env-rules.json even if ~/.dotpilotrc sets one
+func SetAutoEnvironment(enabled bool) {
+	autoEnvironment = enabled
+}
+
+// LoadEnvRules reads env-rules.json from the dotpilot repository. A missing
+// file means no rules.
+func LoadEnvRules(dotpilotDir string) ([]EnvRule, error) {
+	data, err := os.ReadFile(filepath.Join(dotpilotDir, envRulesFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []EnvRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", envRulesFile, err)
+	}
+	for i, rule := range rules {
+		if rule.Env == "" {
+			return nil, fmt.Errorf("rule %d of %s has no env", i+1, envRulesFile)
+		}
+		if _, err := path.Match(rule.Hostname, ""); err != nil {
+			return nil, fmt.Errorf("invalid hostname pattern %q in %s: %w", rule.Hostname, envRulesFile, err)
+		}
+	}
+	return rules, nil
+}
+
+// DetectEnvironment returns the first rule of env-rules.json that matches
+// this machine. It returns false if there are no rules or none matches.
+func DetectEnvironment(dotpilotDir string) (EnvRuleMatch, bool, error) {
+	rules, err := LoadEnvRules(dotpilotDir)
+	if err != nil || len(rules) == 0 {
+		return EnvRuleMatch{}, false, err
+	}
+
+	hostname, err := MachineID()
+	if err != nil {
+		return EnvRuleMatch{}, false, err
+	}
+	osName := utils.GetOSInfo().Name
+	for i, rule := range rules {
+		if rule.matches(hostname, osName) {
+			return EnvRuleMatch{Rule: rule, Index: i + 1}, true, nil
+		}
+	}
+	return EnvRuleMatch{}, false, nil
+}
+
+// matches reports whether all conditions of the rule hold on a machine with
+// hostname running osName
+func (r EnvRule) matches(hostname, osName string) bool {
+	if r.Hostname != "" {
+		if ok, _ := path.Match(strings.ToLower(r.Hostname), strings.ToLower(hostname)); !ok {
+			return false
+		}
+	}
+	if r.OS != "" && !strings.EqualFold(r.OS, osName) && !strings.EqualFold(r.OS, runtime.GOOS) {
+		return false
+	}
+	if r.EnvVar != "" {
+		name, value, hasValue := strings.Cut(r.EnvVar, "=")
+		current := os.Getenv(name)
+		if current == "" || hasValue && current != value {
+			return false
+		}
+	}
+	return true
+}
+
+// applyEnvRules sets the current environment to the one env-rules.json
+// selects, if any, without saving it to ~/.dotpilotrc
+func applyEnvRules(dotpilotDir string) error {
+	if envRulesApplied {
+		return nil
+	}
+	envRulesApplied = true
+
+	match, ok, err := DetectEnvironment(dotpilotDir)
+	if err != nil || !ok {
+		return err
+	}
+
+	if _, err := os.Stat(filepath.Join(dotpilotDir, "envs", match.Rule.Env)); err != nil && match.Rule.Env != "default" {
+		utils.Logger.Warn().Msgf("%s selects environment %s, which has no envs/%s directory", envRulesFile, match.Rule.Env, match.Rule.Env)
+	}
+	utils.Logger.Info().Msgf("Using environment %s, selected by %s of %s", match.Rule.Env, match, envRulesFile)
+	overrideConfigValue("current_environment", match.Rule.Env, fmt.Sprintf("%s %s", filepath.Join(dotpilotDir, envRulesFile), match))
+	currentConfig.CurrentEnvironment = match.Rule.Env
+	return nil
+}
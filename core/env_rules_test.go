@@ -0,0 +1,117 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestEnvRuleMatches(t *testing.T) {
+	t.Setenv("WORK_LAPTOP", "1")
+	t.Setenv("SITE", "berlin")
+
+	tests := []struct {
+		rule EnvRule
+		want bool
+	}{
+		{EnvRule{Hostname: "*-prod"}, true},
+		{EnvRule{Hostname: "WEB-*"}, true},
+		{EnvRule{Hostname: "*-dev"}, false},
+		{EnvRule{OS: "ubuntu"}, true},
+		{EnvRule{OS: "macOS"}, false},
+		{EnvRule{EnvVar: "WORK_LAPTOP"}, true},
+		{EnvRule{EnvVar: "HOME_LAPTOP"}, false},
+		{EnvRule{EnvVar: "SITE=berlin"}, true},
+		{EnvRule{EnvVar: "SITE=paris"}, false},
+		{EnvRule{Hostname: "*-prod", OS: "macOS"}, false},
+		{EnvRule{}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.matches("web-prod", "ubuntu"); got != tt.want {
+			t.Errorf("%+v matches = %v, want %v", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestEnvRulesSelectEnvironment(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("DOTPILOT_TEST_MACHINE", "1")
+	savedConfig, savedLoaded := currentConfig, configLoaded
+	defer func() {
+		currentConfig, configLoaded = savedConfig, savedLoaded
+		resetConfigFragments()
+		autoEnvironment = false
+	}()
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "envs/prod/.zshrc", "prod\n")
+	writeRepoFile(t, dotpilotDir, envRulesFile, `[
+  {"hostname": "no-such-host-*", "env": "staging"},
+  {"env_var": "DOTPILOT_TEST_MACHINE", "env": "prod"},
+  {"env": "personal"}
+]`)
+
+	match, ok, err := DetectEnvironment(dotpilotDir)
+	if err != nil || !ok || match.Rule.Env != "prod" || match.Index != 2 {
+		t.Fatalf("DetectEnvironment = %+v, %v, %v, want rule 2", match, ok, err)
+	}
+
+	// Without an environment in ~/.dotpilotrc the rules pick it
+	rcPath := filepath.Join(home, ".dotpilotrc")
+	writeRepoFile(t, home, ".dotpilotrc", `{"tracking_paths": []}`)
+	configLoaded = false
+	repo, err := OpenRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env := repo.Environment(); env != "prod" {
+		t.Errorf("environment %q, want prod from the rules", env)
+	}
+
+	// It isn't saved
+	if err := SaveConfig(rcPath); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(rcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved Config
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.CurrentEnvironment != "" {
+		t.Errorf("the detected environment was saved: %s", data)
+	}
+
+	// An environment that is set wins, unless --auto-env
+	writeRepoFile(t, home, ".dotpilotrc", `{"current_environment": "work", "tracking_paths": []}`)
+	for _, auto := range []bool{false, true} {
+		autoEnvironment = auto
+		configLoaded = false
+		repo, err := OpenRepository()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[bool]string{false: "work", true: "prod"}[auto]
+		if env := repo.Environment(); env != want {
+			t.Errorf("auto-env %v: environment %q, want %s", auto, env, want)
+		}
+	}
+	if err := SaveConfig(rcPath); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(rcPath); !json.Valid(data) || GetConfig().CurrentEnvironment != "prod" {
+		t.Fatalf("config %s", data)
+	}
+	if err := LoadConfig(rcPath); err != nil || GetConfig().CurrentEnvironment != "work" {
+		t.Errorf("after saving with --auto-env, ~/.dotpilotrc sets %q, %v, want work", GetConfig().CurrentEnvironment, err)
+	}
+}
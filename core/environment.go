@@ -2,6 +2,7 @@ package core
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -9,58 +10,324 @@ import (
 	"github.com/dotpilot/utils"
 )
 
+// ApplyOptions controls how configurations are linked into the home directory
+type ApplyOptions struct {
+	Backup     bool // Back up existing targets before replacing them
+	DiffPrompt bool // Show a diff and ask before replacing a target
+	OnlyNew    bool // Only link targets that don't exist yet, leave existing ones untouched
+	// QuietShadows suppresses the warning about targets defined in more than
+	// one layer
+	QuietShadows bool
+	// Paths limits the apply to these slash-separated repo paths, for example
+	// the files changed by a pull. A nil slice applies everything.
+	Paths []string
+	// Target is the directory the layers are applied into, the home
+	// directory if empty. Apply hooks only run when applying into the home
+	// directory.
+	Target string
+	// Exclude are glob patterns of targets to leave out, in addition to
+	// those in .dotpilotignore, see ExcludePatterns
+	Exclude []string
+	// Relative creates links relative to the directory of their target,
+	// also set by Options["relative_symlinks"], see RelativeSymlinks
+	Relative bool
+	// Prune removes the tracked targets whose repo file was deleted, like
+	// by a pull, see PruneRemoteDeletions. It only applies to the home
+	// directory.
+	Prune bool
+	// Interactive asks about every change before anything is changed,
+	// instead of the DiffPrompt questions, see applyReviewer
+	Interactive bool
+	// User adds the layer users/<User>/ last and applies into the home
+	// directory of that user unless Target is set, see users.go
+	User string
+
+	// input is where Interactive reads answers from, stdin if nil
+	input io.Reader
+}
+
 // ApplyConfigurations applies all configurations based on the environment
 func ApplyConfigurations(dotpilotDir, environment string) error {
-	return ApplyConfigurationsWithOptions(dotpilotDir, environment, true, true)
+	return ApplyConfigurationsWithOptions(dotpilotDir, environment, ApplyOptions{Backup: true, DiffPrompt: true})
 }
 
 // ApplyConfigurationsWithOptions applies all configurations with specified options
-func ApplyConfigurationsWithOptions(dotpilotDir, environment string, backup, diffPrompt bool) error {
-	// Get hostname
-	hostname, err := os.Hostname()
+func ApplyConfigurationsWithOptions(dotpilotDir, environment string, opts ApplyOptions) error {
+	configDirs, err := activeLayers(dotpilotDir, environment)
 	if err != nil {
 		return err
 	}
+	var account *UserAccount
+	if opts.User != "" {
+		if account, opts.Target, err = UserTarget(opts.User, opts.Target); err != nil {
+			return err
+		}
+		configDirs = append(configDirs, UserLayerDir(dotpilotDir, opts.User))
+	}
+
+	if !opts.QuietShadows && !currentConfig.QuietShadows {
+		warnShadows(dotpilotDir, configDirs, opts.Paths)
+	}
 
-	// Apply configurations in order:
-	// 1. Common
-	// 2. Environment-specific
-	// 3. Machine-specific
+	root, err := TargetRoot(opts.Target)
+	if err != nil {
+		return err
+	}
+	home, err := Home()
+	if err != nil {
+		return err
+	}
 
-	// 1. Apply common configurations
-	commonDir := filepath.Join(dotpilotDir, "common")
-	if err := applyConfigDir(commonDir, backup, diffPrompt); err != nil {
+	if opts.Exclude, err = ExcludePatterns(dotpilotDir, opts.Exclude); err != nil {
+		return fmt.Errorf("failed to read %s: %w", ignoreFile, err)
+	}
+	if err := checkApplyJournal(dotpilotDir); err != nil {
+		return err
+	}
+	opts.Relative = opts.Relative || RelativeSymlinks()
+	linkModes, err := LoadLinkModes(dotpilotDir)
+	if err != nil {
 		return err
 	}
 
-	// 2. Apply environment-specific configurations
-	if environment != "" {
-		envDir := filepath.Join(dotpilotDir, "envs", environment)
-		if err := applyConfigDir(envDir, backup, diffPrompt); err != nil {
+	// Work out every change first, so the prompts come before anything is
+	// touched, then make them under a journal
+	plan := &applyPlan{links: make(map[string]plannedLink), linkModes: linkModes}
+	for _, configDir := range configDirs {
+		if err := applyConfigDir(dotpilotDir, configDir, root, opts, plan); err != nil {
 			return err
 		}
 	}
+	steps, skipped, blocked, err := planApplySteps(dotpilotDir, plan, opts)
+	if err != nil {
+		return err
+	}
+	// Copies take the mode of their repo file
+	if err := EnforceFileModes(dotpilotDir, configDirs); err != nil {
+		return err
+	}
+	if err := runApplySteps(dotpilotDir, steps); err != nil {
+		return err
+	}
 
-	// 3. Apply machine-specific configurations
-	machineDir := filepath.Join(dotpilotDir, "machine", hostname)
-	if err := applyConfigDir(machineDir, backup, diffPrompt); err != nil {
+	var linked, backedUp []string
+	for _, step := range steps {
+		if step.Keep {
+			backedUp = append(backedUp, step.Target)
+		}
+		if step.Op != "link" {
+			continue
+		}
+		linked = append(linked, step.Target)
+
+		// Update tracking list, which only covers the home directory
+		if root == home {
+			if relTarget, ok := trackingPath(home, step.Target); ok {
+				AddTrackingPath(relTarget)
+			}
+		}
+	}
+
+	pruneBackupsOf(backedUp...)
+
+	if account != nil {
+		if err := ChownTargets(root, linked, *account); err != nil {
+			return err
+		}
+	}
+
+	if opts.Prune && root == home {
+		pruned, err := PruneRemoteDeletions(dotpilotDir, environment)
+		for _, p := range pruned {
+			switch {
+			case p.Backup != "":
+				utils.Logger.Info().Msgf("Moved %s to %s, it was deleted from the repository", p.Target, p.Backup)
+			case p.Removed:
+				utils.Logger.Info().Msgf("Removed %s, it was deleted from the repository", p.Target)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to prune deleted files: %w", err)
+		}
+	}
+
+	if opts.OnlyNew && len(skipped) > 0 {
+		utils.Logger.Info().Msgf("Left %d existing files untouched", len(skipped))
+	}
+	if len(plan.excluded) > 0 {
+		utils.Logger.Info().Msgf("Excluded %d targets: %s", len(plan.excluded), strings.Join(plan.excluded, ", "))
+	}
+
+	if root != home {
+		utils.Logger.Debug().Msgf("Not running apply hooks, %s is not the home directory", root)
+	} else if err := RunApplyHooks(dotpilotDir, environment, linked); err != nil {
 		return err
 	}
 
+	if len(blocked) > 0 {
+		return fmt.Errorf("directories are in the way of repo files, they were left alone: %w", &ConflictError{Targets: blocked})
+	}
 	return nil
 }
 
-// applyConfigDir applies configurations from a specific directory
-func applyConfigDir(configDir string, backup, diffPrompt bool) error {
+// TargetRoot returns the absolute directory to apply into for a --target
+// flag, creating it if needed. An empty target is the home directory.
+func TargetRoot(target string) (string, error) {
+	if target == "" {
+		return Home()
+	}
+
+	root, err := filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(root); err == nil && !info.IsDir() {
+		return "", fmt.Errorf("target %s is not a directory", root)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return "", fmt.Errorf("failed to create target directory: %w", err)
+	}
+	return root, nil
+}
+
+// DefaultLayerOrder is the order layers are applied in unless
+// Options["layer_order"] in ~/.dotpilotrc sets another: "common", then "env"
+// for envs/<env>/, then "machine" for machine/<hostname>/. A later layer wins.
+var DefaultLayerOrder = []string{"common", "env", "machine"}
+
+// LayerOrder returns the configured order layers are applied in, see
+// DefaultLayerOrder
+func LayerOrder() ([]string, error) {
+	value, ok := GetConfig().Options["layer_order"]
+	if !ok || value == nil {
+		return append([]string(nil), DefaultLayerOrder...), nil
+	}
+
+	var order []string
+	switch v := value.(type) {
+	case []string:
+		order = v
+	case []interface{}:
+		for _, item := range v {
+			layer, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid layer_order option: %v is not a string", item)
+			}
+			order = append(order, layer)
+		}
+	default:
+		return nil, fmt.Errorf("invalid layer_order option: expected a list like %q", DefaultLayerOrder)
+	}
+	if err := ValidateLayerOrder(order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// ValidateLayerOrder checks that order names each of the layers of
+// DefaultLayerOrder exactly once
+func ValidateLayerOrder(order []string) error {
+	valid := len(order) == len(DefaultLayerOrder)
+	seen := make(map[string]bool)
+	for _, layer := range order {
+		known := false
+		for _, l := range DefaultLayerOrder {
+			known = known || l == layer
+		}
+		if !known || seen[layer] {
+			valid = false
+		}
+		seen[layer] = true
+	}
+	if !valid {
+		return fmt.Errorf("invalid layer_order option %q: list each of %s exactly once", order, strings.Join(DefaultLayerOrder, ", "))
+	}
+	return nil
+}
+
+// activeLayers returns the layer directories applied for environment, in the
+// order they are applied, see LayerOrder. The machine layer is left out if its
+// fingerprint doesn't match this machine, and disabled layers are left out,
+// see LayerDisabled.
+func activeLayers(dotpilotDir, environment string) ([]string, error) {
+	order, err := LayerOrder()
+	if err != nil {
+		return nil, err
+	}
+
+	// Get hostname
+	hostname, err := MachineID()
+	if err != nil {
+		return nil, err
+	}
+
+	layerDirs := map[string]string{"common": filepath.Join(dotpilotDir, "common")}
+	if environment != "" {
+		layerDirs["env"] = filepath.Join(dotpilotDir, "envs", environment)
+	}
+	machineDir := filepath.Join(dotpilotDir, "machine", hostname)
+	allowed, err := MachineLayerAllowed(machineDir)
+	if err != nil {
+		return nil, err
+	}
+	if allowed {
+		layerDirs["machine"] = machineDir
+	}
+
+	var configDirs []string
+	for _, layer := range order {
+		dir, ok := layerDirs[layer]
+		if !ok {
+			continue
+		}
+		disabled, err := LayerDisabled(layer)
+		if err != nil {
+			return nil, err
+		}
+		if disabled {
+			utils.Logger.Debug().Msgf("Leaving out the %s layer, it is disabled", layer)
+			continue
+		}
+		configDirs = append(configDirs, dir)
+	}
+	return configDirs, nil
+}
+
+// applyPlan collects what applying the layers links, before anything in the
+// target root changes
+type applyPlan struct {
+	dirs     []plannedDir
+	links    map[string]plannedLink // By target, a later layer replaces an earlier one
+	targets  []string               // Keys of links in the order they were found
+	excluded []string               // Slash-separated targets left out by an exclude pattern
+	// linkModes are the recorded link modes by repo path, see LoadLinkModes
+	linkModes map[string]LinkMode
+}
+
+// plannedDir is a directory of a layer that has to exist below the target root
+type plannedDir struct {
+	target string
+	mode   os.FileMode
+}
+
+// plannedLink is the repo file a target links to
+type plannedLink struct {
+	repoFile   string
+	linkSource string   // What the link points to, see linkSourceFor
+	mode       LinkMode // How the target is made from repoFile
+}
+
+// applyConfigDir adds the directories and files of a specific layer directory
+// to plan, with targets below root, normally the home directory. Applying
+// into the home directory honors relocated XDG base directories.
+func applyConfigDir(dotpilotDir, configDir, root string, opts ApplyOptions, plan *applyPlan) error {
 	// Check if directory exists
 	_, err := os.Stat(configDir)
 	if os.IsNotExist(err) {
 		utils.Logger.Debug().Msgf("Configuration directory does not exist: %s", configDir)
 		return nil
 	}
-
-	// Get home directory
-	home, err := os.UserHomeDir()
+	home, err := Home()
 	if err != nil {
 		return err
 	}
@@ -89,77 +356,258 @@ func applyConfigDir(configDir string, backup, diffPrompt bool) error {
 		if relPath == "README.md" {
 			return nil
 		}
+		if repoPath, err := RepoPath(dotpilotDir, path); err == nil && isMachineFingerprint(repoPath) {
+			return nil
+		}
 
-		// Construct the target path in the home directory
-		targetPath := filepath.Join(home, relPath)
+		// Skip paths outside the sparse include list
+		if isSparseExcluded(dotpilotDir, path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Skip paths that are not part of a partial apply
+		if opts.Paths != nil {
+			repoPath, err := RepoPath(dotpilotDir, path)
+			if err != nil {
+				return err
+			}
+			if !matchApplyPaths(opts.Paths, repoPath, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		// Skip targets matching an exclude pattern
+		relTarget := filepath.ToSlash(strings.TrimSuffix(relPath, symlinkSuffix))
+		if pattern := excludedBy(opts.Exclude, relTarget, info.IsDir()); pattern != "" {
+			utils.Logger.Debug().Msgf("Excluding %s (matches %s)", relTarget, pattern)
+			plan.excluded = append(plan.excluded, relTarget)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Construct the target path below the target root
+		targetPath := filepath.Join(root, relPath)
+		if root == home {
+			targetPath = expandXDG(home, filepath.ToSlash(relPath))
+		}
 
 		// Handle directory
 		if info.IsDir() {
-			if err := os.MkdirAll(targetPath, info.Mode()); err != nil {
+			plan.dirs = append(plan.dirs, plannedDir{target: targetPath, mode: info.Mode()})
+			return nil
+		}
+
+		// Targets link to the repo file, except for tracked symlinks, which
+		// are recreated with the same link target
+		if isSymlinkDescriptor(path) {
+			targetPath = strings.TrimSuffix(targetPath, symlinkSuffix)
+		}
+		linkSource, err := linkSourceFor(path)
+		if err != nil {
+			return err
+		}
+		mode := LinkSymlink
+		if !isSymlinkDescriptor(path) {
+			repoPath, err := RepoPath(dotpilotDir, path)
+			if err != nil {
 				return err
 			}
-			return nil
+			mode = linkModeOf(plan.linkModes, repoPath)
 		}
 
-		// Check if target already exists and is not a symlink to our path
-		targetInfo, err := os.Lstat(targetPath)
-		if err == nil {
-			isSymlink := targetInfo.Mode()&os.ModeSymlink != 0
-			
-			if isSymlink {
-				// Check if symlink points to our dotpilot path
-				linkTarget, err := os.Readlink(targetPath)
-				if err == nil && linkTarget == path {
-					utils.Logger.Debug().Msgf("Symlink already exists: %s -> %s", targetPath, path)
-					return nil
+		if _, ok := plan.links[targetPath]; !ok {
+			plan.targets = append(plan.targets, targetPath)
+		}
+		plan.links[targetPath] = plannedLink{repoFile: path, linkSource: linkSource, mode: mode}
+		return nil
+	})
+}
+
+// planApplySteps turns plan into the steps that apply it: the directories to
+// create and the targets to link, moving what is in the way aside. Targets
+// that already link to their repo file are left out, and so are existing
+// targets with OnlyNew, which are returned as skipped, and the ones the user
+// declines to replace with DiffPrompt, or to change at all with Interactive.
+// Targets that are directories with
+// files in them are never moved aside, they are returned as blocked, for
+// 'dotpilot resolve' to sort out.
+func planApplySteps(dotpilotDir string, plan *applyPlan, opts ApplyOptions) (steps []applyStep, skipped, blocked []string, err error) {
+	var reviewer *applyReviewer
+	if opts.Interactive {
+		reviewer = newApplyReviewer(opts.input)
+	}
+
+	created := make(map[string]bool)
+	for _, dir := range plan.dirs {
+		if created[dir.target] {
+			continue
+		}
+		if _, err := os.Lstat(dir.target); os.IsNotExist(err) {
+			// A relocated XDG base directory may need its parents too
+			var parents []string
+			for parent := filepath.Dir(dir.target); !created[parent]; parent = filepath.Dir(parent) {
+				if _, err := os.Lstat(parent); err == nil || parent == filepath.Dir(parent) {
+					break
 				}
+				parents = append(parents, parent)
+			}
+			for i := len(parents) - 1; i >= 0; i-- {
+				steps = append(steps, applyStep{Op: "mkdir", Target: parents[i], Mode: 0755})
+				created[parents[i]] = true
 			}
+			steps = append(steps, applyStep{Op: "mkdir", Target: dir.target, Mode: dir.mode.Perm()})
+			created[dir.target] = true
+		} else if err != nil {
+			return nil, nil, nil, err
+		}
+	}
 
-			// It exists but isn't a correct symlink, prompt for diff if needed
-			if diffPrompt {
-				if _, err := os.Stat(targetPath); err == nil {
-					diff, err := FileDiff(targetPath, path)
-					if err != nil {
-						utils.Logger.Warn().Err(err).Msgf("Failed to get diff for %s", targetPath)
-					} else {
-						fmt.Printf("Diff for %s:\n%s\n", targetPath, diff)
-						
-						if !utils.PromptYesNo(fmt.Sprintf("Apply changes to %s?", targetPath)) {
-							utils.Logger.Info().Msgf("Skipping %s", targetPath)
-							return nil
-						}
-					}
+	for _, targetPath := range plan.targets {
+		link := plan.links[targetPath]
+		step := applyStep{Op: "link", Target: targetPath, Source: link.linkSource}
+		if link.mode != LinkSymlink {
+			// Hardlinks and copies are made from the repo file, see
+			// MaterializeFile
+			step.Source = link.repoFile
+			step.LinkMode = link.mode
+		} else if !isSymlinkDescriptor(link.repoFile) {
+			step.Source = symlinkContent(targetPath, link.linkSource, opts.Relative)
+		}
+
+		targetInfo, err := os.Lstat(targetPath)
+		if os.IsNotExist(err) {
+			if reviewer != nil {
+				if ok, err := reviewer.review(targetPath, link.repoFile, step.Source, link.mode, false); err != nil {
+					return nil, nil, nil, err
+				} else if !ok {
+					continue
 				}
 			}
+			steps = append(steps, step)
+			continue
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
 
-			// Backup if requested
-			if backup {
-				backupPath, err := BackupFile(targetPath)
-				if err != nil {
-					utils.Logger.Warn().Err(err).Msgf("Failed to backup %s", targetPath)
-				} else if backupPath != "" {
-					utils.Logger.Info().Msgf("Backed up %s to %s", targetPath, backupPath)
-				}
+		// A link into the repository from another layer or environment is
+		// dotpilot's own and replaced without asking or keeping a backup,
+		// and so is a hardlink or copy that wasn't changed since it was made
+		own := false
+		isLink := targetInfo.Mode()&os.ModeSymlink != 0
+		if isLink {
+			// Links in the other form, absolute or relative, count too
+			if link.mode == LinkSymlink && linksTo(targetPath, link.linkSource) {
+				utils.Logger.Debug().Msgf("Symlink already exists: %s -> %s", targetPath, link.linkSource)
+				continue
 			}
+			linkTarget, err := readLinkTarget(targetPath)
+			own = err == nil && insideDir(linkTarget, filepath.Clean(dotpilotDir))
+		} else if link.mode != LinkSymlink && materialized(targetPath, link.repoFile, link.mode) {
+			utils.Logger.Debug().Msgf("%s is already a %s of %s", targetPath, link.mode, link.repoFile)
+			continue
+		} else if targetInfo.Mode().IsRegular() && unchangedSinceMaterialized(targetPath) {
+			own = true
+		} else if targetInfo.IsDir() && !isEmptyDir(targetPath) {
+			// Moving it aside would hide everything in it
+			utils.Logger.Warn().Msgf("Not linking %s to %s, the target is a directory that isn't empty", targetPath, link.linkSource)
+			blocked = append(blocked, targetPath)
+			continue
+		}
 
-			// Remove the target if it exists
-			if err := os.Remove(targetPath); err != nil {
-				return err
+		// A parent directory already links into the repository, replacing
+		// the target would delete the repo file itself. A link of its own is
+		// replaced by a hardlink or copy.
+		if (link.mode == LinkSymlink || !isLink) && resolvesTo(targetPath, link.repoFile) {
+			utils.Logger.Debug().Msgf("%s is linked through a parent directory", targetPath)
+			continue
+		}
+
+		// Leave anything that already exists alone in additive mode
+		if opts.OnlyNew {
+			utils.Logger.Info().Msgf("Skipping %s (already exists)", targetPath)
+			skipped = append(skipped, targetPath)
+			continue
+		}
+
+		// It exists but isn't a correct symlink, prompt for diff if needed
+		if reviewer != nil {
+			if ok, err := reviewer.review(targetPath, link.repoFile, step.Source, link.mode, opts.Backup && !own); err != nil {
+				return nil, nil, nil, err
+			} else if !ok {
+				continue
+			}
+		} else if opts.DiffPrompt && !own && isSymlinkDescriptor(link.repoFile) {
+			if !utils.PromptYesNo(fmt.Sprintf("Replace %s with a symlink to %s?", targetPath, link.linkSource)) {
+				utils.Logger.Info().Msgf("Skipping %s", targetPath)
+				continue
+			}
+		} else if opts.DiffPrompt && !own && !targetInfo.IsDir() && !sameFileContent(targetPath, link.repoFile) {
+			if _, err := os.Stat(targetPath); err == nil {
+				diff, err := FileDiff(targetPath, link.repoFile)
+				if err != nil {
+					utils.Logger.Warn().Err(err).Msgf("Failed to get diff for %s", targetPath)
+				} else {
+					fmt.Printf("Diff for %s:\n%s\n", targetPath, diff)
+
+					if !utils.PromptYesNo(fmt.Sprintf("Apply changes to %s?", targetPath)) {
+						utils.Logger.Info().Msgf("Skipping %s", targetPath)
+						continue
+					}
+				}
 			}
 		}
 
-		// Create symlink
-		utils.Logger.Debug().Msgf("Creating symlink: %s -> %s", targetPath, path)
-		if err := os.Symlink(path, targetPath); err != nil {
-			return err
+		// The target is moved aside until the apply is done, and kept as the
+		// backup if requested
+		step.Keep = opts.Backup && !own
+		if step.Keep {
+			step.Backup = backupPathFor(targetPath)
+		} else {
+			step.Backup = targetPath + applyAsideSuffix
 		}
+		steps = append(steps, step)
+	}
+	if reviewer != nil {
+		steps = dropUnusedDirs(steps)
+	}
+	return steps, skipped, blocked, nil
+}
 
-		// Update tracking list
-		relTarget, err := filepath.Rel(home, targetPath)
-		if err == nil {
-			AddTrackingPath(relTarget)
+// dropUnusedDirs leaves out the directories no link goes into, such as those
+// of the files skipped in an interactive apply
+func dropUnusedDirs(steps []applyStep) []applyStep {
+	var kept []applyStep
+	for _, step := range steps {
+		if step.Op != "mkdir" {
+			kept = append(kept, step)
+			continue
 		}
+		for _, other := range steps {
+			if other.Op != "mkdir" && insideDir(other.Target, step.Target) {
+				kept = append(kept, step)
+				break
+			}
+		}
+	}
+	return kept
+}
 
-		return nil
-	})
+// matchApplyPaths reports whether a repo path is one of paths or, for a
+// directory, an ancestor of one of them
+func matchApplyPaths(paths []string, repoPath string, isDir bool) bool {
+	for _, p := range paths {
+		if p == repoPath || (isDir && strings.HasPrefix(p, repoPath+"/")) {
+			return true
+		}
+	}
+	return false
 }
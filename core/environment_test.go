@@ -0,0 +1,416 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyOnlyNew(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	commonDir := filepath.Join(dotpilotDir, "common")
+	repoFiles := []string{".present", ".absent", ".link", ".config/app/conf"}
+	for _, name := range repoFiles {
+		path := filepath.Join(commonDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("repo\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An existing regular file and an existing symlink pointing elsewhere
+	if err := os.WriteFile(filepath.Join(home, ".present"), []byte("local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	elsewhere := filepath.Join(home, "elsewhere")
+	if err := os.Symlink(elsewhere, filepath.Join(home, ".link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{OnlyNew: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Existing targets are untouched
+	data, err := os.ReadFile(filepath.Join(home, ".present"))
+	if err != nil || string(data) != "local\n" {
+		t.Errorf(".present was modified: %q, %v", data, err)
+	}
+	if link, err := os.Readlink(filepath.Join(home, ".link")); err != nil || link != elsewhere {
+		t.Errorf(".link was modified: %q, %v", link, err)
+	}
+
+	// Missing targets are linked into the repo
+	for _, name := range []string{".absent", ".config/app/conf"} {
+		link, err := os.Readlink(filepath.Join(home, name))
+		if err != nil {
+			t.Errorf("%s was not linked: %v", name, err)
+			continue
+		}
+		if want := filepath.Join(commonDir, name); link != want {
+			t.Errorf("%s links to %s, want %s", name, link, want)
+		}
+	}
+}
+
+func TestApplyPaths(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	for _, name := range []string{"common/.changed", "common/.unchanged", "common/.config/app/conf"} {
+		path := filepath.Join(dotpilotDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("repo\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := ApplyOptions{Paths: []string{"common/.changed", "common/.config/app/conf"}}
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", opts); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{".changed", ".config/app/conf"} {
+		if _, err := os.Readlink(filepath.Join(home, name)); err != nil {
+			t.Errorf("%s was not linked: %v", name, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(home, ".unchanged")); !os.IsNotExist(err) {
+		t.Errorf(".unchanged was applied although it is not in Paths")
+	}
+}
+
+func TestApplyTarget(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	for _, name := range []string{"common/.zshrc", "common/.bashrc", "common/.config/app/conf", "envs/work/.bashrc"} {
+		path := filepath.Join(dotpilotDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The target doesn't exist yet
+	target := filepath.Join(t.TempDir(), "image", "root")
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "work", ApplyOptions{Target: target}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The layout below the target mirrors the home directory, with later
+	// layers winning
+	want := map[string]string{
+		".zshrc":           "common/.zshrc",
+		".bashrc":          "envs/work/.bashrc",
+		".config/app/conf": "common/.config/app/conf",
+	}
+	for name, repoPath := range want {
+		link, err := os.Readlink(filepath.Join(target, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("%s was not linked below the target: %v", name, err)
+			continue
+		}
+		if want := filepath.Join(dotpilotDir, filepath.FromSlash(repoPath)); link != want {
+			t.Errorf("%s links to %s, want %s", name, link, want)
+		}
+	}
+
+	// The home directory is left alone
+	for name := range want {
+		if _, err := os.Lstat(filepath.Join(home, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Errorf("%s was linked into the home directory", name)
+		}
+	}
+}
+
+func TestValidateLayerOrder(t *testing.T) {
+	valid := [][]string{DefaultLayerOrder, {"machine", "common", "env"}}
+	for _, order := range valid {
+		if err := ValidateLayerOrder(order); err != nil {
+			t.Errorf("ValidateLayerOrder(%q) = %v", order, err)
+		}
+	}
+	invalid := [][]string{nil, {"common", "env"}, {"common", "env", "env"}, {"common", "env", "host"}, {"common", "env", "machine", "common"}}
+	for _, order := range invalid {
+		if err := ValidateLayerOrder(order); err == nil {
+			t.Errorf("ValidateLayerOrder(%q) accepted", order)
+		}
+	}
+
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+	currentConfig.Options = map[string]interface{}{"layer_order": []interface{}{"common", "env", 1}}
+	if _, err := LayerOrder(); err == nil {
+		t.Error("LayerOrder accepted a number")
+	}
+}
+
+func TestLayerOrderPrecedence(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	writeRepoFile(t, dotpilotDir, "common/.vimrc", "common\n")
+	writeRepoFile(t, dotpilotDir, "envs/dev/.vimrc", "dev\n")
+	writeRepoFile(t, dotpilotDir, "machine/"+hostname+"/.vimrc", "machine\n")
+
+	// The machine layer is a base that the environment overrides
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+	currentConfig.CurrentEnvironment = "dev"
+	currentConfig.Options = map[string]interface{}{"layer_order": []interface{}{"common", "machine", "env"}}
+
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "dev", ApplyOptions{QuietShadows: true}); err != nil {
+		t.Fatal(err)
+	}
+	envVimrc := filepath.Join(dotpilotDir, "envs", "dev", ".vimrc")
+	if link, err := os.Readlink(filepath.Join(home, ".vimrc")); err != nil || link != envVimrc {
+		t.Errorf(".vimrc links to %q, %v, want %s", link, err, envVimrc)
+	}
+
+	shadows, err := FindShadows(dotpilotDir, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shadows) != 1 || shadows[0].Winner != "envs/dev/.vimrc" || len(shadows[0].Shadowed) != 2 {
+		t.Errorf("shadows = %+v, want envs/dev/.vimrc winning over two files", shadows)
+	}
+
+	repoPath, err := FindRepoPath(dotpilotDir, filepath.Join(home, ".vimrc"), "dev", "")
+	if err != nil || repoPath != "envs/dev/.vimrc" {
+		t.Errorf("FindRepoPath = %q, %v, want envs/dev/.vimrc", repoPath, err)
+	}
+
+	layers, ok := precedingLayers(dotpilotDir, envVimrc)
+	want := []string{filepath.Join(dotpilotDir, "envs", "dev"), filepath.Join(dotpilotDir, "machine", hostname), filepath.Join(dotpilotDir, "common")}
+	if !ok || !reflect.DeepEqual(layers, want) {
+		t.Errorf("precedingLayers = %v, want %v", layers, want)
+	}
+}
+
+func TestApplyExclude(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	for _, name := range []string{"common/.zshrc", "common/.vimrc", "common/.zshrc.local", "common/.config/app/conf", "common/.config/JetBrains/options.xml"} {
+		path := filepath.Join(dotpilotDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ignore := "# Machine-local files\n*.local\n\n.config/JetBrains/\n"
+	if err := os.WriteFile(filepath.Join(dotpilotDir, ".dotpilotignore"), []byte(ignore), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// --exclude adds to the patterns of .dotpilotignore
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{Exclude: []string{"~/.vimrc"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{".zshrc", ".config/app/conf"} {
+		if _, err := os.Readlink(filepath.Join(home, filepath.FromSlash(name))); err != nil {
+			t.Errorf("%s was not linked: %v", name, err)
+		}
+	}
+	for _, name := range []string{".vimrc", ".zshrc.local", ".config/JetBrains", ".dotpilotignore"} {
+		if _, err := os.Lstat(filepath.Join(home, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Errorf("%s was applied although it is excluded", name)
+		}
+	}
+}
+
+func TestApplyRelativeSymlinks(t *testing.T) {
+	home := filepath.Join(t.TempDir(), "home")
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	for _, name := range []string{"common/.zshrc", "common/.config/app/conf"} {
+		path := filepath.Join(dotpilotDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{Relative: true}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		".zshrc":           filepath.FromSlash(".dotpilot/common/.zshrc"),
+		".config/app/conf": filepath.FromSlash("../../.dotpilot/common/.config/app/conf"),
+	}
+	for name, wantLink := range want {
+		link, err := os.Readlink(filepath.Join(home, filepath.FromSlash(name)))
+		if err != nil || link != wantLink {
+			t.Errorf("%s links to %q (%v), want %q", name, link, err, wantLink)
+		}
+	}
+
+	// An apply with absolute links counts the relative ones as applied
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if link, _ := os.Readlink(filepath.Join(home, ".zshrc")); link != want[".zshrc"] {
+		t.Errorf(".zshrc was relinked to %q", link)
+	}
+
+	// Moving the home directory together with the repository keeps the
+	// links working
+	moved := filepath.Join(filepath.Dir(home), "moved")
+	if err := os.Rename(home, moved); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", moved)
+	for name := range want {
+		target := filepath.Join(moved, filepath.FromSlash(name))
+		data, err := os.ReadFile(target)
+		if err != nil {
+			t.Fatalf("%s no longer resolves: %v", name, err)
+		}
+		if string(data) != "common/"+name+"\n" {
+			t.Errorf("%s reads %q", name, data)
+		}
+		if !linksTo(target, filepath.Join(moved, ".dotpilot", "common", filepath.FromSlash(name))) {
+			t.Errorf("%s isn't recognized as a link to its repo file", name)
+		}
+	}
+
+	// Reapply converts a link to the configured form
+	result, err := ReapplyFile(filepath.Join(moved, ".dotpilot"), "common/.zshrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Backup != "" {
+		t.Errorf("converting the link made a backup at %s", result.Backup)
+	}
+	wantAbs := filepath.Join(moved, ".dotpilot", "common", ".zshrc")
+	if link, _ := os.Readlink(filepath.Join(moved, ".zshrc")); link != wantAbs {
+		t.Errorf(".zshrc links to %q after reapply, want %q", link, wantAbs)
+	}
+}
+
+func TestApplyDirectoryInTheWay(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+	currentConfig.CurrentEnvironment = "default"
+
+	// The repo has files where home has a populated and an empty directory
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	writeRepoFile(t, dotpilotDir, "common/.emacs.d", "file\n")
+	writeRepoFile(t, dotpilotDir, "common/.empty", "file\n")
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "zsh\n")
+	writeRepoFile(t, home, ".emacs.d/init.el", "precious\n")
+	if err := os.Mkdir(filepath.Join(home, ".empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	err := ApplyConfigurationsWithOptions(dotpilotDir, "default", ApplyOptions{QuietShadows: true})
+	var conflictErr *ConflictError
+	if !errors.As(err, &conflictErr) || !reflect.DeepEqual(conflictErr.Targets, []string{filepath.Join(home, ".emacs.d")}) {
+		t.Fatalf("apply = %v, want a conflict for .emacs.d", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(home, ".emacs.d", "init.el")); err != nil || string(data) != "precious\n" {
+		t.Errorf("the populated directory lost its file: %q, %v", data, err)
+	}
+	for _, name := range []string{".zshrc", ".empty"} {
+		if !resolvesTo(filepath.Join(home, name), filepath.Join(dotpilotDir, "common", name)) {
+			t.Errorf("%s isn't linked", name)
+		}
+	}
+
+	// It remains a conflict until resolved by moving the directory aside
+	conflicts, err := detectConflicts(dotpilotDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || !conflicts[0].Directory {
+		t.Fatalf("conflicts = %+v, want the directory", conflicts)
+	}
+	if _, err := resolveConflict(conflicts[0], StrategyKeepLocal); err == nil {
+		t.Error("keep-local resolved a directory conflict")
+	}
+	decision, err := resolveConflict(conflicts[0], StrategyKeepRemote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(decision.Backup, "init.el")); err != nil || string(data) != "precious\n" {
+		t.Errorf("the directory wasn't moved to %s: %q, %v", decision.Backup, data, err)
+	}
+	if !resolvesTo(filepath.Join(home, ".emacs.d"), filepath.Join(dotpilotDir, "common", ".emacs.d")) {
+		t.Error(".emacs.d isn't linked after keeping the remote version")
+	}
+}
+
+func TestApplyInteractive(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+	currentConfig.CurrentEnvironment = "default"
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	for _, name := range []string{".a", ".b", ".c"} {
+		writeRepoFile(t, dotpilotDir, "common/"+name, "repo\n")
+	}
+	writeRepoFile(t, home, ".b", "local\n")
+
+	// Quitting at the first question changes nothing
+	opts := ApplyOptions{Backup: true, QuietShadows: true, Interactive: true, input: strings.NewReader("q\n")}
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "default", opts); !errors.Is(err, ErrApplyQuit) {
+		t.Fatalf("apply = %v, want ErrApplyQuit", err)
+	}
+	for _, name := range []string{".a", ".c"} {
+		if _, err := os.Lstat(filepath.Join(home, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was linked after quitting: %v", name, err)
+		}
+	}
+
+	// Skip .a, look at the diff of .b and replace it, link .c
+	opts.input = strings.NewReader("s\nd\na\na\n")
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "default", opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(home, ".a")); !os.IsNotExist(err) {
+		t.Errorf(".a was linked after skipping it: %v", err)
+	}
+	for _, name := range []string{".b", ".c"} {
+		if !resolvesTo(filepath.Join(home, name), filepath.Join(dotpilotDir, "common", name)) {
+			t.Errorf("%s isn't linked", name)
+		}
+	}
+	backups, _ := filepath.Glob(filepath.Join(home, ".b.dotpilot.bak.*"))
+	if len(backups) != 1 {
+		t.Fatalf("backups of .b: %v", backups)
+	}
+	if data, err := os.ReadFile(backups[0]); err != nil || string(data) != "local\n" {
+		t.Errorf("backup holds %q, %v", data, err)
+	}
+}
@@ -0,0 +1,210 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// environmentKeepFile keeps an empty environment directory in git
+const environmentKeepFile = ".gitkeep"
+
+// ValidateEnvironmentName rejects names that aren't a single safe path
+// segment below envs/
+func ValidateEnvironmentName(name string) error {
+	valid := name != "" && !strings.HasPrefix(name, ".") && !strings.HasPrefix(name, "-")
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._-", c)) {
+			valid = false
+		}
+	}
+	if !valid || strings.Contains(name, "..") {
+		return fmt.Errorf("invalid environment name %q, use letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+// environmentDir returns the layer directory of an environment
+func environmentDir(dotpilotDir, name string) string {
+	return filepath.Join(dotpilotDir, "envs", name)
+}
+
+// ListEnvironments returns the names of the environments of the repository,
+// sorted
+func ListEnvironments(dotpilotDir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(dotpilotDir, "envs"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// CreateEnvironment creates the layer directory of a new environment. With
+// from set to "common" or the name of another environment, the files of that
+// layer are copied into it; otherwise it starts out empty, holding only a
+// .gitkeep so git records it.
+func CreateEnvironment(dotpilotDir, name, from string) error {
+	if err := ValidateEnvironmentName(name); err != nil {
+		return err
+	}
+	dir := environmentDir(dotpilotDir, name)
+	if _, err := os.Lstat(dir); err == nil {
+		return fmt.Errorf("%w: %s", ErrEnvironmentExists, name)
+	}
+
+	if from == "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, environmentKeepFile), nil, 0644)
+	}
+
+	source := filepath.Join(dotpilotDir, "common")
+	if from != "common" {
+		if err := ValidateEnvironmentName(from); err != nil {
+			return err
+		}
+		source = environmentDir(dotpilotDir, from)
+	}
+	if info, err := os.Stat(source); err != nil || !info.IsDir() {
+		return fmt.Errorf("%w: %s", ErrEnvironmentNotFound, from)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	if err := utils.CopyTree(source, dir); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	utils.Logger.Debug().Msgf("Seeded environment %s from %s", name, source)
+	return nil
+}
+
+// DeleteEnvironment removes the layer directory of an environment. Symlinks
+// in home that point into it are removed as well, so deleting the current
+// environment doesn't leave dangling links behind. It returns the removed
+// links.
+func DeleteEnvironment(dotpilotDir, home, name string) ([]string, error) {
+	if err := ValidateEnvironmentName(name); err != nil {
+		return nil, err
+	}
+	dir := environmentDir(dotpilotDir, name)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%w: %s", ErrEnvironmentNotFound, name)
+	}
+
+	var removed []string
+	err := walkLayerLinks(dir, home, func(target, relPath string) error {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+		removed = append(removed, target)
+		return nil
+	})
+	if err != nil {
+		return removed, err
+	}
+	return removed, os.RemoveAll(dir)
+}
+
+// RenameEnvironment renames the layer directory of an environment. Symlinks
+// in home that point into it are pointed at the new directory, and the
+// configuration is updated if it is the current environment. It returns the
+// relinked targets.
+func RenameEnvironment(dotpilotDir, home, oldName, newName string) ([]string, error) {
+	for _, name := range []string{oldName, newName} {
+		if err := ValidateEnvironmentName(name); err != nil {
+			return nil, err
+		}
+	}
+	oldDir := environmentDir(dotpilotDir, oldName)
+	newDir := environmentDir(dotpilotDir, newName)
+	if info, err := os.Stat(oldDir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%w: %s", ErrEnvironmentNotFound, oldName)
+	}
+	if _, err := os.Lstat(newDir); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrEnvironmentExists, newName)
+	}
+
+	// Collect the links first, they can't be resolved once the directory
+	// moved. Relative links stay relative.
+	links := map[string]string{}
+	err := walkLayerLinks(oldDir, home, func(target, relPath string) error {
+		link, err := os.Readlink(target)
+		if err != nil {
+			return err
+		}
+		links[target] = symlinkContent(target, filepath.Join(newDir, relPath), !filepath.IsAbs(link))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(oldDir, newDir); err != nil {
+		return nil, err
+	}
+
+	relinked := make([]string, 0, len(links))
+	for target, source := range links {
+		if err := os.Remove(target); err != nil {
+			return relinked, err
+		}
+		if err := os.Symlink(source, target); err != nil {
+			return relinked, err
+		}
+		relinked = append(relinked, target)
+	}
+	sort.Strings(relinked)
+
+	current := GetConfig().CurrentEnvironment
+	if current == oldName || current == "" && oldName == "default" {
+		if err := UpdateEnvironment(newName); err != nil {
+			return relinked, err
+		}
+	}
+	return relinked, nil
+}
+
+// walkLayerLinks calls fn for every path in home that is a symlink to the file
+// or directory at the same relative path in layerDir
+func walkLayerLinks(layerDir, home string, fn func(target, relPath string) error) error {
+	return filepath.Walk(layerDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(layerDir, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+
+		target := expandXDG(home, filepath.ToSlash(relPath))
+		targetInfo, err := os.Lstat(target)
+		if err != nil || targetInfo.Mode()&os.ModeSymlink == 0 || !resolvesTo(target, path) {
+			return nil
+		}
+		if err := fn(target, relPath); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
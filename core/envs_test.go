@@ -0,0 +1,125 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestValidateEnvironmentName(t *testing.T) {
+	for _, name := range []string{"dev", "work-laptop", "prod_2", "v1.2"} {
+		if err := ValidateEnvironmentName(name); err != nil {
+			t.Errorf("ValidateEnvironmentName(%q) = %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", ".hidden", "-rf", "a/b", `a\b`, "a..b", "with space"} {
+		if err := ValidateEnvironmentName(name); err == nil {
+			t.Errorf("ValidateEnvironmentName(%q) accepted", name)
+		}
+	}
+}
+
+func TestCreateEnvironment(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "common\n")
+	writeRepoFile(t, dotpilotDir, "envs/prod/.vimrc", "prod\n")
+
+	if err := CreateEnvironment(dotpilotDir, "empty", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dotpilotDir, "envs", "empty", ".gitkeep")); err != nil {
+		t.Errorf("empty environment has no .gitkeep: %v", err)
+	}
+
+	if err := CreateEnvironment(dotpilotDir, "dev", "common"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dotpilotDir, "envs", "dev", ".zshrc")); err != nil || string(data) != "common\n" {
+		t.Errorf("dev/.zshrc = %q, %v", data, err)
+	}
+
+	if err := CreateEnvironment(dotpilotDir, "staging", "prod"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dotpilotDir, "envs", "staging", ".vimrc")); err != nil || string(data) != "prod\n" {
+		t.Errorf("staging/.vimrc = %q, %v", data, err)
+	}
+
+	if err := CreateEnvironment(dotpilotDir, "dev", ""); !errors.Is(err, ErrEnvironmentExists) {
+		t.Errorf("creating dev twice = %v, want ErrEnvironmentExists", err)
+	}
+	if err := CreateEnvironment(dotpilotDir, "qa", "missing"); !errors.Is(err, ErrEnvironmentNotFound) {
+		t.Errorf("seeding from a missing environment = %v, want ErrEnvironmentNotFound", err)
+	}
+	if _, err := os.Stat(filepath.Join(dotpilotDir, "envs", "qa")); !os.IsNotExist(err) {
+		t.Errorf("failed create left envs/qa behind: %v", err)
+	}
+
+	names, err := ListEnvironments(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dev", "empty", "prod", "staging"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ListEnvironments = %v, want %v", names, want)
+	}
+}
+
+func TestRenameAndDeleteEnvironment(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "common\n")
+	writeRepoFile(t, dotpilotDir, "envs/work/.vimrc", "work\n")
+	if err := CommitChanges(dotpilotDir, "initial"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateDefaultConfigFile("", "work"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "work", ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	relinked, err := RenameEnvironment(dotpilotDir, home, "work", "office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vimrc := filepath.Join(home, ".vimrc")
+	if want := []string{vimrc}; !reflect.DeepEqual(relinked, want) {
+		t.Errorf("relinked = %v, want %v", relinked, want)
+	}
+	if link, err := os.Readlink(vimrc); err != nil || link != filepath.Join(dotpilotDir, "envs", "office", ".vimrc") {
+		t.Errorf(".vimrc links to %q, %v", link, err)
+	}
+	if got := GetConfig().CurrentEnvironment; got != "office" {
+		t.Errorf("current environment = %q, want office", got)
+	}
+	if _, err := RenameEnvironment(dotpilotDir, home, "work", "other"); !errors.Is(err, ErrEnvironmentNotFound) {
+		t.Errorf("renaming a missing environment = %v, want ErrEnvironmentNotFound", err)
+	}
+
+	removed, err := DeleteEnvironment(dotpilotDir, home, "office")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{vimrc}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed = %v, want %v", removed, want)
+	}
+	if _, err := os.Lstat(vimrc); !os.IsNotExist(err) {
+		t.Errorf(".vimrc still exists: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(home, ".zshrc")); err != nil {
+		t.Errorf("link of the common layer was removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dotpilotDir, "envs", "office")); !os.IsNotExist(err) {
+		t.Errorf("envs/office still exists: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sentinel errors returned by the core package. They are usually wrapped with
+// more context, so callers should compare with errors.Is.
+var (
+	// ErrNotInitialized is returned when the dotpilot repository does not exist
+	ErrNotInitialized = errors.New("dotpilot is not initialized")
+	// ErrFileExists is returned when a destination already exists and
+	// overwriting was not requested
+	ErrFileExists = errors.New("file already exists")
+	// ErrSecretExists is returned when adding a secret under a name that is taken
+	ErrSecretExists = errors.New("secret already exists")
+	// ErrSecretNotFound is returned when a named secret does not exist
+	ErrSecretNotFound = errors.New("secret not found")
+	// ErrGPGUnavailable is returned when gpg is needed but not installed
+	ErrGPGUnavailable = errors.New("gpg is not installed")
+	// ErrSopsUnavailable is returned when sops is needed but not installed
+	ErrSopsUnavailable = errors.New("sops is not installed")
+	// ErrNoGPGKey is returned when gpg is installed but has no usable key
+	ErrNoGPGKey = errors.New("no GPG key available")
+	// ErrEncryptFailed is returned when gpg, sops or AES could not encrypt a
+	// secret
+	ErrEncryptFailed = errors.New("encryption failed")
+	// ErrDecryptFailed is returned when a secret could not be decrypted, for
+	// example with the wrong key or a damaged blob
+	ErrDecryptFailed = errors.New("decryption failed")
+	// ErrUnsupportedPackageSystem is returned for unknown package managers
+	ErrUnsupportedPackageSystem = errors.New("unsupported package system")
+	// ErrStashExists is returned when stashing while an earlier stash is pending
+	ErrStashExists = errors.New("a previous stash is pending")
+	// ErrUntrackableSource is returned when tracking the home directory or
+	// the dotpilot repository or a path in it, which would move the
+	// repository into itself
+	ErrUntrackableSource = errors.New("can't track the home directory or the dotpilot repository")
+	// ErrManagedDestination is returned when a decrypted secret would be
+	// written into the dotpilot repository, typically through a symlink
+	ErrManagedDestination = errors.New("destination is inside the dotpilot repository")
+	// ErrLocked is returned when another dotpilot process holds the
+	// repository lock
+	ErrLocked = errors.New("another dotpilot operation is in progress")
+	// ErrSnapshotExists is returned when creating a snapshot under a name
+	// that is taken
+	ErrSnapshotExists = errors.New("snapshot already exists")
+	// ErrSnapshotNotFound is returned when a named snapshot does not exist
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	// ErrNetwork is returned when the remote could not be reached
+	ErrNetwork = errors.New("the remote could not be reached")
+	// ErrAuthFailed is returned when the remote rejected the credentials
+	ErrAuthFailed = errors.New("authentication with the remote failed")
+	// ErrDiskFull is returned when there is no space left to write to
+	ErrDiskFull = errors.New("no space left on device")
+	// ErrInterrupted is returned when an operation was canceled, for example
+	// with Ctrl-C
+	ErrInterrupted = errors.New("interrupted")
+	// ErrEnvironmentExists is returned when creating an environment under a
+	// name that is taken
+	ErrEnvironmentExists = errors.New("environment already exists")
+	// ErrEnvironmentNotFound is returned when a named environment does not
+	// exist
+	ErrEnvironmentNotFound = errors.New("environment not found")
+	// ErrEnvironmentInUse is returned when deleting the current environment
+	ErrEnvironmentInUse = errors.New("environment is the current environment")
+	// ErrSensitiveContent is returned when a file about to be tracked as
+	// plaintext looks like it holds a secret
+	ErrSensitiveContent = errors.New("file looks like it contains a secret")
+	// ErrApplyInterrupted is returned when an earlier apply was interrupted
+	// and its changes have to be recovered first
+	ErrApplyInterrupted = errors.New("an earlier apply was interrupted")
+	// ErrConflict is matched by ConflictError
+	ErrConflict = errors.New("unresolved conflicts")
+	// ErrApplyQuit is returned when the user quits an interactive apply
+	ErrApplyQuit = errors.New("apply quit")
+	// ErrConflictsAborted is returned when the user aborts an interactive
+	// conflict resolution before anything was changed
+	ErrConflictsAborted = errors.New("conflict resolution aborted")
+	// ErrCommitRejected is returned when the pre-commit hook of the
+	// repository fails
+	ErrCommitRejected = errors.New("commit rejected")
+	// ErrLayoutTooNew is returned when the repository was migrated by a newer
+	// version of dotpilot
+	ErrLayoutTooNew = errors.New("the repository layout is newer than this dotpilot")
+	// ErrUntrustedCommit is matched by UntrustedCommitsError
+	ErrUntrustedCommit = errors.New("commit not signed by a trusted key")
+)
+
+// ConflictError reports conflicts that could not be resolved
+type ConflictError struct {
+	Targets []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%d conflicts could not be resolved: %s", len(e.Targets), strings.Join(e.Targets, ", "))
+}
+
+// Is makes errors.Is(err, ErrConflict) match a ConflictError
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
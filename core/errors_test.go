@@ -0,0 +1,44 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConflictErrorIs(t *testing.T) {
+	var err error = &ConflictError{Targets: []string{"/home/u/.bashrc"}}
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("errors.Is(%v, ErrConflict) = false", err)
+	}
+
+	var conflictErr *ConflictError
+	if !errors.As(err, &conflictErr) || len(conflictErr.Targets) != 1 {
+		t.Errorf("errors.As did not recover the targets from %v", err)
+	}
+}
+
+func TestCanAdd(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	sm := NewSecretManager(dotpilotDir)
+	if err := os.MkdirAll(sm.secretsDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sm.secretsDir, "taken"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sm.CanAdd("taken", false); !errors.Is(err, ErrSecretExists) {
+		t.Errorf("CanAdd(taken, false) = %v, want ErrSecretExists", err)
+	}
+	if err := sm.CanAdd("taken", true); err != nil {
+		t.Errorf("CanAdd(taken, true) = %v", err)
+	}
+	if err := sm.CanAdd("free", false); err != nil {
+		t.Errorf("CanAdd(free, false) = %v", err)
+	}
+	if err := sm.RemoveSecret("free"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("RemoveSecret(free) = %v, want ErrSecretNotFound", err)
+	}
+}
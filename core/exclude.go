@@ -0,0 +1,67 @@
+package core
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFile lists exclude patterns in the repository root that apply and
+// bootstrap always use, one per line
+const ignoreFile = ".dotpilotignore"
+
+// ExcludePatterns returns the exclude patterns of the .dotpilotignore file in
+// the repository followed by extra, for example those given with --exclude.
+// Blank lines and lines starting with # are ignored.
+//
+// Patterns are globs matched against the target path relative to the home
+// directory, like ".config/JetBrains" or ".local/share/*". A pattern without
+// a slash matches the name at any depth, a pattern ending in a slash only
+// matches directories, and excluding a directory excludes everything in it.
+func ExcludePatterns(dotpilotDir string, extra []string) ([]string, error) {
+	var patterns []string
+	file, err := os.Open(filepath.Join(dotpilotDir, ignoreFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				patterns = append(patterns, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return append(patterns, extra...), nil
+}
+
+// excludedBy returns the first of patterns that matches relPath, the
+// slash-separated target path relative to the home directory, or "" if none
+// does. See ExcludePatterns for the syntax.
+func excludedBy(patterns []string, relPath string, isDir bool) string {
+	for _, pattern := range patterns {
+		p := strings.TrimPrefix(strings.TrimPrefix(filepath.ToSlash(pattern), "~/"), "/")
+		if strings.HasSuffix(p, "/") {
+			if !isDir {
+				continue
+			}
+			p = strings.TrimSuffix(p, "/")
+		}
+
+		name := relPath
+		if !strings.Contains(p, "/") {
+			name = path.Base(relPath)
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return pattern
+		}
+	}
+	return ""
+}
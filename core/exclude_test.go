@@ -0,0 +1,29 @@
+package core
+
+import "testing"
+
+func TestExcludedBy(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		match   bool
+	}{
+		{"*.local", ".zshrc.local", false, true},
+		{"*.local", ".config/git/config.local", false, true},
+		{".zshrc", ".zshrc", false, true},
+		{".zshrc", ".zshrc.local", false, false},
+		{"~/.config/JetBrains", ".config/JetBrains", true, true},
+		{"/.config/JetBrains", ".config/JetBrains", true, true},
+		{".config/*/cache", ".config/app/cache", true, true},
+		{".config/*", ".config/app/conf", false, false},
+		{"cache/", "cache", true, true},
+		{"cache/", "cache", false, false},
+	}
+	for _, tt := range tests {
+		got := excludedBy([]string{tt.pattern}, tt.path, tt.isDir) != ""
+		if got != tt.match {
+			t.Errorf("excludedBy(%q, %q, %v) = %v, want %v", tt.pattern, tt.path, tt.isDir, got, tt.match)
+		}
+	}
+}
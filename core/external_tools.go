@@ -0,0 +1,110 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// External merge and diff tools
+//
+// Resolving a conflict by merging, or viewing its diff, runs the first of a
+// list of known tools that is installed. Options["merge_tool"] and
+// Options["diff_tool"] in ~/.dotpilotrc pick another, as the program and its
+// arguments in a list, so a path with spaces in it works:
+//
+//	"merge_tool": ["/opt/My Tools/bin/merge", "--wait"]
+//
+// A string is the path of the program, taken whole. The paths of the files
+// are appended to the arguments: the local file, the merged result and the
+// remote file for a merge tool, the local and the remote file for a diff
+// tool. 'dotpilot diff --tool' can name a tool for one run instead, see
+// ViewDiffExternal.
+
+var (
+	// defaultMergeTools are tried in order unless Options["merge_tool"] is set
+	defaultMergeTools = [][]string{{"meld"}, {"kdiff3"}, {"vimdiff"}, {"code", "-d"}}
+	// defaultDiffTools are tried in order unless Options["diff_tool"] is set
+	defaultDiffTools = [][]string{{"meld"}, {"kdiff3"}, {"vimdiff"}, {"code", "-d"}, {"diff", "-u"}}
+)
+
+// externalTool returns the argv of the tool Options[option] configures, or
+// of the first of defaults that is installed. It returns nil if none is.
+func externalTool(option string, defaults [][]string) ([]string, error) {
+	value, ok := GetConfig().Options[option]
+	if !ok || value == nil {
+		for _, tool := range defaults {
+			if _, err := exec.LookPath(tool[0]); err == nil {
+				return tool, nil
+			}
+		}
+		return nil, nil
+	}
+
+	var tool []string
+	switch v := value.(type) {
+	case string:
+		tool = []string{v}
+	case []string:
+		tool = v
+	case []interface{}:
+		for _, item := range v {
+			arg, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid %s option: %v is not a string", option, item)
+			}
+			tool = append(tool, arg)
+		}
+	default:
+		return nil, fmt.Errorf("invalid %s option: expected a list like [\"code\", \"-d\"]", option)
+	}
+	if len(tool) == 0 || strings.TrimSpace(tool[0]) == "" {
+		return nil, fmt.Errorf("invalid %s option: no program", option)
+	}
+	if _, err := exec.LookPath(tool[0]); err != nil {
+		return nil, fmt.Errorf("%s option: %w", option, err)
+	}
+	return tool, nil
+}
+
+// toolCommand returns the command running tool on paths, wired to the
+// terminal
+func toolCommand(tool []string, paths ...string) *exec.Cmd {
+	args := append(append([]string(nil), tool[1:]...), paths...)
+	cmd := exec.Command(tool[0], args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// ViewDiffExternal compares from with to in a diff tool: tool, the program
+// and its arguments, if given, else the one Options["diff_tool"] configures
+// or the first of defaultDiffTools that is installed. If there is none, diff
+// is printed to out instead.
+func ViewDiffExternal(out io.Writer, tool []string, from, to, diff string) error {
+	selectedTool := tool
+	if len(tool) > 0 {
+		if _, err := exec.LookPath(tool[0]); err != nil {
+			return fmt.Errorf("diff tool %s: %w", tool[0], err)
+		}
+	} else {
+		var err error
+		if selectedTool, err = externalTool("diff_tool", defaultDiffTools); err != nil {
+			return err
+		}
+	}
+
+	if selectedTool == nil {
+		fmt.Fprintf(out, "Diff between %s and %s:\n%s\n", from, to, diff)
+		return nil
+	}
+
+	cmd := toolCommand(selectedTool, from, to)
+	utils.Logger.Info().Msgf("Launching diff tool: %q", cmd.Args)
+	return cmd.Run()
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,8 +13,204 @@ import (
 	"github.com/dotpilot/utils"
 )
 
-// TrackFile tracks a file or directory in dotpilot
+// ExistingAction says what tracking does with a file that is already in the
+// repository
+type ExistingAction int
+
+const (
+	// ExistingFail stops with ErrFileExists
+	ExistingFail ExistingAction = iota
+	// ExistingOverwrite replaces the file in the repository
+	ExistingOverwrite
+	// ExistingSkip leaves the file in the repository and the source untouched
+	ExistingSkip
+	// ExistingPrompt asks for each file whether to overwrite or skip it. It
+	// skips without asking when prompts are disabled.
+	ExistingPrompt
+)
+
+// TrackOptions controls how files are tracked
+type TrackOptions struct {
+	Existing ExistingAction // What to do with files already in the repository
+	// ForcePlaintext tracks files that LooksSensitive flags instead of
+	// refusing with ErrSensitiveContent
+	ForcePlaintext bool
+	// DryRun only fills in TrackResult.Plan, nothing is copied, linked or
+	// asked. Files that would be asked about are planned as TrackAsk, and
+	// duplicates as skipped like without a terminal.
+	DryRun bool
+	// Relative replaces the tracked files with links relative to their
+	// directory, also set by Options["relative_symlinks"]
+	Relative bool
+	// Dereference follows symlinks to directories outside the repository and
+	// tracks the files in them, instead of tracking the links as links
+	Dereference bool
+	// Move renames regular files into the repository instead of copying
+	// them, so nothing is backed up, see moveSingleFile
+	Move bool
+	// LinkMode replaces the tracked files with a hardlink or copy of the
+	// repo file instead of a symlink, see MaterializeFile. Recording it for
+	// apply is up to the caller, see RecordLinkModes.
+	LinkMode LinkMode
+}
+
+// TrackResult reports what a track did or, with DryRun, would do
+type TrackResult struct {
+	Skipped    []string // Sources not tracked because their destination exists
+	Duplicates []string // Sources not tracked because their content is tracked already
+	// Plan has what happens to each file, in the order they are tracked
+	Plan []TrackPlanEntry
+}
+
+// TrackAction classifies what tracking does with a file
+type TrackAction string
+
+const (
+	TrackNewCopy          TrackAction = "new-copy"          // Copied into the repository
+	TrackOverwrite        TrackAction = "overwrite"         // Replaces the file in the repository
+	TrackSymlink          TrackAction = "symlink"           // A symlink of the user's own, tracked as a link
+	TrackAlreadyLinked    TrackAction = "already-linked"    // Applied from the repository already
+	TrackAsk              TrackAction = "ask"               // In the repository already, track asks what to do
+	TrackSkippedExisting  TrackAction = "skipped-existing"  // In the repository already and left alone
+	TrackSkippedDuplicate TrackAction = "skipped-duplicate" // Identical to a file tracked in another layer
+	TrackSkippedByIgnore  TrackAction = "skipped-by-ignore" // Matches a pattern in .dotpilotignore
+)
+
+// TrackActions lists the actions in the order they are reported in
+var TrackActions = []TrackAction{
+	TrackNewCopy, TrackOverwrite, TrackSymlink, TrackAlreadyLinked, TrackAsk,
+	TrackSkippedExisting, TrackSkippedDuplicate, TrackSkippedByIgnore,
+}
+
+// TrackPlanEntry is what tracking does with one file, or with a directory
+// that is skipped as a whole
+type TrackPlanEntry struct {
+	Source      string      `json:"source"`
+	Destination string      `json:"destination"`
+	Action      TrackAction `json:"action"`
+	// Backup is set if the source is moved to a backup and replaced by a
+	// link into the repository
+	Backup bool `json:"backup"`
+}
+
+// TrackFile tracks a file or directory in dotpilot. A symlink that doesn't
+// point into the repository is tracked as a symlink, see trackSymlink.
 func TrackFile(source, destination, dotpilotDir string, overwrite bool) error {
+	existing := ExistingFail
+	if overwrite {
+		existing = ExistingOverwrite
+	}
+	_, err := TrackFileWithOptions(source, destination, dotpilotDir, TrackOptions{Existing: existing})
+	return err
+}
+
+// TrackFileWithOptions tracks a file or directory in dotpilot, deciding per
+// file what to do with destinations that already exist. Files whose source
+// already links to their destination are tracked and left alone. Unless
+// opts.ForcePlaintext is set, nothing is tracked if a file looks like it
+// holds a secret, see LooksSensitive.
+func TrackFileWithOptions(source, destination, dotpilotDir string, opts TrackOptions) (TrackResult, error) {
+	home, err := Home()
+	if err != nil {
+		return TrackResult{}, err
+	}
+	if err := CheckTrackSource(home, dotpilotDir, source); err != nil {
+		return TrackResult{}, err
+	}
+
+	t := &tracker{dotpilotDir: dotpilotDir, existing: opts.Existing, dryRun: opts.DryRun, relative: opts.Relative || RelativeSymlinks(), dereference: opts.Dereference, move: opts.Move, linkMode: opts.LinkMode}
+	if t.linkMode == "" {
+		t.linkMode = LinkSymlink
+	}
+	if !opts.ForcePlaintext && !t.tracksAsLink(source) {
+		if err := checkSensitive(source, t.follow()); err != nil {
+			return TrackResult{}, err
+		}
+	}
+
+	if patterns, err := ExcludePatterns(dotpilotDir, nil); err != nil {
+		utils.Logger.Warn().Err(err).Msgf("Failed to read %s", ignoreFile)
+	} else {
+		t.ignore = patterns
+	}
+	err = t.track(source, destination)
+	return t.result, err
+}
+
+// CheckTrackSource returns ErrUntrackableSource if source is home, or is,
+// contains or lies inside dotpilotDir. Tracking any of them would copy the
+// repository into itself and replace its files, .git included, with links.
+func CheckTrackSource(home, dotpilotDir, source string) error {
+	absSource, err := filepath.Abs(source)
+	if err != nil {
+		return err
+	}
+	absHome, err := filepath.Abs(home)
+	if err != nil {
+		return err
+	}
+	absDotpilotDir, err := filepath.Abs(dotpilotDir)
+	if err != nil {
+		return err
+	}
+	if absSource == absHome || insideDir(absDotpilotDir, absSource) || insideDir(absSource, absDotpilotDir) {
+		return fmt.Errorf("%w: %s", ErrUntrackableSource, source)
+	}
+	return nil
+}
+
+// tracker carries the choice for existing destinations through a track, so
+// "skip all" or "overwrite all" holds for the rest of a directory
+type tracker struct {
+	dotpilotDir string
+	existing    ExistingAction
+	reader      *bufio.Reader
+	duplicates  *duplicateIndex // Built on first use
+	dryRun      bool
+	relative    bool // Link relative to the directory of the source
+	dereference bool // Follow symlinked directories, see TrackOptions
+	move        bool // Move files into the repository, see TrackOptions
+	linkMode    LinkMode // How the tracked files are replaced, see TrackOptions
+	ignore      []string // Patterns of files inside tracked directories to leave out
+	result      TrackResult
+}
+
+// plan records what happens to source
+func (t *tracker) plan(source, destination string, action TrackAction, backup bool) {
+	t.result.Plan = append(t.result.Plan, TrackPlanEntry{Source: source, Destination: destination, Action: action, Backup: backup})
+}
+
+// follow returns the symlinks walkTree follows when tracking a directory:
+// none, or with dereference those to directories outside the repository
+func (t *tracker) follow() func(path string) bool {
+	if !t.dereference {
+		return nil
+	}
+	return func(path string) bool {
+		return isForeignSymlink(path, t.dotpilotDir)
+	}
+}
+
+// tracksAsLink reports whether source is a symlink of the user's own that is
+// tracked as a link rather than by what it points to
+func (t *tracker) tracksAsLink(source string) bool {
+	if !isForeignSymlink(source, t.dotpilotDir) {
+		return false
+	}
+	if t.dereference {
+		if info, err := os.Stat(source); err == nil && info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// track tracks a file or directory
+func (t *tracker) track(source, destination string) error {
+	if t.tracksAsLink(source) {
+		return t.trackSymlink(source, destination)
+	}
+
 	// Check if source exists
 	sourceInfo, err := os.Stat(source)
 	if err != nil {
@@ -22,38 +219,56 @@ func TrackFile(source, destination, dotpilotDir string, overwrite bool) error {
 
 	// Create destination directory
 	destDir := filepath.Dir(destination)
-	if err := os.MkdirAll(destDir, 0755); err != nil {
-		return err
-	}
-
-	// Check if destination already exists
-	_, err = os.Stat(destination)
-	if err == nil && !overwrite {
-		return fmt.Errorf("destination already exists: %s", destination)
+	if !t.dryRun {
+		if err := os.MkdirAll(destDir, 0755); err != nil {
+			return err
+		}
 	}
 
-	// Handle directory
+	// Handle directory, the files in an existing one are checked one by one
 	if sourceInfo.IsDir() {
-		return trackDirectory(source, destination, overwrite)
+		if _, err := os.Stat(destination); err == nil && t.existing == ExistingFail {
+			return fmt.Errorf("%w: %s", ErrFileExists, destination)
+		}
+		return t.trackDirectory(source, destination)
 	}
 
 	// Handle file
-	return trackSingleFile(source, destination, overwrite)
+	return t.trackSingleFile(source, destination)
 }
 
-// trackDirectory tracks a directory and its contents
-func trackDirectory(source, destination string, overwrite bool) error {
+// trackDirectory tracks a directory and its contents. Files and directories
+// matching a pattern of .dotpilotignore, relative to the home directory, are
+// left out. Symlinked directories inside it are tracked as links, or with
+// dereference followed, see walkTree.
+func (t *tracker) trackDirectory(source, destination string) error {
 	// Create destination directory
-	if err := os.MkdirAll(destination, 0755); err != nil {
+	if !t.dryRun {
+		if err := os.MkdirAll(destination, 0755); err != nil {
+			return err
+		}
+	}
+	home, err := Home()
+	if err != nil {
+		return err
+	}
+	dotpilotDir, err := filepath.Abs(t.dotpilotDir)
+	if err != nil {
 		return err
 	}
 
 	// Walk through the source directory
-	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+	return walkTree(source, t.follow(), func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
+		// Never descend into the repository itself
+		if abs, _ := filepath.Abs(path); info.IsDir() && abs == dotpilotDir {
+			utils.Logger.Debug().Msgf("Skipping the dotpilot repository %s", path)
+			return filepath.SkipDir
+		}
+
 		// Get the relative path from the source directory
 		relPath, err := filepath.Rel(source, path)
 		if err != nil {
@@ -68,31 +283,77 @@ func trackDirectory(source, destination string, overwrite bool) error {
 		// Construct the destination path
 		destPath := filepath.Join(destination, relPath)
 
+		// Leave out what apply would exclude anyway
+		if relHome, ok := HomeRelPath(home, path); ok {
+			if pattern := excludedBy(t.ignore, relHome, info.IsDir()); pattern != "" {
+				utils.Logger.Debug().Msgf("Skipping %s (matches %s)", path, pattern)
+				t.plan(path, destPath, TrackSkippedByIgnore, false)
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
 		// Handle directory
 		if info.IsDir() {
+			if t.dryRun {
+				return nil
+			}
 			if err := os.MkdirAll(destPath, info.Mode()); err != nil {
 				return err
 			}
 			return nil
 		}
 
+		// Handle symlinks of the user's own
+		if info.Mode()&os.ModeSymlink != 0 && isForeignSymlink(path, t.dotpilotDir) {
+			return t.trackSymlink(path, destPath)
+		}
+
 		// Handle file
-		return trackSingleFile(path, destPath, overwrite)
+		return t.trackSingleFile(path, destPath)
 	})
 }
 
 // trackSingleFile tracks a single file
-func trackSingleFile(source, destination string, overwrite bool) error {
+func (t *tracker) trackSingleFile(source, destination string) error {
 	// Get source info
 	sourceInfo, err := os.Stat(source)
 	if err != nil {
 		return err
 	}
 
+	// A source applied from the repository is tracked already, copying it
+	// onto itself would empty it
+	if resolvesTo(source, destination) {
+		utils.Logger.Info().Msgf("%s is already tracked", source)
+		t.plan(source, destination, TrackAlreadyLinked, false)
+		return nil
+	}
+
 	// Check if destination already exists
-	_, err = os.Stat(destination)
-	if err == nil && !overwrite {
-		return fmt.Errorf("destination already exists: %s", destination)
+	_, err = os.Lstat(destination)
+	action := TrackNewCopy
+	if err == nil {
+		action = TrackOverwrite
+	}
+	if write, err := t.shouldWrite(source, destination); !write || err != nil {
+		return err
+	}
+
+	// Check if the same content is tracked already
+	if !t.checkDuplicate(source, destination) {
+		return nil
+	}
+
+	// The source is replaced by a link unless it links to the destination
+	linkInfo, err := os.Lstat(source)
+	backup := err == nil && linkInfo.Mode()&os.ModeSymlink == 0
+	move := t.move && backup
+	t.plan(source, destination, action, backup && !move)
+	if t.dryRun {
+		return nil
 	}
 
 	// Create destination directory
@@ -100,51 +361,207 @@ func trackSingleFile(source, destination string, overwrite bool) error {
 	if err := os.MkdirAll(destDir, 0755); err != nil {
 		return err
 	}
+	if move {
+		return t.moveSingleFile(source, destination, sourceInfo.Size())
+	}
 
 	// Copy file
-	if err := copyFile(source, destination, sourceInfo.Mode()); err != nil {
+	if err := copyTextFile(source, destination, sourceInfo.Mode()); err != nil {
 		return err
 	}
+	if t.duplicates != nil {
+		t.duplicates.add(destination, sourceInfo.Size())
+	}
 
 	// Create symlink, first backup existing file if necessary
 	linkSource := destination
 	linkDest := source
 
 	// Check if source is already a symlink
-	linkInfo, err := os.Lstat(source)
 	if err == nil && linkInfo.Mode()&os.ModeSymlink != 0 {
 		// If it's already a symlink, check if it points to our destination
-		linkTarget, err := os.Readlink(source)
-		if err == nil && linkTarget == destination {
+		if linksTo(source, destination) {
 			utils.Logger.Debug().Msgf("Symlink already exists: %s -> %s", source, destination)
 			return nil
 		}
 	}
 
 	// Backup existing file if it's not already a symlink to our destination
-	if err == nil && linkInfo.Mode()&os.ModeSymlink == 0 {
+	if backup {
 		backupPath := source + ".dotpilot.bak." + time.Now().Format("20060102150405")
 		utils.Logger.Debug().Msgf("Backing up %s to %s", source, backupPath)
-		if err := os.Rename(source, backupPath); err != nil {
+		if err := utils.MoveFile(source, backupPath); err != nil {
 			return err
 		}
+		pruneBackupsOf(source)
 	}
 
-	// Create symlink
-	utils.Logger.Debug().Msgf("Creating symlink: %s -> %s", linkDest, linkSource)
-	if err := os.Symlink(linkSource, linkDest); err != nil {
-		return err
+	// Create symlink, or a hardlink or copy in those link modes
+	if t.linkMode != LinkSymlink {
+		if _, err := MaterializeFile(linkSource, linkDest, t.linkMode); err != nil {
+			return err
+		}
+	} else {
+		utils.Logger.Debug().Msgf("Creating symlink: %s -> %s", linkDest, linkSource)
+		if err := os.Symlink(symlinkContent(linkDest, linkSource, t.relative), linkDest); err != nil {
+			return err
+		}
 	}
 
 	// Update tracking list
-	relSource, err := filepath.Rel(os.Getenv("HOME"), source)
-	if err == nil {
+	home, _ := Home()
+	if relSource, ok := trackingPath(home, source); ok {
 		AddTrackingPath(relSource)
 	}
 
 	return nil
 }
 
+// moveSingleFile moves the regular file source into the repository at
+// destination, replacing what is there, and links it back, or hardlinks or
+// copies it back in those link modes. Unlike copying,
+// there is no backup, since the file itself is in the repository; if the link
+// can't be created, the file is moved back.
+func (t *tracker) moveSingleFile(source, destination string, size int64) error {
+	if err := os.Remove(destination); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	utils.Logger.Debug().Msgf("Moving %s to %s", source, destination)
+	if err := utils.MoveFile(source, destination); err != nil {
+		return err
+	}
+
+	var err error
+	if t.linkMode != LinkSymlink {
+		_, err = MaterializeFile(destination, source, t.linkMode)
+	} else {
+		utils.Logger.Debug().Msgf("Creating symlink: %s -> %s", source, destination)
+		err = symlink(symlinkContent(source, destination, t.relative), source)
+	}
+	if err != nil {
+		if restoreErr := utils.MoveFile(destination, source); restoreErr != nil {
+			return fmt.Errorf("failed to link %s: %w, and to move it back from %s: %v", source, err, destination, restoreErr)
+		}
+		return fmt.Errorf("failed to link %s, it was moved back: %w", source, err)
+	}
+	if t.duplicates != nil {
+		t.duplicates.add(destination, size)
+	}
+
+	// The repository copy gets the line endings a copy would have
+	if style := LineEndings(); style != "" {
+		info, err := os.Stat(destination)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(destination)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(destination, convertLineEndings(data, style), info.Mode()); err != nil {
+			return err
+		}
+	}
+
+	// Update tracking list
+	home, _ := Home()
+	if relSource, ok := trackingPath(home, source); ok {
+		AddTrackingPath(relSource)
+	}
+	return nil
+}
+
+// shouldWrite reports whether source may be stored at destination, asking if
+// destination exists and the options say so
+func (t *tracker) shouldWrite(source, destination string) (bool, error) {
+	if _, err := os.Lstat(destination); os.IsNotExist(err) {
+		return true, nil
+	}
+
+	switch t.existing {
+	case ExistingOverwrite:
+		return true, nil
+	case ExistingSkip:
+		t.skip(source, destination)
+		return false, nil
+	case ExistingPrompt:
+		if t.dryRun {
+			t.plan(source, destination, TrackAsk, false)
+			return false, nil
+		}
+		return t.askOverwrite(source, destination)
+	default:
+		return false, fmt.Errorf("%w: %s", ErrFileExists, destination)
+	}
+}
+
+// askOverwrite asks whether to replace destination with source. Answering
+// for all files changes what happens with the remaining ones.
+func (t *tracker) askOverwrite(source, destination string) (bool, error) {
+	if utils.IsNonInteractive() {
+		t.skip(source, destination)
+		return false, nil
+	}
+
+	if t.reader == nil {
+		t.reader = bufio.NewReader(os.Stdin)
+	}
+
+	fmt.Printf("\n%s is already in the repository at %s\n", source, destination)
+	for {
+		fmt.Print("[o]verwrite, [s]kip, [O]verwrite all, [S]kip all, show [d]iff? ")
+		response, err := t.reader.ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+
+		switch strings.TrimSpace(response) {
+		case "o":
+			return true, nil
+		case "s":
+			t.skip(source, destination)
+			return false, nil
+		case "O":
+			t.existing = ExistingOverwrite
+			return true, nil
+		case "S":
+			t.existing = ExistingSkip
+			t.skip(source, destination)
+			return false, nil
+		case "d":
+			fmt.Print(trackDiff(source, destination))
+		default:
+			fmt.Println("Please answer o, s, O, S or d")
+		}
+	}
+}
+
+// skip records that source was left alone because destination exists
+func (t *tracker) skip(source, destination string) {
+	utils.Logger.Debug().Msgf("Skipping %s, it is already in the repository", source)
+	t.result.Skipped = append(t.result.Skipped, source)
+	t.plan(source, destination, TrackSkippedExisting, false)
+}
+
+// trackDiff shows how tracking source would change the repository file at
+// destination
+func trackDiff(source, destination string) string {
+	from, err := readLayerFile(destination)
+	if err != nil {
+		return fmt.Sprintf("Failed to read %s: %v\n", destination, err)
+	}
+	to, err := readLayerFile(source)
+	if err != nil {
+		return fmt.Sprintf("Failed to read %s: %v\n", source, err)
+	}
+
+	diff := UnifiedDiff(destination, source, comparableContent(from), comparableContent(to))
+	if diff == "" {
+		return "The files are identical\n"
+	}
+	return diff
+}
+
 // copyFile copies a file from source to destination
 func copyFile(source, destination string, mode os.FileMode) error {
 	// Open source file
@@ -166,6 +583,28 @@ func copyFile(source, destination string, mode os.FileMode) error {
 	return err
 }
 
+// resolvesTo reports whether target and source are the same file once all
+// symlinks are followed, for example because a parent directory of target is a
+// symlink into the repository
+func resolvesTo(target, source string) bool {
+	targetInfo, err := os.Stat(target)
+	if err != nil {
+		return false
+	}
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(targetInfo, sourceInfo)
+}
+
+// insideDir reports whether path is dir or lies below it. Both paths must be
+// absolute and cleaned.
+func insideDir(path, dir string) bool {
+	relPath, err := filepath.Rel(dir, path)
+	return err == nil && relPath != ".." && !strings.HasPrefix(relPath, ".."+string(filepath.Separator))
+}
+
 // BackupFile creates a backup of a file
 func BackupFile(path string) (string, error) {
 	// Check if file exists
@@ -175,7 +614,7 @@ func BackupFile(path string) (string, error) {
 	}
 
 	// Create backup path
-	backupPath := path + ".dotpilot.bak." + time.Now().Format("20060102150405")
+	backupPath := backupPathFor(path)
 	
 	// Copy file
 	sourceInfo, err := os.Stat(path)
@@ -187,11 +626,27 @@ func BackupFile(path string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	pruneBackupsOf(path)
 
 	return backupPath, nil
 }
 
-// FileDiff returns the diff between two files
+// backupPathFor returns the path BackupFile and apply back a path up to. A
+// number is appended if a backup was made within the same second already.
+func backupPathFor(path string) string {
+	backupPath := path + ".dotpilot.bak." + time.Now().Format("20060102150405")
+	for i := 1; ; i++ {
+		candidate := backupPath
+		if i > 1 {
+			candidate = fmt.Sprintf("%s.%d", backupPath, i)
+		}
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// FileDiff returns a unified diff from file1 to file2
 func FileDiff(file1, file2 string) (string, error) {
 	// Read files
 	content1, err := ioutil.ReadFile(file1)
@@ -204,29 +659,16 @@ func FileDiff(file1, file2 string) (string, error) {
 		return "", err
 	}
 
-	// Compare line by line
-	lines1 := strings.Split(string(content1), "\n")
-	lines2 := strings.Split(string(content2), "\n")
-
-	diff := ""
-	maxLines := len(lines1)
-	if len(lines2) > maxLines {
-		maxLines = len(lines2)
-	}
-
-	for i := 0; i < maxLines; i++ {
-		if i >= len(lines1) {
-			diff += fmt.Sprintf("+ %s\n", lines2[i])
-		} else if i >= len(lines2) {
-			diff += fmt.Sprintf("- %s\n", lines1[i])
-		} else if lines1[i] != lines2[i] {
-			diff += fmt.Sprintf("- %s\n+ %s\n", lines1[i], lines2[i])
-		}
-	}
-
+	diff := UnifiedDiff(file1, file2, comparableContent(content1), comparableContent(content2))
 	if diff == "" {
 		return "Files are identical", nil
 	}
 
 	return diff, nil
 }
+
+// isEmptyDir reports whether path is a directory without entries
+func isEmptyDir(path string) bool {
+	entries, err := os.ReadDir(path)
+	return err == nil && len(entries) == 0
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// File modes
+//
+// Git only records whether a file is executable, so a dotfile that must not
+// be readable by others, like ~/.ssh/authorized_keys, comes back 0644 from a
+// clone. file-modes.json in the root of the repository records the modes set
+// with track --chmod by repo path, like {"common/.ssh/authorized_keys":
+// "0600"}. The targets link to the repo files, so apply and bootstrap give
+// the repo files of the layers they apply their recorded mode, which is the
+// mode the targets resolve to.
+
+// fileModesFile records the modes of repo files. It lives in the root of the
+// dotpilot repository, so it is never linked into the home directory itself.
+const fileModesFile = "file-modes.json"
+
+// ParseFileMode parses an octal permission mode like "600", "0600" or
+// "0o600"
+func ParseFileMode(s string) (os.FileMode, error) {
+	digits := strings.TrimPrefix(s, "0o")
+	mode, err := strconv.ParseUint(digits, 8, 32)
+	if err != nil || len(digits) < 3 || len(digits) > 4 || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode %q, expected octal permissions like 0600", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// LoadFileModes reads the recorded modes from file-modes.json, by
+// slash-separated repo path. A missing file means no modes.
+func LoadFileModes(dotpilotDir string) (map[string]os.FileMode, error) {
+	data, err := os.ReadFile(filepath.Join(dotpilotDir, fileModesFile))
+	if os.IsNotExist(err) {
+		return map[string]os.FileMode{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var recorded map[string]string
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", fileModesFile, err)
+	}
+	modes := make(map[string]os.FileMode, len(recorded))
+	for repoPath, value := range recorded {
+		mode, err := ParseFileMode(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s in %s: %w", repoPath, fileModesFile, err)
+		}
+		modes[repoPath] = mode
+	}
+	return modes, nil
+}
+
+// RecordFileModes records mode for the repo files at paths, and the files
+// below those that are directories, and gives them that mode. It returns the
+// repo paths recorded.
+func RecordFileModes(dotpilotDir string, paths []string, mode os.FileMode) ([]string, error) {
+	modes, err := LoadFileModes(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var recorded []string
+	for _, p := range paths {
+		files, err := filesBelow(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			repoPath, err := RepoPath(dotpilotDir, file)
+			if err != nil {
+				return nil, err
+			}
+			if err := os.Chmod(file, mode); err != nil {
+				return nil, err
+			}
+			modes[repoPath] = mode
+			recorded = append(recorded, repoPath)
+		}
+	}
+
+	values := make(map[string]string, len(modes))
+	for repoPath, mode := range modes {
+		values[repoPath] = fmt.Sprintf("%04o", mode)
+	}
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dotpilotDir, fileModesFile), append(data, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	return recorded, nil
+}
+
+// EnforceFileModes gives the repo files inside layerDirs that have a recorded
+// mode that mode. Recorded files that don't exist are left out.
+func EnforceFileModes(dotpilotDir string, layerDirs []string) error {
+	modes, err := LoadFileModes(dotpilotDir)
+	if err != nil {
+		return err
+	}
+
+	for repoPath, mode := range modes {
+		file := filepath.Join(dotpilotDir, filepath.FromSlash(repoPath))
+		inLayer := false
+		for _, layerDir := range layerDirs {
+			inLayer = inLayer || insideDir(file, layerDir)
+		}
+		if !inLayer {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode().Perm() != mode {
+			if err := os.Chmod(file, mode); err != nil {
+				return fmt.Errorf("failed to set the mode of %s: %w", repoPath, err)
+			}
+		}
+	}
+	return nil
+}
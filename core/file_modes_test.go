@@ -0,0 +1,80 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestParseFileMode(t *testing.T) {
+	valid := map[string]os.FileMode{"600": 0600, "0600": 0600, "0o600": 0600, "0755": 0755, "0777": 0777}
+	for s, want := range valid {
+		if got, err := ParseFileMode(s); err != nil || got != want {
+			t.Errorf("ParseFileMode(%q) = %o, %v, want %o", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "60", "0689", "rw-------", "u+x", "1777", "00600"} {
+		if _, err := ParseFileMode(s); err == nil {
+			t.Errorf("ParseFileMode(%q) accepted", s)
+		}
+	}
+}
+
+func TestApplyFileModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no permission bits")
+	}
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	writeRepoFile(t, dotpilotDir, "common/.ssh/authorized_keys", "ssh-ed25519 AAAA\n")
+	writeRepoFile(t, dotpilotDir, "common/.ssh/config", "Host *\n")
+	writeRepoFile(t, dotpilotDir, "envs/work/.netrc", "machine example.com\n")
+
+	recorded, err := RecordFileModes(dotpilotDir, []string{filepath.Join(dotpilotDir, "common", ".ssh", "authorized_keys"), filepath.Join(dotpilotDir, "envs", "work")}, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != 2 {
+		t.Errorf("recorded %q", recorded)
+	}
+	modes, err := LoadFileModes(dotpilotDir)
+	if err != nil || modes["common/.ssh/authorized_keys"] != 0600 || modes["envs/work/.netrc"] != 0600 || len(modes) != 2 {
+		t.Errorf("loaded %v, %v", modes, err)
+	}
+
+	// A clone only knows 0644
+	for _, name := range []string{"common/.ssh/authorized_keys", "common/.ssh/config", "envs/work/.netrc"} {
+		if err := os.Chmod(filepath.Join(dotpilotDir, filepath.FromSlash(name)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target := t.TempDir()
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "work", ApplyOptions{Target: target}); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]os.FileMode{".ssh/authorized_keys": 0600, ".ssh/config": 0644, ".netrc": 0600}
+	for name, mode := range want {
+		info, err := os.Stat(filepath.Join(target, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("%s has mode %o, want %o", name, info.Mode().Perm(), mode)
+		}
+	}
+
+	// Bootstrap applies a layer at a time
+	if err := os.Chmod(filepath.Join(dotpilotDir, "common", ".ssh", "authorized_keys"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ApplyDirectoryConfigsWithOptions(filepath.Join(dotpilotDir, "common"), t.TempDir(), DirectoryApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dotpilotDir, "common", ".ssh", "authorized_keys")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("bootstrap left the mode at %v, %v", info.Mode(), err)
+	}
+}
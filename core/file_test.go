@@ -0,0 +1,419 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dotpilot/utils"
+	"github.com/go-git/go-git/v5"
+)
+
+func TestTrackSymlink(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// ~/.config/foo intentionally points to a directory elsewhere
+	volume := filepath.Join(t.TempDir(), "volume", "foo")
+	if err := os.MkdirAll(volume, 0755); err != nil {
+		t.Fatal(err)
+	}
+	source := filepath.Join(home, ".config", "foo")
+	if err := os.MkdirAll(filepath.Dir(source), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(volume, source); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(dotpilotDir, "common", ".config", "foo")
+	if err := TrackFile(source, dest, dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The repository records the link target and the home link is untouched
+	data, err := os.ReadFile(dest + symlinkSuffix)
+	if err != nil || string(data) != volume+"\n" {
+		t.Fatalf("descriptor = %q, %v, want %s", data, err, volume)
+	}
+	if _, err := os.Lstat(dest); !os.IsNotExist(err) {
+		t.Errorf("%s was created: %v", dest, err)
+	}
+	if link, err := os.Readlink(source); err != nil || link != volume {
+		t.Errorf("%s links to %q, %v, want %s", source, link, err, volume)
+	}
+
+	if err := CommitChanges(dotpilotDir, "track foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Apply recreates it on a fresh home directory
+	if err := os.Remove(source); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if link, err := os.Readlink(source); err != nil || link != volume {
+		t.Errorf("apply linked %s to %q, %v, want %s", source, link, err, volume)
+	}
+
+	// The recreated symlink doesn't count as drift
+	changes, err := LocalDrift(dotpilotDir, "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("drift = %+v, want none", changes)
+	}
+}
+
+func TestTrackSymlinkedSubdirectory(t *testing.T) {
+	for _, dereference := range []bool{false, true} {
+		t.Run(map[bool]string{false: "links", true: "dereference"}[dereference], func(t *testing.T) {
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+			dotpilotDir := filepath.Join(home, ".dotpilot")
+			if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+				t.Fatal(err)
+			}
+
+			// ~/.config/app/themes links to a directory elsewhere, loop back to app
+			source := filepath.Join(home, ".config", "app")
+			writeRepoFile(t, source, "settings.conf", "theme = dark\n")
+			themes := filepath.Join(t.TempDir(), "themes")
+			writeRepoFile(t, themes, "dark.conf", "background = black\n")
+			if err := os.Symlink(themes, filepath.Join(source, "themes")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(source, filepath.Join(themes, "loop")); err != nil {
+				t.Fatal(err)
+			}
+
+			dest := filepath.Join(dotpilotDir, "common", ".config", "app")
+			if _, err := TrackFileWithOptions(source, dest, dotpilotDir, TrackOptions{Dereference: dereference}); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := os.Stat(filepath.Join(dest, "settings.conf")); err != nil {
+				t.Errorf("settings.conf not tracked: %v", err)
+			}
+			_, linkErr := os.Stat(filepath.Join(dest, "themes"+symlinkSuffix))
+			_, fileErr := os.Stat(filepath.Join(dest, "themes", "dark.conf"))
+			if dereference {
+				if fileErr != nil || linkErr == nil {
+					t.Errorf("themes was not followed: %v, link recorded %v", fileErr, linkErr == nil)
+				}
+				// The link back to app is recorded, not followed
+				if _, err := os.Stat(filepath.Join(dest, "themes", "loop"+symlinkSuffix)); err != nil {
+					t.Errorf("loop not recorded as a link: %v", err)
+				}
+				if link, err := os.Readlink(filepath.Join(themes, "dark.conf")); err != nil || link != filepath.Join(dest, "themes", "dark.conf") {
+					t.Errorf("dark.conf links to %q, %v", link, err)
+				}
+			} else if linkErr != nil || fileErr == nil {
+				t.Errorf("themes was not recorded as a link: %v, followed %v", linkErr, fileErr == nil)
+			}
+		})
+	}
+}
+
+func TestTrackDotpilotSymlinkIsNotASymlink(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	// A file applied by dotpilot links into the repository
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	repoFile := filepath.Join(dotpilotDir, "common", ".zshrc")
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "repo\n")
+	source := filepath.Join(home, ".zshrc")
+	if err := os.Symlink(repoFile, source); err != nil {
+		t.Fatal(err)
+	}
+
+	if isForeignSymlink(source, dotpilotDir) {
+		t.Errorf("%s was treated as a symlink of the user's own", source)
+	}
+	if isForeignSymlink(repoFile, dotpilotDir) {
+		t.Errorf("regular file %s was treated as a symlink", repoFile)
+	}
+}
+
+func TestTrackDirectorySkipExisting(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	// a.conf is in the repository already, b.conf is new
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	writeRepoFile(t, dotpilotDir, "common/.config/app/a.conf", "repo\n")
+	source := filepath.Join(home, ".config", "app")
+	writeRepoFile(t, source, "a.conf", "local\n")
+	writeRepoFile(t, source, "b.conf", "new\n")
+	dest := filepath.Join(dotpilotDir, "common", ".config", "app")
+
+	if err := TrackFile(source, dest, dotpilotDir, false); !errors.Is(err, ErrFileExists) {
+		t.Fatalf("TrackFile() without overwrite = %v, want ErrFileExists", err)
+	}
+
+	// Prompts answer skip without asking when they are disabled
+	utils.SetNonInteractive(true)
+	defer utils.SetNonInteractive(false)
+	result, err := TrackFileWithOptions(source, dest, dotpilotDir, TrackOptions{Existing: ExistingPrompt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{filepath.Join(source, "a.conf")}
+	if !reflect.DeepEqual(result.Skipped, want) {
+		t.Errorf("Skipped = %v, want %v", result.Skipped, want)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "a.conf")); string(data) != "repo\n" {
+		t.Errorf("skipped a.conf was overwritten with %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "b.conf")); string(data) != "new\n" {
+		t.Errorf("b.conf in the repository = %q, want new", data)
+	}
+
+	// Tracking again leaves the file that is now tracked alone
+	result, err = TrackFileWithOptions(source, dest, dotpilotDir, TrackOptions{Existing: ExistingOverwrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "b.conf")); string(data) != "new\n" {
+		t.Errorf("re-tracking b.conf left %q in the repository", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "a.conf")); string(data) != "local\n" {
+		t.Errorf("overwritten a.conf = %q, want local", data)
+	}
+}
+
+func TestTrackWarnsAboutDuplicates(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "export EDITOR=vim\n")
+	writeRepoFile(t, home, ".zshrc", "export EDITOR=vim\n")
+	writeRepoFile(t, home, ".bashrc", "export EDITOR=nano\n")
+
+	// Prompts answer no without asking when they are disabled
+	utils.SetNonInteractive(true)
+	defer utils.SetNonInteractive(false)
+
+	// The same content in an environment layer is skipped
+	source := filepath.Join(home, ".zshrc")
+	dest := filepath.Join(dotpilotDir, "envs", "dev", ".zshrc")
+	result, err := TrackFileWithOptions(source, dest, dotpilotDir, TrackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Duplicates, []string{source}) {
+		t.Errorf("Duplicates = %v, want %s", result.Duplicates, source)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("duplicate %s was tracked: %v", dest, err)
+	}
+
+	// Different content is tracked
+	source = filepath.Join(home, ".bashrc")
+	dest = filepath.Join(dotpilotDir, "envs", "dev", ".bashrc")
+	result, err = TrackFileWithOptions(source, dest, dotpilotDir, TrackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Duplicates) != 0 {
+		t.Errorf("Duplicates = %v, want none", result.Duplicates)
+	}
+	if _, err := os.Stat(dest); err != nil {
+		t.Errorf("%s was not tracked: %v", dest, err)
+	}
+}
+
+func TestTrackDryRunPlan(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, ".dotpilotignore", ".config/app/cache/\n")
+	writeRepoFile(t, dotpilotDir, "common/.config/app/existing.conf", "old\n")
+	writeRepoFile(t, home, ".config/app/existing.conf", "new\n")
+	writeRepoFile(t, home, ".config/app/fresh.conf", "fresh\n")
+	writeRepoFile(t, home, ".config/app/cache/state", "state\n")
+	if err := os.Symlink("/etc/hosts", filepath.Join(home, ".config", "app", "hosts")); err != nil {
+		t.Fatal(err)
+	}
+
+	source := filepath.Join(home, ".config", "app")
+	dest := filepath.Join(dotpilotDir, "common", ".config", "app")
+	result, err := TrackFileWithOptions(source, dest, dotpilotDir, TrackOptions{Existing: ExistingPrompt, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := map[string]TrackAction{}
+	backups := map[string]bool{}
+	for _, entry := range result.Plan {
+		relPath, _ := filepath.Rel(source, entry.Source)
+		actions[filepath.ToSlash(relPath)] = entry.Action
+		backups[filepath.ToSlash(relPath)] = entry.Backup
+	}
+	want := map[string]TrackAction{
+		"cache":         TrackSkippedByIgnore,
+		"existing.conf": TrackAsk,
+		"fresh.conf":    TrackNewCopy,
+		"hosts":         TrackSymlink,
+	}
+	if !reflect.DeepEqual(actions, want) {
+		t.Errorf("plan = %v, want %v", actions, want)
+	}
+	if !backups["fresh.conf"] || backups["hosts"] {
+		t.Errorf("backups = %v, want only fresh.conf", backups)
+	}
+
+	// Nothing was copied or linked
+	if _, err := os.Lstat(filepath.Join(dest, "fresh.conf")); !os.IsNotExist(err) {
+		t.Errorf("fresh.conf was copied into the repository")
+	}
+	if info, err := os.Lstat(filepath.Join(source, "fresh.conf")); err != nil || info.Mode()&os.ModeSymlink != 0 {
+		t.Errorf("fresh.conf was replaced: %v", err)
+	}
+
+	// A real track does what was planned, leaving the ignored cache out
+	result, err = TrackFileWithOptions(source, dest, dotpilotDir, TrackOptions{Existing: ExistingOverwrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Plan) != 4 {
+		t.Errorf("plan = %+v, want the 4 entries of the dry run", result.Plan)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "cache")); !os.IsNotExist(err) {
+		t.Errorf("the ignored cache was tracked")
+	}
+	if link, err := os.Readlink(filepath.Join(source, "fresh.conf")); err != nil || link != filepath.Join(dest, "fresh.conf") {
+		t.Errorf("fresh.conf = %q, %v, want a link into the repository", link, err)
+	}
+}
+
+func TestTrackMove(t *testing.T) {
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+
+	// crossDevice returns a directory on another filesystem than the test
+	// directory, or skips
+	crossDevice := func(t *testing.T) string {
+		dir, err := os.MkdirTemp("/dev/shm", "dotpilot-test")
+		if err != nil {
+			t.Skip("no second filesystem:", err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		probe := filepath.Join(dir, "probe")
+		if err := os.WriteFile(probe, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if os.Rename(probe, filepath.Join(t.TempDir(), "probe")) == nil {
+			t.Skip("/dev/shm is on the same filesystem as the test directory")
+		}
+		return dir
+	}
+	tests := []struct {
+		name      string
+		sourceDir func(t *testing.T) string
+		failLink  bool
+	}{
+		{"same device", func(t *testing.T) string { return os.Getenv("HOME") }, false},
+		{"across devices", crossDevice, false},
+		{"link fails", func(t *testing.T) string { return os.Getenv("HOME") }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+			dotpilotDir := filepath.Join(home, ".dotpilot")
+			if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+				t.Fatal(err)
+			}
+			if tt.failLink {
+				symlink = func(oldname, newname string) error { return errors.New("no links here") }
+				defer func() { symlink = os.Symlink }()
+			}
+
+			source := filepath.Join(tt.sourceDir(t), ".bigrc")
+			if err := os.WriteFile(source, []byte("big\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			destination := filepath.Join(dotpilotDir, "common", ".bigrc")
+
+			result, err := TrackFileWithOptions(source, destination, dotpilotDir, TrackOptions{Move: true})
+			if tt.failLink {
+				if err == nil {
+					t.Fatal("track succeeded without a link")
+				}
+				if data, err := os.ReadFile(source); err != nil || string(data) != "big\n" {
+					t.Errorf("the original wasn't moved back: %q, %v", data, err)
+				}
+				if _, err := os.Lstat(destination); !os.IsNotExist(err) {
+					t.Errorf("the file is still in the repository: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !resolvesTo(source, destination) {
+				t.Errorf("%s doesn't link to the repository", source)
+			}
+			info, err := os.Stat(destination)
+			if err != nil || info.Mode().Perm() != 0600 {
+				t.Fatalf("repository file: %v, %v", info, err)
+			}
+			if data, _ := os.ReadFile(destination); string(data) != "big\n" {
+				t.Errorf("repository file holds %q", data)
+			}
+			if backups, _ := filepath.Glob(source + ".dotpilot.bak.*"); len(backups) != 0 {
+				t.Errorf("backups were made: %v", backups)
+			}
+			if len(result.Plan) != 1 || result.Plan[0].Backup {
+				t.Errorf("plan %+v, want no backup", result.Plan)
+			}
+		})
+	}
+}
+
+func TestTrackRefusesHomeAndRepository(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	writeRepoFile(t, dotpilotDir, ".git/HEAD", "ref: refs/heads/main\n")
+	writeRepoFile(t, home, ".zshrc", "export EDITOR=vim\n")
+	dest := filepath.Join(dotpilotDir, "common")
+
+	for _, source := range []string{home, dotpilotDir, filepath.Join(dotpilotDir, ".git")} {
+		if _, err := TrackFileWithOptions(source, dest, dotpilotDir, TrackOptions{Existing: ExistingOverwrite}); !errors.Is(err, ErrUntrackableSource) {
+			t.Errorf("tracking %s = %v, want ErrUntrackableSource", source, err)
+		}
+	}
+	if info, err := os.Lstat(filepath.Join(dotpilotDir, ".git", "HEAD")); err != nil || !info.Mode().IsRegular() {
+		t.Fatalf(".git/HEAD was replaced: %v, %v", info, err)
+	}
+
+	// A directory holding the repository is walked around it
+	tr := &tracker{dotpilotDir: dotpilotDir, existing: ExistingOverwrite, dryRun: true, linkMode: LinkSymlink}
+	if err := tr.trackDirectory(home, dest); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.result.Plan) != 1 || tr.result.Plan[0].Source != filepath.Join(home, ".zshrc") {
+		t.Errorf("plan %+v, want only .zshrc", tr.result.Plan)
+	}
+}
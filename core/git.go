@@ -1,9 +1,13 @@
 package core
 
 import (
+        "context"
+        "errors"
         "fmt"
         "os"
         "path/filepath"
+        "sort"
+        "strings"
         "time"
 
         "github.com/dotpilot/utils"
@@ -11,43 +15,81 @@ import (
         "github.com/go-git/go-git/v5/config"
         "github.com/go-git/go-git/v5/plumbing"
         "github.com/go-git/go-git/v5/plumbing/object"
+        "github.com/go-git/go-git/v5/plumbing/transport"
 )
 
 // RemoteStatus represents the status of the local repository compared to the remote
 type RemoteStatus struct {
         Ahead  int
         Behind int
+        // Shallow is set for a shallow clone, whose counts only cover the
+        // history it has
+        Shallow bool
 }
 
-// InitializeRepo initializes the dotpilot repository
-func InitializeRepo(remoteURL, dotpilotDir, environment string) error {
+// CheckInitialized returns an error wrapping ErrNotInitialized if the dotpilot
+// repository does not exist
+func CheckInitialized(dotpilotDir string) error {
+        if _, err := os.Stat(dotpilotDir); os.IsNotExist(err) {
+                return fmt.Errorf("%w: %s does not exist", ErrNotInitialized, dotpilotDir)
+        }
+        return nil
+}
+
+// InitializeRepo initializes the dotpilot repository. If sparsePaths is not
+// empty, only those repo paths are applied on this machine (see sparse.go).
+// A non-empty subdir keeps the layers in that subdirectory of the repository
+// (monorepo mode, see repo.go). A depth above 0 clones only that many commits
+// (see shallow.go). Canceling ctx aborts the clone; if the clone fails, a
+// dotpilotDir created for it is removed again. An existing dotpilotDir left
+// by an interrupted init is resumed.
+func InitializeRepo(ctx context.Context, remoteURL, dotpilotDir, environment string, sparsePaths []string, subdir string, depth int) error {
+        subdir, err := cleanSubdir(subdir)
+        if err != nil {
+                return err
+        }
+        layerDir := filepath.Join(dotpilotDir, filepath.FromSlash(subdir))
+
         // Create directory if it doesn't exist
+        _, statErr := os.Stat(dotpilotDir)
+        created := os.IsNotExist(statErr)
         if err := os.MkdirAll(dotpilotDir, 0755); err != nil {
                 return err
         }
 
+        // Carry on where an interrupted init stopped, see init_state.go
+        if !created {
+                if err := resumeInit(dotpilotDir, remoteURL); err != nil {
+                        return err
+                }
+        }
+
+        auth, err := authForURL(remoteURL)
+        if err != nil {
+                return err
+        }
+
         // Clone repository
         utils.Logger.Debug().Msgf("Cloning repository %s to %s", remoteURL, dotpilotDir)
-        _, err := git.PlainClone(dotpilotDir, false, &git.CloneOptions{
-                URL:      remoteURL,
-                Progress: os.Stdout,
-        })
+        err = cloneRepository(ctx, remoteURL, dotpilotDir, auth, depth)
 
         if err != nil {
                 // If the repository doesn't exist, initialize a new one
                 if err == git.ErrRepositoryAlreadyExists {
                         utils.Logger.Debug().Msg("Repository already exists, skipping clone")
-                } else if err == git.ErrRepositoryNotExists {
-                        utils.Logger.Debug().Msg("Remote repository doesn't exist, initializing new one")
+                } else if err == git.ErrRepositoryNotExists || errors.Is(err, transport.ErrEmptyRemoteRepository) {
+                        utils.Logger.Debug().Msg("Remote repository doesn't exist or is empty, initializing new one")
                         
                         // Initialize new repo
-                        repo, err := git.PlainInit(dotpilotDir, false)
+                        repo, err := git.PlainInitWithOptions(dotpilotDir, &git.PlainInitOptions{
+                                InitOptions: git.InitOptions{DefaultBranch: plumbing.NewBranchReferenceName(fallbackBranch)},
+                        })
                         if err != nil {
                                 return err
                         }
 
                         // Create default directory structure
-                        createDirStructure(dotpilotDir)
+                        createDirStructure(layerDir)
 
                         // Add remote
                         _, err = repo.CreateRemote(&config.RemoteConfig{
@@ -80,12 +122,59 @@ func InitializeRepo(remoteURL, dotpilotDir, environment string) error {
                                 return err
                         }
                 } else {
+                        if created {
+                                os.RemoveAll(dotpilotDir)
+                        }
                         return err
                 }
         }
 
+        // Pull and push the default branch of the remote. A remote that
+        // doesn't exist yet can't tell, the next sync tries again.
+        if repo, err := git.PlainOpen(dotpilotDir); err != nil {
+                return err
+        } else if branch, err := trackDefaultBranch(repo); err != nil {
+                utils.Logger.Debug().Err(err).Msg("Failed to detect the default branch of the remote")
+        } else {
+                utils.Logger.Debug().Msgf("Tracking the default branch %s of the remote", branch)
+        }
+
         // Create dotpilotrc file
-        return CreateDefaultConfigFile(remoteURL, environment)
+        if err := CreateDefaultConfigFile(remoteURL, environment); err != nil {
+                return err
+        }
+
+        // Record the subdirectory and set up its layers if the repository
+        // doesn't have them yet
+        if subdir != "" {
+                if _, err := os.Stat(layerDir); os.IsNotExist(err) {
+                        if err := createDirStructure(layerDir); err != nil {
+                                return err
+                        }
+                }
+                if err := UpdateSubdir(subdir); err != nil {
+                        return err
+                }
+        }
+
+        // Keep sensitive and machine-local files out of a cloned repository
+        changed, err := EnsureGitignore(layerDir)
+        if err != nil {
+                return err
+        }
+        if changed {
+                if err := CommitChanges(layerDir, "Add dotpilot entries to .gitignore"); err != nil {
+                        return err
+                }
+        }
+
+        // Record the sparse include list
+        if len(sparsePaths) > 0 {
+                utils.Logger.Debug().Msgf("Limiting applied paths to: %v", sparsePaths)
+                return UpdateSparsePaths(sparsePaths)
+        }
+
+        return nil
 }
 
 // createDirStructure creates the default directory structure for dotpilot
@@ -101,7 +190,7 @@ func createDirStructure(dotpilotDir string) error {
         }
 
         // Create machine directory with hostname
-        hostname, err := os.Hostname()
+        hostname, err := MachineID()
         if err != nil {
                 hostname = "unknown"
         }
@@ -125,13 +214,27 @@ This repository contains dotfiles managed by the DotPilot tool.
                 return err
         }
 
-        return nil
+        // Keep sensitive and machine-local files out of the repository
+        if _, err := EnsureGitignore(dotpilotDir); err != nil {
+                return err
+        }
+
+        // A new repository needs no migrations
+        return writeLayoutVersion(dotpilotDir, LatestLayoutVersion())
 }
 
-// CommitChanges commits the changes in the repository with the given message
+// CommitChanges commits the changes in the repository with the given message,
+// formatted by the commit template in use, see CommitTemplate. The
+// repository's pre-commit hook, hooks/pre-commit, runs first and can reject
+// the commit, leaving the changes staged; see SetNoVerify.
 func CommitChanges(dotpilotDir, message string) error {
+        return commitChanges(dotpilotDir, commitMessage(dotpilotDir, message))
+}
+
+// commitChanges commits the changes in the repository with message as is
+func commitChanges(dotpilotDir, message string) error {
         // Open repository
-        repo, err := git.PlainOpen(dotpilotDir)
+        repo, err := openRepo(dotpilotDir)
         if err != nil {
                 return err
         }
@@ -143,8 +246,12 @@ func CommitChanges(dotpilotDir, message string) error {
         }
 
         // Add all changes
-        _, err = w.Add(".")
-        if err != nil {
+        if err := stageAll(repo, dotpilotDir); err != nil {
+                return err
+        }
+
+        // Let the repository's pre-commit hook check them
+        if err := runPreCommitHook(dotpilotDir); err != nil {
                 return err
         }
 
@@ -163,10 +270,86 @@ func CommitChanges(dotpilotDir, message string) error {
         return nil
 }
 
-// HasUncommittedChanges checks if there are uncommitted changes in the repository
+// StageChanges adds all changes in the repository to the index without
+// committing them, so several operations can be grouped into one commit
+func StageChanges(dotpilotDir string) error {
+        // Open repository
+        repo, err := openRepo(dotpilotDir)
+        if err != nil {
+                return err
+        }
+
+        return stageAll(repo, dotpilotDir)
+}
+
+// stageAll adds every new, modified and deleted file below dotpilotDir to the
+// index. In monorepo mode the rest of the repository is left alone. Files
+// handed to git-crypt are staged with the git binary, which runs the filter.
+func stageAll(repo *git.Repository, dotpilotDir string) error {
+        if namesGitCryptFilter(dotpilotDir) || namesGitCryptFilter(worktreeRoot(dotpilotDir)) {
+                _, err := gitOutput(dotpilotDir, "add", "--all", "--", ".")
+                return err
+        }
+
+        w, err := repo.Worktree()
+        if err != nil {
+                return err
+        }
+
+        prefix, err := repoPrefix(repo, dotpilotDir)
+        if err != nil {
+                return err
+        }
+        if prefix == "" {
+                return w.AddWithOptions(&git.AddOptions{All: true})
+        }
+        _, err = w.Add(strings.TrimSuffix(prefix, "/"))
+        return err
+}
+
+// GetStagedFiles returns the repo paths that are staged but not yet committed
+func GetStagedFiles(dotpilotDir string) ([]string, error) {
+        // Open repository
+        repo, err := openRepo(dotpilotDir)
+        if err != nil {
+                return nil, err
+        }
+
+        // Get worktree
+        w, err := repo.Worktree()
+        if err != nil {
+                return nil, err
+        }
+
+        // Get status
+        status, err := w.Status()
+        if err != nil {
+                return nil, err
+        }
+
+        prefix, err := repoPrefix(repo, dotpilotDir)
+        if err != nil {
+                return nil, err
+        }
+
+        var staged []string
+        for path, fileStatus := range status {
+                if fileStatus.Staging != git.Unmodified && fileStatus.Staging != git.Untracked {
+                        if relPath, ok := trimRepoPrefix(prefix, path); ok {
+                                staged = append(staged, relPath)
+                        }
+                }
+        }
+        sort.Strings(staged)
+
+        return staged, nil
+}
+
+// HasUncommittedChanges checks if there are uncommitted changes in the
+// repository, including changes that are staged but not yet committed
 func HasUncommittedChanges(dotpilotDir string) (bool, error) {
         // Open repository
-        repo, err := git.PlainOpen(dotpilotDir)
+        repo, err := openRepo(dotpilotDir)
         if err != nil {
                 return false, err
         }
@@ -183,13 +366,24 @@ func HasUncommittedChanges(dotpilotDir string) (bool, error) {
                 return false, err
         }
 
-        return !status.IsClean(), nil
+        // In monorepo mode only changes to the dotfiles count
+        prefix, err := repoPrefix(repo, dotpilotDir)
+        if err != nil {
+                return false, err
+        }
+        for path, fileStatus := range status {
+                if _, ok := trimRepoPrefix(prefix, path); ok && (fileStatus.Staging != git.Unmodified || fileStatus.Worktree != git.Unmodified) {
+                        return true, nil
+                }
+        }
+
+        return false, nil
 }
 
 // PullChanges pulls changes from the remote
 func PullChanges(dotpilotDir string) error {
         // Open repository
-        repo, err := git.PlainOpen(dotpilotDir)
+        repo, err := openRepo(dotpilotDir)
         if err != nil {
                 return err
         }
@@ -200,44 +394,373 @@ func PullChanges(dotpilotDir string) error {
                 return err
         }
 
+        auth, err := remoteAuth(repo)
+        if err != nil {
+                return err
+        }
+
+        // Follow the default branch of the remote
+        branch, err := trackDefaultBranch(repo)
+        if err != nil {
+                return err
+        }
+
         // Pull
         err = w.Pull(&git.PullOptions{
+                RemoteName:    "origin",
+                ReferenceName: plumbing.NewBranchReferenceName(branch),
+                Auth:          auth,
+                Progress:      os.Stdout,
+        })
+
+        // An empty remote gets its first commits with the next push
+        if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+                return nil
+        }
+        if err != nil && err != git.NoErrAlreadyUpToDate {
+                return classifyRemoteError(context.Background(), err)
+        }
+
+        return nil
+}
+
+// FetchChanges updates the remote-tracking refs of origin without touching the
+// worktree or the current branch
+func FetchChanges(dotpilotDir string) error {
+        // Open repository
+        repo, err := openRepo(dotpilotDir)
+        if err != nil {
+                return err
+        }
+
+        auth, err := remoteAuth(repo)
+        if err != nil {
+                return err
+        }
+
+        // Fetch
+        err = repo.Fetch(&git.FetchOptions{
                 RemoteName: "origin",
-                Progress:   os.Stdout,
+                Auth:       auth,
         })
 
         if err != nil && err != git.NoErrAlreadyUpToDate {
+                return classifyRemoteError(context.Background(), err)
+        }
+
+        return nil
+}
+
+// CommitSummary describes a commit without exposing go-git types
+type CommitSummary struct {
+        Hash    string    `json:"hash"`
+        Author  string    `json:"author"`
+        When    time.Time `json:"date"`
+        Subject string    `json:"subject"`
+}
+
+// IncomingCommits returns the commits on the remote-tracking branch of origin
+// that the current branch does not contain yet, newest first. It only looks at
+// refs already fetched, see FetchChanges.
+func IncomingCommits(dotpilotDir string) ([]CommitSummary, error) {
+        return remoteDifference(dotpilotDir, true)
+}
+
+// OutgoingCommits returns the commits on the current branch that the
+// remote-tracking branch of origin does not contain yet, newest first: the
+// commits the next push sends. It only looks at refs already fetched, see
+// FetchChanges.
+func OutgoingCommits(dotpilotDir string) ([]CommitSummary, error) {
+        return remoteDifference(dotpilotDir, false)
+}
+
+// remoteDifference returns the commits only the remote-tracking branch has if
+// incoming is set, or only the current branch has otherwise
+func remoteDifference(dotpilotDir string, incoming bool) ([]CommitSummary, error) {
+        // Open repository
+        repo, err := openRepo(dotpilotDir)
+        if err != nil {
+                return nil, err
+        }
+
+        head, err := repo.Head()
+        if err != nil {
+                return nil, err
+        }
+
+        remoteRef, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", upstreamBranch(repo, head)), true)
+        if err != nil {
+                return nil, err
+        }
+
+        from, other := remoteRef.Hash(), head.Hash()
+        if !incoming {
+                from, other = other, from
+        }
+
+        // Everything reachable from the other side is already there
+        known, err := reachableCommits(repo, other)
+        if err != nil {
+                return nil, err
+        }
+
+        fromLog, err := logFrom(repo, from, git.LogOrderCommitterTime)
+        if err != nil {
+                return nil, err
+        }
+
+        commits := []CommitSummary{}
+        err = fromLog.ForEach(func(c *object.Commit) error {
+                if !known[c.Hash] {
+                        commits = append(commits, CommitSummary{
+                                Hash:    c.Hash.String(),
+                                Author:  c.Author.Name,
+                                When:    c.Author.When,
+                                Subject: strings.SplitN(strings.TrimSpace(c.Message), "\n", 2)[0],
+                        })
+                }
+                return nil
+        })
+        if err != nil {
+                return nil, err
+        }
+
+        return commits, nil
+}
+
+// reachableCommits returns the hashes of all commits reachable from hash
+func reachableCommits(repo *git.Repository, hash plumbing.Hash) (map[plumbing.Hash]bool, error) {
+        commits := make(map[plumbing.Hash]bool)
+        revList, err := logFrom(repo, hash, git.LogOrderDFS)
+        if err != nil {
+                return nil, err
+        }
+        err = revList.ForEach(func(c *object.Commit) error {
+                commits[c.Hash] = true
+                return nil
+        })
+        return commits, err
+}
+
+// aheadBehind counts the commits only local and only remote can reach, like
+// git rev-list --left-right --count local...remote. The history both have is
+// that of their merge bases, so diverged histories only count the commits
+// after them, and merges from the other side are not counted twice.
+func aheadBehind(repo *git.Repository, local, remote plumbing.Hash) (int, int, error) {
+        localCommits := make(map[plumbing.Hash]bool)
+        err := walkCommits(repo, []plumbing.Hash{local}, nil, func(hash plumbing.Hash) {
+                localCommits[hash] = true
+        })
+        if err != nil {
+                return 0, 0, err
+        }
+
+        // The remote side down to the merge bases, the first commits local has
+        behind := 0
+        var bases []plumbing.Hash
+        err = walkCommits(repo, []plumbing.Hash{remote}, func(hash plumbing.Hash) bool {
+                if localCommits[hash] {
+                        bases = append(bases, hash)
+                        return true
+                }
+                return false
+        }, func(plumbing.Hash) {
+                behind++
+        })
+        if err != nil {
+                return 0, 0, err
+        }
+
+        // Local's commits, except those of the history below the merge bases
+        shared := 0
+        err = walkCommits(repo, bases, nil, func(plumbing.Hash) {
+                shared++
+        })
+        if err != nil {
+                return 0, 0, err
+        }
+        return len(localCommits) - shared, behind, nil
+}
+
+// walkCommits calls visit once for every commit reachable from starts,
+// stopping at the history a shallow clone has. Commits for which stop returns
+// true are neither visited nor walked past.
+func walkCommits(repo *git.Repository, starts []plumbing.Hash, stop func(plumbing.Hash) bool, visit func(plumbing.Hash)) error {
+        boundary, err := shallowBoundary(repo)
+        if err != nil {
                 return err
         }
+        seen := make(map[plumbing.Hash]bool)
+        for _, hash := range boundary {
+                seen[hash] = true
+        }
 
+        pending := append([]plumbing.Hash{}, starts...)
+        for len(pending) > 0 {
+                hash := pending[len(pending)-1]
+                pending = pending[:len(pending)-1]
+                if seen[hash] {
+                        continue
+                }
+                seen[hash] = true
+                if stop != nil && stop(hash) {
+                        continue
+                }
+
+                commit, err := repo.CommitObject(hash)
+                if err != nil {
+                        return err
+                }
+                visit(hash)
+                pending = append(pending, commit.ParentHashes...)
+        }
         return nil
 }
 
+// HeadHash returns the commit HEAD currently points to
+func HeadHash(dotpilotDir string) (plumbing.Hash, error) {
+        // Open repository
+        repo, err := openRepo(dotpilotDir)
+        if err != nil {
+                return plumbing.ZeroHash, err
+        }
+
+        head, err := repo.Head()
+        if err != nil {
+                return plumbing.ZeroHash, err
+        }
+
+        return head.Hash(), nil
+}
+
+// ResolveCommit returns the commit a revision like HEAD~1, a branch or a hash
+// names in the repository
+func ResolveCommit(dotpilotDir, revision string) (plumbing.Hash, error) {
+        // Open repository
+        repo, err := openRepo(dotpilotDir)
+        if err != nil {
+                return plumbing.ZeroHash, err
+        }
+
+        hash, err := repo.ResolveRevision(plumbing.Revision(revision))
+        if err != nil {
+                return plumbing.ZeroHash, fmt.Errorf("unknown revision %s: %w", revision, err)
+        }
+        return *hash, nil
+}
+
+// ChangedFilesBetween returns the slash-separated repo paths of the files that
+// were added, modified, renamed or deleted between two commits, sorted
+func ChangedFilesBetween(dotpilotDir string, oldHash, newHash plumbing.Hash) ([]string, error) {
+        if oldHash == newHash {
+                return []string{}, nil
+        }
+
+        // Open repository
+        repo, err := openRepo(dotpilotDir)
+        if err != nil {
+                return nil, err
+        }
+
+        oldTree, err := commitTree(repo, oldHash)
+        if err != nil {
+                return nil, err
+        }
+        newTree, err := commitTree(repo, newHash)
+        if err != nil {
+                return nil, err
+        }
+
+        changes, err := object.DiffTree(oldTree, newTree)
+        if err != nil {
+                return nil, err
+        }
+
+        prefix, err := repoPrefix(repo, dotpilotDir)
+        if err != nil {
+                return nil, err
+        }
+
+        // Renames show up with both names, report each path once
+        seen := make(map[string]bool)
+        files := []string{}
+        for _, change := range changes {
+                for _, name := range []string{change.From.Name, change.To.Name} {
+                        name, ok := trimRepoPrefix(prefix, name)
+                        if ok && name != "" && !seen[name] {
+                                seen[name] = true
+                                files = append(files, name)
+                        }
+                }
+        }
+        sort.Strings(files)
+
+        return files, nil
+}
+
+// ChangedFilesSince returns the files changed between oldHash and the current
+// HEAD, see ChangedFilesBetween
+func ChangedFilesSince(dotpilotDir string, oldHash plumbing.Hash) ([]string, error) {
+        newHash, err := HeadHash(dotpilotDir)
+        if err != nil {
+                return nil, err
+        }
+        return ChangedFilesBetween(dotpilotDir, oldHash, newHash)
+}
+
+// commitTree returns the tree of the given commit
+func commitTree(repo *git.Repository, hash plumbing.Hash) (*object.Tree, error) {
+        commit, err := repo.CommitObject(hash)
+        if err != nil {
+                return nil, err
+        }
+        return commit.Tree()
+}
+
 // PushChanges pushes changes to the remote
 func PushChanges(dotpilotDir string) error {
         // Open repository
-        repo, err := git.PlainOpen(dotpilotDir)
+        repo, err := openRepo(dotpilotDir)
+        if err != nil {
+                return err
+        }
+
+        auth, err := remoteAuth(repo)
         if err != nil {
                 return err
         }
 
+        // Push the current branch to its upstream, rather than every branch
+        // to one of the same name
+        var refSpecs []config.RefSpec
+        head, headErr := repo.Head()
+        if headErr == nil && head.Name().IsBranch() {
+                refSpecs = append(refSpecs, config.RefSpec(fmt.Sprintf("%s:%s", head.Name(), plumbing.NewBranchReferenceName(upstreamBranch(repo, head)))))
+        }
+
         // Push
         err = repo.Push(&git.PushOptions{
                 RemoteName: "origin",
+                RefSpecs:   refSpecs,
+                Auth:       auth,
                 Progress:   os.Stdout,
         })
 
         if err != nil && err != git.NoErrAlreadyUpToDate {
-                return err
+                return classifyRemoteError(context.Background(), err)
         }
 
+        // What this machine pushed needn't be verified when it is pulled back
+        if headErr == nil {
+                return recordPushedCommits(repo, head.Hash())
+        }
         return nil
 }
 
 // GetGitStatus returns a string representation of the git status
 func GetGitStatus(dotpilotDir string) (string, error) {
         // Open repository
-        repo, err := git.PlainOpen(dotpilotDir)
+        repo, err := openRepo(dotpilotDir)
         if err != nil {
                 return "", err
         }
@@ -254,7 +777,30 @@ func GetGitStatus(dotpilotDir string) (string, error) {
                 return "", err
         }
 
-        return status.String(), nil
+        return formatGitStatus(status), nil
+}
+
+// formatGitStatus formats status like git status --short, sorted by path.
+// Status.String ranges over a map, so its order changes from run to run.
+func formatGitStatus(status git.Status) string {
+        paths := make([]string, 0, len(status))
+        for path := range status {
+                paths = append(paths, path)
+        }
+        sort.Strings(paths)
+
+        var b strings.Builder
+        for _, path := range paths {
+                fileStatus := status[path]
+                if fileStatus.Staging == git.Unmodified && fileStatus.Worktree == git.Unmodified {
+                        continue
+                }
+                if fileStatus.Staging == git.Renamed {
+                        path = fmt.Sprintf("%s -> %s", path, fileStatus.Extra)
+                }
+                fmt.Fprintf(&b, "%c%c %s\n", fileStatus.Staging, fileStatus.Worktree, path)
+        }
+        return b.String()
 }
 
 // GetRemoteStatus returns the status of the local repository compared to the remote
@@ -265,7 +811,7 @@ func GetRemoteStatus(dotpilotDir string) (RemoteStatus, error) {
         }
 
         // Open repository
-        repo, err := git.PlainOpen(dotpilotDir)
+        repo, err := openRepo(dotpilotDir)
         if err != nil {
                 return result, err
         }
@@ -277,61 +823,55 @@ func GetRemoteStatus(dotpilotDir string) (RemoteStatus, error) {
         }
 
         // Get remote reference
-        remoteRef, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", head.Name().Short()), true)
+        remoteRef, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", upstreamBranch(repo, head)), true)
         if err != nil {
                 return result, err
         }
 
-        // Count commits ahead and behind
-        revList, err := repo.Log(&git.LogOptions{
-                From:  head.Hash(),
-                Order: git.LogOrderCommitterTime,
-        })
+        // Count the commits only one side can reach
+        result.Ahead, result.Behind, err = aheadBehind(repo, head.Hash(), remoteRef.Hash())
         if err != nil {
                 return result, err
         }
 
-        // Count commits ahead
-        err = revList.ForEach(func(c *object.Commit) error {
-                if c.Hash == remoteRef.Hash() {
-                        return fmt.Errorf("stop")
-                }
-                result.Ahead++
-                return nil
-        })
-        if err != nil && err.Error() != "stop" {
+        shallow, err := repo.Storer.Shallow()
+        if err != nil {
                 return result, err
         }
+        result.Shallow = len(shallow) > 0
 
-        // Count commits behind
-        revList, err = repo.Log(&git.LogOptions{
-                From:  remoteRef.Hash(),
-                Order: git.LogOrderCommitterTime,
-        })
+        return result, nil
+}
+
+// RemoteURLs returns the URLs of the git remotes of the repository, origin's
+// first
+func RemoteURLs(dotpilotDir string) ([]string, error) {
+        repo, err := openRepo(dotpilotDir)
         if err != nil {
-                return result, err
+                return nil, err
         }
 
-        err = revList.ForEach(func(c *object.Commit) error {
-                if c.Hash == head.Hash() {
-                        return fmt.Errorf("stop")
-                }
-                result.Behind++
-                return nil
-        })
-        if err != nil && err.Error() != "stop" {
-                return result, err
+        remotes, err := repo.Remotes()
+        if err != nil {
+                return nil, err
         }
+        sort.SliceStable(remotes, func(i, j int) bool {
+                return remotes[i].Config().Name == "origin" && remotes[j].Config().Name != "origin"
+        })
 
-        return result, nil
+        var urls []string
+        for _, remote := range remotes {
+                urls = append(urls, remote.Config().URLs...)
+        }
+        return urls, nil
 }
 
-// GetTrackedFiles returns a list of files tracked by dotpilot
+// GetTrackedFiles returns a list of files tracked by dotpilot, sorted by path
 func GetTrackedFiles(dotpilotDir string) ([]string, error) {
         var trackedFiles []string
 
         // Open repository
-        repo, err := git.PlainOpen(dotpilotDir)
+        repo, err := openRepo(dotpilotDir)
         if err != nil {
                 return nil, err
         }
@@ -354,19 +894,27 @@ func GetTrackedFiles(dotpilotDir string) ([]string, error) {
                 return nil, err
         }
 
+        prefix, err := repoPrefix(repo, dotpilotDir)
+        if err != nil {
+                return nil, err
+        }
+
         // Walk the tree
         err = tree.Files().ForEach(func(f *object.File) error {
-                // Skip .git directory and README.md
-                if f.Name == "README.md" {
+                // Skip files outside the dotfiles, README.md and .gitignore
+                name, ok := trimRepoPrefix(prefix, f.Name)
+                if !ok || name == "README.md" || name == gitignoreFile {
                         return nil
                 }
 
-                trackedFiles = append(trackedFiles, f.Name)
+                trackedFiles = append(trackedFiles, name)
                 return nil
         })
         if err != nil {
                 return nil, err
         }
 
+        // The order of the tree walk isn't guaranteed, keep the output stable
+        sort.Strings(trackedFiles)
         return trackedFiles, nil
 }
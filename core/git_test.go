@@ -0,0 +1,213 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// writeRepoFile writes a file below the repository root
+func writeRepoFile(t *testing.T, dotpilotDir, name, content string) {
+	t.Helper()
+
+	path := filepath.Join(dotpilotDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChangedFilesBetween(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "one\n")
+	writeRepoFile(t, dotpilotDir, "common/.vimrc", "one\n")
+	writeRepoFile(t, dotpilotDir, "envs/dev/.gitconfig", "one\n")
+	if err := CommitChanges(dotpilotDir, "first"); err != nil {
+		t.Fatal(err)
+	}
+	oldHash, err := HeadHash(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "two\n")
+	writeRepoFile(t, dotpilotDir, "machine/laptop/.bashrc", "one\n")
+	if err := os.Remove(filepath.Join(dotpilotDir, "common", ".vimrc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := CommitChanges(dotpilotDir, "second"); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := ChangedFilesSince(dotpilotDir, oldHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"common/.vimrc", "common/.zshrc", "machine/laptop/.bashrc"}
+	if !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed files = %v, want %v", changed, want)
+	}
+
+	changed, err = ChangedFilesBetween(dotpilotDir, oldHash, oldHash)
+	if err != nil || len(changed) != 0 {
+		t.Errorf("same commit reported changes %v, %v", changed, err)
+	}
+}
+
+func TestFetchIncomingCommits(t *testing.T) {
+	remoteDir := t.TempDir()
+	if _, err := git.PlainInit(remoteDir, false); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, remoteDir, "common/.zshrc", "one\n")
+	if err := CommitChanges(remoteDir, "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	dotpilotDir := filepath.Join(t.TempDir(), ".dotpilot")
+	if _, err := git.PlainClone(dotpilotDir, false, &git.CloneOptions{URL: remoteDir}); err != nil {
+		t.Fatal(err)
+	}
+
+	// One commit on each side
+	writeRepoFile(t, remoteDir, "common/.zshrc", "two\n")
+	if err := CommitChanges(remoteDir, "remote change"); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "common/.vimrc", "one\n")
+	if err := CommitChanges(dotpilotDir, "local change"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := FetchChanges(dotpilotDir); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := GetRemoteStatus(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Ahead != 1 || status.Behind != 1 {
+		t.Errorf("remote status = %+v, want 1 ahead and 1 behind", status)
+	}
+
+	incoming, err := IncomingCommits(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(incoming) != 1 || incoming[0].Subject != "remote change" {
+		t.Errorf("incoming commits = %+v, want only the remote change", incoming)
+	}
+
+	// Fetching leaves the worktree alone
+	data, err := os.ReadFile(filepath.Join(dotpilotDir, "common", ".zshrc"))
+	if err != nil || string(data) != "one\n" {
+		t.Errorf("fetch changed the worktree: %q, %v", data, err)
+	}
+}
+
+// storeCommit stores a commit without files on top of parents
+func storeCommit(t *testing.T, repo *git.Repository, message string, parents ...plumbing.Hash) plumbing.Hash {
+	t.Helper()
+
+	store := func(o interface{ Encode(plumbing.EncodedObject) error }) plumbing.Hash {
+		obj := repo.Storer.NewEncodedObject()
+		if err := o.Encode(obj); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := repo.Storer.SetEncodedObject(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	signature := object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(1700000000, 0)}
+	return store(&object.Commit{
+		Author:       signature,
+		Committer:    signature,
+		Message:      message,
+		TreeHash:     store(&object.Tree{}),
+		ParentHashes: parents,
+	})
+}
+
+func TestAheadBehindDiverged(t *testing.T) {
+	repo, err := git.PlainInit(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b1 - b2 - l1 - l2 - merge
+	//        \            /
+	//         r1 ------- r2 - r3
+	b1 := storeCommit(t, repo, "b1")
+	b2 := storeCommit(t, repo, "b2", b1)
+	l2 := storeCommit(t, repo, "l2", storeCommit(t, repo, "l1", b2))
+	r1 := storeCommit(t, repo, "r1", b2)
+	r2 := storeCommit(t, repo, "r2", r1)
+	r3 := storeCommit(t, repo, "r3", r2)
+	merge := storeCommit(t, repo, "merge", l2, r2)
+	unrelated := storeCommit(t, repo, "u2", storeCommit(t, repo, "u1"))
+
+	tests := []struct {
+		name          string
+		local, remote plumbing.Hash
+		ahead, behind int
+	}{
+		{"in sync", l2, l2, 0, 0},
+		{"behind", b2, r3, 0, 3},
+		{"diverged", l2, r3, 2, 3},
+		{"merged part of the remote", merge, r3, 3, 1},
+		{"unrelated histories", l2, unrelated, 4, 2},
+	}
+	for _, tt := range tests {
+		ahead, behind, err := aheadBehind(repo, tt.local, tt.remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ahead != tt.ahead || behind != tt.behind {
+			t.Errorf("%s: %d ahead, %d behind, want %d and %d", tt.name, ahead, behind, tt.ahead, tt.behind)
+		}
+	}
+}
+
+func TestGetGitStatusSorted(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"common/.zshrc", "envs/work/.gitconfig", "common/.bashrc", "machine/laptop/.ssh/config", "common/.vimrc"}
+	for _, name := range names {
+		writeRepoFile(t, dotpilotDir, name, name+"\n")
+	}
+	if err := CommitChanges(dotpilotDir, "dotfiles"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range append(names, "common/.inputrc", "envs/home/.gitconfig") {
+		writeRepoFile(t, dotpilotDir, name, "changed\n")
+	}
+
+	// The order is the same every time
+	want := " M common/.bashrc\n?? common/.inputrc\n M common/.vimrc\n M common/.zshrc\n?? envs/home/.gitconfig\n M envs/work/.gitconfig\n M machine/laptop/.ssh/config\n"
+	for i := 0; i < 5; i++ {
+		got, err := GetGitStatus(dotpilotDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("GetGitStatus = %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Git attributes for the secret directories
+//
+// Encrypted blobs must never be merged line by line: a textual merge of two
+// AES or sops payloads produces a file that no longer decrypts. Both secret
+// managers keep a managed block in the .gitattributes of their directory that
+// marks every file as binary, except the metadata index and the attributes
+// file itself. Lines outside the block belong to the user and are preserved.
+//
+// Optionally the block names the dotpilot-secret diff driver, whose textconv
+// prints the backend, size and hash of a blob instead of its ciphertext. The
+// driver lives in the local repository config, so it is configured again by
+// Initialize on every machine that checks out an attributes file naming it.
+
+const (
+	gitattributesFile  = ".gitattributes"
+	attributesBegin    = "# BEGIN dotpilot (managed, do not edit)"
+	attributesEnd      = "# END dotpilot"
+	secretDiffDriver   = "dotpilot-secret"
+	secretDiffSelector = "diff=" + secretDiffDriver
+)
+
+// secretAttributes returns the managed block, with or without the diff driver
+func secretAttributes(diffDriver bool) string {
+	secretLine := "* binary merge=binary"
+	if diffDriver {
+		secretLine += " " + secretDiffSelector
+	}
+
+	return strings.Join([]string{
+		attributesBegin,
+		"# Encrypted secrets are opaque blobs, never diff or merge them as text",
+		secretLine,
+		gitattributesFile + " text diff merge",
+		secretIndexFile + " text diff merge",
+		attributesEnd,
+	}, "\n") + "\n"
+}
+
+// splitAttributes separates the managed block from the user's lines. It
+// returns the lines before and after the block and whether the block enables
+// the diff driver.
+func splitAttributes(content string) (before, after string, diffDriver bool) {
+	start := strings.Index(content, attributesBegin)
+	if start < 0 {
+		return content, "", false
+	}
+	end := strings.Index(content[start:], attributesEnd)
+	if end < 0 {
+		return content[:start], "", strings.Contains(content[start:], secretDiffSelector)
+	}
+	end += start + len(attributesEnd)
+
+	block := content[start:end]
+	return content[:start], strings.TrimPrefix(content[end:], "\n"), strings.Contains(block, secretDiffSelector)
+}
+
+// writeSecretAttributes writes the managed block into the .gitattributes of a
+// secrets directory. The file is only rewritten when its content changes.
+func writeSecretAttributes(secretsDir string, diffDriver bool) error {
+	path := filepath.Join(secretsDir, gitattributesFile)
+	existing, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	before, after, _ := splitAttributes(string(existing))
+	if before != "" && !strings.HasSuffix(before, "\n") {
+		before += "\n"
+	}
+	content := before + secretAttributes(diffDriver) + after
+	if bytes.Equal(existing, []byte(content)) {
+		return nil
+	}
+
+	return ioutil.WriteFile(path, []byte(content), 0644)
+}
+
+// secretDiffEnabled reports whether the attributes of a secrets directory name
+// the dotpilot-secret diff driver
+func secretDiffEnabled(secretsDir string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(secretsDir, gitattributesFile))
+	if err != nil {
+		return false
+	}
+	_, _, diffDriver := splitAttributes(string(data))
+	return diffDriver
+}
+
+// ensureSecretAttributes keeps the attributes of a secrets directory up to
+// date, preserving whether the diff driver is enabled, and configures the
+// driver in the repository when it is
+func ensureSecretAttributes(dotpilotDir, secretsDir string) error {
+	diffDriver := secretDiffEnabled(secretsDir)
+	if err := writeSecretAttributes(secretsDir, diffDriver); err != nil {
+		return err
+	}
+	if !diffDriver {
+		return nil
+	}
+	return configureSecretDiff(dotpilotDir)
+}
+
+// enableSecretDiff switches the attributes of a secrets directory to the
+// dotpilot-secret diff driver and configures the driver in the repository
+func enableSecretDiff(dotpilotDir, secretsDir string) error {
+	if err := writeSecretAttributes(secretsDir, true); err != nil {
+		return err
+	}
+	return configureSecretDiff(dotpilotDir)
+}
+
+// configureSecretDiff sets diff.dotpilot-secret.textconv in the local config of
+// the dotpilot repository to the running dotpilot binary
+func configureSecretDiff(dotpilotDir string) error {
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return err
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		executable = "dotpilot"
+	}
+	textconv := shellQuote(executable) + " secrets textconv"
+
+	driver := cfg.Raw.Section("diff").Subsection(secretDiffDriver)
+	if driver.Option("textconv") == textconv {
+		return nil
+	}
+	driver.SetOption("textconv", textconv)
+	return repo.SetConfig(cfg)
+}
+
+// shellQuote quotes s for the shell git runs textconv commands with
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// DescribeSecretBlob summarizes an encrypted blob for the dotpilot-secret diff
+// driver. It shows what changed without printing any ciphertext.
+func DescribeSecretBlob(data []byte) string {
+	backend := BackendAES
+	switch {
+	case looksGPGEncrypted(data):
+		backend = BackendGPG
+	case bytes.Contains(data, []byte("\nsops:")) || bytes.Contains(data, []byte(`"sops":`)):
+		backend = BackendSops
+	}
+
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("encrypted secret\nbackend: %s\nsize: %d bytes\nsha256: %s\n", backend, len(data), hex.EncodeToString(sum[:]))
+}
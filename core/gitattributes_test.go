@@ -0,0 +1,86 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestSecretAttributes(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	repo, err := git.PlainInit(dotpilotDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sm := NewSecretManager(dotpilotDir)
+	attributesPath := filepath.Join(sm.secretsDir, gitattributesFile)
+	if err := os.MkdirAll(sm.secretsDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(attributesPath, []byte("*.txt text\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Initialize adds the managed block and keeps the user's lines
+	for i := 0; i < 2; i++ {
+		if err := sm.Initialize(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(attributesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "*.txt text\n" + secretAttributes(false); string(data) != want {
+		t.Errorf("attributes = %q, want %q", data, want)
+	}
+
+	// Enabling the diff driver survives later Initialize calls
+	if err := sm.EnableDiffDriver(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(attributesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "*.txt text\n" + secretAttributes(true); string(data) != want {
+		t.Errorf("attributes = %q, want %q", data, want)
+	}
+
+	cfg, err := repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	textconv := cfg.Raw.Section("diff").Subsection(secretDiffDriver).Option("textconv")
+	if !strings.HasSuffix(textconv, " secrets textconv") {
+		t.Errorf("textconv = %q", textconv)
+	}
+}
+
+func TestDescribeSecretBlob(t *testing.T) {
+	tests := []struct {
+		data    string
+		backend string
+	}{
+		{"-----BEGIN PGP MESSAGE-----\n", BackendGPG},
+		{"token: ENC[AES256_GCM,data:abc]\nsops:\n    version: 3.8.1\n", BackendSops},
+		{"c2FsdGVkX19ub25jZQ==", BackendAES},
+	}
+
+	for _, tt := range tests {
+		description := DescribeSecretBlob([]byte(tt.data))
+		if !strings.Contains(description, "backend: "+tt.backend+"\n") {
+			t.Errorf("DescribeSecretBlob(%q) = %q, want backend %s", tt.data, description, tt.backend)
+		}
+		if strings.Contains(description, tt.data) {
+			t.Errorf("DescribeSecretBlob(%q) reveals the blob", tt.data)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// git-crypt interop
+//
+// Repositories that already keep their secrets with git-crypt encrypt every
+// file whose attributes name the git-crypt filter when it is staged, and
+// decrypt it on checkout once the repository is unlocked. 'track --git-crypt'
+// tracks a file like any other and appends a line to the .gitattributes of
+// the dotpilot repository that hands it to the filter, so the plaintext stays
+// in the worktree and only ciphertext is committed.
+//
+// go-git doesn't run filters. While the attributes of the dotpilot
+// repository name the git-crypt filter, changes are staged with the git
+// binary instead, which does.
+
+const (
+	gitCryptDir      = ".git-crypt"
+	gitCryptFilter   = "git-crypt"
+	gitCryptSelector = "filter=" + gitCryptFilter
+)
+
+// GitCryptConfigured reports whether the repository of dotpilotDir uses
+// git-crypt: its worktree has a .git-crypt directory, or the attributes of
+// the worktree or of the dotpilot repository name the git-crypt filter
+func GitCryptConfigured(dotpilotDir string) bool {
+	root := worktreeRoot(dotpilotDir)
+	if info, err := os.Stat(filepath.Join(root, gitCryptDir)); err == nil && info.IsDir() {
+		return true
+	}
+	return namesGitCryptFilter(root) || namesGitCryptFilter(dotpilotDir)
+}
+
+// GitCryptUnlocked reports whether git-crypt is unlocked in the repository of
+// dotpilotDir: the filter is configured and a key is installed. While it is
+// locked, files handed to the filter are staged as plaintext.
+func GitCryptUnlocked(dotpilotDir string) bool {
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return false
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		return false
+	}
+	if cfg.Raw.Section("filter").Subsection(gitCryptFilter).Option("smudge") == "" {
+		return false
+	}
+
+	gitDir, err := gitOutput(dotpilotDir, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return false
+	}
+	keys, err := ioutil.ReadDir(filepath.Join(strings.TrimSpace(gitDir), gitCryptFilter, "keys"))
+	return err == nil && len(keys) > 0
+}
+
+// EnsureGitCryptAttributes hands the files at paths, absolute paths inside
+// dotpilotDir, to the git-crypt filter. Directories stand for the files below
+// them. A line is appended to the .gitattributes of dotpilotDir for each path
+// with a file the filter doesn't apply to yet. It returns the patterns added.
+func EnsureGitCryptAttributes(dotpilotDir string, paths []string) ([]string, error) {
+	var patterns []string
+	for _, path := range paths {
+		relPath, err := filepath.Rel(dotpilotDir, path)
+		if err != nil {
+			return nil, err
+		}
+		if relPath == "." || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("%s is outside the dotpilot repository", path)
+		}
+
+		files, err := filesBelow(path)
+		if err != nil {
+			return nil, err
+		}
+		unfiltered, err := withoutGitCryptFilter(dotpilotDir, files)
+		if err != nil {
+			return nil, err
+		}
+		if !unfiltered {
+			continue
+		}
+
+		pattern := "/" + escapeGlob(filepath.ToSlash(relPath))
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			pattern += "/**"
+		}
+		if strings.ContainsAny(pattern, " \t\"") {
+			// git reads C-style quoted patterns
+			pattern = strconv.Quote(pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	attributesPath := filepath.Join(dotpilotDir, gitattributesFile)
+	existing, err := ioutil.ReadFile(attributesPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(existing)
+	if len(existing) > 0 && !bytes.HasSuffix(existing, []byte("\n")) {
+		buf.WriteString("\n")
+	}
+	for _, pattern := range patterns {
+		fmt.Fprintf(&buf, "%s %s diff=%s\n", pattern, gitCryptSelector, gitCryptFilter)
+	}
+	if err := ioutil.WriteFile(attributesPath, buf.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
+
+// withoutGitCryptFilter reports whether the git-crypt filter doesn't apply to
+// any of files, absolute paths inside dotpilotDir
+func withoutGitCryptFilter(dotpilotDir string, files []string) (bool, error) {
+	if len(files) == 0 {
+		return false, nil
+	}
+
+	args := []string{"check-attr", "-z", "filter", "--"}
+	for _, file := range files {
+		relPath, err := filepath.Rel(dotpilotDir, file)
+		if err != nil {
+			return false, err
+		}
+		args = append(args, relPath)
+	}
+	out, err := gitOutput(dotpilotDir, args...)
+	if err != nil {
+		return false, err
+	}
+
+	// Each file is reported as <path> NUL filter NUL <value> NUL
+	fields := strings.Split(out, "\x00")
+	for i := 2; i < len(fields); i += 3 {
+		if fields[i] != gitCryptFilter {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// filesBelow returns path if it is a file, or the files below it if it is a
+// directory
+func filesBelow(path string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, p)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// escapeGlob escapes the wildcards in path, so the pattern matches only path
+func escapeGlob(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// namesGitCryptFilter reports whether the .gitattributes in dir names the
+// git-crypt filter
+func namesGitCryptFilter(dir string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(dir, gitattributesFile))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			if field == gitCryptSelector {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// worktreeRoot returns the root of the worktree dotpilotDir is in, dotpilotDir
+// itself if it can't be opened
+func worktreeRoot(dotpilotDir string) string {
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return dotpilotDir
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		return dotpilotDir
+	}
+	return w.Filesystem.Root()
+}
+
+// gitOutput runs the git binary in dotpilotDir and returns its output
+func gitOutput(dotpilotDir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dotpilotDir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
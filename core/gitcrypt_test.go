@@ -0,0 +1,88 @@
+package core
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestGitCryptAttributes(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dotpilotDir := t.TempDir()
+	repo, err := git.PlainInit(dotpilotDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if GitCryptConfigured(dotpilotDir) {
+		t.Error("a plain repository uses git-crypt")
+	}
+
+	writeRepoFile(t, dotpilotDir, ".gitattributes", "secrets/** filter=git-crypt diff=git-crypt")
+	writeRepoFile(t, dotpilotDir, "secrets/token", "token\n")
+	writeRepoFile(t, dotpilotDir, "common/.ssh/id ed25519", "private key\n")
+	if !GitCryptConfigured(dotpilotDir) {
+		t.Fatal("git-crypt attributes not detected")
+	}
+	if GitCryptUnlocked(dotpilotDir) {
+		t.Error("git-crypt unlocked without a filter or key")
+	}
+
+	// Only the file the filter doesn't apply to yet gets a line
+	paths := []string{filepath.Join(dotpilotDir, "secrets"), filepath.Join(dotpilotDir, "common", ".ssh", "id ed25519")}
+	patterns, err := EnsureGitCryptAttributes(dotpilotDir, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patterns) != 1 || patterns[0] != `"/common/.ssh/id ed25519"` {
+		t.Errorf("patterns = %q", patterns)
+	}
+	if patterns, err = EnsureGitCryptAttributes(dotpilotDir, paths); err != nil || len(patterns) != 0 {
+		t.Errorf("second call added %q, %v", patterns, err)
+	}
+
+	// A stand-in filter, unlocked with a key installed
+	cfg, err := repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := cfg.Raw.Section("filter").Subsection(gitCryptFilter)
+	filter.SetOption("clean", "tr a-z A-Z")
+	filter.SetOption("smudge", "cat")
+	if err := repo.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, ".git/git-crypt/keys/default", "key")
+	if !GitCryptUnlocked(dotpilotDir) {
+		t.Fatal("git-crypt locked with a filter and key")
+	}
+
+	// Committing runs the filter, the worktree keeps the plaintext
+	if err := CommitChanges(dotpilotDir, "Track a key"); err != nil {
+		t.Fatal(err)
+	}
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := commit.File("common/.ssh/id ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := file.Contents(); content != "PRIVATE KEY\n" {
+		t.Errorf("committed %q, want the filtered content", content)
+	}
+	data, err := os.ReadFile(filepath.Join(dotpilotDir, "common", ".ssh", "id ed25519"))
+	if err != nil || string(data) != "private key\n" {
+		t.Errorf("worktree holds %q, %v", data, err)
+	}
+}
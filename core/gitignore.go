@@ -0,0 +1,144 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dotpilot/utils"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// .gitignore of the dotpilot directory
+//
+// Some files in the dotpilot directory must never be committed: the AES key
+// of the secrets backend, backups of replaced files, logs and machine-local
+// state. The .gitignore of the dotpilot directory carries a managed block
+// listing them, between the same markers as the secret .gitattributes. Lines
+// outside the block belong to the user and are preserved. Machine-local state
+// is also listed in .git/info/exclude (see excludeLocalFile), which works
+// before the .gitignore is pulled on a machine.
+
+const gitignoreFile = ".gitignore"
+
+// gitignoreBlock is the managed block of the .gitignore
+var gitignoreBlock = strings.Join([]string{
+	attributesBegin,
+	"# The key of the AES secrets backend, anyone holding it can decrypt them",
+	"/.secret_key",
+	"# Backups made when files are replaced",
+	"*.dotpilot.bak.*",
+	"*.backup",
+	"# Logs and machine-local state",
+	"/logs/",
+	"/" + lockFileName,
+	"/" + packageStateFile,
+	"/" + bootstrapStateFile,
+	"/" + snapshotsDir + "/",
+	attributesEnd,
+}, "\n") + "\n"
+
+// EnsureGitignore writes the managed block into the .gitignore of the
+// dotpilot directory and reports whether the file changed. It warns about
+// files the block ignores that are committed already, since ignoring them
+// doesn't remove them from the repository.
+func EnsureGitignore(dotpilotDir string) (bool, error) {
+	path := filepath.Join(dotpilotDir, gitignoreFile)
+	existing, content, err := managedGitignore(path)
+	if err != nil {
+		return false, err
+	}
+
+	changed := !bytes.Equal(existing, content)
+	if changed {
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			return false, err
+		}
+		utils.Logger.Debug().Msgf("Updated %s", path)
+	}
+
+	committed, err := committedIgnoredFiles(dotpilotDir)
+	if err != nil {
+		utils.Logger.Debug().Err(err).Msg("Failed to check for committed files that should be ignored")
+		return changed, nil
+	}
+	for _, repoPath := range committed {
+		utils.Logger.Warn().Msgf("%s is committed although it must not be, remove it with 'git rm --cached %s'", repoPath, repoPath)
+		if filepath.Base(repoPath) == ".secret_key" {
+			utils.Logger.Warn().Msg("Anyone with access to the repository history can decrypt the AES secrets, re-encrypt them with a new key")
+		}
+	}
+
+	return changed, nil
+}
+
+// managedGitignore returns the .gitignore at path and what it is with the
+// managed block brought up to date
+func managedGitignore(path string) (existing, content []byte, err error) {
+	existing, err = ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	before, after, _ := splitAttributes(string(existing))
+	if before != "" && !strings.HasSuffix(before, "\n") {
+		before += "\n"
+	}
+	return existing, []byte(before + gitignoreBlock + after), nil
+}
+
+// committedIgnoredFiles returns the committed files below dotpilotDir that the
+// managed block ignores, as paths relative to the repository root
+func committedIgnoredFiles(dotpilotDir string) ([]string, error) {
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		// Nothing is committed yet
+		return nil, nil
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := repoPrefix(repo, dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []gitignore.Pattern
+	for _, line := range strings.Split(gitignoreBlock, "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, gitignore.ParsePattern(line, nil))
+		}
+	}
+	matcher := gitignore.NewMatcher(patterns)
+
+	var committed []string
+	err = tree.Files().ForEach(func(f *object.File) error {
+		relPath, ok := trimRepoPrefix(prefix, f.Name)
+		if !ok {
+			return nil
+		}
+
+		// A file is ignored if it or one of its parent directories matches
+		parts := strings.Split(relPath, "/")
+		for i := range parts {
+			if matcher.Match(parts[:i+1], i < len(parts)-1) {
+				committed = append(committed, f.Name)
+				break
+			}
+		}
+		return nil
+	})
+	return committed, err
+}
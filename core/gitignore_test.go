@@ -0,0 +1,79 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestEnsureGitignore(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The user's own entries are kept
+	writeRepoFile(t, dotpilotDir, ".gitignore", "node_modules/")
+	changed, err := EnsureGitignore(dotpilotDir)
+	if err != nil || !changed {
+		t.Fatalf("EnsureGitignore() = %v, %v, want a change", changed, err)
+	}
+	data, err := os.ReadFile(filepath.Join(dotpilotDir, ".gitignore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "node_modules/\n" + gitignoreBlock; string(data) != want {
+		t.Errorf(".gitignore = %q, want %q", data, want)
+	}
+
+	if changed, err := EnsureGitignore(dotpilotDir); err != nil || changed {
+		t.Errorf("second EnsureGitignore() = %v, %v, want no change", changed, err)
+	}
+}
+
+func TestCommittedIgnoredFiles(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Committed before the repository had a .gitignore
+	writeRepoFile(t, dotpilotDir, ".secret_key", "key")
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "zsh\n")
+	writeRepoFile(t, dotpilotDir, "common/.zshrc.dotpilot.bak.20240101120000", "old\n")
+	writeRepoFile(t, dotpilotDir, "common/.config/app/settings.backup", "old\n")
+	if err := CommitChanges(dotpilotDir, "initial"); err != nil {
+		t.Fatal(err)
+	}
+
+	committed, err := committedIgnoredFiles(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{".secret_key", "common/.config/app/settings.backup", "common/.zshrc.dotpilot.bak.20240101120000"}
+	if !reflect.DeepEqual(committed, want) {
+		t.Errorf("committed ignored files = %v, want %v", committed, want)
+	}
+
+	// New ones aren't committed anymore
+	if _, err := EnsureGitignore(dotpilotDir); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "common/.vimrc.dotpilot.bak.20240101120000", "old\n")
+	if err := CommitChanges(dotpilotDir, "gitignore"); err != nil {
+		t.Fatal(err)
+	}
+	tracked, err := GetTrackedFiles(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range tracked {
+		if strings.HasPrefix(name, "common/.vimrc") {
+			t.Errorf("%s was committed", name)
+		}
+	}
+}
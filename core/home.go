@@ -0,0 +1,34 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Sandboxing
+//
+// Every path dotpilot works with is derived from the home directory, and the
+// machine layers, hooks and guards go by the hostname. DOTPILOT_HOME and
+// DOTPILOT_HOSTNAME override both, so the real commands can run against a
+// sandbox, as integration tests and the demos do, without touching the
+// dotfiles of whoever runs them. dotpilot always asks Home and MachineID
+// rather than the system. Programs dotpilot starts, like git, gpg and hooks,
+// still see the real HOME.
+
+// Home returns the home directory dotpilot works in: DOTPILOT_HOME if set,
+// otherwise the home directory of the user
+func Home() (string, error) {
+	if home := os.Getenv("DOTPILOT_HOME"); home != "" {
+		return filepath.Abs(home)
+	}
+	return os.UserHomeDir()
+}
+
+// MachineID returns the name of this machine, which names its
+// machine/<hostname>/ layer: DOTPILOT_HOSTNAME if set, otherwise the hostname
+func MachineID() (string, error) {
+	if hostname := os.Getenv("DOTPILOT_HOSTNAME"); hostname != "" {
+		return hostname, nil
+	}
+	return os.Hostname()
+}
@@ -0,0 +1,35 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHomeAndMachineIDOverrides(t *testing.T) {
+	userHome := t.TempDir()
+	t.Setenv("HOME", userHome)
+	t.Setenv("DOTPILOT_HOME", "")
+	t.Setenv("DOTPILOT_HOSTNAME", "")
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if home, err := Home(); err != nil || home != userHome {
+		t.Errorf("Home() = %q, %v, want %s", home, err, userHome)
+	}
+	if id, err := MachineID(); err != nil || id != hostname {
+		t.Errorf("MachineID() = %q, %v, want %s", id, err, hostname)
+	}
+
+	sandbox := t.TempDir()
+	t.Setenv("DOTPILOT_HOME", sandbox+"/box/")
+	t.Setenv("DOTPILOT_HOSTNAME", "ci-runner")
+	if home, err := Home(); err != nil || home != filepath.Join(sandbox, "box") {
+		t.Errorf("Home() = %q, %v, want the sandbox", home, err)
+	}
+	if id, err := MachineID(); err != nil || id != "ci-runner" {
+		t.Errorf("MachineID() = %q, %v, want ci-runner", id, err)
+	}
+}
@@ -1,8 +1,12 @@
 package core
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/dotpilot/utils"
 )
@@ -10,7 +14,7 @@ import (
 // RunHooks runs hooks based on the environment
 func RunHooks(dotpilotDir, environment, hookName string) error {
 	// Get hostname
-	hostname, err := os.Hostname()
+	hostname, err := MachineID()
 	if err != nil {
 		return err
 	}
@@ -28,8 +32,9 @@ func RunHooks(dotpilotDir, environment, hookName string) error {
 	hookFiles = append(hookFiles, filepath.Join(dotpilotDir, "machine", hostname, hookName))
 
 	// Run hooks
+	env := ScriptEnv(dotpilotDir, environment)
 	for _, hookFile := range hookFiles {
-		if err := runHook(hookFile); err != nil {
+		if err := runHook(dotpilotDir, hookFile, env); err != nil {
 			return err
 		}
 	}
@@ -37,27 +42,117 @@ func RunHooks(dotpilotDir, environment, hookName string) error {
 	return nil
 }
 
-// runHook runs a single hook script
-func runHook(hookFile string) error {
+// runHook runs a single hook script in dotpilotDir with the given environment
+func runHook(dotpilotDir, hookFile string, env []string) error {
 	// Check if hook file exists
 	if _, err := os.Stat(hookFile); os.IsNotExist(err) {
 		utils.Logger.Debug().Msgf("Hook file does not exist: %s", hookFile)
 		return nil
 	}
 
-	// Make hook file executable
-	if err := os.Chmod(hookFile, 0755); err != nil {
+	// Execute hook with the interpreter of its #! line, see ScriptCommand,
+	// logging its output as it runs
+	cmd, err := ScriptCommand(hookFile)
+	if err != nil {
 		return err
 	}
-
-	// Execute hook
 	utils.Logger.Info().Msgf("Running hook: %s", hookFile)
-	output, err := utils.ExecuteCommand(hookFile)
-	if err != nil {
-		utils.Logger.Error().Err(err).Msgf("Hook failed: %s\nOutput: %s", hookFile, output)
+	opts := utils.StreamOptions{Env: append(env, "PWD="+dotpilotDir), Dir: dotpilotDir, Prefix: filepath.Base(hookFile)}
+	if code, err := utils.StreamCommandWithOptions(context.Background(), opts, cmd.Path, cmd.Args[1:]...); err != nil {
+		utils.Logger.Error().Err(err).Msgf("Hook failed with exit code %d: %s", code, hookFile)
 		return err
 	}
 
 	utils.Logger.Info().Msgf("Hook succeeded: %s", hookFile)
 	return nil
 }
+
+// ScriptEnv returns the environment for hooks, setup scripts and package
+// commands: the current process environment, see scriptBaseEnv, plus the
+// DOTPILOT_* variables describing this machine, so shared scripts can branch
+// without hardcoding.
+func ScriptEnv(dotpilotDir, environment string) []string {
+	hostname, err := MachineID()
+	if err != nil {
+		hostname = "unknown"
+	}
+	if environment == "" {
+		environment = "default"
+	}
+	osInfo := utils.GetOSInfo()
+
+	return append(scriptBaseEnv(),
+		"DOTPILOT_DIR="+dotpilotDir,
+		"DOTPILOT_ENV="+environment,
+		"DOTPILOT_HOSTNAME="+hostname,
+		"DOTPILOT_OS="+osInfo.Name,
+		"DOTPILOT_PKG_MANAGER="+osInfo.PackageManager,
+	)
+}
+
+// scriptEnvDropped are the variables of the process environment that scripts
+// don't get: the DOTPILOT_* variables of an outer dotpilot, like one running
+// the hook that runs this dotpilot, which ScriptEnv sets afresh, and the
+// access token for the remote
+var scriptEnvDropped = map[string]bool{
+	"DOTPILOT_DIR":           true,
+	"DOTPILOT_ENV":           true,
+	"DOTPILOT_HOSTNAME":      true,
+	"DOTPILOT_OS":            true,
+	"DOTPILOT_PKG_MANAGER":   true,
+	"DOTPILOT_APPLIED_FILES": true,
+	"DOTPILOT_GIT_TOKEN":     true,
+}
+
+// scriptBaseEnv returns the process environment without scriptEnvDropped
+func scriptBaseEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if !scriptEnvDropped[name] {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// preCommitHook is the hook CommitChanges runs before every commit, relative
+// to the dotpilot repository. Unlike the hooks of the layers it is the same on
+// every machine.
+var preCommitHook = filepath.Join("hooks", "pre-commit")
+
+// noVerify skips the pre-commit hook, see SetNoVerify
+var noVerify bool
+
+// SetNoVerify makes CommitChanges commit without running the pre-commit hook
+func SetNoVerify(skip bool) {
+	noVerify = skip
+}
+
+// runPreCommitHook runs hooks/pre-commit of the repository, if there is one,
+// with the staged repo paths in DOTPILOT_STAGED_FILES, one per line. It
+// returns an error wrapping ErrCommitRejected with the hook's output if the
+// hook fails.
+func runPreCommitHook(dotpilotDir string) error {
+	if noVerify {
+		return nil
+	}
+	hookFile := filepath.Join(dotpilotDir, preCommitHook)
+	if _, err := os.Stat(hookFile); os.IsNotExist(err) {
+		return nil
+	}
+
+	staged, err := GetStagedFiles(dotpilotDir)
+	if err != nil {
+		return err
+	}
+	env := append(ScriptEnv(dotpilotDir, GetConfig().CurrentEnvironment),
+		"DOTPILOT_STAGED_FILES="+strings.Join(staged, "\n"))
+
+	utils.Logger.Debug().Msgf("Running hook: %s", hookFile)
+	var output bytes.Buffer
+	if err := RunShellScript(hookFile, dotpilotDir, env, &output, &output); err != nil {
+		return fmt.Errorf("%w by %s (%v): %s", ErrCommitRejected, preCommitHook, err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestHookEnvironment(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	commonDir := filepath.Join(dotpilotDir, "common")
+	if err := os.MkdirAll(commonDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hook dumps its environment so the test can inspect it
+	outFile := filepath.Join(dotpilotDir, "env.out")
+	hook := "#!/bin/sh\nenv > '" + outFile + "'\n"
+	if err := os.WriteFile(filepath.Join(commonDir, "postpull.sh"), []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Variables of an outer dotpilot and the access token aren't passed on
+	t.Setenv("DOTPILOT_ENV", "stale")
+	t.Setenv("DOTPILOT_GIT_TOKEN", "secret")
+
+	if err := RunHooks(dotpilotDir, "dev", "postpull.sh"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := string(data)
+
+	hostname, _ := os.Hostname()
+	expected := []string{
+		"DOTPILOT_DIR=" + dotpilotDir,
+		"DOTPILOT_ENV=dev",
+		"DOTPILOT_HOSTNAME=" + hostname,
+		"DOTPILOT_OS=",
+		"DOTPILOT_PKG_MANAGER=",
+	}
+	for _, want := range expected {
+		if !strings.Contains(env, want) {
+			t.Errorf("hook environment is missing %q", want)
+		}
+	}
+	for _, unwanted := range []string{"DOTPILOT_ENV=stale", "DOTPILOT_GIT_TOKEN="} {
+		if strings.Contains(env, unwanted) {
+			t.Errorf("hook environment has %q", unwanted)
+		}
+	}
+}
+
+func TestScriptWorkingDirectory(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	writeRepoFile(t, dotpilotDir, "common/postpull.sh", "pwd -P > hook.out\necho \"$PWD\" >> hook.out\n")
+	writeRepoFile(t, dotpilotDir, "common/setup.d/10-cwd.sh", "pwd -P > script.out\n")
+
+	// Wherever dotpilot runs, scripts run in the repository
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RunHooks(dotpilotDir, "dev", "postpull.sh"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunScript(dotpilotDir, "dev", filepath.Join(dotpilotDir, "common", "setup.d", "10-cwd.sh")); err != nil {
+		t.Fatal(err)
+	}
+
+	realDir, err := filepath.EvalSymlinks(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dotpilotDir, "hook.out")); err != nil || string(data) != realDir+"\n"+dotpilotDir+"\n" {
+		t.Errorf("hook ran in %q (%v), want %s", data, err, dotpilotDir)
+	}
+	if data, err := os.ReadFile(filepath.Join(dotpilotDir, "script.out")); err != nil || string(data) != realDir+"\n" {
+		t.Errorf("setup script ran in %q (%v), want %s", data, err, dotpilotDir)
+	}
+}
+
+func TestRunShellScriptInterpreter(t *testing.T) {
+	dir := t.TempDir()
+	outFile := filepath.Join(dir, "out")
+
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		// Without a #! line, bash runs it
+		{"plain.sh", "echo \"${BASH_VERSION:+bash} $DOTPILOT_ENV\" > '" + outFile + "'\n", "bash dev\n"},
+		// An interpreter that isn't at its path is looked up on PATH
+		{"moved.sh", "#!/nonexistent/bin/sh\necho moved > '" + outFile + "'\n", "moved\n"},
+		{"hook.py", "#!/usr/bin/env python3\nimport os\nopen(" + strconv.Quote(outFile) + ", 'w').write('python ' + os.environ['DOTPILOT_ENV'] + '\\n')\n", "python dev\n"},
+	}
+	for _, tt := range tests {
+		if strings.HasSuffix(tt.name, ".py") {
+			if _, err := exec.LookPath("python3"); err != nil {
+				t.Log("python3 isn't installed")
+				continue
+			}
+		}
+
+		// Scripts don't need to be executable
+		script := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(script, []byte(tt.script), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := RunShellScript(script, dir, ScriptEnv(dir, "dev"), nil, nil); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if data, err := os.ReadFile(outFile); err != nil || string(data) != tt.want {
+			t.Errorf("%s wrote %q (%v), want %q", tt.name, data, err, tt.want)
+		}
+	}
+
+	if _, err := ScriptCommand(filepath.Join(dir, "missing.sh")); !os.IsNotExist(err) {
+		t.Errorf("ScriptCommand of a missing script = %v", err)
+	}
+}
+
+func TestPreCommitHook(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "zsh\n")
+	if err := CommitChanges(dotpilotDir, "initial"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetNoVerify(false)
+
+	// The hook rejects a JSON file that doesn't end with a newline
+	hook := "#!/bin/sh\n" +
+		"for f in $DOTPILOT_STAGED_FILES; do\n" +
+		"  if [ -n \"$(tail -c1 \"$f\")\" ]; then echo \"$f: missing newline\"; exit 1; fi\n" +
+		"done\n"
+	writeRepoFile(t, dotpilotDir, "hooks/pre-commit", hook)
+	writeRepoFile(t, dotpilotDir, "common/.config/app.json", "{}")
+
+	err := CommitChanges(dotpilotDir, "Add app.json")
+	if !errors.Is(err, ErrCommitRejected) || !strings.Contains(err.Error(), "common/.config/app.json: missing newline") {
+		t.Fatalf("CommitChanges = %v, want a rejection with the hook's output", err)
+	}
+	if staged, err := GetStagedFiles(dotpilotDir); err != nil || len(staged) != 2 {
+		t.Errorf("staged after the rejection: %v, %v", staged, err)
+	}
+
+	// Fixed, the hook lets the commit through
+	writeRepoFile(t, dotpilotDir, "common/.config/app.json", "{}\n")
+	if err := CommitChanges(dotpilotDir, "Add app.json"); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := HasUncommittedChanges(dotpilotDir); err != nil || changed {
+		t.Errorf("changes left after the commit: %v, %v", changed, err)
+	}
+
+	// --no-verify skips the hook
+	writeRepoFile(t, dotpilotDir, "common/.config/other.json", "{}")
+	SetNoVerify(true)
+	if err := CommitChanges(dotpilotDir, "Add other.json"); err != nil {
+		t.Errorf("CommitChanges with the hook skipped = %v", err)
+	}
+}
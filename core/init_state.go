@@ -0,0 +1,133 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dotpilot/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Interrupted init
+//
+// init clones or creates the repository, adds the origin remote, commits the
+// layer directories and writes ~/.dotpilotrc. When it is interrupted in
+// between, the dotpilot directory exists but isn't usable. InitializeRepo
+// picks up such a directory where it was left instead of starting over, so a
+// finished clone isn't thrown away.
+
+// InitState describes how far init got in the dotpilot directory
+type InitState struct {
+	Exists     bool // The dotpilot directory exists
+	Empty      bool // It has no files at all
+	Repository bool // It holds a git repository
+	Commits    bool // The repository has a commit checked out
+	Remote     bool // The repository has an origin remote
+	Config     bool // ~/.dotpilotrc exists
+}
+
+// CheckInitState returns how far init got in ~/.dotpilot of home
+func CheckInitState(home string) (InitState, error) {
+	var state InitState
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+
+	entries, err := os.ReadDir(dotpilotDir)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	state.Exists = true
+	state.Empty = len(entries) == 0
+
+	if _, err := os.Stat(filepath.Join(home, ".dotpilotrc")); err == nil {
+		state.Config = true
+	}
+
+	repo, err := git.PlainOpen(dotpilotDir)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	state.Repository = true
+	if _, err := repo.Head(); err == nil {
+		state.Commits = true
+	}
+	if _, err := repo.Remote("origin"); err == nil {
+		state.Remote = true
+	}
+	return state, nil
+}
+
+// Complete reports whether init finished
+func (s InitState) Complete() bool {
+	return s.Repository && s.Commits && s.Remote && s.Config
+}
+
+// Resumable reports whether the dotpilot directory was left behind by an
+// interrupted init that InitializeRepo can resume. A directory with files but
+// no repository isn't dotpilot's to touch.
+func (s InitState) Resumable() bool {
+	return s.Exists && !s.Complete() && (s.Repository || s.Empty)
+}
+
+// Missing returns the steps of init that didn't happen
+func (s InitState) Missing() []string {
+	var missing []string
+	if !s.Repository {
+		missing = append(missing, "git repository")
+	}
+	if !s.Commits {
+		missing = append(missing, "initial commit")
+	}
+	if !s.Remote {
+		missing = append(missing, "origin remote")
+	}
+	if !s.Config {
+		missing = append(missing, "~/.dotpilotrc")
+	}
+	return missing
+}
+
+// resumeInit prepares a repository an interrupted init left in dotpilotDir
+// for InitializeRepo to carry on. A repository without commits holds nothing
+// worth keeping and is cleared, so it is cloned again. One with commits gets
+// the origin remote if it is missing; an origin with another URL is an error.
+func resumeInit(dotpilotDir, remoteURL string) error {
+	repo, err := git.PlainOpen(dotpilotDir)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := repo.Head(); errors.Is(err, plumbing.ErrReferenceNotFound) {
+		utils.Logger.Info().Msg("Starting over the repository of the interrupted init, it has no commits")
+		removeDirContents(dotpilotDir)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	remote, err := repo.Remote("origin")
+	if errors.Is(err, git.ErrRemoteNotFound) {
+		utils.Logger.Info().Msgf("Adding the origin remote %s the interrupted init didn't add", remoteURL)
+		_, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{remoteURL}})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if urls := remote.Config().URLs; len(urls) == 0 || urls[0] != remoteURL {
+		return fmt.Errorf("the existing repository in %s has the origin %v, not %s", dotpilotDir, urls, remoteURL)
+	}
+	return nil
+}
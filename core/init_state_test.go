@@ -0,0 +1,85 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestResumeInterruptedInit(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+
+	remoteDir := initMainRemote(t, true)
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	resume := func() {
+		t.Helper()
+		state, err := CheckInitState(home)
+		if err != nil || !state.Resumable() {
+			t.Fatalf("init state = %+v, %v, want resumable", state, err)
+		}
+		if err := InitializeRepo(context.Background(), remoteDir, dotpilotDir, "default", nil, "", 0); err != nil {
+			t.Fatal(err)
+		}
+		if state, err := CheckInitState(home); err != nil || !state.Complete() {
+			t.Fatalf("init state after resuming = %+v, %v", state, err)
+		}
+	}
+
+	// A repository without commits, interrupted before the initial commit,
+	// is cloned again
+	repo, err := git.PlainInit(dotpilotDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "README.md", "partial\n")
+	state, err := CheckInitState(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"initial commit", "origin remote", "~/.dotpilotrc"}; !reflect.DeepEqual(state.Missing(), want) {
+		t.Errorf("missing = %v, want %v", state.Missing(), want)
+	}
+	resume()
+	if _, err := os.Stat(filepath.Join(dotpilotDir, "common", ".zshrc")); err != nil {
+		t.Fatalf("the remote wasn't cloned: %v", err)
+	}
+
+	// A clone interrupted before writing the config and adding the remote
+	// keeps what it has
+	writeRepoFile(t, dotpilotDir, "common/.vimrc", "local\n")
+	if err := os.Remove(filepath.Join(home, ".dotpilotrc")); err != nil {
+		t.Fatal(err)
+	}
+	if repo, err = git.PlainOpen(dotpilotDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.DeleteRemote("origin"); err != nil {
+		t.Fatal(err)
+	}
+	resume()
+	if data, err := os.ReadFile(filepath.Join(dotpilotDir, "common", ".vimrc")); err != nil || string(data) != "local\n" {
+		t.Errorf("resuming lost the clone: %q (%v)", data, err)
+	}
+
+	// Another origin or a directory with other files isn't resumed
+	if err := os.Remove(filepath.Join(home, ".dotpilotrc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitializeRepo(context.Background(), t.TempDir(), dotpilotDir, "default", nil, "", 0); err == nil {
+		t.Error("resuming with another remote succeeded")
+	}
+	if err := os.RemoveAll(filepath.Join(dotpilotDir, ".git")); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := CheckInitState(home); err != nil || state.Resumable() {
+		t.Errorf("init state = %+v, %v, want not resumable", state, err)
+	}
+}
@@ -0,0 +1,135 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Disabling layers
+//
+// A layer can be left out without deleting its directory, say the machine
+// layer while debugging. Options["disabled_layers"] in ~/.dotpilotrc lists
+// the layers that stay off, by their name in DefaultLayerOrder, and
+// 'dotpilot layers disable' and 'enable' edit it. --skip-common, --skip-env
+// and --skip-machine turn a layer off for one run, see SetSkippedLayers. A
+// disabled layer is not applied and doesn't count for conflicts or drift;
+// what it linked before is left alone.
+
+const disabledLayersOption = "disabled_layers"
+
+// skippedLayers are the layers turned off for this run, see SetSkippedLayers
+var skippedLayers []string
+
+// SetSkippedLayers turns layers off for the rest of the run, in addition to
+// those Options["disabled_layers"] disables, for flags given on the command
+// line
+func SetSkippedLayers(layers ...string) error {
+	for _, layer := range layers {
+		if err := ValidateLayerName(layer); err != nil {
+			return err
+		}
+	}
+	skippedLayers = layers
+	return nil
+}
+
+// ValidateLayerName checks that layer is one of the layers of
+// DefaultLayerOrder
+func ValidateLayerName(layer string) error {
+	for _, l := range DefaultLayerOrder {
+		if l == layer {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown layer %q, expected one of %s", layer, strings.Join(DefaultLayerOrder, ", "))
+}
+
+// DisabledLayers returns the layers Options["disabled_layers"] in
+// ~/.dotpilotrc turns off
+func DisabledLayers() ([]string, error) {
+	value, ok := GetConfig().Options[disabledLayersOption]
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	var layers []string
+	switch v := value.(type) {
+	case []string:
+		layers = v
+	case []interface{}:
+		for _, item := range v {
+			layer, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid disabled_layers option: %v is not a string", item)
+			}
+			layers = append(layers, layer)
+		}
+	default:
+		return nil, fmt.Errorf(`invalid disabled_layers option: expected a list like ["machine"]`)
+	}
+	for _, layer := range layers {
+		if err := ValidateLayerName(layer); err != nil {
+			return nil, fmt.Errorf("invalid disabled_layers option: %w", err)
+		}
+	}
+	return layers, nil
+}
+
+// LayerDisabled reports whether layer is disabled in ~/.dotpilotrc or
+// skipped for this run
+func LayerDisabled(layer string) (bool, error) {
+	disabled, err := DisabledLayers()
+	if err != nil {
+		return false, err
+	}
+	for _, l := range append(disabled, skippedLayers...) {
+		if l == layer {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SetLayerEnabled turns layer on or off in ~/.dotpilotrc. It reports whether
+// that changed anything.
+func SetLayerEnabled(layer string, enabled bool) (bool, error) {
+	if err := ValidateLayerName(layer); err != nil {
+		return false, err
+	}
+	disabled, err := DisabledLayers()
+	if err != nil {
+		return false, err
+	}
+
+	var layers []string
+	wasDisabled := false
+	for _, l := range disabled {
+		if l == layer {
+			wasDisabled = true
+			continue
+		}
+		layers = append(layers, l)
+	}
+	if wasDisabled != enabled {
+		return false, nil
+	}
+	if !enabled {
+		layers = append(layers, layer)
+	}
+
+	if currentConfig.Options == nil {
+		currentConfig.Options = make(map[string]interface{})
+	}
+	if len(layers) == 0 {
+		delete(currentConfig.Options, disabledLayersOption)
+	} else {
+		currentConfig.Options[disabledLayersOption] = layers
+	}
+
+	home, err := Home()
+	if err != nil {
+		return false, err
+	}
+	return true, SaveConfig(filepath.Join(home, ".dotpilotrc"))
+}
@@ -0,0 +1,79 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestApplyDisabledLayers(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	writeRepoFile(t, dotpilotDir, "common/.bashrc", "common\n")
+	writeRepoFile(t, dotpilotDir, "common/.vimrc", "common\n")
+	writeRepoFile(t, dotpilotDir, "envs/dev/.gitconfig", "dev\n")
+	writeRepoFile(t, dotpilotDir, "machine/"+hostname+"/.vimrc", "machine\n")
+
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+	currentConfig.Options = map[string]interface{}{}
+
+	// Disabling persists the layer in ~/.dotpilotrc
+	if changed, err := SetLayerEnabled("machine", false); err != nil || !changed {
+		t.Fatalf("SetLayerEnabled = %v, %v", changed, err)
+	}
+	if changed, err := SetLayerEnabled("machine", false); err != nil || changed {
+		t.Errorf("disabling twice = %v, %v", changed, err)
+	}
+	if _, err := SetLayerEnabled("users", false); err == nil {
+		t.Error("an unknown layer was disabled")
+	}
+	if err := LoadConfig(filepath.Join(home, ".dotpilotrc")); err != nil {
+		t.Fatal(err)
+	}
+	if disabled, err := DisabledLayers(); err != nil || !reflect.DeepEqual(disabled, []string{"machine"}) {
+		t.Fatalf("DisabledLayers = %q, %v", disabled, err)
+	}
+
+	// The env layer is skipped for this run only
+	if err := SetSkippedLayers("env"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetSkippedLayers()
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "dev", ApplyOptions{QuietShadows: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	commonVimrc := filepath.Join(dotpilotDir, "common", ".vimrc")
+	if link, err := os.Readlink(filepath.Join(home, ".vimrc")); err != nil || link != commonVimrc {
+		t.Errorf(".vimrc links to %q, %v, want %s of the common layer", link, err, commonVimrc)
+	}
+	if _, err := os.Lstat(filepath.Join(home, ".gitconfig")); !os.IsNotExist(err) {
+		t.Errorf("the skipped env layer was applied: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(home, ".bashrc")); err != nil {
+		t.Errorf("the common layer wasn't applied: %v", err)
+	}
+
+	// Enabled again, the machine layer wins
+	if changed, err := SetLayerEnabled("machine", true); err != nil || !changed {
+		t.Fatalf("SetLayerEnabled = %v, %v", changed, err)
+	}
+	if _, ok := GetConfig().Options[disabledLayersOption]; ok {
+		t.Error("the option is left behind with no layer disabled")
+	}
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "dev", ApplyOptions{QuietShadows: true}); err != nil {
+		t.Fatal(err)
+	}
+	machineVimrc := filepath.Join(dotpilotDir, "machine", hostname, ".vimrc")
+	if link, err := os.Readlink(filepath.Join(home, ".vimrc")); err != nil || link != machineVimrc {
+		t.Errorf(".vimrc links to %q, %v, want %s", link, err, machineVimrc)
+	}
+}
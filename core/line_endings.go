@@ -0,0 +1,115 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+
+	"github.com/dotpilot/utils"
+)
+
+// Line endings
+//
+// A dotfile edited on Windows may come back with CRLF line endings while the
+// repository holds LF, or the other way around. With Options["line_endings"]
+// in ~/.dotpilotrc set to "lf", "crlf" or "native", such files count as the
+// same: drift, diffs and conflict detection ignore differences in line
+// endings only, and apply replaces such a target without asking. Files
+// copied into the repository, by track or by keeping the local version of a
+// conflict, are written with those line endings, native being CRLF on
+// Windows and LF elsewhere. Without the option, or with "preserve", files
+// are compared byte by byte and copied as they are. Files with a NUL byte
+// aren't text and are never converted.
+//
+// Git converts line endings itself with `* text=auto` in the .gitattributes
+// of the repository, which stores text files with LF whatever they were
+// committed with.
+
+// Line ending styles of Options["line_endings"]
+const (
+	LineEndingsLF       = "lf"
+	LineEndingsCRLF     = "crlf"
+	LineEndingsNative   = "native"
+	LineEndingsPreserve = "preserve"
+)
+
+// LineEndings returns the line endings files are normalized to,
+// LineEndingsLF or LineEndingsCRLF with native resolved for this system, or
+// "" when they are preserved
+func LineEndings() string {
+	value, _ := GetConfig().Options["line_endings"].(string)
+	switch value {
+	case LineEndingsLF, LineEndingsCRLF:
+		return value
+	case LineEndingsNative:
+		if runtime.GOOS == "windows" {
+			return LineEndingsCRLF
+		}
+		return LineEndingsLF
+	case "", LineEndingsPreserve:
+		return ""
+	}
+	utils.Logger.Warn().Msgf("Ignoring the line_endings option %q, expected lf, crlf, native or preserve", value)
+	return ""
+}
+
+// isText reports whether data looks like text, with no NUL byte
+func isText(data []byte) bool {
+	return bytes.IndexByte(data, 0) < 0
+}
+
+// convertLineEndings returns text data with the line endings of style,
+// LineEndingsLF or LineEndingsCRLF. Anything else leaves data as it is.
+func convertLineEndings(data []byte, style string) []byte {
+	if !isText(data) || (style != LineEndingsLF && style != LineEndingsCRLF) {
+		return data
+	}
+	lf := bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	if style == LineEndingsCRLF {
+		return bytes.ReplaceAll(lf, []byte("\n"), []byte("\r\n"))
+	}
+	return lf
+}
+
+// comparableContent returns data as it is compared and diffed: with LF line
+// endings when the line_endings option is set, see LineEndings
+func comparableContent(data []byte) []byte {
+	if LineEndings() == "" {
+		return data
+	}
+	return convertLineEndings(data, LineEndingsLF)
+}
+
+// sameContent reports whether a and b are the same, apart from their line
+// endings when the line_endings option is set
+func sameContent(a, b []byte) bool {
+	return bytes.Equal(comparableContent(a), comparableContent(b))
+}
+
+// sameFileContent reports whether the files at path1 and path2 have the same
+// content, see sameContent and sameIgnoringWhitespace
+func sameFileContent(path1, path2 string) bool {
+	content1, err := os.ReadFile(path1)
+	if err != nil {
+		return false
+	}
+	content2, err := os.ReadFile(path2)
+	if err != nil {
+		return false
+	}
+	return sameIgnoringWhitespace(content1, content2)
+}
+
+// copyTextFile copies source to destination like copyFile, converting the
+// line endings of a text file when the line_endings option is set
+func copyTextFile(source, destination string, mode os.FileMode) error {
+	style := LineEndings()
+	if style == "" {
+		return copyFile(source, destination, mode)
+	}
+	data, err := os.ReadFile(source)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(destination, convertLineEndings(data, style), mode)
+}
@@ -0,0 +1,99 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConvertLineEndings(t *testing.T) {
+	mixed := []byte("one\r\ntwo\nthree\r\n")
+
+	if got := string(convertLineEndings(mixed, LineEndingsLF)); got != "one\ntwo\nthree\n" {
+		t.Errorf("lf: got %q", got)
+	}
+	if got := string(convertLineEndings(mixed, LineEndingsCRLF)); got != "one\r\ntwo\r\nthree\r\n" {
+		t.Errorf("crlf: got %q", got)
+	}
+	if got := string(convertLineEndings(mixed, "")); got != string(mixed) {
+		t.Errorf("no style: got %q", got)
+	}
+
+	binary := []byte("a\x00\r\nb\n")
+	if got := string(convertLineEndings(binary, LineEndingsLF)); got != string(binary) {
+		t.Errorf("binary file converted to %q", got)
+	}
+}
+
+func TestLineEndingsOption(t *testing.T) {
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+
+	for value, want := range map[string]string{"": "", "preserve": "", "lf": "lf", "crlf": "crlf", "bogus": ""} {
+		currentConfig.Options = map[string]interface{}{"line_endings": value}
+		if got := LineEndings(); got != want {
+			t.Errorf("line_endings %q: got %q, want %q", value, got, want)
+		}
+	}
+	currentConfig.Options = map[string]interface{}{"line_endings": "native"}
+	if got := LineEndings(); got != LineEndingsLF && got != LineEndingsCRLF {
+		t.Errorf("native resolved to %q", got)
+	}
+}
+
+func TestLineEndingsDriftAndConflicts(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+
+	// Same lines, mixed line endings on one side and CRLF on the other
+	writeRepoFile(t, dotpilotDir, "envs/default/.vimrc", "set number\nsyntax on\r\n")
+	if err := os.WriteFile(filepath.Join(home, ".vimrc"), []byte("set number\r\nsyntax on\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A real change stays a change
+	writeRepoFile(t, dotpilotDir, "envs/default/.bashrc", "alias ll='ls -l'\n")
+	if err := os.WriteFile(filepath.Join(home, ".bashrc"), []byte("alias ll='ls -la'\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+	currentConfig.CurrentEnvironment = "default"
+
+	count := func() (drift, conflicts int) {
+		t.Helper()
+		changes, err := LocalDrift(dotpilotDir, "default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := detectConflicts(dotpilotDir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(changes), len(found)
+	}
+
+	currentConfig.Options = map[string]interface{}{"line_endings": "preserve"}
+	if drift, conflicts := count(); drift != 2 || conflicts != 2 {
+		t.Errorf("preserving line endings: %d drifted and %d conflicts, want 2 and 2", drift, conflicts)
+	}
+
+	currentConfig.Options = map[string]interface{}{"line_endings": "lf"}
+	if drift, conflicts := count(); drift != 1 || conflicts != 1 {
+		t.Errorf("normalizing line endings: %d drifted and %d conflicts, want 1 and 1", drift, conflicts)
+	}
+	diff, err := FileDiff(filepath.Join(home, ".vimrc"), filepath.Join(dotpilotDir, "envs", "default", ".vimrc"))
+	if err != nil || diff != "Files are identical" {
+		t.Errorf("FileDiff = %q, %v", diff, err)
+	}
+
+	// Keeping the local version writes it with the configured line endings
+	conflict := ConflictFile{LocalPath: filepath.Join(home, ".bashrc"), RemotePath: filepath.Join(dotpilotDir, "envs", "default", ".bashrc")}
+	if _, err := resolveKeepLocal(conflict); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(conflict.RemotePath); err != nil || string(data) != "alias ll='ls -la'\n" {
+		t.Errorf("kept local version is %q, %v", data, err)
+	}
+}
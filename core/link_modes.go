@@ -0,0 +1,321 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// Link modes
+//
+// Most targets are symlinks into the repository. Programs that resolve
+// symlinks oddly can get a hardlink to the repo file instead, and programs
+// that rewrite their files in place, replacing a link with a plain file, a
+// copy of it. link-modes.json in the root of the repository records the mode
+// of the repo files that aren't symlinked, set with track --link-mode, like
+// {"common/.gitconfig": "copy"}. apply and bootstrap create each target in
+// its mode, see MaterializeFile.
+//
+// A hardlink only works within one filesystem, across filesystems the target
+// is copied instead. Git replaces a repo file on checkout rather than writing
+// into it, so a pull breaks the hardlink and the next apply links the target
+// again. The hash of what was hardlinked or copied to each target is kept in
+// .link-state.json, which is machine-local: a target that still matches it
+// is dotpilot's own and replaced without asking, one that doesn't was changed
+// locally and is treated like any file in the way.
+
+// LinkMode is how a target is made from its repo file
+type LinkMode string
+
+const (
+	LinkSymlink  LinkMode = "symlink"  // A symlink to the repo file, the default
+	LinkHardlink LinkMode = "hardlink" // A hardlink to the repo file, a copy across filesystems
+	LinkCopy     LinkMode = "copy"     // A copy of the repo file
+)
+
+// LinkModes are the link modes in the order they are documented
+var LinkModes = []LinkMode{LinkSymlink, LinkHardlink, LinkCopy}
+
+// linkModesFile records the link modes of repo files. It lives in the root
+// of the dotpilot repository, like file-modes.json.
+const linkModesFile = "link-modes.json"
+
+// linkStateFile records the hash of the hardlinked and copied targets on
+// this machine. It is machine-local and kept out of git.
+const linkStateFile = ".link-state.json"
+
+// sameFilesystem reports whether the files at path1 and path2 are on the same
+// filesystem, replaced in tests
+var sameFilesystem = onSameFilesystem
+
+// ParseLinkMode parses a link mode like "copy"
+func ParseLinkMode(s string) (LinkMode, error) {
+	for _, mode := range LinkModes {
+		if LinkMode(s) == mode {
+			return mode, nil
+		}
+	}
+	var names []string
+	for _, mode := range LinkModes {
+		names = append(names, string(mode))
+	}
+	return "", fmt.Errorf("invalid link mode %q, expected one of %s", s, strings.Join(names, ", "))
+}
+
+// LoadLinkModes reads the recorded link modes from link-modes.json, by
+// slash-separated repo path. A missing file means every file is symlinked.
+func LoadLinkModes(dotpilotDir string) (map[string]LinkMode, error) {
+	data, err := os.ReadFile(filepath.Join(dotpilotDir, linkModesFile))
+	if os.IsNotExist(err) {
+		return map[string]LinkMode{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var recorded map[string]string
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", linkModesFile, err)
+	}
+	modes := make(map[string]LinkMode, len(recorded))
+	for repoPath, value := range recorded {
+		mode, err := ParseLinkMode(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s in %s: %w", repoPath, linkModesFile, err)
+		}
+		modes[repoPath] = mode
+	}
+	return modes, nil
+}
+
+// linkModeOf returns the link mode of the repo file at repoPath in modes,
+// LinkSymlink unless another is recorded
+func linkModeOf(modes map[string]LinkMode, repoPath string) LinkMode {
+	if mode, ok := modes[repoPath]; ok {
+		return mode
+	}
+	return LinkSymlink
+}
+
+// RecordLinkModes records mode for the repo files at paths, and the files
+// below those that are directories, in link-modes.json. LinkSymlink removes
+// them, it is the default. Tracked symlinks are always recreated as links
+// and left out. It returns the repo paths recorded.
+func RecordLinkModes(dotpilotDir string, paths []string, mode LinkMode) ([]string, error) {
+	modes, err := LoadLinkModes(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var recorded []string
+	for _, p := range paths {
+		files, err := filesBelow(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if isSymlinkDescriptor(file) {
+				continue
+			}
+			repoPath, err := RepoPath(dotpilotDir, file)
+			if err != nil {
+				return nil, err
+			}
+			if mode == LinkSymlink {
+				delete(modes, repoPath)
+			} else {
+				modes[repoPath] = mode
+			}
+			recorded = append(recorded, repoPath)
+		}
+	}
+
+	path := filepath.Join(dotpilotDir, linkModesFile)
+	if len(modes) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return recorded, nil
+	}
+	values := make(map[string]string, len(modes))
+	for repoPath, mode := range modes {
+		values[repoPath] = string(mode)
+	}
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	sort.Strings(recorded)
+	return recorded, nil
+}
+
+// MaterializeFile makes target from the repo file repoFile in mode: a
+// symlink, relative if Options["relative_symlinks"] says so, a hardlink or a
+// copy. A file at target is replaced, a directory is not. A hardlink across
+// filesystems, or on a filesystem without them, falls back to a copy with a
+// warning. It returns the mode target was made in. The hash of a hardlinked
+// or copied target is recorded, see unchangedSinceMaterialized.
+func MaterializeFile(repoFile, target string, mode LinkMode) (LinkMode, error) {
+	if mode == "" {
+		mode = LinkSymlink
+	}
+
+	// Made next to target and renamed over it, so target is never missing
+	// or half written
+	tmp := target + ".dotpilot.tmp"
+	os.Remove(tmp)
+	switch mode {
+	case LinkSymlink:
+		utils.Logger.Debug().Msgf("Creating symlink: %s -> %s", target, repoFile)
+		if err := symlink(symlinkContent(target, repoFile, RelativeSymlinks()), tmp); err != nil {
+			return "", err
+		}
+	case LinkHardlink:
+		if same, err := sameFilesystem(repoFile, filepath.Dir(target)); err != nil {
+			return "", err
+		} else if !same {
+			utils.Logger.Warn().Msgf("Copying %s to %s instead of hardlinking it, they are on different filesystems", repoFile, target)
+			mode = LinkCopy
+		} else if err := os.Link(repoFile, tmp); err != nil {
+			utils.Logger.Warn().Err(err).Msgf("Copying %s to %s instead of hardlinking it", repoFile, target)
+			mode = LinkCopy
+		} else {
+			utils.Logger.Debug().Msgf("Creating hardlink: %s -> %s", target, repoFile)
+		}
+	}
+	if mode == LinkCopy {
+		info, err := os.Stat(repoFile)
+		if err != nil {
+			return "", err
+		}
+		utils.Logger.Debug().Msgf("Copying %s to %s", repoFile, target)
+		if err := copyFile(repoFile, tmp, info.Mode().Perm()); err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if mode == LinkSymlink {
+		return mode, nil
+	}
+
+	if hash, err := fileHash(target); err != nil {
+		utils.Logger.Warn().Err(err).Msgf("Failed to hash %s", target)
+	} else if err := recordLinkState(target, hash); err != nil {
+		utils.Logger.Warn().Err(err).Msgf("Failed to record the state of %s", target)
+	}
+	return mode, nil
+}
+
+// materialized reports whether target is already made from repoFile in
+// mode: a hardlink to it, or for a copy a regular file with its content. A
+// hardlink that fell back to a copy counts too.
+func materialized(target, repoFile string, mode LinkMode) bool {
+	info, err := os.Lstat(target)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	if mode == LinkHardlink && resolvesTo(target, repoFile) {
+		return true
+	}
+	if mode != LinkHardlink && mode != LinkCopy {
+		return false
+	}
+	targetContent, err := os.ReadFile(target)
+	if err != nil {
+		return false
+	}
+	repoContent, err := os.ReadFile(repoFile)
+	return err == nil && bytes.Equal(targetContent, repoContent)
+}
+
+// unchangedSinceMaterialized reports whether target still has the content
+// MaterializeFile last hardlinked or copied to it, so replacing it loses
+// nothing. A target that was edited locally doesn't.
+func unchangedSinceMaterialized(target string) bool {
+	state, err := loadLinkState()
+	if err != nil {
+		return false
+	}
+	recorded, ok := state[target]
+	if !ok {
+		return false
+	}
+	hash, err := fileHash(target)
+	return err == nil && hash == recorded
+}
+
+// fileHash returns the hex SHA-256 of the content of the file at path
+func fileHash(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// loadLinkState reads the hashes of the hardlinked and copied targets, by
+// target path. A missing state file means there are none.
+func loadLinkState() (map[string]string, error) {
+	dotpilotDir, err := dotpilotRepoDir()
+	if err != nil {
+		return nil, err
+	}
+	state := make(map[string]string)
+	data, err := os.ReadFile(filepath.Join(dotpilotDir, linkStateFile))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		utils.Logger.Warn().Err(err).Msgf("Ignoring unreadable %s, copied targets will be treated as changed", linkStateFile)
+		return make(map[string]string), nil
+	}
+	return state, nil
+}
+
+// recordLinkState records the hash of target after it was hardlinked or
+// copied and saves the state
+func recordLinkState(target, hash string) error {
+	state, err := loadLinkState()
+	if err != nil {
+		return err
+	}
+	if state[target] == hash {
+		return nil
+	}
+	state[target] = hash
+
+	dotpilotDir, err := dotpilotRepoDir()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dotpilotDir, linkStateFile), append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := excludeLocalFile(dotpilotDir, linkStateFile); err != nil {
+		utils.Logger.Debug().Err(err).Msgf("Failed to exclude %s from git", linkStateFile)
+	}
+	return nil
+}
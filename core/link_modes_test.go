@@ -0,0 +1,209 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// backupsOf returns the backups of original
+func backupsOf(t *testing.T, original string) []string {
+	t.Helper()
+	backups, err := filepath.Glob(original + backupMarker + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backups
+}
+
+func TestMaterializeFile(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	writeRepoFile(t, dotpilotDir, "common/.gitconfig", "[user]\n")
+	repoFile := filepath.Join(dotpilotDir, "common", ".gitconfig")
+
+	for _, mode := range LinkModes {
+		target := filepath.Join(home, "gitconfig-"+string(mode))
+		if err := os.WriteFile(target, []byte("in the way\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		made, err := MaterializeFile(repoFile, target, mode)
+		if err != nil || made != mode {
+			t.Fatalf("MaterializeFile(%s) = %s, %v", mode, made, err)
+		}
+
+		info, err := os.Lstat(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch mode {
+		case LinkSymlink:
+			if !linksTo(target, repoFile) {
+				t.Errorf("%s isn't a link to %s", target, repoFile)
+			}
+		case LinkHardlink:
+			if !info.Mode().IsRegular() || !resolvesTo(target, repoFile) {
+				t.Errorf("%s isn't a hardlink of %s", target, repoFile)
+			}
+		case LinkCopy:
+			if !info.Mode().IsRegular() || resolvesTo(target, repoFile) || !materialized(target, repoFile, LinkCopy) {
+				t.Errorf("%s isn't a copy of %s", target, repoFile)
+			}
+		}
+		if mode != LinkSymlink && !unchangedSinceMaterialized(target) {
+			t.Errorf("the %s %s isn't recorded", mode, target)
+		}
+	}
+
+	// An edited copy no longer matches its recorded hash
+	copied := filepath.Join(home, "gitconfig-copy")
+	if err := os.WriteFile(copied, []byte("[user]\n\tname = me\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if unchangedSinceMaterialized(copied) || materialized(copied, repoFile, LinkCopy) {
+		t.Error("the edited copy counts as unchanged")
+	}
+}
+
+func TestMaterializeFileAcrossFilesystems(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	writeRepoFile(t, dotpilotDir, "common/.bashrc", "export EDITOR=vim\n")
+	repoFile := filepath.Join(dotpilotDir, "common", ".bashrc")
+
+	saved := sameFilesystem
+	defer func() { sameFilesystem = saved }()
+	sameFilesystem = func(path1, path2 string) (bool, error) { return false, nil }
+
+	target := filepath.Join(home, ".bashrc")
+	made, err := MaterializeFile(repoFile, target, LinkHardlink)
+	if err != nil || made != LinkCopy {
+		t.Fatalf("MaterializeFile = %s, %v, want a copy", made, err)
+	}
+	if resolvesTo(target, repoFile) || !materialized(target, repoFile, LinkHardlink) {
+		t.Errorf("%s isn't a copy of %s", target, repoFile)
+	}
+}
+
+func TestApplyLinkModes(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	writeRepoFile(t, dotpilotDir, "common/.inputrc", "set editing-mode vi\n")
+	writeRepoFile(t, dotpilotDir, "common/.config/Code/settings.json", "{}\n")
+	writeRepoFile(t, dotpilotDir, "common/.vimrc", "set nu\n")
+
+	recorded, err := RecordLinkModes(dotpilotDir, []string{filepath.Join(dotpilotDir, "common", ".inputrc")}, LinkHardlink)
+	if err != nil || len(recorded) != 1 {
+		t.Fatalf("RecordLinkModes = %q, %v", recorded, err)
+	}
+	if _, err := RecordLinkModes(dotpilotDir, []string{filepath.Join(dotpilotDir, "common", ".config")}, LinkCopy); err != nil {
+		t.Fatal(err)
+	}
+	modes, err := LoadLinkModes(dotpilotDir)
+	if err != nil || len(modes) != 2 || modes["common/.inputrc"] != LinkHardlink || modes["common/.config/Code/settings.json"] != LinkCopy {
+		t.Fatalf("LoadLinkModes = %v, %v", modes, err)
+	}
+
+	// The vimrc was symlinked before and is a copy now
+	vimrc := filepath.Join(home, ".vimrc")
+	if err := os.Symlink(filepath.Join(dotpilotDir, "common", ".vimrc"), vimrc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RecordLinkModes(dotpilotDir, []string{filepath.Join(dotpilotDir, "common", ".vimrc")}, LinkCopy); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := ApplyOptions{Backup: true, QuietShadows: true}
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", opts); err != nil {
+		t.Fatal(err)
+	}
+	inputrc := filepath.Join(home, ".inputrc")
+	settings := filepath.Join(home, ".config", "Code", "settings.json")
+	if !resolvesTo(inputrc, filepath.Join(dotpilotDir, "common", ".inputrc")) {
+		t.Error(".inputrc isn't hardlinked")
+	}
+	for _, copied := range []string{settings, vimrc} {
+		if info, err := os.Lstat(copied); err != nil || !info.Mode().IsRegular() {
+			t.Errorf("%s isn't a copy: %v", copied, err)
+		}
+	}
+
+	// An unchanged copy is refreshed, an edited one backed up
+	writeRepoFile(t, dotpilotDir, "common/.config/Code/settings.json", `{"editor.fontSize": 14}`+"\n")
+	writeRepoFile(t, dotpilotDir, "common/.vimrc", "set nu rnu\n")
+	if err := os.WriteFile(vimrc, []byte("set nu\nset list\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", opts); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(settings); err != nil || !strings.Contains(string(data), "fontSize") {
+		t.Errorf("settings.json = %q, %v, want the new version", data, err)
+	}
+	if data, err := os.ReadFile(vimrc); err != nil || string(data) != "set nu rnu\n" {
+		t.Errorf(".vimrc = %q, %v", data, err)
+	}
+	if backups := backupsOf(t, vimrc); len(backups) != 1 {
+		t.Fatalf("backups of the edited .vimrc: %v", backups)
+	}
+	if backups := backupsOf(t, settings); len(backups) != 0 {
+		t.Errorf("the unchanged copy was backed up: %v", backups)
+	}
+
+	// Bootstrap applies the modes too, it leaves out hidden files
+	writeRepoFile(t, dotpilotDir, "common/tool.conf", "setting = 1\n")
+	toolConf := filepath.Join(dotpilotDir, "common", "tool.conf")
+	if _, err := RecordLinkModes(dotpilotDir, []string{toolConf}, LinkCopy); err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	linked, _, err := ApplyDirectoryConfigsWithOptions(filepath.Join(dotpilotDir, "common"), target, DirectoryApplyOptions{ForceOverwrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(linked) != 1 || !materialized(filepath.Join(target, "tool.conf"), toolConf, LinkCopy) {
+		t.Errorf("bootstrap made %q, want a copy of tool.conf", linked)
+	}
+
+	// Back to a symlink
+	if _, err := RecordLinkModes(dotpilotDir, []string{filepath.Join(dotpilotDir, "common")}, LinkSymlink); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dotpilotDir, linkModesFile)); !os.IsNotExist(err) {
+		t.Errorf("%s is left behind without link modes: %v", linkModesFile, err)
+	}
+}
+
+func TestTrackLinkMode(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if err := os.MkdirAll(dotpilotDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []LinkMode{LinkHardlink, LinkCopy} {
+		source := filepath.Join(home, ".tool-"+string(mode))
+		if err := os.WriteFile(source, []byte("mode = "+string(mode)+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		destination := filepath.Join(dotpilotDir, "common", ".tool-"+string(mode))
+		if _, err := TrackFileWithOptions(source, destination, dotpilotDir, TrackOptions{LinkMode: mode}); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Lstat(source)
+		if err != nil || !info.Mode().IsRegular() {
+			t.Fatalf("%s was replaced by %v, %v", source, info.Mode(), err)
+		}
+		if resolvesTo(source, destination) != (mode == LinkHardlink) || !materialized(source, destination, mode) {
+			t.Errorf("%s isn't a %s of %s", source, mode, destination)
+		}
+		if backups := backupsOf(t, source); len(backups) != 1 {
+			t.Errorf("backups of %s: %v", source, backups)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build windows
+
+package core
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// onSameFilesystem reports whether the files at path1 and path2 are on the
+// same volume. Hardlinks that fail anyway fall back to a copy.
+func onSameFilesystem(path1, path2 string) (bool, error) {
+	return strings.EqualFold(filepath.VolumeName(path1), filepath.VolumeName(path2)), nil
+}
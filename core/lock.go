@@ -0,0 +1,114 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// lockFileName is the lock file inside ~/.dotpilot. It is machine-local and
+// kept out of git.
+const lockFileName = ".lock"
+
+// errLockHeld is returned by lockFile when another process holds the lock
+var errLockHeld = errors.New("lock is held by another process")
+
+// Lock is the exclusive lock a mutating dotpilot command holds on the
+// repository, so two commands, like a sync from cron and a track from the
+// shell, can't modify it at the same time. The operating system releases it
+// when the process exits, so a crashed command doesn't leave it behind.
+type Lock struct {
+	file *os.File
+}
+
+// LockPath returns the path of the repository lock file
+func LockPath(home string) string {
+	return filepath.Join(home, ".dotpilot", lockFileName)
+}
+
+// AcquireLock takes the repository lock without waiting. It returns an error
+// matching ErrLocked, naming the process holding the lock, if another
+// dotpilot operation is in progress.
+func AcquireLock(home string) (*Lock, error) {
+	path := LockPath(home)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockFile(file); err != nil {
+		file.Close()
+		if errors.Is(err, errLockHeld) {
+			return nil, lockedError(path)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	// Record who holds the lock for the error other commands report
+	owner := fmt.Sprintf("%d %s\n", os.Getpid(), commandLine())
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(owner), 0)
+	}
+
+	if err := excludeLocalFile(filepath.Dir(path), lockFileName); err != nil {
+		utils.Logger.Debug().Err(err).Msg("Failed to exclude the lock file from git")
+	}
+
+	return &Lock{file: file}, nil
+}
+
+// Release gives up the lock. The lock file is left in place, removing it
+// would let another process lock a new file while this one is still open.
+func (l *Lock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	l.file.Truncate(0)
+	err := unlockFile(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file = nil
+	return err
+}
+
+// ForceUnlock removes the lock file, for a lock held by a dotpilot process
+// that hangs. Commands started afterwards lock a new file, so only use it
+// when the process holding the lock is no longer doing any work.
+func ForceUnlock(home string) error {
+	path := LockPath(home)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	utils.Logger.Warn().Msgf("Removed the lock file %s", path)
+	return nil
+}
+
+// lockedError returns ErrLocked with the process recorded in the lock file
+func lockedError(path string) error {
+	data, err := ioutil.ReadFile(path)
+	owner := strings.TrimSpace(string(data))
+	if err != nil || owner == "" {
+		return ErrLocked
+	}
+
+	pid, command, _ := strings.Cut(owner, " ")
+	return fmt.Errorf("%w (pid %s: %s)", ErrLocked, pid, command)
+}
+
+// commandLine returns how this process was invoked, e.g. "dotpilot sync"
+func commandLine() string {
+	if len(os.Args) == 0 {
+		return "dotpilot"
+	}
+	return strings.Join(append([]string{filepath.Base(os.Args[0])}, os.Args[1:]...), " ")
+}
@@ -0,0 +1,55 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAcquireLock(t *testing.T) {
+	home := t.TempDir()
+
+	lock, err := AcquireLock(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second command is turned away and told who holds the lock
+	_, err = AcquireLock(home)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("second AcquireLock() = %v, want ErrLocked", err)
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid())) {
+		t.Errorf("error %q doesn't name the process holding the lock", err)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	lock, err = AcquireLock(home)
+	if err != nil {
+		t.Fatalf("AcquireLock() after Release() = %v", err)
+	}
+	defer lock.Release()
+}
+
+func TestForceUnlock(t *testing.T) {
+	home := t.TempDir()
+
+	stuck, err := AcquireLock(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Release()
+
+	if err := ForceUnlock(home); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := AcquireLock(home)
+	if err != nil {
+		t.Fatalf("AcquireLock() after ForceUnlock() = %v", err)
+	}
+	defer lock.Release()
+}
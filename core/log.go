@@ -0,0 +1,151 @@
+package core
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/utils/merkletrie"
+)
+
+// LogOptions configures Log
+type LogOptions struct {
+	Limit int // Maximum number of commits, 0 for all
+	// Files computes the files each commit changed, which needs a tree diff
+	// per commit
+	Files bool
+}
+
+// LogEntry is a commit of the dotfiles history
+type LogEntry struct {
+	Hash    string    `json:"hash"`
+	Author  string    `json:"author"`
+	Email   string    `json:"email"`
+	When    time.Time `json:"date"`
+	Subject string    `json:"subject"`
+	Message string    `json:"message"`
+	// Files are the files the commit changed compared to its first parent,
+	// only set with LogOptions.Files
+	Files []LogFile `json:"files,omitempty"`
+}
+
+// LogFile is a file changed by a commit
+type LogFile struct {
+	// Path is slash-separated and relative to the dotpilot directory, or to
+	// the repository root for files outside it in monorepo mode
+	Path   string `json:"path"`
+	Action string `json:"action"` // added, modified or deleted
+}
+
+// Log returns the commits reachable from HEAD, newest first. A repository
+// without commits has an empty log.
+func Log(dotpilotDir string, opts LogOptions) ([]LogEntry, error) {
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		// No commits yet
+		return nil, nil
+	}
+	prefix, err := repoPrefix(repo, dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := logFrom(repo, head.Hash(), git.LogOrderDFS)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var entries []LogEntry
+	err = iter.ForEach(func(c *object.Commit) error {
+		if opts.Limit > 0 && len(entries) >= opts.Limit {
+			return storer.ErrStop
+		}
+
+		message := strings.TrimSpace(c.Message)
+		entry := LogEntry{
+			Hash:    c.Hash.String(),
+			Author:  c.Author.Name,
+			Email:   c.Author.Email,
+			When:    c.Author.When,
+			Subject: strings.SplitN(message, "\n", 2)[0],
+			Message: message,
+		}
+		if opts.Files {
+			files, err := commitFiles(c, prefix)
+			if err != nil {
+				return err
+			}
+			entry.Files = files
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil && !errors.Is(err, storer.ErrStop) {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// commitFiles returns the files c changed compared to its first parent, or
+// all of its files for a root commit, sorted by path. The oldest commits of a
+// shallow clone don't have their parent, so nothing is known about their
+// changes and it returns nil.
+func commitFiles(c *object.Commit, prefix string) ([]LogFile, error) {
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, err
+	}
+	var parentTree *object.Tree
+	if c.NumParents() > 0 {
+		parent, err := c.Parent(0)
+		if errors.Is(err, plumbing.ErrObjectNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if parentTree, err = parent.Tree(); err != nil {
+			return nil, err
+		}
+	}
+
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]LogFile, 0, len(changes))
+	for _, change := range changes {
+		action, err := change.Action()
+		if err != nil {
+			return nil, err
+		}
+		name := change.To.Name
+		file := LogFile{Path: name, Action: "modified"}
+		switch action {
+		case merkletrie.Insert:
+			file.Action = "added"
+		case merkletrie.Delete:
+			file.Action = "deleted"
+			name = change.From.Name
+		}
+		if relPath, ok := trimRepoPrefix(prefix, name); ok {
+			file.Path = relPath
+		} else {
+			file.Path = name
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
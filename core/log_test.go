@@ -0,0 +1,77 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestLog(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Empty repositories have an empty log
+	if entries, err := Log(dotpilotDir, LogOptions{}); err != nil || len(entries) != 0 {
+		t.Fatalf("Log() of an empty repository = %v, %v", entries, err)
+	}
+
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "zsh\n")
+	writeRepoFile(t, dotpilotDir, "common/.vimrc", "vim\n")
+	if err := CommitChanges(dotpilotDir, "Add zshrc and vimrc"); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "zsh 2\n")
+	writeRepoFile(t, dotpilotDir, "envs/dev/.gitconfig", "git\n")
+	if err := os.Remove(filepath.Join(dotpilotDir, "common", ".vimrc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := CommitChanges(dotpilotDir, "Rework\n\nMove things around"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without Files, no tree diffs are made
+	entries, err := Log(dotpilotDir, LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Subject != "Rework" || entries[1].Subject != "Add zshrc and vimrc" {
+		t.Fatalf("Log() = %+v, want both commits newest first", entries)
+	}
+	if entries[0].Message != "Rework\n\nMove things around" || entries[0].Files != nil {
+		t.Errorf("Log() newest = %+v", entries[0])
+	}
+
+	entries, err = Log(dotpilotDir, LogOptions{Limit: 1, Files: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Log(Limit: 1) returned %d commits", len(entries))
+	}
+	want := []LogFile{
+		{Path: "common/.vimrc", Action: "deleted"},
+		{Path: "common/.zshrc", Action: "modified"},
+		{Path: "envs/dev/.gitconfig", Action: "added"},
+	}
+	if !reflect.DeepEqual(entries[0].Files, want) {
+		t.Errorf("files = %+v, want %+v", entries[0].Files, want)
+	}
+
+	// The root commit lists all of its files as added
+	entries, err = Log(dotpilotDir, LogOptions{Files: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []LogFile{
+		{Path: "common/.vimrc", Action: "added"},
+		{Path: "common/.zshrc", Action: "added"},
+	}
+	if !reflect.DeepEqual(entries[1].Files, want) {
+		t.Errorf("root commit files = %+v, want %+v", entries[1].Files, want)
+	}
+}
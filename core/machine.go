@@ -0,0 +1,124 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// machineFingerprintFile is the name of the fingerprint file in a
+// machine/<hostname>/ layer. It describes the layer and is never applied.
+const machineFingerprintFile = "machine.json"
+
+// MachineFingerprint describes the system a machine/<hostname>/ layer was
+// written for. Empty fields match any system.
+type MachineFingerprint struct {
+	Hostname string `json:"hostname,omitempty"`
+	OS       string `json:"os,omitempty"`
+	Arch     string `json:"arch,omitempty"`
+}
+
+// CurrentMachineFingerprint returns the fingerprint of this system
+func CurrentMachineFingerprint() (MachineFingerprint, error) {
+	hostname, err := MachineID()
+	if err != nil {
+		return MachineFingerprint{}, err
+	}
+	return MachineFingerprint{Hostname: hostname, OS: runtime.GOOS, Arch: runtime.GOARCH}, nil
+}
+
+// Mismatches lists the fields of the fingerprint that conflict with current
+func (f MachineFingerprint) Mismatches(current MachineFingerprint) []string {
+	var mismatches []string
+	check := func(field, want, got string) {
+		if want != "" && !strings.EqualFold(want, got) {
+			mismatches = append(mismatches, fmt.Sprintf("%s is %s, expected %s", field, got, want))
+		}
+	}
+	check("hostname", f.Hostname, current.Hostname)
+	check("os", f.OS, current.OS)
+	check("arch", f.Arch, current.Arch)
+	return mismatches
+}
+
+// LoadMachineFingerprint reads the fingerprint of a machine layer. It returns
+// nil if the layer has no fingerprint.
+func LoadMachineFingerprint(machineDir string) (*MachineFingerprint, error) {
+	data, err := os.ReadFile(filepath.Join(machineDir, machineFingerprintFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var fingerprint MachineFingerprint
+	if err := json.Unmarshal(data, &fingerprint); err != nil {
+		return nil, fmt.Errorf("invalid %s in %s: %w", machineFingerprintFile, machineDir, err)
+	}
+	return &fingerprint, nil
+}
+
+// WriteMachineFingerprint records the fingerprint of this system in the
+// machine layer of the current hostname and returns the path of the file
+func WriteMachineFingerprint(dotpilotDir string) (string, error) {
+	fingerprint, err := CurrentMachineFingerprint()
+	if err != nil {
+		return "", err
+	}
+
+	machineDir := filepath.Join(dotpilotDir, "machine", fingerprint.Hostname)
+	if err := os.MkdirAll(machineDir, 0755); err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(fingerprint, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	fingerprintPath := filepath.Join(machineDir, machineFingerprintFile)
+	if err := os.WriteFile(fingerprintPath, append(data, '\n'), 0644); err != nil {
+		return "", err
+	}
+	return fingerprintPath, nil
+}
+
+// MachineLayerAllowed reports whether a machine layer may be applied on this
+// system. With the machine_guard option disabled, or without a fingerprint in
+// the layer, every layer is allowed. A layer whose fingerprint conflicts with
+// this system is refused with a warning.
+func MachineLayerAllowed(machineDir string) (bool, error) {
+	if !currentConfig.MachineGuard {
+		return true, nil
+	}
+
+	fingerprint, err := LoadMachineFingerprint(machineDir)
+	if err != nil || fingerprint == nil {
+		return err == nil, err
+	}
+
+	current, err := CurrentMachineFingerprint()
+	if err != nil {
+		return false, err
+	}
+
+	if mismatches := fingerprint.Mismatches(current); len(mismatches) > 0 {
+		utils.Logger.Warn().Msgf("Skipping %s, it was written for another machine: %s", machineDir, strings.Join(mismatches, ", "))
+		return false, nil
+	}
+	return true, nil
+}
+
+// isMachineFingerprint reports whether a slash-separated repo path is the
+// fingerprint file of a machine layer
+func isMachineFingerprint(repoPath string) bool {
+	parts := strings.Split(path.Clean(repoPath), "/")
+	return len(parts) == 3 && parts[0] == "machine" && parts[2] == machineFingerprintFile
+}
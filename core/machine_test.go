@@ -0,0 +1,84 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMachineGuard(t *testing.T) {
+	current, err := CurrentMachineFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		fingerprint MachineFingerprint
+		applied     bool
+	}{
+		{"matching", current, true},
+		{"os only", MachineFingerprint{OS: current.OS}, true},
+		{"other os", MachineFingerprint{Hostname: current.Hostname, OS: "plan9", Arch: current.Arch}, false},
+		{"other arch", MachineFingerprint{OS: current.OS, Arch: "mips"}, false},
+	}
+
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+	currentConfig.MachineGuard = true
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+
+			dotpilotDir := filepath.Join(home, ".dotpilot")
+			machineDir := filepath.Join(dotpilotDir, "machine", current.Hostname)
+			if err := os.MkdirAll(machineDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(machineDir, ".machinerc"), []byte("machine\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			data, err := json.Marshal(tt.fingerprint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(machineDir, machineFingerprintFile), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = os.Lstat(filepath.Join(home, ".machinerc"))
+			if applied := err == nil; applied != tt.applied {
+				t.Errorf(".machinerc applied = %v, want %v", applied, tt.applied)
+			}
+
+			// The fingerprint itself is never linked into home
+			if _, err := os.Lstat(filepath.Join(home, machineFingerprintFile)); !os.IsNotExist(err) {
+				t.Errorf("%s was linked into home", machineFingerprintFile)
+			}
+		})
+	}
+}
+
+func TestMachineGuardDisabled(t *testing.T) {
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+	currentConfig.MachineGuard = false
+
+	machineDir := t.TempDir()
+	data := []byte(`{"os": "plan9"}`)
+	if err := os.WriteFile(filepath.Join(machineDir, machineFingerprintFile), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	allowed, err := MachineLayerAllowed(machineDir)
+	if err != nil || !allowed {
+		t.Errorf("MachineLayerAllowed = %v, %v, want true without machine_guard", allowed, err)
+	}
+}
@@ -0,0 +1,161 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Migrations
+//
+// Repositories created by older versions of dotpilot lack what newer ones
+// rely on, like the managed .gitignore or the secret metadata index. The
+// layout version of a repository is recorded in .dotpilot-version in its
+// root, and 'dotpilot migrate' runs the migrations above it in order. Each
+// migration checks what is there before changing it, so running one again,
+// or on a repository that already has what it adds, changes nothing. A
+// repository without the file is at version 0; one created by init is at
+// the latest version.
+
+// layoutVersionFile records the layout version of the repository
+const layoutVersionFile = ".dotpilot-version"
+
+// Migration brings a repository from the layout version before it to Version
+type Migration struct {
+	Version     int
+	Description string
+	// run makes the changes, or only reports them with dryRun
+	run func(dotpilotDir string, dryRun bool) ([]string, error)
+}
+
+// migrations are the migrations in order, Version is their position counting
+// from 1
+var migrations = []Migration{
+	{Version: 1, Description: "Add the dotpilot entries to .gitignore", run: migrateGitignore},
+	{Version: 2, Description: "Index the secrets added before the metadata index", run: migrateSecretIndex},
+}
+
+// LatestLayoutVersion is the layout version this dotpilot creates
+func LatestLayoutVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// LayoutVersion returns the layout version of the repository, 0 if it has no
+// .dotpilot-version
+func LayoutVersion(dotpilotDir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dotpilotDir, layoutVersionFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("invalid %s: %q", layoutVersionFile, bytes.TrimSpace(data))
+	}
+	return version, nil
+}
+
+// writeLayoutVersion records version as the layout version of the repository
+func writeLayoutVersion(dotpilotDir string, version int) error {
+	return os.WriteFile(filepath.Join(dotpilotDir, layoutVersionFile), []byte(strconv.Itoa(version)+"\n"), 0644)
+}
+
+// PendingMigrations returns the migrations the repository needs, in order. It
+// returns an error wrapping ErrLayoutTooNew for a repository migrated by a
+// newer dotpilot.
+func PendingMigrations(dotpilotDir string) ([]Migration, error) {
+	version, err := LayoutVersion(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	if version > LatestLayoutVersion() {
+		return nil, fmt.Errorf("%w: version %d, this dotpilot knows up to %d", ErrLayoutTooNew, version, LatestLayoutVersion())
+	}
+	return migrations[version:], nil
+}
+
+// Run applies the migration to the repository and records its version,
+// returning what it changed. With dryRun it only returns what it would change.
+func (m Migration) Run(dotpilotDir string, dryRun bool) ([]string, error) {
+	changes, err := m.run(dotpilotDir, dryRun)
+	if err != nil || dryRun {
+		return changes, err
+	}
+	return changes, writeLayoutVersion(dotpilotDir, m.Version)
+}
+
+// migrateGitignore adds the managed block to the .gitignore
+func migrateGitignore(dotpilotDir string, dryRun bool) ([]string, error) {
+	existing, content, err := managedGitignore(filepath.Join(dotpilotDir, gitignoreFile))
+	if err != nil || bytes.Equal(existing, content) {
+		return nil, err
+	}
+	change := "Updated the dotpilot entries of " + gitignoreFile
+	if existing == nil {
+		change = "Created " + gitignoreFile
+	}
+	if !dryRun {
+		if _, err := EnsureGitignore(dotpilotDir); err != nil {
+			return nil, err
+		}
+	}
+	return []string{change}, nil
+}
+
+// migrateSecretIndex adds the secrets without an entry in the metadata index
+// of their directory to it, with what can be inferred from their blobs
+func migrateSecretIndex(dotpilotDir string, dryRun bool) ([]string, error) {
+	stores := []struct {
+		secretsDir   string
+		inferBackend func(path string) string
+	}{
+		{filepath.Join(dotpilotDir, "secrets"), inferSecretBackend},
+		{filepath.Join(dotpilotDir, "sops-secrets"), func(string) string { return BackendSops }},
+	}
+
+	var changes []string
+	for _, store := range stores {
+		secretsDir := store.secretsDir
+		environments, err := secretEnvironments(secretsDir)
+		if err != nil {
+			return nil, err
+		}
+		dirs := []string{secretsDir}
+		for _, environment := range environments {
+			dirs = append(dirs, secretScopeDir(secretsDir, environment))
+		}
+
+		for _, dir := range dirs {
+			index, err := loadSecretIndex(dir)
+			if err != nil {
+				return nil, err
+			}
+			secrets, err := listSecretMetadata(dir, store.inferBackend)
+			if err != nil {
+				return nil, err
+			}
+
+			added := false
+			for _, meta := range secrets {
+				if _, ok := index[meta.Name]; ok {
+					continue
+				}
+				index[meta.Name] = meta
+				added = true
+				relPath, _ := filepath.Rel(dotpilotDir, filepath.Join(dir, meta.Name))
+				changes = append(changes, fmt.Sprintf("Indexed %s (%s)", filepath.ToSlash(relPath), meta.Backend))
+			}
+			if added && !dryRun {
+				if err := saveSecretIndex(dir, index); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,66 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	writeRepoFile(t, dotpilotDir, "common/.bashrc", "export EDITOR=vim\n")
+	writeRepoFile(t, dotpilotDir, "secrets/token", "blob")
+	writeRepoFile(t, dotpilotDir, "sops-secrets/envs/work/api_key", "sops blob")
+
+	pending, err := PendingMigrations(dotpilotDir)
+	if err != nil || len(pending) != LatestLayoutVersion() {
+		t.Fatalf("pending = %v, %v, want every migration", pending, err)
+	}
+
+	// A dry run reports the changes without making them
+	for _, migration := range pending {
+		changes, err := migration.Run(dotpilotDir, true)
+		if err != nil || len(changes) == 0 {
+			t.Errorf("dry run of %q = %q, %v", migration.Description, changes, err)
+		}
+	}
+	for _, name := range []string{gitignoreFile, layoutVersionFile, "secrets/" + secretIndexFile} {
+		if _, err := os.Stat(filepath.Join(dotpilotDir, name)); !os.IsNotExist(err) {
+			t.Errorf("the dry run created %s", name)
+		}
+	}
+
+	for _, migration := range pending {
+		if _, err := migration.Run(dotpilotDir, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if version, err := LayoutVersion(dotpilotDir); err != nil || version != LatestLayoutVersion() {
+		t.Errorf("layout version = %d, %v", version, err)
+	}
+	if index, err := loadSecretIndex(filepath.Join(dotpilotDir, "secrets")); err != nil || index["token"].Backend != BackendAES || index["token"].SHA256 == "" {
+		t.Errorf("secrets index = %v, %v", index, err)
+	}
+	if index, err := loadSecretIndex(filepath.Join(dotpilotDir, "sops-secrets", "envs", "work")); err != nil || index["api_key"].Backend != BackendSops {
+		t.Errorf("sops index of work = %v, %v", index, err)
+	}
+
+	// Nothing is left to do, and running the migrations again changes nothing
+	if pending, err := PendingMigrations(dotpilotDir); err != nil || len(pending) != 0 {
+		t.Errorf("pending after migrating = %v, %v", pending, err)
+	}
+	for _, migration := range migrations {
+		if changes, err := migration.Run(dotpilotDir, false); err != nil || len(changes) != 0 {
+			t.Errorf("running %q again = %q, %v", migration.Description, changes, err)
+		}
+	}
+
+	// A newer dotpilot migrated the repository
+	if err := writeLayoutVersion(dotpilotDir, LatestLayoutVersion()+1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PendingMigrations(dotpilotDir); !errors.Is(err, ErrLayoutTooNew) {
+		t.Errorf("pending of a newer layout = %v, want ErrLayoutTooNew", err)
+	}
+}
@@ -1,16 +1,21 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/dotpilot/utils"
 )
 
-// InstallPackages installs packages based on the environment and OS
-func InstallPackages(dotpilotDir, environment, overridePackageSystem string) error {
+// InstallPackages installs packages based on the environment and OS. Package
+// files that haven't changed since their last successful install are skipped,
+// and of a changed file only the packages not installed before are installed,
+// unless force is set.
+func InstallPackages(dotpilotDir, environment, overridePackageSystem string, force bool) error {
 	// Get OS info
 	osInfo := utils.GetOSInfo()
 	packageSystem := osInfo.PackageManager
@@ -22,45 +27,20 @@ func InstallPackages(dotpilotDir, environment, overridePackageSystem string) err
 
 	utils.Logger.Info().Msgf("Detected OS: %s, Package System: %s", osInfo.Name, packageSystem)
 
-	// Get package files in order:
-	// 1. Common
-	// 2. Environment-specific
-	// 3. Machine-specific
-
-	// Get hostname
-	hostname, err := os.Hostname()
+	packageFiles, err := packageFilesFor(dotpilotDir, environment, packageSystem)
 	if err != nil {
 		return err
 	}
 
-	// Define package file names based on package system
-	var packageFiles []string
-	switch packageSystem {
-	case "apt":
-		packageFiles = append(packageFiles, filepath.Join(dotpilotDir, "common", "packages.apt"))
-		if environment != "" {
-			packageFiles = append(packageFiles, filepath.Join(dotpilotDir, "envs", environment, "packages.apt"))
-		}
-		packageFiles = append(packageFiles, filepath.Join(dotpilotDir, "machine", hostname, "packages.apt"))
-	case "brew":
-		packageFiles = append(packageFiles, filepath.Join(dotpilotDir, "common", "packages.brew"))
-		if environment != "" {
-			packageFiles = append(packageFiles, filepath.Join(dotpilotDir, "envs", environment, "packages.brew"))
-		}
-		packageFiles = append(packageFiles, filepath.Join(dotpilotDir, "machine", hostname, "packages.brew"))
-	case "yay":
-		packageFiles = append(packageFiles, filepath.Join(dotpilotDir, "common", "packages.yay"))
-		if environment != "" {
-			packageFiles = append(packageFiles, filepath.Join(dotpilotDir, "envs", environment, "packages.yay"))
-		}
-		packageFiles = append(packageFiles, filepath.Join(dotpilotDir, "machine", hostname, "packages.yay"))
-	default:
-		return fmt.Errorf("unsupported package system: %s", packageSystem)
+	state, err := loadPackageState(dotpilotDir)
+	if err != nil {
+		return err
 	}
 
 	// Read package files and install packages
+	env := ScriptEnv(dotpilotDir, environment)
 	for _, packageFile := range packageFiles {
-		if err := installPackagesFromFile(packageFile, packageSystem); err != nil {
+		if err := installPackageFile(dotpilotDir, packageFile, packageSystem, env, state, force); err != nil {
 			return err
 		}
 	}
@@ -68,36 +48,113 @@ func InstallPackages(dotpilotDir, environment, overridePackageSystem string) err
 	return nil
 }
 
-// installPackagesFromFile installs packages from a file
-func installPackagesFromFile(packageFile, packageSystem string) error {
+// packageFilesFor returns the package files of a package system in the order
+// they are installed:
+// 1. Common
+// 2. Environment-specific
+// 3. Machine-specific
+func packageFilesFor(dotpilotDir, environment, packageSystem string) ([]string, error) {
+	switch packageSystem {
+	case "apt", "brew", "yay":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedPackageSystem, packageSystem)
+	}
+
+	// Get hostname
+	hostname, err := MachineID()
+	if err != nil {
+		return nil, err
+	}
+
+	name := "packages." + packageSystem
+	packageFiles := []string{filepath.Join(dotpilotDir, "common", name)}
+	if environment != "" {
+		packageFiles = append(packageFiles, filepath.Join(dotpilotDir, "envs", environment, name))
+	}
+	packageFiles = append(packageFiles, filepath.Join(dotpilotDir, "machine", hostname, name))
+
+	return packageFiles, nil
+}
+
+// installPackageFile installs the packages of packageFile that state doesn't
+// record as installed, and records the file once they are
+func installPackageFile(dotpilotDir, packageFile, packageSystem string, env []string, state *PackageState, force bool) error {
 	// Check if package file exists
-	if _, err := os.Stat(packageFile); os.IsNotExist(err) {
+	data, err := os.ReadFile(packageFile)
+	if os.IsNotExist(err) {
 		utils.Logger.Debug().Msgf("Package file does not exist: %s", packageFile)
 		return nil
 	}
+	if err != nil {
+		return err
+	}
 
-	// Read package file
-	data, err := os.ReadFile(packageFile)
+	repoPath, err := RepoPath(dotpilotDir, packageFile)
 	if err != nil {
 		return err
 	}
 
-	// Parse packages
-	lines := strings.Split(string(data), "\n")
+	hash := packageFileHash(data)
+	previous, known := state.Files[repoPath]
+	if known && !force && previous.SHA256 == hash && previous.PackageSystem == packageSystem {
+		utils.Logger.Info().Msgf("Skipping %s (unchanged since the last install)", packageFile)
+		return nil
+	}
+
+	packages := parsePackages(data)
+	toInstall := packages
+	if known && !force && previous.PackageSystem == packageSystem {
+		toInstall = newPackages(packages, previous.Installed)
+	}
+
+	if len(toInstall) == 0 {
+		utils.Logger.Debug().Msgf("No packages to install from %s", packageFile)
+	} else if err := installPackagesFromFile(packageFile, toInstall, packageSystem, env); err != nil {
+		return err
+	}
+
+	return state.record(dotpilotDir, repoPath, PackageFileState{
+		SHA256:        hash,
+		PackageSystem: packageSystem,
+		Installed:     packages,
+		Updated:       time.Now().UTC().Truncate(time.Second),
+	})
+}
+
+// parsePackages returns the packages listed in a package file, one per line,
+// ignoring blank lines and comments. Each line is a package name taken
+// literally: ~ and $VARIABLES aren't expanded.
+func parsePackages(data []byte) []string {
 	var packages []string
-	for _, line := range lines {
+	for _, line := range strings.Split(string(data), "\n") {
 		line = strings.TrimSpace(line)
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
 		packages = append(packages, line)
 	}
+	return packages
+}
 
-	if len(packages) == 0 {
-		utils.Logger.Debug().Msgf("No packages to install from %s", packageFile)
-		return nil
+// newPackages returns the packages that are not in installed
+func newPackages(packages, installed []string) []string {
+	seen := make(map[string]bool, len(installed))
+	for _, p := range installed {
+		seen[p] = true
 	}
 
+	var added []string
+	for _, p := range packages {
+		if !seen[p] {
+			added = append(added, p)
+		}
+	}
+	return added
+}
+
+// installPackagesFromFile installs packages listed in a package file, running
+// the package manager with the given environment
+func installPackagesFromFile(packageFile string, packages []string, packageSystem string, env []string) error {
 	utils.Logger.Info().Msgf("Installing %d packages from %s", len(packages), packageFile)
 
 	// Build installation command
@@ -114,13 +171,14 @@ func installPackagesFromFile(packageFile, packageSystem string) error {
 		cmd = "yay"
 		args = append([]string{"-S", "--noconfirm"}, packages...)
 	default:
-		return fmt.Errorf("unsupported package system: %s", packageSystem)
+		return fmt.Errorf("%w: %s", ErrUnsupportedPackageSystem, packageSystem)
 	}
 
-	// Run installation command
-	output, err := utils.ExecuteCommand(cmd, args...)
+	// Run installation command, following its output
+	progress := newPackageProgress(packageSystem, fmt.Sprintf("Installing %d packages from %s", len(packages), filepath.Base(packageFile)))
+	_, err := utils.StreamCommandWithOptions(context.Background(), utils.StreamOptions{Env: env, OnLine: progress.line}, cmd, args...)
+	progress.stop(err)
 	if err != nil {
-		utils.Logger.Error().Err(err).Msgf("Failed to install packages: %s", output)
 		return err
 	}
 
@@ -0,0 +1,145 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// Package install progress
+//
+// The output of the package manager is followed line by line while it runs.
+// On a terminal it drives a spinner showing the latest step, which becomes a
+// bar once the package manager tells how much there is to do: apt announces
+// how many packages it upgrades and installs and then downloads (Get:N) and
+// sets up each, pacman, and so yay, numbers its steps as (N/M). Without a
+// terminal each line is logged instead.
+
+var (
+	aptCountsLine  = regexp.MustCompile(`^(\d+) upgraded, (\d+) newly installed`)
+	aptFetchLine   = regexp.MustCompile(`^Get:\d+\s`)
+	aptSetupLine   = regexp.MustCompile(`^Setting up (\S+)`)
+	brewStepLine   = regexp.MustCompile(`^==> (.+)`)
+	pacmanStepLine = regexp.MustCompile(`^\((\d+)/(\d+)\) (installing|upgrading) (\S+)`)
+)
+
+// packageOutputTail is how many lines of output are kept to show when the
+// package manager fails
+const packageOutputTail = 20
+
+// packageProgress follows the output of a package manager installing
+// packages
+type packageProgress struct {
+	packageSystem string
+	description   string
+	op            *utils.Operation // nil without a terminal
+	bar           bool             // Whether op is a bar yet
+
+	// current of total steps, once the package manager reported total
+	current, total int
+
+	tail []string
+}
+
+// newPackageProgress returns a progress for installing packages with
+// packageSystem, showing a spinner with description on a terminal
+func newPackageProgress(packageSystem, description string) *packageProgress {
+	p := &packageProgress{packageSystem: packageSystem, description: description}
+	if utils.IsTerminal() {
+		p.op = utils.NewOperation("packages", description, utils.Spinner)
+		p.op.Start()
+	}
+	return p
+}
+
+// line takes the next line of output of the package manager
+func (p *packageProgress) line(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	p.tail = append(p.tail, line)
+	if len(p.tail) > packageOutputTail {
+		p.tail = p.tail[1:]
+	}
+
+	message := p.step(line)
+	if p.op == nil {
+		utils.Logger.Info().Msgf("%s: %s", p.packageSystem, line)
+		return
+	}
+	utils.Logger.Debug().Msgf("%s: %s", p.packageSystem, line)
+
+	if p.total > 0 && !p.bar {
+		// Now that there is a total, the spinner becomes a bar
+		p.op.StopSilent()
+		p.op = utils.NewOperation("packages", p.description, utils.Bar)
+		p.op.Start()
+		p.bar = true
+	}
+	if message != "" {
+		p.op.SetMessage(fmt.Sprintf("%s: %s", p.description, message))
+	}
+	if p.bar {
+		p.op.UpdateProgress(p.current, p.total)
+	}
+}
+
+// step updates the counts from line and returns what it says the package
+// manager is doing, or an empty string
+func (p *packageProgress) step(line string) string {
+	switch p.packageSystem {
+	case "apt":
+		if match := aptCountsLine.FindStringSubmatch(line); match != nil {
+			upgraded, _ := strconv.Atoi(match[1])
+			installed, _ := strconv.Atoi(match[2])
+			// Every package is downloaded, then set up
+			p.total = 2 * (upgraded + installed)
+			return ""
+		}
+		if aptFetchLine.MatchString(line) {
+			p.advance()
+			if fields := strings.Fields(line); len(fields) > 4 {
+				return "downloading " + fields[4]
+			}
+			return "downloading"
+		}
+		if match := aptSetupLine.FindStringSubmatch(line); match != nil {
+			p.advance()
+			return "setting up " + match[1]
+		}
+	case "brew":
+		if match := brewStepLine.FindStringSubmatch(line); match != nil {
+			return match[1]
+		}
+	case "yay":
+		if match := pacmanStepLine.FindStringSubmatch(line); match != nil {
+			p.current, _ = strconv.Atoi(match[1])
+			p.total, _ = strconv.Atoi(match[2])
+			return match[3] + " " + match[4]
+		}
+	}
+	return ""
+}
+
+// advance counts a step, without going past the total, in case apt sets up
+// more than it announced
+func (p *packageProgress) advance() {
+	if p.current < p.total {
+		p.current++
+	}
+}
+
+// stop removes the indicator, err is the outcome of the package manager. On
+// failure the last lines of output are logged.
+func (p *packageProgress) stop(err error) {
+	if p.op != nil {
+		p.op.StopSilent()
+	}
+	if err != nil {
+		utils.Logger.Error().Err(err).Msgf("Failed to install packages:\n%s", strings.Join(p.tail, "\n"))
+	}
+}
@@ -0,0 +1,51 @@
+package core
+
+import "testing"
+
+func TestPackageProgressSteps(t *testing.T) {
+	tests := []struct {
+		packageSystem string
+		lines         []string
+		messages      []string
+		current       int
+		total         int
+	}{
+		{
+			packageSystem: "apt",
+			lines: []string{
+				"Reading package lists...",
+				"0 upgraded, 2 newly installed, 0 to remove and 3 not upgraded.",
+				"Get:1 http://archive.ubuntu.com/ubuntu jammy/main amd64 libonig5 amd64 6.9.7.1-2build1 [172 kB]",
+				"Get:2 http://archive.ubuntu.com/ubuntu jammy/main amd64 jq amd64 1.6-2.1ubuntu3 [52.5 kB]",
+				"Setting up libonig5:amd64 (6.9.7.1-2build1) ...",
+			},
+			messages: []string{"", "", "downloading libonig5", "downloading jq", "setting up libonig5:amd64"},
+			current:  3,
+			total:    4,
+		},
+		{
+			packageSystem: "brew",
+			lines:         []string{"==> Fetching jq", "Already downloaded: /tmp/jq.tar.gz", "==> Pouring jq--1.7.arm64_sonoma.bottle.tar.gz"},
+			messages:      []string{"Fetching jq", "", "Pouring jq--1.7.arm64_sonoma.bottle.tar.gz"},
+		},
+		{
+			packageSystem: "yay",
+			lines:         []string{"(1/2) checking keys in keyring", "(2/3) installing jq"},
+			messages:      []string{"", "installing jq"},
+			current:       2,
+			total:         3,
+		},
+	}
+
+	for _, tt := range tests {
+		p := &packageProgress{packageSystem: tt.packageSystem}
+		for i, line := range tt.lines {
+			if message := p.step(line); message != tt.messages[i] {
+				t.Errorf("%s: step(%q) = %q, want %q", tt.packageSystem, line, message, tt.messages[i])
+			}
+		}
+		if p.current != tt.current || p.total != tt.total {
+			t.Errorf("%s: progress %d/%d, want %d/%d", tt.packageSystem, p.current, p.total, tt.current, tt.total)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dotpilot/utils"
+)
+
+// packageStateFile records which package files were installed on this
+// machine. It is machine-local and kept out of git.
+const packageStateFile = ".package-state.json"
+
+// PackageState is the install state of the package files on this machine
+type PackageState struct {
+	Files map[string]PackageFileState `json:"files"` // Keyed by repo path
+}
+
+// PackageFileState is the last successful install of a package file
+type PackageFileState struct {
+	SHA256        string    `json:"sha256"`         // Hash of the file when it was installed
+	PackageSystem string    `json:"package_system"` // apt, brew or yay
+	Installed     []string  `json:"installed"`      // Packages listed in the file at the time
+	Updated       time.Time `json:"updated"`
+}
+
+// PackageFileStatus describes whether a package file needs installing
+type PackageFileStatus struct {
+	RepoPath  string
+	Installed bool     // Whether the file is unchanged since its last install
+	Pending   []string // Packages that the next install would install
+	Updated   time.Time
+}
+
+// loadPackageState reads the package state of dotpilotDir. A missing state
+// file means nothing was installed yet.
+func loadPackageState(dotpilotDir string) (*PackageState, error) {
+	state := &PackageState{Files: make(map[string]PackageFileState)}
+
+	data, err := ioutil.ReadFile(filepath.Join(dotpilotDir, packageStateFile))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		utils.Logger.Warn().Err(err).Msgf("Ignoring unreadable %s, all package files will be installed", packageStateFile)
+		return &PackageState{Files: make(map[string]PackageFileState)}, nil
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]PackageFileState)
+	}
+	return state, nil
+}
+
+// record stores the install state of a package file and saves the state
+func (s *PackageState) record(dotpilotDir, repoPath string, file PackageFileState) error {
+	s.Files[repoPath] = file
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dotpilotDir, packageStateFile), append(data, '\n'), 0644); err != nil {
+		return err
+	}
+
+	return excludeLocalFile(dotpilotDir, packageStateFile)
+}
+
+// packageFileHash returns the hex SHA-256 of a package file's content
+func packageFileHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// PackageStatus reports for each existing package file of the environment
+// whether it is installed or which of its packages are pending. It returns the
+// package system used.
+func PackageStatus(dotpilotDir, environment, overridePackageSystem string) (string, []PackageFileStatus, error) {
+	packageSystem := overridePackageSystem
+	if packageSystem == "" {
+		packageSystem = utils.GetOSInfo().PackageManager
+	}
+
+	packageFiles, err := packageFilesFor(dotpilotDir, environment, packageSystem)
+	if err != nil {
+		return packageSystem, nil, err
+	}
+
+	state, err := loadPackageState(dotpilotDir)
+	if err != nil {
+		return packageSystem, nil, err
+	}
+
+	var statuses []PackageFileStatus
+	for _, packageFile := range packageFiles {
+		data, err := ioutil.ReadFile(packageFile)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return packageSystem, nil, err
+		}
+
+		repoPath, err := RepoPath(dotpilotDir, packageFile)
+		if err != nil {
+			return packageSystem, nil, err
+		}
+
+		status := PackageFileStatus{RepoPath: repoPath, Pending: parsePackages(data)}
+		if previous, ok := state.Files[repoPath]; ok && previous.PackageSystem == packageSystem {
+			status.Updated = previous.Updated
+			status.Installed = previous.SHA256 == packageFileHash(data)
+			if status.Installed {
+				status.Pending = nil
+			} else {
+				status.Pending = newPackages(status.Pending, previous.Installed)
+			}
+		}
+		statuses = append(statuses, status)
+	}
+
+	return packageSystem, statuses, nil
+}
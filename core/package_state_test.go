@@ -0,0 +1,91 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestInstallPackagesSkipsUnchangedFiles(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dotpilotDir := t.TempDir()
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fake apt-get that logs the packages it is asked to install
+	binDir := t.TempDir()
+	logFile := filepath.Join(t.TempDir(), "apt.log")
+	script := "#!/bin/sh\nshift 2\necho \"$@\" >> " + logFile + "\n"
+	if err := os.WriteFile(filepath.Join(binDir, "apt-get"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	installs := func() []string {
+		data, err := os.ReadFile(logFile)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+
+	writeRepoFile(t, dotpilotDir, "common/packages.apt", "git\n# editors\nvim\n")
+	if err := CommitChanges(dotpilotDir, "packages"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, statuses, err := PackageStatus(dotpilotDir, "dev", "apt"); err != nil || len(statuses) != 1 || statuses[0].Installed {
+		t.Fatalf("status before install = %+v, %v", statuses, err)
+	}
+
+	if err := InstallPackages(dotpilotDir, "dev", "apt", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := InstallPackages(dotpilotDir, "dev", "apt", false); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"git vim"}; !reflect.DeepEqual(installs(), want) {
+		t.Errorf("installs = %v, want %v", installs(), want)
+	}
+
+	// Only the added package is installed from a changed file
+	writeRepoFile(t, dotpilotDir, "common/packages.apt", "git\nvim\ntmux\n")
+	_, statuses, err := PackageStatus(dotpilotDir, "dev", "apt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].Installed || !reflect.DeepEqual(statuses[0].Pending, []string{"tmux"}) {
+		t.Errorf("status after edit = %+v", statuses)
+	}
+	if err := InstallPackages(dotpilotDir, "dev", "apt", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := InstallPackages(dotpilotDir, "dev", "apt", true); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"git vim", "tmux", "git vim tmux"}; !reflect.DeepEqual(installs(), want) {
+		t.Errorf("installs = %v, want %v", installs(), want)
+	}
+
+	// The machine-local state is never committed
+	if err := CommitChanges(dotpilotDir, "more packages"); err != nil {
+		t.Fatal(err)
+	}
+	tracked, err := GetTrackedFiles(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range tracked {
+		if f == packageStateFile {
+			t.Errorf("%s was committed", packageStateFile)
+		}
+	}
+}
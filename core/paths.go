@@ -0,0 +1,68 @@
+package core
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// RepoPath returns the path of file relative to the dotpilot repository in the
+// slash-separated form git uses for tree entries, regardless of the host OS
+func RepoPath(dotpilotDir, file string) (string, error) {
+	relPath, err := filepath.Rel(dotpilotDir, file)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(relPath), nil
+}
+
+// RepoPathToTarget maps a slash-separated repo path to the file it is applied
+// to in home. Files under common/ map directly below home, files under
+// envs/<env>/ and machine/<hostname>/ drop the layer and its name. It returns
+// false for paths outside the layers, for the layer directories themselves and
+// for the machine.json fingerprint of a machine layer. Paths in the default
+// location of a relocated XDG base map into the base, see expandXDG; with an
+// empty home, the target is returned relative to home.
+func RepoPathToTarget(home, repoPath string) (string, bool) {
+	if isMachineFingerprint(repoPath) {
+		return "", false
+	}
+
+	parts := strings.Split(path.Clean(repoPath), "/")
+
+	var rest []string
+	switch parts[0] {
+	case "common":
+		rest = parts[1:]
+	case "envs", "machine":
+		if len(parts) < 2 {
+			return "", false
+		}
+		rest = parts[2:]
+	default:
+		return "", false
+	}
+	if len(rest) == 0 {
+		return "", false
+	}
+
+	// A symlink descriptor stands for the symlink without its suffix
+	target := strings.TrimSuffix(path.Join(rest...), symlinkSuffix)
+	if home == "" {
+		return filepath.FromSlash(target), true
+	}
+	return expandXDG(home, target), true
+}
+
+// TargetToRepoPath maps a file in home to the slash-separated repo path it is
+// applied from in layer, for example "common" or "envs/dev". It is the inverse
+// of RepoPathToTarget for a known layer and returns false for paths outside
+// home and the XDG bases, and for home itself. Tracked symlinks are stored
+// under the returned path plus symlinkSuffix.
+func TargetToRepoPath(home, target, layer string) (string, bool) {
+	relPath, ok := HomeRelPath(home, target)
+	if !ok {
+		return "", false
+	}
+	return path.Join(layer, relPath), true
+}
@@ -0,0 +1,64 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRepoPathToTarget(t *testing.T) {
+	home := filepath.Join("home", "user")
+
+	tests := []struct {
+		repoPath string
+		want     string
+		ok       bool
+	}{
+		{"common/.zshrc", filepath.Join(home, ".zshrc"), true},
+		{"common/.config/nvim/init.lua", filepath.Join(home, ".config", "nvim", "init.lua"), true},
+		{"envs/dev/.vimrc", filepath.Join(home, ".vimrc"), true},
+		{"envs/dev/.config/git/config", filepath.Join(home, ".config", "git", "config"), true},
+		{"machine/laptop/.bashrc", filepath.Join(home, ".bashrc"), true},
+		{"common/.config/foo.dotpilot-symlink", filepath.Join(home, ".config", "foo"), true},
+		{"common", "", false},
+		{"envs/dev", "", false},
+		{"machine", "", false},
+		{"secrets/token", "", false},
+		{"README.md", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := RepoPathToTarget(home, tt.repoPath)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("RepoPathToTarget(%q) = %q, %v, want %q, %v", tt.repoPath, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestTargetToRepoPath(t *testing.T) {
+	home := filepath.Join("home", "user")
+
+	tests := []struct {
+		target string
+		layer  string
+		want   string
+		ok     bool
+	}{
+		{filepath.Join(home, ".zshrc"), "common", "common/.zshrc", true},
+		{filepath.Join(home, ".config", "nvim", "init.lua"), "envs/dev", "envs/dev/.config/nvim/init.lua", true},
+		{filepath.Join(home, ".bashrc"), "machine/laptop", "machine/laptop/.bashrc", true},
+		{home, "common", "", false},
+		{filepath.Join("etc", "hosts"), "common", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := TargetToRepoPath(home, tt.target, tt.layer)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("TargetToRepoPath(%q, %q) = %q, %v, want %q, %v", tt.target, tt.layer, got, ok, tt.want, tt.ok)
+		}
+		if ok {
+			if back, _ := RepoPathToTarget(home, got); back != tt.target {
+				t.Errorf("RepoPathToTarget(%q) = %q, want %q", got, back, tt.target)
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Plugins
+//
+// Like git, dotpilot runs an executable named dotpilot-<name> found on PATH
+// for a command <name> it doesn't know, so subcommands can be added without
+// changing dotpilot. Plugins get the DOTPILOT_* variables of ScriptEnv.
+
+// PluginPrefix is the prefix of the executables run as plugins
+const PluginPrefix = "dotpilot-"
+
+// Plugin is an external subcommand found on PATH
+type Plugin struct {
+	Name string // Subcommand, the executable name without PluginPrefix
+	Path string // Executable to run
+}
+
+// LookPlugin returns the plugin run for the subcommand name, the first
+// dotpilot-<name> executable on PATH
+func LookPlugin(name string) (Plugin, bool) {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return Plugin{}, false
+	}
+	path, err := exec.LookPath(PluginPrefix + name)
+	if err != nil {
+		return Plugin{}, false
+	}
+	return Plugin{Name: name, Path: path}, true
+}
+
+// ListPlugins returns the plugins on PATH, ordered by name. Like the shell,
+// only the first executable of a name on PATH counts.
+func ListPlugins() []Plugin {
+	var plugins []Plugin
+	seen := make(map[string]bool)
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			name, ok := pluginName(entry.Name())
+			if !ok || seen[name] || entry.IsDir() {
+				continue
+			}
+			path, err := exec.LookPath(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				// Not executable
+				continue
+			}
+			seen[name] = true
+			plugins = append(plugins, Plugin{Name: name, Path: path})
+		}
+	}
+
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].Name < plugins[j].Name })
+	return plugins
+}
+
+// pluginName returns the subcommand an executable file name provides, without
+// the extension on Windows
+func pluginName(file string) (string, bool) {
+	name := strings.TrimPrefix(file, PluginPrefix)
+	if name == file {
+		return "", false
+	}
+	if runtime.GOOS == "windows" {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return name, name != ""
+}
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/dotpilot/utils"
+)
+
+// Pruning remote deletions
+//
+// Apply only creates and updates links. When a file is deleted from the repo
+// on another machine, pulling the deletion leaves its link here dangling and
+// the tracking paths of ~/.dotpilotrc still list it. Pruning looks for
+// tracked targets that no applied layer provides anymore, removes what
+// dotpilot put there and drops them from the tracking paths.
+
+// PrunedTarget is a tracked target whose file was deleted from the repo
+type PrunedTarget struct {
+	Target string // File in the home directory
+	// Backup is where a regular file that replaced the link was moved, empty
+	// if there was none
+	Backup string
+	// Removed is set if the link or file was removed from the target, it is
+	// unset if the target was missing already or isn't dotpilot's to remove
+	Removed bool
+}
+
+// PruneRemoteDeletions cleans up the tracked targets in the home directory
+// whose repo file is gone from every layer applied for environment. A link
+// into the repository is removed, a regular file that replaced it is moved
+// to a backup, and anything else is left alone. All of them are dropped from
+// the tracking paths.
+func PruneRemoteDeletions(dotpilotDir, environment string) ([]PrunedTarget, error) {
+	home, err := Home()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := appliedLayers(environment, "")
+	if err != nil {
+		return nil, err
+	}
+	dotpilotDir, err = filepath.Abs(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var pruned []PrunedTarget
+	var stale []string
+	var pruneErr error
+	for _, tracked := range GetConfig().TrackingPaths {
+		target := trackingTarget(home, tracked)
+		if providedByLayers(dotpilotDir, home, target, layers) {
+			continue
+		}
+
+		result, err := pruneTarget(dotpilotDir, target)
+		if err != nil {
+			pruneErr = err
+			break
+		}
+		pruned = append(pruned, result)
+		stale = append(stale, tracked)
+	}
+
+	// Forget what was pruned even if a later target failed
+	if err := RemoveTrackingPaths(stale...); err != nil && pruneErr == nil {
+		pruneErr = err
+	}
+	return pruned, pruneErr
+}
+
+// providedByLayers reports whether any of layers has a file, directory or
+// symlink descriptor for target
+func providedByLayers(dotpilotDir, home, target string, layers []string) bool {
+	for _, layer := range layers {
+		repoPath, ok := TargetToRepoPath(home, target, layer)
+		if !ok {
+			continue
+		}
+		for _, candidate := range []string{repoPath, repoPath + symlinkSuffix} {
+			if _, err := os.Lstat(filepath.Join(dotpilotDir, filepath.FromSlash(candidate))); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pruneTarget removes a link into the repository at target, or moves a
+// regular file there to a backup
+func pruneTarget(dotpilotDir, target string) (PrunedTarget, error) {
+	result := PrunedTarget{Target: target}
+
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := readLinkTarget(target)
+		if err != nil || !insideDir(link, dotpilotDir) {
+			utils.Logger.Warn().Msgf("Leaving %s alone, it doesn't link into the repository", target)
+			return result, nil
+		}
+		if err := os.Remove(target); err != nil {
+			return result, err
+		}
+	case info.Mode().IsRegular():
+		backup := backupPathFor(target)
+		if err := os.Rename(target, backup); err != nil {
+			return result, err
+		}
+		result.Backup = backup
+		pruneBackupsOf(target)
+	default:
+		utils.Logger.Warn().Msgf("Leaving %s alone, it isn't a file dotpilot applied", target)
+		return result, nil
+	}
+
+	result.Removed = true
+	return result, nil
+}
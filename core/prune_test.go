@@ -0,0 +1,99 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestPruneRemoteDeletionsAfterPull(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+	currentConfig = Config{TrackingPaths: []string{}}
+
+	// This machine applies three files from the remote
+	remoteDir := initMainRemote(t, true)
+	seedDir := t.TempDir()
+	if _, err := git.PlainClone(seedDir, false, &git.CloneOptions{URL: remoteDir}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{".vimrc", ".bashrc"} {
+		writeRepoFile(t, seedDir, "common/"+name, name+"\n")
+	}
+	if err := CommitChanges(seedDir, "more files"); err != nil {
+		t.Fatal(err)
+	}
+	if err := PushChanges(seedDir); err != nil {
+		t.Fatal(err)
+	}
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if _, err := git.PlainClone(dotpilotDir, false, &git.CloneOptions{URL: remoteDir}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{Prune: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := GetConfig().TrackingPaths, []string{".bashrc", ".vimrc", ".zshrc"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("tracking paths = %v, want %v", got, want)
+	}
+
+	// .bashrc was replaced by a regular file here, and another machine
+	// deletes it and .vimrc
+	bashrc := filepath.Join(home, ".bashrc")
+	if err := os.Remove(bashrc); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, home, ".bashrc", "local\n")
+	for _, name := range []string{".vimrc", ".bashrc"} {
+		if err := os.Remove(filepath.Join(seedDir, "common", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CommitChanges(seedDir, "delete"); err != nil {
+		t.Fatal(err)
+	}
+	if err := PushChanges(seedDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without pruning, the dangling link stays
+	if err := PullChanges(dotpilotDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(home, ".vimrc")); err != nil {
+		t.Fatalf("apply without pruning removed .vimrc: %v", err)
+	}
+
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{Prune: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(home, ".vimrc")); !os.IsNotExist(err) {
+		t.Errorf("the link to the deleted .vimrc is still there (%v)", err)
+	}
+	if _, err := os.Lstat(bashrc); !os.IsNotExist(err) {
+		t.Errorf("the regular .bashrc is still there (%v)", err)
+	}
+	backups, _ := filepath.Glob(bashrc + ".dotpilot.bak.*")
+	if len(backups) != 1 {
+		t.Fatalf("backups of .bashrc = %v", backups)
+	}
+	if data, err := os.ReadFile(backups[0]); err != nil || string(data) != "local\n" {
+		t.Errorf("backup reads %q (%v)", data, err)
+	}
+	if !linksTo(filepath.Join(home, ".zshrc"), filepath.Join(dotpilotDir, "common", ".zshrc")) {
+		t.Error(".zshrc isn't linked anymore")
+	}
+	if got, want := GetConfig().TrackingPaths, []string{".zshrc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tracking paths = %v, want %v", got, want)
+	}
+}
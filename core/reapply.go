@@ -0,0 +1,195 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ReapplyResult describes what ReapplyFile did to a target
+type ReapplyResult struct {
+	RepoPath  string // Slash-separated repo path the target links to
+	Target    string // Path in the home directory
+	Backup    string // Backup of the replaced file, empty if nothing was backed up
+	Unchanged bool   // The target already was the correct symlink
+}
+
+// appliedLayers returns the repo layers applied on this machine, highest
+// precedence first. layer restricts the result to common, machine or a single
+// environment name.
+func appliedLayers(environment, layer string) ([]string, error) {
+	hostname, err := MachineID()
+	if err != nil {
+		return nil, err
+	}
+
+	switch layer {
+	case "":
+		order, err := LayerOrder()
+		if err != nil {
+			return nil, err
+		}
+		var layers []string
+		for i := len(order) - 1; i >= 0; i-- {
+			switch order[i] {
+			case "common":
+				layers = append(layers, "common")
+			case "env":
+				if environment != "" {
+					layers = append(layers, path.Join("envs", environment))
+				}
+			case "machine":
+				layers = append(layers, path.Join("machine", hostname))
+			}
+		}
+		return layers, nil
+	case "common":
+		return []string{"common"}, nil
+	case "machine":
+		return []string{path.Join("machine", hostname)}, nil
+	default:
+		return []string{path.Join("envs", layer)}, nil
+	}
+}
+
+// FindRepoPath resolves a path given by the user, either a file in the home
+// directory or a file inside the dotpilot repository, to the slash-separated
+// repo path it is applied from. For home paths the layers applied on this
+// machine are searched the same way apply layers them, so by default the
+// machine layer wins over the environment, which wins over common, see
+// LayerOrder. layer restricts the search as described for appliedLayers.
+func FindRepoPath(dotpilotDir, file, environment, layer string) (string, error) {
+	absPath, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+
+	// A path inside the repository names the layer itself
+	if repoPath, err := RepoPath(dotpilotDir, absPath); err == nil && !strings.HasPrefix(repoPath, "../") && repoPath != ".." {
+		if _, ok := RepoPathToTarget("", repoPath); !ok {
+			return "", fmt.Errorf("%s is not inside common/, envs/<env>/ or machine/<hostname>/", repoPath)
+		}
+		return repoPath, nil
+	}
+
+	home, err := Home()
+	if err != nil {
+		return "", err
+	}
+	if _, ok := TargetToRepoPath(home, absPath, ""); !ok {
+		return "", fmt.Errorf("%s is neither in the home directory nor in the dotpilot repository", absPath)
+	}
+
+	layers, err := appliedLayers(environment, layer)
+	if err != nil {
+		return "", err
+	}
+	if found := findInLayers(dotpilotDir, home, absPath, layers); len(found) > 0 {
+		return found[0], nil
+	}
+
+	return "", fmt.Errorf("%s is not tracked in %s", absPath, strings.Join(layers, ", "))
+}
+
+// findInLayers returns the repo files that provide target in each of layers,
+// in the order of layers. A layer provides target with a regular file or with
+// a symlink descriptor.
+func findInLayers(dotpilotDir, home, target string, layers []string) []string {
+	var found []string
+	for _, l := range layers {
+		repoPath, ok := TargetToRepoPath(home, target, l)
+		if !ok {
+			continue
+		}
+		for _, candidate := range []string{repoPath, repoPath + symlinkSuffix} {
+			info, err := os.Stat(filepath.Join(dotpilotDir, filepath.FromSlash(candidate)))
+			if err == nil && !info.IsDir() {
+				found = append(found, candidate)
+				break
+			}
+		}
+	}
+	return found
+}
+
+// ReapplyFile recreates the symlink for a single repo file, backing up
+// whatever currently occupies the target. The link is relative with
+// Options["relative_symlinks"], and an existing link in the other form is
+// converted.
+func ReapplyFile(dotpilotDir, repoPath string) (ReapplyResult, error) {
+	result := ReapplyResult{RepoPath: repoPath}
+
+	home, err := Home()
+	if err != nil {
+		return result, err
+	}
+
+	target, ok := RepoPathToTarget(home, repoPath)
+	if !ok {
+		return result, fmt.Errorf("%s is not inside common/, envs/<env>/ or machine/<hostname>/", repoPath)
+	}
+	result.Target = target
+
+	source := filepath.Join(dotpilotDir, filepath.FromSlash(repoPath))
+	info, err := os.Stat(source)
+	if err != nil {
+		return result, err
+	}
+	if info.IsDir() {
+		return result, fmt.Errorf("%s is a directory, reapply individual files", repoPath)
+	}
+
+	// Tracked symlinks are recreated rather than linked to the repo file
+	linkSource, err := linkSourceFor(source)
+	if err != nil {
+		return result, err
+	}
+	content := linkSource
+	if !isSymlinkDescriptor(source) {
+		content = symlinkContent(target, linkSource, RelativeSymlinks())
+	}
+
+	if targetInfo, err := os.Lstat(target); err == nil {
+		if resolvesTo(target, source) && targetInfo.Mode()&os.ModeSymlink == 0 {
+			// Linked through a parent directory, removing it would delete the repo file
+			result.Unchanged = true
+			return result, nil
+		}
+		// A link in the other form, absolute or relative, is converted
+		// without a backup
+		converting := false
+		if targetInfo.Mode()&os.ModeSymlink != 0 {
+			if link, err := os.Readlink(target); err == nil && link == content {
+				result.Unchanged = true
+				return result, nil
+			}
+			converting = linksTo(target, linkSource)
+		} else if targetInfo.IsDir() {
+			return result, fmt.Errorf("%s is a directory, refusing to replace it", target)
+		}
+
+		if !converting {
+			if result.Backup, err = BackupFile(target); err != nil {
+				return result, err
+			}
+		}
+		if err := os.Remove(target); err != nil {
+			return result, err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return result, err
+	}
+	if err := os.Symlink(content, target); err != nil {
+		return result, err
+	}
+
+	if relTarget, ok := trackingPath(home, target); ok {
+		AddTrackingPath(relTarget)
+	}
+
+	return result, nil
+}
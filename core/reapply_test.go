@@ -0,0 +1,67 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReapply(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	for _, name := range []string{"common/.zshrc", "envs/dev/.zshrc", "common/.vimrc", "machine/" + hostname + "/.vimrc"} {
+		path := filepath.Join(dotpilotDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		file, layer, want string
+	}{
+		{filepath.Join(home, ".zshrc"), "", "envs/dev/.zshrc"},
+		{filepath.Join(home, ".zshrc"), "common", "common/.zshrc"},
+		{filepath.Join(home, ".vimrc"), "", "machine/" + hostname + "/.vimrc"},
+		{filepath.Join(dotpilotDir, "common", ".vimrc"), "", "common/.vimrc"},
+	}
+	for _, tt := range tests {
+		got, err := FindRepoPath(dotpilotDir, tt.file, "dev", tt.layer)
+		if err != nil || got != tt.want {
+			t.Errorf("FindRepoPath(%s, %q) = %q, %v, want %q", tt.file, tt.layer, got, err, tt.want)
+		}
+	}
+	if _, err := FindRepoPath(dotpilotDir, filepath.Join(home, ".missing"), "dev", ""); err == nil {
+		t.Error("FindRepoPath found an untracked file")
+	}
+
+	// A clobbered target is backed up and relinked
+	target := filepath.Join(home, ".zshrc")
+	if err := os.WriteFile(target, []byte("rewritten\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err := ReapplyFile(dotpilotDir, "envs/dev/.zshrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link, err := os.Readlink(target); err != nil || link != filepath.Join(dotpilotDir, "envs", "dev", ".zshrc") {
+		t.Errorf("target links to %q, %v", link, err)
+	}
+	if data, err := os.ReadFile(result.Backup); err != nil || string(data) != "rewritten\n" {
+		t.Errorf("backup %q holds %q, %v", result.Backup, data, err)
+	}
+
+	result, err = ReapplyFile(dotpilotDir, "envs/dev/.zshrc")
+	if err != nil || !result.Unchanged {
+		t.Errorf("second reapply = %+v, %v, want unchanged", result, err)
+	}
+}
@@ -0,0 +1,136 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Reinitializing
+//
+// init --force removes ~/.dotpilot before cloning again, which throws away
+// whatever exists nowhere else: commits that weren't pushed, changes that
+// weren't committed, and the files dotpilot keeps out of git on purpose, above
+// all the AES key, without which the secrets encrypted with it are lost.
+// InspectReinit finds those so init can warn about them, and report what it
+// would delete with --dry-run.
+
+// localOnlyFiles are the files dotpilot keeps in the dotpilot directory but
+// out of git, with what they are
+var localOnlyFiles = []struct {
+	name        string
+	description string
+}{
+	{secretKeyFile, "the AES key of the secrets"},
+	{snapshotsDir, "the snapshots of this machine"},
+	{packageStateFile, "the packages installed on this machine"},
+	{linkStateFile, "the hardlinked and copied targets of this machine"},
+	{bootstrapStateFile, "the progress of an interrupted bootstrap"},
+	{applyJournalName, "the journal of an interrupted apply"},
+}
+
+// secretKeyFile is the AES key of the secrets in the dotpilot directory
+const secretKeyFile = ".secret_key"
+
+// LocalOnlyFile is a file of the dotpilot directory that isn't in git
+type LocalOnlyFile struct {
+	Path        string
+	Description string
+}
+
+// ReinitReport is what init --force would delete
+type ReinitReport struct {
+	Dir   string // The directory removed, ~/.dotpilot
+	Files int    // Number of files below Dir
+	Size  int64  // Their size in bytes
+	// Unpushed is the number of commits the remote-tracking branch doesn't
+	// have, see GetRemoteStatus. It is only known without RemoteErr.
+	Unpushed  int
+	RemoteErr error
+	// Uncommitted are the changed and untracked files, relative to the
+	// dotpilot directory
+	Uncommitted []string
+	LocalOnly   []LocalOnlyFile
+	KeyFile     string // The AES key, empty if there is none
+}
+
+// AtRisk reports whether reinitializing loses anything that can't be cloned
+// again
+func (r ReinitReport) AtRisk() bool {
+	return r.Unpushed > 0 || r.RemoteErr != nil || len(r.Uncommitted) > 0 || len(r.LocalOnly) > 0
+}
+
+// InspectReinit reports what reinitializing the dotpilot repository of home
+// would delete. The remote isn't contacted, unpushed commits are counted
+// against the last fetch.
+func InspectReinit(home string) (ReinitReport, error) {
+	report := ReinitReport{Dir: filepath.Join(home, ".dotpilot")}
+	err := filepath.WalkDir(report.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		report.Files++
+		if info, err := d.Info(); err == nil {
+			report.Size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return report, nil
+		}
+		return report, err
+	}
+
+	// The layers may live in a subdirectory of the repository
+	dotpilotDir := DotpilotDir(home)
+	for _, f := range localOnlyFiles {
+		path := filepath.Join(dotpilotDir, f.name)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		report.LocalOnly = append(report.LocalOnly, LocalOnlyFile{Path: path, Description: f.description})
+		if f.name == secretKeyFile {
+			report.KeyFile = path
+		}
+	}
+
+	if _, err := git.PlainOpen(report.Dir); errors.Is(err, git.ErrRepositoryNotExists) {
+		report.RemoteErr = fmt.Errorf("%s isn't a git repository", report.Dir)
+		return report, nil
+	}
+
+	status, err := GetRemoteStatus(dotpilotDir)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		// Nothing was pushed yet, or the remote branch is gone
+		report.Unpushed, err = countCommits(dotpilotDir)
+	} else if err == nil {
+		report.Unpushed = status.Ahead
+	}
+	if err != nil {
+		report.RemoteErr = err
+	}
+
+	report.Uncommitted, err = uncommittedFiles(dotpilotDir)
+	return report, err
+}
+
+// BackupSecretKey copies the AES key keyFile to the home directory, next to
+// the dotpilot directory, so it survives reinitializing. It returns the path
+// of the copy.
+func BackupSecretKey(home, keyFile string) (string, error) {
+	backupPath := filepath.Join(home, ".dotpilot"+secretKeyFile+"."+time.Now().Format("20060102150405"))
+	if err := copyFile(keyFile, backupPath, 0600); err != nil {
+		return "", err
+	}
+	return backupPath, nil
+}
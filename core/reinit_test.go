@@ -0,0 +1,71 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInspectReinit(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+
+	// Nothing to lose without a dotpilot directory
+	report, err := InspectReinit(home)
+	if err != nil || report.Files != 0 || report.AtRisk() {
+		t.Fatalf("InspectReinit without a repository = %+v, %v", report, err)
+	}
+
+	// A fresh clone only has the commit of the layer directories init adds
+	remoteDir := initMainRemote(t, true)
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if err := InitializeRepo(context.Background(), remoteDir, dotpilotDir, "default", nil, "", 0); err != nil {
+		t.Fatal(err)
+	}
+	report, err = InspectReinit(home)
+	if err != nil || report.Files == 0 || len(report.Uncommitted) != 0 || len(report.LocalOnly) != 0 || report.RemoteErr != nil {
+		t.Fatalf("InspectReinit of a clone = %+v, %v", report, err)
+	}
+	unpushed := report.Unpushed
+
+	// Local changes, a commit that wasn't pushed and the AES key are lost
+	writeRepoFile(t, dotpilotDir, "common/.vimrc", "set nu\n")
+	if err := CommitChanges(dotpilotDir, "Add vimrc"); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "common/.inputrc", "set editing-mode vi\n")
+	keyFile := filepath.Join(dotpilotDir, secretKeyFile)
+	if err := os.WriteFile(keyFile, []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	report, err = InspectReinit(home)
+	if err != nil || !report.AtRisk() {
+		t.Fatalf("InspectReinit = %+v, %v", report, err)
+	}
+	if report.Unpushed != unpushed+1 || report.RemoteErr != nil {
+		t.Errorf("unpushed = %d, %v, want %d", report.Unpushed, report.RemoteErr, unpushed+1)
+	}
+	if want := []string{"common/.inputrc"}; !reflect.DeepEqual(report.Uncommitted, want) {
+		t.Errorf("uncommitted = %v, want %v", report.Uncommitted, want)
+	}
+	if report.KeyFile != keyFile || len(report.LocalOnly) != 1 {
+		t.Errorf("local-only files = %+v, key %q", report.LocalOnly, report.KeyFile)
+	}
+
+	// The key is backed up outside the dotpilot directory
+	backup, err := BackupSecretKey(home, report.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(backup) != home {
+		t.Errorf("the key was backed up to %s", backup)
+	}
+	if data, err := os.ReadFile(backup); err != nil || string(data) != "key" {
+		t.Errorf("backup = %q, %v", data, err)
+	}
+}
@@ -0,0 +1,184 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// Repairing the configuration
+//
+// ~/.dotpilotrc holds the remote, the current environment and the paths
+// dotpilot tracks, all of which the repository records too. When the file is
+// lost or corrupted, RepairConfig rebuilds them from the repository: the
+// remote from origin, the environment from the one with the most committed
+// dotfiles, and the tracking paths from the targets of the committed
+// dotfiles of the layers active on this machine. Options and the other
+// settings of a file that still parses are kept.
+
+// ConfigRepair is a configuration rebuilt from the repository
+type ConfigRepair struct {
+	Config Config
+	// Environments maps each environment to the number of dotfiles committed
+	// in it
+	Environments map[string]int
+	// Tied lists the environments with the most dotfiles when several have as
+	// many and none was asked for; Config names the first
+	Tied []string
+}
+
+// RepairConfig rebuilds the configuration at configPath from the repository
+// in dotpilotDir, using environment as the current environment unless it is
+// empty. subdir is recorded as the monorepo subdirectory. Nothing is written.
+func RepairConfig(configPath, home, dotpilotDir, environment, subdir string) (*ConfigRepair, error) {
+	repair := &ConfigRepair{Environments: make(map[string]int)}
+
+	// Start from the defaults, or what still parses of the old file
+	config := Config{
+		Options: map[string]interface{}{
+			"backup_before_overwrite": true,
+			"prompt_on_diff":          true,
+		},
+	}
+	if data, err := ioutil.ReadFile(configPath); err == nil {
+		var old Config
+		if json.Unmarshal(data, &old) == nil {
+			if old.Options == nil {
+				old.Options = config.Options
+			}
+			config = old
+		}
+	}
+	config.Subdir = subdir
+	// Open the enclosing repository in monorepo mode
+	currentConfig.Subdir = subdir
+
+	urls, err := RemoteURLs(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	config.RemoteRepository = ""
+	if len(urls) > 0 {
+		config.RemoteRepository = urls[0]
+	}
+
+	dotfiles, err := GetTrackedDotfiles(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// The environment with the most dotfiles, unless one was asked for
+	names, err := ListEnvironments(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		repair.Environments[name] = 0
+	}
+	for _, dotfile := range dotfiles {
+		if name, ok := environmentOfLayer(dotfile.Layer); ok {
+			repair.Environments[name]++
+		}
+	}
+	config.CurrentEnvironment = environment
+	if environment == "" {
+		config.CurrentEnvironment, repair.Tied = mostPopulated(repair.Environments)
+	}
+
+	// The targets of the layers active on this machine
+	hostname, err := MachineID()
+	if err != nil {
+		return nil, err
+	}
+	active := map[string]bool{
+		"common":                                true,
+		"envs/" + config.CurrentEnvironment:     true,
+		"machine/" + filepath.ToSlash(hostname): true,
+	}
+	seen := make(map[string]bool)
+	config.TrackingPaths = []string{}
+	for _, dotfile := range dotfiles {
+		if !active[dotfile.Layer] {
+			continue
+		}
+		tracked, ok := trackingPath(home, dotfile.TargetPath(home))
+		if ok && !seen[tracked] {
+			seen[tracked] = true
+			config.TrackingPaths = append(config.TrackingPaths, tracked)
+		}
+	}
+	sort.Strings(config.TrackingPaths)
+
+	repair.Config = config
+	return repair, nil
+}
+
+// SaveRepairedConfig makes config the current configuration and writes it to
+// configPath atomically, so an interrupted write leaves the old file intact
+func SaveRepairedConfig(configPath string, config Config) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(configPath), "."+filepath.Base(configPath)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer utils.Cleanup.AddFile(tmp.Name())()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), configPath); err != nil {
+		return err
+	}
+
+	SetConfig(config)
+	return nil
+}
+
+// environmentOfLayer returns the environment of a layer like "envs/dev"
+func environmentOfLayer(layer string) (string, bool) {
+	name, ok := strings.CutPrefix(layer, "envs/")
+	return name, ok && name != ""
+}
+
+// mostPopulated returns the environment with the most dotfiles, "default" if
+// there are none, and all environments tied with it, if any are
+func mostPopulated(counts map[string]int) (string, []string) {
+	var names []string
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return "default", nil
+	}
+
+	var best []string
+	for _, name := range names {
+		switch {
+		case len(best) == 0 || counts[name] > counts[best[0]]:
+			best = []string{name}
+		case counts[name] == counts[best[0]]:
+			best = append(best, name)
+		}
+	}
+	if len(best) == 1 {
+		return best[0], nil
+	}
+	return best[0], best
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+)
+
+func TestRepairConfig(t *testing.T) {
+	saved := currentConfig
+	defer SetConfig(saved)
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("DOTPILOT_HOSTNAME", "laptop")
+	t.Setenv("XDG_CONFIG_HOME", "")
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	repo, err := git.PlainInit(dotpilotDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{"git@example.com:me/dotfiles.git"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"common/.zshrc",
+		"common/install_packages.sh",
+		"envs/work/.gitconfig",
+		"envs/work/.config/app/settings.json",
+		"envs/home/.gitconfig",
+		"envs/empty/.gitkeep",
+		"machine/laptop/.ssh/config",
+		"machine/desktop/.xinitrc",
+	} {
+		writeRepoFile(t, dotpilotDir, name, name+"\n")
+	}
+	if err := CommitChanges(dotpilotDir, "dotfiles"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupted file falls back to the defaults
+	configPath := filepath.Join(home, ".dotpilotrc")
+	if err := os.WriteFile(configPath, []byte(`{"current_environment": "wo`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repair, err := RepairConfig(configPath, home, dotpilotDir, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"work": 2, "home": 1, "empty": 0}; !reflect.DeepEqual(repair.Environments, want) {
+		t.Errorf("environments = %v, want %v", repair.Environments, want)
+	}
+	if len(repair.Tied) != 0 {
+		t.Errorf("tied = %v", repair.Tied)
+	}
+	got := repair.Config
+	if got.RemoteRepository != "git@example.com:me/dotfiles.git" || got.CurrentEnvironment != "work" {
+		t.Errorf("remote %q, environment %q", got.RemoteRepository, got.CurrentEnvironment)
+	}
+	want := []string{".config/app/settings.json", ".gitconfig", ".ssh/config", ".zshrc"}
+	if !reflect.DeepEqual(got.TrackingPaths, want) {
+		t.Errorf("tracking paths = %q, want %q", got.TrackingPaths, want)
+	}
+	if got.Options["backup_before_overwrite"] != true {
+		t.Errorf("options = %v, want the defaults", got.Options)
+	}
+
+	// Saving replaces the file and the current configuration
+	if err := SaveRepairedConfig(configPath, got); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written Config
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatalf("written config doesn't parse: %v", err)
+	}
+	if written.CurrentEnvironment != "work" || GetConfig().CurrentEnvironment != "work" {
+		t.Errorf("saved environment %q, current %q", written.CurrentEnvironment, GetConfig().CurrentEnvironment)
+	}
+	if entries, _ := os.ReadDir(home); len(entries) != 2 {
+		t.Errorf("temporary files left in home: %v", entries)
+	}
+
+	// The options of a file that parses are kept, and a given environment wins
+	if err := os.WriteFile(configPath, []byte(`{"options": {"layer_order": ["env", "common"]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repair, err = RepairConfig(configPath, home, dotpilotDir, "home", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repair.Config.CurrentEnvironment != "home" || repair.Config.Options["layer_order"] == nil {
+		t.Errorf("environment %q, options %v", repair.Config.CurrentEnvironment, repair.Config.Options)
+	}
+	if want := []string{".gitconfig", ".ssh/config", ".zshrc"}; !reflect.DeepEqual(repair.Config.TrackingPaths, want) {
+		t.Errorf("tracking paths = %q, want %q", repair.Config.TrackingPaths, want)
+	}
+}
+
+func TestMostPopulated(t *testing.T) {
+	if name, tied := mostPopulated(nil); name != "default" || tied != nil {
+		t.Errorf("no environments: %q, %v", name, tied)
+	}
+	name, tied := mostPopulated(map[string]int{"b": 3, "a": 3, "c": 1})
+	if name != "a" || !reflect.DeepEqual(tied, []string{"a", "b"}) {
+		t.Errorf("tie: %q, %v", name, tied)
+	}
+}
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// Monorepo mode
+//
+// Normally ~/.dotpilot is the git repository and holds the layers directly.
+// In monorepo mode the dotfiles are a subdirectory of a larger repository
+// (Config.Subdir), which is still cloned to ~/.dotpilot as a whole. The
+// dotpilotDir used throughout this package is then that subdirectory, so the
+// layer logic is unchanged. Git operations open the enclosing repository and
+// translate between paths relative to its root and paths relative to
+// dotpilotDir; commits only ever stage changes inside dotpilotDir.
+
+// DotpilotDir returns the directory holding the layers: ~/.dotpilot, or its
+// configured subdirectory in monorepo mode
+func DotpilotDir(home string) string {
+	return filepath.Join(home, ".dotpilot", filepath.FromSlash(currentConfig.Subdir))
+}
+
+// cleanSubdir validates a monorepo subdirectory and returns it in slash form
+func cleanSubdir(subdir string) (string, error) {
+	cleaned := path.Clean(filepath.ToSlash(subdir))
+	if cleaned == "." {
+		return "", nil
+	}
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("subdirectory %q must be a relative path inside the repository", subdir)
+	}
+	return cleaned, nil
+}
+
+// openRepo opens the git repository holding dotpilotDir. In monorepo mode
+// that is the first parent directory containing .git.
+func openRepo(dotpilotDir string) (*git.Repository, error) {
+	if currentConfig.Subdir == "" {
+		return git.PlainOpen(dotpilotDir)
+	}
+	return git.PlainOpenWithOptions(dotpilotDir, &git.PlainOpenOptions{DetectDotGit: true})
+}
+
+// repoPrefix returns the slash-separated path of dotpilotDir inside the
+// worktree of repo, with a trailing slash, or "" if dotpilotDir is the root
+func repoPrefix(repo *git.Repository, dotpilotDir string) (string, error) {
+	w, err := repo.Worktree()
+	if err != nil {
+		return "", err
+	}
+
+	root, err := filepath.EvalSymlinks(w.Filesystem.Root())
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(dotpilotDir)
+	if err != nil {
+		return "", err
+	}
+
+	relPath, err := filepath.Rel(root, dir)
+	if err != nil {
+		return "", err
+	}
+	if relPath == "." {
+		return "", nil
+	}
+	return filepath.ToSlash(relPath) + "/", nil
+}
+
+// trimRepoPrefix converts a path relative to the repository root into a path
+// relative to dotpilotDir. It returns false for paths outside dotpilotDir.
+func trimRepoPrefix(prefix, name string) (string, bool) {
+	if prefix == "" {
+		return name, true
+	}
+	if !strings.HasPrefix(name, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(name, prefix), true
+}
+
+// excludeLocalFile keeps a machine-local file in dotpilotDir out of git by
+// listing it in .git/info/exclude, which unlike .gitignore is never committed
+func excludeLocalFile(dotpilotDir, name string) error {
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return err
+	}
+	prefix, err := repoPrefix(repo, dotpilotDir)
+	if err != nil {
+		return err
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+
+	excludePath := filepath.Join(w.Filesystem.Root(), ".git", "info", "exclude")
+	pattern := "/" + prefix + name
+
+	data, err := ioutil.ReadFile(excludePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == pattern {
+			return nil
+		}
+	}
+
+	if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+		data = append(data, '\n')
+	}
+	data = append(data, pattern+"\n"...)
+
+	if err := os.MkdirAll(filepath.Dir(excludePath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(excludePath, data, 0644)
+}
@@ -0,0 +1,111 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestSubdirLayout(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+
+	// A larger repository with the dotfiles in dotfiles/
+	remoteDir := t.TempDir()
+	if _, err := git.PlainInit(remoteDir, false); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, remoteDir, "src/main.go", "package main\n")
+	writeRepoFile(t, remoteDir, "dotfiles/common/.zshrc", "zsh\n")
+	if err := CommitChanges(remoteDir, "initial"); err != nil {
+		t.Fatal(err)
+	}
+
+	repoDir := filepath.Join(home, ".dotpilot")
+	if err := InitializeRepo(context.Background(), remoteDir, repoDir, "default", nil, "dotfiles/", 0); err != nil {
+		t.Fatal(err)
+	}
+	if currentConfig.Subdir != "dotfiles" {
+		t.Fatalf("subdir = %q, want dotfiles", currentConfig.Subdir)
+	}
+	dotpilotDir := DotpilotDir(home)
+	if want := filepath.Join(repoDir, "dotfiles"); dotpilotDir != want {
+		t.Fatalf("DotpilotDir = %s, want %s", dotpilotDir, want)
+	}
+
+	// Layers are applied from the subdirectory
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if link, err := os.Readlink(filepath.Join(home, ".zshrc")); err != nil || link != filepath.Join(dotpilotDir, "common", ".zshrc") {
+		t.Errorf(".zshrc links to %q, %v", link, err)
+	}
+
+	// Changes outside the subdirectory are neither counted nor committed
+	writeRepoFile(t, repoDir, "src/main.go", "package main // edited\n")
+	if changed, err := HasUncommittedChanges(dotpilotDir); err != nil || changed {
+		t.Errorf("HasUncommittedChanges = %v, %v with only outside changes", changed, err)
+	}
+
+	oldHash, err := HeadHash(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "common/.vimrc", "vim\n")
+	if changed, err := HasUncommittedChanges(dotpilotDir); err != nil || !changed {
+		t.Errorf("HasUncommittedChanges = %v, %v with a new dotfile", changed, err)
+	}
+	if err := CommitChanges(dotpilotDir, "add vimrc"); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := ChangedFilesSince(dotpilotDir, oldHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"common/.vimrc"}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed files = %v, want %v", changed, want)
+	}
+
+	tracked, err := GetTrackedFiles(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"common/.vimrc", "common/.zshrc"}; !reflect.DeepEqual(tracked, want) {
+		t.Errorf("tracked files = %v, want %v", tracked, want)
+	}
+
+	repo, err := git.PlainOpen(repoDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := w.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fileStatus := status.File("src/main.go"); fileStatus.Worktree != git.Modified || fileStatus.Staging != git.Unmodified {
+		t.Errorf("src/main.go status = %+v, want an unstaged modification", fileStatus)
+	}
+}
+
+func TestCleanSubdir(t *testing.T) {
+	for _, subdir := range []string{"../configs", "/abs", ".."} {
+		if _, err := cleanSubdir(subdir); err == nil {
+			t.Errorf("cleanSubdir(%q) succeeded", subdir)
+		}
+	}
+	if got, err := cleanSubdir("./configs/dotfiles/"); err != nil || got != "configs/dotfiles" {
+		t.Errorf("cleanSubdir = %q, %v", got, err)
+	}
+}
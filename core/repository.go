@@ -0,0 +1,238 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Repository is the initialized dotpilot repository of the current user. It
+// bundles the directory and configuration that the functions of this package
+// take as a dotpilotDir string, and wraps the most common operations.
+type Repository struct {
+	Home   string // Home directory the dotfiles are applied to
+	Dir    string // Directory holding the layers, see DotpilotDir
+	Config Config // Configuration when the repository was opened
+
+	git *git.Repository // Opened on first use by Git
+}
+
+// RepositoryStatus is the state of the repository as shown by 'dotpilot status'
+type RepositoryStatus struct {
+	Environment string
+	Changes     string   // git status of the uncommitted changes, empty if clean
+	Staged      []string // Repo paths staged with --no-commit
+	Tracked     []string // Repo paths of the committed files
+	// Dotfiles are the committed files that are applied as dotfiles, without
+	// the scripts, package lists and other files configuring dotpilot
+	Dotfiles []TrackedDotfile
+	Remote   RemoteStatus
+	// RemoteErr is why Remote couldn't be determined, e.g. because the
+	// repository has no remote-tracking branch. It wraps ErrNetwork if
+	// the remote status took too long, like when offline.
+	RemoteErr error
+	// RemoteSkipped is set when StatusOptions.Offline left out the remote
+	RemoteSkipped bool
+}
+
+// StatusOptions controls what StatusWithOptions checks
+type StatusOptions struct {
+	Offline bool // Skip the remote status entirely
+	// RemoteTimeout is how long to wait for the remote status, see
+	// remoteStatusTimeout for the default
+	RemoteTimeout time.Duration
+}
+
+// remoteStatusTimeout is how long Status waits for the remote status by
+// default, so that status stays fast without a network
+const remoteStatusTimeout = 5 * time.Second
+
+// getRemoteStatus is GetRemoteStatus, replaced in tests to hang
+var getRemoteStatus = GetRemoteStatus
+
+// OpenRepository opens the dotpilot repository of the current user. The
+// configuration is loaded from ~/.dotpilotrc unless one was loaded already. It
+// returns an error wrapping ErrNotInitialized if there is no repository.
+func OpenRepository() (*Repository, error) {
+	home, err := Home()
+	if err != nil {
+		return nil, err
+	}
+
+	if !configLoaded {
+		configPath := filepath.Join(home, ".dotpilotrc")
+		if _, err := os.Stat(configPath); err == nil {
+			if err := LoadConfig(configPath); err != nil {
+				return nil, err
+			}
+		} else {
+			InitDefaultConfig()
+		}
+	}
+
+	dir := DotpilotDir(home)
+	if err := CheckInitialized(dir); err != nil {
+		return nil, err
+	}
+
+	// Let env-rules.json pick the environment, see DetectEnvironment
+	if autoEnvironment || currentConfig.CurrentEnvironment == "" {
+		if err := applyEnvRules(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Repository{Home: home, Dir: dir, Config: GetConfig()}, nil
+}
+
+// Environment returns the current environment, "default" if none is set
+func (r *Repository) Environment() string {
+	if r.Config.CurrentEnvironment == "" {
+		return "default"
+	}
+	return r.Config.CurrentEnvironment
+}
+
+// Git returns the git repository holding the dotfiles
+func (r *Repository) Git() (*git.Repository, error) {
+	if r.git == nil {
+		repo, err := openRepo(r.Dir)
+		if err != nil {
+			return nil, err
+		}
+		r.git = repo
+	}
+	return r.git, nil
+}
+
+// Commit commits all changes to the dotfiles, see CommitChanges
+func (r *Repository) Commit(message string) error {
+	return CommitChanges(r.Dir, message)
+}
+
+// Pull pulls changes from the remote, see PullChanges
+func (r *Repository) Pull() error {
+	return PullChanges(r.Dir)
+}
+
+// Push pushes commits to the remote, see PushChanges
+func (r *Repository) Push() error {
+	return PushChanges(r.Dir)
+}
+
+// Apply links the layers of the current environment into the home directory,
+// see ApplyConfigurationsWithOptions
+func (r *Repository) Apply(opts ApplyOptions) error {
+	return ApplyConfigurationsWithOptions(r.Dir, r.Environment(), opts)
+}
+
+// ReportApply returns the state of every target an apply would link, see
+// ReportApply
+func (r *Repository) ReportApply(opts ApplyOptions) (*ApplyReport, error) {
+	return ReportApply(r.Dir, r.Environment(), opts)
+}
+
+// Track moves source into the repository at destination and links it back,
+// see TrackFile
+func (r *Repository) Track(source, destination string, overwrite bool) error {
+	return TrackFile(source, destination, r.Dir, overwrite)
+}
+
+// TrackWithOptions moves source into the repository at destination and links
+// it back, see TrackFileWithOptions
+func (r *Repository) TrackWithOptions(source, destination string, opts TrackOptions) (TrackResult, error) {
+	return TrackFileWithOptions(source, destination, r.Dir, opts)
+}
+
+// Status returns the state of the working tree, the remote and the tracked
+// files, see StatusWithOptions
+func (r *Repository) Status() (RepositoryStatus, error) {
+	return r.StatusWithOptions(context.Background(), StatusOptions{})
+}
+
+// StatusWithOptions returns the state of the working tree, the remote and the
+// tracked files. The remote status is given up on when ctx is done or the
+// remote timeout passes, leaving RemoteErr set, so the local state is
+// returned even without a network.
+func (r *Repository) StatusWithOptions(ctx context.Context, opts StatusOptions) (RepositoryStatus, error) {
+	status := RepositoryStatus{Environment: r.Environment()}
+
+	hasChanges, err := HasUncommittedChanges(r.Dir)
+	if err != nil {
+		return status, err
+	}
+	if hasChanges {
+		if status.Changes, err = GetGitStatus(r.Dir); err != nil {
+			return status, err
+		}
+		if status.Staged, err = GetStagedFiles(r.Dir); err != nil {
+			return status, err
+		}
+	}
+
+	if opts.Offline {
+		status.RemoteSkipped = true
+	} else {
+		status.Remote, status.RemoteErr = remoteStatusWithin(ctx, r.Dir, opts.RemoteTimeout)
+	}
+
+	// A repository without commits tracks nothing yet
+	status.Tracked, err = GetTrackedFiles(r.Dir)
+	if err != nil && !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return status, err
+	}
+	status.Dotfiles = dotfilesOf(status.Tracked)
+	return status, nil
+}
+
+// remoteStatusWithin returns the remote status of dotpilotDir, or an error
+// wrapping ErrNetwork if it takes longer than timeout, remoteStatusTimeout if
+// 0, or ctx is done first
+func remoteStatusWithin(ctx context.Context, dotpilotDir string, timeout time.Duration) (RemoteStatus, error) {
+	if timeout <= 0 {
+		timeout = remoteStatusTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		status RemoteStatus
+		err    error
+	}
+	done := make(chan result, 1)
+	// The goroutine may outlive this call, it mustn't read the global then
+	getStatus := getRemoteStatus
+	go func() {
+		status, err := getStatus(dotpilotDir)
+		done <- result{status, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.status, res.err
+	case <-ctx.Done():
+		return RemoteStatus{}, fmt.Errorf("%w: no remote status within %v: %v", ErrNetwork, timeout, ctx.Err())
+	}
+}
+
+// ListDotfiles returns the committed dotfiles with the state of their targets,
+// sorted by repo path
+func (r *Repository) ListDotfiles() ([]DotfileReport, error) {
+	// A repository without commits tracks nothing yet
+	dotfiles, err := GetTrackedDotfiles(r.Dir)
+	if err != nil && !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return nil, err
+	}
+
+	reports := make([]DotfileReport, 0, len(dotfiles))
+	for _, dotfile := range dotfiles {
+		reports = append(reports, dotfile.Report(r.Dir, r.Home))
+	}
+	return reports, nil
+}
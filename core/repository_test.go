@@ -0,0 +1,106 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestOpenRepository(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	savedConfig, savedLoaded := currentConfig, configLoaded
+	defer func() { currentConfig, configLoaded = savedConfig, savedLoaded }()
+	currentConfig, configLoaded = Config{}, false
+
+	if _, err := OpenRepository(); !errors.Is(err, ErrNotInitialized) {
+		t.Fatalf("OpenRepository without a repository = %v, want ErrNotInitialized", err)
+	}
+
+	// The configuration is loaded from ~/.dotpilotrc when nobody loaded it
+	configLoaded = false
+	rc := `{"current_environment": "work", "tracking_paths": []}`
+	if err := os.WriteFile(filepath.Join(home, ".dotpilotrc"), []byte(rc), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := OpenRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.Dir != dotpilotDir || repo.Home != home {
+		t.Errorf("Dir, Home = %s, %s", repo.Dir, repo.Home)
+	}
+	if env := repo.Environment(); env != "work" {
+		t.Errorf("Environment() = %q, want work", env)
+	}
+
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "zsh\n")
+	status, err := repo.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Changes == "" || len(status.Tracked) != 0 {
+		t.Errorf("status before commit = %+v", status)
+	}
+
+	if err := repo.Commit("Add zshrc"); err != nil {
+		t.Fatal(err)
+	}
+	status, err = repo.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Changes != "" || !reflect.DeepEqual(status.Tracked, []string{"common/.zshrc"}) {
+		t.Errorf("status after commit = %+v", status)
+	}
+	if status.RemoteErr == nil {
+		t.Error("expected a remote status error for a repository without a remote")
+	}
+}
+
+func TestStatusOffline(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	repo := &Repository{Home: home, Dir: dotpilotDir}
+
+	// A remote status that never comes is given up on
+	release := make(chan struct{})
+	defer close(release)
+	getRemoteStatus = func(string) (RemoteStatus, error) {
+		<-release
+		return RemoteStatus{}, nil
+	}
+	defer func() { getRemoteStatus = GetRemoteStatus }()
+
+	status, err := repo.StatusWithOptions(context.Background(), StatusOptions{RemoteTimeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(status.RemoteErr, ErrNetwork) || status.RemoteSkipped {
+		t.Errorf("remote error %v, skipped %v, want ErrNetwork", status.RemoteErr, status.RemoteSkipped)
+	}
+
+	status, err = repo.StatusWithOptions(context.Background(), StatusOptions{Offline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.RemoteErr != nil || !status.RemoteSkipped {
+		t.Errorf("offline: remote error %v, skipped %v", status.RemoteErr, status.RemoteSkipped)
+	}
+}
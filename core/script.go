@@ -0,0 +1,128 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// Scripts
+//
+// Hooks and bootstrap setup scripts may be written in any language. A script
+// runs with the interpreter of its #! line, so a repo can hold Python, fish
+// or zsh scripts next to bash ones, and scripts don't need to be executable.
+// Without a #! line, PowerShell and batch files on Windows get their
+// interpreter from the extension, and everything else runs with bash.
+
+// scriptSniffLen is how much of a script is read to find its #! line and to
+// tell a compiled program from a text file
+const scriptSniffLen = 512
+
+// windowsInterpreters are the interpreters of scripts without a #! line on
+// Windows, by extension
+var windowsInterpreters = map[string][]string{
+	".ps1": {"powershell", "-NoProfile", "-ExecutionPolicy", "Bypass", "-File"},
+	".cmd": {"cmd", "/C"},
+	".bat": {"cmd", "/C"},
+}
+
+// ScriptCommand returns the command running scriptPath with args: with the
+// interpreter of its #! line, by extension on Windows, as a program for a
+// compiled executable, and with bash otherwise. An interpreter that isn't at
+// the path of the #! line is looked up on PATH by name, so a script written
+// for /usr/bin/python3 also runs where python3 is elsewhere.
+func ScriptCommand(scriptPath string, args ...string) (*exec.Cmd, error) {
+	f, err := os.Open(scriptPath)
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, scriptSniffLen)
+	n, err := io.ReadFull(f, head)
+	f.Close()
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	interpreter, err := scriptInterpreter(scriptPath, head)
+	if err != nil {
+		return nil, err
+	}
+	if interpreter == nil {
+		return exec.Command(scriptPath, args...), nil
+	}
+
+	cmdArgs := append(append([]string{}, interpreter[1:]...), scriptPath)
+	return exec.Command(interpreter[0], append(cmdArgs, args...)...), nil
+}
+
+// scriptInterpreter returns the interpreter and its arguments for a script
+// starting with head, or nil for a compiled program that runs by itself
+func scriptInterpreter(scriptPath string, head []byte) ([]string, error) {
+	if bytes.HasPrefix(head, []byte("#!")) {
+		line := strings.SplitN(string(head[2:]), "\n", 2)[0]
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("%s has an empty #! line", scriptPath)
+		}
+		program, err := resolveInterpreter(fields[0])
+		if err != nil && filepath.Base(fields[0]) == "env" && len(fields) > 1 {
+			// No env program, like on Windows, run what it would run
+			fields = fields[1:]
+			program, err = exec.LookPath(fields[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("interpreter of %s: %w", scriptPath, err)
+		}
+		return append([]string{program}, fields[1:]...), nil
+	}
+
+	if runtime.GOOS == "windows" {
+		if interpreter, ok := windowsInterpreters[strings.ToLower(filepath.Ext(scriptPath))]; ok {
+			return interpreter, nil
+		}
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		// Not a text file
+		return nil, nil
+	}
+	return []string{"bash"}, nil
+}
+
+// resolveInterpreter returns the program to run for the interpreter path of a
+// #! line, the program of that name on PATH if the path doesn't exist
+func resolveInterpreter(path string) (string, error) {
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	return exec.LookPath(filepath.Base(path))
+}
+
+// RunShellScript runs scriptPath, see ScriptCommand, in the working directory
+// dir with env and its output written to stdout and stderr. A nil env
+// inherits the environment of dotpilot.
+func RunShellScript(scriptPath, dir string, env []string, stdout, stderr io.Writer) error {
+	cmd, err := ScriptCommand(scriptPath)
+	if err != nil {
+		return err
+	}
+	utils.Logger.Debug().Msgf("Running %s in %s", strings.Join(cmd.Args, " "), dir)
+
+	cmd.Dir = dir
+	if env != nil && dir != "" {
+		// Shells trust an inherited PWD that names another directory. env
+		// may be shared with other scripts, so it is never appended to.
+		env = append(env[:len(env):len(env)], "PWD="+dir)
+	}
+	cmd.Env = env
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
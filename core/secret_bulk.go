@@ -0,0 +1,92 @@
+package core
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+)
+
+// Bulk secret restore
+//
+// Restoring dozens of secrets runs one gpg or sops process per secret, which
+// is slow when done one after another. DecryptAll hands them to a bounded pool
+// of workers instead. One secret is always decrypted on its own first: it makes
+// gpg-agent ask for the passphrase once, so the workers that follow find it
+// cached rather than racing each other for pinentry.
+
+// DefaultSecretParallelism is the number of secrets decrypted at once by default
+const DefaultSecretParallelism = 4
+
+// SecretRestore is a secret to decrypt during a bulk restore
+type SecretRestore struct {
+	Name        string
+	Environment string // Environment the secret belongs to, empty for a common secret
+	Destination string // Absolute path the plaintext is written to
+}
+
+// DecryptAll decrypts every secret to its destination, running at most
+// parallel decryptions at once. It returns one error per restore, nil for the
+// secrets that were decrypted.
+func (sm *SecretManager) DecryptAll(restores []SecretRestore, parallel int) []error {
+	return decryptAll(restores, firstGPGSecret(sm.secretsDir, restores), parallel, func(r SecretRestore) error {
+		return sm.ForEnvironment(r.Environment).DecryptFile(r.Name, r.Destination)
+	})
+}
+
+// firstGPGSecret returns the index of the first of restores encrypted with
+// GPG, 0 if there is none. Only GPG secrets need the agent, so it is unlocked
+// with one of them.
+func firstGPGSecret(secretsDir string, restores []SecretRestore) int {
+	for i, r := range restores {
+		data, err := ioutil.ReadFile(filepath.Join(secretScopeDir(secretsDir, r.Environment), r.Name))
+		if err == nil && looksGPGEncrypted(data) {
+			return i
+		}
+	}
+	return 0
+}
+
+// DecryptAll decrypts every secret to its destination, running at most
+// parallel decryptions at once. It returns one error per restore, nil for the
+// secrets that were decrypted.
+func (sm *SopsManager) DecryptAll(restores []SecretRestore, parallel int) []error {
+	return decryptAll(restores, 0, parallel, func(r SecretRestore) error {
+		return sm.ForEnvironment(r.Environment).DecryptFile(r.Name, r.Destination)
+	})
+}
+
+// decryptAll runs decrypt for restores[first] alone, then for the remaining
+// restores on at most parallel workers
+func decryptAll(restores []SecretRestore, first, parallel int, decrypt func(r SecretRestore) error) []error {
+	errs := make([]error, len(restores))
+	if len(restores) == 0 {
+		return errs
+	}
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	errs[first] = decrypt(restores[first])
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel && w < len(restores)-1; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				errs[i] = decrypt(restores[i])
+			}
+		}()
+	}
+
+	for i := range restores {
+		if i != first {
+			jobs <- i
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	return errs
+}
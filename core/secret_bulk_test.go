@@ -0,0 +1,83 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDecryptAllBoundsParallelism(t *testing.T) {
+	var restores []SecretRestore
+	for i := 0; i < 10; i++ {
+		restores = append(restores, SecretRestore{Name: fmt.Sprintf("secret%d", i), Destination: fmt.Sprintf("/dest/%d", i)})
+	}
+
+	var mu sync.Mutex
+	running, maxRunning, firstDone := 0, 0, false
+	errs := decryptAll(restores, 3, 2, func(r SecretRestore) error {
+		name := r.Name
+		mu.Lock()
+		if name != "secret3" && !firstDone {
+			t.Errorf("%s decrypted before the first secret finished", name)
+		}
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		if name == "secret3" {
+			firstDone = true
+		}
+		mu.Unlock()
+
+		if name == "secret7" {
+			return errors.New("bad passphrase")
+		}
+		return nil
+	})
+
+	if maxRunning > 2 {
+		t.Errorf("%d decryptions ran at once, want at most 2", maxRunning)
+	}
+	for i, err := range errs {
+		if (err != nil) != (i == 7) {
+			t.Errorf("errs[%d] = %v", i, err)
+		}
+	}
+}
+
+func TestWriteSecretFileIsPrivate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeSecretFile(path, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("mode = %o, want 600", perm)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != "new" {
+		t.Errorf("content = %q, want new", data)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary file left behind: %d entries", len(entries))
+	}
+}
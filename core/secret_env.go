@@ -0,0 +1,57 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+)
+
+// Environment variable secrets
+//
+// A token that lives in the shell environment, like GITHUB_TOKEN, can be kept
+// as a secret with secrets add --env-var: the value of the variable is read
+// from the environment of dotpilot and encrypted, and the name of the
+// variable is recorded in the metadata of the secret. secrets export-env
+// decrypts those secrets again and prints export lines for the shell to eval.
+// The value is only ever held in memory.
+
+// envVarName matches the names a shell can export
+var envVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// EncryptEnvVar encrypts the value of the environment variable variable as
+// the secret name, recording the variable it is exported as
+func (sm *SecretManager) EncryptEnvVar(variable, name string) error {
+	if !envVarName.MatchString(variable) {
+		return fmt.Errorf("invalid environment variable name %q", variable)
+	}
+	value, ok := os.LookupEnv(variable)
+	if !ok {
+		return fmt.Errorf("environment variable %s is not set", variable)
+	}
+	return sm.encrypt([]byte(value), SecretMetadata{Name: name, EnvVar: variable})
+}
+
+// ExportEnv decrypts the secrets added from environment variables, the common
+// ones and those of the environment of the manager, and returns a line
+// exporting each, like export GITHUB_TOKEN='...', sorted by variable
+func (sm *SecretManager) ExportEnv() ([]string, error) {
+	secrets, err := sm.ListSecretMetadata()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].EnvVar < secrets[j].EnvVar })
+
+	var lines []string
+	for _, secret := range secrets {
+		if secret.EnvVar == "" {
+			continue
+		}
+		value, err := sm.DecryptData(secret.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", secret.Name, err)
+		}
+		lines = append(lines, fmt.Sprintf("export %s=%s", secret.EnvVar, shellQuote(string(value))))
+	}
+	return lines, nil
+}
@@ -0,0 +1,63 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEnvVarSecrets(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("GITHUB_TOKEN", "ghp_it's $secret")
+	t.Setenv("EMPTY_TOKEN", "")
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	sm := NewSecretManager(dotpilotDir)
+	sm.useGPG = false
+	if err := sm.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sm.EncryptEnvVar("GITHUB_TOKEN", "github_token"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.EncryptEnvVar("EMPTY_TOKEN", "EMPTY_TOKEN"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.EncryptData([]byte("not exported"), "api_key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.EncryptEnvVar("DOTPILOT_NOT_SET", "unset"); err == nil {
+		t.Error("encrypted a variable that isn't set")
+	}
+	if err := sm.EncryptEnvVar("NOT-A-NAME", "invalid"); err == nil {
+		t.Error("encrypted a variable with an invalid name")
+	}
+
+	// The value is only in the encrypted blob
+	data, err := os.ReadFile(filepath.Join(dotpilotDir, "secrets", "github_token"))
+	if err != nil || bytes.Contains(data, []byte("ghp_")) {
+		t.Errorf("stored %q, %v", data, err)
+	}
+
+	lines, err := sm.ExportEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`export EMPTY_TOKEN=''`, `export GITHUB_TOKEN='ghp_it'\''s $secret'`}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("ExportEnv = %q, want %q", lines, want)
+	}
+
+	// The shell gets the value back as it was
+	if _, err := exec.LookPath("sh"); err == nil {
+		out, err := exec.Command("sh", "-c", lines[1]+`; printf %s "$GITHUB_TOKEN"`).Output()
+		if err != nil || string(out) != "ghp_it's $secret" {
+			t.Errorf("sh exported %q, %v", out, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dotpilot/utils"
+)
+
+// Secret health
+//
+// secrets list --tree and sops list --tree show whether each secret is usable
+// on this machine. The quick check only looks at the file system and the
+// tools: whether the blob still has the hash recorded in the index, whether
+// the tools and keys its backend needs are here, and whether its plaintext is
+// at its destination. With verify, each secret is also decrypted, like get
+// --all does but without writing the plaintext anywhere, which runs gpg or
+// sops once per secret and may ask for a passphrase.
+
+// SecretHealth is the state of a secret on this machine
+type SecretHealth struct {
+	SecretMetadata
+	Layer string `json:"layer"`
+	// Changed is whether the blob no longer has the hash recorded in the
+	// index, like after a merge or an edit outside dotpilot
+	Changed bool `json:"changed"`
+	// Decryptable is whether the tools and keys the backend needs are
+	// present, or with verify whether the secret was decrypted
+	Decryptable bool `json:"decryptable"`
+	// Verified is whether Decryptable comes from decrypting the secret
+	Verified bool   `json:"verified"`
+	Problem  string `json:"problem,omitempty"` // Why the secret can't be decrypted
+	// Present is whether the plaintext is at the destination, or the
+	// environment variable of the secret is set. Secrets without either are
+	// never present.
+	Present bool `json:"present"`
+}
+
+// Health returns the health of secrets, which were listed by this manager.
+// With verify, each of them is decrypted to check it can be.
+func (sm *SecretManager) Health(secrets []SecretMetadata, verify bool) []SecretHealth {
+	restores := make([]SecretRestore, len(secrets))
+	for i, s := range secrets {
+		restores[i] = SecretRestore{Name: s.Name, Environment: s.Environment}
+	}
+	return secretHealth(sm.secretsDir, secrets, verify, func(s SecretMetadata) error {
+		if s.Backend == BackendGPG {
+			if !sm.useGPG {
+				return fmt.Errorf("%w (%s)", ErrGPGUnavailable, utils.InstallHint("gpg"))
+			}
+			return nil
+		}
+		if _, err := os.Stat(sm.keyFile); err != nil {
+			return fmt.Errorf("no AES key on this machine, copy %s from another one", filepath.Base(sm.keyFile))
+		}
+		return nil
+	}, func() []error {
+		return decryptAll(restores, firstGPGSecret(sm.secretsDir, restores), DefaultSecretParallelism, func(r SecretRestore) error {
+			_, err := sm.ForEnvironment(r.Environment).DecryptData(r.Name)
+			return err
+		})
+	})
+}
+
+// Health returns the health of secrets, which were listed by this manager.
+// With verify, each of them is decrypted to check it can be.
+func (sm *SopsManager) Health(secrets []SecretMetadata, verify bool) []SecretHealth {
+	restores := make([]SecretRestore, len(secrets))
+	for i, s := range secrets {
+		restores[i] = SecretRestore{Name: s.Name, Environment: s.Environment}
+	}
+	return secretHealth(sm.secretsDir, secrets, verify, func(SecretMetadata) error {
+		return sm.requireTools()
+	}, func() []error {
+		return decryptAll(restores, 0, DefaultSecretParallelism, func(r SecretRestore) error {
+			_, err := sm.ForEnvironment(r.Environment).DecryptData(r.Name)
+			return err
+		})
+	})
+}
+
+// secretHealth checks secrets of secretsDir with canDecrypt, and with verify
+// also with decrypt, which returns one error per secret
+func secretHealth(secretsDir string, secrets []SecretMetadata, verify bool, canDecrypt func(SecretMetadata) error, decrypt func() []error) []SecretHealth {
+	home, _ := Home()
+
+	health := make([]SecretHealth, len(secrets))
+	for i, s := range secrets {
+		h := SecretHealth{SecretMetadata: s, Layer: s.Layer()}
+
+		if hash, err := blobHash(filepath.Join(secretScopeDir(secretsDir, s.Environment), s.Name)); err == nil {
+			h.Changed = s.SHA256 != "" && hash != s.SHA256
+		}
+
+		if err := canDecrypt(s); err != nil {
+			h.Problem = err.Error()
+		} else {
+			h.Decryptable = true
+		}
+
+		if s.EnvVar != "" {
+			_, h.Present = os.LookupEnv(s.EnvVar)
+		} else if s.Destination != "" {
+			if destPath, err := utils.ExpandHome(home, s.Destination); err == nil {
+				_, err := os.Stat(destPath)
+				h.Present = err == nil
+			}
+		}
+		health[i] = h
+	}
+
+	if !verify {
+		return health
+	}
+	for i, err := range decrypt() {
+		health[i].Verified = true
+		health[i].Decryptable = err == nil
+		health[i].Problem = ""
+		if err != nil {
+			health[i].Problem = err.Error()
+		}
+	}
+	return health
+}
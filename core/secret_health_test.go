@@ -0,0 +1,64 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretHealth(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	sm := NewSecretManager(dotpilotDir)
+	sm.useGPG = false
+	if err := sm.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.EncryptData([]byte("token"), "token"); err != nil {
+		t.Fatal(err)
+	}
+	destination := filepath.Join(home, ".token")
+	if err := sm.SetDestination("token", destination); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.ForEnvironment("prod").EncryptData([]byte("prod token"), "api_key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.DecryptFile("token", destination); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := sm.ListAllSecretMetadata()
+	if err != nil || len(secrets) != 2 {
+		t.Fatalf("ListAllSecretMetadata = %v, %v", secrets, err)
+	}
+	health := sm.Health(secrets, false)
+	if h := health[0]; h.Name != "token" || h.Layer != "common" || !h.Decryptable || h.Verified || !h.Present || h.Changed {
+		t.Errorf("health of token = %+v", h)
+	}
+	if h := health[1]; h.Name != "api_key" || h.Layer != "envs/prod" || !h.Decryptable || h.Present {
+		t.Errorf("health of api_key = %+v", h)
+	}
+
+	// Decrypting checks the blobs themselves
+	if err := os.WriteFile(filepath.Join(dotpilotDir, "secrets", "envs", "prod", "api_key"), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	health = sm.Health(secrets, true)
+	if h := health[0]; !h.Decryptable || !h.Verified || h.Problem != "" {
+		t.Errorf("verified health of token = %+v", h)
+	}
+	if h := health[1]; h.Decryptable || !h.Verified || h.Problem == "" || !h.Changed {
+		t.Errorf("verified health of the corrupted api_key = %+v", h)
+	}
+
+	// Without the AES key, the quick check already knows
+	if err := os.Remove(filepath.Join(dotpilotDir, ".secret_key")); err != nil {
+		t.Fatal(err)
+	}
+	if h := sm.Health(secrets, false)[0]; h.Decryptable || h.Problem == "" {
+		t.Errorf("health of token without the key = %+v", h)
+	}
+}
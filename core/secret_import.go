@@ -0,0 +1,204 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ImportedSecret is a secret read from another secret store, before it is
+// encrypted
+type ImportedSecret struct {
+	Name   string
+	Value  []byte
+	Origin string // Where the secret was read from, recorded in its metadata
+}
+
+// dotenvKey matches the variable names accepted in .env files
+var dotenvKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// ReadDotenvSecrets reads the variables of a .env file as secrets named after
+// the variables. Blank lines, comments and a leading "export" are ignored.
+// Values may be double quoted, with \n, \t, \" and \\ escapes, or single
+// quoted, taken literally; unquoted values end at a " #" comment.
+func ReadDotenvSecrets(path string) ([]ImportedSecret, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var secrets []ImportedSecret
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !dotenvKey.MatchString(key) {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, lineNo)
+		}
+		value, err := parseDotenvValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+
+		secrets = append(secrets, ImportedSecret{
+			Name:   key,
+			Value:  []byte(value),
+			Origin: "dotenv:" + portablePath(path),
+		})
+	}
+	return secrets, scanner.Err()
+}
+
+// parseDotenvValue returns the value of a .env assignment
+func parseDotenvValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		end := strings.LastIndex(value, `"`)
+		if end == 0 {
+			return "", fmt.Errorf("unterminated double quote")
+		}
+		unquoted, err := strconv.Unquote(value[:end+1])
+		if err != nil {
+			return "", fmt.Errorf("invalid double quoted value: %w", err)
+		}
+		return unquoted, nil
+	case strings.HasPrefix(value, "'"):
+		end := strings.LastIndex(value, "'")
+		if end == 0 {
+			return "", fmt.Errorf("unterminated single quote")
+		}
+		return value[1:end], nil
+	}
+
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value), nil
+}
+
+// ReadJSONSecrets reads a JSON object mapping secret names to string values,
+// in name order
+func ReadJSONSecrets(r io.Reader) ([]ImportedSecret, error) {
+	var values map[string]string
+	if err := json.NewDecoder(r).Decode(&values); err != nil {
+		return nil, fmt.Errorf("expected a JSON object of names to string values: %w", err)
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	secrets := make([]ImportedSecret, 0, len(names))
+	for _, name := range names {
+		secrets = append(secrets, ImportedSecret{
+			Name:   name,
+			Value:  []byte(values[name]),
+			Origin: "json",
+		})
+	}
+	return secrets, nil
+}
+
+// passStoreDir returns the password store directory pass uses
+func passStoreDir() (string, error) {
+	if dir := os.Getenv("PASSWORD_STORE_DIR"); dir != "" {
+		return dir, nil
+	}
+	home, err := Home()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".password-store"), nil
+}
+
+// ReadPassSecrets reads an entry of the pass password store, or every entry
+// below a folder of it, with 'pass show'. Secrets are named after their entry
+// relative to the store, with slashes replaced by underscores, so
+// github/token becomes github_token.
+func ReadPassSecrets(entry string) ([]ImportedSecret, error) {
+	if _, err := exec.LookPath("pass"); err != nil {
+		return nil, fmt.Errorf("pass is not installed")
+	}
+	storeDir, err := passStoreDir()
+	if err != nil {
+		return nil, err
+	}
+
+	entry = strings.Trim(filepath.ToSlash(entry), "/")
+	entries := []string{entry}
+	if info, err := os.Stat(filepath.Join(storeDir, filepath.FromSlash(entry))); err == nil && info.IsDir() {
+		if entries, err = passEntries(storeDir, entry); err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("no pass entries found below %s", entry)
+		}
+	}
+
+	secrets := make([]ImportedSecret, 0, len(entries))
+	for _, e := range entries {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command("pass", "show", e)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		cmd.Stdin = os.Stdin
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("pass show %s failed: %w: %s", e, err, strings.TrimSpace(stderr.String()))
+		}
+		secrets = append(secrets, ImportedSecret{
+			Name:   strings.ReplaceAll(e, "/", "_"),
+			Value:  stdout.Bytes(),
+			Origin: "pass:" + e,
+		})
+	}
+	return secrets, nil
+}
+
+// passEntries returns the names of the entries below folder of the password
+// store, in path order
+func passEntries(storeDir, folder string) ([]string, error) {
+	var entries []string
+	root := filepath.Join(storeDir, filepath.FromSlash(folder))
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && strings.HasPrefix(info.Name(), ".") && path != root {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".gpg") {
+			return nil
+		}
+		relPath, err := filepath.Rel(storeDir, path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, strings.TrimSuffix(filepath.ToSlash(relPath), ".gpg"))
+		return nil
+	})
+	return entries, err
+}
+
+// ImportData encrypts data as the named secret like EncryptData and records
+// origin, the store it was imported from, in its metadata
+func (sm *SecretManager) ImportData(data []byte, name, origin string) error {
+	return sm.encrypt(data, SecretMetadata{Name: name, Origin: origin})
+}
@@ -0,0 +1,146 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadDotenvSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	content := strings.Join([]string{
+		"# API credentials",
+		"",
+		"export API_KEY=abc123",
+		`DB_URL="postgres://db\nline" # quoted`,
+		"LITERAL='$HOME \\n' ",
+		"EMPTY=",
+		"WITH_COMMENT=value # trailing",
+	}, "\n")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := ReadDotenvSecrets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, s := range secrets {
+		got[s.Name] = string(s.Value)
+		if s.Origin != "dotenv:"+path {
+			t.Errorf("%s: origin = %q", s.Name, s.Origin)
+		}
+	}
+	want := map[string]string{
+		"API_KEY":      "abc123",
+		"DB_URL":       "postgres://db\nline",
+		"LITERAL":      `$HOME \n`,
+		"EMPTY":        "",
+		"WITH_COMMENT": "value",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDotenvSecrets = %q, want %q", got, want)
+	}
+
+	if err := os.WriteFile(path, []byte("not an assignment\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadDotenvSecrets(path); err == nil {
+		t.Errorf("ReadDotenvSecrets accepted a line without =")
+	}
+}
+
+func TestReadJSONSecrets(t *testing.T) {
+	secrets, err := ReadJSONSecrets(strings.NewReader(`{"github_token": "ghp_x", "api_key": "k"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ImportedSecret{
+		{Name: "api_key", Value: []byte("k"), Origin: "json"},
+		{Name: "github_token", Value: []byte("ghp_x"), Origin: "json"},
+	}
+	if !reflect.DeepEqual(secrets, want) {
+		t.Errorf("ReadJSONSecrets = %+v, want %+v", secrets, want)
+	}
+
+	if _, err := ReadJSONSecrets(strings.NewReader(`{"n": 1}`)); err == nil {
+		t.Errorf("ReadJSONSecrets accepted a non-string value")
+	}
+}
+
+func TestReadPassSecrets(t *testing.T) {
+	// A fake pass printing the entry name
+	bin := t.TempDir()
+	script := "#!/bin/sh\necho \"secret of $2\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "pass"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	store := t.TempDir()
+	t.Setenv("PASSWORD_STORE_DIR", store)
+	for _, name := range []string{"github/token.gpg", "github/ci/deploy.gpg", "email.gpg", ".gpg-id"} {
+		path := filepath.Join(store, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	secrets, err := ReadPassSecrets("github")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ImportedSecret{
+		{Name: "github_ci_deploy", Value: []byte("secret of github/ci/deploy\n"), Origin: "pass:github/ci/deploy"},
+		{Name: "github_token", Value: []byte("secret of github/token\n"), Origin: "pass:github/token"},
+	}
+	if !reflect.DeepEqual(secrets, want) {
+		t.Errorf("ReadPassSecrets(github) = %+v, want %+v", secrets, want)
+	}
+
+	secrets, err = ReadPassSecrets("email")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 1 || secrets[0].Name != "email" {
+		t.Errorf("ReadPassSecrets(email) = %+v, want the single entry", secrets)
+	}
+}
+
+func TestImportDataRecordsOrigin(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	sm := NewSecretManager(dotpilotDir)
+	sm.useGPG = false
+	if err := sm.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sm.ImportData([]byte("ghp_x"), "github_token", "pass:github/token"); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := sm.ListSecretMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 1 || secrets[0].Origin != "pass:github/token" || secrets[0].Backend != BackendAES || secrets[0].Destination != "" {
+		t.Errorf("metadata = %+v, want an AES secret imported from pass", secrets)
+	}
+
+	dest := filepath.Join(home, "token")
+	if err := sm.DecryptFile("github_token", dest); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(dest); err != nil || string(data) != "ghp_x" {
+		t.Errorf("decrypted %q, %v", data, err)
+	}
+}
@@ -0,0 +1,396 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// secretIndexFile is the metadata index kept next to the encrypted blobs in
+// secrets/ and sops-secrets/
+const secretIndexFile = ".index.json"
+
+// secretEnvsDir is the directory of a secrets directory holding the secrets
+// of the environments, one directory per environment with its own index.
+// Secrets at the top of the secrets directory are common to all environments,
+// which includes every secret added before environments could have their own.
+const secretEnvsDir = "envs"
+
+// Secret backends recorded in the metadata index
+const (
+	BackendAES  = "aes"
+	BackendGPG  = "gpg"
+	BackendSops = "sops"
+)
+
+// SecretMetadata describes a stored secret without revealing its content
+type SecretMetadata struct {
+	Name        string    `json:"name"`
+	Source      string    `json:"source,omitempty"`      // Path the secret was added from, empty for stdin
+	Destination string    `json:"destination,omitempty"` // Where the secret is meant to be decrypted to
+	Origin      string    `json:"origin,omitempty"`      // Store the secret was imported from, e.g. pass:github/token
+	EnvVar      string    `json:"env_var,omitempty"`     // Environment variable the secret was added from and is exported as
+	Backend     string    `json:"backend"`               // aes, gpg or sops
+	Added       time.Time `json:"added"`
+	// SHA256 is the hash of the encrypted blob, so changes can be detected
+	// without decrypting and without publishing a hash of the plaintext
+	SHA256 string `json:"sha256"`
+	// Environment is the environment the secret belongs to, empty for a
+	// common secret. It is set when listing, the index doesn't store it.
+	Environment string `json:"environment,omitempty"`
+}
+
+// Layer returns the layer of the secret like the dotfile layers are named:
+// "common" or "envs/<env>"
+func (m SecretMetadata) Layer() string {
+	if m.Environment == "" {
+		return "common"
+	}
+	return secretEnvsDir + "/" + m.Environment
+}
+
+// loadSecretIndex reads the metadata index of a secrets directory. A missing
+// index is not an error, secrets added before it existed simply have no entry.
+func loadSecretIndex(secretsDir string) (map[string]SecretMetadata, error) {
+	index := make(map[string]SecretMetadata)
+
+	data, err := ioutil.ReadFile(filepath.Join(secretsDir, secretIndexFile))
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []SecretMetadata
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		index[entry.Name] = entry
+	}
+
+	return index, nil
+}
+
+// saveSecretIndex writes the metadata index sorted by name so it diffs cleanly
+func saveSecretIndex(secretsDir string, index map[string]SecretMetadata) error {
+	entries := make([]SecretMetadata, 0, len(index))
+	for _, entry := range index {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(secretsDir, secretIndexFile), append(data, '\n'), 0600)
+}
+
+// recordSecret adds or replaces the index entry for a freshly written secret.
+// The destination of an existing entry is kept if meta doesn't set one.
+func recordSecret(secretsDir string, meta SecretMetadata) error {
+	index, err := loadSecretIndex(secretsDir)
+	if err != nil {
+		return err
+	}
+
+	hash, err := blobHash(filepath.Join(secretsDir, meta.Name))
+	if err != nil {
+		return err
+	}
+	meta.SHA256 = hash
+	meta.Added = time.Now().UTC().Truncate(time.Second)
+	if meta.Destination == "" {
+		meta.Destination = index[meta.Name].Destination
+	}
+
+	index[meta.Name] = meta
+	return saveSecretIndex(secretsDir, index)
+}
+
+// updateSecretHash refreshes the blob hash of an indexed secret after it was
+// changed in place, keeping the rest of its metadata
+func updateSecretHash(secretsDir, name string) error {
+	index, err := loadSecretIndex(secretsDir)
+	if err != nil {
+		return err
+	}
+
+	meta, ok := index[name]
+	if !ok {
+		return nil
+	}
+	if meta.SHA256, err = blobHash(filepath.Join(secretsDir, name)); err != nil {
+		return err
+	}
+	index[name] = meta
+
+	return saveSecretIndex(secretsDir, index)
+}
+
+// forgetSecret removes the index entry of a secret, if there is one
+func forgetSecret(secretsDir, name string) error {
+	index, err := loadSecretIndex(secretsDir)
+	if err != nil {
+		return err
+	}
+	if _, ok := index[name]; !ok {
+		return nil
+	}
+
+	delete(index, name)
+	return saveSecretIndex(secretsDir, index)
+}
+
+// setSecretDestination records where a secret is meant to be decrypted to
+func setSecretDestination(secretsDir, name, destination string) error {
+	index, err := loadSecretIndex(secretsDir)
+	if err != nil {
+		return err
+	}
+
+	meta, ok := index[name]
+	if !ok {
+		return nil
+	}
+	meta.Destination = portablePath(destination)
+	index[name] = meta
+
+	return saveSecretIndex(secretsDir, index)
+}
+
+// listSecretMetadata returns metadata for every secret blob in secretsDir.
+// Secrets without an index entry get what can be inferred from the blob,
+// with the backend guessed by inferBackend.
+func listSecretMetadata(secretsDir string, inferBackend func(path string) string) ([]SecretMetadata, error) {
+	index, err := loadSecretIndex(secretsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(secretsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets []SecretMetadata
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+
+		meta, ok := index[f.Name()]
+		if !ok {
+			path := filepath.Join(secretsDir, f.Name())
+			meta = SecretMetadata{
+				Name:    f.Name(),
+				Backend: inferBackend(path),
+				Added:   f.ModTime().UTC().Truncate(time.Second),
+			}
+			if hash, err := blobHash(path); err == nil {
+				meta.SHA256 = hash
+			}
+		}
+		secrets = append(secrets, meta)
+	}
+
+	return secrets, nil
+}
+
+// secretScopeDir returns the directory of secretsDir holding the secrets of
+// environment, secretsDir itself for the common secrets
+func secretScopeDir(secretsDir, environment string) string {
+	if environment == "" {
+		return secretsDir
+	}
+	return filepath.Join(secretsDir, secretEnvsDir, environment)
+}
+
+// createSecretScopeDir returns the directory of secretsDir new secrets of
+// environment are added to, creating it for an environment
+func createSecretScopeDir(secretsDir, environment string) (string, error) {
+	if environment == "" {
+		return secretsDir, nil
+	}
+	if err := validateSecretEnvironment(environment); err != nil {
+		return "", err
+	}
+	dir := secretScopeDir(secretsDir, environment)
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// validateSecretEnvironment rejects environment names that would leave the
+// secrets directory, the empty name of the common secrets is valid
+func validateSecretEnvironment(environment string) error {
+	if environment == "" {
+		return nil
+	}
+	return ValidateEnvironmentName(environment)
+}
+
+// scopeEnvironment maps the "common" layer name to the empty environment of
+// the common secrets
+func scopeEnvironment(environment string) string {
+	if environment == "common" {
+		return ""
+	}
+	return environment
+}
+
+// secretEnvironments returns the environments that have a directory of
+// secrets in secretsDir, sorted
+func secretEnvironments(secretsDir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(secretsDir, secretEnvsDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var environments []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			environments = append(environments, entry.Name())
+		}
+	}
+	return environments, nil
+}
+
+// locateSecret returns the directory holding the secret name as seen from
+// environment: the directory of the environment if the secret is there, the
+// common one otherwise. It returns an error wrapping ErrSecretNotFound if
+// neither has it.
+func locateSecret(secretsDir, environment, name string) (string, error) {
+	if err := validateSecretName(name); err != nil {
+		return "", err
+	}
+	if err := validateSecretEnvironment(environment); err != nil {
+		return "", err
+	}
+	for _, dir := range []string{secretScopeDir(secretsDir, environment), secretsDir} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && !info.IsDir() {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+}
+
+// listScopedSecretMetadata returns the metadata of the secrets seen from
+// environment, the common ones and those of the environment, sorted by name.
+// A secret of the environment hides a common one of the same name.
+func listScopedSecretMetadata(secretsDir, environment string, inferBackend func(path string) string) ([]SecretMetadata, error) {
+	if err := validateSecretEnvironment(environment); err != nil {
+		return nil, err
+	}
+	secrets, err := listSecretMetadata(secretsDir, inferBackend)
+	if err != nil || environment == "" {
+		return secrets, err
+	}
+
+	scoped, err := listSecretMetadata(secretScopeDir(secretsDir, environment), inferBackend)
+	if err != nil {
+		return nil, err
+	}
+	hidden := make(map[string]bool)
+	for i := range scoped {
+		scoped[i].Environment = environment
+		hidden[scoped[i].Name] = true
+	}
+	for _, meta := range secrets {
+		if !hidden[meta.Name] {
+			scoped = append(scoped, meta)
+		}
+	}
+	sort.Slice(scoped, func(i, j int) bool { return scoped[i].Name < scoped[j].Name })
+	return scoped, nil
+}
+
+// listAllSecretMetadata returns the metadata of the common secrets followed by
+// those of every environment
+func listAllSecretMetadata(secretsDir string, inferBackend func(path string) string) ([]SecretMetadata, error) {
+	secrets, err := listSecretMetadata(secretsDir, inferBackend)
+	if err != nil {
+		return nil, err
+	}
+	environments, err := secretEnvironments(secretsDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, environment := range environments {
+		scoped, err := listSecretMetadata(secretScopeDir(secretsDir, environment), inferBackend)
+		if err != nil {
+			return nil, err
+		}
+		for _, meta := range scoped {
+			meta.Environment = environment
+			secrets = append(secrets, meta)
+		}
+	}
+	return secrets, nil
+}
+
+// secretNames returns the names of secrets
+func secretNames(secrets []SecretMetadata) []string {
+	var names []string
+	for _, meta := range secrets {
+		names = append(names, meta.Name)
+	}
+	return names
+}
+
+// validateSecretName rejects names that would clash with the files dotpilot
+// keeps in the secrets directories, such as the metadata index
+func validateSecretName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid secret name %q, names may not be empty, start with '.' or contain path separators", name)
+	}
+	return nil
+}
+
+// blobHash returns the hex SHA-256 of a file
+func blobHash(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return dataHash(data), nil
+}
+
+// dataHash returns the hex SHA-256 of data, as recorded in the index
+func dataHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// portablePath stores paths below the home directory as ~/... so the index
+// stays meaningful on machines with a different home
+func portablePath(path string) string {
+	if path == "" {
+		return ""
+	}
+
+	home, err := Home()
+	if err != nil {
+		return path
+	}
+	if rel, err := filepath.Rel(home, path); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "~/" + filepath.ToSlash(rel)
+	}
+	return path
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretIndex(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	sm := NewSecretManager(dotpilotDir)
+	sm.useGPG = false
+	if err := sm.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(home, ".aws", "credentials")
+	if err := os.MkdirAll(filepath.Dir(src), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(src, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sm.EncryptFile(src, "aws"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.EncryptData([]byte("token"), "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The index itself is not listed as a secret
+	names, err := sm.ListSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("ListSecrets() = %v, want aws and token", names)
+	}
+
+	secrets, err := sm.ListSecretMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 2 {
+		t.Fatalf("expected 2 secrets, got %d", len(secrets))
+	}
+	aws := secrets[0]
+	if aws.Name != "aws" || aws.Backend != BackendAES || aws.Source != "~/.aws/credentials" || aws.Destination != "~/.aws/credentials" {
+		t.Errorf("unexpected metadata for aws: %+v", aws)
+	}
+	if hash, _ := blobHash(filepath.Join(dotpilotDir, "secrets", "aws")); aws.SHA256 != hash || aws.Added.IsZero() {
+		t.Errorf("aws hash or added time not recorded: %+v", aws)
+	}
+	if token := secrets[1]; token.Source != "" || token.Destination != "" {
+		t.Errorf("stdin secret has a source or destination: %+v", token)
+	}
+
+	if err := sm.SetDestination("token", filepath.Join(home, ".config", "token")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.RemoveSecret("aws"); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := loadSecretIndex(sm.secretsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := index["aws"]; ok {
+		t.Error("removed secret is still indexed")
+	}
+	if got := index["token"].Destination; got != "~/.config/token" {
+		t.Errorf("token destination = %q, want ~/.config/token", got)
+	}
+
+	if err := sm.CanAdd(secretIndexFile, true); err == nil {
+		t.Errorf("CanAdd accepted the index file name")
+	}
+}
+
+func TestCheckSecretDestination(t *testing.T) {
+	home := t.TempDir()
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	repoFile := filepath.Join(dotpilotDir, "common", ".netrc")
+	if err := os.MkdirAll(filepath.Dir(repoFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(repoFile, []byte("repo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dotpilot-applied symlink is refused unless it may be replaced
+	managed := filepath.Join(home, ".netrc")
+	if err := os.Symlink(repoFile, managed); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSecretDestination(dotpilotDir, managed, false); !errors.Is(err, ErrManagedDestination) {
+		t.Errorf("managed symlink: err = %v, want ErrManagedDestination", err)
+	}
+	if err := CheckSecretDestination(dotpilotDir, managed, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(managed); !os.IsNotExist(err) {
+		t.Errorf("managed symlink was not removed")
+	}
+
+	// A directory linked into the repository can't be fixed by removing a link
+	linkedDir := filepath.Join(home, ".config")
+	if err := os.Symlink(filepath.Join(dotpilotDir, "common"), linkedDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSecretDestination(dotpilotDir, filepath.Join(linkedDir, "token"), true); !errors.Is(err, ErrManagedDestination) {
+		t.Errorf("linked parent: err = %v, want ErrManagedDestination", err)
+	}
+
+	// Symlinks elsewhere and regular files are fine
+	other := filepath.Join(home, ".other")
+	if err := os.Symlink(filepath.Join(home, "elsewhere"), other); err != nil {
+		t.Fatal(err)
+	}
+	for _, dest := range []string{other, filepath.Join(home, ".absent")} {
+		if err := CheckSecretDestination(dotpilotDir, dest, false); err != nil {
+			t.Errorf("%s: %v", dest, err)
+		}
+	}
+	if _, err := os.Lstat(other); err != nil {
+		t.Errorf("unmanaged symlink was removed")
+	}
+}
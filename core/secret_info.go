@@ -0,0 +1,81 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SecretInfo describes a stored secret and its encrypted blob. It is read
+// from the metadata index and the file system only, without gpg or sops, so
+// it is available offline and without the keys.
+type SecretInfo struct {
+	SecretMetadata
+	Path string      `json:"path"` // The encrypted blob
+	Size int64       `json:"size"` // Size of the blob in bytes
+	Mode os.FileMode `json:"mode"` // Permissions of the blob
+	// Indexed is whether the secret has an index entry; secrets added before
+	// the index existed only have what can be inferred from the blob
+	Indexed bool `json:"indexed"`
+	// Changed is whether the blob no longer has the hash recorded in the
+	// index, like after a merge or an edit outside dotpilot
+	Changed bool `json:"changed"`
+}
+
+// secretInfo returns what is known about the secret name as seen from
+// environment, with the backend of a secret without an index entry guessed
+// by inferBackend
+func secretInfo(secretsDir, environment, name string, inferBackend func(path string) string) (*SecretInfo, error) {
+	dir, err := locateSecret(secretsDir, environment, name)
+	if err != nil {
+		return nil, err
+	}
+	index, err := loadSecretIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, name)
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := blobHash(path)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, indexed := index[name]
+	if !indexed {
+		meta = SecretMetadata{
+			Name:    name,
+			Backend: inferBackend(path),
+			Added:   stat.ModTime().UTC().Truncate(time.Second),
+			SHA256:  hash,
+		}
+	}
+	if dir != secretsDir {
+		meta.Environment = environment
+	}
+
+	return &SecretInfo{
+		SecretMetadata: meta,
+		Path:           path,
+		Size:           stat.Size(),
+		Mode:           stat.Mode().Perm(),
+		Indexed:        indexed,
+		Changed:        indexed && meta.SHA256 != hash,
+	}, nil
+}
+
+// Info returns the metadata of a secret and its blob without decrypting it
+func (sm *SecretManager) Info(name string) (*SecretInfo, error) {
+	return secretInfo(sm.secretsDir, sm.environment, name, inferSecretBackend)
+}
+
+// Info returns the metadata of a secret and its blob without decrypting it
+func (sm *SopsManager) Info(name string) (*SecretInfo, error) {
+	return secretInfo(sm.secretsDir, sm.environment, name, func(string) string {
+		return BackendSops
+	})
+}
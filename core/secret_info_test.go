@@ -0,0 +1,67 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretInfo(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	sm := NewSecretManager(dotpilotDir)
+	sm.useGPG = false
+	if err := sm.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.EncryptData([]byte("token"), "token"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.SetDestination("token", filepath.Join(home, ".config", "token")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.ForEnvironment("prod").EncryptData([]byte("prod token"), "api_key"); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := sm.Info("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dotpilotDir, "secrets", "token")
+	stat, _ := os.Stat(path)
+	if !info.Indexed || info.Changed || info.Backend != BackendAES || info.Destination != "~/.config/token" || info.Path != path || info.Size != stat.Size() || info.Mode != stat.Mode().Perm() || info.Layer() != "common" {
+		t.Errorf("unexpected info for token: %+v", info)
+	}
+
+	// A secret of an environment
+	if info, err := sm.ForEnvironment("prod").Info("api_key"); err != nil || info.Layer() != "envs/prod" {
+		t.Errorf("info of api_key = %+v, %v", info, err)
+	}
+	if _, err := sm.Info("api_key"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("info of a secret of another environment = %v, want ErrSecretNotFound", err)
+	}
+
+	// A blob changed outside dotpilot
+	if err := os.WriteFile(path, []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := sm.Info("token"); err != nil || !info.Changed {
+		t.Errorf("info of a changed secret = %+v, %v", info, err)
+	}
+
+	// A secret added before the index existed
+	if err := os.WriteFile(filepath.Join(dotpilotDir, "secrets", "legacy"), []byte("-----BEGIN PGP MESSAGE-----\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	info, err = sm.Info("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Indexed || info.Changed || info.Backend != BackendGPG || info.SHA256 == "" || info.Added.IsZero() || info.Mode != 0640 {
+		t.Errorf("unexpected info for legacy: %+v", info)
+	}
+}
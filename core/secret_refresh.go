@@ -0,0 +1,240 @@
+package core
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/dotpilot/utils"
+)
+
+// Refreshing secrets after a pull
+//
+// A secret decrypted to its destination goes stale when a pull brings a new
+// version of its blob. With Options["reencrypt_on_pull"] in ~/.dotpilotrc,
+// sync decrypts the secrets whose blob changed again after pulling, before
+// the post-pull hooks run. A blob changed when the hash the pulled index
+// records for it differs from the one before the pull.
+//
+// Only unlocked secrets are refreshed: those whose plaintext is at their
+// recorded destination on this machine. A secret that was never decrypted
+// here, or whose plaintext was removed, stays locked, as do secrets added by
+// the pull.
+
+// reencryptOnPullOption is the option of ~/.dotpilotrc that turns refreshing
+// on
+const reencryptOnPullOption = "reencrypt_on_pull"
+
+// ReencryptOnPull reports whether Options["reencrypt_on_pull"] asks sync to
+// refresh the secrets a pull changed
+func ReencryptOnPull() bool {
+	enabled, _ := GetConfig().Options[reencryptOnPullOption].(bool)
+	return enabled
+}
+
+// SetReencryptOnPull turns refreshing secrets after a pull on or off in
+// ~/.dotpilotrc
+func SetReencryptOnPull(enabled bool) error {
+	if currentConfig.Options == nil {
+		currentConfig.Options = make(map[string]interface{})
+	}
+	if enabled {
+		currentConfig.Options[reencryptOnPullOption] = true
+	} else {
+		delete(currentConfig.Options, reencryptOnPullOption)
+	}
+
+	home, err := Home()
+	if err != nil {
+		return err
+	}
+
+	configPath := filepath.Join(home, ".dotpilotrc")
+	return SaveConfig(configPath)
+}
+
+// SecretRefresh is what happened to a secret whose blob changed
+type SecretRefresh struct {
+	Secret      SecretMetadata
+	Destination string // Absolute path of the plaintext, empty if none is recorded
+	Refreshed   bool
+	Skipped     string // Why a secret that wasn't refreshed was left alone, empty on error
+	Err         error
+}
+
+// RefreshChangedSecrets decrypts the secrets of environment, and the common
+// ones, whose blob changed since the commit oldHash again to their
+// destinations, if they are unlocked, see above. It returns one refresh per
+// changed secret.
+func RefreshChangedSecrets(dotpilotDir, home, environment string, oldHash plumbing.Hash, parallel int) ([]SecretRefresh, error) {
+	secretManager := NewSecretManager(dotpilotDir).ForEnvironment(environment)
+	secrets, err := secretManager.ListSecretMetadata()
+	if err != nil {
+		return nil, err
+	}
+	refreshes, err := refreshChangedSecrets(dotpilotDir, home, secretManager.secretsDir, secrets, oldHash, parallel, secretManager.DecryptAll)
+	if err != nil {
+		return nil, err
+	}
+
+	sopsManager := NewSopsManager(dotpilotDir).ForEnvironment(environment)
+	sopsSecrets, err := sopsManager.ListSecretMetadata()
+	if err != nil {
+		return nil, err
+	}
+	sopsRefreshes, err := refreshChangedSecrets(dotpilotDir, home, sopsManager.secretsDir, sopsSecrets, oldHash, parallel, sopsManager.DecryptAll)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(refreshes, sopsRefreshes...), nil
+}
+
+// refreshChangedSecrets refreshes those of secrets, stored in secretsDir,
+// whose blob changed since oldHash with decryptAll
+func refreshChangedSecrets(dotpilotDir, home, secretsDir string, secrets []SecretMetadata, oldHash plumbing.Hash, parallel int, decryptAll func([]SecretRestore, int) []error) ([]SecretRefresh, error) {
+	changed, err := changedSecretsSince(dotpilotDir, secretsDir, secrets, oldHash)
+	if err != nil || len(changed) == 0 {
+		return nil, err
+	}
+
+	refreshes := make([]SecretRefresh, len(changed))
+	var restores []SecretRestore
+	var pending []int
+	for i, s := range changed {
+		refreshes[i].Secret = s
+		if s.Destination == "" {
+			refreshes[i].Skipped = "no destination recorded"
+			continue
+		}
+
+		destPath, err := utils.ExpandHome(home, s.Destination)
+		if err == nil {
+			destPath, err = filepath.Abs(destPath)
+		}
+		if err != nil {
+			refreshes[i].Err = err
+			continue
+		}
+		refreshes[i].Destination = destPath
+
+		if _, err := os.Lstat(destPath); os.IsNotExist(err) {
+			refreshes[i].Skipped = "locked, not decrypted on this machine"
+			continue
+		}
+		if err := CheckSecretDestination(dotpilotDir, destPath, false); err != nil {
+			refreshes[i].Err = err
+			continue
+		}
+
+		restores = append(restores, SecretRestore{Name: s.Name, Environment: s.Environment, Destination: destPath})
+		pending = append(pending, i)
+	}
+
+	for j, err := range decryptAll(restores, parallel) {
+		i := pending[j]
+		refreshes[i].Err = err
+		refreshes[i].Refreshed = err == nil
+	}
+	return refreshes, nil
+}
+
+// changedSecretsSince returns those of secrets, stored in secretsDir, whose
+// blob hash differs from the one at the commit oldHash. Secrets that didn't
+// exist at oldHash aren't included.
+func changedSecretsSince(dotpilotDir, secretsDir string, secrets []SecretMetadata, oldHash plumbing.Hash) ([]SecretMetadata, error) {
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := repoPrefix(repo, dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	oldTree, err := commitTree(repo, oldHash)
+	if err != nil {
+		return nil, err
+	}
+
+	// The index of each secrets directory before the pull
+	oldIndexes := make(map[string]map[string]SecretMetadata)
+	var changed []SecretMetadata
+	for _, s := range secrets {
+		rel, err := filepath.Rel(dotpilotDir, secretScopeDir(secretsDir, s.Environment))
+		if err != nil {
+			return nil, err
+		}
+		dir := prefix + filepath.ToSlash(rel)
+
+		oldIndex, ok := oldIndexes[dir]
+		if !ok {
+			if oldIndex, err = treeSecretIndex(oldTree, path.Join(dir, secretIndexFile)); err != nil {
+				return nil, err
+			}
+			oldIndexes[dir] = oldIndex
+		}
+
+		after := s.SHA256
+		if after == "" {
+			if after, err = blobHash(filepath.Join(secretScopeDir(secretsDir, s.Environment), s.Name)); err != nil {
+				return nil, err
+			}
+		}
+		before := oldIndex[s.Name].SHA256
+		if before == "" {
+			// Not indexed before the pull, hash the blob as it was
+			file, err := oldTree.File(path.Join(dir, s.Name))
+			if err == object.ErrFileNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			content, err := file.Contents()
+			if err != nil {
+				return nil, err
+			}
+			before = dataHash([]byte(content))
+		}
+
+		if before != after {
+			changed = append(changed, s)
+		}
+	}
+	return changed, nil
+}
+
+// treeSecretIndex reads the metadata index at indexPath of tree, an empty
+// index if there is none
+func treeSecretIndex(tree *object.Tree, indexPath string) (map[string]SecretMetadata, error) {
+	index := make(map[string]SecretMetadata)
+
+	file, err := tree.File(indexPath)
+	if err == object.ErrFileNotFound {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	content, err := file.Contents()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []SecretMetadata
+	if err := json.Unmarshal([]byte(content), &entries); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		index[entry.Name] = entry
+	}
+	return index, nil
+}
@@ -0,0 +1,81 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestRefreshChangedSecrets(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	sm := NewSecretManager(dotpilotDir)
+	sm.useGPG = false
+	if err := sm.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"token", "locked", "same"} {
+		if err := sm.EncryptData([]byte(name+" v1"), name); err != nil {
+			t.Fatal(err)
+		}
+		if err := sm.SetDestination(name, filepath.Join(home, "."+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only token and same are unlocked on this machine
+	for _, name := range []string{"token", "same"} {
+		if err := sm.DecryptFile(name, filepath.Join(home, "."+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CommitChanges(dotpilotDir, "initial"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := HeadHash(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What a pull brings: new versions of token and locked, and a new secret
+	// whose destination happens to exist
+	for _, name := range []string{"token", "locked", "fresh"} {
+		if err := sm.EncryptData([]byte(name+" v2"), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sm.SetDestination("fresh", filepath.Join(home, ".fresh")); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, home, ".fresh", "mine\n")
+	if err := CommitChanges(dotpilotDir, "pulled"); err != nil {
+		t.Fatal(err)
+	}
+
+	refreshes, err := RefreshChangedSecrets(dotpilotDir, home, "", before, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]SecretRefresh)
+	for _, r := range refreshes {
+		got[r.Secret.Name] = r
+	}
+	if len(got) != 2 || !got["token"].Refreshed || got["locked"].Refreshed || got["locked"].Skipped == "" {
+		t.Fatalf("refreshes %+v, want token refreshed and locked skipped", refreshes)
+	}
+
+	for name, want := range map[string]string{".token": "token v2", ".same": "same v1", ".fresh": "mine\n"} {
+		if data, err := os.ReadFile(filepath.Join(home, name)); err != nil || string(data) != want {
+			t.Errorf("%s holds %q, %v, want %q", name, data, err, want)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(home, ".locked")); !os.IsNotExist(err) {
+		t.Errorf("the locked secret was decrypted: %v", err)
+	}
+}
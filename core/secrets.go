@@ -1,12 +1,12 @@
 package core
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -24,6 +24,9 @@ type SecretManager struct {
 	dotpilotDir string
 	keyFile     string
 	secretsDir  string
+	// environment is the environment secrets are added to, and looked up in
+	// before the common secrets. Empty for the common secrets.
+	environment string
 	useGPG      bool
 }
 
@@ -31,31 +34,53 @@ type SecretManager struct {
 func NewSecretManager(dotpilotDir string) *SecretManager {
 	return &SecretManager{
 		dotpilotDir: dotpilotDir,
-		keyFile:     filepath.Join(dotpilotDir, ".secret_key"),
+		keyFile:     filepath.Join(dotpilotDir, secretKeyFile),
 		secretsDir:  filepath.Join(dotpilotDir, "secrets"),
 		useGPG:      isGPGAvailable(),
 	}
 }
 
+// ForEnvironment returns a secret manager for the secrets of environment,
+// which adds secrets to secrets/envs/<environment>/ and sees the common
+// secrets too. An empty environment or "common" selects the common secrets.
+func (sm *SecretManager) ForEnvironment(environment string) *SecretManager {
+	scoped := *sm
+	scoped.environment = scopeEnvironment(environment)
+	return &scoped
+}
+
 // isGPGAvailable checks if GPG is available on the system
 func isGPGAvailable() bool {
 	_, err := exec.LookPath("gpg")
 	return err == nil
 }
 
-// Initialize sets up the secrets directory and encryption keys
+// Initialize sets up the secrets directory. Encryption keys are only created
+// when a secret is first encrypted, so listing and removing secrets work
+// without any crypto tooling present.
 func (sm *SecretManager) Initialize() error {
 	// Create secrets directory if it doesn't exist
 	if err := os.MkdirAll(sm.secretsDir, 0700); err != nil {
 		return err
 	}
 
-	// If using GPG, no need to create a key file
-	if sm.useGPG {
-		utils.Logger.Info().Msg("Using GPG for secrets encryption")
-		return nil
+	// Keep git from diffing and merging the encrypted blobs as text
+	if err := ensureSecretAttributes(sm.dotpilotDir, sm.secretsDir); err != nil {
+		return err
 	}
 
+	// Never commit the AES key, also in repositories set up before dotpilot
+	// managed the .gitignore
+	if _, err := EnsureGitignore(sm.dotpilotDir); err != nil {
+		return err
+	}
+
+	utils.Logger.Debug().Msg("Secret manager initialized")
+	return nil
+}
+
+// ensureKey generates the AES key file if it does not exist yet
+func (sm *SecretManager) ensureKey() error {
 	// Check if key file exists
 	if _, err := os.Stat(sm.keyFile); os.IsNotExist(err) {
 		// Generate a new key
@@ -69,142 +94,297 @@ func (sm *SecretManager) Initialize() error {
 		if err := ioutil.WriteFile(sm.keyFile, []byte(encodedKey), 0600); err != nil {
 			return err
 		}
+		if err := excludeLocalFile(sm.dotpilotDir, filepath.Base(sm.keyFile)); err != nil {
+			utils.Logger.Debug().Err(err).Msg("Failed to exclude the encryption key from git")
+		}
 
 		utils.Logger.Info().Msg("Generated new encryption key")
 	}
 
-	utils.Logger.Info().Msg("Secret manager initialized")
 	return nil
 }
 
 // EncryptFile encrypts a file and stores it in the secrets directory
 func (sm *SecretManager) EncryptFile(srcPath, name string) error {
-	// Create destination path
-	destPath := filepath.Join(sm.secretsDir, name)
-
 	// Read the source file
 	data, err := ioutil.ReadFile(srcPath)
 	if err != nil {
 		return err
 	}
 
-	// Use GPG if available
+	return sm.encrypt(data, SecretMetadata{
+		Name:        name,
+		Source:      portablePath(srcPath),
+		Destination: portablePath(srcPath),
+	})
+}
+
+// EncryptData encrypts in-memory data and stores it in the secrets directory
+// without writing the plaintext to disk
+func (sm *SecretManager) EncryptData(data []byte, name string) error {
+	return sm.encrypt(data, SecretMetadata{Name: name})
+}
+
+// encrypt stores data as the secret meta names and records meta, completed
+// with the backend, in the index
+func (sm *SecretManager) encrypt(data []byte, meta SecretMetadata) error {
+	dir, err := createSecretScopeDir(sm.secretsDir, sm.environment)
+	if err != nil {
+		return err
+	}
+
+	// Create destination path
+	destPath := filepath.Join(dir, meta.Name)
+
+	backend := BackendAES
 	if sm.useGPG {
-		return sm.encryptWithGPG(data, destPath)
+		// Use GPG if available
+		utils.Logger.Debug().Msg("Using GPG for secrets encryption")
+		backend = BackendGPG
+		if err := sm.encryptWithGPG(data, destPath); err != nil {
+			return err
+		}
+	} else {
+		// Use AES otherwise
+		if err := sm.ensureKey(); err != nil {
+			return err
+		}
+		if err := sm.encryptWithAES(data, destPath); err != nil {
+			return err
+		}
 	}
 
-	// Use AES otherwise
-	return sm.encryptWithAES(data, destPath)
+	meta.Backend = backend
+	return recordSecret(dir, meta)
 }
 
+
 // DecryptFile decrypts a file from the secrets directory
 func (sm *SecretManager) DecryptFile(name, destPath string) error {
-	// Get the source path
-	srcPath := filepath.Join(sm.secretsDir, name)
+	plaintext, err := sm.DecryptData(name)
+	if err != nil {
+		return err
+	}
 
-	// Check if the file exists
-	if _, err := os.Stat(srcPath); os.IsNotExist(err) {
-		return fmt.Errorf("secret file %s does not exist", name)
+	if err := writeSecretFile(destPath, plaintext); err != nil {
+		return err
 	}
 
-	// Use GPG if available
-	if sm.useGPG {
-		return sm.decryptWithGPG(srcPath, destPath)
+	utils.Logger.Info().Msgf("Decrypted %s to %s", name, destPath)
+	return nil
+}
+
+// DecryptData decrypts a secret in memory and returns the plaintext. Nothing
+// is written to disk.
+func (sm *SecretManager) DecryptData(name string) ([]byte, error) {
+	// Get the source path, the secret of the environment hides a common one
+	dir, err := locateSecret(sm.secretsDir, sm.environment, name)
+	if err != nil {
+		return nil, err
+	}
+	srcPath := filepath.Join(dir, name)
+
+	// Pick the backend from the stored format rather than from what happens
+	// to be installed, so a GPG secret isn't fed to the AES decoder
+	data, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if looksGPGEncrypted(data) {
+		if !sm.useGPG {
+			return nil, fmt.Errorf("secret %s is encrypted with GPG but %w (%s)", name, ErrGPGUnavailable, utils.InstallHint("gpg"))
+		}
+		return sm.decryptWithGPG(srcPath)
 	}
 
 	// Use AES otherwise
-	return sm.decryptWithAES(srcPath, destPath)
+	return sm.decryptWithAES(data)
 }
 
-// ListSecrets returns a list of all secret files
+// ListSecrets returns the names of the secrets, the common ones and those of
+// the environment of the manager
 func (sm *SecretManager) ListSecrets() ([]string, error) {
-	var secrets []string
+	secrets, err := sm.ListSecretMetadata()
+	return secretNames(secrets), err
+}
+
+// ListSecretMetadata returns the metadata of the common secrets and those of
+// the environment of the manager, which hide common ones of the same name.
+// Secrets added before the metadata index existed get their backend inferred
+// from the stored blob.
+func (sm *SecretManager) ListSecretMetadata() ([]SecretMetadata, error) {
+	return listScopedSecretMetadata(sm.secretsDir, sm.environment, inferSecretBackend)
+}
+
+// ListAllSecretMetadata returns the metadata of the secrets of all
+// environments, the common ones first
+func (sm *SecretManager) ListAllSecretMetadata() ([]SecretMetadata, error) {
+	return listAllSecretMetadata(sm.secretsDir, inferSecretBackend)
+}
 
-	// Check if the secrets directory exists
-	if _, err := os.Stat(sm.secretsDir); os.IsNotExist(err) {
-		return secrets, nil
+// inferSecretBackend tells GPG and AES blobs apart for secrets without an
+// index entry
+func inferSecretBackend(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err == nil && looksGPGEncrypted(data) {
+		return BackendGPG
 	}
+	return BackendAES
+}
 
-	// Read the directory
-	files, err := ioutil.ReadDir(sm.secretsDir)
+// SetDestination records where a secret is meant to be decrypted to
+func (sm *SecretManager) SetDestination(name, destination string) error {
+	dir, err := locateSecret(sm.secretsDir, sm.environment, name)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return setSecretDestination(dir, name, destination)
+}
 
-	// Add each file to the list
-	for _, f := range files {
-		if !f.IsDir() {
-			secrets = append(secrets, f.Name())
-		}
+// EnableDiffDriver makes git show the backend, size and hash of changed
+// secrets in diffs instead of their ciphertext
+func (sm *SecretManager) EnableDiffDriver() error {
+	return enableSecretDiff(sm.dotpilotDir, sm.secretsDir)
+}
+
+// CanAdd returns ErrSecretExists if a secret with the given name already
+// exists and overwriting was not requested
+func (sm *SecretManager) CanAdd(name string, overwrite bool) error {
+	if err := validateSecretName(name); err != nil {
+		return err
+	}
+	if err := validateSecretEnvironment(sm.environment); err != nil {
+		return err
+	}
+	if overwrite {
+		return nil
 	}
 
-	return secrets, nil
+	if _, err := os.Stat(filepath.Join(secretScopeDir(sm.secretsDir, sm.environment), name)); err == nil {
+		return fmt.Errorf("%w: %s", ErrSecretExists, name)
+	}
+	return nil
 }
 
-// RemoveSecret removes a secret file
+// RemoveSecret removes a secret file. Only a secret of the environment of the
+// manager is removed, never a common one it hides.
 func (sm *SecretManager) RemoveSecret(name string) error {
+	if err := validateSecretName(name); err != nil {
+		return err
+	}
+	if err := validateSecretEnvironment(sm.environment); err != nil {
+		return err
+	}
+
 	// Get the file path
-	path := filepath.Join(sm.secretsDir, name)
+	dir := secretScopeDir(sm.secretsDir, sm.environment)
+	path := filepath.Join(dir, name)
 
 	// Check if the file exists
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return fmt.Errorf("secret file %s does not exist", name)
+		return fmt.Errorf("%w: %s", ErrSecretNotFound, name)
 	}
 
-	// Remove the file
-	return os.Remove(path)
+	// Remove the file and its metadata
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return forgetSecret(dir, name)
 }
 
-// encryptWithGPG encrypts data using GPG
-func (sm *SecretManager) encryptWithGPG(data []byte, destPath string) error {
-	// Get GPG recipient (default to user's GPG ID)
-	recipient, err := getGPGRecipient()
+// CheckSecretDestination makes sure decrypting a secret to destPath cannot
+// write the plaintext into the dotpilot repository. A destination that is a
+// symlink into the repository, like a file applied by dotpilot, is removed when
+// replaceLink is set so the secret is written as a regular file instead. Without
+// replaceLink, and for destinations whose parent directory lies inside the
+// repository, it returns an error wrapping ErrManagedDestination. Any other
+// symlink is followed, which is reported with a warning.
+func CheckSecretDestination(dotpilotDir, destPath string, replaceLink bool) error {
+	repoDir, err := filepath.EvalSymlinks(dotpilotDir)
 	if err != nil {
 		return err
 	}
 
-	// Create a temp file for input
-	tmpfile, err := ioutil.TempFile("", "dotpilot-gpg-*")
+	// The destination directory itself may be (a link into) the repository
+	if parentDir, err := filepath.EvalSymlinks(filepath.Dir(destPath)); err == nil && insideDir(parentDir, repoDir) {
+		return fmt.Errorf("%w: %s resolves to %s", ErrManagedDestination, filepath.Dir(destPath), parentDir)
+	}
+
+	info, err := os.Lstat(destPath)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+
+	linkTarget, err := os.Readlink(destPath)
 	if err != nil {
 		return err
 	}
-	defer os.Remove(tmpfile.Name())
+	if !filepath.IsAbs(linkTarget) {
+		linkTarget = filepath.Join(filepath.Dir(destPath), linkTarget)
+	}
+	resolved, err := filepath.EvalSymlinks(linkTarget)
+	if err != nil {
+		// A dangling link, the secret would be created where it points
+		resolved = filepath.Clean(linkTarget)
+	}
 
-	// Write data to temp file
-	if _, err := tmpfile.Write(data); err != nil {
-		return err
+	if !insideDir(resolved, repoDir) {
+		utils.Logger.Warn().Msgf("%s is a symlink, the secret will be written to %s", destPath, resolved)
+		return nil
+	}
+
+	if !replaceLink {
+		return fmt.Errorf("%w: %s is a symlink to %s, decrypting over it would store the plaintext in the repository", ErrManagedDestination, destPath, resolved)
 	}
-	if err := tmpfile.Close(); err != nil {
+
+	utils.Logger.Warn().Msgf("Replacing the symlink %s -> %s with the decrypted secret", destPath, resolved)
+	return os.Remove(destPath)
+}
+
+// encryptWithGPG encrypts data using GPG
+func (sm *SecretManager) encryptWithGPG(data []byte, destPath string) error {
+	// Get GPG recipient (default to user's GPG ID)
+	recipient, err := getGPGRecipient()
+	if err != nil {
 		return err
 	}
 
-	// Use GPG to encrypt
-	cmd := exec.Command("gpg", "--encrypt", "--recipient", recipient, "--output", destPath, tmpfile.Name())
+	// Use GPG to encrypt, feeding the plaintext on stdin so it never touches disk
+	cmd := exec.Command("gpg", "--yes", "--encrypt", "--recipient", recipient, "--output", destPath)
+	cmd.Stdin = bytes.NewReader(data)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("gpg encryption failed: %s - %s", err, string(output))
+		return fmt.Errorf("gpg %w: %s - %s", ErrEncryptFailed, err, string(output))
 	}
 
 	utils.Logger.Info().Msgf("Encrypted file with GPG to %s", destPath)
 	return nil
 }
 
-// decryptWithGPG decrypts a file using GPG
-func (sm *SecretManager) decryptWithGPG(srcPath, destPath string) error {
-	// Use GPG to decrypt
-	cmd := exec.Command("gpg", "--decrypt", "--output", destPath, srcPath)
-	output, err := cmd.CombinedOutput()
+// decryptWithGPG decrypts a file using GPG, reading the plaintext from its
+// stdout so it never touches disk
+func (sm *SecretManager) decryptWithGPG(srcPath string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("gpg", "--decrypt", srcPath)
+	cmd.Stderr = &stderr
+	plaintext, err := cmd.Output()
 	if err != nil {
-		return fmt.Errorf("gpg decryption failed: %s - %s", err, string(output))
+		return nil, fmt.Errorf("gpg %w: %s - %s", ErrDecryptFailed, err, stderr.String())
 	}
+	return plaintext, nil
+}
 
-	// Set correct permissions on the output file
-	if err := os.Chmod(destPath, 0600); err != nil {
-		return err
+// looksGPGEncrypted reports whether data is an OpenPGP message rather than the
+// base64 text written by encryptWithAES
+func looksGPGEncrypted(data []byte) bool {
+	if strings.HasPrefix(string(data), "-----BEGIN PGP MESSAGE") {
+		return true
 	}
 
-	utils.Logger.Info().Msgf("Decrypted file with GPG to %s", destPath)
-	return nil
+	// Binary OpenPGP packets always have the high bit of the first byte set,
+	// which never happens in base64 text
+	return len(data) > 0 && data[0]&0x80 != 0
 }
 
 // getGPGRecipient gets the default GPG key ID
@@ -233,7 +413,7 @@ func getGPGRecipient() (string, error) {
 		}
 	}
 
-	return "", errors.New("unable to find GPG key, please specify recipient manually")
+	return "", fmt.Errorf("%w, please specify recipient manually", ErrNoGPGKey)
 }
 
 // encryptWithAES encrypts data using AES-256-GCM
@@ -292,34 +472,25 @@ func (sm *SecretManager) encryptWithAES(data []byte, destPath string) error {
 	return nil
 }
 
-// decryptWithAES decrypts a file using AES-256-GCM
-func (sm *SecretManager) decryptWithAES(srcPath, destPath string) error {
+// decryptWithAES decrypts data written by encryptWithAES
+func (sm *SecretManager) decryptWithAES(data []byte) ([]byte, error) {
 	// Get the encryption key
 	key, err := sm.getEncryptionKey()
 	if err != nil {
-		return err
-	}
-
-	// Read the encrypted data
-	data, err := ioutil.ReadFile(srcPath)
-	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Decode from base64
 	decoded, err := base64.StdEncoding.DecodeString(string(data))
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%w: %v", ErrDecryptFailed, err)
 	}
 
-	// Extract salt, nonce, and ciphertext
-	if len(decoded) < 32 {
-		return errors.New("invalid encrypted data format")
+	// Extract the salt
+	if len(decoded) < 16 {
+		return nil, fmt.Errorf("%w: invalid encrypted data format", ErrDecryptFailed)
 	}
-
 	salt := decoded[:16]
-	nonce := decoded[16:32]
-	ciphertext := decoded[32:]
 
 	// Derive the key using PBKDF2
 	derivedKey := pbkdf2.Key(key, salt, 4096, 32, sha256.New)
@@ -327,27 +498,62 @@ func (sm *SecretManager) decryptWithAES(srcPath, destPath string) error {
 	// Create a new AES cipher block
 	block, err := aes.NewCipher(derivedKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Create a new GCM cipher mode
 	gcm, err := cipher.NewGCM(block)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// Extract the nonce and ciphertext; the nonce is written with the GCM
+	// nonce size, not the salt size
+	nonceEnd := 16 + gcm.NonceSize()
+	if len(decoded) < nonceEnd {
+		return nil, fmt.Errorf("%w: invalid encrypted data format", ErrDecryptFailed)
 	}
+	nonce := decoded[16:nonceEnd]
+	ciphertext := decoded[nonceEnd:]
 
 	// Decrypt the data
 	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%w: %v", ErrDecryptFailed, err)
 	}
 
-	// Write to file
-	if err := ioutil.WriteFile(destPath, plaintext, 0600); err != nil {
+	return plaintext, nil
+}
+
+// writeSecretFile writes decrypted plaintext to path. The data goes to a
+// temporary file created with mode 0600 that then replaces path, so it is
+// never readable by others, not even when path existed with looser
+// permissions. A symlink at path is followed, as a plain write would.
+func writeSecretFile(path string, data []byte) error {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
 		return err
 	}
+	tmpPath := tmp.Name()
+	defer utils.Cleanup.AddFile(tmpPath)()
 
-	utils.Logger.Info().Msgf("Decrypted file with AES to %s", destPath)
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		utils.ShredFile(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		utils.ShredFile(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		utils.ShredFile(tmpPath)
+		return err
+	}
 	return nil
 }
 
@@ -0,0 +1,146 @@
+package core
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDecryptDataWritesNothing(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("TMPDIR", t.TempDir())
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	sm := NewSecretManager(dotpilotDir)
+	sm.useGPG = false
+	if err := sm.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.EncryptData([]byte("s3cret"), "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	before := listTree(t, home)
+	tmpBefore := listTree(t, os.Getenv("TMPDIR"))
+	plaintext, err := sm.DecryptData("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "s3cret" {
+		t.Errorf("DecryptData = %q, want %q", plaintext, "s3cret")
+	}
+	if after := listTree(t, home); !reflect.DeepEqual(after, before) {
+		t.Errorf("decrypting changed the files in home: %v, was %v", after, before)
+	}
+	if after := listTree(t, os.Getenv("TMPDIR")); !reflect.DeepEqual(after, tmpBefore) {
+		t.Errorf("decrypting left temporary files: %v", after)
+	}
+
+	if _, err := sm.DecryptData("missing"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("DecryptData(missing) = %v, want ErrSecretNotFound", err)
+	}
+
+	// A damaged blob fails to decrypt
+	blob := filepath.Join(secretScopeDir(sm.secretsDir, sm.environment), "token")
+	if err := os.WriteFile(blob, []byte(base64.StdEncoding.EncodeToString(make([]byte, 64))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.DecryptData("token"); !errors.Is(err, ErrDecryptFailed) {
+		t.Errorf("DecryptData(damaged) = %v, want ErrDecryptFailed", err)
+	}
+}
+
+// listTree returns every path below dir
+func listTree(t *testing.T, dir string) []string {
+	t.Helper()
+
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestSecretsScopedToEnvironments(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	common := NewSecretManager(dotpilotDir)
+	common.useGPG = false
+	if err := common.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A flat secret from before environments had secrets is common
+	for name, value := range map[string]string{"shared": "shared", "api_key": "common key"} {
+		if err := common.EncryptData([]byte(value), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dev := common.ForEnvironment("dev")
+	if err := dev.EncryptData([]byte("dev key"), "api_key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := common.ForEnvironment("prod").EncryptData([]byte("prod only"), "deploy"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dotpilotDir, "secrets", "envs", "dev", "api_key")); err != nil {
+		t.Fatalf("the dev secret isn't stored below secrets/envs/dev: %v", err)
+	}
+
+	// The environment sees its own secrets and the common ones, and hides
+	// common ones of the same name
+	secrets, err := dev.ListSecretMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range secrets {
+		got = append(got, s.Layer()+"/"+s.Name)
+	}
+	if want := []string{"envs/dev/api_key", "common/shared"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("dev secrets = %v, want %v", got, want)
+	}
+	if plaintext, err := dev.DecryptData("api_key"); err != nil || string(plaintext) != "dev key" {
+		t.Errorf("dev api_key = %q, %v", plaintext, err)
+	}
+	if plaintext, err := dev.DecryptData("shared"); err != nil || string(plaintext) != "shared" {
+		t.Errorf("dev shared = %q, %v", plaintext, err)
+	}
+	if _, err := dev.DecryptData("deploy"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("dev sees the prod secret: %v", err)
+	}
+	if names, err := common.ListSecrets(); err != nil || !reflect.DeepEqual(names, []string{"api_key", "shared"}) {
+		t.Errorf("common secrets = %v, %v", names, err)
+	}
+	if all, err := common.ListAllSecretMetadata(); err != nil || len(all) != 4 {
+		t.Errorf("all secrets = %+v, %v, want 4", all, err)
+	}
+
+	// Removing the dev secret leaves the common one it hid
+	if err := dev.RemoveSecret("shared"); !errors.Is(err, ErrSecretNotFound) {
+		t.Errorf("removing a common secret from dev = %v, want ErrSecretNotFound", err)
+	}
+	if err := dev.RemoveSecret("api_key"); err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := dev.DecryptData("api_key"); err != nil || string(plaintext) != "common key" {
+		t.Errorf("dev api_key after removing it = %q, %v", plaintext, err)
+	}
+
+	if err := common.ForEnvironment("../escape").EncryptData([]byte("x"), "x"); err == nil {
+		t.Errorf("an environment outside the secrets directory was accepted")
+	}
+}
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+)
+
+// sensitiveScanLimit is how much of a file LooksSensitive is given when
+// tracking, secrets are near the top of the files they are in
+const sensitiveScanLimit = 1 << 20
+
+// Patterns of content that must not be committed as plaintext
+var (
+	privateKeyPattern   = regexp.MustCompile(`-----BEGIN (?:[A-Z0-9]+ )*PRIVATE KEY(?: BLOCK)?-----`)
+	awsAccessKeyPattern = regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)
+	awsSecretKeyPattern = regexp.MustCompile(`(?i)aws_secret_access_key\s*[:=]\s*["']?[A-Za-z0-9/+]{40}\b`)
+	sopsValuePattern    = regexp.MustCompile(`ENC\[AES256_GCM,data:`)
+	tokenPattern        = regexp.MustCompile(`[A-Za-z0-9+/_-]{40,}={0,2}`)
+)
+
+// minTokenEntropy is the Shannon entropy in bits per character above which a
+// long token looks random. Hex strings such as commit hashes stay below 4,
+// base64 encoded keys and API tokens are above 4.5.
+const minTokenEntropy = 4.5
+
+// LooksSensitive reports whether data looks like it holds a secret that
+// shouldn't be stored in git as plaintext, and why: private keys, AWS access
+// keys, files already encrypted with SOPS and long random-looking tokens.
+// Binary data is only checked for the text markers.
+func LooksSensitive(data []byte) (bool, string) {
+	switch {
+	case privateKeyPattern.Match(data):
+		return true, "contains a private key"
+	case awsAccessKeyPattern.Match(data):
+		return true, "contains an AWS access key ID"
+	case awsSecretKeyPattern.Match(data):
+		return true, "contains an AWS secret access key"
+	case sopsValuePattern.Match(data):
+		return true, "is encrypted with SOPS"
+	}
+
+	if bytes.IndexByte(data, 0) >= 0 {
+		return false, ""
+	}
+	for _, token := range tokenPattern.FindAll(data, -1) {
+		// SSH public keys, as in authorized_keys or a git signing key, are
+		// base64 of a blob starting with a zero length byte
+		if bytes.HasPrefix(token, []byte("AAAA")) {
+			continue
+		}
+		if looksRandom(token) {
+			return true, fmt.Sprintf("contains a random-looking token (%s...)", token[:6])
+		}
+	}
+	return false, ""
+}
+
+// looksRandom reports whether token mixes upper case letters, lower case
+// letters and digits with a high entropy, as keys and tokens do and words,
+// paths and hashes don't
+func looksRandom(token []byte) bool {
+	var upper, lower, digit bool
+	counts := map[byte]int{}
+	for _, c := range token {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= '0' && c <= '9':
+			digit = true
+		}
+		counts[c]++
+	}
+	if !upper || !lower || !digit {
+		return false
+	}
+
+	var entropy float64
+	for _, n := range counts {
+		p := float64(n) / float64(len(token))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy >= minTokenEntropy
+}
+
+// fileLooksSensitive runs LooksSensitive on the start of a file
+func fileLooksSensitive(path string) (bool, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, "", err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, sensitiveScanLimit))
+	if err != nil {
+		return false, "", err
+	}
+	sensitive, reason := LooksSensitive(data)
+	return sensitive, reason, nil
+}
+
+// checkSensitive returns an error wrapping ErrSensitiveContent for the first
+// file below source that looks sensitive. Symlinks are tracked as links, not
+// copied, and are not checked, except for the symlinked directories follow
+// accepts, see walkTree.
+func checkSensitive(source string, follow func(path string) bool) error {
+	return walkTree(source, follow, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		sensitive, reason, err := fileLooksSensitive(path)
+		if err != nil {
+			return err
+		}
+		if sensitive {
+			return fmt.Errorf("%w: %s %s", ErrSensitiveContent, path, reason)
+		}
+		return nil
+	})
+}
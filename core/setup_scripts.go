@@ -0,0 +1,183 @@
+package core
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dotpilot/utils"
+)
+
+// Setup scripts
+//
+// Bootstrap runs the setup scripts of each layer: install_packages.sh, then
+// the scripts in setup.d/. The install_packages.sh scripts of all layers come
+// first and always one after the other, since package managers take a lock
+// and the other scripts may configure what they installed. The setup.d
+// scripts run in the order of the number their name starts with, like
+// 10-fonts.sh before 20-shell.sh, then the ones without a number. With
+// parallel, the scripts sharing a number run at the same time, across layers.
+
+// setupScriptName is the package install script of a layer
+const setupScriptName = "install_packages.sh"
+
+// setupScriptsDir is the directory of a layer holding further setup scripts
+const setupScriptsDir = "setup.d"
+
+// Stages of setup scripts without a number
+const (
+	packagesStage   = -1
+	unnumberedStage = math.MaxInt
+)
+
+// SetupScript is a setup script of a layer
+type SetupScript struct {
+	// Name is the slash-separated path of the script relative to the
+	// repository, like common/setup.d/10-fonts.sh
+	Name  string
+	Path  string
+	stage int
+}
+
+// ScriptFailure is a setup script that failed
+type ScriptFailure struct {
+	Script SetupScript
+	Err    error
+}
+
+// FindSetupScripts returns the setup scripts of layers, slash-separated layer
+// directories like "common" or "envs/dev" in the order they are applied, in
+// the order they run
+func FindSetupScripts(dotpilotDir string, layers []string) ([]SetupScript, error) {
+	var scripts []SetupScript
+	for _, layer := range layers {
+		layerDir := filepath.Join(dotpilotDir, filepath.FromSlash(layer))
+		if info, err := os.Stat(filepath.Join(layerDir, setupScriptName)); err == nil && !info.IsDir() {
+			scripts = append(scripts, SetupScript{
+				Name:  path.Join(layer, setupScriptName),
+				Path:  filepath.Join(layerDir, setupScriptName),
+				stage: packagesStage,
+			})
+		}
+
+		entries, err := os.ReadDir(filepath.Join(layerDir, setupScriptsDir))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			scripts = append(scripts, SetupScript{
+				Name:  path.Join(layer, setupScriptsDir, entry.Name()),
+				Path:  filepath.Join(layerDir, setupScriptsDir, entry.Name()),
+				stage: scriptStage(entry.Name()),
+			})
+		}
+	}
+
+	// Stable, so a stage keeps the layer order and each layer's names sorted
+	sort.SliceStable(scripts, func(i, j int) bool { return scripts[i].stage < scripts[j].stage })
+	return scripts, nil
+}
+
+// scriptStage returns the number a setup.d script name starts with
+func scriptStage(name string) int {
+	digits := len(name) - len(strings.TrimLeft(name, "0123456789"))
+	stage, err := strconv.Atoi(name[:digits])
+	if err != nil {
+		return unnumberedStage
+	}
+	return stage
+}
+
+// RunSetupScripts runs scripts in order with the DOTPILOT_* variables of
+// ScriptEnv, see FindSetupScripts. A failing script doesn't stop the others,
+// the failures are returned. With parallel, the setup.d scripts sharing a
+// number run at the same time, their output logged line by line with the
+// script name as prefix.
+func RunSetupScripts(dotpilotDir, environment string, scripts []SetupScript, parallel bool) []ScriptFailure {
+	var failures []ScriptFailure
+	for start := 0; start < len(scripts); {
+		end := start + 1
+		for end < len(scripts) && scripts[end].stage == scripts[start].stage {
+			end++
+		}
+		stage := scripts[start:end]
+		start = end
+
+		if !parallel || len(stage) == 1 || stage[0].stage == packagesStage {
+			for _, script := range stage {
+				utils.Logger.Info().Msgf("Running setup script %s...", script.Name)
+				if err := RunScript(dotpilotDir, environment, script.Path); err != nil {
+					failures = append(failures, ScriptFailure{Script: script, Err: err})
+				}
+			}
+			continue
+		}
+
+		utils.Logger.Info().Msgf("Running %d setup scripts in parallel...", len(stage))
+		env := ScriptEnv(dotpilotDir, environment)
+		errs := make([]error, len(stage))
+		var wg sync.WaitGroup
+		for i, script := range stage {
+			wg.Add(1)
+			go func(i int, script SetupScript) {
+				defer wg.Done()
+				output := &logWriter{prefix: script.Name}
+				errs[i] = RunShellScript(script.Path, dotpilotDir, env, output, output)
+				output.Flush()
+			}(i, script)
+		}
+		wg.Wait()
+		for i, err := range errs {
+			if err != nil {
+				failures = append(failures, ScriptFailure{Script: stage[i], Err: err})
+			}
+		}
+	}
+	return failures
+}
+
+// logWriter logs everything written to it line by line
+type logWriter struct {
+	prefix string
+	mu     sync.Mutex
+	buf    bytes.Buffer
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := string(w.buf.Next(i + 1))
+		utils.Logger.Info().Msgf("[%s] %s", w.prefix, strings.TrimRight(line, "\r\n"))
+	}
+	return len(p), nil
+}
+
+// Flush logs a trailing line without a newline
+func (w *logWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.buf.Len() > 0 {
+		utils.Logger.Info().Msgf("[%s] %s", w.prefix, w.buf.String())
+		w.buf.Reset()
+	}
+}
@@ -0,0 +1,95 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSetupScriptsOrder(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	logFile := filepath.Join(t.TempDir(), "log")
+	script := func(name string) {
+		t.Helper()
+		writeRepoFile(t, dotpilotDir, name, "#!/bin/sh\necho "+name+" >> '"+logFile+"'\n")
+	}
+	script("common/setup.d/20-shell.sh")
+	script("common/setup.d/10-fonts.sh")
+	script("common/setup.d/misc.sh")
+	script("envs/dev/install_packages.sh")
+	script("envs/dev/setup.d/10-dev.sh")
+	script("common/install_packages.sh")
+	writeRepoFile(t, dotpilotDir, "envs/dev/setup.d/20-fail.sh", "#!/bin/sh\nexit 3\n")
+	writeRepoFile(t, dotpilotDir, "common/setup.d/.hidden", "not a script\n")
+
+	scripts, err := FindSetupScripts(dotpilotDir, []string{"common", "envs/dev", "machine/none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Packages first, then by number across layers, unnumbered last
+	want := []string{
+		"common/install_packages.sh",
+		"envs/dev/install_packages.sh",
+		"common/setup.d/10-fonts.sh",
+		"envs/dev/setup.d/10-dev.sh",
+		"common/setup.d/20-shell.sh",
+		"envs/dev/setup.d/20-fail.sh",
+		"common/setup.d/misc.sh",
+	}
+	var names []string
+	for _, s := range scripts {
+		names = append(names, s.Name)
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("setup scripts = %v, want %v", names, want)
+	}
+
+	for _, parallel := range []bool{false, true} {
+		os.Remove(logFile)
+		failures := RunSetupScripts(dotpilotDir, "dev", scripts, parallel)
+		if len(failures) != 1 || failures[0].Script.Name != "envs/dev/setup.d/20-fail.sh" {
+			t.Errorf("parallel %v: failures = %+v, want 20-fail.sh", parallel, failures)
+		}
+
+		data, err := os.ReadFile(logFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ran := strings.Fields(string(data))
+		if len(ran) != 6 {
+			t.Fatalf("parallel %v: ran %v", parallel, ran)
+		}
+		if !parallel && !reflect.DeepEqual(ran, append(want[:5:5], want[6])) {
+			t.Errorf("ran %v in the wrong order", ran)
+		}
+		// In parallel only scripts sharing a number may swap
+		if parallel && (ran[0] != want[0] || ran[1] != want[1] || ran[4] != want[4] || ran[5] != want[6]) {
+			t.Errorf("ran %v in parallel, stages out of order", ran)
+		}
+	}
+}
+
+func TestSetupScriptsRunInParallel(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	signals := t.TempDir()
+
+	// Each script waits for the other, which only works if they run at the
+	// same time
+	wait := func(self, other string) string {
+		return "#!/bin/sh\ntouch '" + filepath.Join(signals, self) + "'\n" +
+			"for i in $(seq 50); do [ -e '" + filepath.Join(signals, other) + "' ] && exit 0; sleep 0.1; done\nexit 1\n"
+	}
+	writeRepoFile(t, dotpilotDir, "common/setup.d/10-a.sh", wait("a", "b"))
+	writeRepoFile(t, dotpilotDir, "envs/dev/setup.d/10-b.sh", wait("b", "a"))
+
+	scripts, err := FindSetupScripts(dotpilotDir, []string{"common", "envs/dev"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures := RunSetupScripts(dotpilotDir, "dev", scripts, true); len(failures) != 0 {
+		t.Errorf("failures = %+v", failures)
+	}
+}
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"bytes"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// Shadowed targets
+//
+// Layers are applied in order and a later layer wins: a file in envs/<env>/
+// replaces the link to the same file in common/. That is intended, but it is
+// invisible, and the common/ copy becomes a dead file that is easy to edit by
+// mistake. FindShadows reports every target defined in more than one active
+// layer.
+
+// Shadow is a target that is defined in more than one active layer
+type Shadow struct {
+	Target   string         // Path relative to the home directory, slash-separated
+	Winner   string         // Repo path of the file that is applied
+	Shadowed []ShadowedFile // Files of earlier layers that are never applied
+}
+
+// ShadowedFile is a layer file hidden by a later layer
+type ShadowedFile struct {
+	RepoPath string
+	Differs  bool // Whether its content differs from the winner
+}
+
+// FindShadows returns the targets defined in more than one of the layers
+// applied for environment, sorted by target
+func FindShadows(dotpilotDir, environment string) ([]Shadow, error) {
+	configDirs, err := activeLayers(dotpilotDir, environment)
+	if err != nil {
+		return nil, err
+	}
+	return findShadows(dotpilotDir, configDirs)
+}
+
+// findShadows returns the targets defined in more than one of configDirs,
+// which are given in the order they are applied
+func findShadows(dotpilotDir string, configDirs []string) ([]Shadow, error) {
+	definitions := make(map[string][]string)
+	var targets []string
+	for _, configDir := range configDirs {
+		files, err := layerFiles(dotpilotDir, configDir)
+		if err != nil {
+			return nil, err
+		}
+		for relPath, path := range files {
+			if _, ok := definitions[relPath]; !ok {
+				targets = append(targets, relPath)
+			}
+			definitions[relPath] = append(definitions[relPath], path)
+		}
+	}
+
+	var shadows []Shadow
+	for _, target := range targets {
+		paths := definitions[target]
+		if len(paths) < 2 {
+			continue
+		}
+
+		winnerPath := paths[len(paths)-1]
+		winnerData, err := readLayerFile(winnerPath)
+		if err != nil {
+			return nil, err
+		}
+		winner, err := RepoPath(dotpilotDir, winnerPath)
+		if err != nil {
+			return nil, err
+		}
+
+		shadow := Shadow{Target: target, Winner: winner}
+		for _, path := range paths[:len(paths)-1] {
+			data, err := readLayerFile(path)
+			if err != nil {
+				return nil, err
+			}
+			repoPath, err := RepoPath(dotpilotDir, path)
+			if err != nil {
+				return nil, err
+			}
+			shadow.Shadowed = append(shadow.Shadowed, ShadowedFile{RepoPath: repoPath, Differs: !bytes.Equal(data, winnerData)})
+		}
+		shadows = append(shadows, shadow)
+	}
+
+	sort.Slice(shadows, func(i, j int) bool { return shadows[i].Target < shadows[j].Target })
+	return shadows, nil
+}
+
+// layerFiles maps the slash-separated target of every file applyConfigDir
+// would link from configDir to the file's path
+func layerFiles(dotpilotDir, configDir string) (map[string]string, error) {
+	files := make(map[string]string)
+	err := walkLayerDirs(dotpilotDir, []string{configDir}, func(layer, repoPath string) error {
+		relPath := strings.TrimPrefix(repoPath, layer+"/")
+		files[strings.TrimSuffix(relPath, symlinkSuffix)] = filepath.Join(dotpilotDir, filepath.FromSlash(repoPath))
+		return nil
+	})
+	return files, err
+}
+
+// warnShadows logs a warning for each target defined in more than one of
+// configDirs. With paths set, only targets involving one of them are reported.
+func warnShadows(dotpilotDir string, configDirs []string, paths []string) {
+	shadows, err := findShadows(dotpilotDir, configDirs)
+	if err != nil {
+		utils.Logger.Debug().Err(err).Msg("Failed to check for shadowed files")
+		return
+	}
+
+	warned := false
+	for _, shadow := range shadows {
+		if paths != nil && !shadowInvolves(shadow, paths) {
+			continue
+		}
+		for _, shadowed := range shadow.Shadowed {
+			state := "identical"
+			if shadowed.Differs {
+				state = "differs"
+			}
+			utils.Logger.Warn().Msgf("~/%s: %s shadows %s (%s)", shadow.Target, shadow.Winner, shadowed.RepoPath, state)
+		}
+		warned = true
+	}
+
+	if warned {
+		utils.Logger.Info().Msg("Shadowed files are never applied, see 'dotpilot conflicts shadows'. Set \"quiet_shadows\": true in ~/.dotpilotrc to silence this.")
+	}
+}
+
+// shadowInvolves reports whether any file of shadow is one of paths
+func shadowInvolves(shadow Shadow, paths []string) bool {
+	for _, p := range paths {
+		if p == shadow.Winner {
+			return true
+		}
+		for _, shadowed := range shadow.Shadowed {
+			if p == shadowed.RepoPath {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindShadows(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dotpilotDir := t.TempDir()
+
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "common zsh\n")
+	writeRepoFile(t, dotpilotDir, "envs/dev/.zshrc", "dev zsh\n")
+	writeRepoFile(t, dotpilotDir, "common/.config/git/config", "[user]\n")
+	writeRepoFile(t, dotpilotDir, "envs/dev/.config/git/config", "[user]\n")
+	writeRepoFile(t, dotpilotDir, "common/.bashrc", "bash\n")
+	writeRepoFile(t, dotpilotDir, "envs/work/.bashrc", "work bash\n")
+	writeRepoFile(t, dotpilotDir, "common/README.md", "docs\n")
+	writeRepoFile(t, dotpilotDir, "envs/dev/README.md", "docs\n")
+
+	shadows, err := FindShadows(dotpilotDir, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Shadow{
+		{
+			Target:   ".config/git/config",
+			Winner:   "envs/dev/.config/git/config",
+			Shadowed: []ShadowedFile{{RepoPath: "common/.config/git/config", Differs: false}},
+		},
+		{
+			Target:   ".zshrc",
+			Winner:   "envs/dev/.zshrc",
+			Shadowed: []ShadowedFile{{RepoPath: "common/.zshrc", Differs: true}},
+		},
+	}
+	if !reflect.DeepEqual(shadows, want) {
+		t.Errorf("shadows = %+v, want %+v", shadows, want)
+	}
+
+	if !shadowInvolves(shadows[1], []string{"common/.zshrc"}) {
+		t.Error("a pull changing common/.zshrc should report its shadow")
+	}
+	if shadowInvolves(shadows[1], []string{"common/.bashrc"}) {
+		t.Error("a pull changing common/.bashrc should not report the .zshrc shadow")
+	}
+}
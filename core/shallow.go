@@ -0,0 +1,61 @@
+package core
+
+import (
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Shallow clones
+//
+// init --depth only fetches the latest commits. The oldest of them are
+// recorded as shallow: their parents aren't in the repository, so walking the
+// history has to stop there instead of failing on the missing objects.
+
+// IsShallow reports whether the repository is a shallow clone that only has
+// part of the history
+func IsShallow(dotpilotDir string) (bool, error) {
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return false, err
+	}
+	shallow, err := repo.Storer.Shallow()
+	return len(shallow) > 0, err
+}
+
+// shallowBoundary returns the parents of the shallow commits, which a shallow
+// clone doesn't have. It is empty for a full clone.
+func shallowBoundary(repo *git.Repository) ([]plumbing.Hash, error) {
+	shallow, err := repo.Storer.Shallow()
+	if err != nil {
+		return nil, err
+	}
+
+	var boundary []plumbing.Hash
+	for _, hash := range shallow {
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return nil, err
+		}
+		boundary = append(boundary, commit.ParentHashes...)
+	}
+	return boundary, nil
+}
+
+// logFrom iterates over the commits reachable from hash like repo.Log, but
+// stops at the history a shallow clone has
+func logFrom(repo *git.Repository, hash plumbing.Hash, order git.LogOrder) (object.CommitIter, error) {
+	boundary, err := shallowBoundary(repo)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if order == git.LogOrderCommitterTime {
+		return object.NewCommitIterCTime(commit, nil, boundary), nil
+	}
+	return object.NewCommitPreorderIter(commit, nil, boundary), nil
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestShallowInitializeRepo(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+
+	// A remote with three commits, with the .gitignore init would add
+	remoteDir := initMainRemote(t, true)
+	seedDir := t.TempDir()
+	if _, err := git.PlainClone(seedDir, false, &git.CloneOptions{URL: remoteDir}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EnsureGitignore(seedDir); err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"one\n", "two\n"} {
+		writeRepoFile(t, seedDir, "common/.vimrc", content)
+		if err := CommitChanges(seedDir, "vimrc "+content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := PushChanges(seedDir); err != nil {
+		t.Fatal(err)
+	}
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if err := InitializeRepo(context.Background(), remoteDir, dotpilotDir, "default", nil, "", 1); err != nil {
+		t.Fatal(err)
+	}
+	if shallow, err := IsShallow(dotpilotDir); err != nil || !shallow {
+		t.Fatalf("IsShallow = %v, %v, want true", shallow, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dotpilotDir, "common", ".vimrc")); err != nil || string(data) != "two\n" {
+		t.Fatalf(".vimrc reads %q (%v)", data, err)
+	}
+
+	// The history stops at the one commit that was cloned, whose changes
+	// aren't known
+	entries, err := Log(dotpilotDir, LogOptions{Files: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Subject != "vimrc two" || len(entries[0].Files) != 0 {
+		t.Errorf("log = %+v, want the latest commit without files", entries)
+	}
+	status, err := GetRemoteStatus(dotpilotDir)
+	if err != nil || !status.Shallow || status.Ahead != 0 || status.Behind != 0 {
+		t.Errorf("remote status = %+v, %v, want shallow and in sync", status, err)
+	}
+
+	// Syncing goes on from there
+	writeRepoFile(t, seedDir, "common/.vimrc", "three\n")
+	if err := CommitChanges(seedDir, "vimrc three"); err != nil {
+		t.Fatal(err)
+	}
+	if err := PushChanges(seedDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := FetchChanges(dotpilotDir); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := GetRemoteStatus(dotpilotDir); err != nil || status.Behind != 1 {
+		t.Errorf("remote status = %+v, %v, want one behind", status, err)
+	}
+	if err := PullChanges(dotpilotDir); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := Log(dotpilotDir, LogOptions{}); err != nil || len(entries) != 2 {
+		t.Errorf("log = %+v, %v, want two commits", entries, err)
+	}
+}
@@ -0,0 +1,469 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dotpilot/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Snapshots
+//
+// A snapshot is a named checkpoint of the repository and of what it applied
+// to the home directory. The commit is recorded as an annotated git tag below
+// snapshotTagPrefix. The state of the managed targets, which ones were
+// symlinks and where they pointed, is kept in snapshotsDir together with
+// copies of the targets that were regular files, e.g. local edits that
+// replaced a symlink. Both are machine-local: tags aren't pushed and
+// snapshotsDir is kept out of git.
+
+// snapshotTagPrefix namespaces the tags of snapshots
+const snapshotTagPrefix = "dotpilot-snapshot/"
+
+// snapshotsDir holds a directory per snapshot in the dotpilot directory
+const snapshotsDir = ".snapshots"
+
+// Snapshot is a named checkpoint of the repository and the applied files
+type Snapshot struct {
+	Name        string           `json:"name"`
+	Commit      string           `json:"commit"`
+	Environment string           `json:"environment"`
+	Created     time.Time        `json:"created"`
+	Targets     []SnapshotTarget `json:"targets"`
+}
+
+// SnapshotTarget is the state of a managed target when the snapshot was taken
+type SnapshotTarget struct {
+	Path  string `json:"path"`            // Slash-separated, relative to home
+	Link  string `json:"link,omitempty"`  // Where the target linked to
+	Saved bool   `json:"saved,omitempty"` // A regular file, a copy is kept with the snapshot
+}
+
+// validateSnapshotName rejects names that aren't usable as a tag and a
+// directory name
+func validateSnapshotName(name string) error {
+	valid := name != "" && !strings.HasPrefix(name, ".") && !strings.HasPrefix(name, "-")
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._-", c)) {
+			valid = false
+		}
+	}
+	if !valid || strings.Contains(name, "..") {
+		return fmt.Errorf("invalid snapshot name %q, use letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+// snapshotDir returns where the state of a snapshot is kept
+func snapshotDir(dotpilotDir, name string) string {
+	return filepath.Join(dotpilotDir, snapshotsDir, name)
+}
+
+// CreateSnapshot tags the current commit as name and records which managed
+// targets in home are symlinks and where they point, keeping copies of the
+// ones that are regular files. Uncommitted changes aren't part of a commit,
+// so they have to be committed first.
+func CreateSnapshot(dotpilotDir, environment, name string) (*Snapshot, error) {
+	if err := validateSnapshotName(name); err != nil {
+		return nil, err
+	}
+
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := repo.Tag(snapshotTagPrefix + name); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotExists, name)
+	}
+
+	hasChanges, err := HasUncommittedChanges(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	if hasChanges {
+		return nil, fmt.Errorf("the repository has uncommitted changes, commit them with 'dotpilot commit' first")
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	home, err := Home()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedFiles(dotpilotDir, environment)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{
+		Name:        name,
+		Commit:      head.Hash().String(),
+		Environment: environment,
+		Created:     time.Now(),
+	}
+
+	// Record the state of the targets, copying regular files
+	dir := snapshotDir(dotpilotDir, name)
+	for relPath := range applied {
+		target := expandXDG(home, relPath)
+		info, err := os.Lstat(target)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(target)
+			if err != nil {
+				return nil, err
+			}
+			snapshot.Targets = append(snapshot.Targets, SnapshotTarget{Path: relPath, Link: link})
+		case info.Mode().IsRegular():
+			saved := filepath.Join(dir, "files", filepath.FromSlash(relPath))
+			if err := os.MkdirAll(filepath.Dir(saved), 0700); err != nil {
+				return nil, err
+			}
+			if err := copyFile(target, saved, info.Mode()); err != nil {
+				return nil, err
+			}
+			snapshot.Targets = append(snapshot.Targets, SnapshotTarget{Path: relPath, Saved: true})
+		}
+	}
+	sort.Slice(snapshot.Targets, func(i, j int) bool { return snapshot.Targets[i].Path < snapshot.Targets[j].Path })
+
+	if err := saveSnapshot(dotpilotDir, snapshot); err != nil {
+		return nil, err
+	}
+
+	_, err = repo.CreateTag(snapshotTagPrefix+name, head.Hash(), &git.CreateTagOptions{
+		Tagger: &object.Signature{
+			Name:  "dotpilot",
+			Email: "dotpilot@local",
+			When:  snapshot.Created,
+		},
+		Message: fmt.Sprintf("dotpilot snapshot %s", name),
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	utils.Logger.Info().Msgf("Created snapshot %s at %s with %d files", name, head.Hash().String()[:7], len(snapshot.Targets))
+	return snapshot, nil
+}
+
+// saveSnapshot writes the state file of a snapshot
+func saveSnapshot(dotpilotDir string, snapshot *Snapshot) error {
+	dir := snapshotDir(dotpilotDir, snapshot.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "state.json"), append(data, '\n'), 0600); err != nil {
+		return err
+	}
+
+	return excludeLocalFile(dotpilotDir, snapshotsDir)
+}
+
+// loadSnapshot reads the state file of a snapshot
+func loadSnapshot(dotpilotDir, name string) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(filepath.Join(snapshotDir(dotpilotDir, name), "state.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("unreadable state of snapshot %s: %w", name, err)
+	}
+	return &snapshot, nil
+}
+
+// snapshotCommit returns the commit the tag of a snapshot points to
+func snapshotCommit(repo *git.Repository, name string) (*object.Commit, error) {
+	ref, err := repo.Tag(snapshotTagPrefix + name)
+	if err == git.ErrTagNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Annotated tags point to a tag object, lightweight ones to the commit
+	if tag, err := repo.TagObject(ref.Hash()); err == nil {
+		return tag.Commit()
+	}
+	return repo.CommitObject(ref.Hash())
+}
+
+// ListSnapshots returns all snapshots, oldest first. A snapshot whose state
+// file is missing is listed with what its tag records.
+func ListSnapshots(dotpilotDir string) ([]Snapshot, error) {
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := repo.Tags()
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []Snapshot
+	err = tags.ForEach(func(ref *plumbing.Reference) error {
+		name, ok := strings.CutPrefix(ref.Name().Short(), snapshotTagPrefix)
+		if !ok {
+			return nil
+		}
+
+		if snapshot, err := loadSnapshot(dotpilotDir, name); err == nil {
+			snapshots = append(snapshots, *snapshot)
+			return nil
+		}
+
+		snapshot := Snapshot{Name: name}
+		if commit, err := snapshotCommit(repo, name); err == nil {
+			snapshot.Commit = commit.Hash.String()
+			snapshot.Created = commit.Committer.When
+		}
+		if tag, err := repo.TagObject(ref.Hash()); err == nil {
+			snapshot.Created = tag.Tagger.When
+		}
+		snapshots = append(snapshots, snapshot)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Created.Before(snapshots[j].Created) })
+	return snapshots, nil
+}
+
+// DeleteSnapshot removes the tag and the recorded state of a snapshot
+func DeleteSnapshot(dotpilotDir, name string) error {
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return err
+	}
+
+	if err := repo.DeleteTag(snapshotTagPrefix + name); err == git.ErrTagNotFound {
+		return fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	} else if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(snapshotDir(dotpilotDir, name))
+}
+
+// RestoreSnapshot returns the repository and the home directory to a
+// snapshot. The content of the tagged commit is committed on top of the
+// current branch, so history is kept and the next sync doesn't undo the
+// restore. The snapshot's environment is then applied, symlinks to files
+// that no longer exist are removed and the recorded symlinks and regular
+// files are put back. Files replaced along the way are backed up.
+func RestoreSnapshot(dotpilotDir, name string) (*Snapshot, error) {
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := snapshotCommit(repo, name)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := loadSnapshot(dotpilotDir, name)
+	if os.IsNotExist(err) {
+		utils.Logger.Warn().Msgf("The recorded state of snapshot %s is missing, only restoring the repository", name)
+		snapshot = &Snapshot{Name: name, Commit: commit.Hash.String(), Environment: GetConfig().CurrentEnvironment}
+	} else if err != nil {
+		return nil, err
+	}
+
+	hasChanges, err := HasUncommittedChanges(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	if hasChanges {
+		return nil, fmt.Errorf("the repository has uncommitted changes, commit them with 'dotpilot commit' or take a snapshot first")
+	}
+
+	home, err := Home()
+	if err != nil {
+		return nil, err
+	}
+
+	// Remember what links into the repository now, files added after the
+	// snapshot disappear with the restore
+	linked, err := appliedFiles(dotpilotDir, GetConfig().CurrentEnvironment)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := restoreCommitContent(repo, dotpilotDir, commit, fmt.Sprintf("Restored snapshot %s", name)); err != nil {
+		return nil, err
+	}
+
+	environment := snapshot.Environment
+	if environment == "" {
+		environment = "default"
+	}
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, environment, ApplyOptions{Backup: true}); err != nil {
+		return nil, err
+	}
+
+	// Remove symlinks left dangling by files the snapshot doesn't have
+	for relPath, path := range linked {
+		target := expandXDG(home, relPath)
+		if !linksTo(target, path) {
+			continue
+		}
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			utils.Logger.Info().Msgf("Removing %s, it is not part of snapshot %s", target, name)
+			if err := os.Remove(target); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, recorded := range snapshot.Targets {
+		if err := restoreSnapshotTarget(dotpilotDir, home, name, recorded); err != nil {
+			return nil, err
+		}
+	}
+
+	utils.Logger.Info().Msgf("Restored snapshot %s from %s", name, commit.Hash.String()[:7])
+	return snapshot, nil
+}
+
+// restoreCommitContent makes the files below dotpilotDir match commit and
+// commits them on top of HEAD with message, see MaybeCommit. Nothing is
+// committed if HEAD already has the same content. The files are written one by one because a
+// go-git hard reset would also delete the untracked machine-local files, like
+// the recorded snapshots themselves.
+func restoreCommitContent(repo *git.Repository, dotpilotDir string, commit *object.Commit, message string) error {
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	headCommit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return err
+	}
+	if headCommit.TreeHash == commit.TreeHash {
+		return nil
+	}
+
+	prefix, err := repoPrefix(repo, dotpilotDir)
+	if err != nil {
+		return err
+	}
+	headTree, err := headCommit.Tree()
+	if err != nil {
+		return err
+	}
+	snapshotTree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+
+	// Write the files of the snapshot that differ
+	err = snapshotTree.Files().ForEach(func(f *object.File) error {
+		relPath, ok := trimRepoPrefix(prefix, f.Name)
+		if !ok || entryHash(headTree, f.Name) == f.Hash {
+			return nil
+		}
+		return restoreStashedFile(snapshotTree, f.Name, filepath.Join(dotpilotDir, filepath.FromSlash(relPath)))
+	})
+	if err != nil {
+		return err
+	}
+
+	// Remove the files added since
+	err = headTree.Files().ForEach(func(f *object.File) error {
+		relPath, ok := trimRepoPrefix(prefix, f.Name)
+		if !ok || entryHash(snapshotTree, f.Name) != plumbing.ZeroHash {
+			return nil
+		}
+		return restoreStashedFile(snapshotTree, f.Name, filepath.Join(dotpilotDir, filepath.FromSlash(relPath)))
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = MaybeCommit(dotpilotDir, message)
+	return err
+}
+
+// restoreSnapshotTarget puts a target back the way a snapshot recorded it
+func restoreSnapshotTarget(dotpilotDir, home, name string, recorded SnapshotTarget) error {
+	target := expandXDG(home, recorded.Path)
+
+	if recorded.Link != "" {
+		if link, err := os.Readlink(target); err == nil && link == recorded.Link {
+			return nil
+		}
+		if err := backupForRestore(target); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return os.Symlink(recorded.Link, target)
+	}
+
+	if !recorded.Saved {
+		return nil
+	}
+
+	saved := filepath.Join(snapshotDir(dotpilotDir, name), "files", filepath.FromSlash(recorded.Path))
+	info, err := os.Stat(saved)
+	if err != nil {
+		return err
+	}
+	if err := backupForRestore(target); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return copyFile(saved, target, info.Mode())
+}
+
+// backupForRestore moves target out of the way. Symlinks are removed, regular
+// files are backed up first.
+func backupForRestore(target string) error {
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode().IsRegular() {
+		backupPath, err := BackupFile(target)
+		if err != nil {
+			return err
+		}
+		utils.Logger.Info().Msgf("Backed up %s to %s", target, backupPath)
+	}
+	return os.Remove(target)
+}
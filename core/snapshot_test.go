@@ -0,0 +1,104 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "v1\n")
+	writeRepoFile(t, dotpilotDir, "common/.vimrc", "repo\n")
+	if err := CommitChanges(dotpilotDir, "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "default", ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A local edit replaced the symlink of .vimrc
+	vimrc := filepath.Join(home, ".vimrc")
+	if err := os.Remove(vimrc); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, home, ".vimrc", "local\n")
+
+	snapshot, err := CreateSnapshot(dotpilotDir, "default", "before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Targets) != 2 {
+		t.Errorf("snapshot recorded %+v, want .vimrc and .zshrc", snapshot.Targets)
+	}
+	if _, err := CreateSnapshot(dotpilotDir, "default", "before"); !errors.Is(err, ErrSnapshotExists) {
+		t.Errorf("second CreateSnapshot() = %v, want ErrSnapshotExists", err)
+	}
+
+	// The risky change
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "v2\n")
+	writeRepoFile(t, dotpilotDir, "common/.newrc", "new\n")
+	if err := CommitChanges(dotpilotDir, "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "default", ApplyOptions{Backup: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RestoreSnapshot(dotpilotDir, "before"); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(home, ".zshrc")); err != nil || string(data) != "v1\n" {
+		t.Errorf(".zshrc = %q, %v, want v1", data, err)
+	}
+	if _, err := os.Lstat(filepath.Join(home, ".newrc")); !os.IsNotExist(err) {
+		t.Errorf(".newrc wasn't removed: %v", err)
+	}
+	info, err := os.Lstat(vimrc)
+	if err != nil || !info.Mode().IsRegular() {
+		t.Fatalf(".vimrc is not a regular file: %v", err)
+	}
+	if data, _ := os.ReadFile(vimrc); string(data) != "local\n" {
+		t.Errorf(".vimrc = %q, want the local edit", data)
+	}
+
+	// The restore is a new commit, history is kept
+	repo, err := git.PlainOpen(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := repo.Log(&git.LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits := 0
+	log.ForEach(func(*object.Commit) error {
+		commits++
+		return nil
+	})
+	if commits != 3 {
+		t.Errorf("%d commits, want v1, v2 and the restore", commits)
+	}
+
+	snapshots, err := ListSnapshots(dotpilotDir)
+	if err != nil || len(snapshots) != 1 || snapshots[0].Name != "before" {
+		t.Errorf("ListSnapshots() = %+v, %v", snapshots, err)
+	}
+	if err := DeleteSnapshot(dotpilotDir, "before"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RestoreSnapshot(dotpilotDir, "before"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("RestoreSnapshot() after delete = %v, want ErrSnapshotNotFound", err)
+	}
+}
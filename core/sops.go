@@ -16,9 +16,13 @@ import (
 type SopsManager struct {
 	dotpilotDir string
 	secretsDir  string
+	// environment is the environment secrets are added to, and looked up in
+	// before the common secrets. Empty for the common secrets.
+	environment string
 	hasSops     bool
 	hasGPG      bool
-	fingerprint string
+	// prepared is set once the SOPS configuration is ready for encryption
+	prepared bool
 }
 
 // NewSopsManager creates a new SOPS secret manager
@@ -39,36 +43,97 @@ func NewSopsManager(dotpilotDir string) *SopsManager {
 	return sm
 }
 
-// Initialize sets up the SOPS secrets directory and configuration
+// ForEnvironment returns a SOPS manager for the secrets of environment, which
+// adds secrets to sops-secrets/envs/<environment>/ and sees the common
+// secrets too. An empty environment or "common" selects the common secrets.
+func (sm *SopsManager) ForEnvironment(environment string) *SopsManager {
+	scoped := *sm
+	scoped.environment = scopeEnvironment(environment)
+	return &scoped
+}
+
+// Initialize sets up the SOPS secrets directory. It does not require sops or
+// gpg to be installed, so listing and removing secrets keep working on machines
+// without the crypto tooling; encrypt, decrypt and edit check for them lazily.
 func (sm *SopsManager) Initialize() error {
 	// Create secrets directory if it doesn't exist
 	if err := os.MkdirAll(sm.secretsDir, 0700); err != nil {
 		return err
 	}
 
-	// Check if we have the required tools
+	// Keep git from diffing and merging the encrypted blobs as text
+	if err := ensureSecretAttributes(sm.dotpilotDir, sm.secretsDir); err != nil {
+		return err
+	}
+
+	utils.Logger.Debug().Msg("SOPS Secret manager initialized")
+	return nil
+}
+
+// requireTools checks that the external tools needed for encryption and
+// decryption with the keys in .sops.yaml are installed
+func (sm *SopsManager) requireTools() error {
+	keys, err := sm.KeySources()
+	if err != nil {
+		return err
+	}
+	return sm.requireToolsFor(keys)
+}
+
+// requireToolsFor checks that the external tools needed for encryption and
+// decryption with keys are installed. sops reaches cloud key sources itself,
+// so gpg is only needed without one.
+func (sm *SopsManager) requireToolsFor(keys SopsKeySources) error {
 	if !sm.hasSops {
-		return fmt.Errorf("sops is not installed, please install it to use secure secrets encryption")
+		return fmt.Errorf("%w, please install it to use secure secrets encryption (%s)", ErrSopsUnavailable, utils.InstallHint("sops"))
 	}
 
-	if !sm.hasGPG {
-		return fmt.Errorf("gpg is not installed, please install it to use secure secrets encryption")
+	if !sm.hasGPG && !keys.Cloud() {
+		return fmt.Errorf("%w, please install it to use secure secrets encryption (%s)", ErrGPGUnavailable, utils.InstallHint("gpg"))
 	}
 
-	// Get or create GPG key for encryption
-	fingerprint, err := sm.getGPGFingerprint()
+	return nil
+}
+
+// prepareEncryption makes sure the tools, keys and SOPS configuration
+// required for encrypting new secrets are available. The key sources
+// configured in ~/.dotpilotrc are added to .sops.yaml, and the local GPG key
+// unless there is a cloud key source.
+func (sm *SopsManager) prepareEncryption() error {
+	if sm.prepared {
+		return nil
+	}
+
+	keys, err := sm.KeySources()
 	if err != nil {
 		return err
 	}
-	sm.fingerprint = fingerprint
-
-	// Create or update SOPS configuration file
-	err = sm.createSopsConfig()
+	configured, err := ConfiguredSopsKeySources()
 	if err != nil {
 		return err
 	}
+	added := keys.Merge(configured)
+	if err := sm.requireToolsFor(keys); err != nil {
+		return err
+	}
 
-	utils.Logger.Info().Msg("SOPS Secret manager initialized")
+	if !keys.Cloud() {
+		// Get or create GPG key for encryption
+		fingerprint, err := sm.getGPGFingerprint()
+		if err != nil {
+			return err
+		}
+		added += keys.Merge(SopsKeySources{PGP: []string{fingerprint}})
+	}
+
+	// Create or update SOPS configuration file, keeping the keys added by
+	// others
+	if added > 0 {
+		if err := sm.writeSopsConfig(keys); err != nil {
+			return err
+		}
+	}
+	sm.prepared = true
 	return nil
 }
 
@@ -88,7 +153,7 @@ func (sm *SopsManager) getGPGFingerprint() (string, error) {
 	// If no key found or error, ask user to create one
 	utils.Logger.Info().Msg("No suitable GPG key found. You need to create a GPG key for encrypting secrets.")
 	utils.Logger.Info().Msg("Run the following command to create a key: gpg --full-generate-key")
-	return "", fmt.Errorf("no GPG key available, please create one and try again")
+	return "", fmt.Errorf("%w, please create one and try again", ErrNoGPGKey)
 }
 
 // parseGPGFingerprint extracts a fingerprint from GPG output
@@ -107,31 +172,18 @@ func (sm *SopsManager) parseGPGFingerprint(output string) string {
 	return ""
 }
 
-// createSopsConfig creates or updates the SOPS configuration file
-func (sm *SopsManager) createSopsConfig() error {
-	configPath := filepath.Join(sm.dotpilotDir, ".sops.yaml")
-	
-	// Create SOPS config content
-	config := fmt.Sprintf(`---
-creation_rules:
-  - path_regex: %s/.*
-    pgp: %s
-`, sm.secretsDir, sm.fingerprint)
-
-	// Write the configuration file
-	err := ioutil.WriteFile(configPath, []byte(config), 0644)
-	if err != nil {
+// EncryptFile encrypts a file using SOPS and stores it in the secrets directory
+func (sm *SopsManager) EncryptFile(srcPath, name string) error {
+	if err := sm.prepareEncryption(); err != nil {
 		return err
 	}
 
-	utils.Logger.Debug().Msgf("Created SOPS config at %s", configPath)
-	return nil
-}
-
-// EncryptFile encrypts a file using SOPS and stores it in the secrets directory
-func (sm *SopsManager) EncryptFile(srcPath, name string) error {
 	// Create destination path
-	destPath := filepath.Join(sm.secretsDir, name)
+	dir, err := createSecretScopeDir(sm.secretsDir, sm.environment)
+	if err != nil {
+		return err
+	}
+	destPath := filepath.Join(dir, name)
 
 	// Use SOPS to encrypt the file
 	cmd := exec.Command("sops", "--encrypt", "--input-type", "json", "--output-type", "json", srcPath)
@@ -141,7 +193,7 @@ func (sm *SopsManager) EncryptFile(srcPath, name string) error {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			errOutput = string(exitErr.Stderr)
 		}
-		return fmt.Errorf("encryption failed: %v - %s", err, errOutput)
+		return fmt.Errorf("%w: %v - %s", ErrEncryptFailed, err, errOutput)
 	}
 
 	// Write encrypted data to file
@@ -151,20 +203,29 @@ func (sm *SopsManager) EncryptFile(srcPath, name string) error {
 	}
 
 	utils.Logger.Info().Msgf("Encrypted file with SOPS to %s", destPath)
-	return nil
+	return sm.record(name, srcPath)
 }
 
 // EncryptData encrypts data directly using SOPS
 func (sm *SopsManager) EncryptData(data []byte, name string) error {
+	if err := sm.prepareEncryption(); err != nil {
+		return err
+	}
+
 	// Create destination path
-	destPath := filepath.Join(sm.secretsDir, name)
+	dir, err := createSecretScopeDir(sm.secretsDir, sm.environment)
+	if err != nil {
+		return err
+	}
+	destPath := filepath.Join(dir, name)
 
 	// Create a temporary file for SOPS
 	tmpFile, err := ioutil.TempFile("", "sops-*.json")
 	if err != nil {
 		return err
 	}
-	defer os.Remove(tmpFile.Name())
+	defer utils.ShredFile(tmpFile.Name())
+	defer utils.Cleanup.AddFile(tmpFile.Name())()
 
 	// Wrap data in JSON if it's not already JSON
 	var jsonData []byte
@@ -197,7 +258,7 @@ func (sm *SopsManager) EncryptData(data []byte, name string) error {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			errOutput = string(exitErr.Stderr)
 		}
-		return fmt.Errorf("encryption failed: %v - %s", err, errOutput)
+		return fmt.Errorf("%w: %v - %s", ErrEncryptFailed, err, errOutput)
 	}
 
 	// Write encrypted data to file
@@ -207,17 +268,30 @@ func (sm *SopsManager) EncryptData(data []byte, name string) error {
 	}
 
 	utils.Logger.Info().Msgf("Encrypted data with SOPS to %s", destPath)
-	return nil
+	return sm.record(name, "")
+}
+
+// record adds the metadata of a freshly encrypted secret to the index
+func (sm *SopsManager) record(name, source string) error {
+	return recordSecret(secretScopeDir(sm.secretsDir, sm.environment), SecretMetadata{
+		Name:        name,
+		Source:      portablePath(source),
+		Destination: portablePath(source),
+		Backend:     BackendSops,
+	})
 }
 
 // DecryptFile decrypts a file from the secrets directory
 func (sm *SopsManager) DecryptFile(name, destPath string) error {
-	// Get the source path
-	srcPath := filepath.Join(sm.secretsDir, name)
+	// Get the source path, the secret of the environment hides a common one
+	dir, err := locateSecret(sm.secretsDir, sm.environment, name)
+	if err != nil {
+		return err
+	}
+	srcPath := filepath.Join(dir, name)
 
-	// Check if the file exists
-	if _, err := os.Stat(srcPath); os.IsNotExist(err) {
-		return fmt.Errorf("secret file %s does not exist", name)
+	if err := sm.requireTools(); err != nil {
+		return err
 	}
 
 	// Use SOPS to decrypt the file
@@ -228,7 +302,7 @@ func (sm *SopsManager) DecryptFile(name, destPath string) error {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			errOutput = string(exitErr.Stderr)
 		}
-		return fmt.Errorf("decryption failed: %v - %s", err, errOutput)
+		return fmt.Errorf("%w: %v - %s", ErrDecryptFailed, err, errOutput)
 	}
 
 	// Check if the data is wrapped
@@ -243,8 +317,7 @@ func (sm *SopsManager) DecryptFile(name, destPath string) error {
 	}
 
 	// Write to destination file
-	err = ioutil.WriteFile(destPath, decryptedData, 0600)
-	if err != nil {
+	if err := writeSecretFile(destPath, decryptedData); err != nil {
 		return err
 	}
 
@@ -254,12 +327,15 @@ func (sm *SopsManager) DecryptFile(name, destPath string) error {
 
 // DecryptData decrypts data directly from a file
 func (sm *SopsManager) DecryptData(name string) ([]byte, error) {
-	// Get the source path
-	srcPath := filepath.Join(sm.secretsDir, name)
+	// Get the source path, the secret of the environment hides a common one
+	dir, err := locateSecret(sm.secretsDir, sm.environment, name)
+	if err != nil {
+		return nil, err
+	}
+	srcPath := filepath.Join(dir, name)
 
-	// Check if the file exists
-	if _, err := os.Stat(srcPath); os.IsNotExist(err) {
-		return nil, fmt.Errorf("secret file %s does not exist", name)
+	if err := sm.requireTools(); err != nil {
+		return nil, err
 	}
 
 	// Use SOPS to decrypt the file
@@ -270,7 +346,7 @@ func (sm *SopsManager) DecryptData(name string) ([]byte, error) {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			errOutput = string(exitErr.Stderr)
 		}
-		return nil, fmt.Errorf("decryption failed: %v - %s", err, errOutput)
+		return nil, fmt.Errorf("%w: %v - %s", ErrDecryptFailed, err, errOutput)
 	}
 
 	// Check if the data is wrapped
@@ -287,61 +363,118 @@ func (sm *SopsManager) DecryptData(name string) ([]byte, error) {
 	return decryptedData, nil
 }
 
-// ListSecrets returns a list of all secret files
+// ListSecrets returns the names of the secrets, the common ones and those of
+// the environment of the manager
 func (sm *SopsManager) ListSecrets() ([]string, error) {
-	var secrets []string
+	secrets, err := sm.ListSecretMetadata()
+	return secretNames(secrets), err
+}
 
-	// Check if the secrets directory exists
-	if _, err := os.Stat(sm.secretsDir); os.IsNotExist(err) {
-		return secrets, nil
-	}
+// ListSecretMetadata returns the metadata of the common secrets and those of
+// the environment of the manager, which hide common ones of the same name
+func (sm *SopsManager) ListSecretMetadata() ([]SecretMetadata, error) {
+	return listScopedSecretMetadata(sm.secretsDir, sm.environment, func(string) string {
+		return BackendSops
+	})
+}
+
+// ListAllSecretMetadata returns the metadata of the secrets of all
+// environments, the common ones first
+func (sm *SopsManager) ListAllSecretMetadata() ([]SecretMetadata, error) {
+	return listAllSecretMetadata(sm.secretsDir, func(string) string {
+		return BackendSops
+	})
+}
 
-	// Read the directory
-	files, err := ioutil.ReadDir(sm.secretsDir)
+// SetDestination records where a secret is meant to be decrypted to
+func (sm *SopsManager) SetDestination(name, destination string) error {
+	dir, err := locateSecret(sm.secretsDir, sm.environment, name)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return setSecretDestination(dir, name, destination)
+}
 
-	// Add each file to the list
-	for _, f := range files {
-		if !f.IsDir() {
-			secrets = append(secrets, f.Name())
-		}
+// EnableDiffDriver makes git show the backend, size and hash of changed
+// secrets in diffs instead of their ciphertext
+func (sm *SopsManager) EnableDiffDriver() error {
+	return enableSecretDiff(sm.dotpilotDir, sm.secretsDir)
+}
+
+// CanAdd returns ErrSecretExists if a secret with the given name already
+// exists and overwriting was not requested
+func (sm *SopsManager) CanAdd(name string, overwrite bool) error {
+	if err := validateSecretName(name); err != nil {
+		return err
+	}
+	if err := validateSecretEnvironment(sm.environment); err != nil {
+		return err
+	}
+	if overwrite {
+		return nil
 	}
 
-	return secrets, nil
+	if _, err := os.Stat(filepath.Join(secretScopeDir(sm.secretsDir, sm.environment), name)); err == nil {
+		return fmt.Errorf("%w: %s", ErrSecretExists, name)
+	}
+	return nil
 }
 
-// RemoveSecret removes a secret file
+// RemoveSecret removes a secret file. Only a secret of the environment of the
+// manager is removed, never a common one it hides.
 func (sm *SopsManager) RemoveSecret(name string) error {
+	if err := validateSecretName(name); err != nil {
+		return err
+	}
+	if err := validateSecretEnvironment(sm.environment); err != nil {
+		return err
+	}
+
 	// Get the file path
-	path := filepath.Join(sm.secretsDir, name)
+	dir := secretScopeDir(sm.secretsDir, sm.environment)
+	path := filepath.Join(dir, name)
 
 	// Check if the file exists
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return fmt.Errorf("secret file %s does not exist", name)
+		return fmt.Errorf("%w: %s", ErrSecretNotFound, name)
 	}
 
-	// Remove the file
-	return os.Remove(path)
+	// Remove the file and its metadata
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return forgetSecret(dir, name)
 }
 
 // EditSecret opens a secret in an editor for direct editing
 func (sm *SopsManager) EditSecret(name string) error {
-	// Get the file path
-	path := filepath.Join(sm.secretsDir, name)
+	// Get the file path, the secret of the environment hides a common one
+	dir, err := locateSecret(sm.secretsDir, sm.environment, name)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name)
 
-	// Check if the file exists
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return fmt.Errorf("secret file %s does not exist", name)
+	if err := sm.requireTools(); err != nil {
+		return err
+	}
+
+	// sops launches the editor itself, make it use the one dotpilot would
+	editor, err := utils.ResolveEditor()
+	if err != nil {
+		return err
 	}
 
 	// Use SOPS to edit the file
 	cmd := exec.Command("sops", path)
+	cmd.Env = append(os.Environ(), "EDITOR="+editor, "SOPS_EDITOR="+editor)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
 	utils.Logger.Info().Msgf("Opening secret %s for editing", name)
-	return cmd.Run()
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	return updateSecretHash(dir, name)
 }
\ No newline at end of file
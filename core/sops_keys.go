@@ -0,0 +1,272 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// SOPS key sources
+//
+// Besides PGP keys, the creation rule in .sops.yaml can encrypt the secrets
+// for keys held by a cloud service: AWS KMS, GCP KMS, Azure Key Vault and
+// HashiCorp Vault transit. sops talks to the service itself when it encrypts
+// and decrypts, so those work on any machine with credentials for the
+// service, without gpg or a GPG key. PGP stays the default: the local GPG key
+// is only added to the rule when no cloud key source is configured. Key
+// sources are added with the flags of `sops recipients add`, or by
+// Options["sops_keys"] in ~/.dotpilotrc, like {"kms": "arn:aws:kms:..."},
+// which the next encrypted secret writes to .sops.yaml.
+
+// SopsKeySources are the keys the creation rule in .sops.yaml encrypts
+// secrets for, by key source
+type SopsKeySources struct {
+	// PGP are the fingerprints of the PGP recipients
+	PGP []string
+	// KMS are AWS KMS key ARNs
+	KMS []string
+	// GCPKMS are GCP KMS key resource IDs
+	GCPKMS []string
+	// AzureKeyVault are Azure Key Vault key URLs
+	AzureKeyVault []string
+	// Vault are HashiCorp Vault transit key URIs
+	Vault []string
+}
+
+// sopsKeySource is one key source of a creation rule
+type sopsKeySource struct {
+	name    string // Key of the source in .sops.yaml
+	label   string
+	example string
+	keys    *[]string
+}
+
+// sources returns the key sources of k in the order .sops.yaml lists them
+func (k *SopsKeySources) sources() []sopsKeySource {
+	return []sopsKeySource{
+		{"pgp", "PGP", "a 40 digit fingerprint", &k.PGP},
+		{"kms", "AWS KMS", "an ARN like arn:aws:kms:us-east-1:111122223333:key/...", &k.KMS},
+		{"gcp_kms", "GCP KMS", "a resource ID like projects/p/locations/global/keyRings/r/cryptoKeys/k", &k.GCPKMS},
+		{"azure_keyvault", "Azure Key Vault", "a URL like https://vault.vault.azure.net/keys/key/version", &k.AzureKeyVault},
+		{"hc_vault_transit_uri", "Vault", "a URI like https://vault.example.com:8200/v1/sops/keys/key", &k.Vault},
+	}
+}
+
+// source returns the key source named name in .sops.yaml
+func (k *SopsKeySources) source(name string) (sopsKeySource, bool) {
+	for _, source := range k.sources() {
+		if source.name == name {
+			return source, true
+		}
+	}
+	return sopsKeySource{}, false
+}
+
+// AddKey validates key and adds it to the key source named name in
+// .sops.yaml, like "kms". A key that is listed already is left out.
+func (k *SopsKeySources) AddKey(name, key string) error {
+	source, ok := k.source(name)
+	if !ok {
+		return fmt.Errorf("unknown SOPS key source %q", name)
+	}
+
+	key = strings.TrimSpace(key)
+	valid := key != ""
+	switch name {
+	case "pgp":
+		fingerprint, err := NormalizeFingerprint(key)
+		if err != nil {
+			return err
+		}
+		key = fingerprint
+	case "kms":
+		valid = valid && strings.HasPrefix(key, "arn:")
+	case "gcp_kms":
+		valid = valid && strings.HasPrefix(key, "projects/")
+	case "azure_keyvault":
+		valid = valid && strings.HasPrefix(key, "https://")
+	case "hc_vault_transit_uri":
+		valid = valid && (strings.HasPrefix(key, "https://") || strings.HasPrefix(key, "http://"))
+	}
+	if !valid {
+		return fmt.Errorf("invalid %s key %q: expected %s", source.label, key, source.example)
+	}
+
+	if !slices.Contains(*source.keys, key) {
+		*source.keys = append(*source.keys, key)
+	}
+	return nil
+}
+
+// Merge adds the keys of other that k doesn't list yet and returns how many
+// it added
+func (k *SopsKeySources) Merge(other SopsKeySources) int {
+	added := 0
+	others := other.sources()
+	for i, source := range k.sources() {
+		for _, key := range *others[i].keys {
+			if !slices.Contains(*source.keys, key) {
+				*source.keys = append(*source.keys, key)
+				added++
+			}
+		}
+	}
+	return added
+}
+
+// Subtract removes the keys of other from k and returns how many it removed
+func (k *SopsKeySources) Subtract(other SopsKeySources) int {
+	removed := 0
+	others := other.sources()
+	for i, source := range k.sources() {
+		var remaining []string
+		for _, key := range *source.keys {
+			if slices.Contains(*others[i].keys, key) {
+				removed++
+			} else {
+				remaining = append(remaining, key)
+			}
+		}
+		*source.keys = remaining
+	}
+	return removed
+}
+
+// Len returns the number of keys of all key sources
+func (k SopsKeySources) Len() int {
+	n := 0
+	for _, source := range k.sources() {
+		n += len(*source.keys)
+	}
+	return n
+}
+
+// Cloud reports whether k lists a key held by a cloud service, which sops
+// reaches without gpg
+func (k SopsKeySources) Cloud() bool {
+	return k.Len() > len(k.PGP)
+}
+
+// Each calls fn with the name in .sops.yaml and the key of every key, in the
+// order .sops.yaml lists them
+func (k SopsKeySources) Each(fn func(name, key string)) {
+	for _, source := range k.sources() {
+		for _, key := range *source.keys {
+			fn(source.name, key)
+		}
+	}
+}
+
+// String lists the keys with their key source, like "AWS KMS arn:aws:..."
+func (k SopsKeySources) String() string {
+	var keys []string
+	for _, source := range k.sources() {
+		for _, key := range *source.keys {
+			keys = append(keys, source.label+" "+key)
+		}
+	}
+	return strings.Join(keys, ", ")
+}
+
+// ConfiguredSopsKeySources returns the key sources Options["sops_keys"] in
+// ~/.dotpilotrc adds to .sops.yaml, by their name in .sops.yaml. A key source
+// is one key or a list of them.
+func ConfiguredSopsKeySources() (SopsKeySources, error) {
+	var keys SopsKeySources
+	value, ok := GetConfig().Options["sops_keys"]
+	if !ok || value == nil {
+		return keys, nil
+	}
+
+	sources, ok := value.(map[string]interface{})
+	if !ok {
+		return keys, fmt.Errorf(`invalid sops_keys option: expected an object like {"kms": "arn:aws:kms:..."}`)
+	}
+	for name, value := range sources {
+		var values []interface{}
+		switch v := value.(type) {
+		case string:
+			values = []interface{}{v}
+		case []interface{}:
+			values = v
+		default:
+			return keys, fmt.Errorf("invalid sops_keys option: %s must be a key or a list of keys", name)
+		}
+		for _, value := range values {
+			key, ok := value.(string)
+			if !ok {
+				return keys, fmt.Errorf("invalid sops_keys option: %v in %s is not a string", value, name)
+			}
+			if err := keys.AddKey(name, key); err != nil {
+				return keys, fmt.Errorf("invalid sops_keys option: %w", err)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// KeySources returns the keys new secrets are encrypted for, as listed in
+// .sops.yaml
+func (sm *SopsManager) KeySources() (SopsKeySources, error) {
+	data, err := ioutil.ReadFile(filepath.Join(sm.dotpilotDir, sopsConfigFile))
+	if os.IsNotExist(err) {
+		return SopsKeySources{}, nil
+	}
+	if err != nil {
+		return SopsKeySources{}, err
+	}
+	return parseSopsKeySources(string(data)), nil
+}
+
+// parseSopsKeySources returns the keys of the creation rules of a SOPS
+// configuration, which lists those of a key source comma separated
+func parseSopsKeySources(config string) SopsKeySources {
+	var keys SopsKeySources
+	for _, line := range strings.Split(config, "\n") {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "- ")
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		source, ok := keys.source(strings.TrimSpace(name))
+		if !ok {
+			continue
+		}
+
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+		for _, key := range strings.Split(value, ",") {
+			key = strings.TrimSpace(key)
+			if key != "" && !slices.Contains(*source.keys, key) {
+				*source.keys = append(*source.keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// writeSopsConfig writes the SOPS configuration encrypting the secrets for
+// keys. The path regex is relative, so the same file works on every machine
+// sharing the repository.
+func (sm *SopsManager) writeSopsConfig(keys SopsKeySources) error {
+	configPath := filepath.Join(sm.dotpilotDir, sopsConfigFile)
+
+	var config strings.Builder
+	fmt.Fprintf(&config, "---\ncreation_rules:\n  - path_regex: %s/.*\n", filepath.Base(sm.secretsDir))
+	for _, source := range keys.sources() {
+		if len(*source.keys) > 0 {
+			fmt.Fprintf(&config, "    %s: %s\n", source.name, strings.Join(*source.keys, ","))
+		}
+	}
+
+	if err := ioutil.WriteFile(configPath, []byte(config.String()), 0644); err != nil {
+		return err
+	}
+
+	utils.Logger.Debug().Msgf("Wrote SOPS config for %d keys to %s", keys.Len(), configPath)
+	return nil
+}
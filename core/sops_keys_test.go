@@ -0,0 +1,131 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSopsKeySourcesConfig(t *testing.T) {
+	const (
+		fingerprint = "0123456789ABCDEF0123456789ABCDEF01234567"
+		arn         = "arn:aws:kms:us-east-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+		gcp         = "projects/dotfiles/locations/global/keyRings/sops/cryptoKeys/sops-key"
+		azure       = "https://dotfiles.vault.azure.net/keys/sops-key/0123456789abcdef"
+		vault       = "https://vault.example.com:8200/v1/sops/keys/dotfiles"
+	)
+	cases := []struct {
+		keys SopsKeySources
+		rule string
+	}{
+		{SopsKeySources{PGP: []string{fingerprint}}, "    pgp: " + fingerprint + "\n"},
+		{SopsKeySources{KMS: []string{arn, arn + "2"}}, "    kms: " + arn + "," + arn + "2\n"},
+		{SopsKeySources{GCPKMS: []string{gcp}}, "    gcp_kms: " + gcp + "\n"},
+		{SopsKeySources{AzureKeyVault: []string{azure}}, "    azure_keyvault: " + azure + "\n"},
+		{SopsKeySources{Vault: []string{vault}}, "    hc_vault_transit_uri: " + vault + "\n"},
+		{SopsKeySources{PGP: []string{fingerprint}, KMS: []string{arn}}, "    pgp: " + fingerprint + "\n    kms: " + arn + "\n"},
+	}
+
+	dotpilotDir := t.TempDir()
+	sm := NewSopsManager(dotpilotDir)
+	for _, c := range cases {
+		if err := sm.writeSopsConfig(c.keys); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(dotpilotDir, ".sops.yaml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "---\ncreation_rules:\n  - path_regex: sops-secrets/.*\n" + c.rule; string(data) != want {
+			t.Errorf("config for %s:\n%s\nwant:\n%s", c.keys, data, want)
+		}
+		if keys, err := sm.KeySources(); err != nil || !reflect.DeepEqual(keys, c.keys) {
+			t.Errorf("KeySources() = %v, %v, want %v", keys, err, c.keys)
+		}
+	}
+
+	if cases[0].keys.Cloud() || !cases[1].keys.Cloud() || !cases[5].keys.Cloud() {
+		t.Error("Cloud() counts PGP keys, or misses cloud keys")
+	}
+
+	// A hand-written rule listing a key source as a quoted string
+	writeRepoFile(t, dotpilotDir, ".sops.yaml", "creation_rules:\n  - kms: 'arn:aws:kms:a, arn:aws:kms:b'\n    path_regex: sops-secrets/.*\n")
+	if keys, err := sm.KeySources(); err != nil || !reflect.DeepEqual(keys.KMS, []string{"arn:aws:kms:a", "arn:aws:kms:b"}) || keys.PGP != nil {
+		t.Errorf("KeySources() of a hand-written config = %v, %v", keys, err)
+	}
+}
+
+func TestSopsKeySourcesAddKey(t *testing.T) {
+	var keys SopsKeySources
+	valid := map[string]string{
+		"pgp":                  "0123 4567 89AB CDEF 0123 4567 89AB CDEF 0123 4567",
+		"kms":                  "arn:aws:kms:eu-west-1:111122223333:alias/sops",
+		"gcp_kms":              "projects/p/locations/global/keyRings/r/cryptoKeys/k",
+		"azure_keyvault":       "https://v.vault.azure.net/keys/k/1",
+		"hc_vault_transit_uri": "http://127.0.0.1:8200/v1/transit/keys/k",
+	}
+	for source, key := range valid {
+		if err := keys.AddKey(source, key); err != nil {
+			t.Errorf("AddKey(%q, %q) = %v", source, key, err)
+		}
+		if err := keys.AddKey(source, key); err != nil {
+			t.Errorf("AddKey(%q, %q) again = %v", source, key, err)
+		}
+	}
+	if keys.Len() != len(valid) || keys.PGP[0] != "0123456789ABCDEF0123456789ABCDEF01234567" {
+		t.Errorf("added %v", keys)
+	}
+
+	for source, key := range map[string]string{
+		"pgp":                  "89ABCDEF01234567",
+		"kms":                  "1234abcd-12ab-34cd-56ef-1234567890ab",
+		"gcp_kms":              "sops-key",
+		"azure_keyvault":       "dotfiles.vault.azure.net",
+		"hc_vault_transit_uri": " ",
+		"age":                  "age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p",
+	} {
+		if err := keys.AddKey(source, key); err == nil {
+			t.Errorf("AddKey(%q, %q) accepted", source, key)
+		}
+	}
+
+	removed := keys.Subtract(SopsKeySources{KMS: []string{valid["kms"]}, GCPKMS: []string{"projects/other"}})
+	if removed != 1 || keys.KMS != nil || keys.Len() != len(valid)-1 {
+		t.Errorf("Subtract removed %d, left %v", removed, keys)
+	}
+}
+
+func TestPrepareEncryptionWithCloudKeys(t *testing.T) {
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+	currentConfig.Options = map[string]interface{}{"sops_keys": map[string]interface{}{
+		"kms":                  []interface{}{"arn:aws:kms:us-east-1:111122223333:key/a", "arn:aws:kms:us-east-1:111122223333:key/b"},
+		"hc_vault_transit_uri": "https://vault.example.com:8200/v1/sops/keys/dotfiles",
+	}}
+
+	dotpilotDir := t.TempDir()
+	sm := NewSopsManager(dotpilotDir)
+	// No gpg or GPG key is needed for cloud keys, and sops is only run later
+	sm.hasSops, sm.hasGPG = true, false
+	if err := sm.prepareEncryption(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := sm.KeySources()
+	if err != nil || len(keys.KMS) != 2 || len(keys.Vault) != 1 || keys.PGP != nil {
+		t.Errorf("KeySources() = %v, %v", keys, err)
+	}
+
+	// Without a cloud key source PGP is required
+	currentConfig.Options = map[string]interface{}{}
+	other := NewSopsManager(t.TempDir())
+	other.hasSops, other.hasGPG = true, false
+	if err := other.prepareEncryption(); err == nil {
+		t.Error("prepareEncryption without gpg succeeded")
+	}
+
+	currentConfig.Options = map[string]interface{}{"sops_keys": map[string]interface{}{"age": "age1abc"}}
+	if _, err := ConfiguredSopsKeySources(); err == nil {
+		t.Error("an unknown key source was accepted")
+	}
+}
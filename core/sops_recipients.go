@@ -0,0 +1,131 @@
+package core
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// SOPS recipients
+//
+// Secrets in sops-secrets/ are encrypted for every key listed in the creation
+// rule of .sops.yaml, PGP fingerprints and cloud keys, see SopsKeySources, so
+// sharing them with a team means adding each member's key there and running
+// `sops updatekeys` on every secret.
+// dotpilot owns .sops.yaml and rewrites it with a single creation rule.
+
+// sopsConfigFile is the SOPS configuration in the dotpilot directory
+const sopsConfigFile = ".sops.yaml"
+
+// NormalizeFingerprint validates a PGP fingerprint and returns it in the form
+// gpg prints it: upper case hex without spaces or 0x prefix. Short key IDs
+// are rejected because they are easy to collide.
+func NormalizeFingerprint(fingerprint string) (string, error) {
+	normalized := strings.ToUpper(strings.Join(strings.Fields(fingerprint), ""))
+	normalized = strings.TrimPrefix(normalized, "0X")
+
+	if len(normalized) != 40 && len(normalized) != 64 {
+		return "", fmt.Errorf("invalid fingerprint %q: expected 40 hex digits (or 64 for v5 keys), not a key ID", fingerprint)
+	}
+	for _, c := range normalized {
+		if !strings.ContainsRune("0123456789ABCDEF", c) {
+			return "", fmt.Errorf("invalid fingerprint %q: %q is not a hex digit", fingerprint, c)
+		}
+	}
+	return normalized, nil
+}
+
+// Recipients returns the fingerprints of the PGP keys new secrets are
+// encrypted for, in the order listed in .sops.yaml
+func (sm *SopsManager) Recipients() ([]string, error) {
+	keys, err := sm.KeySources()
+	return keys.PGP, err
+}
+
+// AddRecipients gives keys access to all SOPS secrets: PGP keys, whose public
+// key must be in the local keyring, and cloud keys. Adding keys that already
+// are recipients re-encrypts the secrets again, which finishes an earlier
+// update that was interrupted.
+func (sm *SopsManager) AddRecipients(keys SopsKeySources) error {
+	recipients, err := sm.KeySources()
+	if err != nil {
+		return err
+	}
+	added := recipients.Merge(keys)
+	if err := sm.requireToolsFor(recipients); err != nil {
+		return err
+	}
+
+	// sops needs the public keys to encrypt the data keys for them
+	for _, fingerprint := range keys.PGP {
+		if err := exec.Command("gpg", "--list-keys", fingerprint).Run(); err != nil {
+			return fmt.Errorf("no public key for %s in the gpg keyring, import it with 'gpg --import' first", fingerprint)
+		}
+	}
+
+	if added == 0 {
+		utils.Logger.Info().Msgf("%s already can decrypt the secrets", keys)
+	} else if err := sm.writeSopsConfig(recipients); err != nil {
+		return err
+	}
+
+	return sm.updateKeys()
+}
+
+// RemoveRecipients revokes the access of keys to all SOPS secrets. The last
+// key can't be removed. Secrets the keys could decrypt before stay readable in
+// the git history, so rotate any credentials they hold.
+func (sm *SopsManager) RemoveRecipients(keys SopsKeySources) error {
+	recipients, err := sm.KeySources()
+	if err != nil {
+		return err
+	}
+	if err := sm.requireToolsFor(recipients); err != nil {
+		return err
+	}
+
+	removed := recipients.Subtract(keys)
+	if recipients.Len() == 0 {
+		return fmt.Errorf("can't remove %s, no recipient would be left", keys)
+	}
+
+	if removed == 0 {
+		utils.Logger.Info().Msgf("%s is not a recipient", keys)
+	} else if err := sm.writeSopsConfig(recipients); err != nil {
+		return err
+	}
+
+	return sm.updateKeys()
+}
+
+// updateKeys re-encrypts the data key of every secret for the recipients in
+// .sops.yaml. The secret values themselves don't change.
+func (sm *SopsManager) updateKeys() error {
+	secrets, err := sm.ListAllSecretMetadata()
+	if err != nil {
+		return err
+	}
+
+	for _, secret := range secrets {
+		name := secret.Name
+		dir := secretScopeDir(sm.secretsDir, secret.Environment)
+		path := filepath.Join(dir, name)
+		utils.Logger.Debug().Msgf("Updating the keys of %s", name)
+
+		cmd := exec.Command("sops", "updatekeys", "--yes", "--input-type", "json", path)
+		cmd.Dir = sm.dotpilotDir
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to update the keys of %s: %v - %s", name, err, strings.TrimSpace(string(output)))
+		}
+
+		if err := updateSecretHash(dir, name); err != nil {
+			return err
+		}
+	}
+
+	utils.Logger.Info().Msgf("Updated the keys of %d secrets", len(secrets))
+	return nil
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeFingerprint(t *testing.T) {
+	const want = "0123456789ABCDEF0123456789ABCDEF01234567"
+	for _, input := range []string{
+		want,
+		"0123456789abcdef0123456789abcdef01234567",
+		"0123 4567 89AB CDEF 0123  4567 89AB CDEF 0123 4567",
+		"0x0123456789ABCDEF0123456789ABCDEF01234567",
+	} {
+		if got, err := NormalizeFingerprint(input); err != nil || got != want {
+			t.Errorf("NormalizeFingerprint(%q) = %q, %v, want %s", input, got, err, want)
+		}
+	}
+
+	for _, input := range []string{"", "89ABCDEF01234567", "0123456789ABCDEF0123456789ABCDEF0123456Z"} {
+		if _, err := NormalizeFingerprint(input); err == nil {
+			t.Errorf("NormalizeFingerprint(%q) succeeded, want an error", input)
+		}
+	}
+}
+
+func TestSopsRecipients(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	sm := NewSopsManager(dotpilotDir)
+
+	if recipients, err := sm.Recipients(); err != nil || len(recipients) != 0 {
+		t.Fatalf("Recipients() without .sops.yaml = %v, %v", recipients, err)
+	}
+
+	want := []string{
+		"0123456789ABCDEF0123456789ABCDEF01234567",
+		"89ABCDEF0123456789ABCDEF0123456789ABCDEF",
+	}
+	if err := sm.writeSopsConfig(SopsKeySources{PGP: want}); err != nil {
+		t.Fatal(err)
+	}
+	if recipients, err := sm.Recipients(); err != nil || !reflect.DeepEqual(recipients, want) {
+		t.Errorf("Recipients() = %v, %v, want %v", recipients, err, want)
+	}
+
+	// A configuration written by an earlier version or by hand
+	writeRepoFile(t, dotpilotDir, ".sops.yaml", "---\ncreation_rules:\n  - path_regex: "+filepath.Join(dotpilotDir, "sops-secrets")+"/.*\n    pgp: '"+want[0]+", "+want[1]+"'\n")
+	if recipients, err := sm.Recipients(); err != nil || !reflect.DeepEqual(recipients, want) {
+		t.Errorf("Recipients() of a hand-written config = %v, %v, want %v", recipients, err, want)
+	}
+}
@@ -0,0 +1,96 @@
+package core
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Sparse checkout support
+//
+// go-git (v5.11) exposes CheckoutOptions.SparseCheckoutDirectories, but it does
+// not take effect on a fresh clone and any skip-worktree entries are committed
+// as deletions the next time dotpilot stages changes with `Add(".")`. To keep
+// the repository intact, dotpilot always checks out the full tree and applies
+// the sparse include list as a filter instead: paths outside the list are never
+// linked into the home directory or considered during conflict detection.
+
+// IsSparseIncluded reports whether a repo-relative path is covered by the
+// configured sparse include list. When no list is configured every path is
+// included.
+func IsSparseIncluded(relPath string) bool {
+	included, _ := matchSparsePaths(currentConfig.SparsePaths, relPath)
+	return included
+}
+
+// isSparseExcluded reports whether a path inside the dotpilot repository
+// should be skipped because of the sparse include list. Directories that are
+// ancestors of an included path are never excluded so traversal can reach them.
+func isSparseExcluded(dotpilotDir, path string, isDir bool) bool {
+	if len(currentConfig.SparsePaths) == 0 {
+		return false
+	}
+
+	relPath, err := filepath.Rel(dotpilotDir, path)
+	if err != nil || relPath == "." {
+		return false
+	}
+
+	included, ancestor := matchSparsePaths(currentConfig.SparsePaths, relPath)
+	if included {
+		return false
+	}
+	return !(isDir && ancestor)
+}
+
+// matchSparsePaths matches a repo-relative path against the include patterns.
+// Patterns are slash-separated and may use path.Match globs in any segment.
+// It returns whether the path is included (it equals or lives below a pattern)
+// and whether it is an ancestor directory of a pattern.
+func matchSparsePaths(patterns []string, relPath string) (included, ancestor bool) {
+	if len(patterns) == 0 {
+		return true, false
+	}
+
+	segments := strings.Split(filepath.ToSlash(relPath), "/")
+	for _, pattern := range patterns {
+		pattern = strings.Trim(filepath.ToSlash(pattern), "/")
+		if pattern == "" {
+			continue
+		}
+		patternSegments := strings.Split(pattern, "/")
+
+		n := len(segments)
+		if len(patternSegments) < n {
+			n = len(patternSegments)
+		}
+
+		matched := true
+		for i := 0; i < n; i++ {
+			ok, err := path.Match(patternSegments[i], segments[i])
+			if err != nil || !ok {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		if len(segments) >= len(patternSegments) {
+			return true, false
+		}
+		ancestor = true
+	}
+
+	return false, ancestor
+}
+
+// dotpilotRepoDir returns the default location of the dotpilot repository
+func dotpilotRepoDir() (string, error) {
+	home, err := Home()
+	if err != nil {
+		return "", err
+	}
+	return DotpilotDir(home), nil
+}
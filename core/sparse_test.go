@@ -0,0 +1,129 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestMatchSparsePaths(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		relPath  string
+		included bool
+		ancestor bool
+	}{
+		// No list includes everything
+		{nil, "envs/work/.zshrc", true, false},
+		// Directories include what is below them, with or without slashes
+		{[]string{"common"}, "common", true, false},
+		{[]string{"common"}, "common/.config/nvim/init.vim", true, false},
+		{[]string{"/common/"}, "common/.zshrc", true, false},
+		{[]string{"common"}, "envs/work/.zshrc", false, false},
+		// Whole segments are matched, not string prefixes
+		{[]string{"common/.con"}, "common/.config/nvim", false, false},
+		{[]string{"envs/work"}, "envs/workstation/.zshrc", false, false},
+		// Files
+		{[]string{"common/.zshrc"}, "common/.zshrc", true, false},
+		{[]string{"common/.zshrc"}, "common/.zshrc.local", false, false},
+		// Directories above a pattern are ancestors, not included
+		{[]string{"common/.config/nvim"}, "common", false, true},
+		{[]string{"common/.config/nvim"}, "common/.config", false, true},
+		{[]string{"common/.config/nvim"}, "common/.vimrc", false, false},
+		// Globs match within a segment
+		{[]string{"envs/*"}, "envs/work/.zshrc", true, false},
+		{[]string{"machine/*/.ssh"}, "machine/laptop/.ssh/config", true, false},
+		{[]string{"machine/*/.ssh"}, "machine/laptop/.zshrc", false, false},
+		{[]string{"common/.z*"}, "common/.zshrc", true, false},
+		{[]string{"common/.z*"}, "common/.bashrc", false, false},
+		// Any pattern including the path wins
+		{[]string{"envs/work", "common"}, "common/.zshrc", true, false},
+		// Invalid globs match nothing
+		{[]string{"common/["}, "common/.zshrc", false, false},
+	}
+	for _, tt := range tests {
+		included, ancestor := matchSparsePaths(tt.patterns, tt.relPath)
+		if included != tt.included || ancestor != tt.ancestor {
+			t.Errorf("matchSparsePaths(%q, %q) = %v, %v, want %v, %v",
+				tt.patterns, tt.relPath, included, ancestor, tt.included, tt.ancestor)
+		}
+	}
+}
+
+func TestIsSparseExcluded(t *testing.T) {
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+	currentConfig.SparsePaths = []string{"common/.config/nvim", "envs/*"}
+
+	dotpilotDir := t.TempDir()
+	tests := []struct {
+		relPath  string
+		isDir    bool
+		excluded bool
+	}{
+		{".", true, false},
+		{"common", true, false}, // Walked to reach common/.config/nvim
+		{"common/.config", true, false},
+		{"common/.config/nvim/init.vim", false, false},
+		{"common/.zshrc", false, true},
+		{"common/.config/git", true, true},
+		{"envs/work/.zshrc", false, false},
+		{"machine", true, true},
+		{"machine/laptop/.zshrc", false, true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dotpilotDir, filepath.FromSlash(tt.relPath))
+		if got := isSparseExcluded(dotpilotDir, path, tt.isDir); got != tt.excluded {
+			t.Errorf("isSparseExcluded(%q) = %v, want %v", tt.relPath, got, tt.excluded)
+		}
+		if !tt.isDir && IsSparseIncluded(tt.relPath) == tt.excluded {
+			t.Errorf("IsSparseIncluded(%q) = %v, want %v", tt.relPath, !tt.excluded, !tt.excluded)
+		}
+	}
+
+	// Without a list nothing is excluded
+	currentConfig.SparsePaths = nil
+	if isSparseExcluded(dotpilotDir, filepath.Join(dotpilotDir, "machine"), true) || !IsSparseIncluded("machine/laptop/.zshrc") {
+		t.Error("paths excluded without sparse paths")
+	}
+}
+
+func TestApplySkipsSparseExcluded(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+	currentConfig = Config{TrackingPaths: []string{}, SparsePaths: []string{"common/.zshrc", "common/.config/nvim"}}
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{".zshrc", ".vimrc", ".config/nvim/init.vim", ".config/git/config"} {
+		writeRepoFile(t, dotpilotDir, "common/"+name, name+"\n")
+	}
+	if err := CommitChanges(dotpilotDir, "dotfiles"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for name, linked := range map[string]bool{
+		".zshrc":                true,
+		".config/nvim/init.vim": true,
+		".vimrc":                false,
+		".config/git/config":    false,
+	} {
+		_, err := os.Lstat(filepath.Join(home, filepath.FromSlash(name)))
+		if linked && err != nil {
+			t.Errorf("%s wasn't applied: %v", name, err)
+		}
+		if !linked && !os.IsNotExist(err) {
+			t.Errorf("%s outside the sparse paths was applied: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dotpilot/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// StashRef is the ref that holds stashed changes. go-git has no stash support,
+// so uncommitted changes are recorded as a commit on this scratch ref (parented
+// on the HEAD they were made against) and the worktree is reset to HEAD.
+const StashRef = plumbing.ReferenceName("refs/dotpilot/stash")
+
+// HasStash reports whether a stash is currently recorded
+func HasStash(dotpilotDir string) (bool, error) {
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = repo.Reference(StashRef, true)
+	if err == plumbing.ErrReferenceNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// StashChanges records all uncommitted changes on StashRef and resets the
+// worktree to HEAD. It returns the zero hash if there was nothing to stash.
+func StashChanges(dotpilotDir string) (plumbing.Hash, error) {
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	// Refuse to overwrite a stash that was never re-applied
+	if _, err := repo.Reference(StashRef, true); err == nil {
+		return plumbing.ZeroHash, fmt.Errorf("%w at %s, re-apply or drop it first", ErrStashExists, StashRef)
+	}
+
+	w, err := repo.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	status, err := w.Status()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if status.IsClean() {
+		return plumbing.ZeroHash, nil
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	// Commit the changes, then move the stash commit to the scratch ref and
+	// put the branch back where it was
+	if _, err := w.Add("."); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	stashHash, err := w.Commit(fmt.Sprintf("dotpilot stash on %s", head.Name().Short()), &git.CommitOptions{
+		Author: &object.Signature{
+			Name:  "dotpilot",
+			Email: "dotpilot@local",
+			When:  time.Now(),
+		},
+	})
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(StashRef, stashHash)); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	if err := w.Reset(&git.ResetOptions{Commit: head.Hash(), Mode: git.HardReset}); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	utils.Logger.Info().Msgf("Stashed uncommitted changes as %s (%s)", StashRef, stashHash.String()[:7])
+	return stashHash, nil
+}
+
+// PopStash re-applies the stashed changes onto the current worktree without
+// committing them. Files that were also changed upstream are handed to the
+// conflict resolver, with the stashed version as the local side and the pulled
+// repo file as the remote side. The stash ref is only dropped once re-applying
+// succeeded and every conflict kept the stashed version, so a failed pop can be
+// retried and a stashed version that was skipped or replaced by the remote one
+// can still be recovered from StashRef.
+func PopStash(dotpilotDir string, strategy ConflictResolutionStrategy) error {
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return err
+	}
+
+	ref, err := repo.Reference(StashRef, true)
+	if err != nil {
+		return fmt.Errorf("no stash found: %w", err)
+	}
+
+	stashCommit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return err
+	}
+	if stashCommit.NumParents() == 0 {
+		return fmt.Errorf("stash commit %s has no parent", ref.Hash())
+	}
+	baseCommit, err := stashCommit.Parent(0)
+	if err != nil {
+		return err
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	headCommit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return err
+	}
+
+	baseTree, err := baseCommit.Tree()
+	if err != nil {
+		return err
+	}
+	stashTree, err := stashCommit.Tree()
+	if err != nil {
+		return err
+	}
+	headTree, err := headCommit.Tree()
+	if err != nil {
+		return err
+	}
+
+	changes, err := object.DiffTree(baseTree, stashTree)
+	if err != nil {
+		return err
+	}
+
+	// Stash paths are relative to the repository root, which in monorepo mode
+	// is a parent of dotpilotDir
+	w, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	repoRoot := w.Filesystem.Root()
+
+	var conflicts []ConflictFile
+	scratchDir := ""
+
+	for _, change := range changes {
+		name := change.To.Name
+		if name == "" {
+			name = change.From.Name
+		}
+		repoFile := filepath.Join(repoRoot, filepath.FromSlash(name))
+
+		baseHash := entryHash(baseTree, name)
+		stashHash := entryHash(stashTree, name)
+		headHash := entryHash(headTree, name)
+
+		switch {
+		case headHash == stashHash:
+			// Upstream already has the stashed content
+			continue
+		case headHash == baseHash:
+			// Upstream didn't touch this file, re-apply the stashed change
+			if err := restoreStashedFile(stashTree, name, repoFile); err != nil {
+				return err
+			}
+			continue
+		case stashHash == plumbing.ZeroHash:
+			// Deleted locally but changed upstream: keep the upstream version
+			utils.Logger.Warn().Msgf("Stashed deletion of %s conflicts with upstream changes, keeping upstream version", name)
+			continue
+		case headHash == plumbing.ZeroHash:
+			// Deleted upstream but changed locally: bring back the local version
+			utils.Logger.Warn().Msgf("%s was deleted upstream, restoring the stashed version", name)
+			if err := restoreStashedFile(stashTree, name, repoFile); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Both sides changed the file
+		if scratchDir == "" {
+			scratchDir, err = os.MkdirTemp("", "dotpilot-stash-*")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(scratchDir)
+			defer utils.Cleanup.AddFile(scratchDir)()
+		}
+		scratchFile := filepath.Join(scratchDir, filepath.FromSlash(name))
+		if err := restoreStashedFile(stashTree, name, scratchFile); err != nil {
+			return err
+		}
+
+		diff, err := FileDiff(scratchFile, repoFile)
+		if err != nil {
+			diff = "Unable to generate diff"
+		}
+
+		conflicts = append(conflicts, ConflictFile{
+			LocalPath:  scratchFile,
+			RemotePath: repoFile,
+			Target:     name,
+			Diff:       diff,
+			Kind:       classifyConflict(scratchFile, repoFile),
+			Stashed:    true,
+		})
+	}
+
+	if len(conflicts) > 0 {
+		utils.Logger.Warn().Msgf("%d stashed files conflict with upstream changes", len(conflicts))
+		decisions, err := ResolveConflictList(conflicts, strategy)
+		writeConflictLog(dotpilotDir, strategy, decisions)
+		if err != nil {
+			return fmt.Errorf("stash kept at %s: %w", StashRef, err)
+		}
+		if !keptStashed(decisions) {
+			utils.Logger.Warn().Msgf("Not every stashed version was kept, the stash stays at %s. Once you no longer need it, run 'git update-ref -d %s' in %s", StashRef, StashRef, dotpilotDir)
+			return nil
+		}
+	}
+
+	utils.Logger.Info().Msgf("Re-applied stashed changes from %s", ref.Hash().String()[:7])
+	return DropStash(dotpilotDir)
+}
+
+// DropStash deletes the stash ref
+func DropStash(dotpilotDir string) error {
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return err
+	}
+
+	return repo.Storer.RemoveReference(StashRef)
+}
+
+// keptStashed reports whether every conflict of decisions kept the stashed
+// version in the repository, replacing the repo file or next to it
+func keptStashed(decisions []ConflictDecision) bool {
+	for _, d := range decisions {
+		if d.Outcome != OutcomeKeptLocal && d.Outcome != OutcomeBackedUp {
+			return false
+		}
+	}
+	return true
+}
+
+// entryHash returns the blob hash of a path in a tree, or the zero hash if the
+// path does not exist
+func entryHash(tree *object.Tree, name string) plumbing.Hash {
+	entry, err := tree.FindEntry(name)
+	if err != nil {
+		return plumbing.ZeroHash
+	}
+	return entry.Hash
+}
+
+// restoreStashedFile writes the stashed version of a path to dest, or removes
+// dest if the stash deleted it
+func restoreStashedFile(tree *object.Tree, name, dest string) error {
+	file, err := tree.File(name)
+	if err == object.ErrFileNotFound {
+		if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	mode, err := file.Mode.ToOSFileMode()
+	if err != nil {
+		mode = 0644
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	reader, err := file.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	out, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, reader)
+	return err
+}
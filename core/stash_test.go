@@ -0,0 +1,77 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestPopStashKeepsStashUnlessKept(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dotpilotDir := t.TempDir()
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "base\n")
+	if err := CommitChanges(dotpilotDir, "initial"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A local edit is stashed, and the same file changes upstream
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "stashed\n")
+	if _, err := StashChanges(dotpilotDir); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "remote\n")
+	if err := CommitChanges(dotpilotDir, "upstream"); err != nil {
+		t.Fatal(err)
+	}
+	repoFile := filepath.Join(dotpilotDir, "common", ".zshrc")
+
+	// Keeping the remote version leaves the stashed one on the stash ref
+	if err := PopStash(dotpilotDir, StrategyKeepRemote); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(repoFile); string(data) != "remote\n" {
+		t.Errorf("after keep-remote the repo file is %q", data)
+	}
+	if ok, err := HasStash(dotpilotDir); err != nil || !ok {
+		t.Fatalf("stash dropped after keep-remote: %v, %v", ok, err)
+	}
+
+	// It can be popped again, and is dropped once it is kept
+	if err := PopStash(dotpilotDir, StrategyKeepLocal); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(repoFile); string(data) != "stashed\n" {
+		t.Errorf("after keep-local the repo file is %q", data)
+	}
+	if ok, err := HasStash(dotpilotDir); err != nil || ok {
+		t.Errorf("stash kept after keep-local: %v, %v", ok, err)
+	}
+}
+
+func TestKeptStashed(t *testing.T) {
+	tests := []struct {
+		outcomes []ConflictOutcome
+		want     bool
+	}{
+		{nil, true},
+		{[]ConflictOutcome{OutcomeKeptLocal, OutcomeBackedUp}, true},
+		{[]ConflictOutcome{OutcomeKeptLocal, OutcomeKeptRemote}, false},
+		{[]ConflictOutcome{OutcomeSkipped}, false},
+		{[]ConflictOutcome{OutcomeKeptLocal, OutcomeSkipped}, false},
+		{[]ConflictOutcome{OutcomeMerged}, false},
+	}
+	for _, tt := range tests {
+		var decisions []ConflictDecision
+		for _, outcome := range tt.outcomes {
+			decisions = append(decisions, ConflictDecision{Target: "common/.zshrc", Outcome: outcome})
+		}
+		if got := keptStashed(decisions); got != tt.want {
+			t.Errorf("keptStashed(%v) = %v, want %v", tt.outcomes, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// FileStat holds the size of a single tracked file
+type FileStat struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// RepoStats summarizes the contents and history of the dotpilot repository
+type RepoStats struct {
+	TrackedFiles int            `json:"tracked_files"`
+	TotalSize    int64          `json:"total_size"`
+	Layers       map[string]int `json:"layers"`
+	FileTypes    map[string]int `json:"file_types"`
+	Secrets      int            `json:"secrets"`
+	SopsSecrets  int            `json:"sops_secrets"`
+	Commits      int            `json:"commits"`
+	RepoSize     int64          `json:"repo_size"`
+	LargestFiles []FileStat     `json:"largest_files"`
+}
+
+// GetRepoStats walks the tracked files and git history of the repository.
+// The top largest tracked files are included in the result.
+func GetRepoStats(dotpilotDir string, top int) (RepoStats, error) {
+	stats := RepoStats{
+		Layers:    make(map[string]int),
+		FileTypes: make(map[string]int),
+	}
+
+	trackedFiles, err := GetTrackedFiles(dotpilotDir)
+	if err != nil {
+		return stats, err
+	}
+
+	var files []FileStat
+	for _, file := range trackedFiles {
+		stats.TrackedFiles++
+		stats.Layers[layerOf(file)]++
+		stats.FileTypes[fileTypeOf(file)]++
+
+		info, err := os.Stat(filepath.Join(dotpilotDir, filepath.FromSlash(file)))
+		if err != nil {
+			// Deleted in the worktree but still committed
+			continue
+		}
+		stats.TotalSize += info.Size()
+		files = append(files, FileStat{Path: file, Size: info.Size()})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Size != files[j].Size {
+			return files[i].Size > files[j].Size
+		}
+		return files[i].Path < files[j].Path
+	})
+	if top >= 0 && len(files) > top {
+		files = files[:top]
+	}
+	stats.LargestFiles = files
+
+	// Secrets
+	secrets, err := NewSecretManager(dotpilotDir).ListAllSecretMetadata()
+	if err != nil {
+		return stats, err
+	}
+	stats.Secrets = len(secrets)
+
+	sopsSecrets, err := NewSopsManager(dotpilotDir).ListAllSecretMetadata()
+	if err != nil {
+		return stats, err
+	}
+	stats.SopsSecrets = len(sopsSecrets)
+
+	// Commits
+	stats.Commits, err = countCommits(dotpilotDir)
+	if err != nil {
+		return stats, err
+	}
+
+	// On-disk size of the git database
+	err = filepath.Walk(filepath.Join(dotpilotDir, ".git"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			stats.RepoSize += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, nil
+}
+
+// countCommits counts the commits reachable from HEAD
+func countCommits(dotpilotDir string) (int, error) {
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return 0, err
+	}
+
+	ref, err := repo.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		// No commits yet
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	iter, err := logFrom(repo, ref.Hash(), git.LogOrderDFS)
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close()
+
+	count := 0
+	err = iter.ForEach(func(c *object.Commit) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// layerOf returns the layer a repo-relative path belongs to, such as
+// "common", "envs/dev" or "machine/laptop"
+func layerOf(relPath string) string {
+	parts := strings.Split(filepath.ToSlash(relPath), "/")
+	if len(parts) < 2 {
+		return "other"
+	}
+
+	switch parts[0] {
+	case "common", "secrets", "sops-secrets":
+		return parts[0]
+	case "envs", "machine":
+		if len(parts) < 3 {
+			return parts[0]
+		}
+		return parts[0] + "/" + parts[1]
+	default:
+		return "other"
+	}
+}
+
+// fileTypeOf returns the extension of a path, or "(none)" for files without
+// one such as ".zshrc"
+func fileTypeOf(relPath string) string {
+	base := filepath.Base(relPath)
+	ext := filepath.Ext(base)
+	if ext == "" || ext == base {
+		return "(none)"
+	}
+	return strings.ToLower(ext)
+}
@@ -0,0 +1,411 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// stowLocalIgnore is the per-package ignore list understood by GNU Stow
+const stowLocalIgnore = ".stow-local-ignore"
+
+// defaultStowIgnore mirrors GNU Stow's built-in ignore list, used when a
+// package has no .stow-local-ignore
+var defaultStowIgnore = []string{
+	`RCS`, `.+,v`, `CVS`, `\.\#.+`, `\.cvsignore`, `\.svn`, `_darcs`, `\.hg`,
+	`\.git`, `\.gitignore`, `\.gitmodules`, `.+~`, `\#.*\#`,
+	`^/README.*`, `^/LICENSE.*`, `^/COPYING`, `\.stow-local-ignore`,
+}
+
+// StowImportOptions controls how a GNU Stow directory is imported
+type StowImportOptions struct {
+	Layer     string   // Repo layer to import into, e.g. "common" or "envs/dev"
+	Packages  []string // Only import these packages, all of them when empty
+	Fold      bool     // Link whole directories owned by a single package, like Stow's tree folding
+	Dotfiles  bool     // Translate "dot-" prefixes to "." like stow --dotfiles
+	Overwrite bool     // Overwrite files that already exist in the repo layer
+	DryRun    bool     // Only report what would be imported
+}
+
+// StowImport is one link created by ImportStow
+type StowImport struct {
+	Package  string // Stow package the link came from
+	RepoPath string // Slash-separated repo path of the file or folded directory
+	Target   string // Path in the home directory
+	Dir      bool   // The link is a folded directory
+	Files    int    // Number of files behind the link
+}
+
+// stowFile is a file found in a Stow package
+type stowFile struct {
+	pkg     string
+	source  string // Path inside the stow directory
+	relPath string // Slash-separated path relative to home, after dot- translation
+}
+
+// ImportStow copies the files of a GNU Stow directory into a repo layer and
+// replaces their links in the home directory with links into the repository.
+// Each top-level directory of stowDir is a package whose contents mirror the
+// home directory. Nothing is changed if any file already exists in the layer
+// and Overwrite is not set.
+func ImportStow(dotpilotDir, stowDir string, opts StowImportOptions) ([]StowImport, error) {
+	home, err := Home()
+	if err != nil {
+		return nil, err
+	}
+
+	stowDir, err = filepath.Abs(stowDir)
+	if err != nil {
+		return nil, err
+	}
+	if resolved, err := filepath.EvalSymlinks(stowDir); err == nil {
+		stowDir = resolved
+	}
+
+	packages, err := stowPackages(stowDir, opts.Packages)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []stowFile
+	for _, pkg := range packages {
+		pkgFiles, err := scanStowPackage(stowDir, pkg, opts.Dotfiles)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read package %s: %w", pkg, err)
+		}
+		files = append(files, pkgFiles...)
+	}
+
+	layerDir := filepath.Join(dotpilotDir, opts.Layer)
+	repoPrefix := filepath.ToSlash(opts.Layer)
+
+	// Check for clashes before touching anything
+	owners := make(map[string]string)
+	for _, f := range files {
+		if other, ok := owners[f.relPath]; ok {
+			return nil, fmt.Errorf("%s is provided by both %s and %s", f.relPath, other, f.pkg)
+		}
+		owners[f.relPath] = f.pkg
+
+		dest := filepath.Join(layerDir, filepath.FromSlash(f.relPath))
+		if _, err := os.Stat(dest); err == nil && !opts.Overwrite {
+			return nil, fmt.Errorf("%w: %s", ErrFileExists, dest)
+		}
+	}
+
+	imports := planStowLinks(files, home, stowDir, repoPrefix, opts.Fold)
+	if opts.DryRun {
+		return imports, nil
+	}
+
+	// Copy every file into the repository
+	for _, f := range files {
+		dest := filepath.Join(layerDir, filepath.FromSlash(f.relPath))
+		info, err := os.Stat(f.source)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return nil, err
+		}
+		if err := copyFile(f.source, dest, info.Mode()); err != nil {
+			return nil, err
+		}
+	}
+
+	// Point the home directory at the repository instead of the stow directory
+	for _, imp := range imports {
+		source := filepath.Join(dotpilotDir, filepath.FromSlash(imp.RepoPath))
+		if err := linkStowTarget(home, stowDir, imp.Target, source); err != nil {
+			return nil, fmt.Errorf("failed to link %s: %w", imp.Target, err)
+		}
+		if relTarget, ok := trackingPath(home, imp.Target); ok {
+			AddTrackingPath(relTarget)
+		}
+	}
+
+	return imports, nil
+}
+
+// stowPackages returns the package directories to import, sorted
+func stowPackages(stowDir string, only []string) ([]string, error) {
+	entries, err := os.ReadDir(stowDir)
+	if err != nil {
+		return nil, err
+	}
+
+	available := make(map[string]bool)
+	var packages []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			available[entry.Name()] = true
+			packages = append(packages, entry.Name())
+		}
+	}
+
+	if len(only) == 0 {
+		return packages, nil
+	}
+
+	for _, pkg := range only {
+		if !available[pkg] {
+			return nil, fmt.Errorf("package %s does not exist in %s", pkg, stowDir)
+		}
+	}
+	sort.Strings(only)
+	return only, nil
+}
+
+// scanStowPackage lists the files of a package, honoring Stow's ignore rules
+func scanStowPackage(stowDir, pkg string, dotfiles bool) ([]stowFile, error) {
+	pkgDir := filepath.Join(stowDir, pkg)
+
+	ignore, err := loadStowIgnore(pkgDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []stowFile
+	err = filepath.Walk(pkgDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == pkgDir {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(pkgDir, p)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		if stowIgnored(ignore, relPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		if dotfiles {
+			relPath = translateDotfiles(relPath)
+		}
+		files = append(files, stowFile{pkg: pkg, source: p, relPath: relPath})
+		return nil
+	})
+
+	return files, err
+}
+
+// loadStowIgnore compiles the package's .stow-local-ignore, falling back to
+// Stow's defaults. Like Stow, patterns containing a slash match the path from
+// the package root (with a leading slash), others match the file name.
+func loadStowIgnore(pkgDir string) ([]*regexp.Regexp, error) {
+	patterns := defaultStowIgnore
+
+	f, err := os.Open(filepath.Join(pkgDir, stowLocalIgnore))
+	if err == nil {
+		defer f.Close()
+
+		patterns = []string{regexp.QuoteMeta(stowLocalIgnore)}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				patterns = append(patterns, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + strings.TrimPrefix(pattern, "^") + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// stowIgnored reports whether a slash-separated package path is ignored
+func stowIgnored(ignore []*regexp.Regexp, relPath string) bool {
+	for _, re := range ignore {
+		if strings.Contains(re.String(), "/") {
+			if re.MatchString("/" + relPath) {
+				return true
+			}
+		} else if re.MatchString(path.Base(relPath)) {
+			return true
+		}
+	}
+	return false
+}
+
+// translateDotfiles turns every "dot-" prefixed path segment into a dotfile
+func translateDotfiles(relPath string) string {
+	segments := strings.Split(relPath, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, "dot-") {
+			segments[i] = "." + strings.TrimPrefix(segment, "dot-")
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// planStowLinks decides which links to create. Without folding every file is
+// linked on its own. With folding, the topmost directory that belongs to a
+// single package and isn't a real directory in home is linked as a whole.
+func planStowLinks(files []stowFile, home, stowDir, repoPrefix string, fold bool) []StowImport {
+	dirOwners := make(map[string]map[string]bool)
+	if fold {
+		for _, f := range files {
+			for dir := path.Dir(f.relPath); dir != "."; dir = path.Dir(dir) {
+				if dirOwners[dir] == nil {
+					dirOwners[dir] = make(map[string]bool)
+				}
+				dirOwners[dir][f.pkg] = true
+			}
+		}
+	}
+
+	byUnit := make(map[string]*StowImport)
+	var units []string
+	for _, f := range files {
+		unit, isDir := f.relPath, false
+		if fold {
+			if dir := foldableDir(f.relPath, dirOwners, home, stowDir); dir != "" {
+				unit, isDir = dir, true
+			}
+		}
+
+		imp, ok := byUnit[unit]
+		if !ok {
+			imp = &StowImport{
+				Package:  f.pkg,
+				RepoPath: path.Join(repoPrefix, unit),
+				Target:   filepath.Join(home, filepath.FromSlash(unit)),
+				Dir:      isDir,
+			}
+			byUnit[unit] = imp
+			units = append(units, unit)
+		}
+		imp.Files++
+	}
+
+	sort.Strings(units)
+	imports := make([]StowImport, 0, len(units))
+	for _, unit := range units {
+		imports = append(imports, *byUnit[unit])
+	}
+	return imports
+}
+
+// foldableDir returns the topmost ancestor directory of relPath that can be
+// linked as a whole, or "" if the file has to be linked on its own
+func foldableDir(relPath string, dirOwners map[string]map[string]bool, home, stowDir string) string {
+	segments := strings.Split(relPath, "/")
+	for i := 1; i < len(segments); i++ {
+		dir := strings.Join(segments[:i], "/")
+		if len(dirOwners[dir]) != 1 {
+			continue
+		}
+
+		// Anything in home other than Stow's own link may hold files that
+		// aren't ours
+		target := filepath.Join(home, filepath.FromSlash(dir))
+		if _, err := os.Lstat(target); err == nil && !linksInto(target, stowDir) {
+			continue
+		}
+		return dir
+	}
+	return ""
+}
+
+// linkStowTarget links target to source. Links into the stow directory are
+// replaced, including folded parent directories, and anything else that
+// is in the way is backed up first. The link is relative with
+// Options["relative_symlinks"].
+func linkStowTarget(home, stowDir, target, source string) error {
+	// Unfold parent directories that Stow linked as a whole
+	rel, err := filepath.Rel(home, filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	dir := home
+	if rel != "." {
+		for _, segment := range strings.Split(rel, string(filepath.Separator)) {
+			dir = filepath.Join(dir, segment)
+			if linksInto(dir, stowDir) {
+				utils.Logger.Debug().Msgf("Unfolding %s", dir)
+				if err := os.Remove(dir); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	if info, err := os.Lstat(target); err == nil {
+		switch {
+		case info.Mode()&os.ModeSymlink != 0 && linksInto(target, stowDir):
+			// The old Stow link, safe to replace
+		case resolvesTo(target, source):
+			return nil
+		case info.IsDir():
+			return fmt.Errorf("%s is a directory", target)
+		default:
+			backupPath, err := BackupFile(target)
+			if err != nil {
+				return err
+			}
+			if backupPath != "" {
+				utils.Logger.Info().Msgf("Backed up %s to %s", target, backupPath)
+			}
+		}
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+
+	return EnsureSymlink(target, symlinkContent(target, source, RelativeSymlinks()))
+}
+
+// linksInto reports whether path is a symlink that points into dir
+func linksInto(path, dir string) bool {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+
+	// Follow the whole chain when possible, Stow usually writes relative links
+	link, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if link, err = os.Readlink(path); err != nil {
+			return false
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(path), link)
+		}
+	}
+
+	rel, err := filepath.Rel(dir, link)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
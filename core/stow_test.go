@@ -0,0 +1,82 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImportStowFold(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	stowDir := filepath.Join(home, "dotfiles")
+	files := map[string]string{
+		"zsh/dot-zshrc":                  "zsh\n",
+		"zsh/README.md":                  "ignored\n",
+		"nvim/.config/nvim/init.lua":     "nvim\n",
+		"nvim/.config/nvim/lua/plug.lua": "plug\n",
+		"git/.config/git/config":         "git\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(stowDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The way Stow left things: a file link and a folded directory
+	if err := os.Symlink(filepath.Join(stowDir, "zsh", "dot-zshrc"), filepath.Join(home, ".zshrc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(home, ".config"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(stowDir, "nvim", ".config", "nvim"), filepath.Join(home, ".config", "nvim")); err != nil {
+		t.Fatal(err)
+	}
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	imports, err := ImportStow(dotpilotDir, stowDir, StowImportOptions{Layer: "common", Fold: true, Dotfiles: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// .config is shared by two packages, so it stays a real directory
+	want := map[string]bool{
+		"common/.config/git":  true,
+		"common/.config/nvim": true,
+		"common/.zshrc":       false,
+	}
+	if len(imports) != len(want) {
+		t.Fatalf("imports = %+v, want %d links", imports, len(want))
+	}
+	for _, imp := range imports {
+		isDir, ok := want[imp.RepoPath]
+		if !ok || imp.Dir != isDir {
+			t.Errorf("unexpected import %+v", imp)
+		}
+		link, err := os.Readlink(imp.Target)
+		if err != nil || link != filepath.Join(dotpilotDir, filepath.FromSlash(imp.RepoPath)) {
+			t.Errorf("%s links to %q, %v", imp.Target, link, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dotpilotDir, "common", "README.md")); !os.IsNotExist(err) {
+		t.Error("README.md was imported despite Stow's ignore list")
+	}
+
+	// Applying afterwards must leave the folded links and the repo files alone
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dotpilotDir, "common", ".config", "nvim", "lua", "plug.lua"))
+	if err != nil || string(data) != "plug\n" {
+		t.Errorf("repo file damaged by apply: %q, %v", data, err)
+	}
+	if link, err := os.Readlink(filepath.Join(home, ".config", "nvim")); err != nil || link != filepath.Join(dotpilotDir, "common", ".config", "nvim") {
+		t.Errorf("folded link replaced by apply: %q, %v", link, err)
+	}
+}
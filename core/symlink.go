@@ -0,0 +1,283 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// Tracked symlinks
+//
+// A symlink of the user's own, like ~/.config/foo pointing to a mounted
+// volume, is tracked as a symlink descriptor rather than by copying what it
+// points to: a small file named after the target with symlinkSuffix appended
+// that holds the link target. Apply recreates the symlink verbatim at the
+// target without the suffix. The repository doesn't hold a real symlink
+// because go-git rewrites absolute symlink targets relative to the worktree
+// when committing, which breaks them on every other machine.
+
+// symlinkSuffix marks a symlink descriptor in a layer
+const symlinkSuffix = ".dotpilot-symlink"
+
+// isForeignSymlink reports whether path is a symlink that doesn't resolve into
+// the repository, so it wasn't created by dotpilot. Dangling symlinks count as
+// foreign.
+func isForeignSymlink(path, dotpilotDir string) bool {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return true
+	}
+	repoDir, err := filepath.EvalSymlinks(dotpilotDir)
+	if err != nil {
+		return true
+	}
+	return !insideDir(resolved, repoDir)
+}
+
+// walkTree walks the tree at root like filepath.Walk, but symlinks to
+// directories that follow accepts are followed: fn sees them with the info of
+// the directory and the paths below them as below the link. A link back into a
+// directory being walked, or to a parent of one, is not followed but passed on
+// as a link with a warning, so loops end. A nil follow follows no links.
+func walkTree(root string, follow func(path string) bool, fn filepath.WalkFunc) error {
+	var walked []string
+	var walk func(walkRoot, shownRoot string) error
+	walk = func(walkRoot, shownRoot string) error {
+		if real, err := filepath.EvalSymlinks(walkRoot); err == nil {
+			walked = append(walked, real)
+		}
+		return filepath.Walk(walkRoot, func(walkPath string, info os.FileInfo, err error) error {
+			relPath, relErr := filepath.Rel(walkRoot, walkPath)
+			if relErr != nil {
+				return relErr
+			}
+			path := filepath.Join(shownRoot, relPath)
+			if err != nil || follow == nil || info.Mode()&os.ModeSymlink == 0 || !follow(path) {
+				return fn(path, info, err)
+			}
+
+			target, statErr := os.Stat(walkPath)
+			if statErr != nil || !target.IsDir() {
+				return fn(path, info, nil)
+			}
+			real, err := filepath.EvalSymlinks(walkPath)
+			if err != nil {
+				return fn(path, info, err)
+			}
+			for _, dir := range walked {
+				if insideDir(real, dir) || insideDir(dir, real) {
+					utils.Logger.Warn().Msgf("Not following %s, it leads back to %s", path, dir)
+					return fn(path, info, nil)
+				}
+			}
+
+			if err := fn(path, target, nil); err != nil {
+				if err == filepath.SkipDir {
+					return nil
+				}
+				return err
+			}
+			return walk(real, path)
+		})
+	}
+
+	walkRoot := root
+	if follow != nil && follow(root) {
+		if real, err := filepath.EvalSymlinks(root); err == nil {
+			walkRoot = real
+		}
+	}
+	return walk(walkRoot, root)
+}
+
+// trackSymlink stores the symlink source in the repository as a descriptor
+// next to where destination would be. The content it points to is not copied.
+// The symlink in the home directory already is what apply would create, so it
+// is left in place.
+func (t *tracker) trackSymlink(source, destination string) error {
+	linkTarget, err := os.Readlink(source)
+	if err != nil {
+		return err
+	}
+
+	// Check if destination already exists
+	descriptor := destination + symlinkSuffix
+	if current, err := linkSourceFor(descriptor); err == nil && current == linkTarget {
+		utils.Logger.Info().Msgf("%s is already tracked", source)
+		t.plan(source, descriptor, TrackAlreadyLinked, false)
+		return nil
+	}
+	if write, err := t.shouldWrite(source, descriptor); !write || err != nil {
+		return err
+	}
+	t.plan(source, descriptor, TrackSymlink, false)
+	if t.dryRun {
+		return nil
+	}
+
+	// Create destination directory
+	if err := os.MkdirAll(filepath.Dir(descriptor), 0755); err != nil {
+		return err
+	}
+
+	utils.Logger.Debug().Msgf("Tracking symlink %s -> %s", source, linkTarget)
+	if err := ioutil.WriteFile(descriptor, []byte(linkTarget+"\n"), 0644); err != nil {
+		return err
+	}
+
+	// Update tracking list
+	home, _ := Home()
+	if relSource, ok := trackingPath(home, source); ok {
+		AddTrackingPath(relSource)
+	}
+
+	return nil
+}
+
+// isSymlinkDescriptor reports whether a layer file stands for a tracked symlink
+func isSymlinkDescriptor(path string) bool {
+	return strings.HasSuffix(path, symlinkSuffix)
+}
+
+// linkSourceFor returns what the target of a layer file links to: the link
+// target held by a symlink descriptor, or the layer file itself
+func linkSourceFor(path string) (string, error) {
+	if !isSymlinkDescriptor(path) {
+		return path, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	linkTarget := strings.TrimRight(string(data), "\r\n")
+	if linkTarget == "" {
+		return "", fmt.Errorf("symlink descriptor %s is empty", path)
+	}
+	return linkTarget, nil
+}
+
+// readLayerFile returns the content of a layer file. Symlinks, and the
+// descriptors standing for them, read as where they point, so a tracked
+// symlink compares equal to the symlink apply created from it.
+func readLayerFile(path string) ([]byte, error) {
+	if isSymlinkDescriptor(path) {
+		linkTarget, err := linkSourceFor(path)
+		if err != nil {
+			return nil, err
+		}
+		return []byte("symlink to " + linkTarget + "\n"), nil
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		linkTarget, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		return []byte("symlink to " + linkTarget + "\n"), nil
+	}
+	return ioutil.ReadFile(path)
+}
+
+// Relative links
+//
+// The links to repo files are absolute by default. With
+// Options["relative_symlinks"] in ~/.dotpilotrc, or --relative, they are
+// relative to the directory of the target instead, like
+// ../.dotpilot/common/.bashrc, so they keep resolving when the home directory
+// and the repository move together, for example to a new disk. Everything
+// that checks a link accepts both forms.
+
+// RelativeSymlinks reports whether Options["relative_symlinks"] asks for
+// relative links
+func RelativeSymlinks() bool {
+	relative, _ := GetConfig().Options["relative_symlinks"].(bool)
+	return relative
+}
+
+// symlinkContent returns what a link at target to source holds: source
+// itself or, with relative, the path to it from the directory of target
+func symlinkContent(target, source string, relative bool) string {
+	if !relative || !filepath.IsAbs(source) {
+		return source
+	}
+	relSource, err := filepath.Rel(filepath.Dir(target), source)
+	if err != nil {
+		return source
+	}
+	return relSource
+}
+
+// readLinkTarget returns where the symlink at path points, with a relative
+// link resolved against the directory of path
+func readLinkTarget(path string) (string, error) {
+	link, err := os.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(link) {
+		link = filepath.Join(filepath.Dir(path), link)
+	}
+	return filepath.Clean(link), nil
+}
+
+// linksTo reports whether path is a symlink to source, either absolute or
+// relative
+func linksTo(path, source string) bool {
+	link, err := os.Readlink(path)
+	if err != nil {
+		return false
+	}
+	if link == source {
+		return true
+	}
+	if !filepath.IsAbs(source) {
+		return false
+	}
+	resolved, err := readLinkTarget(path)
+	return err == nil && resolved == filepath.Clean(source)
+}
+
+// EnsureSymlink makes target a symlink with the content source, like
+// os.Symlink(source, target), but tolerates a target created in the meantime,
+// by a retry or another apply running at the same time. A symlink at target
+// that already links to source is fine, another symlink is replaced once. A
+// file or directory that appeared at target is left alone and the error
+// returned.
+func EnsureSymlink(target, source string) error {
+	err := symlink(source, target)
+	if err == nil || !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	if linksTo(target, source) {
+		return nil
+	}
+	if info, lstatErr := os.Lstat(target); lstatErr != nil || info.Mode()&os.ModeSymlink == 0 {
+		return err
+	}
+
+	utils.Logger.Debug().Msgf("Replacing symlink %s, it changed while linking", target)
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = symlink(source, target)
+	if errors.Is(err, fs.ErrExist) && linksTo(target, source) {
+		return nil
+	}
+	return err
+}
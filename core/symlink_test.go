@@ -0,0 +1,62 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestEnsureSymlinkConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "repo", ".zshrc")
+	target := filepath.Join(dir, ".zshrc")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 16)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = EnsureSymlink(target, source)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("goroutine %d: %v", i, err)
+		}
+	}
+	if link, err := os.Readlink(target); err != nil || link != source {
+		t.Errorf("link = %q, %v, want %q", link, err, source)
+	}
+}
+
+func TestEnsureSymlinkExisting(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "repo", ".zshrc")
+	target := filepath.Join(dir, ".zshrc")
+
+	// A stale link is replaced
+	if err := os.Symlink(filepath.Join(dir, "old", ".zshrc"), target); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureSymlink(target, source); err != nil {
+		t.Fatal(err)
+	}
+	if link, err := os.Readlink(target); err != nil || link != source {
+		t.Errorf("link = %q, %v, want %q", link, err, source)
+	}
+
+	// A file is not
+	file := filepath.Join(dir, ".bashrc")
+	if err := os.WriteFile(file, []byte("local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureSymlink(file, source); !os.IsExist(err) {
+		t.Errorf("EnsureSymlink over a file = %v, want it to exist", err)
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "local\n" {
+		t.Errorf("the file is now %q, %v", data, err)
+	}
+}
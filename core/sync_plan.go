@@ -0,0 +1,236 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// SyncPlanOptions configures PlanSync
+type SyncPlanOptions struct {
+	// Fetch updates the remote-tracking branch first, otherwise the plan is
+	// made against the remote as last fetched
+	Fetch bool
+}
+
+// SyncPlan is what 'dotpilot sync' would do, computed without changing the
+// repository, its branches or the home directory
+type SyncPlan struct {
+	Environment string `json:"environment"`
+	// Uncommitted are the repo paths with changes that sync would commit, or
+	// stash with --stash, before pulling
+	Uncommitted []string `json:"uncommitted"`
+	// RemoteErr is why the remote couldn't be compared, for example because
+	// the fetch failed or the branch has no remote-tracking branch. Incoming,
+	// Outgoing, Apply and Conflicts are empty then.
+	RemoteErr string `json:"remote_error,omitempty"`
+	// Incoming are the commits a pull would bring in, newest first
+	Incoming []CommitSummary `json:"incoming"`
+	// Outgoing are the commits a push would send, newest first, not counting
+	// the commit of the uncommitted changes
+	Outgoing []CommitSummary `json:"outgoing"`
+	// Diverged is set when both sides have commits, so the pull has to merge
+	Diverged bool `json:"diverged"`
+	// Apply are the files in the home directory the pulled changes would
+	// update, sorted by target
+	Apply []PlannedChange `json:"apply"`
+	// Conflicts are the files in Apply whose target has local changes that
+	// applying would replace
+	Conflicts []PlannedChange `json:"conflicts"`
+}
+
+// PlannedChange is a file in the home directory sync would change
+type PlannedChange struct {
+	RepoPath string `json:"repo_path"` // Slash-separated path relative to the dotpilot repository
+	Target   string `json:"target"`
+	// Action is "create" for a target that doesn't exist yet, "update" for a
+	// target whose content changes, "delete" for a file removed upstream whose
+	// link would dangle, or "replace" for a target with local changes that
+	// apply would back up and replace, or prompt for
+	Action string `json:"action"`
+	// Diff from the file in the home directory to the incoming version, only
+	// set for conflicts
+	Diff string `json:"diff,omitempty"`
+}
+
+// PlanSync computes what a sync of environment would do: the changes it
+// would commit, the commits it would pull and push, the files applying the
+// pulled commits would change and which of those have local changes in the
+// way. With opts.Fetch the remote-tracking branch is updated like 'dotpilot
+// fetch' does; nothing else is written.
+func PlanSync(dotpilotDir, environment string, opts SyncPlanOptions) (*SyncPlan, error) {
+	plan := &SyncPlan{
+		Environment: environment,
+		Incoming:    []CommitSummary{},
+		Outgoing:    []CommitSummary{},
+		Apply:       []PlannedChange{},
+		Conflicts:   []PlannedChange{},
+	}
+
+	uncommitted, err := uncommittedFiles(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	plan.Uncommitted = uncommitted
+
+	if opts.Fetch {
+		if err := FetchChanges(dotpilotDir); err != nil {
+			plan.RemoteErr = classifyRemoteError(context.Background(), err).Error()
+			return plan, nil
+		}
+	}
+
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	remoteRef, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", head.Name().Short()), true)
+	if err != nil {
+		plan.RemoteErr = "no remote-tracking branch for " + head.Name().Short()
+		return plan, nil
+	}
+
+	if plan.Incoming, err = IncomingCommits(dotpilotDir); err != nil {
+		return nil, err
+	}
+	if plan.Outgoing, err = OutgoingCommits(dotpilotDir); err != nil {
+		return nil, err
+	}
+	plan.Diverged = len(plan.Incoming) > 0 && len(plan.Outgoing) > 0
+	if len(plan.Incoming) == 0 {
+		return plan, nil
+	}
+
+	changes, err := RemoteChanges(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	remoteTree, err := commitTree(repo, remoteRef.Hash())
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := repoPrefix(repo, dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := activeLayers(dotpilotDir, environment)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, change := range changes {
+		if change.Target == "" || !inLayers(dotpilotDir, change.RepoPath, layers) || !IsSparseIncluded(change.RepoPath) {
+			continue
+		}
+		remote, err := treeFileContent(remoteTree, prefix+change.RepoPath)
+		if err != nil {
+			return nil, err
+		}
+
+		planned := PlannedChange{RepoPath: change.RepoPath, Target: change.Target}
+		planned.Action, planned.Diff = plannedAction(dotpilotDir, change, remote)
+		if planned.Action == "" {
+			continue
+		}
+		plan.Apply = append(plan.Apply, planned)
+		if planned.Action == "replace" {
+			plan.Conflicts = append(plan.Conflicts, planned)
+		}
+	}
+	sort.Slice(plan.Apply, func(i, j int) bool { return plan.Apply[i].Target < plan.Apply[j].Target })
+	sort.Slice(plan.Conflicts, func(i, j int) bool { return plan.Conflicts[i].Target < plan.Conflicts[j].Target })
+
+	return plan, nil
+}
+
+// plannedAction returns what applying the remote version of a changed file
+// does to its target, and for local changes in the way the diff from the
+// target to the remote version. It returns an empty action if applying
+// leaves the target alone.
+func plannedAction(dotpilotDir string, change FileChange, remote []byte) (string, string) {
+	if _, err := os.Lstat(change.Target); os.IsNotExist(err) {
+		if remote == nil {
+			return "", ""
+		}
+		return "create", ""
+	}
+
+	// A target linked to the repository follows the pull
+	linked := resolvesTo(change.Target, filepath.Join(dotpilotDir, filepath.FromSlash(change.RepoPath)))
+	if link, err := readLinkTarget(change.Target); err == nil && insideDir(link, filepath.Clean(dotpilotDir)) {
+		linked = true
+	}
+	switch {
+	case remote == nil && linked:
+		return "delete", ""
+	case remote == nil:
+		// Removed upstream, apply leaves the file alone
+		return "", ""
+	case linked:
+		return "update", ""
+	}
+
+	var local []byte
+	var err error
+	if isSymlinkDescriptor(change.RepoPath) {
+		local, err = readLayerFile(change.Target)
+	} else {
+		local, err = os.ReadFile(change.Target)
+	}
+	if err == nil && sameIgnoringWhitespace(local, remote) {
+		return "update", ""
+	}
+	return "replace", UnifiedDiff(change.Target, "b/"+change.RepoPath, comparableContent(local), comparableContent(remote))
+}
+
+// inLayers reports whether repoPath lies in one of the layer directories
+func inLayers(dotpilotDir, repoPath string, layers []string) bool {
+	path := filepath.Join(dotpilotDir, filepath.FromSlash(repoPath))
+	for _, layer := range layers {
+		if insideDir(path, layer) {
+			return true
+		}
+	}
+	return false
+}
+
+// uncommittedFiles returns the repo paths with staged or unstaged changes,
+// sorted
+func uncommittedFiles(dotpilotDir string) ([]string, error) {
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	status, err := w.Status()
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := repoPrefix(repo, dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for path, fileStatus := range status {
+		if fileStatus.Staging == git.Unmodified && fileStatus.Worktree == git.Unmodified {
+			continue
+		}
+		if relPath, ok := trimRepoPrefix(prefix, path); ok {
+			files = append(files, relPath)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
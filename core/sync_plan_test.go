@@ -0,0 +1,98 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestPlanSync(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	remoteDir := t.TempDir()
+	if _, err := git.PlainInit(remoteDir, false); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, remoteDir, "common/.zshrc", "one\n")
+	writeRepoFile(t, remoteDir, "common/.vimrc", "one\n")
+	if err := CommitChanges(remoteDir, "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if _, err := git.PlainClone(dotpilotDir, false, &git.CloneOptions{URL: remoteDir}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "default", ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, home, ".bashrc", "local\n")
+
+	// Upstream changes one file, removes one and adds two, one of which is
+	// in the way of a local file
+	writeRepoFile(t, remoteDir, "common/.zshrc", "two\n")
+	if err := os.Remove(filepath.Join(remoteDir, "common", ".vimrc")); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, remoteDir, "common/.inputrc", "new\n")
+	writeRepoFile(t, remoteDir, "common/.bashrc", "remote\n")
+	writeRepoFile(t, remoteDir, "envs/work/.tmux.conf", "other environment\n")
+	if err := CommitChanges(remoteDir, "remote change"); err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "edited\n")
+
+	before, err := HeadHash(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := PlanSync(dotpilotDir, "default", SyncPlanOptions{Fetch: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.RemoteErr != "" {
+		t.Fatalf("remote error: %s", plan.RemoteErr)
+	}
+	if want := []string{"common/.zshrc"}; !reflect.DeepEqual(plan.Uncommitted, want) {
+		t.Errorf("uncommitted = %v, want %v", plan.Uncommitted, want)
+	}
+	if len(plan.Incoming) != 1 || plan.Incoming[0].Subject != "remote change" {
+		t.Errorf("incoming = %+v, want the remote change", plan.Incoming)
+	}
+	if len(plan.Outgoing) != 0 || plan.Diverged {
+		t.Errorf("outgoing = %+v, diverged = %v", plan.Outgoing, plan.Diverged)
+	}
+
+	actions := map[string]string{}
+	for _, change := range plan.Apply {
+		actions[change.RepoPath] = change.Action
+	}
+	want := map[string]string{
+		"common/.bashrc":  "replace",
+		"common/.inputrc": "create",
+		"common/.vimrc":   "delete",
+		"common/.zshrc":   "update",
+	}
+	if !reflect.DeepEqual(actions, want) {
+		t.Errorf("actions = %v, want %v", actions, want)
+	}
+	if len(plan.Conflicts) != 1 || plan.Conflicts[0].Target != filepath.Join(home, ".bashrc") || plan.Conflicts[0].Diff == "" {
+		t.Errorf("conflicts = %+v, want ~/.bashrc with a diff", plan.Conflicts)
+	}
+
+	// Nothing but the remote-tracking branch changed
+	if after, err := HeadHash(dotpilotDir); err != nil || after != before {
+		t.Errorf("HEAD moved from %s to %s, %v", before, after, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dotpilotDir, "common", ".zshrc")); err != nil || string(data) != "edited\n" {
+		t.Errorf("worktree changed: %q, %v", data, err)
+	}
+	if _, err := os.Lstat(filepath.Join(home, ".inputrc")); !os.IsNotExist(err) {
+		t.Errorf("~/.inputrc was created: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// layerMetaFiles are the files at the top of a layer that configure dotpilot
+// rather than being dotfiles: setup scripts, hooks and the layer's README
+var layerMetaFiles = map[string]bool{
+	"install_packages.sh": true,
+	"preinstall.sh":       true,
+	"postinstall.sh":      true,
+	"postpull.sh":         true,
+	"README.md":           true,
+}
+
+// TrackedDotfile is a committed dotfile, a file of a layer that is applied
+// into the home directory
+type TrackedDotfile struct {
+	RepoPath string `json:"repo_path"` // Slash-separated path relative to the dotpilot repository
+	// Layer is "common", "envs/<env>" or "machine/<hostname>"
+	Layer string `json:"layer"`
+	// Target is the slash-separated path the file is applied to, relative to
+	// the home directory
+	Target string `json:"target"`
+}
+
+// GetTrackedDotfiles returns the committed dotfiles, sorted by repo path. Unlike
+// GetTrackedFiles it leaves out everything that isn't applied as a dotfile:
+// files outside the layers like secrets, .sops.yaml and apply-hooks.json, and
+// the setup scripts, hooks, package lists, machine fingerprints and .gitkeep
+// files inside them.
+func GetTrackedDotfiles(dotpilotDir string) ([]TrackedDotfile, error) {
+	files, err := GetTrackedFiles(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	return dotfilesOf(files), nil
+}
+
+// dotfilesOf returns the dotfiles among repo paths, sorted by repo path
+func dotfilesOf(files []string) []TrackedDotfile {
+	var dotfiles []TrackedDotfile
+	for _, file := range files {
+		if dotfile, ok := trackedDotfile(file); ok {
+			dotfiles = append(dotfiles, dotfile)
+		}
+	}
+	sort.Slice(dotfiles, func(i, j int) bool { return dotfiles[i].RepoPath < dotfiles[j].RepoPath })
+	return dotfiles
+}
+
+// trackedDotfile classifies a repo path, returning false if it isn't a dotfile
+func trackedDotfile(repoPath string) (TrackedDotfile, bool) {
+	target, ok := RepoPathToTarget("", repoPath)
+	if !ok {
+		return TrackedDotfile{}, false
+	}
+	layer := layerOf(repoPath)
+	relPath := strings.TrimPrefix(repoPath, layer+"/")
+
+	if path.Base(relPath) == ".gitkeep" || layerMetaFiles[relPath] {
+		return TrackedDotfile{}, false
+	}
+	if strings.HasPrefix(relPath, "packages.") && !strings.Contains(relPath, "/") {
+		return TrackedDotfile{}, false
+	}
+	return TrackedDotfile{RepoPath: repoPath, Layer: layer, Target: filepath.ToSlash(target)}, true
+}
+
+// DotfileReport is a tracked dotfile with the state of its target, as listed
+// by 'dotpilot list'
+type DotfileReport struct {
+	Path       string     `json:"path"`   // Slash-separated path relative to the dotpilot repository
+	Layer      string     `json:"layer"`  // "common", "envs/<env>" or "machine/<hostname>"
+	Target     string     `json:"target"` // Path the file is applied to
+	LinkStatus LinkHealth `json:"linkStatus"`
+}
+
+// Report returns dotfile with the state of its target below home
+func (d TrackedDotfile) Report(dotpilotDir, home string) DotfileReport {
+	return DotfileReport{
+		Path:       d.RepoPath,
+		Layer:      d.Layer,
+		Target:     d.TargetPath(home),
+		LinkStatus: d.Health(dotpilotDir, home),
+	}
+}
+
+// LinkHealth is the state of the target of a tracked dotfile
+type LinkHealth string
+
+const (
+	HealthLinked    LinkHealth = "linked"    // The target resolves to the repo file
+	HealthMissing   LinkHealth = "missing"   // Nothing exists at the target
+	HealthBroken    LinkHealth = "broken"    // The target is a symlink to nothing
+	HealthElsewhere LinkHealth = "elsewhere" // The target links to another file, like that of a higher layer
+	HealthUnlinked  LinkHealth = "unlinked"  // A regular file or directory is at the target
+)
+
+// TargetPath returns the path dotfile is applied to below home, in the
+// relocated XDG base directory if there is one
+func (d TrackedDotfile) TargetPath(home string) string {
+	return expandXDG(home, d.Target)
+}
+
+// Health returns the state of the target of dotfile below home. Tracked
+// symlinks are linked when the target holds the same link target as their
+// descriptor.
+func (d TrackedDotfile) Health(dotpilotDir, home string) LinkHealth {
+	target := d.TargetPath(home)
+	info, err := os.Lstat(target)
+	if err != nil {
+		return HealthMissing
+	}
+
+	source := filepath.Join(dotpilotDir, filepath.FromSlash(d.RepoPath))
+	if isSymlinkDescriptor(source) {
+		if linkSource, err := linkSourceFor(source); err == nil && linksTo(target, linkSource) {
+			return HealthLinked
+		}
+	} else if resolvesTo(target, source) {
+		return HealthLinked
+	}
+
+	if info.Mode()&os.ModeSymlink == 0 {
+		return HealthUnlinked
+	}
+	if _, err := os.Stat(target); err != nil {
+		return HealthBroken
+	}
+	return HealthElsewhere
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestGetTrackedDotfiles(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := []string{
+		".sops.yaml",
+		"apply-hooks.json",
+		"secrets/token",
+		"common/install_packages.sh",
+		"common/packages.brew",
+		"envs/work/postpull.sh",
+		"envs/empty/.gitkeep",
+		"machine/laptop/machine.json",
+		"machine/laptop/README.md",
+	}
+	dotfiles := []string{
+		"common/.zshrc",
+		"common/bin/backup.sh",
+		"common/.config/app/packages.json",
+		"envs/work/.gitconfig",
+		"machine/laptop/.ssh/config.dotpilot-symlink",
+	}
+	for _, name := range append(meta, dotfiles...) {
+		writeRepoFile(t, dotpilotDir, name, name+"\n")
+	}
+	if err := CommitChanges(dotpilotDir, "meta files and dotfiles"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetTrackedDotfiles(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TrackedDotfile{
+		{RepoPath: "common/.config/app/packages.json", Layer: "common", Target: ".config/app/packages.json"},
+		{RepoPath: "common/.zshrc", Layer: "common", Target: ".zshrc"},
+		{RepoPath: "common/bin/backup.sh", Layer: "common", Target: "bin/backup.sh"},
+		{RepoPath: "envs/work/.gitconfig", Layer: "envs/work", Target: ".gitconfig"},
+		{RepoPath: "machine/laptop/.ssh/config.dotpilot-symlink", Layer: "machine/laptop", Target: ".ssh/config"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTrackedDotfiles = %+v, want %+v", got, want)
+	}
+
+	// The raw list still has everything
+	tracked, err := GetTrackedFiles(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracked) != len(meta)+len(dotfiles) {
+		t.Errorf("GetTrackedFiles = %v, want all %d files", tracked, len(meta)+len(dotfiles))
+	}
+	if !sort.StringsAreSorted(tracked) {
+		t.Errorf("GetTrackedFiles = %v, want it sorted", tracked)
+	}
+}
+
+func TestTrackedDotfileHealth(t *testing.T) {
+	home := t.TempDir()
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	for _, name := range []string{"common/.linked", "common/.missing", "common/.replaced", "common/.shadowed", "envs/work/.shadowed", "common/.broken"} {
+		writeRepoFile(t, dotpilotDir, name, name+"\n")
+	}
+	writeRepoFile(t, dotpilotDir, "common/.ssh/config.dotpilot-symlink", "/etc/ssh/ssh_config\n")
+
+	link := func(source, target string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(source, target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link(filepath.Join(dotpilotDir, "common", ".linked"), filepath.Join(home, ".linked"))
+	link(filepath.Join(dotpilotDir, "envs", "work", ".shadowed"), filepath.Join(home, ".shadowed"))
+	link(filepath.Join(dotpilotDir, "common", ".gone"), filepath.Join(home, ".broken"))
+	link("/etc/ssh/ssh_config", filepath.Join(home, ".ssh", "config"))
+	writeRepoFile(t, home, ".replaced", "local edit\n")
+
+	tests := map[string]LinkHealth{
+		"common/.linked":                      HealthLinked,
+		"common/.missing":                     HealthMissing,
+		"common/.replaced":                    HealthUnlinked,
+		"common/.shadowed":                    HealthElsewhere,
+		"envs/work/.shadowed":                 HealthLinked,
+		"common/.broken":                      HealthBroken,
+		"common/.ssh/config.dotpilot-symlink": HealthLinked,
+	}
+	for repoPath, want := range tests {
+		dotfile, ok := trackedDotfile(repoPath)
+		if !ok {
+			t.Fatalf("%s is not a dotfile", repoPath)
+		}
+		if got := dotfile.Health(dotpilotDir, home); got != want {
+			t.Errorf("Health(%s) = %s, want %s", repoPath, got, want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package core
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Tracking drift
+//
+// The tracking paths of ~/.dotpilotrc, the dotfiles of the repository and the
+// links in the home directory are meant to agree, but drift apart: a file
+// removed from the repo by hand stays in the tracking paths, a pull brings
+// dotfiles no command recorded, and a link made by an older dotpilot or by
+// hand isn't recorded either. CheckTracking compares the three for the layers
+// applied on this machine, and FixTracking brings the tracking paths in line
+// with the repository. Nothing in the repository or the home directory is
+// changed by either.
+
+// TrackingDrift is where the tracking paths, the repository and the home
+// directory disagree
+type TrackingDrift struct {
+	// MissingFromRepo are the tracking paths no applied layer has a file for
+	MissingFromRepo []string
+	// NotInConfig are the dotfiles of the applied layers no tracking path
+	// covers, one per target
+	NotInConfig []TrackedDotfile
+	// UntrackedLinks are the links into the repository in the home directory
+	// that no tracking path covers, without the targets of NotInConfig
+	UntrackedLinks []CleanLink
+}
+
+// Empty reports whether the tracking paths, repository and home directory
+// agree
+func (d TrackingDrift) Empty() bool {
+	return len(d.MissingFromRepo) == 0 && len(d.NotInConfig) == 0 && len(d.UntrackedLinks) == 0
+}
+
+// CheckTracking compares the tracking paths with the repository and the home
+// directory, see TrackingDrift
+func (r *Repository) CheckTracking() (TrackingDrift, error) {
+	return checkTracking(r.Dir, r.Home, r.Environment(), GetConfig().TrackingPaths)
+}
+
+// checkTracking compares tracked, the tracking paths, with the layers of
+// environment in dotpilotDir and the links below home
+func checkTracking(dotpilotDir, home, environment string, tracked []string) (TrackingDrift, error) {
+	var drift TrackingDrift
+
+	dotpilotDir, err := filepath.Abs(dotpilotDir)
+	if err != nil {
+		return drift, err
+	}
+	layers, err := appliedLayers(environment, "")
+	if err != nil {
+		return drift, err
+	}
+	targets := make([]string, len(tracked))
+	for i, p := range tracked {
+		targets[i] = trackingTarget(home, p)
+	}
+
+	for i, target := range targets {
+		if !providedByLayers(dotpilotDir, home, target, layers) {
+			drift.MissingFromRepo = append(drift.MissingFromRepo, tracked[i])
+		}
+	}
+
+	// A repository without commits has no dotfiles yet
+	dotfiles, err := GetTrackedDotfiles(dotpilotDir)
+	if err != nil && !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return drift, err
+	}
+	applied := make(map[string]bool, len(layers))
+	for _, layer := range layers {
+		applied[layer] = true
+	}
+	reported := make(map[string]bool)
+	for _, dotfile := range dotfiles {
+		target := dotfile.TargetPath(home)
+		if !applied[dotfile.Layer] || !IsSparseIncluded(dotfile.RepoPath) || reported[target] || coveredBy(target, targets) {
+			continue
+		}
+		reported[target] = true
+		drift.NotInConfig = append(drift.NotInConfig, dotfile)
+	}
+	sort.Slice(drift.NotInConfig, func(i, j int) bool { return drift.NotInConfig[i].Target < drift.NotInConfig[j].Target })
+
+	links, err := repositoryLinks(dotpilotDir, home)
+	if err != nil {
+		return drift, err
+	}
+	for _, link := range links {
+		if !reported[link.Target] && !coveredBy(link.Target, targets) {
+			drift.UntrackedLinks = append(drift.UntrackedLinks, link)
+		}
+	}
+	return drift, nil
+}
+
+// FixTracking drops the tracking paths of drift.MissingFromRepo and adds
+// those of drift.NotInConfig and of the untracked links whose repo file
+// exists. Links to nothing are left for 'dotpilot clean'.
+func (r *Repository) FixTracking(drift TrackingDrift) error {
+	if err := RemoveTrackingPaths(drift.MissingFromRepo...); err != nil {
+		return err
+	}
+
+	var targets []string
+	for _, dotfile := range drift.NotInConfig {
+		targets = append(targets, dotfile.TargetPath(r.Home))
+	}
+	for _, link := range drift.UntrackedLinks {
+		if _, err := os.Stat(link.Source); err == nil {
+			targets = append(targets, link.Target)
+		}
+	}
+	for _, target := range targets {
+		if tracked, ok := trackingPath(r.Home, target); ok {
+			if err := AddTrackingPath(tracked); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// coveredBy reports whether target is one of targets or below one of them,
+// like a file of a tracked directory
+func coveredBy(target string, targets []string) bool {
+	for _, t := range targets {
+		if target == t || insideDir(target, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// repositoryLinks returns the links below home that resolve into
+// dotpilotDir, searched like PlanClean does, sorted by target
+func repositoryLinks(dotpilotDir, home string) ([]CleanLink, error) {
+	realDotpilotDir, err := filepath.EvalSymlinks(dotpilotDir)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := cleanDirs(dotpilotDir, realDotpilotDir, home)
+	if err != nil {
+		return nil, err
+	}
+
+	var links []CleanLink
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Type()&fs.ModeSymlink == 0 {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			source, err := readLinkTarget(path)
+			if err == nil && (insideDir(source, dotpilotDir) || insideDir(source, realDotpilotDir)) {
+				links = append(links, CleanLink{Target: path, Source: source})
+			}
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Target < links[j].Target })
+	return links, nil
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestCheckTracking(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+	currentConfig = Config{TrackingPaths: []string{".zshrc", ".bashrc", ".config/nvim"}}
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{".zshrc", ".vimrc", ".config/nvim/init.vim"} {
+		writeRepoFile(t, dotpilotDir, "common/"+name, name+"\n")
+	}
+	if err := CommitChanges(dotpilotDir, "dotfiles"); err != nil {
+		t.Fatal(err)
+	}
+	// Uncommitted, and only linked
+	writeRepoFile(t, dotpilotDir, "common/.tmux.conf", "tmux\n")
+
+	for name, source := range map[string]string{
+		".zshrc":     "common/.zshrc",
+		".vimrc":     "common/.vimrc",
+		".tmux.conf": "common/.tmux.conf",
+		".profile":   "common/.profile", // Deleted from the repo
+	} {
+		if err := os.Symlink(filepath.Join(dotpilotDir, source), filepath.Join(home, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repo := &Repository{Home: home, Dir: dotpilotDir, Config: currentConfig}
+	drift, err := repo.CheckTracking()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{".bashrc"}; !reflect.DeepEqual(drift.MissingFromRepo, want) {
+		t.Errorf("MissingFromRepo = %v, want %v", drift.MissingFromRepo, want)
+	}
+	if len(drift.NotInConfig) != 1 || drift.NotInConfig[0].RepoPath != "common/.vimrc" {
+		t.Errorf("NotInConfig = %+v, want common/.vimrc", drift.NotInConfig)
+	}
+	var links []string
+	for _, link := range drift.UntrackedLinks {
+		links = append(links, filepath.Base(link.Target))
+	}
+	if want := []string{".profile", ".tmux.conf"}; !reflect.DeepEqual(links, want) {
+		t.Errorf("UntrackedLinks = %v, want %v", links, want)
+	}
+
+	// Fixing leaves the link to nothing for clean
+	if err := repo.FixTracking(drift); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := GetConfig().TrackingPaths, []string{".zshrc", ".config/nvim", ".vimrc", ".tmux.conf"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tracking paths after fix = %v, want %v", got, want)
+	}
+	drift, err = repo.CheckTracking()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift.MissingFromRepo) != 0 || len(drift.NotInConfig) != 0 || len(drift.UntrackedLinks) != 1 {
+		t.Errorf("drift after fix = %+v", drift)
+	}
+}
@@ -0,0 +1,413 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"golang.org/x/crypto/ssh"
+)
+
+// Verifying pulled commits
+//
+// The dotfiles of a repository end up in shell startup files and setup
+// scripts, so whoever can push to the remote can run code on every machine
+// that syncs. With Options["trusted_signers"] in ~/.dotpilotrc, sync pulls
+// with PullVerifiedChanges, which checks every fetched commit before the
+// branch and the worktree, and so the linked dotfiles, get any of them: each
+// must carry a valid signature of one of the listed keys. OpenPGP keys are
+// listed by their fingerprint, as gpg --fingerprint shows it, and their
+// public keys are taken from the gpg keyring. SSH keys are listed by their
+// SHA256 fingerprint, as ssh-keygen -lf shows it, and the public key comes
+// with the signature. A commit that is unsigned, signed by another key or whose
+// signature doesn't match fails the check.
+//
+// The commits already checked are those of VerifiedRef, which is moved along
+// with every verified pull and every push, so commits are never trusted just
+// because they made it onto the branch. The first verified pull takes the
+// commits of HEAD as checked.
+
+const trustedSignersOption = "trusted_signers"
+
+// VerifiedRef is the last commit whose history was verified, or pushed from
+// this machine, see PullVerifiedChanges
+const VerifiedRef = plumbing.ReferenceName("refs/dotpilot/verified")
+
+// sshSignatureNamespace is the namespace git signs commits in with SSH keys
+const sshSignatureNamespace = "git"
+
+// UntrustedCommit is a pulled commit that isn't signed by a trusted key
+type UntrustedCommit struct {
+	Hash    string
+	Subject string
+	Reason  string // Why the commit isn't trusted, like "unsigned"
+}
+
+// UntrustedCommitsError reports the pulled commits that failed verification
+type UntrustedCommitsError struct {
+	Commits []UntrustedCommit
+}
+
+func (e *UntrustedCommitsError) Error() string {
+	var commits []string
+	for _, c := range e.Commits {
+		commits = append(commits, fmt.Sprintf("%s (%s)", c.Hash[:7], c.Reason))
+	}
+	return fmt.Sprintf("pulled commits not signed by a trusted key: %s", strings.Join(commits, ", "))
+}
+
+// Is makes errors.Is(err, ErrUntrustedCommit) match an UntrustedCommitsError
+func (e *UntrustedCommitsError) Is(target error) bool {
+	return target == ErrUntrustedCommit
+}
+
+// TrustedSigners returns the fingerprints Options["trusted_signers"] in
+// ~/.dotpilotrc lists, normalized like normalizeFingerprint. No fingerprints
+// means pulled commits aren't verified.
+func TrustedSigners() ([]string, error) {
+	value, ok := GetConfig().Options[trustedSignersOption]
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	var items []interface{}
+	switch v := value.(type) {
+	case []interface{}:
+		items = v
+	case []string:
+		for _, item := range v {
+			items = append(items, item)
+		}
+	default:
+		return nil, fmt.Errorf(`invalid trusted_signers option: expected a list of fingerprints like ["SHA256:..."]`)
+	}
+
+	var signers []string
+	for _, item := range items {
+		fingerprint, ok := item.(string)
+		if !ok || strings.TrimSpace(fingerprint) == "" {
+			return nil, fmt.Errorf("invalid trusted_signers option: %v is not a fingerprint", item)
+		}
+		signers = append(signers, normalizeFingerprint(fingerprint))
+	}
+	return signers, nil
+}
+
+// normalizeFingerprint returns an OpenPGP fingerprint in upper case without
+// spaces or a 0x prefix, and an SSH fingerprint as it is
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.TrimSpace(fingerprint)
+	if strings.HasPrefix(fingerprint, "SHA256:") {
+		return fingerprint
+	}
+	fingerprint = strings.TrimPrefix(strings.TrimPrefix(fingerprint, "0x"), "0X")
+	return strings.ToUpper(strings.Join(strings.Fields(fingerprint), ""))
+}
+
+// VerifyIncomingCommits checks that every commit tip has and verified doesn't
+// is signed by one of the trusted signers, see TrustedSigners. Without
+// trusted signers nothing is checked. verified is plumbing.ZeroHash if no
+// commit was verified yet. The commits failing the check are returned in an
+// UntrustedCommitsError.
+func VerifyIncomingCommits(dotpilotDir string, tip, verified plumbing.Hash) error {
+	trusted, err := TrustedSigners()
+	if err != nil || len(trusted) == 0 {
+		return err
+	}
+
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[plumbing.Hash]bool)
+	if !verified.IsZero() {
+		if known, err = reachableCommits(repo, verified); err != nil {
+			return err
+		}
+	}
+
+	keyring, err := openPGPKeyring(trusted)
+	if err != nil {
+		return err
+	}
+	trustedSet := make(map[string]bool)
+	for _, fingerprint := range trusted {
+		trustedSet[fingerprint] = true
+	}
+
+	var untrusted []UntrustedCommit
+	var walkErr error
+	err = walkCommits(repo, []plumbing.Hash{tip}, func(hash plumbing.Hash) bool {
+		return known[hash]
+	}, func(hash plumbing.Hash) {
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			walkErr = err
+			return
+		}
+		if reason := verifyCommitSignature(commit, trustedSet, keyring); reason != "" {
+			untrusted = append(untrusted, UntrustedCommit{
+				Hash:    hash.String(),
+				Subject: strings.SplitN(strings.TrimSpace(commit.Message), "\n", 2)[0],
+				Reason:  reason,
+			})
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if walkErr != nil {
+		return walkErr
+	}
+	if len(untrusted) > 0 {
+		return &UntrustedCommitsError{Commits: untrusted}
+	}
+	return nil
+}
+
+// openPGPKeyring returns the armored public keys of the OpenPGP fingerprints
+// of trusted from the gpg keyring, or "" if there are none. Keys gpg doesn't
+// have are left out, so commits signed by them fail verification.
+func openPGPKeyring(trusted []string) (string, error) {
+	var fingerprints []string
+	for _, fingerprint := range trusted {
+		if !strings.HasPrefix(fingerprint, "SHA256:") {
+			fingerprints = append(fingerprints, fingerprint)
+		}
+	}
+	if len(fingerprints) == 0 {
+		return "", nil
+	}
+	if _, err := exec.LookPath("gpg"); err != nil {
+		return "", fmt.Errorf("verifying OpenPGP signatures of pulled commits: %w", ErrGPGUnavailable)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("gpg", append([]string{"--export", "--armor"}, fingerprints...)...)
+	cmd.Stderr = &stderr
+	keyring, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to export the trusted keys from gpg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(keyring), nil
+}
+
+// verifyCommitSignature returns why commit isn't signed by one of trusted,
+// or "" if it is. keyring has the armored OpenPGP keys of trusted.
+func verifyCommitSignature(commit *object.Commit, trusted map[string]bool, keyring string) string {
+	signature := strings.TrimSpace(commit.PGPSignature)
+	switch {
+	case signature == "":
+		return "unsigned"
+	case strings.HasPrefix(signature, "-----BEGIN SSH SIGNATURE-----"):
+		fingerprint, err := verifySSHCommitSignature(commit)
+		if err != nil {
+			return fmt.Sprintf("bad SSH signature: %v", err)
+		}
+		if !trusted[fingerprint] {
+			return "signed by the untrusted key " + fingerprint
+		}
+		return ""
+	default:
+		if keyring == "" {
+			return "signed with OpenPGP, no trusted OpenPGP key"
+		}
+		entity, err := commit.Verify(keyring)
+		if err != nil {
+			return fmt.Sprintf("not signed by a trusted OpenPGP key: %v", err)
+		}
+		if fingerprint := fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint); !trusted[fingerprint] {
+			return "signed by the untrusted key " + fingerprint
+		}
+		return ""
+	}
+}
+
+// sshSignature is an SSH signature, see PROTOCOL.sshsig of OpenSSH
+type sshSignature struct {
+	Magic         [6]byte
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// sshSignedData is what an SSH signature signs, see PROTOCOL.sshsig
+type sshSignedData struct {
+	Magic         [6]byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+// verifySSHCommitSignature checks the SSH signature of commit and returns the
+// SHA256 fingerprint of the key that made it
+func verifySSHCommitSignature(commit *object.Commit) (string, error) {
+	armored := strings.TrimSpace(commit.PGPSignature)
+	armored = strings.TrimPrefix(armored, "-----BEGIN SSH SIGNATURE-----")
+	armored = strings.TrimSuffix(armored, "-----END SSH SIGNATURE-----")
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(armored), ""))
+	if err != nil {
+		return "", err
+	}
+
+	var sig sshSignature
+	if err := ssh.Unmarshal(blob, &sig); err != nil {
+		return "", err
+	}
+	if string(sig.Magic[:]) != "SSHSIG" || sig.Version != 1 {
+		return "", fmt.Errorf("not an SSH signature")
+	}
+	if sig.Namespace != sshSignatureNamespace {
+		return "", fmt.Errorf("signed for %q instead of git", sig.Namespace)
+	}
+	publicKey, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(sig.Signature, &signature); err != nil {
+		return "", err
+	}
+
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return "", fmt.Errorf("unsupported hash algorithm %q", sig.HashAlgorithm)
+	}
+	encoded := &plumbing.MemoryObject{}
+	if err := commit.EncodeWithoutSignature(encoded); err != nil {
+		return "", err
+	}
+	reader, err := encoded.Reader()
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, reader); err != nil {
+		return "", err
+	}
+
+	signed := sshSignedData{
+		Magic:         sig.Magic,
+		Namespace:     sig.Namespace,
+		Reserved:      sig.Reserved,
+		HashAlgorithm: sig.HashAlgorithm,
+		Hash:          h.Sum(nil),
+	}
+	if err := publicKey.Verify(ssh.Marshal(signed), &signature); err != nil {
+		return "", err
+	}
+	return ssh.FingerprintSHA256(publicKey), nil
+}
+
+// PullVerifiedChanges pulls like PullChanges, but fetches first and only
+// fast-forwards the current branch once every fetched commit VerifiedRef
+// doesn't have passed VerifyIncomingCommits. Nothing of a pull failing the
+// check reaches the branch or the worktree, and it is checked again by the
+// next pull. VerifiedRef is moved to the pulled commit.
+func PullVerifiedChanges(dotpilotDir string) error {
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return err
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	auth, err := remoteAuth(repo)
+	if err != nil {
+		return err
+	}
+
+	// Follow the default branch of the remote
+	branch, err := trackDefaultBranch(repo)
+	if err != nil {
+		return err
+	}
+
+	err = repo.Fetch(&git.FetchOptions{
+		RemoteName: "origin",
+		Auth:       auth,
+		Progress:   os.Stdout,
+	})
+	// An empty remote gets its first commits with the next push
+	if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return nil
+	}
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return classifyRemoteError(context.Background(), err)
+	}
+
+	remoteRef, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", branch), true)
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return err
+	}
+	remote := remoteRef.Hash()
+
+	verified := head.Hash()
+	if ref, err := repo.Reference(VerifiedRef, true); err == nil {
+		verified = ref.Hash()
+	}
+	if err := VerifyIncomingCommits(dotpilotDir, remote, verified); err != nil {
+		return err
+	}
+
+	// Only fast-forward, like PullChanges
+	remoteCommits, err := reachableCommits(repo, remote)
+	if err != nil {
+		return err
+	}
+	switch {
+	case remote == head.Hash():
+	case remoteCommits[head.Hash()]:
+		if err := w.Reset(&git.ResetOptions{Commit: remote, Mode: git.MergeReset}); err != nil {
+			return err
+		}
+	default:
+		// Fine if only this machine has new commits
+		localCommits, err := reachableCommits(repo, head.Hash())
+		if err != nil {
+			return err
+		}
+		if !localCommits[remote] {
+			return git.ErrNonFastForwardUpdate
+		}
+	}
+
+	return repo.Storer.SetReference(plumbing.NewHashReference(VerifiedRef, remote))
+}
+
+// recordPushedCommits moves VerifiedRef to hash once the commits of hash were
+// pushed, so pulling them back doesn't verify them. Without VerifiedRef no
+// pull was verified yet and it is left alone.
+func recordPushedCommits(repo *git.Repository, hash plumbing.Hash) error {
+	if _, err := repo.Reference(VerifiedRef, true); err != nil {
+		return nil
+	}
+	return repo.Storer.SetReference(plumbing.NewHashReference(VerifiedRef, hash))
+}
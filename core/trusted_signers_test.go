@@ -0,0 +1,299 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"golang.org/x/crypto/ssh"
+)
+
+// commitWith commits a change to a file of dotpilotDir with opts, signing the
+// commit with sshKey if it isn't nil
+func commitWith(t *testing.T, dotpilotDir, content string, opts git.CommitOptions, sshKey ssh.Signer) plumbing.Hash {
+	t.Helper()
+
+	repo, err := git.PlainOpen(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRepoFile(t, dotpilotDir, "common/.bashrc", content)
+	if _, err := w.Add("common/.bashrc"); err != nil {
+		t.Fatal(err)
+	}
+	opts.Author = &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}
+	hash, err := w.Commit(content, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sshKey == nil {
+		return hash
+	}
+
+	// Sign the commit like git does with gpg.format ssh
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := &plumbing.MemoryObject{}
+	if err := commit.EncodeWithoutSignature(encoded); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := encoded.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha512.Sum512(payload)
+	signed := sshSignedData{Namespace: sshSignatureNamespace, HashAlgorithm: "sha512", Hash: digest[:]}
+	copy(signed.Magic[:], "SSHSIG")
+	signature, err := sshKey.Sign(rand.Reader, ssh.Marshal(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := sshSignature{
+		Version:       1,
+		PublicKey:     sshKey.PublicKey().Marshal(),
+		Namespace:     sshSignatureNamespace,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(signature),
+	}
+	copy(blob.Magic[:], "SSHSIG")
+	commit.PGPSignature = "-----BEGIN SSH SIGNATURE-----\n" + base64.StdEncoding.EncodeToString(ssh.Marshal(blob)) + "\n-----END SSH SIGNATURE-----\n"
+
+	obj := repo.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	signedHash, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Reset(&git.ResetOptions{Commit: signedHash, Mode: git.SoftReset}); err != nil {
+		t.Fatal(err)
+	}
+	return signedHash
+}
+
+// verifyHead verifies the commits HEAD of dotpilotDir has and verified doesn't
+func verifyHead(t *testing.T, dotpilotDir string, verified plumbing.Hash) error {
+	t.Helper()
+	head, err := HeadHash(dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return VerifyIncomingCommits(dotpilotDir, head, verified)
+}
+
+func newSSHSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestVerifyIncomingCommitsSSH(t *testing.T) {
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+
+	dotpilotDir := t.TempDir()
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	trusted, other := newSSHSigner(t), newSSHSigner(t)
+
+	before := commitWith(t, dotpilotDir, "unsigned before the pull\n", git.CommitOptions{}, nil)
+	commitWith(t, dotpilotDir, "signed\n", git.CommitOptions{}, trusted)
+	currentConfig.Options = map[string]interface{}{}
+
+	// Without trusted signers nothing is verified
+	if err := verifyHead(t, dotpilotDir, plumbing.ZeroHash); err != nil {
+		t.Fatal(err)
+	}
+
+	currentConfig.Options[trustedSignersOption] = []interface{}{ssh.FingerprintSHA256(trusted.PublicKey())}
+	if err := verifyHead(t, dotpilotDir, before); err != nil {
+		t.Errorf("a commit signed by a trusted key failed: %v", err)
+	}
+
+	// Commits from before the pull aren't checked, the unsigned one fails
+	// when it is new
+	err := verifyHead(t, dotpilotDir, plumbing.ZeroHash)
+	var untrusted *UntrustedCommitsError
+	if !errors.As(err, &untrusted) || !errors.Is(err, ErrUntrustedCommit) || len(untrusted.Commits) != 1 || untrusted.Commits[0].Hash != before.String() {
+		t.Fatalf("VerifyIncomingCommits = %v, want the unsigned commit only", err)
+	}
+
+	signed := commitWith(t, dotpilotDir, "signed\n", git.CommitOptions{}, trusted)
+	commitWith(t, dotpilotDir, "unsigned\n", git.CommitOptions{}, nil)
+	commitWith(t, dotpilotDir, "untrusted\n", git.CommitOptions{}, other)
+	err = verifyHead(t, dotpilotDir, signed)
+	if !errors.As(err, &untrusted) || len(untrusted.Commits) != 2 {
+		t.Fatalf("VerifyIncomingCommits = %v, want the unsigned and the untrusted commit", err)
+	}
+	reasons := untrusted.Commits[0].Reason + "; " + untrusted.Commits[1].Reason
+	if !strings.Contains(reasons, "unsigned") || !strings.Contains(reasons, ssh.FingerprintSHA256(other.PublicKey())) {
+		t.Errorf("reasons %q", reasons)
+	}
+
+	// Only the commits of the tip are checked
+	if err := VerifyIncomingCommits(dotpilotDir, signed, before); err != nil {
+		t.Errorf("up to the signed commit: %v", err)
+	}
+}
+
+func TestVerifyIncomingCommitsOpenPGP(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not installed")
+	}
+	t.Setenv("GNUPGHOME", t.TempDir())
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+
+	trusted, err := openpgp.NewEntity("trusted", "", "trusted@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := openpgp.NewEntity("other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// gpg knows both keys, only one is trusted
+	for _, entity := range []*openpgp.Entity{trusted, other} {
+		var key bytes.Buffer
+		w, err := armor.Encode(&key, openpgp.PublicKeyType, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := entity.Serialize(w); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		cmd := exec.Command("gpg", "--batch", "--import")
+		cmd.Stdin = &key
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("gpg --import: %v: %s", err, out)
+		}
+	}
+
+	dotpilotDir := t.TempDir()
+	if _, err := git.PlainInit(dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	before := commitWith(t, dotpilotDir, "before\n", git.CommitOptions{}, nil)
+	signed := commitWith(t, dotpilotDir, "signed\n", git.CommitOptions{SignKey: trusted}, nil)
+	fingerprint := fmt.Sprintf("%x", trusted.PrimaryKey.Fingerprint)
+	currentConfig.Options = map[string]interface{}{trustedSignersOption: []interface{}{"0x" + fingerprint}}
+
+	if err := verifyHead(t, dotpilotDir, before); err != nil {
+		t.Errorf("a commit signed by a trusted key failed: %v", err)
+	}
+
+	commitWith(t, dotpilotDir, "untrusted\n", git.CommitOptions{SignKey: other}, nil)
+	err = verifyHead(t, dotpilotDir, signed)
+	var untrusted *UntrustedCommitsError
+	if !errors.As(err, &untrusted) || len(untrusted.Commits) != 1 || untrusted.Commits[0].Subject != "untrusted" {
+		t.Errorf("VerifyIncomingCommits = %v, want the commit of the untrusted key", err)
+	}
+
+	// A fingerprint gpg doesn't have trusts nothing
+	currentConfig.Options[trustedSignersOption] = []interface{}{strings.Repeat("AB", 20)}
+	if err := verifyHead(t, dotpilotDir, before); !errors.Is(err, ErrUntrustedCommit) {
+		t.Errorf("with an unknown key: %v", err)
+	}
+}
+
+func TestPullVerifiedChanges(t *testing.T) {
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+
+	remoteDir := initMainRemote(t, true)
+	seedDir, dotpilotDir := t.TempDir(), t.TempDir()
+	for _, dir := range []string{seedDir, dotpilotDir} {
+		if _, err := git.PlainClone(dir, false, &git.CloneOptions{URL: remoteDir}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trusted := newSSHSigner(t)
+	currentConfig.Options = map[string]interface{}{trustedSignersOption: []interface{}{ssh.FingerprintSHA256(trusted.PublicKey())}}
+	bashrc := filepath.Join(dotpilotDir, "common", ".bashrc")
+
+	// A signed commit is pulled
+	signed := commitWith(t, seedDir, "signed\n", git.CommitOptions{}, trusted)
+	if err := PushChanges(seedDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := PullVerifiedChanges(dotpilotDir); err != nil {
+		t.Fatal(err)
+	}
+	if head, _ := HeadHash(dotpilotDir); head != signed {
+		t.Fatalf("HEAD is %v after pulling a signed commit, want %v", head, signed)
+	}
+
+	// What this machine pushes isn't verified when the other one builds on it
+	commitWith(t, dotpilotDir, "local\n", git.CommitOptions{}, nil)
+	if err := PushChanges(dotpilotDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := PullChanges(seedDir); err != nil {
+		t.Fatal(err)
+	}
+	signed = commitWith(t, seedDir, "signed again\n", git.CommitOptions{}, trusted)
+	if err := PushChanges(seedDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := PullVerifiedChanges(dotpilotDir); err != nil {
+		t.Fatalf("pulling on top of a pushed commit: %v", err)
+	}
+	if head, _ := HeadHash(dotpilotDir); head != signed {
+		t.Fatalf("HEAD is %v, want %v", head, signed)
+	}
+
+	// An unsigned commit reaches neither the branch nor the worktree, and is
+	// refused again by the next pull
+	commitWith(t, seedDir, "unsigned\n", git.CommitOptions{}, nil)
+	if err := PushChanges(seedDir); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := PullVerifiedChanges(dotpilotDir); !errors.Is(err, ErrUntrustedCommit) {
+			t.Fatalf("pull %d of an unsigned commit = %v", i+1, err)
+		}
+		if head, _ := HeadHash(dotpilotDir); head != signed {
+			t.Errorf("HEAD moved to %v", head)
+		}
+		if data, _ := os.ReadFile(bashrc); string(data) != "signed again\n" {
+			t.Errorf("the worktree has %q", data)
+		}
+	}
+}
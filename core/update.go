@@ -0,0 +1,235 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dotpilot/utils"
+)
+
+// releasesURL is the GitHub API endpoint of the latest dotpilot release,
+// replaced in tests
+var releasesURL = "https://api.github.com/repos/cloudcwfranck/dotpilot/releases/latest"
+
+// releaseTimeout bounds every request of the update check, so it fails fast
+// when offline
+const releaseTimeout = 5 * time.Second
+
+// checksumsAsset is the release asset with the SHA-256 checksums of the
+// binaries, in the format of sha256sum
+const checksumsAsset = "checksums.txt"
+
+// Release is a published dotpilot release
+type Release struct {
+	Tag    string         `json:"tag_name"`
+	URL    string         `json:"html_url"` // Release page
+	Assets []ReleaseAsset `json:"assets"`
+}
+
+// ReleaseAsset is a file attached to a release
+type ReleaseAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// LatestRelease asks GitHub for the latest dotpilot release. Network failures
+// are returned wrapping ErrNetwork.
+func LatestRelease(ctx context.Context) (*Release, error) {
+	ctx, cancel := context.WithTimeout(ctx, releaseTimeout)
+	defer cancel()
+
+	body, err := httpGet(ctx, releasesURL)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var release Release
+	if err := json.NewDecoder(body).Decode(&release); err != nil {
+		return nil, fmt.Errorf("failed to parse the release: %w", err)
+	}
+	if release.Tag == "" {
+		return nil, errors.New("the latest release has no tag")
+	}
+	return &release, nil
+}
+
+// BinaryAsset returns the binary of the release for this platform, named
+// dotpilot-<os>-<arch>
+func (r *Release) BinaryAsset() (ReleaseAsset, bool) {
+	name := fmt.Sprintf("dotpilot-%s-%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return r.asset(name)
+}
+
+// asset returns the asset called name
+func (r *Release) asset(name string) (ReleaseAsset, bool) {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			return asset, true
+		}
+	}
+	return ReleaseAsset{}, false
+}
+
+// IsNewerVersion reports whether version latest is newer than current. Both
+// are semantic versions with an optional v prefix; a current version that
+// isn't one, like "dev" for a build from source, is never out of date.
+func IsNewerVersion(latest, current string) bool {
+	l, ok := parseVersion(latest)
+	if !ok {
+		return false
+	}
+	c, ok := parseVersion(current)
+	if !ok {
+		return false
+	}
+	for i := range l {
+		if l[i] != c[i] {
+			return l[i] > c[i]
+		}
+	}
+	return false
+}
+
+// parseVersion splits a version like v1.2.3 into its numbers, ignoring any
+// pre-release or build suffix
+func parseVersion(version string) ([3]int, bool) {
+	var numbers [3]int
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+	parts := strings.Split(version, ".")
+	if len(parts) == 0 || len(parts) > 3 {
+		return numbers, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return numbers, false
+		}
+		numbers[i] = n
+	}
+	return numbers, true
+}
+
+// SelfUpdate replaces the executable at path with the binary of release for
+// this platform, after checking it against the checksums of the release.
+// Only Linux and macOS are supported, Windows can't replace a running
+// executable.
+func SelfUpdate(ctx context.Context, release *Release, path string) error {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		return fmt.Errorf("self-update is not supported on %s, download the new version from %s", runtime.GOOS, release.URL)
+	}
+	binary, ok := release.BinaryAsset()
+	if !ok {
+		return fmt.Errorf("release %s has no binary for %s/%s", release.Tag, runtime.GOOS, runtime.GOARCH)
+	}
+	checksums, ok := release.asset(checksumsAsset)
+	if !ok {
+		return fmt.Errorf("release %s has no %s to verify the download", release.Tag, checksumsAsset)
+	}
+
+	want, err := releaseChecksum(ctx, checksums.URL, binary.Name)
+	if err != nil {
+		return err
+	}
+
+	// Download next to the executable, so the rename that replaces it
+	// stays on one filesystem
+	path, err = filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".dotpilot-update-*")
+	if err != nil {
+		return fmt.Errorf("failed to create the download: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer utils.Cleanup.AddFile(tmp.Name())()
+	defer tmp.Close()
+
+	body, err := httpGet(ctx, binary.URL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), body); err != nil {
+		return fmt.Errorf("%w: failed to download %s: %w", ErrNetwork, binary.Name, err)
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != want {
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", binary.Name, got, want)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// releaseChecksum returns the SHA-256 of name from the checksums file at url
+func releaseChecksum(ctx context.Context, url, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, releaseTimeout)
+	defer cancel()
+
+	body, err := httpGet(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("%w: failed to download %s: %w", ErrNetwork, checksumsAsset, err)
+	}
+	return "", fmt.Errorf("%s has no checksum for %s", checksumsAsset, name)
+}
+
+// httpGet fetches url, returning the body of a successful response.
+// Transport errors are wrapped in ErrNetwork.
+func httpGet(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNetwork, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestIsNewerVersion(t *testing.T) {
+	tests := []struct {
+		latest, current string
+		newer           bool
+	}{
+		{"v1.2.0", "v1.1.9", true},
+		{"v1.10.0", "v1.9.0", true},
+		{"v2.0.0", "1.9.9", true},
+		{"v1.2.0", "v1.2.0", false},
+		{"v1.2.0", "v1.3.0", false},
+		{"v1.2.1-rc.1", "v1.2.0", true},
+		{"v1.2", "v1.2.0", false},
+		{"v1.2.0", "dev", false},
+		{"nightly", "v1.2.0", false},
+	}
+	for _, tt := range tests {
+		if got := IsNewerVersion(tt.latest, tt.current); got != tt.newer {
+			t.Errorf("IsNewerVersion(%q, %q) = %v, want %v", tt.latest, tt.current, got, tt.newer)
+		}
+	}
+}
+
+func TestSelfUpdate(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("self-update is not supported on", runtime.GOOS)
+	}
+
+	binary := []byte("#!/bin/sh\necho new\n")
+	sum := sha256.Sum256(binary)
+	name := fmt.Sprintf("dotpilot-%s-%s", runtime.GOOS, runtime.GOARCH)
+	checksums := hex.EncodeToString(sum[:]) + "  " + name + "\n"
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest":
+			fmt.Fprintf(w, `{"tag_name": "v9.0.0", "html_url": "%[1]s/release", "assets": [
+				{"name": %[2]q, "browser_download_url": "%[1]s/binary"},
+				{"name": "checksums.txt", "browser_download_url": "%[1]s/checksums"}]}`, server.URL, name)
+		case "/binary":
+			w.Write(binary)
+		case "/checksums":
+			fmt.Fprint(w, checksums)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	saved := releasesURL
+	defer func() { releasesURL = saved }()
+	releasesURL = server.URL + "/latest"
+
+	release, err := LatestRelease(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if release.Tag != "v9.0.0" {
+		t.Errorf("tag = %q, want v9.0.0", release.Tag)
+	}
+
+	executable := filepath.Join(t.TempDir(), "dotpilot")
+	if err := os.WriteFile(executable, []byte("old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// A download that doesn't match its checksum is not installed
+	checksums = "0000  " + name + "\n"
+	if err := SelfUpdate(context.Background(), release, executable); err == nil {
+		t.Fatal("SelfUpdate with a bad checksum succeeded")
+	}
+	if data, _ := os.ReadFile(executable); string(data) != "old" {
+		t.Errorf("executable replaced despite the bad checksum: %q", data)
+	}
+
+	checksums = hex.EncodeToString(sum[:]) + "  " + name + "\n"
+	if err := SelfUpdate(context.Background(), release, executable); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(executable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(executable); string(data) != string(binary) || info.Mode().Perm() != 0755 {
+		t.Errorf("executable = %q, mode %v, want the new binary with mode 0755", data, info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(executable)); len(entries) != 1 {
+		t.Errorf("download left behind: %v", entries)
+	}
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dotpilot/utils"
+)
+
+// User layers
+//
+// One repository can provision several accounts, like an administrator's own
+// and a service account. users/<name>/ holds the dotfiles of the account
+// <name>. Applying for a user (apply --user) adds that layer after the
+// configured ones, so it wins over them, and links into the home directory of
+// the user, or into Target if set. When dotpilot runs as root, the links and
+// directories it creates there are handed to the user. The user must be able
+// to read the repository for the links to resolve.
+
+// UserAccount is an account dotpilot applies a user layer for
+type UserAccount struct {
+	Name string
+	Home string
+	UID  int // -1 where accounts have no numeric IDs, like on Windows
+	GID  int
+}
+
+// LookupUser returns the account called name
+func LookupUser(name string) (UserAccount, error) {
+	if err := validateUserName(name); err != nil {
+		return UserAccount{}, err
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return UserAccount{}, err
+	}
+
+	account := UserAccount{Name: name, Home: u.HomeDir, UID: -1, GID: -1}
+	if uid, err := strconv.Atoi(u.Uid); err == nil {
+		account.UID = uid
+	}
+	if gid, err := strconv.Atoi(u.Gid); err == nil {
+		account.GID = gid
+	}
+	return account, nil
+}
+
+// UserLayerDir returns the layer directory of the user called name
+func UserLayerDir(dotpilotDir, name string) string {
+	return filepath.Join(dotpilotDir, "users", name)
+}
+
+// validateUserName checks that name can name a directory below users/
+func validateUserName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid user name %q", name)
+	}
+	return nil
+}
+
+// UserTarget returns the account of the user called name and the directory
+// to apply their layer into: target if set, otherwise their home directory.
+// An account that doesn't exist on this machine is only accepted with a
+// target, like an image being built, and as nil, since nothing can be handed
+// to it.
+func UserTarget(name, target string) (*UserAccount, string, error) {
+	if err := validateUserName(name); err != nil {
+		return nil, "", err
+	}
+	account, err := LookupUser(name)
+	if err != nil {
+		if target == "" {
+			return nil, "", fmt.Errorf("no home directory for user %s: %w", name, err)
+		}
+		utils.Logger.Debug().Err(err).Msgf("User %s doesn't exist here, leaving the ownership of %s alone", name, target)
+		return nil, target, nil
+	}
+	if target == "" {
+		target = account.Home
+	}
+	return &account, target, nil
+}
+
+// ChownTargets hands the targets below root, the directories between them
+// and root, and root itself to account. It does nothing unless dotpilot runs
+// as root; links themselves are changed, not what they point to.
+func ChownTargets(root string, targets []string, account UserAccount) error {
+	if os.Geteuid() != 0 || account.UID < 0 {
+		return nil
+	}
+
+	root = filepath.Clean(root)
+	seen := map[string]bool{root: true}
+	paths := []string{root}
+	for _, target := range targets {
+		for p := filepath.Clean(target); !seen[p] && insideDir(p, root); p = filepath.Dir(p) {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+
+	for _, p := range paths {
+		if err := os.Lchown(p, account.UID, account.GID); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to hand %s to %s: %w", p, account.Name, err)
+		}
+	}
+	return nil
+}
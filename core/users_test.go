@@ -0,0 +1,55 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyUserLayers(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	for _, name := range []string{"common/.zshrc", "common/.bashrc", "users/alice/.bashrc", "users/alice/.config/app/conf", "users/svc/.profile"} {
+		writeRepoFile(t, dotpilotDir, name, name+"\n")
+	}
+
+	// Neither account exists here, so each needs a target
+	homes := map[string]string{"alice": t.TempDir(), "svc": t.TempDir()}
+	for name, target := range homes {
+		if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{Target: target, User: name}); err != nil {
+			t.Fatalf("applying for %s: %v", name, err)
+		}
+	}
+
+	want := map[string]map[string]string{
+		"alice": {".zshrc": "common/.zshrc", ".bashrc": "users/alice/.bashrc", ".config/app/conf": "users/alice/.config/app/conf", ".profile": ""},
+		"svc":   {".zshrc": "common/.zshrc", ".bashrc": "common/.bashrc", ".profile": "users/svc/.profile", ".config": ""},
+	}
+	for name, targets := range want {
+		for target, repoPath := range targets {
+			path := filepath.Join(homes[name], filepath.FromSlash(target))
+			link, err := os.Readlink(path)
+			if repoPath == "" {
+				if _, err := os.Lstat(path); !os.IsNotExist(err) {
+					t.Errorf("%s of %s exists, it belongs to another user", target, name)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s of %s was not linked: %v", target, name, err)
+			} else if want := filepath.Join(dotpilotDir, filepath.FromSlash(repoPath)); link != want {
+				t.Errorf("%s of %s links to %s, want %s", target, name, link, want)
+			}
+		}
+	}
+
+	// Without a target, the account must exist
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{User: "no-such-user-here"}); err == nil {
+		t.Error("applied for a missing user without a target")
+	}
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{Target: t.TempDir(), User: "../alice"}); err == nil {
+		t.Error("applied for an invalid user name")
+	}
+}
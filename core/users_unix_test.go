@@ -0,0 +1,44 @@
+//go:build !windows
+
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestChownTargets(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("only root can hand files to another user")
+	}
+	account, err := LookupUser("nobody")
+	if err != nil || account.UID < 0 {
+		t.Skip("no nobody account")
+	}
+
+	root := t.TempDir()
+	target := filepath.Join(root, ".config", "app", "conf")
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/hostname", target); err != nil {
+		t.Fatal(err)
+	}
+	if err := ChownTargets(root, []string{target}, account); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{root, filepath.Join(root, ".config"), filepath.Dir(target), target} {
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid := int(info.Sys().(*syscall.Stat_t).Uid); uid != account.UID {
+			t.Errorf("%s is owned by %d, want %d", path, uid, account.UID)
+		}
+	}
+	if info, err := os.Stat("/etc/hostname"); err == nil && int(info.Sys().(*syscall.Stat_t).Uid) == account.UID {
+		t.Error("the link target was handed over too")
+	}
+}
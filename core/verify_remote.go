@@ -0,0 +1,137 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Remote preflight
+//
+// VerifyRemote lists the refs of the origin remote with the credentials
+// sync would use, like git ls-remote. It fetches no objects and changes
+// nothing, so it is a quick way to find out whether the remote is reachable
+// before a long bootstrap instead of after the package installs.
+
+// RemoteProblem is why the remote couldn't be reached
+type RemoteProblem string
+
+const (
+	RemoteDNS             RemoteProblem = "dns"                  // The host name doesn't resolve
+	RemoteRefused         RemoteProblem = "connection refused"   // Nothing listens at the host and port
+	RemoteTimeout         RemoteProblem = "timeout"              // The remote didn't answer in time
+	RemoteUnreachable     RemoteProblem = "network"              // Any other network failure
+	RemoteAuthRejected    RemoteProblem = "auth rejected"        // The credentials were missing or rejected
+	RemoteHostKeyMismatch RemoteProblem = "host key mismatch"    // The SSH host key differs from known_hosts
+	RemoteUnknownHostKey  RemoteProblem = "unknown host key"     // The SSH host isn't in known_hosts
+	RemoteNotFound        RemoteProblem = "repository not found" // The remote has no such repository
+	RemoteOtherProblem    RemoteProblem = "error"                // None of the above
+)
+
+// verifyRemoteTimeout is how long VerifyRemote waits for the remote by default
+const verifyRemoteTimeout = 15 * time.Second
+
+// RemoteVerification is the outcome of VerifyRemote
+type RemoteVerification struct {
+	URL      string
+	Auth     string // Credentials used, like "ssh-public-keys", or "none"
+	Refs     int    // Refs the remote advertised
+	Duration time.Duration
+	// Problem is why the remote couldn't be reached, empty if it could.
+	// Err is the error behind it, wrapping ErrNetwork or ErrAuthFailed
+	// when those apply.
+	Problem RemoteProblem
+	Err     error
+}
+
+// OK reports whether the remote was reached
+func (v RemoteVerification) OK() bool {
+	return v.Problem == ""
+}
+
+// VerifyRemote checks that the origin remote of the repository in
+// dotpilotDir is reachable with the credentials of remoteAuth. Without a
+// deadline on ctx it gives up after 15 seconds. The returned error is for a
+// repository without an origin remote; a remote that can't be reached is
+// reported in the RemoteVerification.
+func VerifyRemote(ctx context.Context, dotpilotDir string) (RemoteVerification, error) {
+	var v RemoteVerification
+	repo, err := openRepo(dotpilotDir)
+	if err != nil {
+		return v, err
+	}
+	remote, err := repo.Remote("origin")
+	if err != nil {
+		return v, fmt.Errorf("no origin remote: %w", err)
+	}
+	if urls := remote.Config().URLs; len(urls) > 0 {
+		v.URL = urls[0]
+	}
+
+	auth, err := remoteAuth(repo)
+	if err != nil {
+		return v, err
+	}
+	v.Auth = "none"
+	if auth != nil {
+		v.Auth = auth.Name()
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, verifyRemoteTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	v.Duration = time.Since(start)
+	if err != nil {
+		v.Problem = remoteProblem(ctx, err)
+		v.Err = classifyRemoteError(context.Background(), err)
+		return v, nil
+	}
+	v.Refs = len(refs)
+	return v, nil
+}
+
+// remoteProblem returns why listing the refs of a remote failed with err
+func remoteProblem(ctx context.Context, err error) RemoteProblem {
+	message := strings.ToLower(err.Error())
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return RemoteTimeout
+	case strings.Contains(message, "knownhosts: key mismatch"):
+		return RemoteHostKeyMismatch
+	case strings.Contains(message, "knownhosts: key is unknown"):
+		return RemoteUnknownHostKey
+	case errors.Is(err, transport.ErrAuthenticationRequired),
+		errors.Is(err, transport.ErrAuthorizationFailed),
+		strings.Contains(message, "unable to authenticate"),
+		strings.Contains(message, "permission denied (publickey"):
+		return RemoteAuthRejected
+	case errors.Is(err, transport.ErrRepositoryNotFound):
+		return RemoteNotFound
+	case errors.As(err, &dnsErr),
+		strings.Contains(message, "no such host"):
+		return RemoteDNS
+	case errors.Is(err, syscall.ECONNREFUSED),
+		strings.Contains(message, "connection refused"):
+		return RemoteRefused
+	case errors.As(err, &netErr),
+		strings.Contains(message, "network is unreachable"):
+		return RemoteUnreachable
+	}
+	return RemoteOtherProblem
+}
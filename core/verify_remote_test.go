@@ -0,0 +1,77 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+)
+
+func TestVerifyRemote(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	remoteDir := initMainRemote(t, true)
+	dotpilotDir := t.TempDir()
+	if _, err := git.PlainClone(dotpilotDir, false, &git.CloneOptions{URL: remoteDir}); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := VerifyRemote(context.Background(), dotpilotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.OK() || v.URL != remoteDir || v.Refs == 0 || v.Auth != "none" {
+		t.Errorf("reachable remote: %+v", v)
+	}
+
+	// Point origin at a port nothing listens on and at a missing repository
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedURL := "http://" + listener.Addr().String() + "/dotfiles.git"
+	listener.Close()
+
+	for url, want := range map[string]RemoteProblem{
+		closedURL: RemoteRefused,
+		filepath.Join(t.TempDir(), "missing.git"): RemoteNotFound,
+	} {
+		repo, err := git.PlainOpen(dotpilotDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo.DeleteRemote("origin")
+		if _, err := repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{url}}); err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := VerifyRemote(context.Background(), dotpilotDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Problem != want || v.Err == nil {
+			t.Errorf("%s: problem %q (%v), want %q", url, v.Problem, v.Err, want)
+		}
+		if want == RemoteRefused && !errors.Is(v.Err, ErrNetwork) {
+			t.Errorf("%s: %v doesn't wrap ErrNetwork", url, v.Err)
+		}
+	}
+}
+
+func TestRemoteProblem(t *testing.T) {
+	ctx := context.Background()
+	for message, want := range map[string]RemoteProblem{
+		"ssh: handshake failed: knownhosts: key mismatch":                              RemoteHostKeyMismatch,
+		"ssh: handshake failed: knownhosts: key is unknown":                            RemoteUnknownHostKey,
+		"ssh: handshake failed: ssh: unable to authenticate, attempted methods [none]": RemoteAuthRejected,
+		"dial tcp: lookup example.invalid: no such host":                               RemoteDNS,
+		"something else": RemoteOtherProblem,
+	} {
+		if got := remoteProblem(ctx, errors.New(message)); got != want {
+			t.Errorf("%q: got %q, want %q", message, got, want)
+		}
+	}
+}
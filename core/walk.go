@@ -0,0 +1,71 @@
+package core
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Walking the layers
+//
+// Conflict detection and the shadow check go over the files of the layers.
+// walkLayerDirs hands each file to a callback as the walk finds it, straight
+// from the directory entries, instead of collecting every path of a layer
+// first and statting each one again, so large repositories don't have to fit
+// their file list in memory before the work starts.
+
+// walkLayerDirs calls fn for every file apply would link from layerDirs, in
+// order. layer is the layer directory, like "common" or "envs/dev", and
+// repoPath the slash-separated path of the file. Files apply skips, like
+// README.md of a layer, the machine fingerprint and paths outside the sparse
+// include list, are left out. Layer directories that don't exist are skipped.
+// An error returned by fn stops the walk and is returned.
+func walkLayerDirs(dotpilotDir string, layerDirs []string, fn func(layer, repoPath string) error) error {
+	for _, layerDir := range layerDirs {
+		layerDir = filepath.Clean(layerDir)
+		layer, err := RepoPath(dotpilotDir, layerDir)
+		if err != nil {
+			return err
+		}
+
+		err = filepath.WalkDir(layerDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if path == layerDir && os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if path == layerDir {
+				if !d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			// Skip the same files applyConfigDir skips
+			relPath := path[len(layerDir)+1:]
+			if strings.HasPrefix(relPath, ".git") || relPath == "README.md" {
+				return nil
+			}
+			if relPath == machineFingerprintFile && strings.HasPrefix(layer, "machine/") {
+				return nil
+			}
+			if isSparseExcluded(dotpilotDir, path, d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if d.IsDir() {
+				return nil
+			}
+			return fn(layer, layer+"/"+filepath.ToSlash(relPath))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
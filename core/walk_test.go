@@ -0,0 +1,140 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWalkLayerDirs(t *testing.T) {
+	dotpilotDir := t.TempDir()
+	for _, name := range []string{
+		"common/.bashrc",
+		"common/README.md",
+		"common/.gitkeep",
+		"common/.config/nvim/init.vim",
+		"envs/work/.gitconfig",
+		"envs/work/.ssh/config",
+		"envs/home/.zshrc",
+		"machine/laptop/machine.json",
+		"machine/laptop/.Xresources",
+		"secrets/.index.json",
+		"README.md",
+	} {
+		writeRepoFile(t, dotpilotDir, name, "\n")
+	}
+
+	var layerDirs []string
+	for _, layer := range []string{"common", "envs/home", "envs/missing", "envs/work", "machine/laptop"} {
+		layerDirs = append(layerDirs, filepath.Join(dotpilotDir, filepath.FromSlash(layer)))
+	}
+
+	var walked []string
+	err := walkLayerDirs(dotpilotDir, layerDirs, func(layer, repoPath string) error {
+		walked = append(walked, layer+" "+repoPath)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"common common/.bashrc",
+		"common common/.config/nvim/init.vim",
+		"envs/home envs/home/.zshrc",
+		"envs/work envs/work/.ssh/config",
+		"machine/laptop machine/laptop/.Xresources",
+	}
+	if !reflect.DeepEqual(walked, want) {
+		t.Errorf("walked %q, want %q", walked, want)
+	}
+
+	// An error stops the walk
+	stop := errors.New("stop")
+	calls := 0
+	err = walkLayerDirs(dotpilotDir, layerDirs, func(layer, repoPath string) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("walkLayerDirs returned %v after %d calls", err, calls)
+	}
+
+	// A repository without layers has nothing to walk
+	empty := t.TempDir()
+	if err := walkLayerDirs(empty, []string{filepath.Join(empty, "common")}, func(layer, repoPath string) error { return stop }); err != nil {
+		t.Errorf("empty repository: %v", err)
+	}
+}
+
+// makeLargeRepo creates a repository with n files spread over the layers and
+// nested directories
+func makeLargeRepo(tb testing.TB, n int) string {
+	tb.Helper()
+
+	dotpilotDir := tb.TempDir()
+	layers := []string{"common", "envs/default", "envs/work", "machine/laptop"}
+	for i := 0; i < n; i++ {
+		dir := filepath.Join(dotpilotDir, filepath.FromSlash(layers[i%len(layers)]), ".config", fmt.Sprintf("app%02d", i%50), fmt.Sprintf("sub%d", i%7))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%05d", i)), nil, 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return dotpilotDir
+}
+
+// BenchmarkWalkLayerDirs compares collecting every path of the layers into a
+// slice with filepath.Walk, as conflict detection used to, to streaming them
+// with walkLayerDirs
+func BenchmarkWalkLayerDirs(b *testing.B) {
+	dotpilotDir := makeLargeRepo(b, 20000)
+	layerDirs := []string{"common", "envs/default", "envs/work", "machine/laptop"}
+
+	b.Run("collect", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var files []string
+			for _, layer := range layerDirs {
+				err := filepath.Walk(filepath.Join(dotpilotDir, filepath.FromSlash(layer)), func(path string, info os.FileInfo, err error) error {
+					if err != nil || info.IsDir() {
+						return err
+					}
+					files = append(files, path)
+					return nil
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			if len(files) != 20000 {
+				b.Fatalf("collected %d files", len(files))
+			}
+		}
+	})
+
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			n := 0
+			var dirs []string
+			for _, layer := range layerDirs {
+				dirs = append(dirs, filepath.Join(dotpilotDir, filepath.FromSlash(layer)))
+			}
+			err := walkLayerDirs(dotpilotDir, dirs, func(layer, repoPath string) error {
+				n++
+				return nil
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if n != 20000 {
+				b.Fatalf("walked %d files", n)
+			}
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WhichResult describes which repo file provides a target in the home
+// directory and what the target currently is
+type WhichResult struct {
+	Target string // Path in the home directory
+	// RepoPath is the slash-separated repo path apply links Target to, empty
+	// if no active layer provides it
+	RepoPath string
+	// Shadowed are the repo paths of lower layers that also provide Target,
+	// highest precedence first. Apply ignores them.
+	Shadowed []string
+	Exists   bool   // Something exists at Target
+	Link     string // Where Target points if it is a symlink
+	// Linked reports whether Target resolves to RepoPath, either directly or
+	// through a linked parent directory
+	Linked bool
+}
+
+// Which resolves file, a path in the home directory or inside the dotpilot
+// repository, to the repo file that provides it under environment. The layers
+// are searched the way apply layers them: machine, then environment, then
+// common. For a repo path the target it maps to is resolved, so the result
+// tells whether that repo file is the one in effect.
+func Which(dotpilotDir, environment, file string) (WhichResult, error) {
+	var result WhichResult
+
+	home, err := Home()
+	if err != nil {
+		return result, err
+	}
+	absPath, err := filepath.Abs(file)
+	if err != nil {
+		return result, err
+	}
+
+	// A path inside the repository is mapped to its target first
+	result.Target = absPath
+	if repoPath, err := RepoPath(dotpilotDir, absPath); err == nil && !strings.HasPrefix(repoPath, "../") && repoPath != ".." {
+		target, ok := RepoPathToTarget(home, repoPath)
+		if !ok {
+			return result, fmt.Errorf("%s is not inside common/, envs/<env>/ or machine/<hostname>/", repoPath)
+		}
+		result.Target = target
+	} else if _, ok := TargetToRepoPath(home, absPath, ""); !ok {
+		return result, fmt.Errorf("%s is neither in the home directory nor in the dotpilot repository", absPath)
+	}
+
+	// The active layers, highest precedence first
+	configDirs, err := activeLayers(dotpilotDir, environment)
+	if err != nil {
+		return result, err
+	}
+	var layers []string
+	for i := len(configDirs) - 1; i >= 0; i-- {
+		layer, err := RepoPath(dotpilotDir, configDirs[i])
+		if err != nil {
+			return result, err
+		}
+		layers = append(layers, layer)
+	}
+
+	if found := findInLayers(dotpilotDir, home, result.Target, layers); len(found) > 0 {
+		result.RepoPath = found[0]
+		result.Shadowed = found[1:]
+	}
+
+	info, err := os.Lstat(result.Target)
+	if err != nil {
+		return result, nil
+	}
+	result.Exists = true
+	if info.Mode()&os.ModeSymlink != 0 {
+		result.Link, _ = os.Readlink(result.Target)
+	}
+
+	if result.RepoPath != "" {
+		source := filepath.Join(dotpilotDir, filepath.FromSlash(result.RepoPath))
+		linkSource, err := linkSourceFor(source)
+		if err != nil {
+			return result, err
+		}
+		if isSymlinkDescriptor(source) {
+			// Tracked symlinks are recreated with the same link target
+			result.Linked = result.Link == linkSource
+		} else {
+			result.Linked = resolvesTo(result.Target, source)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,63 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWhich(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	writeRepoFile(t, dotpilotDir, "common/.zshrc", "common\n")
+	writeRepoFile(t, dotpilotDir, "envs/dev/.zshrc", "dev\n")
+	writeRepoFile(t, dotpilotDir, "common/.vimrc", "vim\n")
+
+	// .zshrc still links to the shadowed common copy, .vimrc is applied
+	if err := os.Symlink(filepath.Join(dotpilotDir, "common", ".zshrc"), filepath.Join(home, ".zshrc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dotpilotDir, "common", ".vimrc"), filepath.Join(home, ".vimrc")); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Which(dotpilotDir, "dev", filepath.Join(home, ".zshrc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := WhichResult{
+		Target:   filepath.Join(home, ".zshrc"),
+		RepoPath: "envs/dev/.zshrc",
+		Shadowed: []string{"common/.zshrc"},
+		Exists:   true,
+		Link:     filepath.Join(dotpilotDir, "common", ".zshrc"),
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("Which(~/.zshrc) = %+v, want %+v", result, want)
+	}
+
+	// A repo path resolves to its target and the file in effect there
+	result, err = Which(dotpilotDir, "dev", filepath.Join(dotpilotDir, "common", ".vimrc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Target != filepath.Join(home, ".vimrc") || result.RepoPath != "common/.vimrc" || !result.Linked {
+		t.Errorf("Which(common/.vimrc) = %+v, want a linked ~/.vimrc", result)
+	}
+
+	// Files no layer provides
+	result, err = Which(dotpilotDir, "dev", filepath.Join(home, ".profile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RepoPath != "" || result.Exists {
+		t.Errorf("Which(~/.profile) = %+v, want nothing", result)
+	}
+
+	if _, err := Which(dotpilotDir, "dev", filepath.Join(dotpilotDir, "README.md")); err == nil {
+		t.Errorf("Which(README.md) succeeded outside the layers")
+	}
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/dotpilot/utils"
+)
+
+// Whitespace
+//
+// An editor that strips trailing spaces or adds a final newline makes a copy
+// of a dotfile differ from the repository without changing anything that
+// matters. With Options["ignore_whitespace"] in ~/.dotpilotrc, or
+// --ignore-whitespace on diff and sync, such files count as the same: drift
+// and conflict detection skip them and apply replaces them without asking.
+// "trailing" ignores whitespace at the end of lines and missing or extra
+// newlines at the end of the file, "all" ignores all whitespace within lines
+// too, including indentation, so it isn't safe for files where indentation
+// matters, like Makefiles or YAML. Line breaks in the middle of a file always
+// count. The diffs shown still contain the whitespace changes; only whether a
+// file differs is decided without them. Files with a NUL byte are compared
+// byte by byte.
+
+// Whitespace modes of Options["ignore_whitespace"]
+const (
+	WhitespaceTrailing = "trailing"
+	WhitespaceAll      = "all"
+	WhitespaceNone     = "none"
+)
+
+// whitespaceOverride replaces the option when set, see SetIgnoreWhitespace
+var whitespaceOverride string
+
+// SetIgnoreWhitespace makes IgnoreWhitespace return mode, whatever the option
+// says, for a flag given on the command line
+func SetIgnoreWhitespace(mode string) error {
+	switch mode {
+	case WhitespaceTrailing, WhitespaceAll, WhitespaceNone:
+		whitespaceOverride = mode
+		return nil
+	}
+	return fmt.Errorf("invalid whitespace mode %q, expected trailing, all or none", mode)
+}
+
+// IgnoreWhitespace returns the whitespace differences files are compared
+// without, WhitespaceTrailing or WhitespaceAll, or "" when every byte counts.
+// true in the option means WhitespaceTrailing.
+func IgnoreWhitespace() string {
+	var value interface{} = whitespaceOverride
+	if whitespaceOverride == "" {
+		value = GetConfig().Options["ignore_whitespace"]
+	}
+	switch value {
+	case WhitespaceTrailing, true:
+		return WhitespaceTrailing
+	case WhitespaceAll:
+		return WhitespaceAll
+	case nil, "", WhitespaceNone, false:
+		return ""
+	}
+	utils.Logger.Warn().Msgf("Ignoring the ignore_whitespace option %v, expected trailing, all or none", value)
+	return ""
+}
+
+// normalizeWhitespace returns data without the whitespace mode ignores
+func normalizeWhitespace(data []byte, mode string) []byte {
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if mode == WhitespaceAll {
+			lines[i] = bytes.Join(bytes.Fields(line), nil)
+		} else {
+			lines[i] = bytes.TrimRight(line, " \t\r\f\v")
+		}
+	}
+	return bytes.TrimRight(bytes.Join(lines, []byte("\n")), "\n")
+}
+
+// sameIgnoringWhitespace reports whether a and b are the same apart from the
+// whitespace IgnoreWhitespace ignores, see sameContent for line endings
+func sameIgnoringWhitespace(a, b []byte) bool {
+	mode := IgnoreWhitespace()
+	if mode == "" || !isText(a) || !isText(b) {
+		return sameContent(a, b)
+	}
+	return bytes.Equal(normalizeWhitespace(comparableContent(a), mode), normalizeWhitespace(comparableContent(b), mode))
+}
@@ -0,0 +1,111 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSameIgnoringWhitespace(t *testing.T) {
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+
+	cases := []struct {
+		a, b          string
+		trailing, all bool
+	}{
+		{"set number  \nsyntax on\n", "set number\nsyntax on\n", true, true},
+		{"set number\nsyntax on", "set number\nsyntax on\n", true, true},
+		{"set number\n", "set number\n\n\n", true, true},
+		{"set number\t\r\n", "set number\n", true, true},
+		{"  set number\n", "set number\n", false, true},
+		{"set  number\n", "set number\n", false, true},
+		{"set number\nsyntax on\n", "set number\n\nsyntax on\n", false, false},
+		{"set number\n", "set nonumber\n", false, false},
+		{"a \x00\n", "a\x00\n", false, false},
+	}
+	for _, c := range cases {
+		for mode, want := range map[string]bool{"": c.a == c.b, WhitespaceTrailing: c.trailing, WhitespaceAll: c.all} {
+			currentConfig.Options = map[string]interface{}{"ignore_whitespace": mode}
+			if got := sameIgnoringWhitespace([]byte(c.a), []byte(c.b)); got != want {
+				t.Errorf("%q and %q with %q: got %v, want %v", c.a, c.b, mode, got, want)
+			}
+		}
+	}
+}
+
+func TestIgnoreWhitespaceOption(t *testing.T) {
+	saved := currentConfig
+	defer func() { currentConfig = saved; whitespaceOverride = "" }()
+
+	for value, want := range map[interface{}]string{nil: "", "": "", "none": "", false: "", true: "trailing", "trailing": "trailing", "all": "all", "bogus": ""} {
+		currentConfig.Options = map[string]interface{}{"ignore_whitespace": value}
+		if got := IgnoreWhitespace(); got != want {
+			t.Errorf("ignore_whitespace %v: got %q, want %q", value, got, want)
+		}
+	}
+
+	// The flag wins over the option
+	if err := SetIgnoreWhitespace("none"); err != nil {
+		t.Fatal(err)
+	}
+	if got := IgnoreWhitespace(); got != "" {
+		t.Errorf("none over all: got %q", got)
+	}
+	if err := SetIgnoreWhitespace("some"); err == nil {
+		t.Error("invalid mode accepted")
+	}
+}
+
+func TestWhitespaceDriftAndConflicts(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+
+	// Trailing whitespace, a missing final newline, and a real change
+	files := map[string][2]string{
+		".vimrc":   {"set number\nsyntax on\n", "set number \nsyntax on\t\n"},
+		".inputrc": {"set bell-style none\n", "set bell-style none"},
+		".bashrc":  {"alias ll='ls -l'\n", "alias ll='ls -la'  \n"},
+	}
+	for name, content := range files {
+		writeRepoFile(t, dotpilotDir, "envs/default/"+name, content[0])
+		if err := os.WriteFile(filepath.Join(home, name), []byte(content[1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved := currentConfig
+	defer func() { currentConfig = saved }()
+	currentConfig.CurrentEnvironment = "default"
+
+	count := func() (drift, conflicts int) {
+		t.Helper()
+		changes, err := LocalDrift(dotpilotDir, "default")
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := detectConflicts(dotpilotDir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(changes), len(found)
+	}
+
+	currentConfig.Options = map[string]interface{}{}
+	if drift, conflicts := count(); drift != 3 || conflicts != 3 {
+		t.Errorf("comparing every byte: %d drifted and %d conflicts, want 3 and 3", drift, conflicts)
+	}
+
+	currentConfig.Options = map[string]interface{}{"ignore_whitespace": "trailing"}
+	if drift, conflicts := count(); drift != 1 || conflicts != 1 {
+		t.Errorf("ignoring trailing whitespace: %d drifted and %d conflicts, want 1 and 1", drift, conflicts)
+	}
+
+	// The whitespace is still shown when inspecting a file
+	diff, err := FileDiff(filepath.Join(home, ".vimrc"), filepath.Join(dotpilotDir, "envs", "default", ".vimrc"))
+	if err != nil || !strings.Contains(diff, "-set number \n") {
+		t.Errorf("FileDiff = %q, %v", diff, err)
+	}
+}
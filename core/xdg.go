@@ -0,0 +1,121 @@
+package core
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// XDG base directories
+//
+// XDG_CONFIG_HOME and XDG_DATA_HOME may move ~/.config and ~/.local/share
+// elsewhere, even outside the home directory. The layers always hold such
+// files at the default location, like common/.config/nvim/init.lua, so they
+// are the same on every machine: tracking maps a file below a relocated base
+// back to its default location, and apply expands the default location to
+// wherever the base is on the machine it runs on.
+
+// xdgBase is an XDG base directory that can be relocated
+type xdgBase struct {
+	env        string // Variable relocating it
+	defaultDir string // Slash-separated location below home if not relocated
+}
+
+var xdgBases = []xdgBase{
+	{env: "XDG_CONFIG_HOME", defaultDir: ".config"},
+	{env: "XDG_DATA_HOME", defaultDir: ".local/share"},
+}
+
+// dir returns where the base is for home, and whether it is relocated. Like
+// the XDG specification says, a relative value is ignored.
+func (b xdgBase) dir(home string) (string, bool) {
+	defaultDir := filepath.Join(home, filepath.FromSlash(b.defaultDir))
+	dir := os.Getenv(b.env)
+	if dir == "" || !filepath.IsAbs(dir) {
+		return defaultDir, false
+	}
+	dir = filepath.Clean(dir)
+	return dir, dir != defaultDir
+}
+
+// HomeRelPath returns the slash-separated path of target relative to home,
+// which is where it is stored below a layer. A target below a relocated XDG
+// base maps to the default location of the base. It returns false for
+// targets outside home and the XDG bases, and for home itself.
+func HomeRelPath(home, target string) (string, bool) {
+	target = filepath.Clean(target)
+	for _, base := range xdgBases {
+		dir, relocated := base.dir(home)
+		if !relocated {
+			continue
+		}
+		if relPath, err := filepath.Rel(dir, target); err == nil && isBelow(relPath) {
+			return path.Join(base.defaultDir, filepath.ToSlash(relPath)), true
+		}
+		if target == dir {
+			return base.defaultDir, true
+		}
+	}
+
+	relPath, err := filepath.Rel(home, target)
+	if err != nil || relPath == "." || !isBelow(relPath) {
+		return "", false
+	}
+	return filepath.ToSlash(relPath), true
+}
+
+// expandXDG returns the file a slash-separated path relative to home is
+// applied to: below home, or below the relocated XDG base for a path in the
+// default location of one
+func expandXDG(home, relPath string) string {
+	for _, base := range xdgBases {
+		dir, relocated := base.dir(home)
+		if !relocated {
+			continue
+		}
+		if relPath == base.defaultDir {
+			return dir
+		}
+		if rest := strings.TrimPrefix(relPath, base.defaultDir+"/"); rest != relPath {
+			return filepath.Join(dir, filepath.FromSlash(rest))
+		}
+	}
+	return filepath.Join(home, filepath.FromSlash(relPath))
+}
+
+// trackingPath returns how target is recorded in the tracking paths of
+// ~/.dotpilotrc: relative to home, or to the XDG base it was applied into,
+// like $XDG_CONFIG_HOME/nvim/init.lua
+func trackingPath(home, target string) (string, bool) {
+	target = filepath.Clean(target)
+	for _, base := range xdgBases {
+		dir, relocated := base.dir(home)
+		if !relocated {
+			continue
+		}
+		if relPath, err := filepath.Rel(dir, target); err == nil && isBelow(relPath) {
+			return "$" + base.env + "/" + filepath.ToSlash(relPath), true
+		}
+	}
+	return HomeRelPath(home, target)
+}
+
+// trackingTarget returns the file a path from the tracking paths of
+// ~/.dotpilotrc refers to, the inverse of trackingPath. A path recorded
+// relative to an XDG base follows the base to where it is now.
+func trackingTarget(home, tracked string) string {
+	for _, base := range xdgBases {
+		if rest := strings.TrimPrefix(tracked, "$"+base.env+"/"); rest != tracked {
+			dir, _ := base.dir(home)
+			return filepath.Join(dir, filepath.FromSlash(rest))
+		}
+	}
+	return expandXDG(home, tracked)
+}
+
+// isBelow reports whether a relative path from filepath.Rel stays inside
+// the directory it is relative to, and isn't the directory itself
+func isBelow(relPath string) bool {
+	return relPath != "." && relPath != ".." && !strings.HasPrefix(relPath, ".."+string(filepath.Separator))
+}
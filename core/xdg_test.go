@@ -0,0 +1,90 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHomeRelPathXDG(t *testing.T) {
+	root := t.TempDir()
+	home := filepath.Join(root, "home")
+	config := filepath.Join(root, "xdg", "config")
+	t.Setenv("XDG_CONFIG_HOME", config)
+	t.Setenv("XDG_DATA_HOME", "relative/is/ignored")
+
+	tests := []struct {
+		target string
+		want   string
+		ok     bool
+	}{
+		{filepath.Join(config, "nvim", "init.lua"), ".config/nvim/init.lua", true},
+		{config, ".config", true},
+		{filepath.Join(home, ".bashrc"), ".bashrc", true},
+		{filepath.Join(home, ".local", "share", "app"), ".local/share/app", true},
+		{filepath.Join(root, "elsewhere"), "", false},
+		{home, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := HomeRelPath(home, tt.target)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("HomeRelPath(%s) = %q, %v, want %q, %v", tt.target, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	// The inverse expands the default location into the relocated base
+	if got, want := expandXDG(home, ".config/nvim/init.lua"), filepath.Join(config, "nvim", "init.lua"); got != want {
+		t.Errorf("expandXDG = %s, want %s", got, want)
+	}
+	if got, want := expandXDG(home, ".configure"), filepath.Join(home, ".configure"); got != want {
+		t.Errorf("expandXDG = %s, want %s", got, want)
+	}
+	if got, ok := trackingPath(home, filepath.Join(config, "nvim", "init.lua")); got != "$XDG_CONFIG_HOME/nvim/init.lua" || !ok {
+		t.Errorf("trackingPath = %q, %v", got, ok)
+	}
+}
+
+func TestTrackAndApplyRelocatedXDGConfigHome(t *testing.T) {
+	root := t.TempDir()
+	home := filepath.Join(root, "home")
+	t.Setenv("HOME", home)
+	dotpilotDir := filepath.Join(home, ".dotpilot")
+	if err := os.MkdirAll(filepath.Join(dotpilotDir, "common"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Track a file from a config home outside the home directory
+	config := filepath.Join(root, "xdg", "config")
+	t.Setenv("XDG_CONFIG_HOME", config)
+	source := filepath.Join(config, "nvim", "init.lua")
+	writeRepoFile(t, filepath.Dir(source), "init.lua", "set number\n")
+
+	repoPath, ok := TargetToRepoPath(home, source, "common")
+	if !ok || repoPath != "common/.config/nvim/init.lua" {
+		t.Fatalf("TargetToRepoPath = %q, %v", repoPath, ok)
+	}
+	destination := filepath.Join(dotpilotDir, filepath.FromSlash(repoPath))
+	if err := TrackFile(source, destination, dotpilotDir, false); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(destination); err != nil || string(data) != "set number\n" {
+		t.Fatalf("repo file reads %q (%v)", data, err)
+	}
+
+	// Apply on a machine whose config home is somewhere else again
+	other := filepath.Join(root, "other", "config")
+	t.Setenv("XDG_CONFIG_HOME", other)
+	if err := ApplyConfigurationsWithOptions(dotpilotDir, "", ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(other, "nvim", "init.lua")
+	if !linksTo(target, destination) {
+		t.Errorf("%s doesn't link to %s", target, destination)
+	}
+	if _, err := os.Lstat(filepath.Join(home, ".config")); !os.IsNotExist(err) {
+		t.Errorf("apply created ~/.config although XDG_CONFIG_HOME is relocated")
+	}
+	if got, ok := RepoPathToTarget(home, repoPath); !ok || got != target {
+		t.Errorf("RepoPathToTarget = %s, want %s", got, target)
+	}
+}
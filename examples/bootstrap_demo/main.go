@@ -2,9 +2,9 @@ package main
 
 import (
         "fmt"
-        "os"
         "time"
 
+        "github.com/dotpilot/core"
         "github.com/dotpilot/utils"
 )
 
@@ -55,7 +55,7 @@ func main() {
         machineOp := manager.AddOperation("machine", "Applying machine dotfiles...", utils.Bar)
         machineOp.Start()
         
-        hostname, _ := os.Hostname()
+        hostname, _ := core.MachineID()
         fmt.Printf("   Detected hostname: %s\n", hostname)
         
         for i := 0; i <= 100; i += 15 {
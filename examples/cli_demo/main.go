@@ -2,10 +2,10 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
 	"time"
 
+	"github.com/dotpilot/core"
 	"github.com/dotpilot/utils"
 )
 
@@ -15,7 +15,7 @@ func main() {
 	fmt.Println("================")
 	
 	// Create demo directory structure
-	home, _ := os.UserHomeDir()
+	home, _ := core.Home()
 	dotpilotDir := filepath.Join(home, ".dotpilot")
 	
 	fmt.Println("1. Running 'dotpilot init' command")
@@ -27,8 +27,7 @@ func main() {
 	op1.Start()
 	
 	time.Sleep(2 * time.Second)
-	op1.SetState(utils.Success)
-	op1.Stop()
+	op1.StopWithResult(utils.Success, "Initialized dotpilot repository")
 	
 	fmt.Printf("✓ Created dotpilot directory at %s\n", dotpilotDir)
 	fmt.Printf("✓ Initialized Git repository\n")
@@ -43,8 +42,7 @@ func main() {
 	op2.Start()
 	
 	time.Sleep(1 * time.Second)
-	op2.SetState(utils.Success)
-	op2.Stop()
+	op2.StopWithResult(utils.Success, "Tracked ~/.bashrc")
 	
 	fmt.Printf("✓ Copied ~/.bashrc to %s/common/.bashrc\n", dotpilotDir)
 	fmt.Printf("✓ Created symlink from %s/common/.bashrc to ~/.bashrc\n", dotpilotDir)
@@ -59,15 +57,13 @@ func main() {
 	op3.Start()
 	
 	time.Sleep(1 * time.Second)
-	op3.SetState(utils.Success)
-	op3.Stop()
+	op3.StopWithResult(utils.Success, "Changes committed")
 	
 	op4 := syncOp.AddOperation("pull", "Pulling changes from remote...", utils.Bounce)
 	op4.Start()
 	
 	time.Sleep(2 * time.Second)
-	op4.SetState(utils.Success)
-	op4.Stop()
+	op4.StopWithResult(utils.Success, "Changes pulled from remote")
 	
 	op5 := syncOp.AddOperation("apply", "Applying configurations...", utils.Bar)
 	op5.Start()
@@ -78,20 +74,14 @@ func main() {
 		time.Sleep(50 * time.Millisecond)
 	}
 	
-	op5.SetState(utils.Success)
-	op5.Stop()
+	op5.StopWithResult(utils.Success, "Configurations applied")
 	
 	op6 := syncOp.AddOperation("push", "Pushing changes to remote...", utils.Bounce)
 	op6.Start()
 	
 	time.Sleep(1 * time.Second)
-	op6.SetState(utils.Success)
-	op6.Stop()
+	op6.StopWithResult(utils.Success, "Changes pushed to remote")
 	
-	fmt.Printf("✓ Changes committed\n")
-	fmt.Printf("✓ Changes pulled from remote\n")
-	fmt.Printf("✓ Configurations applied\n")
-	fmt.Printf("✓ Changes pushed to remote\n")
 	
 	// Simulate bootstrap command
 	fmt.Println("\n4. Running 'dotpilot bootstrap' command")
@@ -107,8 +97,7 @@ func main() {
 		time.Sleep(100 * time.Millisecond)
 	}
 	
-	op7.SetState(utils.Success)
-	op7.Stop()
+	op7.StopWithResult(utils.Success, "Applied common dotfiles")
 	
 	op8 := bootstrapOp.AddOperation("env", "Applying environment-specific dotfiles...", utils.Bar)
 	op8.Start()
@@ -118,13 +107,12 @@ func main() {
 		time.Sleep(100 * time.Millisecond)
 	}
 	
-	op8.SetState(utils.Success)
-	op8.Stop()
+	op8.StopWithResult(utils.Success, "Applied environment-specific dotfiles")
 	
 	op9 := bootstrapOp.AddOperation("machine", "Applying machine-specific dotfiles...", utils.Bar)
 	op9.Start()
 	
-	hostname, _ := os.Hostname()
+	hostname, _ := core.MachineID()
 	fmt.Printf("   Detected hostname: %s\n", hostname)
 	
 	for i := 0; i <= 100; i += 10 {
@@ -132,20 +120,14 @@ func main() {
 		time.Sleep(100 * time.Millisecond)
 	}
 	
-	op9.SetState(utils.Success)
-	op9.Stop()
+	op9.StopWithResult(utils.Success, "Applied machine-specific dotfiles")
 	
 	op10 := bootstrapOp.AddOperation("scripts", "Running setup scripts...", utils.Pulse)
 	op10.Start()
 	
 	time.Sleep(2 * time.Second)
-	op10.SetState(utils.Success)
-	op10.Stop()
+	op10.StopWithResult(utils.Success, "Ran setup scripts")
 	
-	fmt.Printf("✓ Applied common dotfiles\n")
-	fmt.Printf("✓ Applied environment-specific dotfiles\n")
-	fmt.Printf("✓ Applied machine-specific dotfiles\n")
-	fmt.Printf("✓ Ran setup scripts\n")
 	
 	fmt.Println("\n✨ DotPilot CLI Demo Completed!")
 }
\ No newline at end of file
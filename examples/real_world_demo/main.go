@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/dotpilot/core"
 	"github.com/dotpilot/utils"
 )
 
@@ -13,7 +14,7 @@ import (
 // to manage dotfiles across multiple machines
 func main() {
 	// Get home directory for the demo
-	home, _ := os.UserHomeDir()
+	home, _ := core.Home()
 	
 	fmt.Println("DotPilot Real-World Usage Demo")
 	fmt.Println("==============================")
@@ -166,7 +167,7 @@ func main() {
 	op12 := bootstrapOp.AddOperation("machine", "Applying machine-specific dotfiles...", utils.Bar)
 	op12.Start()
 	
-	hostname, _ := os.Hostname()
+	hostname, _ := core.MachineID()
 	fmt.Printf("   Detected hostname: %s\n", hostname)
 	
 	for i := 0; i <= 100; i += 10 {
@@ -8,8 +8,16 @@ import (
 )
 
 func main() {
+	// Ctrl-C and SIGTERM clean up before exiting, see utils.HandleInterrupts
+	utils.HandleInterrupts(func() {
+		utils.Logger.Warn().Msg("Interrupted")
+		os.Exit(cmd.ExitInterrupted)
+	})
+
+	// Commands return the error that stopped them, logged and mapped to
+	// the exit code of its class of failure here
 	if err := cmd.Execute(); err != nil {
-		utils.Logger.Error().Err(err).Msg("Error executing command")
-		os.Exit(1)
+		cmd.LogError(err)
+		os.Exit(cmd.ExitCode(err))
 	}
 }
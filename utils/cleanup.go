@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// Interrupts
+//
+// Ctrl-C or a SIGTERM would otherwise kill dotpilot on the spot, leaving a
+// progress indicator half drawn and temporary files behind, some of them
+// holding decrypted secrets. HandleInterrupts, installed by main, stops the
+// running indicators, shreds the temporary files registered with Cleanup,
+// runs its cleanup funcs, like releasing the repository lock, and exits.
+//
+// Operations that stop cleanly on their own, like a clone that removes what
+// it cloned, take an InterruptContext instead. While one is in use the first
+// interrupt only cancels it, a second one exits anyway.
+
+// Cleanup is the registry of this process, see HandleInterrupts
+var Cleanup = NewCleanupRegistry()
+
+// CleanupRegistry holds the temporary files and cleanup funcs to take care
+// of when the process is interrupted
+type CleanupRegistry struct {
+	mutex   sync.Mutex
+	next    int
+	entries map[int]cleanupEntry
+	// contexts is the number of InterruptContexts in use
+	contexts int
+}
+
+// cleanupEntry is a registered file or func, the other is empty
+type cleanupEntry struct {
+	path string
+	fn   func()
+}
+
+// NewCleanupRegistry returns an empty registry
+func NewCleanupRegistry() *CleanupRegistry {
+	return &CleanupRegistry{entries: make(map[int]cleanupEntry)}
+}
+
+// AddFile registers the temporary file or directory at path to be removed
+// on an interrupt, files are shredded first. It returns a func unregistering
+// it, for once the caller removed it itself:
+//
+//	defer utils.Cleanup.AddFile(tmpPath)()
+func (r *CleanupRegistry) AddFile(path string) (remove func()) {
+	return r.add(cleanupEntry{path: path})
+}
+
+// Add registers fn to run on an interrupt, after the files are removed. It
+// returns a func unregistering it.
+func (r *CleanupRegistry) Add(fn func()) (remove func()) {
+	return r.add(cleanupEntry{fn: fn})
+}
+
+// add registers entry and returns a func unregistering it
+func (r *CleanupRegistry) add(entry cleanupEntry) func() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	id := r.next
+	r.next++
+	r.entries[id] = entry
+	return func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		delete(r.entries, id)
+	}
+}
+
+// Run removes the registered files, then runs the registered funcs, the most
+// recently registered ones first, and empties the registry
+func (r *CleanupRegistry) Run() {
+	r.mutex.Lock()
+	entries := r.entries
+	r.entries = make(map[int]cleanupEntry)
+	r.mutex.Unlock()
+
+	ids := make([]int, 0, len(entries))
+	for id := range entries {
+		ids = append(ids, id)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+
+	for _, id := range ids {
+		path := entries[id].path
+		if path == "" {
+			continue
+		}
+		if info, err := os.Lstat(path); err == nil && info.IsDir() {
+			os.RemoveAll(path)
+		} else if err := ShredFile(path); err != nil {
+			Logger.Debug().Err(err).Msgf("Failed to remove %s", path)
+		}
+	}
+	for _, id := range ids {
+		if fn := entries[id].fn; fn != nil {
+			fn()
+		}
+	}
+}
+
+// HandleInterrupts cleans up and calls exit when the process gets SIGINT or
+// SIGTERM, see above. It returns a func uninstalling the handler.
+func HandleInterrupts(exit func()) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		passed := false
+		for {
+			select {
+			case <-done:
+				return
+			case <-signals:
+			}
+
+			// An InterruptContext gets the first interrupt
+			Cleanup.mutex.Lock()
+			handled := Cleanup.contexts > 0 && !passed
+			Cleanup.mutex.Unlock()
+			if handled {
+				passed = true
+				continue
+			}
+
+			StopIndicators()
+			Cleanup.Run()
+			exit()
+			return
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// InterruptContext returns a context canceled by SIGINT or SIGTERM, for an
+// operation that stops cleanly when it is canceled. Until stop is called,
+// HandleInterrupts leaves the first interrupt to it.
+func InterruptContext(parent context.Context) (ctx context.Context, stop func()) {
+	ctx, stopNotify := signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+	Cleanup.mutex.Lock()
+	Cleanup.contexts++
+	Cleanup.mutex.Unlock()
+
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			stopNotify()
+			Cleanup.mutex.Lock()
+			Cleanup.contexts--
+			Cleanup.mutex.Unlock()
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCleanupRegistry(t *testing.T) {
+	dir := t.TempDir()
+	plaintext := filepath.Join(dir, "plaintext")
+	scratch := filepath.Join(dir, "scratch")
+	kept := filepath.Join(dir, "kept")
+	for _, path := range []string{plaintext, kept} {
+		if err := os.WriteFile(path, []byte("secret"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(scratch, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewCleanupRegistry()
+	var order []string
+	r.Add(func() { order = append(order, "first") })
+	r.AddFile(plaintext)
+	r.AddFile(scratch)
+	r.AddFile(kept)() // Removed by its caller already
+	r.Add(func() { order = append(order, "second") })
+
+	r.Run()
+	for _, path := range []string{plaintext, scratch} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Errorf("an unregistered file was removed: %v", err)
+	}
+	if strings.Join(order, ",") != "second,first" {
+		t.Errorf("funcs ran in order %v, want the newest first", order)
+	}
+
+	// The registry is empty afterwards
+	r.Run()
+	if len(order) != 2 {
+		t.Errorf("funcs ran again: %v", order)
+	}
+}
+
+func TestStopIndicators(t *testing.T) {
+	var buf bytes.Buffer
+	p := NewProgressIndicator("Pulling changes", Spinner)
+	p.output = &buf
+	p.Start()
+
+	StopIndicators()
+	runningMutex.Lock()
+	left := len(running)
+	runningMutex.Unlock()
+	if left != 0 {
+		t.Errorf("%d indicators are still running", left)
+	}
+	if p.active {
+		t.Error("the indicator wasn't stopped")
+	}
+	if out := buf.String(); !strings.HasSuffix(out, "\r") {
+		t.Errorf("the line of the indicator wasn't cleared: %q", out)
+	}
+}
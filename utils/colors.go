@@ -1,5 +1,9 @@
 package utils
 
+import (
+        "os"
+)
+
 // ANSI color codes for terminal output
 const (
         // Reset all styles
@@ -61,23 +65,83 @@ const (
         StateInfo    = Info
 )
 
+// colorEnabled is auto-detected at startup and refined by SetColorMode once
+// the command line flags are parsed
+var colorEnabled = detectColor(false, false)
+
+// ColorEnabled reports whether ANSI color codes should be written
+func ColorEnabled() bool {
+        return colorEnabled
+}
+
+// SetColorMode applies the --no-color and --force-color flags and rebuilds the
+// logger to match. Precedence, highest first:
+//   1. --no-color or NO_COLOR disables color
+//   2. --force-color or CLICOLOR_FORCE enables color, even when not a TTY
+//   3. TERM=dumb disables color
+//   4. otherwise color is enabled only when stdout is a terminal
+func SetColorMode(noColor, forceColor bool) {
+        colorEnabled = detectColor(noColor, forceColor)
+        Logger = newLogger(colorEnabled).Level(Logger.GetLevel())
+}
+
+// detectColor resolves whether color should be used from flags and environment
+func detectColor(noColor, forceColor bool) bool {
+        if noColor || os.Getenv("NO_COLOR") != "" {
+                return false
+        }
+
+        if forceColor {
+                return true
+        }
+        if force := os.Getenv("CLICOLOR_FORCE"); force != "" && force != "0" {
+                return true
+        }
+
+        if os.Getenv("TERM") == "dumb" {
+                return false
+        }
+
+        return IsTerminal()
+}
+
+// IsTerminal reports whether stdout is a terminal
+func IsTerminal() bool {
+        info, err := os.Stdout.Stat()
+        if err != nil {
+                return false
+        }
+        return info.Mode()&os.ModeCharDevice != 0
+}
+
+// colorCode returns the given ANSI code, or an empty string if color is disabled
+func colorCode(code string) string {
+        if !colorEnabled {
+                return ""
+        }
+        return code
+}
+
 // GetColorForState returns the ANSI color code for a given progress state
 func GetColorForState(state ProgressState) string {
         switch state {
         case Success:
-                return Green
+                return colorCode(Green)
         case Warning:
-                return Yellow
+                return colorCode(Yellow)
         case Error:
-                return Red
+                return colorCode(Red)
         case Info:
-                return Cyan
+                return colorCode(Cyan)
         default:
-                return Reset
+                return colorCode(Reset)
         }
 }
 
 // ColorizeText wraps text with the specified color and reset codes
 func ColorizeText(text string, color string) string {
+        if !colorEnabled {
+                return text
+        }
         return color + text + Reset
 }
\ No newline at end of file
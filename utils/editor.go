@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ErrNoEditor is returned by ResolveEditor when no editor is configured or
+// installed
+var ErrNoEditor = errors.New("no editor found, pass --editor or set the VISUAL or EDITOR environment variable")
+
+// fallbackEditors are tried in order when no editor is configured. They all
+// block until the file is closed, which the callers rely on.
+var fallbackEditors = []string{"nano", "vim", "vi", "emacs"}
+
+// editorOverride is set by SetEditor
+var editorOverride string
+
+// SetEditor makes ResolveEditor return editor, for the --editor flag. An empty
+// editor restores the default resolution.
+func SetEditor(editor string) {
+	editorOverride = editor
+}
+
+// ResolveEditor returns the editor command to launch: the one given to
+// SetEditor, then $VISUAL, then $EDITOR, then the first installed fallback
+// editor. The command may include arguments, e.g. "code --wait".
+func ResolveEditor() (string, error) {
+	for _, editor := range []string{editorOverride, os.Getenv("VISUAL"), os.Getenv("EDITOR")} {
+		if strings.TrimSpace(editor) != "" {
+			return editor, nil
+		}
+	}
+
+	for _, editor := range fallbackEditors {
+		if _, err := exec.LookPath(editor); err == nil {
+			return editor, nil
+		}
+	}
+
+	return "", ErrNoEditor
+}
+
+// EditFile opens path in the editor returned by ResolveEditor and waits for
+// it to exit
+func EditFile(path string) error {
+	editor, err := ResolveEditor()
+	if err != nil {
+		return err
+	}
+
+	parts := strings.Fields(editor)
+	cmd := exec.Command(parts[0], append(parts[1:], path)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	Logger.Info().Msgf("Opening %s in %s", path, editor)
+	return cmd.Run()
+}
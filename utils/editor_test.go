@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveEditorOrder(t *testing.T) {
+	t.Setenv("VISUAL", "visual-editor")
+	t.Setenv("EDITOR", "env-editor")
+
+	SetEditor("code --wait")
+	defer SetEditor("")
+	if editor, err := ResolveEditor(); err != nil || editor != "code --wait" {
+		t.Errorf("with --editor: ResolveEditor() = %q, %v", editor, err)
+	}
+
+	SetEditor("")
+	if editor, err := ResolveEditor(); err != nil || editor != "visual-editor" {
+		t.Errorf("with VISUAL: ResolveEditor() = %q, %v", editor, err)
+	}
+
+	t.Setenv("VISUAL", "")
+	if editor, err := ResolveEditor(); err != nil || editor != "env-editor" {
+		t.Errorf("with EDITOR: ResolveEditor() = %q, %v", editor, err)
+	}
+}
+
+func TestResolveEditorFallback(t *testing.T) {
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", "")
+
+	// Only vi is installed
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "vi"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+	if editor, err := ResolveEditor(); err != nil || editor != "vi" {
+		t.Errorf("ResolveEditor() = %q, %v, want vi", editor, err)
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	if _, err := ResolveEditor(); !errors.Is(err, ErrNoEditor) {
+		t.Errorf("ResolveEditor() without editors = %v, want ErrNoEditor", err)
+	}
+}
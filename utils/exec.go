@@ -2,24 +2,173 @@ package utils
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 )
 
 // ExecuteCommand executes a command and returns its output
 func ExecuteCommand(command string, args ...string) (string, error) {
+	return ExecuteCommandWithEnv(nil, command, args...)
+}
+
+// ExecuteCommandWithEnv executes a command with the given environment and
+// returns its output. A nil env inherits the current process environment.
+func ExecuteCommandWithEnv(env []string, command string, args ...string) (string, error) {
 	Logger.Debug().Msgf("Executing command: %s %s", command, strings.Join(args, " "))
 	
 	cmd := exec.Command(command, args...)
+	cmd.Env = env
 	output, err := cmd.CombinedOutput()
 	
 	return string(output), err
 }
 
+// StreamOptions controls how StreamCommandWithOptions runs a command
+type StreamOptions struct {
+	Env   []string  // Environment of the command, nil inherits the current one
+	Dir   string    // Working directory, the current one if empty
+	Stdin io.Reader // Input of the command, none if nil
+
+	// OnLine is called with each line of output. Without it each line is
+	// written to Output, or logged with Prefix in brackets before it.
+	OnLine func(line string)
+	Output io.Writer
+	Prefix string
+}
+
+// StreamCommand runs a command, logging each line of its stdout and stderr
+// as soon as it is written, and returns its exit code. Unlike ExecuteCommand
+// it doesn't hold the output in memory, so it suits long-running commands
+// with a lot of output. Canceling ctx kills the command.
+func StreamCommand(ctx context.Context, name string, args ...string) (int, error) {
+	return StreamCommandWithOptions(ctx, StreamOptions{}, name, args...)
+}
+
+// StreamCommandWithOptions is StreamCommand with options. Lines end at a
+// newline or a carriage return, which progress meters use to redraw a line,
+// and empty lines are dropped. The error is not nil if the command exits
+// with a code other than 0, which is then returned, and the exit code is -1
+// if the command didn't start or was killed.
+func StreamCommandWithOptions(ctx context.Context, opts StreamOptions, name string, args ...string) (int, error) {
+	Logger.Debug().Msgf("Executing command: %s %s", name, strings.Join(args, " "))
+
+	onLine := opts.OnLine
+	if onLine == nil {
+		onLine = func(line string) {
+			switch {
+			case opts.Output != nil:
+				fmt.Fprintln(opts.Output, line)
+			case opts.Prefix != "":
+				Logger.Info().Msgf("[%s] %s", opts.Prefix, line)
+			default:
+				Logger.Info().Msg(line)
+			}
+		}
+	}
+
+	reader, writer := io.Pipe()
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = opts.Env
+	cmd.Dir = opts.Dir
+	cmd.Stdin = opts.Stdin
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	// Children left holding the output open don't keep a killed command waiting
+	cmd.WaitDelay = time.Second
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		scanner.Split(scanOutputLines)
+		for scanner.Scan() {
+			onLine(scanner.Text())
+		}
+		// Keep draining so the command never blocks on a full pipe
+		io.Copy(io.Discard, reader)
+	}()
+
+	err := cmd.Run()
+	writer.Close()
+	<-done
+
+	if ctx.Err() != nil {
+		return -1, fmt.Errorf("%s: %w", name, ctx.Err())
+	}
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode(), err
+		}
+		return -1, err
+	}
+	return 0, nil
+}
+
+// scanOutputLines is a bufio.SplitFunc splitting at newlines and carriage
+// returns, dropping empty lines
+func scanOutputLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := 0
+	for start < len(data) && (data[start] == '\n' || data[start] == '\r') {
+		start++
+	}
+	for i := start; i < len(data); i++ {
+		if data[i] == '\n' || data[i] == '\r' {
+			return i + 1, data[start:i], nil
+		}
+	}
+	if atEOF && start < len(data) {
+		return len(data), data[start:], nil
+	}
+	return start, nil, nil
+}
+
+// nonInteractive is set by SetNonInteractive
+var nonInteractive bool
+
+// SetNonInteractive disables prompts for scripts and CI, where nobody is
+// around to answer them. PromptYesNo then answers no without reading stdin.
+func SetNonInteractive(enabled bool) {
+	nonInteractive = enabled
+}
+
+// IsNonInteractive reports whether prompts are disabled
+func IsNonInteractive() bool {
+	return nonInteractive
+}
+
+// assumeYes is set by SetAssumeYes
+var assumeYes bool
+
+// SetAssumeYes makes PromptYesNo answer yes without reading stdin, unless
+// prompts are disabled with SetNonInteractive, which wins
+func SetAssumeYes(enabled bool) {
+	assumeYes = enabled
+}
+
+// IsAssumeYes reports whether PromptYesNo answers yes by itself
+func IsAssumeYes() bool {
+	return assumeYes
+}
+
 // PromptYesNo asks the user for a yes/no answer
 func PromptYesNo(question string) bool {
+	if nonInteractive {
+		Logger.Info().Msgf("%s [y/n]: n (non-interactive)", question)
+		return false
+	}
+	if assumeYes {
+		Logger.Info().Msgf("%s [y/n]: y (--yes)", question)
+		return true
+	}
+
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		fmt.Printf("%s [y/n]: ", question)
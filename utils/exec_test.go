@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStreamCommand(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The command only goes on once the test saw its first line, so it
+	// would never finish if the output was delivered at the end
+	flag := filepath.Join(t.TempDir(), "seen")
+	var lines []string
+	opts := StreamOptions{OnLine: func(line string) {
+		lines = append(lines, line)
+		if line == "first" {
+			if err := os.WriteFile(flag, nil, 0644); err != nil {
+				t.Error(err)
+			}
+		}
+	}}
+	script := `echo first; while [ ! -e "$1" ]; do sleep 0.01; done; echo second >&2; printf '10%%\r20%%\r\n\nlast'; exit 3`
+	code, err := StreamCommandWithOptions(ctx, opts, "sh", "-c", script, "sh", flag)
+	if ctx.Err() != nil {
+		t.Fatal("the first line wasn't delivered while the command was running")
+	}
+	if code != 3 || err == nil {
+		t.Errorf("exit code %d, %v, want 3 and an error", code, err)
+	}
+	if want := []string{"first", "second", "10%", "20%", "last"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines %q, want %q", lines, want)
+	}
+}
+
+func TestStreamCommandCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := StreamOptions{OnLine: func(line string) { cancel() }}
+
+	start := time.Now()
+	code, err := StreamCommandWithOptions(ctx, opts, "sh", "-c", "echo started; sleep 10")
+	if !errors.Is(err, context.Canceled) || code != -1 {
+		t.Errorf("exit code %d, %v, want -1 and context.Canceled", code, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("canceling took %v", elapsed)
+	}
+}
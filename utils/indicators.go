@@ -7,8 +7,13 @@ import (
         "strings"
         "sync"
         "time"
+
+        "golang.org/x/term"
 )
 
+// defaultTerminalWidth is assumed when the width of the output can't be found
+const defaultTerminalWidth = 80
+
 // ProgressStyle defines the visual style for an animated progress indicator
 type ProgressStyle int
 
@@ -37,9 +42,22 @@ type ProgressIndicator struct {
         active      bool
         progressPct int // Only used for Bar style
         state       ProgressState // Current state (Normal, Success, Warning, Error, Info)
+        autoSuccess bool          // Bar style: turn to Success at 100%, see SetAutoSuccess
+        autoSet     bool          // Whether state was set to Success by reaching 100%
+        width       int           // Terminal width to fit frames into, detected when 0
+        lastWidth   int           // Widest frame drawn so far, cleared when stopping
+        lastLine    string        // Frame drawn last, not drawn again while unchanged
+        started     time.Time     // When the animation started, frames advance from it
+        renderer    *renderer     // Draws the indicator with the other operations of an OperationManager, nil when it draws itself
         mutex       sync.Mutex
 }
 
+// running are the indicators started and not stopped yet, see StopIndicators
+var (
+        running      = make(map[*ProgressIndicator]bool)
+        runningMutex sync.Mutex
+)
+
 // NewProgressIndicator creates a new progress indicator with the specified style
 func NewProgressIndicator(message string, style ProgressStyle) *ProgressIndicator {
         return &ProgressIndicator{
@@ -60,28 +78,45 @@ func (p *ProgressIndicator) Start() {
                 return
         }
         p.active = true
+        p.started = time.Now()
         p.mutex.Unlock()
 
-        go func() {
-                switch p.style {
-                case Spinner:
-                        p.runSpinner()
-                case Bar:
-                        p.runBar()
-                case Bounce:
-                        p.runBounce()
-                case Dots:
-                        p.runDots()
-                case Pulse:
-                        p.runPulse()
-                case Rainbow:
-                        p.runRainbow()
-                }
-        }()
+        runningMutex.Lock()
+        running[p] = true
+        runningMutex.Unlock()
+
+        if p.renderer != nil {
+                p.renderer.add(p)
+                return
+        }
+        go p.run()
 }
 
-// Stop ends the progress animation
+// Stop ends the progress animation and replaces it with a line recording the
+// outcome: a glyph for the current state followed by the message, e.g.
+// "✓ Pulled changes". In the Normal state there is no outcome to record and
+// the line is just cleared.
 func (p *ProgressIndicator) Stop() {
+        p.stop(true)
+}
+
+// StopWithResult sets the final state and message, then stops like Stop
+func (p *ProgressIndicator) StopWithResult(state ProgressState, message string) {
+        p.mutex.Lock()
+        p.state = state
+        p.message = message
+        p.mutex.Unlock()
+        p.stop(true)
+}
+
+// StopSilent ends the progress animation and clears its line without leaving
+// a result behind
+func (p *ProgressIndicator) StopSilent() {
+        p.stop(false)
+}
+
+// stop ends the animation, optionally printing the result line
+func (p *ProgressIndicator) stop(printResult bool) {
         p.stopOnce.Do(func() {
                 p.mutex.Lock()
                 if !p.active {
@@ -89,13 +124,108 @@ func (p *ProgressIndicator) Stop() {
                         return
                 }
                 p.active = false
+                result := ""
+                if glyph := stateGlyph(p.state); glyph != "" && printResult {
+                        result = fmt.Sprintf("%s%s%s %s\n", GetColorForState(p.state), glyph, colorCode(Reset), p.message)
+                }
                 p.mutex.Unlock()
-                p.done <- true
-                // Clear the line after stopping
-                fmt.Fprintf(p.output, "\r%s\r", strings.Repeat(" ", 80))
+                close(p.done)
+
+                runningMutex.Lock()
+                delete(running, p)
+                runningMutex.Unlock()
+
+                if p.renderer != nil {
+                        p.renderer.remove(p, result)
+                        return
+                }
+
+                // Clear the columns the frames used
+                p.mutex.Lock()
+                defer p.mutex.Unlock()
+                fmt.Fprintf(p.output, "\r%s\r%s", strings.Repeat(" ", p.lastWidth), result)
         })
 }
 
+// StopIndicators stops every running indicator, clearing its line without a
+// result, and makes sure the cursor is visible, for when dotpilot is
+// interrupted in the middle of an operation
+func StopIndicators() {
+        runningMutex.Lock()
+        indicators := make([]*ProgressIndicator, 0, len(running))
+        for p := range running {
+                indicators = append(indicators, p)
+        }
+        runningMutex.Unlock()
+
+        for _, p := range indicators {
+                p.StopSilent()
+        }
+        if IsTerminal() {
+                fmt.Fprint(os.Stdout, "\x1b[?25h")
+        }
+}
+
+// stateGlyph returns the symbol a result line starts with for state, or "" for
+// the Normal state
+func stateGlyph(state ProgressState) string {
+        switch state {
+        case Success:
+                return "✓"
+        case Warning:
+                return "⚠"
+        case Error:
+                return "✗"
+        case Info:
+                return "ℹ"
+        default:
+                return ""
+        }
+}
+
+// terminalWidth returns the number of columns of the terminal the indicator
+// writes to
+func (p *ProgressIndicator) terminalWidth() int {
+        if p.width > 0 {
+                return p.width
+        }
+        if f, ok := p.output.(*os.File); ok {
+                if width, _, err := term.GetSize(int(f.Fd())); err == nil && width > 0 {
+                        return width
+                }
+        }
+        return defaultTerminalWidth
+}
+
+// line returns the message between prefix and suffix, truncated so the frame
+// fits on one line, as a wrapped line can't be redrawn or cleared. Must be
+// called with the mutex held.
+func (p *ProgressIndicator) line(prefix, suffix string) string {
+        // The last column is left free, some terminals wrap once it is written
+        room := p.terminalWidth() - 1 - DisplayWidth(prefix) - DisplayWidth(suffix)
+        return prefix + TruncateToWidth(p.message, room) + suffix
+}
+
+// render draws a frame of the animation over the previous one, unless it is
+// the same. Must be called with the mutex held.
+func (p *ProgressIndicator) render(prefix, suffix string) {
+        line := p.line(prefix, suffix)
+        if line == p.lastLine {
+                return
+        }
+        p.lastLine = line
+
+        // Overwrite what is left of a wider earlier frame
+        used := DisplayWidth(line)
+        padding := ""
+        if used < p.lastWidth {
+                padding = strings.Repeat(" ", p.lastWidth-used)
+        } else {
+                p.lastWidth = used
+        }
+        fmt.Fprintf(p.output, "\r%s%s", line, padding)
+}
+
 // UpdateProgress updates the progress percentage (mainly for Bar style)
 // This method can be called with either UpdateProgress(percent) or UpdateProgress(current, total)
 func (p *ProgressIndicator) UpdateProgress(args ...int) {
@@ -124,6 +254,33 @@ func (p *ProgressIndicator) UpdateProgress(args ...int) {
         }
         
         p.progressPct = percent
+        p.completeIfDone()
+}
+
+// SetAutoSuccess makes a bar turn to the Success state, green with a ✓, once
+// its progress reaches 100%, so the caller doesn't have to. A state set with
+// SetState, like Warning or Error, is left alone.
+func (p *ProgressIndicator) SetAutoSuccess(enabled bool) {
+        p.mutex.Lock()
+        defer p.mutex.Unlock()
+        p.autoSuccess = enabled
+        p.completeIfDone()
+}
+
+// completeIfDone moves a bar with auto success from the Normal to the Success
+// state at 100%, and back if its progress drops again. Must be called with the
+// mutex held.
+func (p *ProgressIndicator) completeIfDone() {
+        if !p.autoSuccess || p.style != Bar {
+                return
+        }
+        if p.progressPct == 100 && p.state == Normal {
+                p.state = Success
+                p.autoSet = true
+        } else if p.progressPct < 100 && p.autoSet {
+                p.state = Normal
+                p.autoSet = false
+        }
 }
 
 // SetMessage updates the message displayed with the progress indicator
@@ -138,199 +295,93 @@ func (p *ProgressIndicator) SetState(state ProgressState) {
         p.mutex.Lock()
         defer p.mutex.Unlock()
         p.state = state
+        p.autoSet = false
 }
 
-// runSpinner displays a spinning animation
-func (p *ProgressIndicator) runSpinner() {
-        frames := []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
-        interval := 100 * time.Millisecond
-        i := 0
-        
-        for {
-                select {
-                case <-p.done:
-                        return
-                default:
-                        p.mutex.Lock()
-                        if !p.active {
-                                p.mutex.Unlock()
-                                return
-                        }
-                        
-                        frame := frames[i%len(frames)]
-                        color := GetColorForState(p.state)
-                        fmt.Fprintf(p.output, "\r%s%s%s %s", color, frame, Reset, p.message)
-                        p.mutex.Unlock()
-                        
-                        time.Sleep(interval)
-                        i++
-                }
+// interval returns how often the animation of style advances a frame
+func (style ProgressStyle) interval() time.Duration {
+        if style == Dots {
+                return 300 * time.Millisecond
         }
+        return 100 * time.Millisecond
 }
 
-// runBar displays a progress bar
-func (p *ProgressIndicator) runBar() {
-        barWidth := 20
-        interval := 100 * time.Millisecond
-        
-        for {
-                select {
-                case <-p.done:
-                        return
-                default:
-                        p.mutex.Lock()
-                        if !p.active {
-                                p.mutex.Unlock()
-                                return
-                        }
-                        
-                        progress := p.progressPct
-                        filled := barWidth * progress / 100
-                        unfilled := barWidth - filled
-                        
-                        color := GetColorForState(p.state)
-                        bar := "[" + color + strings.Repeat("=", filled) + Reset + strings.Repeat(" ", unfilled) + "]"
-                        
-                        // Add colored percentage based on state
-                        percentStr := fmt.Sprintf("%s%d%%%s", color, progress, Reset)
-                        
-                        fmt.Fprintf(p.output, "\r%s %s %s", bar, p.message, percentStr)
-                        p.mutex.Unlock()
-                        
-                        time.Sleep(interval)
-                }
-        }
+// frameNumber returns the frame of the animation due now. Must be called with
+// the mutex held.
+func (p *ProgressIndicator) frameNumber() int {
+        return int(time.Since(p.started) / p.style.interval())
 }
 
-// runBounce displays a bouncing animation
-func (p *ProgressIndicator) runBounce() {
-        width := 20
-        pos := 0
-        direction := 1
-        interval := 100 * time.Millisecond
-        
-        for {
-                select {
-                case <-p.done:
-                        return
-                default:
-                        p.mutex.Lock()
-                        if !p.active {
-                                p.mutex.Unlock()
-                                return
-                        }
-                        
-                        color := GetColorForState(p.state)
-                        line := strings.Repeat(" ", width)
-                        runes := []rune(line)
-                        
-                        // Replace the position with a colored ball
-                        runes[pos] = '⚫'
-                        line = string(runes)
-                        
-                        fmt.Fprintf(p.output, "\r[%s%s%s] %s", color, line, Reset, p.message)
+// run draws the animation of an indicator that draws itself until it is
+// stopped
+func (p *ProgressIndicator) run() {
+        ticker := time.NewTicker(p.style.interval())
+        defer ticker.Stop()
+
+        for n := 0; ; n++ {
+                p.mutex.Lock()
+                if !p.active {
                         p.mutex.Unlock()
-                        
-                        if pos == width-1 {
-                                direction = -1
-                        } else if pos == 0 {
-                                direction = 1
-                        }
-                        pos += direction
-                        
-                        time.Sleep(interval)
+                        return
                 }
-        }
-}
+                p.render(p.frame(n))
+                p.mutex.Unlock()
 
-// runDots displays animated dots
-func (p *ProgressIndicator) runDots() {
-        max := 5
-        i := 0
-        interval := 300 * time.Millisecond
-        
-        for {
                 select {
                 case <-p.done:
                         return
-                default:
-                        p.mutex.Lock()
-                        if !p.active {
-                                p.mutex.Unlock()
-                                return
-                        }
-                        
-                        color := GetColorForState(p.state)
-                        dots := strings.Repeat(".", i)
-                        
-                        // Colorize the dots
-                        coloredDots := color + dots + Reset
-                        
-                        fmt.Fprintf(p.output, "\r%s%s%s", p.message, coloredDots, strings.Repeat(" ", max-i))
-                        p.mutex.Unlock()
-                        
-                        i = (i + 1) % (max + 1)
-                        
-                        time.Sleep(interval)
+                case <-ticker.C:
                 }
         }
 }
 
-// runPulse displays a pulsing animation that changes intensity
-func (p *ProgressIndicator) runPulse() {
-        symbols := []string{"▁", "▂", "▃", "▄", "▅", "▆", "▇", "█", "▇", "▆", "▅", "▄", "▃", "▂"}
-        interval := 100 * time.Millisecond
-        i := 0
-        
-        for {
-                select {
-                case <-p.done:
-                        return
-                default:
-                        p.mutex.Lock()
-                        if !p.active {
-                                p.mutex.Unlock()
-                                return
-                        }
-                        
-                        color := GetColorForState(p.state)
-                        symbol := symbols[i%len(symbols)]
-                        
-                        fmt.Fprintf(p.output, "\r%s%s%s %s", color, symbol, Reset, p.message)
-                        p.mutex.Unlock()
-                        
-                        time.Sleep(interval)
-                        i++
+// frame returns what goes before and after the message in frame n of the
+// animation. Only a bar doesn't move, it changes with the progress. Must be
+// called with the mutex held.
+func (p *ProgressIndicator) frame(n int) (prefix, suffix string) {
+        color := GetColorForState(p.state)
+        switch p.style {
+        case Spinner:
+                frames := []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+                return color + frames[n%len(frames)] + colorCode(Reset) + " ", ""
+
+        case Bar:
+                barWidth := 20
+                filled := barWidth * p.progressPct / 100
+                bar := "[" + color + strings.Repeat("=", filled) + colorCode(Reset) + strings.Repeat(" ", barWidth-filled) + "]"
+
+                // Add colored percentage based on state, and a ✓ once a complete
+                // bar succeeded
+                percentStr := fmt.Sprintf("%s%d%%%s", color, p.progressPct, colorCode(Reset))
+                if p.progressPct == 100 && p.state == Success {
+                        percentStr += " " + color + stateGlyph(Success) + colorCode(Reset)
                 }
-        }
-}
+                return bar + " ", " " + percentStr
 
-// runRainbow displays a rainbow animation with cycling colors
-func (p *ProgressIndicator) runRainbow() {
-        colors := []string{Red, Yellow, Green, Cyan, Blue, Purple}
-        symbol := "◆"
-        interval := 100 * time.Millisecond
-        i := 0
-        
-        for {
-                select {
-                case <-p.done:
-                        return
-                default:
-                        p.mutex.Lock()
-                        if !p.active {
-                                p.mutex.Unlock()
-                                return
-                        }
-                        
-                        // Cycle through colors regardless of state
-                        color := colors[i%len(colors)]
-                        
-                        fmt.Fprintf(p.output, "\r%s%s%s %s", color, symbol, Reset, p.message)
-                        p.mutex.Unlock()
-                        
-                        time.Sleep(interval)
-                        i++
+        case Bounce:
+                // The ball goes right and back
+                width := 20
+                pos := n % (2 * (width - 1))
+                if pos >= width {
+                        pos = 2*(width-1) - pos
                 }
+                runes := []rune(strings.Repeat(" ", width))
+                runes[pos] = '⚫'
+                return "[" + color + string(runes) + colorCode(Reset) + "] ", ""
+
+        case Dots:
+                max := 5
+                i := n % (max + 1)
+                return "", color + strings.Repeat(".", i) + colorCode(Reset) + strings.Repeat(" ", max-i)
+
+        case Pulse:
+                symbols := []string{"▁", "▂", "▃", "▄", "▅", "▆", "▇", "█", "▇", "▆", "▅", "▄", "▃", "▂"}
+                return color + symbols[n%len(symbols)] + colorCode(Reset) + " ", ""
+
+        case Rainbow:
+                // Cycle through colors regardless of state
+                colors := []string{Red, Yellow, Green, Cyan, Blue, Purple}
+                return colorCode(colors[n%len(colors)]) + "◆" + colorCode(Reset) + " ", ""
         }
-}
\ No newline at end of file
+        return "", ""
+}
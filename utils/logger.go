@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"io"
 	"os"
 
 	"github.com/rs/zerolog"
@@ -9,10 +10,24 @@ import (
 // Logger is the global logger instance
 var Logger zerolog.Logger
 
+// logOutput is where Logger writes to, see SetLogOutput
+var logOutput io.Writer = os.Stdout
+
 func init() {
 	// Initialize logger
-	output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: "15:04:05"}
-	Logger = zerolog.New(output).With().Timestamp().Logger().Level(zerolog.InfoLevel)
+	Logger = newLogger(colorEnabled).Level(zerolog.InfoLevel)
+}
+
+// newLogger creates the console logger, with or without ANSI colors
+func newLogger(color bool) zerolog.Logger {
+	output := zerolog.ConsoleWriter{Out: logOutput, TimeFormat: "15:04:05", NoColor: !color}
+	return zerolog.New(output).With().Timestamp().Logger()
+}
+
+// SetLogOutput redirects the log messages to w, keeping the level and color mode
+func SetLogOutput(w io.Writer) {
+	logOutput = w
+	Logger = newLogger(colorEnabled).Level(Logger.GetLevel())
 }
 
 // SetLogLevel sets the logging level
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+// rename is os.Rename, replaced in tests to simulate renames across
+// filesystems
+var rename = os.Rename
+
+// errNotSameDevice is ERROR_NOT_SAME_DEVICE, which Windows returns instead of
+// EXDEV for a rename across volumes
+const errNotSameDevice = syscall.Errno(17)
+
+// MoveFile moves src to dst like os.Rename. os.Rename fails when src and dst
+// are on different filesystems, for example when ~/.dotpilot is on another
+// mount than the home directory; MoveFile then copies src to dst, keeping
+// modes and modification times and recreating symlinks, and removes src.
+// Directories are moved recursively. If the copy fails, the partial copy is
+// removed and src is left alone.
+func MoveFile(src, dst string) error {
+	err := rename(src, dst)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+
+	Logger.Debug().Msgf("%s and %s are on different filesystems, copying instead of renaming", src, dst)
+	if err := CopyTree(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// isCrossDevice reports whether err is a rename failing because source and
+// destination are on different filesystems
+func isCrossDevice(err error) bool {
+	if errors.Is(err, syscall.EXDEV) {
+		return true
+	}
+	var errno syscall.Errno
+	return runtime.GOOS == "windows" && errors.As(err, &errno) && errno == errNotSameDevice
+}
+
+// CopyTree copies the file or directory src to dst, which must not exist,
+// keeping modes and modification times and recreating symlinks
+func CopyTree(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, dst)
+	case info.IsDir():
+		if err := os.Mkdir(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := CopyTree(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+				return err
+			}
+		}
+	default:
+		if err := copyRegularFile(src, dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// copyRegularFile copies the content of src to a new file dst with mode
+func copyRegularFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// crossDevice makes rename fail like it does across filesystems
+func crossDevice(t *testing.T) {
+	t.Helper()
+
+	rename = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	t.Cleanup(func() { rename = os.Rename })
+}
+
+func TestMoveFileAcrossDevices(t *testing.T) {
+	crossDevice(t)
+	dir := t.TempDir()
+
+	// A file, a symlink and a directory holding both
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "config"), []byte("data\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/config", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "sub", "config"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if err := MoveFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(src); !os.IsNotExist(err) {
+		t.Errorf("%s still exists after the move", src)
+	}
+	info, err := os.Stat(filepath.Join(dst, "sub", "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 || !info.ModTime().Equal(modTime) {
+		t.Errorf("config has mode %v and time %v, want 0600 and %v", info.Mode().Perm(), info.ModTime(), modTime)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "sub", "config")); err != nil || string(data) != "data\n" {
+		t.Errorf("config = %q, %v", data, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "link")); err != nil || link != "sub/config" {
+		t.Errorf("link = %q, %v, want sub/config", link, err)
+	}
+}
+
+func TestMoveFileKeepsSourceOnFailure(t *testing.T) {
+	crossDevice(t)
+	dir := t.TempDir()
+
+	src := filepath.Join(dir, "config")
+	if err := os.WriteFile(src, []byte("data\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The destination directory doesn't exist, so the copy fails
+	if err := MoveFile(src, filepath.Join(dir, "missing", "config")); err == nil {
+		t.Fatal("MoveFile succeeded without a destination directory")
+	}
+	if data, err := os.ReadFile(src); err != nil || string(data) != "data\n" {
+		t.Errorf("source was lost: %q, %v", data, err)
+	}
+}
+
+func TestMoveFileOtherErrors(t *testing.T) {
+	rename = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EACCES}
+	}
+	defer func() { rename = os.Rename }()
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "config")
+	if err := os.WriteFile(src, []byte("data\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only cross-device failures fall back to copying
+	if err := MoveFile(src, filepath.Join(dir, "moved")); err == nil {
+		t.Fatal("MoveFile hid a permission error")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "moved")); !os.IsNotExist(err) {
+		t.Errorf("MoveFile copied after a permission error")
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+        "os"
         "time"
 )
 
@@ -32,12 +33,26 @@ func (op *Operation) Start() {
         op.Progress.Start()
 }
 
-// Stop ends the operation and progress tracking
+// Stop ends the operation and progress tracking, leaving a line with the
+// outcome of the current state, see ProgressIndicator.Stop
 func (op *Operation) Stop() {
         op.Progress.Stop()
         op.Done = true
 }
 
+// StopWithResult ends the operation with a final state and message
+func (op *Operation) StopWithResult(state ProgressState, message string) {
+        op.Description = message
+        op.Progress.StopWithResult(state, message)
+        op.Done = true
+}
+
+// StopSilent ends the operation without leaving a result line
+func (op *Operation) StopSilent() {
+        op.Progress.StopSilent()
+        op.Done = true
+}
+
 // UpdateProgress updates the operation's progress
 func (op *Operation) UpdateProgress(current, total int) {
         op.Current = current
@@ -64,6 +79,12 @@ func (op *Operation) SetState(state ProgressState) {
         op.Progress.SetState(state)
 }
 
+// SetAutoSuccess makes the operation's bar turn to the Success state once it
+// is complete, see ProgressIndicator.SetAutoSuccess
+func (op *Operation) SetAutoSuccess(enabled bool) {
+        op.Progress.SetAutoSuccess(enabled)
+}
+
 // SimulateProgress simulates progress for operations that don't report actual progress
 func (op *Operation) SimulateProgress(seconds int) {
         go func() {
@@ -90,21 +111,28 @@ func (op *Operation) SimulateProgress(seconds int) {
         }()
 }
 
-// OperationManager manages multiple operations
+// OperationManager manages multiple operations. Its running operations are
+// drawn together, one line each, see renderer.
 type OperationManager struct {
         Operations []*Operation
+        renderer   *renderer
 }
 
-// NewOperationManager creates a new operation manager
+// NewOperationManager creates a new operation manager drawing to stdout
 func NewOperationManager() *OperationManager {
         return &OperationManager{
                 Operations: make([]*Operation, 0),
+                renderer:   newRenderer(os.Stdout),
         }
 }
 
 // AddOperation adds a new operation to the manager
 func (om *OperationManager) AddOperation(name, description string, style ProgressStyle) *Operation {
         op := NewOperation(name, description, style)
+        if om.renderer != nil {
+                op.Progress.renderer = om.renderer
+                op.Progress.output = om.renderer.output
+        }
         om.Operations = append(om.Operations, op)
         return op
 }
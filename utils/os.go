@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
 	"runtime"
@@ -90,3 +91,44 @@ func detectLinuxDistro() OSInfo {
 
 	return info
 }
+
+// InstallHint returns a short, OS-specific instruction for installing one of
+// the external tools dotpilot shells out to (gpg, sops)
+func InstallHint(tool string) string {
+	info := GetOSInfo()
+
+	switch tool {
+	case "gpg":
+		switch info.PackageManager {
+		case "brew":
+			return "install it with: brew install gnupg"
+		case "apt":
+			return "install it with: sudo apt-get install gnupg"
+		case "dnf":
+			return "install it with: sudo dnf install gnupg2"
+		case "pacman", "yay":
+			return "install it with: sudo pacman -S gnupg"
+		case "zypper":
+			return "install it with: sudo zypper install gpg2"
+		}
+		if runtime.GOOS == "windows" {
+			return "install Gpg4win from https://gpg4win.org"
+		}
+		return "see https://gnupg.org/download/"
+	case "sops":
+		switch info.PackageManager {
+		case "brew":
+			return "install it with: brew install sops"
+		case "pacman":
+			return "install it with: sudo pacman -S sops"
+		case "yay":
+			return "install it with: yay -S sops"
+		}
+		if runtime.GOOS == "windows" {
+			return "install it with: choco install sops"
+		}
+		return "download a release from https://github.com/getsops/sops/releases"
+	}
+
+	return fmt.Sprintf("please install %s", tool)
+}
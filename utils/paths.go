@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// ErrBareHome is returned by ExpandHome for a path that is only ~, which
+// would make a command act on the whole home directory
+var ErrBareHome = errors.New("~ on its own is the whole home directory")
+
+// ErrEmptyPath is returned by ExpandHome for an empty path, which would
+// resolve to the working directory
+var ErrEmptyPath = errors.New("empty path")
+
+// ExpandHome expands a leading ~/ in path to home. A path without a leading ~
+// is returned as it is. An empty or blank path fails with ErrEmptyPath, a bare
+// ~ with ErrBareHome, and ~user, the home directory of another user, isn't
+// supported.
+func ExpandHome(home, path string) (string, error) {
+	if strings.TrimSpace(path) == "" {
+		return "", fmt.Errorf("%w, name a file or directory", ErrEmptyPath)
+	}
+	if !strings.HasPrefix(path, "~") {
+		return path, nil
+	}
+
+	rest := path[1:]
+	if strings.Trim(rest, `/`+string(os.PathSeparator)) == "" {
+		return "", fmt.Errorf("%w, name a file or directory in it like ~/.bashrc", ErrBareHome)
+	}
+	if rest[0] != '/' && !(runtime.GOOS == "windows" && rest[0] == '\\') {
+		return "", fmt.Errorf("%s: ~user paths aren't supported, use the full path", path)
+	}
+	return filepath.Join(home, rest), nil
+}
@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpandHome(t *testing.T) {
+	home := filepath.Join("/home", "some user")
+
+	tests := []struct {
+		path, want string
+	}{
+		{"~/.bashrc", filepath.Join(home, ".bashrc")},
+		{"~/My Documents/notes", filepath.Join(home, "My Documents", "notes")},
+		{"/etc/hosts", "/etc/hosts"},
+		{"relative/~", "relative/~"},
+	}
+	for _, tt := range tests {
+		if got, err := ExpandHome(home, tt.path); err != nil || got != tt.want {
+			t.Errorf("ExpandHome(%q) = %q, %v, want %q", tt.path, got, err, tt.want)
+		}
+	}
+
+	for _, path := range []string{"~", "~/", "~//"} {
+		if _, err := ExpandHome(home, path); !errors.Is(err, ErrBareHome) {
+			t.Errorf("ExpandHome(%q) = %v, want ErrBareHome", path, err)
+		}
+	}
+	for _, path := range []string{"", " ", "\t"} {
+		if _, err := ExpandHome(home, path); !errors.Is(err, ErrEmptyPath) {
+			t.Errorf("ExpandHome(%q) = %v, want ErrEmptyPath", path, err)
+		}
+	}
+	if got, err := ExpandHome(home, "~root/.bashrc"); err == nil {
+		t.Errorf("ExpandHome(~root/.bashrc) = %q, want an error", got)
+	}
+}
@@ -2,8 +2,12 @@ package utils
 
 import (
 	"bytes"
+	"fmt"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 // TestProgressIndicatorTypes verifies that all progress indicator types can be created and used
@@ -83,4 +87,242 @@ func TestOperationManager(t *testing.T) {
 	op2.Stop()
 	
 	t.Log("Operation manager test completed successfully")
-}
\ No newline at end of file
+}
+// TestStopLeavesResultLine verifies that Stop replaces the animation with the outcome
+func TestStopLeavesResultLine(t *testing.T) {
+	SetColorMode(true, false)
+	defer SetColorMode(false, false)
+
+	tests := []struct {
+		name string
+		stop func(p *ProgressIndicator)
+		want string
+	}{
+		{"StopWithResult", func(p *ProgressIndicator) { p.StopWithResult(Success, "Pulled changes") }, "✓ Pulled changes\n"},
+		{"Stop", func(p *ProgressIndicator) { p.SetState(Error); p.Stop() }, "✗ Pulling...\n"},
+		{"StopNormal", func(p *ProgressIndicator) { p.Stop() }, ""},
+		{"StopSilent", func(p *ProgressIndicator) { p.SetState(Warning); p.StopSilent() }, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			indicator := NewProgressIndicator("Pulling...", Spinner)
+			indicator.output = &buf
+
+			indicator.Start()
+			time.Sleep(50 * time.Millisecond)
+			tt.stop(indicator)
+
+			// Everything before the last carriage return is the cleared animation
+			out := buf.String()
+			final := out[strings.LastIndex(out, "\r")+1:]
+			if final != tt.want {
+				t.Errorf("final line = %q, want %q", final, tt.want)
+			}
+		})
+	}
+}
+
+// TestLongMessageFitsTerminal verifies that frames are truncated to the terminal width
+func TestLongMessageFitsTerminal(t *testing.T) {
+	var buf bytes.Buffer
+	message := "Synchronisiere Konfigurationsdateien für 日本語のマシン und ünïcödé"
+	indicator := NewProgressIndicator(message, Bar)
+	indicator.output = &buf
+	indicator.width = 30
+
+	indicator.Start()
+	time.Sleep(150 * time.Millisecond)
+	indicator.StopSilent()
+
+	frames := strings.Split(buf.String(), "\r")
+	clear := frames[len(frames)-2]
+	for _, frame := range frames[1 : len(frames)-2] {
+		if !utf8.ValidString(frame) {
+			t.Errorf("frame splits a character: %q", frame)
+		}
+		if width := DisplayWidth(frame); width > 29 {
+			t.Errorf("frame is %d columns wide: %q", width, frame)
+		}
+		if !strings.Contains(frame, "…") {
+			t.Errorf("frame isn't truncated: %q", frame)
+		}
+	}
+	if clear != strings.Repeat(" ", 29) {
+		t.Errorf("cleared %q, want the 29 columns the frames used", clear)
+	}
+}
+
+func TestTruncateToWidth(t *testing.T) {
+	tests := []struct {
+		s     string
+		width int
+		want  string
+	}{
+		{"short", 10, "short"},
+		{"exactly ten", 11, "exactly ten"},
+		{"a longer message", 8, "a longe…"},
+		{"ünïcödé text", 5, "ünïc…"},
+		{"日本語のテキスト", 7, "日本語…"},
+		{"anything", 0, ""},
+	}
+	for _, tt := range tests {
+		got := TruncateToWidth(tt.s, tt.width)
+		if got != tt.want || DisplayWidth(got) > tt.width {
+			t.Errorf("TruncateToWidth(%q, %d) = %q, want %q", tt.s, tt.width, got, tt.want)
+		}
+	}
+	if width := DisplayWidth("\x1b[32m✓\x1b[0m done"); width != 6 {
+		t.Errorf("DisplayWidth counted color codes: %d", width)
+	}
+}
+
+// TestBarAutoSuccess verifies that a bar with auto success turns green with a
+// ✓ once complete, and leaves a state set by the caller alone
+func TestBarAutoSuccess(t *testing.T) {
+	SetColorMode(true, false)
+	defer SetColorMode(false, false)
+
+	var buf bytes.Buffer
+	indicator := NewProgressIndicator("Installing", Bar)
+	indicator.output = &buf
+	indicator.SetAutoSuccess(true)
+
+	indicator.UpdateProgress(3, 4)
+	if indicator.state != Normal {
+		t.Errorf("state at 75%% = %v, want Normal", indicator.state)
+	}
+	indicator.Start()
+	indicator.UpdateProgress(100)
+	time.Sleep(150 * time.Millisecond)
+	indicator.mutex.Lock()
+	frame := buf.String()
+	frame = frame[strings.LastIndex(frame, "\r")+1:]
+	indicator.mutex.Unlock()
+	if indicator.state != Success || !strings.Contains(frame, "100%"+colorCode(Reset)+" "+GetColorForState(Success)+"✓") {
+		t.Errorf("state %v, frame %q, want Success with a ✓", indicator.state, frame)
+	}
+	indicator.Stop()
+	if out := buf.String(); !strings.HasSuffix(out, "✓"+colorCode(Reset)+" Installing\n") {
+		t.Errorf("final line of %q isn't a success", out)
+	}
+
+	// Dropping below 100% undoes it, a state set by the caller stays
+	indicator = NewProgressIndicator("Installing", Bar)
+	indicator.SetAutoSuccess(true)
+	indicator.UpdateProgress(100)
+	indicator.UpdateProgress(50)
+	if indicator.state != Normal {
+		t.Errorf("state after dropping to 50%% = %v, want Normal", indicator.state)
+	}
+	indicator.SetState(Warning)
+	indicator.UpdateProgress(100)
+	if indicator.state != Warning {
+		t.Errorf("state = %v, want the Warning set by the caller", indicator.state)
+	}
+
+	// Without it the caller decides
+	indicator = NewProgressIndicator("Installing", Bar)
+	indicator.UpdateProgress(100)
+	if indicator.state != Normal {
+		t.Errorf("state without auto success = %v, want Normal", indicator.state)
+	}
+}
+
+// TestSharedRenderer verifies that the operations of a manager are drawn on
+// their own lines, and that unchanged lines aren't drawn again
+func TestSharedRenderer(t *testing.T) {
+	var buf bytes.Buffer
+	manager := &OperationManager{renderer: newRenderer(&buf)}
+	output := func() string {
+		manager.renderer.mutex.Lock()
+		defer manager.renderer.mutex.Unlock()
+		return buf.String()
+	}
+
+	bar := manager.AddOperation("apply", "Applying", Bar)
+	bar.Progress.width = 80
+	bar.UpdateProgress(1, 2)
+	bar.Start()
+	first := output()
+	if !strings.HasPrefix(first, "\r[") || !strings.HasSuffix(first, "Applying 50%\x1b[K") {
+		t.Fatalf("first frame = %q", first)
+	}
+
+	// A bar that doesn't progress isn't drawn again
+	time.Sleep(3 * frameInterval)
+	if out := output(); out != first {
+		t.Errorf("unchanged bar drawn again: %q", out[len(first):])
+	}
+
+	// A second operation gets its own line, the bar line is left alone
+	spinner := manager.AddOperation("pull", "Pulling", Spinner)
+	spinner.Start()
+	added := output()[len(first):]
+	if !strings.HasPrefix(added, "\n\r") || strings.Contains(added, "Applying") || !strings.Contains(added, "Pulling") {
+		t.Errorf("adding the spinner drew %q", added)
+	}
+
+	// The result of a stopped operation goes above the block
+	before := len(output())
+	bar.StopWithResult(Success, "Applied")
+	stopped := output()[before:]
+	if !strings.HasPrefix(stopped, "\x1b[1A\r\x1b[J✓ Applied\n\r") || !strings.Contains(stopped, "Pulling") {
+		t.Errorf("stopping the bar drew %q", stopped)
+	}
+
+	spinner.StopSilent()
+	if out := output(); !strings.HasSuffix(out, "\r\x1b[J") {
+		t.Errorf("stopping the last operation ended with %q", out[len(out)-10:])
+	}
+	manager.renderer.mutex.Lock()
+	if manager.renderer.done != nil || len(manager.renderer.active) != 0 {
+		t.Error("renderer still running")
+	}
+	manager.renderer.mutex.Unlock()
+}
+
+// countingWriter counts the writes made to it
+type countingWriter struct {
+	writes atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes.Add(1)
+	return len(p), nil
+}
+
+// BenchmarkIndicatorWrites compares the writes of indicators drawing
+// themselves with those of the shared renderer of a manager, for n
+// indicators running at once
+func BenchmarkIndicatorWrites(b *testing.B) {
+	styles := []ProgressStyle{Spinner, Bar, Bounce, Dots}
+	for _, n := range []int{1, 4, 16} {
+		for _, shared := range []bool{false, true} {
+			name := fmt.Sprintf("standalone/%d", n)
+			if shared {
+				name = fmt.Sprintf("shared/%d", n)
+			}
+			b.Run(name, func(b *testing.B) {
+				var out countingWriter
+				for i := 0; i < b.N; i++ {
+					manager := &OperationManager{}
+					if shared {
+						manager.renderer = newRenderer(&out)
+					}
+					for j := 0; j < n; j++ {
+						op := manager.AddOperation("op", "Working", styles[j%len(styles)])
+						op.Progress.output = &out
+						op.Progress.width = 80
+						op.UpdateProgress(j, n)
+					}
+					manager.StartAll()
+					time.Sleep(500 * time.Millisecond)
+					manager.StopAll()
+				}
+				b.ReportMetric(float64(out.writes.Load())/float64(b.N), "writes/op")
+			})
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// frameInterval is how often the renderer of an OperationManager draws
+const frameInterval = 60 * time.Millisecond
+
+// renderer draws the running indicators of an OperationManager, one line
+// each, in a block at the bottom of the output. Every frame is one buffered
+// write that only rewrites the lines that changed, instead of each indicator
+// drawing over the same line on its own timer. Stopped indicators leave their
+// result line above the block.
+type renderer struct {
+	output io.Writer
+	buf    *bufio.Writer
+	mutex  sync.Mutex
+	active []*ProgressIndicator
+	drawn  []string      // Lines of the block as drawn last
+	done   chan struct{} // Stops the frame loop, nil while it isn't running
+}
+
+// newRenderer returns a renderer drawing to output
+func newRenderer(output io.Writer) *renderer {
+	return &renderer{output: output, buf: bufio.NewWriter(output)}
+}
+
+// add starts drawing p
+func (r *renderer) add(p *ProgressIndicator) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.active = append(r.active, p)
+	if r.done == nil {
+		r.done = make(chan struct{})
+		go r.loop(r.done)
+	}
+	r.draw()
+}
+
+// remove stops drawing p and writes result, a line or "", above the block
+func (r *renderer) remove(p *ProgressIndicator, result string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i, active := range r.active {
+		if active == p {
+			r.active = append(r.active[:i], r.active[i+1:]...)
+			break
+		}
+	}
+
+	// Clear the block and draw the rest of it below the result
+	r.moveToBlock()
+	r.buf.WriteString("\r\x1b[J" + result)
+	r.drawn = nil
+	r.draw()
+	r.buf.Flush()
+
+	if len(r.active) == 0 && r.done != nil {
+		close(r.done)
+		r.done = nil
+	}
+}
+
+// loop draws a frame every frameInterval until done is closed
+func (r *renderer) loop(done chan struct{}) {
+	ticker := time.NewTicker(frameInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			r.mutex.Lock()
+			r.draw()
+			r.mutex.Unlock()
+		}
+	}
+}
+
+// moveToBlock moves the cursor to the first line of the block. Must be called
+// with the mutex held.
+func (r *renderer) moveToBlock() {
+	if len(r.drawn) > 1 {
+		fmt.Fprintf(r.buf, "\x1b[%dA", len(r.drawn)-1)
+	}
+}
+
+// draw redraws the lines of the block that changed since the last frame and
+// leaves the cursor at the end of the last one. Must be called with the mutex
+// held.
+func (r *renderer) draw() {
+	lines := make([]string, len(r.active))
+	changed := len(lines) != len(r.drawn)
+	for i, p := range r.active {
+		p.mutex.Lock()
+		lines[i] = p.line(p.frame(p.frameNumber()))
+		p.mutex.Unlock()
+		changed = changed || lines[i] != r.drawn[i]
+	}
+	if !changed {
+		return
+	}
+
+	r.moveToBlock()
+	for i, line := range lines {
+		if i > 0 {
+			r.buf.WriteString("\n")
+		}
+		if i < len(r.drawn) && r.drawn[i] == line {
+			continue
+		}
+		r.buf.WriteString("\r" + line + "\x1b[K")
+	}
+	r.drawn = lines
+	r.buf.Flush()
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"os"
+)
+
+// ShredFile overwrites a regular file with zeros before removing it, so
+// temporary plaintext such as decrypted secrets is not left behind in the
+// freed blocks. This is best-effort: copy-on-write and journaling filesystems,
+// SSDs with wear leveling and backups may still keep the old content. A
+// missing file is not an error. Symlinks and other non-regular files are
+// removed without being overwritten.
+func ShredFile(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode().IsRegular() {
+		if err := overwriteWithZeros(path, info.Size()); err != nil {
+			Logger.Debug().Err(err).Msgf("Failed to overwrite %s before removing it", path)
+		}
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// overwriteWithZeros writes size zero bytes over the start of path and flushes
+// them to disk
+func overwriteWithZeros(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zeros := make([]byte, 32*1024)
+	for written := int64(0); written < size; {
+		n := int64(len(zeros))
+		if size-written < n {
+			n = size - written
+		}
+		if _, err := f.Write(zeros[:n]); err != nil {
+			return err
+		}
+		written += n
+	}
+
+	return f.Sync()
+}
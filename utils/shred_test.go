@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShredFileRemovesFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "plaintext")
+	if err := ioutil.WriteFile(path, []byte("secret token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep a second name for the inode to check its content was overwritten
+	keep := filepath.Join(dir, "hardlink")
+	if err := os.Link(path, keep); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ShredFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("%s still exists: %v", path, err)
+	}
+
+	data, err := ioutil.ReadFile(keep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(make([]byte, len("secret token"))) {
+		t.Errorf("content = %q, want zeros", data)
+	}
+}
+
+func TestShredFileMissing(t *testing.T) {
+	if err := ShredFile(filepath.Join(t.TempDir(), "missing")); err != nil {
+		t.Errorf("ShredFile() of a missing file = %v, want nil", err)
+	}
+}
+
+func TestShredFileLeavesLinkTarget(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	if err := ioutil.WriteFile(target, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ShredFile(link); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(link); !os.IsNotExist(err) {
+		t.Errorf("link still exists: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(target); string(data) != "keep" {
+		t.Errorf("link target content = %q, want keep", data)
+	}
+}